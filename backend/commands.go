@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"golang.org/x/term"
+
+	"api/internal/model"
+	"api/internal/server"
+	"api/internal/store"
+)
+
+//exit codes of the commands, 2 is what the flag package exits with on bad usage too
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+const usage = `usage: api [command] [flags]
+
+commands:
+  serve                                        run the server, the default without a command
+  migrate                                      apply the pending database migrations and exit
+  user create -name NAME -email EMAIL [-role admin]
+  user list [-all]                             list the users, -all includes deactivated ones
+  user set-password -id ID                     set a password read from stdin, ends the sessions of the user
+
+the commands read the same environment as the server (DB_DRIVER, DATABASE_URL, ...) and work on the database directly,
+without going through the api. -json prints json instead of text
+`
+
+//runCommand runs the command in args and returns the exit code. flags without a command go to serve,
+//so the binary keeps starting the server like before there were commands
+func runCommand(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return serve(args)
+	}
+	switch args[0] {
+	case "serve":
+		return serve(args[1:])
+	case "migrate":
+		return migrateCommand(args[1:])
+	case "user":
+		return userCommand(args[1:])
+	case "help":
+		fmt.Print(usage)
+		return exitOK
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", args[0], usage)
+	return exitUsage
+}
+
+//userCommand runs one of the user subcommands
+func userCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return exitUsage
+	}
+	switch args[0] {
+	case "create":
+		return userCreate(args[1:])
+	case "list":
+		return userList(args[1:])
+	case "set-password":
+		return userSetPassword(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", "user "+args[0], usage)
+	return exitUsage
+}
+
+//parseFlags parses args into flags. ok is false when the command should stop, with code as its exit code
+func parseFlags(flags *flag.FlagSet, args []string) (code int, ok bool) {
+	err := flags.Parse(args)
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		return exitOK, false
+	case err != nil:
+		return exitUsage, false
+	case flags.NArg() > 0:
+		fmt.Fprintf(os.Stderr, "unexpected argument %q\n", flags.Arg(0))
+		return exitUsage, false
+	}
+	return exitOK, true
+}
+
+//cli is what the commands besides serve work with: the configuration and the database, migrated like at startup.
+//the log goes to stderr so stdout only has the output of the command
+type cli struct {
+	db    *sql.DB
+	users store.UserStore
+	json  bool
+}
+
+//openCLI loads the configuration and connects to the database, ctrl-c while waiting for it gives up
+func openCLI(ctx context.Context, asJSON bool) (*cli, error) {
+	cfg, err := server.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: cfg.LogLevel}))
+	slog.SetDefault(logger)
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	db, err := server.OpenDB(ctx, cfg, logger)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to database: %w", err)
+	}
+	users, err := server.NewUserStore(ctx, cfg, db, nil)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("preparing user store: %w", err)
+	}
+	return &cli{db: db, users: users, json: asJSON}, nil
+}
+
+func (c *cli) close() {
+	if closer, ok := c.users.(io.Closer); ok {
+		closer.Close()
+	}
+	c.db.Close()
+}
+
+//print writes v as json with -json, and otherwise what text writes
+func (c *cli) print(v any, text func(w io.Writer)) {
+	if c.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(v)
+		return
+	}
+	text(os.Stdout)
+}
+
+//fail reports err and returns the exit code for it
+func fail(err error) int {
+	fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	return exitFailure
+}
+
+//failFields reports invalid input, one field per line
+func failFields(fields model.FieldErrors) int {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "error: %s %s\n", name, fields[name])
+	}
+	return exitFailure
+}
+
+//migrateCommand applies the pending migrations, which connecting does already, and tells the schema version
+func migrateCommand(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print json")
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	ctx := context.Background()
+	c, err := openCLI(ctx, *asJSON)
+	if err != nil {
+		return fail(err)
+	}
+	defer c.close()
+	version, err := server.SchemaVersion(ctx, c.db)
+	if err != nil {
+		return fail(err)
+	}
+	c.print(map[string]int{"schema_version": version}, func(w io.Writer) {
+		fmt.Fprintf(w, "migrations applied, the schema is at version %d\n", version)
+	})
+	return exitOK
+}
+
+//userCreate creates a user without a password, for the first admin of a new deployment. set-password gives it one
+func userCreate(args []string) int {
+	flags := flag.NewFlagSet("user create", flag.ContinueOnError)
+	name := flags.String("name", "", "the name of the user")
+	email := flags.String("email", "", "the email address of the user")
+	role := flags.String("role", model.RoleMember, "admin or member")
+	asJSON := flags.Bool("json", false, "print json")
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	u := model.User{Name: *name, Email: *email, Role: *role}
+	//checked before connecting, a typo shouldnt have to wait for the database
+	if errs := u.Validate(); errs != nil {
+		return failFields(errs)
+	}
+	ctx := context.Background()
+	c, err := openCLI(ctx, *asJSON)
+	if err != nil {
+		return fail(err)
+	}
+	defer c.close()
+	created, err := c.users.Create(ctx, u, "")
+	if err != nil {
+		return fail(err)
+	}
+	c.print(created, func(w io.Writer) {
+		fmt.Fprintf(w, "created user %d (%s) %s with role %s\n", created.Id, created.Uuid, created.Email, created.Role)
+		fmt.Fprintf(w, "it has no password yet, set one with: user set-password -id %d\n", created.Id)
+	})
+	return exitOK
+}
+
+//userList lists the users ordered by id
+func userList(args []string) int {
+	flags := flag.NewFlagSet("user list", flag.ContinueOnError)
+	all := flags.Bool("all", false, "include deactivated users")
+	asJSON := flags.Bool("json", false, "print json")
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	ctx := context.Background()
+	c, err := openCLI(ctx, *asJSON)
+	if err != nil {
+		return fail(err)
+	}
+	defer c.close()
+	users, err := c.users.List(ctx, store.Filter{IncludeInactive: *all})
+	if err != nil {
+		return fail(err)
+	}
+	c.print(users, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tUUID\tNAME\tEMAIL\tROLE\tACTIVE")
+		for _, u := range users {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%t\n", u.Id, u.Uuid, u.Name, u.Email, u.Role, u.Active)
+		}
+		tw.Flush()
+	})
+	return exitOK
+}
+
+//userSetPassword sets the password of a user. it is read from stdin, never from a flag that would end up in the shell
+//history: typed at a prompt that doesnt echo it, or piped in as the first line
+func userSetPassword(args []string) int {
+	flags := flag.NewFlagSet("user set-password", flag.ContinueOnError)
+	id := flags.String("id", "", "the id of the user")
+	asJSON := flags.Bool("json", false, "print json")
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	if *id == "" {
+		fmt.Fprintln(os.Stderr, "-id is required")
+		return exitUsage
+	}
+	password, err := readPassword()
+	if err != nil {
+		return fail(err)
+	}
+	if msg := model.ValidatePassword(password); msg != "" {
+		return failFields(model.FieldErrors{"password": msg})
+	}
+	ctx := context.Background()
+	c, err := openCLI(ctx, *asJSON)
+	if err != nil {
+		return fail(err)
+	}
+	defer c.close()
+	if err := server.SetPassword(ctx, c.db, *id, password); err != nil {
+		if errors.Is(err, store.ErrUserNotFound) {
+			return fail(fmt.Errorf("user %s does not exist", *id))
+		}
+		return fail(err)
+	}
+	c.print(map[string]any{"id": *id, "password_set": true}, func(w io.Writer) {
+		fmt.Fprintf(w, "password of user %s set, its sessions were ended\n", *id)
+	})
+	return exitOK
+}
+
+//readPassword reads the new password from stdin, see userSetPassword
+func readPassword() (string, error) {
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "new password: ")
+		password, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("reading password: %w", err)
+		}
+		return string(password), nil
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("reading password: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
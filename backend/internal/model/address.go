@@ -0,0 +1,92 @@
+package model
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/language"
+)
+
+//limits of the address fields, the short ones fit what a shipping label has room for
+const (
+	MaxAddressLabelLength = 100
+	MaxAddressLineLength  = 255
+	MaxPostalCodeLength   = 20
+)
+
+//Address is a postal address of a user, for shipping
+type Address struct {
+	XMLName xml.Name `json:"-" xml:"address"`
+	Id      ID       `json:"id" xml:"id"`
+	UserId  ID       `json:"user_id" xml:"user_id"`
+	//label tells the addresses of a user apart, like home or office
+	Label      string `json:"label" xml:"label"`
+	Line1      string `json:"line1" xml:"line1"`
+	Line2      string `json:"line2" xml:"line2"`
+	City       string `json:"city" xml:"city"`
+	PostalCode string `json:"postal_code" xml:"postal_code"`
+	//country is the ISO 3166-1 alpha-2 code, like CH
+	Country string `json:"country" xml:"country"`
+}
+
+//AddressList renders <addresses><address>...</address></addresses> in xml and a plain array in json, like UserList
+type AddressList struct {
+	XMLName   xml.Name  `xml:"addresses"`
+	Addresses []Address `xml:"address"`
+}
+
+func (l AddressList) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.Addresses)
+}
+
+//Validate normalizes the address in place (trims every field, upper cases the country) and checks it can be stored
+//it returns one message per invalid field, or nil when everything is fine
+func (a *Address) Validate() FieldErrors {
+	errs := FieldErrors{}
+	for _, f := range []struct {
+		name     string
+		value    *string
+		max      int
+		required bool
+	}{
+		{"label", &a.Label, MaxAddressLabelLength, false},
+		{"line1", &a.Line1, MaxAddressLineLength, true},
+		{"line2", &a.Line2, MaxAddressLineLength, false},
+		{"city", &a.City, MaxAddressLineLength, true},
+		{"postal_code", &a.PostalCode, MaxPostalCodeLength, false},
+	} {
+		*f.value = strings.TrimSpace(*f.value)
+		switch {
+		case f.required && *f.value == "":
+			errs[f.name] = "is required"
+		case utf8.RuneCountInString(*f.value) > f.max:
+			errs[f.name] = fmt.Sprintf("must be at most %d characters", f.max)
+		}
+	}
+
+	a.Country = strings.ToUpper(strings.TrimSpace(a.Country))
+	switch {
+	case a.Country == "":
+		errs["country"] = "is required"
+	case !IsCountryCode(a.Country):
+		errs["country"] = "must be a two letter ISO 3166-1 country code, like CH"
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+//IsCountryCode reports whether s is the upper case ISO 3166-1 alpha-2 code of a country.
+//regions like EU and the codes for private use like XX are not countries
+func IsCountryCode(s string) bool {
+	if len(s) != 2 || s[0] < 'A' || s[0] > 'Z' || s[1] < 'A' || s[1] > 'Z' {
+		return false
+	}
+	region, err := language.ParseRegion(s)
+	return err == nil && region.IsCountry()
+}
@@ -0,0 +1,58 @@
+package model
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+//limits of the group fields
+const (
+	MaxGroupNameLength        = 100
+	MaxGroupDescriptionLength = 1000
+)
+
+//Group is a team users can be members of. the name is unique ignoring case
+type Group struct {
+	XMLName     xml.Name  `json:"-" xml:"group"`
+	Id          ID        `json:"id" xml:"id"`
+	Name        string    `json:"name" xml:"name"`
+	Description string    `json:"description" xml:"description"`
+	CreatedAt   time.Time `json:"created_at" xml:"created_at"`
+}
+
+//GroupList renders <groups><group>...</group></groups> in xml and a plain array in json, like UserList
+type GroupList struct {
+	XMLName xml.Name `xml:"groups"`
+	Groups  []Group  `xml:"group"`
+}
+
+func (l GroupList) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.Groups)
+}
+
+//Validate trims the name and the description in place and checks the group can be stored
+//it returns one message per invalid field, or nil when everything is fine
+func (g *Group) Validate() FieldErrors {
+	errs := FieldErrors{}
+
+	g.Name = strings.TrimSpace(g.Name)
+	switch {
+	case g.Name == "":
+		errs["name"] = "is required"
+	case utf8.RuneCountInString(g.Name) > MaxGroupNameLength:
+		errs["name"] = "must be at most 100 characters"
+	}
+
+	g.Description = strings.TrimSpace(g.Description)
+	if utf8.RuneCountInString(g.Description) > MaxGroupDescriptionLength {
+		errs["description"] = "must be at most 1000 characters"
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
@@ -0,0 +1,43 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+)
+
+//StringIds makes every ID encode to json as a string of its digits instead of a number, for clients whose javascript
+//would round ids above 2^53, and decode from one as well as from a number. the server sets it from JSON_STRING_IDS at
+//startup
+var StringIds bool
+
+//ID is the type of the ids of the json documents of the service, the users, the addresses and the rest. it is an int64
+//everywhere else, in the database and in the other formats
+type ID int64
+
+func (id ID) MarshalJSON() ([]byte, error) {
+	if StringIds {
+		return strconv.AppendQuote(nil, strconv.FormatInt(int64(id), 10)), nil
+	}
+	return strconv.AppendInt(nil, int64(id), 10), nil
+}
+
+//UnmarshalJSON takes a number, with StringIds a string of digits as well, and null for the zero id like encoding/json
+//does for an int64
+func (id *ID) UnmarshalJSON(b []byte) error {
+	if bytes.Equal(b, []byte("null")) {
+		return nil
+	}
+	digits := b
+	if StringIds && len(b) >= 2 && b[0] == '"' && b[len(b)-1] == '"' {
+		digits = b[1 : len(b)-1]
+	}
+	n, err := strconv.ParseInt(string(digits), 10, 64)
+	if err != nil {
+		//answered like an int64 field that got something else
+		return &json.UnmarshalTypeError{Value: string(b), Type: reflect.TypeFor[int64]()}
+	}
+	*id = ID(n)
+	return nil
+}
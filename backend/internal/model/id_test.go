@@ -0,0 +1,62 @@
+package model
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestIDJSON(t *testing.T) {
+	defer func(was bool) { StringIds = was }(StringIds)
+	for _, id := range []ID{0, 1, -1, 1<<53 + 1, math.MaxInt32, math.MaxInt32 + 1, math.MaxInt64, math.MinInt64} {
+		digits := strconv.FormatInt(int64(id), 10)
+		for _, stringIds := range []bool{false, true} {
+			StringIds = stringIds
+			want := digits
+			if stringIds {
+				want = `"` + digits + `"`
+			}
+			encoded, err := json.Marshal(struct {
+				Id ID `json:"id"`
+			}{id})
+			if err != nil || string(encoded) != `{"id":`+want+`}` {
+				t.Fatalf("%d with StringIds %v encoded to %s, %v", id, stringIds, encoded, err)
+			}
+			var decoded struct {
+				Id ID `json:"id"`
+			}
+			if err := json.Unmarshal(encoded, &decoded); err != nil || decoded.Id != id {
+				t.Fatalf("%s with StringIds %v decoded to %d, %v", encoded, stringIds, decoded.Id, err)
+			}
+		}
+	}
+}
+
+func TestIDJSONRefuses(t *testing.T) {
+	defer func(was bool) { StringIds = was }(StringIds)
+	for _, c := range []struct {
+		doc       string
+		stringIds bool
+	}{
+		{`9223372036854775808`, false},
+		{`-9223372036854775809`, true},
+		{`"9223372036854775808"`, true},
+		{`"12"`, false},
+		{`1.5`, true},
+		{`"1e3"`, true},
+		{`""`, true},
+		{`true`, true},
+	} {
+		StringIds = c.stringIds
+		var id ID
+		err := json.Unmarshal([]byte(c.doc), &id)
+		if _, ok := err.(*json.UnmarshalTypeError); !ok {
+			t.Fatalf("%s with StringIds %v decoded to %d, %v", c.doc, c.stringIds, id, err)
+		}
+	}
+	var id ID = 7
+	if err := json.Unmarshal([]byte(`null`), &id); err != nil || id != 7 {
+		t.Fatalf("null decoded to %d, %v", id, err)
+	}
+}
@@ -0,0 +1,24 @@
+package model
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+//password length limits. bcrypt only looks at the first 72 bytes, so longer passwords are rejected
+//instead of silently ignoring everything after byte 72
+const (
+	MinPasswordLength = 8
+	MaxPasswordBytes  = 72
+)
+
+//ValidatePassword returns what is wrong with a new password, or "" when it is acceptable
+func ValidatePassword(password string) string {
+	switch {
+	case utf8.RuneCountInString(password) < MinPasswordLength:
+		return fmt.Sprintf("must be at least %d characters", MinPasswordLength)
+	case len(password) > MaxPasswordBytes:
+		return fmt.Sprintf("must be at most %d bytes", MaxPasswordBytes)
+	}
+	return ""
+}
@@ -0,0 +1,16 @@
+package model
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+//NotificationPrefs are the emails a user wants. security alerts, like password resets, are always sent, the field
+//is there so clients show it
+type NotificationPrefs struct {
+	XMLName        xml.Name  `json:"-" xml:"preferences"`
+	WelcomeEmail   bool      `json:"welcome_email" xml:"welcome_email"`
+	Marketing      bool      `json:"marketing" xml:"marketing"`
+	SecurityAlerts bool      `json:"security_alerts" xml:"security_alerts"`
+	UpdatedAt      time.Time `json:"updated_at" xml:"updated_at"`
+}
@@ -0,0 +1,46 @@
+package model
+
+import (
+	"crypto/rand"
+	"strings"
+	"time"
+)
+
+//publicIdAlphabet is crockford's base32, the alphabet of ulids. it leaves out I, L, O and U so ids cant be misread
+const publicIdAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+//PublicIdLength is the length of a public id
+const PublicIdLength = 26
+
+//NewPublicId returns a ulid for a user created at t: 10 characters of the unix milliseconds followed by 16 random
+//ones, so public ids sort by when the users were created and cant be guessed. the databases generate them the same
+//way when a user is inserted, see the public_id migrations
+func NewPublicId(t time.Time) string {
+	var id [PublicIdLength]byte
+	ms := uint64(t.UnixMilli())
+	for i := 9; i >= 0; i-- {
+		id[i] = publicIdAlphabet[ms&31]
+		ms >>= 5
+	}
+	random := make([]byte, PublicIdLength-10)
+	rand.Read(random)
+	for i, b := range random {
+		id[10+i] = publicIdAlphabet[b&31]
+	}
+	return string(id[:])
+}
+
+//ParsePublicId returns s as a public id in upper case, ok is false when s isnt one. ulids ignore case.
+//the first character can only go up to 7, the 10 characters of the time have room for 50 bits but it has 48
+func ParsePublicId(s string) (string, bool) {
+	s = strings.ToUpper(s)
+	if len(s) != PublicIdLength || s[0] > '7' {
+		return "", false
+	}
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(publicIdAlphabet, s[i]) < 0 {
+			return "", false
+		}
+	}
+	return s, true
+}
@@ -0,0 +1,51 @@
+package model
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewPublicId(t *testing.T) {
+	created := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	a, b := NewPublicId(created), NewPublicId(created)
+	if a == b || a[:10] != b[:10] {
+		t.Fatalf("two ids of the same millisecond are %s and %s", a, b)
+	}
+	for _, id := range []string{a, b} {
+		if parsed, ok := ParsePublicId(id); !ok || parsed != id {
+			t.Fatalf("%s doesnt parse", id)
+		}
+	}
+	//they sort by when the users were created
+	later := NewPublicId(created.Add(time.Millisecond))
+	if later <= a || later <= b {
+		t.Fatalf("%s sorts before %s", later, a)
+	}
+	if NewPublicId(time.UnixMilli(0))[:10] != "0000000000" {
+		t.Fatalf("the epoch is %s", NewPublicId(time.UnixMilli(0)))
+	}
+}
+
+func TestParsePublicId(t *testing.T) {
+	for in, want := range map[string]string{
+		"01M53N2YF31G34SG6VF3EJQHRX": "01M53N2YF31G34SG6VF3EJQHRX",
+		"01m53n2yf31g34sg6vf3ejqhrx": "01M53N2YF31G34SG6VF3EJQHRX",
+		"7ZZZZZZZZZZZZZZZZZZZZZZZZZ": "7ZZZZZZZZZZZZZZZZZZZZZZZZZ",
+		//the time would overflow 48 bits
+		"8ZZZZZZZZZZZZZZZZZZZZZZZZZ": "",
+		//crockford leaves out I, L, O and U
+		"01M53N2YF31G34SG6VF3EJQHRI":           "",
+		"01M53N2YF31G34SG6VF3EJQHRU":           "",
+		"01M53N2YF31G34SG6VF3EJQHR":            "",
+		"01M53N2YF31G34SG6VF3EJQHRXX":          "",
+		"42":                                   "",
+		"550e8400-e29b-41d4-a716-446655440000": "",
+		strings.Repeat("0", PublicIdLength):    strings.Repeat("0", PublicIdLength),
+	} {
+		got, ok := ParsePublicId(in)
+		if got != want || ok != (want != "") {
+			t.Errorf("ParsePublicId(%q) = %q, %v, want %q", in, got, ok, want)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package model
+
+//roles a user (or api key) can have. admins can change data, members can only read it
+const (
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+//ValidRole reports whether role is one of the roles above
+func ValidRole(role string) bool {
+	return role == RoleAdmin || role == RoleMember
+}
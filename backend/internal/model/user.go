@@ -0,0 +1,323 @@
+package model
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"net/mail"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/language"
+
+	//the zones are looked up in the tz database of the os, the embedded copy is for images that dont have one
+	_ "time/tzdata"
+)
+
+//limits enforced on user input before anything reaches the database
+const (
+	MaxNameLength  = 255
+	MaxEmailLength = 320
+)
+
+//usernamePattern is what a username may look like: 3 to 30 lower case letters, digits and underscores, not starting with a digit
+var usernamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_]{2,29}$`)
+
+//reservedUsernames cant be taken, they would be mistaken for the staff or for paths of the api and the frontend
+var reservedUsernames = []string{"admin", "administrator", "root", "system", "support", "help", "security",
+	"me", "api", "users", "login", "logout", "null", "undefined"}
+
+type User struct {
+	XMLName xml.Name `json:"-" xml:"user"`
+	Id      ID       `json:"id" xml:"id"`
+	//uuid is a random key next to the id that clients can use in its place, it doesnt give away how many users there are
+	Uuid string `json:"uuid" xml:"uuid"`
+	//publicId is a ulid, read only. like the uuid it can be used in place of the id, and it sorts by creation time
+	PublicId string `json:"public_id" xml:"public_id"`
+	Name     string `json:"name" xml:"name"`
+	Email    string `json:"email" xml:"email"`
+	//username is an optional handle, unique ignoring case. left empty on update it keeps the current one
+	Username string `json:"username,omitempty" xml:"username,omitempty"`
+	//phone is an optional number in E.164 form like +41446681800, null when the user has none.
+	//left out on update it keeps the current one, an empty string removes it
+	Phone *string `json:"phone" xml:"phone,omitempty"`
+	//locale is the BCP 47 language tag the frontend shows the user's texts in, like de-CH, and timezone the IANA name of
+	//the zone it shows their times in, like Europe/Zurich. they are en and UTC until the user picks others, left empty
+	//on update they keep the current ones
+	Locale   string `json:"locale" xml:"locale"`
+	Timezone string `json:"timezone" xml:"timezone"`
+	//avatarURL is read only, where the profile picture is served. empty until one is uploaded to PUT /users/{id}/avatar
+	AvatarURL string `json:"avatar_url,omitempty" xml:"avatar_url,omitempty"`
+	//role is admin or member. left empty on create it defaults to member, on update it keeps the current role
+	Role      string    `json:"role" xml:"role"`
+	UpdatedAt time.Time `json:"updated_at" xml:"updated_at"`
+	//verified is read only, it becomes true once the user clicks the link in the verification email
+	Verified bool `json:"verified" xml:"verified"`
+	//active is false for offboarded users, it is changed through the activate and deactivate endpoints only
+	Active bool `json:"active" xml:"active"`
+	//pendingEmail is read only too, a new address waiting to be confirmed. the email field keeps the current address until then
+	PendingEmail string `json:"pending_email,omitempty" xml:"pending_email,omitempty"`
+	//lastLoginAt is read only and only shown to admins, when the user last logged in or refreshed a token, to the minute.
+	//null for users who never did
+	LastLoginAt *time.Time `json:"last_login_at,omitempty" xml:"last_login_at,omitempty"`
+	//addresses are only filled in for GET /users/{id}?include=addresses, they are changed through their own routes
+	Addresses []Address `json:"addresses,omitempty" xml:"addresses>address,omitempty"`
+	//preferences are only filled in for GET /users/{id}?include=preferences, they are changed through their own route
+	Preferences *NotificationPrefs `json:"preferences,omitempty" xml:"preferences,omitempty"`
+	//password is write only: it is accepted on create but never read back from the database or sent to clients,
+	//only its bcrypt hash is stored and store.UserColumns deliberately leaves that column out
+	Password string `json:"password,omitempty" xml:"-"`
+	//version is sent to clients as the etag header rather than in the body
+	Version int `json:"-" xml:"-"`
+}
+
+//Validate normalizes the user in place (trims the name, trims and lowercases the email and the username, puts the phone into E.164) and checks it can be stored
+//it returns one message per invalid field, or nil when everything is fine
+func (u *User) Validate() FieldErrors {
+	errs := FieldErrors{}
+
+	u.Name = strings.TrimSpace(u.Name)
+	switch {
+	case u.Name == "":
+		errs["name"] = "is required"
+	case utf8.RuneCountInString(u.Name) > MaxNameLength:
+		errs["name"] = "must be at most 255 characters"
+	}
+
+	u.Email = strings.ToLower(strings.TrimSpace(u.Email))
+	switch {
+	case u.Email == "":
+		errs["email"] = "is required"
+	case len(u.Email) > MaxEmailLength:
+		errs["email"] = "must be at most 320 characters"
+	case !IsEmailAddress(u.Email):
+		errs["email"] = "must be a valid address"
+	}
+
+	u.Username = strings.ToLower(strings.TrimSpace(u.Username))
+	if u.Username != "" {
+		if msg := ValidateUsername(u.Username); msg != "" {
+			errs["username"] = msg
+		}
+	}
+
+	//an empty phone stays empty, it removes the number on update
+	if u.Phone != nil {
+		phone := strings.TrimSpace(*u.Phone)
+		if phone != "" {
+			var err error
+			if phone, err = NormalizePhone(phone); err != nil {
+				errs["phone"] = err.Error()
+			}
+		}
+		u.Phone = &phone
+	}
+
+	u.Locale = strings.TrimSpace(u.Locale)
+	if u.Locale != "" {
+		if locale, err := NormalizeLocale(u.Locale); err != nil {
+			errs["locale"] = err.Error()
+		} else {
+			u.Locale = locale
+		}
+	}
+
+	u.Timezone = strings.TrimSpace(u.Timezone)
+	if u.Timezone != "" && !IsTimezone(u.Timezone) {
+		errs["timezone"] = "must be an IANA time zone name like UTC, Europe/Zurich or America/New_York"
+	}
+
+	if u.Role != "" && !ValidRole(u.Role) {
+		errs["role"] = "must be one of admin, member"
+	}
+
+	//the password is optional, users without one simply cant log in
+	if u.Password != "" {
+		if msg := ValidatePassword(u.Password); msg != "" {
+			errs["password"] = msg
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+//Clone is a copy of u that shares nothing with it, changing one leaves the other as it was
+func (u User) Clone() User {
+	if u.Phone != nil {
+		phone := *u.Phone
+		u.Phone = &phone
+	}
+	if u.LastLoginAt != nil {
+		at := *u.LastLoginAt
+		u.LastLoginAt = &at
+	}
+	u.Addresses = slices.Clone(u.Addresses)
+	if u.Preferences != nil {
+		prefs := *u.Preferences
+		u.Preferences = &prefs
+	}
+	return u
+}
+
+//ValidateUsername checks a lower case username, it returns what is wrong with it or "" when it can be taken
+func ValidateUsername(username string) string {
+	switch {
+	case len(username) < 3 || len(username) > 30:
+		return "must be 3 to 30 characters"
+	case !usernamePattern.MatchString(username):
+		return "must be lower case letters, digits and underscores, not starting with a digit"
+	case slices.Contains(reservedUsernames, username):
+		return "is reserved"
+	}
+	return ""
+}
+
+//phone numbers in E.164 have a country code of 1 to 3 digits and at most 15 digits in total,
+//the shortest ones in use are 8 digits with their country code
+const (
+	minPhoneDigits = 8
+	maxPhoneDigits = 15
+)
+
+//NormalizePhone turns a phone number like "+41 44-668 18 00" or "+1 (415) 555.0132" into E.164, +41446681800.
+//the separators people type are dropped, the number has to start with + and its country code, which cant start with 0
+func NormalizePhone(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "+") {
+		return "", errors.New("must start with + and the country code")
+	}
+	digits := make([]byte, 0, len(s))
+	for _, c := range s[1:] {
+		switch {
+		case c >= '0' && c <= '9':
+			digits = append(digits, byte(c))
+		case c == ' ' || c == '-' || c == '.' || c == '(' || c == ')':
+		default:
+			return "", errors.New("must only contain digits after the +, besides spaces, dashes, dots and parentheses")
+		}
+	}
+	switch {
+	case len(digits) > 0 && digits[0] == '0':
+		return "", errors.New("must start with a country code, which cant start with 0")
+	case len(digits) < minPhoneDigits || len(digits) > maxPhoneDigits:
+		return "", errors.New("must have 8 to 15 digits including the country code")
+	}
+	return "+" + string(digits), nil
+}
+
+//the preferences a user has until they pick others, see User.Locale
+const (
+	DefaultLocale   = "en"
+	DefaultTimezone = "UTC"
+)
+
+//maxLocaleLength is the longest language tag that is accepted, longer ones are no language anybody reads.
+//maxTimezoneLength is longer than the longest name in the tz database
+const (
+	maxLocaleLength   = 35
+	maxTimezoneLength = 64
+)
+
+//NormalizeLocale turns a BCP 47 language tag like "pt_br" or "DE-ch" into its canonical form, pt-BR and de-CH
+func NormalizeLocale(s string) (string, error) {
+	errInvalid := errors.New("must be a BCP 47 language tag like en, de-CH or pt-BR")
+	if len(s) > maxLocaleLength {
+		return "", errInvalid
+	}
+	tag, err := language.Parse(strings.ReplaceAll(s, "_", "-"))
+	if err != nil || tag == language.Und {
+		return "", errInvalid
+	}
+	return tag.String(), nil
+}
+
+//IsTimezone reports whether s is the name of a zone of the tz database like Europe/Zurich. Local is the zone of the
+//server and not one a user can be in
+func IsTimezone(s string) bool {
+	if len(s) > maxTimezoneLength || s == "Local" {
+		return false
+	}
+	_, err := time.LoadLocation(s)
+	return err == nil
+}
+
+//IsEmailAddress reports whether s is a bare address like bob@example.com
+//net/mail also accepts forms like "Bob <bob@example.com>", those are rejected by comparing the parsed address with the input
+func IsEmailAddress(s string) bool {
+	addr, err := mail.ParseAddress(s)
+	return err == nil && addr.Address == s
+}
+
+//AvatarPath is the avatar_url of the user with the uuid whose picture is stored under key, empty without a picture.
+//the name of the blob changes with every upload, so with it in ?v= clients can cache the picture for good
+func AvatarPath(uuid, key string) string {
+	if key == "" {
+		return ""
+	}
+	return "/api/v1/users/" + uuid + "/avatar?v=" + AvatarVersion(key)
+}
+
+//AvatarVersion is the part of an avatar's blob key that changes with the picture, the file name without its extension
+func AvatarVersion(key string) string {
+	name := path.Base(key)
+	return strings.TrimSuffix(name, path.Ext(name))
+}
+
+//UserList wraps a slice of users so encoding/xml renders <users><user>...</user></users>
+//json clients keep receiving a plain array because of the MarshalJSON method below
+type UserList struct {
+	XMLName xml.Name `xml:"users"`
+	Users   []User   `xml:"user"`
+}
+
+func (l UserList) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.Users)
+}
+
+//ScoredUser is a user found by a search with how well it matched it, a higher score is a better match
+type ScoredUser struct {
+	User
+	Score int `json:"score" xml:"score"`
+}
+
+//ScoredUserList is UserList for search results, json clients receive a plain array of them as well
+type ScoredUserList struct {
+	XMLName xml.Name     `xml:"users"`
+	Users   []ScoredUser `xml:"user"`
+}
+
+func (l ScoredUserList) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.Users)
+}
+
+//FieldErrors maps a field name to what is wrong with it, e.g. {"email": "must be a valid address"}
+type FieldErrors map[string]string
+
+//MarshalXML renders the map as <field name="email">must be a valid address</field> elements
+//encoding/xml cant marshal maps on its own, keys are sorted so the output is stable
+func (f FieldErrors) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, name := range names {
+		field := xml.StartElement{Name: xml.Name{Local: "field"}, Attr: []xml.Attr{{Name: xml.Name{Local: "name"}, Value: name}}}
+		if err := e.EncodeElement(f[name], field); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
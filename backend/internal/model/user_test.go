@@ -0,0 +1,95 @@
+package model
+
+import (
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		user      User
+		errs      FieldErrors
+		wantName  string
+		wantEmail string
+	}{
+		{name: "valid", user: User{Name: "Ada Lovelace", Email: "ada@example.com"}, wantName: "Ada Lovelace", wantEmail: "ada@example.com"},
+		{name: "trimmed and lowercased", user: User{Name: "  Ada  ", Email: " Ada@Example.COM "}, wantName: "Ada", wantEmail: "ada@example.com"},
+		{name: "missing", user: User{Name: "   ", Email: ""}, errs: FieldErrors{"name": "is required", "email": "is required"}},
+		{name: "not an address", user: User{Name: "Ada", Email: "not-an-email"}, errs: FieldErrors{"email": "must be a valid address"}},
+		{name: "address with a display name", user: User{Name: "Ada", Email: "Ada <ada@example.com>"}, errs: FieldErrors{"email": "must be a valid address"}},
+		{name: "longest name", user: User{Name: strings.Repeat("é", 255), Email: "ada@example.com"}, wantName: strings.Repeat("é", 255), wantEmail: "ada@example.com"},
+		{name: "name too long", user: User{Name: strings.Repeat("a", 256), Email: "ada@example.com"}, errs: FieldErrors{"name": "must be at most 255 characters"}},
+		{name: "email too long", user: User{Name: "Ada", Email: strings.Repeat("a", 310) + "@example.com"}, errs: FieldErrors{"email": "must be at most 320 characters"}},
+		{name: "bad role", user: User{Name: "Ada", Email: "ada@example.com", Role: "root"}, errs: FieldErrors{"role": "must be one of admin, member"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u := tc.user
+			errs := u.Validate()
+			if !maps.Equal(errs, tc.errs) {
+				t.Fatalf("got %v, want %v", errs, tc.errs)
+			}
+			if tc.errs != nil {
+				return
+			}
+			if u.Name != tc.wantName || u.Email != tc.wantEmail {
+				t.Fatalf("normalized to %q %q", u.Name, u.Email)
+			}
+		})
+	}
+}
+
+func TestNormalizePhone(t *testing.T) {
+	for in, want := range map[string]string{
+		"+41446681800":       "+41446681800",
+		"+41 44 668 18 00":   "+41446681800",
+		"+1 (415) 555.0132":  "+14155550132",
+		"+44-20-7946-0958":   "+442079460958",
+		" +81 3 1234 5678 ":  "+81312345678",
+		"+86 138 0013 8000":  "+8613800138000",
+		"+999 123456789012":  "+999123456789012",
+		"0446681800":         "",
+		"+0 446681800":       "",
+		"+41 44 668 18 00 x": "",
+		"+4144":              "",
+		"+1234567890123456":  "",
+		"+":                  "",
+	} {
+		got, err := NormalizePhone(in)
+		if got != want || (err == nil) != (want != "") {
+			t.Errorf("NormalizePhone(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+}
+
+func TestValidatePhone(t *testing.T) {
+	for _, tc := range []struct {
+		phone *string
+		want  *string
+		err   string
+	}{
+		//a user without a phone stays without one
+		{nil, nil, ""},
+		{ptr(" +41 44-668 18 00 "), ptr("+41446681800"), ""},
+		//an empty one removes it on update
+		{ptr("  "), ptr(""), ""},
+		{ptr("044 668 18 00"), nil, "must start with + and the country code"},
+	} {
+		u := User{Name: "Ada", Email: "ada@example.com", Phone: tc.phone}
+		errs := u.Validate()
+		if errs["phone"] != tc.err {
+			t.Fatalf("the phone %v got %v", tc.phone, errs)
+		}
+		if tc.err != "" {
+			continue
+		}
+		if (tc.want == nil) != (u.Phone == nil) || tc.want != nil && *u.Phone != *tc.want {
+			t.Fatalf("the phone %v became %v", tc.phone, u.Phone)
+		}
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
@@ -0,0 +1,46 @@
+//Package seed makes up users for development and demo databases and for test fixtures.
+//the users come from a random generator with a fixed seed, so the same n gives the same users on every run
+package seed
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+
+	"api/internal/model"
+)
+
+//the fixed seed of the generator, changing it changes every seeded database
+const (
+	seed1 = 0x5eed
+	seed2 = 0xda7a
+)
+
+var firstNames = []string{
+	"Ada", "Alan", "Amara", "Ben", "Carmen", "Chen", "Dana", "Diego", "Elena", "Emeka",
+	"Farah", "Felix", "Grace", "Hana", "Hugo", "Ines", "Ivan", "Jonas", "Kaito", "Lara",
+	"Leila", "Luca", "Maya", "Mateo", "Nadia", "Noah", "Olga", "Omar", "Priya", "Quinn",
+	"Rosa", "Sami", "Sofia", "Tariq", "Uma", "Victor", "Wen", "Yara", "Yusuf", "Zoe",
+}
+
+var lastNames = []string{
+	"Abara", "Berg", "Costa", "Dubois", "Eriksen", "Fischer", "Garcia", "Haddad", "Ito", "Jensen",
+	"Kowalski", "Lee", "Moreau", "Nakamura", "Okafor", "Petrov", "Quispe", "Rossi", "Schmidt", "Tanaka",
+	"Usman", "Varga", "Wagner", "Xu", "Yilmaz", "Zhang",
+}
+
+//Users returns n made up users. they only have a name and an email address at example.com, the reserved domain
+//nobody receives mail for. the addresses are numbered so they are unique however many users there are
+func Users(n int) []model.User {
+	rng := rand.New(rand.NewPCG(seed1, seed2))
+	users := make([]model.User, n)
+	for i := range users {
+		first := firstNames[rng.IntN(len(firstNames))]
+		last := lastNames[rng.IntN(len(lastNames))]
+		users[i] = model.User{
+			Name:  first + " " + last,
+			Email: fmt.Sprintf("%s.%s.%d@example.com", strings.ToLower(first), strings.ToLower(last), i+1),
+		}
+	}
+	return users
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//sensitiveQueryParams have their values replaced in the access log, they carry tokens and credentials
+var sensitiveQueryParams = map[string]bool{
+	"access_token":  true,
+	"refresh_token": true,
+	"token":         true,
+	"code":          true,
+	"state":         true,
+	"password":      true,
+	"api_key":       true,
+	"key":           true,
+	"secret":        true,
+}
+
+//accessLogSkipPaths turns Config.AccessLogSkipPaths into a set
+func accessLogSkipPaths(list []string) map[string]bool {
+	paths := map[string]bool{}
+	for _, path := range list {
+		paths[path] = true
+	}
+	return paths
+}
+
+//redactedQuery returns the query string with the values of sensitive parameters replaced
+func redactedQuery(u *url.URL) string {
+	if u.RawQuery == "" {
+		return ""
+	}
+	query := u.Query()
+	for name := range query {
+		if sensitiveQueryParams[strings.ToLower(name)] {
+			query[name] = []string{"REDACTED"}
+		}
+	}
+	return query.Encode()
+}
+
+//accessLog logs every request once the handler is done. it sits outside the cors middleware so preflights are logged too
+//headers are never logged, so neither is the Authorization header or the X-API-Key
+func accessLog(skipPaths map[string]bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if skipPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		r, route := withRouteSlot(r)
+		r, capture := withBodyCaptureSlot(r)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		//the request logger already carries the request id, method and path
+		attrs := []any{
+			"query", redactedQuery(r.URL),
+			"route", *route,
+			"status", rec.statusCode(),
+			"bytes", rec.bytes,
+			"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"remote_addr", r.RemoteAddr,
+			"client_ip", clientIP(r),
+			"user_agent", r.UserAgent(),
+			"client_version", clientVersionLogValue(r),
+		}
+		//the request logger has the method that was sent, a POST that overrideMethod turned into another method has that too
+		if method, ok := overriddenMethod(r); ok && overridableMethods[method] {
+			attrs = append(attrs, "effective_method", method)
+		}
+		loggerFrom(r.Context()).Info("request", append(attrs, capture.logAttrs()...)...)
+	})
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//setUserActive activates or deactivates a user and answers with the user
+//setting the state the user is already in succeeds without bumping the version, so retries are harmless.
+//deactivating also ends every session and revokes every refresh token of the user, access tokens that are still valid
+//are refused by authMiddleware from the next request on.
+//deactivating is how a user is deleted without losing it, so an If-Match header is honored like on DELETE
+func setUserActive(db *sql.DB, events eventBroker, cache *userCache, active bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := userIdVar(r)
+		match := parseIfMatch(r)
+		if !checkIfMatchRequired(w, r, match) {
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("starting transaction: %w", err))
+			return
+		}
+		defer tx.Rollback()
+
+		var before, u model.User
+		err = store.ScanUser(tx.QueryRowContext(r.Context(), "SELECT "+store.UserColumns+" FROM users WHERE id = $1 FOR UPDATE", id), &before)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeUserNotFound(w, r, id)
+			return
+		}
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("loading user: %w", err))
+			return
+		}
+		//the row is locked, its version cant change before the update below
+		if !match.Matches(before.Version) {
+			writeUserOpError(w, r, id, store.ErrVersionChanged)
+			return
+		}
+		_, err = tx.ExecContext(r.Context(), `UPDATE users SET active = $2,
+			version = CASE WHEN active = $2 THEN version ELSE version + 1 END,
+			updated_at = CASE WHEN active = $2 THEN updated_at ELSE now() END
+			WHERE id = $1`, before.Id, active)
+		if err == nil {
+			err = store.ScanUser(tx.QueryRowContext(r.Context(), "SELECT "+store.UserColumns+" FROM users WHERE id = $1", before.Id), &u)
+		}
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("updating active state: %w", err))
+			return
+		}
+		if before.Active != active {
+			action := auditUserActivated
+			if !active {
+				action = auditUserDeactivated
+			}
+			if err := auditUserChange(r.Context(), tx, action, &before, &u); err != nil {
+				internalServerError(w, r, err)
+				return
+			}
+			if err := enqueueOutbox(r.Context(), tx, outboxUserUpdated, u); err != nil {
+				internalServerError(w, r, err)
+				return
+			}
+		}
+		if !active {
+			if err := revokeCredentials(r.Context(), tx, int64(u.Id)); err != nil {
+				internalServerError(w, r, err)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			internalServerError(w, r, fmt.Errorf("updating active state: %w", err))
+			return
+		}
+		cache.forget(r.Context(), int64(u.Id))
+		if before.Active != active {
+			events.Publish(userEvent{Type: eventUserUpdated, User: u})
+		}
+
+		w.Header().Set("ETag", userETag(u))
+		writeResponse(w, r, http.StatusOK, u)
+	}
+}
+
+//revokeCredentials ends every session and revokes every refresh token of a user that was deactivated
+func revokeCredentials(ctx context.Context, tx execer, userId int64) error {
+	for _, stmt := range []string{
+		"UPDATE refresh_tokens SET revoked = true WHERE user_id = $1",
+		"DELETE FROM sessions WHERE user_id = $1",
+	} {
+		if _, err := tx.ExecContext(ctx, stmt, userId); err != nil {
+			return fmt.Errorf("revoking credentials of deactivated user: %w", err)
+		}
+	}
+	return nil
+}
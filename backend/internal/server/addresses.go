@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//addressColumns lists the columns scanAddress expects, in order
+const addressColumns = "id, user_id, label, line1, line2, city, postal_code, country"
+
+func scanAddress(row store.RowScanner, a *model.Address) error {
+	return row.Scan(&a.Id, &a.UserId, &a.Label, &a.Line1, &a.Line2, &a.City, &a.PostalCode, &a.Country)
+}
+
+//addressInput is the body of POST and PUT on the addresses of a user, the id and the user come from the path
+type addressInput struct {
+	Label      string `json:"label"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2"`
+	City       string `json:"city"`
+	PostalCode string `json:"postal_code"`
+	Country    string `json:"country"`
+}
+
+//decodeAddress reads and validates the address in the body, it has answered the request when ok is false
+func decodeAddress(w http.ResponseWriter, r *http.Request) (model.Address, bool) {
+	var in addressInput
+	if err := decodeRequest(r, &in); err != nil {
+		writeDecodeError(w, r, err)
+		return model.Address{}, false
+	}
+	a := model.Address{Label: in.Label, Line1: in.Line1, Line2: in.Line2, City: in.City, PostalCode: in.PostalCode, Country: in.Country}
+	if errs := a.Validate(); errs != nil {
+		writeValidationError(w, r, errs)
+		return model.Address{}, false
+	}
+	return a, true
+}
+
+//listAddresses returns the addresses of the user id, oldest first
+func listAddresses(ctx context.Context, db *sql.DB, id int64) ([]model.Address, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+addressColumns+" FROM addresses WHERE user_id = $1 ORDER BY id", id)
+	if err != nil {
+		return nil, fmt.Errorf("listing addresses: %w", err)
+	}
+	defer rows.Close()
+	addresses := []model.Address{}
+	for rows.Next() {
+		var a model.Address
+		if err := scanAddress(rows, &a); err != nil {
+			return nil, fmt.Errorf("reading address: %w", err)
+		}
+		addresses = append(addresses, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("listing addresses: %w", err)
+	}
+	return addresses, nil
+}
+
+//userExists tells a user without addresses from one that doesnt exist
+func userExists(ctx context.Context, db *sql.DB, id int64) (bool, error) {
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", id).Scan(&exists); err != nil {
+		return false, fmt.Errorf("checking user exists: %w", err)
+	}
+	return exists, nil
+}
+
+//getAddresses lists the addresses of the user in the path
+func getAddresses(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := userIdVar(r)
+		addresses, err := listAddresses(r.Context(), db, id)
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		if len(addresses) == 0 {
+			exists, err := userExists(r.Context(), db, id)
+			if err != nil {
+				internalServerError(w, r, err)
+				return
+			}
+			if !exists {
+				writeUserNotFound(w, r, id)
+				return
+			}
+		}
+		writeResponse(w, r, http.StatusOK, model.AddressList{Addresses: addresses})
+	}
+}
+
+//createAddress adds an address to the user in the path
+func createAddress(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := userIdVar(r)
+		a, ok := decodeAddress(w, r)
+		if !ok {
+			return
+		}
+		//inserting only when the user exists answers a missing user with no row instead of a foreign key error
+		//that looks different on every database
+		addressId, err := insertId(r.Context(), db, `INSERT INTO addresses (user_id, label, line1, line2, city, postal_code, country)
+			SELECT id, $2, $3, $4, $5, $6, $7 FROM users WHERE id = $1`,
+			id, a.Label, a.Line1, a.Line2, a.City, a.PostalCode, a.Country)
+		if err == nil {
+			err = scanAddress(db.QueryRowContext(r.Context(), "SELECT "+addressColumns+" FROM addresses WHERE id = $1", addressId), &a)
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			writeUserNotFound(w, r, id)
+			return
+		}
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("creating address: %w", err))
+			return
+		}
+		w.Header().Set("Location", externalURL(r, fmt.Sprintf("%s/%d", r.URL.Path, a.Id)))
+		writeResponse(w, r, http.StatusCreated, a)
+	}
+}
+
+//getAddress returns one address of the user in the path
+func getAddress(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		var a model.Address
+		err := scanAddress(db.QueryRowContext(r.Context(), "SELECT "+addressColumns+" FROM addresses WHERE id = $1 AND user_id = $2",
+			vars["addressId"], userIdVar(r)), &a)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeAddressNotFound(w, r)
+			return
+		}
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("loading address: %w", err))
+			return
+		}
+		writeResponse(w, r, http.StatusOK, a)
+	}
+}
+
+//updateAddress replaces an address of the user in the path
+func updateAddress(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		a, ok := decodeAddress(w, r)
+		if !ok {
+			return
+		}
+		_, err := db.ExecContext(r.Context(), `UPDATE addresses SET label = $3, line1 = $4, line2 = $5, city = $6, postal_code = $7, country = $8
+			WHERE id = $1 AND user_id = $2`,
+			vars["addressId"], userIdVar(r), a.Label, a.Line1, a.Line2, a.City, a.PostalCode, a.Country)
+		if err == nil {
+			//read back rather than counted, mysql doesnt count a row whose values didnt change as affected
+			err = scanAddress(db.QueryRowContext(r.Context(), "SELECT "+addressColumns+" FROM addresses WHERE id = $1 AND user_id = $2",
+				vars["addressId"], userIdVar(r)), &a)
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			writeAddressNotFound(w, r)
+			return
+		}
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("updating address: %w", err))
+			return
+		}
+		writeResponse(w, r, http.StatusOK, a)
+	}
+}
+
+//deleteAddress removes an address of the user in the path
+func deleteAddress(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		res, err := db.ExecContext(r.Context(), "DELETE FROM addresses WHERE id = $1 AND user_id = $2", vars["addressId"], userIdVar(r))
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("deleting address: %w", err))
+			return
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			writeAddressNotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+//writeAddressNotFound answers for an address id that doesnt exist or belongs to another user, which look the same to the caller
+func writeAddressNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, codeNotFound, fmt.Sprintf("address %s does not exist", mux.Vars(r)["addressId"]))
+}
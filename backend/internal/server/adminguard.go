@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net/http"
+	"net/netip"
+	"slices"
+
+	"github.com/gorilla/mux"
+)
+
+//adminNetworkGuard lets the requests of the destructive admin routes through only from the allowed networks
+//(ADMIN_ALLOWED_NETWORKS), like the office vpn, so leaked admin credentials arent enough from anywhere else.
+//the address is the one withClientIP resolved through the trusted proxies. it goes before the authentication, a
+//request from outside is refused without its credentials ever being looked at. no networks is no restriction
+func adminNetworkGuard(allowed []netip.Prefix) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if len(allowed) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := clientIP(r)
+			//a zone like %eth0 keeps an address from matching any network
+			addr, err := netip.ParseAddr(ip)
+			addr = addr.Unmap().WithZone("")
+			if err == nil && slices.ContainsFunc(allowed, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+				loggerFrom(r.Context()).Debug("admin network allowed", "client_ip", ip)
+				next.ServeHTTP(w, r)
+				return
+			}
+			loggerFrom(r.Context()).Warn("admin request from outside the allowed networks refused", "client_ip", ip)
+			writeError(w, r, http.StatusForbidden, codeNetworkNotAllowed, "admin operations are not allowed from this network")
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//api keys look like uk_<id>_<secret>. the id lets us find the row directly, only a hash of the secret is stored
+const apiKeyPrefix = "uk_"
+
+//ApiKey is an api key as shown to admins. Key is only filled in the response that creates it
+type ApiKey struct {
+	XMLName    xml.Name   `json:"-" xml:"api_key"`
+	Id         model.ID   `json:"id" xml:"id"`
+	Label      string     `json:"label" xml:"label"`
+	Role       string     `json:"role" xml:"role"`
+	Key        string     `json:"key,omitempty" xml:"key,omitempty"`
+	CreatedAt  time.Time  `json:"created_at" xml:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at" xml:"last_used_at,omitempty"`
+	//RateLimitPerMinute is the key's own quota, keys without one share the default rate limit
+	RateLimitPerMinute *int `json:"rate_limit_per_minute,omitempty" xml:"rate_limit_per_minute,omitempty"`
+}
+
+//apiKeyIdentity is what an authenticated api key stands for
+type apiKeyIdentity struct {
+	Id   int
+	Role string
+	//RateLimitPerMinute is zero when the key uses the default rate limit
+	RateLimitPerMinute int
+}
+
+//errApiKeyInvalid is returned for malformed, unknown and wrong keys alike
+var errApiKeyInvalid = errors.New("api key is invalid")
+
+//authenticateApiKey checks a key from the X-API-Key header and returns what it stands for
+//every successful check counts as one request in the key's usage for the day
+//the secret is compared in constant time so response timing doesnt leak how much of it was right
+func authenticateApiKey(ctx context.Context, db *sql.DB, key string) (apiKeyIdentity, error) {
+	idPart, secret, ok := strings.Cut(strings.TrimPrefix(key, apiKeyPrefix), "_")
+	if !ok || !strings.HasPrefix(key, apiKeyPrefix) {
+		return apiKeyIdentity{}, errApiKeyInvalid
+	}
+	id, err := strconv.Atoi(idPart)
+	if err != nil {
+		return apiKeyIdentity{}, errApiKeyInvalid
+	}
+
+	k := apiKeyIdentity{Id: id}
+	var storedHash string
+	err = db.QueryRowContext(ctx, "SELECT key_hash, role, COALESCE(rate_limit_per_minute, 0) FROM api_keys WHERE id = $1", id).
+		Scan(&storedHash, &k.Role, &k.RateLimitPerMinute)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apiKeyIdentity{}, errApiKeyInvalid
+	}
+	if err != nil {
+		return apiKeyIdentity{}, fmt.Errorf("loading api key: %w", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(storedHash)) != 1 {
+		return apiKeyIdentity{}, errApiKeyInvalid
+	}
+
+	//the use of a key isnt recorded on a read only database
+	if readOnlyDatabase {
+		return k, nil
+	}
+	if err := recordApiKeyUse(ctx, db, id, time.Now().UTC()); err != nil {
+		return apiKeyIdentity{}, fmt.Errorf("recording api key use: %w", err)
+	}
+	return k, nil
+}
+
+//recordApiKeyUse sets when key id was last used and counts the request for the day in utc. the day is counted up when
+//it has a row already and gets one otherwise, a concurrent request that inserted it first makes the insert fail and
+//it is counted up after all
+func recordApiKeyUse(ctx context.Context, db *sql.DB, id int, now time.Time) error {
+	if _, err := db.ExecContext(ctx, "UPDATE api_keys SET last_used_at = $2 WHERE id = $1", id, now); err != nil {
+		return err
+	}
+	day := now.Format(time.DateOnly)
+	countUp := func() (bool, error) {
+		res, err := db.ExecContext(ctx, "UPDATE api_key_usage SET requests = requests + 1 WHERE api_key_id = $1 AND day = $2", id, day)
+		if err != nil {
+			return false, err
+		}
+		n, err := res.RowsAffected()
+		return n > 0, err
+	}
+	if counted, err := countUp(); counted || err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, "INSERT INTO api_key_usage (api_key_id, day, requests) VALUES ($1, $2, 1)", id, day)
+	if store.IsUniqueViolation(err) {
+		_, err = countUp()
+	}
+	return err
+}
+
+//apiKeyRequest is the body of POST /api/v1/apikeys
+type apiKeyRequest struct {
+	Label string `json:"label"`
+	//role the key acts with, member (read only) unless admin is asked for
+	Role string `json:"role"`
+	//own quota for busy callers like sync jobs, left out to use the default rate limit
+	RateLimitPerMinute *int `json:"rate_limit_per_minute"`
+}
+
+//createApiKey generates a new key. the plaintext key is in this response and nowhere else, it cant be shown again
+func createApiKey(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body apiKeyRequest
+		if err := decodeRequest(r, &body); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+		body.Label = strings.TrimSpace(body.Label)
+		errs := model.FieldErrors{}
+		if body.Label == "" {
+			errs["label"] = "is required"
+		}
+		if body.Role == "" {
+			body.Role = model.RoleMember
+		} else if !model.ValidRole(body.Role) {
+			errs["role"] = "must be one of admin, member"
+		}
+		if body.RateLimitPerMinute != nil && *body.RateLimitPerMinute <= 0 {
+			errs["rate_limit_per_minute"] = "must be a positive number"
+		}
+		if len(errs) > 0 {
+			writeValidationError(w, r, errs)
+			return
+		}
+
+		secret, err := randomToken(32)
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		var createdBy sql.NullInt64
+		if p, ok := principalFromContext(r.Context()); ok && p.UserId != 0 {
+			createdBy = sql.NullInt64{Int64: int64(p.UserId), Valid: true}
+		}
+
+		//the key is read back by the hash of its random secret, mysql has no RETURNING
+		k := ApiKey{Label: body.Label, Role: body.Role, RateLimitPerMinute: body.RateLimitPerMinute}
+		_, err = db.ExecContext(r.Context(), "INSERT INTO api_keys (label, role, key_hash, created_by, rate_limit_per_minute) VALUES ($1, $2, $3, $4, $5)",
+			k.Label, k.Role, hashToken(secret), createdBy, body.RateLimitPerMinute)
+		if err == nil {
+			err = db.QueryRowContext(r.Context(), "SELECT id, created_at FROM api_keys WHERE key_hash = $1", hashToken(secret)).Scan(&k.Id, &k.CreatedAt)
+		}
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("creating api key: %w", err))
+			return
+		}
+		k.Key = fmt.Sprintf("%s%d_%s", apiKeyPrefix, k.Id, secret)
+
+		w.Header().Set("Location", externalURL(r, apiPath(fmt.Sprintf("/api/v1/apikeys/%d", k.Id))))
+		writeResponse(w, r, http.StatusCreated, k)
+	}
+}
+
+//deleteApiKey revokes a key, requests using it fail from then on
+func deleteApiKey(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		res, err := db.ExecContext(r.Context(), "DELETE FROM api_keys WHERE id = $1", id)
+		var deleted int64
+		if err == nil {
+			deleted, err = res.RowsAffected()
+		}
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("deleting api key: %w", err))
+			return
+		}
+		if deleted == 0 {
+			writeError(w, r, http.StatusNotFound, codeNotFound, fmt.Sprintf("api key %s does not exist", id))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+//maxUsageDays is how far back GET /api/v1/apikeys/{id}/usage can look
+const maxUsageDays = 366
+
+//apiKeyDay is the number of requests an api key made on one utc day
+type apiKeyDay struct {
+	Day      string `json:"day" xml:"day"`
+	Requests int64  `json:"requests" xml:"requests"`
+}
+
+//apiKeyUsage is the body of GET /api/v1/apikeys/{id}/usage
+type apiKeyUsage struct {
+	XMLName  xml.Name    `json:"-" xml:"usage"`
+	ApiKeyId model.ID    `json:"api_key_id" xml:"api_key_id"`
+	Days     []apiKeyDay `json:"days" xml:"day"`
+}
+
+//getApiKeyUsage returns the daily request totals of a key, newest first
+//?days= is how many days back to look (default 30), days without requests are left out
+func getApiKeyUsage(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		days := 30
+		if v := r.URL.Query().Get("days"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxUsageDays {
+				writeError(w, r, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("days must be a number between 1 and %d", maxUsageDays))
+				return
+			}
+			days = n
+		}
+
+		usage := apiKeyUsage{Days: []apiKeyDay{}}
+		err := db.QueryRowContext(r.Context(), "SELECT id FROM api_keys WHERE id = $1", id).Scan(&usage.ApiKeyId)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, http.StatusNotFound, codeNotFound, fmt.Sprintf("api key %s does not exist", id))
+			return
+		}
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("loading api key: %w", err))
+			return
+		}
+
+		since := time.Now().UTC().AddDate(0, 0, -days).Format(time.DateOnly)
+		rows, err := db.QueryContext(r.Context(), `SELECT day, requests FROM api_key_usage
+			WHERE api_key_id = $1 AND day > $2 ORDER BY day DESC`, usage.ApiKeyId, since)
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("loading api key usage: %w", err))
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var (
+				d   apiKeyDay
+				day time.Time
+			)
+			if err := rows.Scan(&day, &d.Requests); err != nil {
+				internalServerError(w, r, fmt.Errorf("scanning api key usage: %w", err))
+				return
+			}
+			d.Day = day.Format(time.DateOnly)
+			usage.Days = append(usage.Days, d)
+		}
+		if err := rows.Err(); err != nil {
+			internalServerError(w, r, fmt.Errorf("loading api key usage: %w", err))
+			return
+		}
+		writeResponse(w, r, http.StatusOK, usage)
+	}
+}
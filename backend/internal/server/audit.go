@@ -0,0 +1,300 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"api/internal/model"
+)
+
+//audit actions
+const (
+	auditImpersonationStarted = "impersonation.started"
+	auditImpersonatedRequest  = "impersonation.request"
+	auditUserCreated          = "user.created"
+	auditUserUpdated          = "user.updated"
+	auditUserDeleted          = "user.deleted"
+	auditUserActivated        = "user.activated"
+	auditUserDeactivated      = "user.deactivated"
+	auditUserEmailChanged     = "user.email_changed"
+	auditUserPasswordChanged  = "user.password_changed"
+	auditUserPasswordReset    = "user.password_reset"
+	auditUserExported         = "user.exported"
+	auditUserMerged           = "user.merged"
+	auditUserMergedInto       = "user.merged_into"
+	auditDumpExported         = "dump.exported"
+	auditDumpImported         = "dump.imported"
+
+	//the details of user.credentials_revoked count what was revoked of each kind, see revokedCredentials
+	auditUserCredentialsRevoked = "user.credentials_revoked"
+)
+
+//auditEvent is one row of the audit log
+//actorId is who really did it: the admin while impersonating, the user otherwise. zero ids are stored as null.
+//IP is the address of the client, recordAudit takes it from the request when it is empty
+type auditEvent struct {
+	ActorId            int64
+	ActorApiKeyId      int
+	ImpersonatedUserId int64
+	IP                 string
+	Action             string
+	TargetUserId       int64
+	Diff               fieldDiff
+	Details            any
+}
+
+//fieldChange is the before and after value of one field, either side is missing when the user was created or deleted
+type fieldChange struct {
+	Before any `json:"before,omitempty"`
+	After  any `json:"after,omitempty"`
+}
+
+//fieldDiff maps a changed field to its change
+type fieldDiff map[string]fieldChange
+
+//unauditedFields never go into a diff. updated_at and the etag version change on every write anyway, and the password
+//is only ever set on create (as a hash that isnt even part of User), it is listed here so it can never leak
+var unauditedFields = map[string]bool{"updated_at": true, "password": true}
+
+//userDiff compares two users field by field using their json representation, before or after is nil on create and delete
+func userDiff(before, after *model.User) (fieldDiff, error) {
+	b, err := userFields(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := userFields(after)
+	if err != nil {
+		return nil, err
+	}
+	diff := fieldDiff{}
+	for name := range b {
+		if !unauditedFields[name] && !reflect.DeepEqual(b[name], a[name]) {
+			diff[name] = fieldChange{Before: b[name], After: a[name]}
+		}
+	}
+	for name := range a {
+		if _, ok := b[name]; !ok && !unauditedFields[name] {
+			diff[name] = fieldChange{After: a[name]}
+		}
+	}
+	return diff, nil
+}
+
+func userFields(u *model.User) (map[string]any, error) {
+	fields := map[string]any{}
+	if u == nil {
+		return fields, nil
+	}
+	encoded, err := json.Marshal(u)
+	if err != nil {
+		return nil, fmt.Errorf("encoding user for audit: %w", err)
+	}
+	return fields, json.Unmarshal(encoded, &fields)
+}
+
+//auditUserChange records a change to a user made by the caller in ctx, pass the transaction the change was made in
+func auditUserChange(ctx context.Context, tx execer, action string, before, after *model.User) error {
+	diff, err := userDiff(before, after)
+	if err != nil {
+		return err
+	}
+	e := auditEventFor(ctx, action)
+	e.Diff = diff
+	if after != nil {
+		e.TargetUserId = int64(after.Id)
+	} else if before != nil {
+		e.TargetUserId = int64(before.Id)
+	}
+	return recordAudit(ctx, tx, e)
+}
+
+//auditEventFor starts an event with the caller in ctx as the actor
+func auditEventFor(ctx context.Context, action string) auditEvent {
+	e := auditEvent{Action: action}
+	if p, ok := principalFromContext(ctx); ok {
+		e.ActorId, e.ActorApiKeyId = p.UserId, p.ApiKeyId
+		if p.ImpersonatorId != 0 {
+			e.ActorId, e.ImpersonatedUserId = p.ImpersonatorId, p.UserId
+		}
+	}
+	return e
+}
+
+//nullableId maps the zero id to sql null
+func nullableId[T ~int | ~int64](id T) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
+
+//nullableJSON encodes v for a jsonb column, nil becomes sql null
+func nullableJSON(v any) (sql.NullString, error) {
+	if v == nil {
+		return sql.NullString{}, nil
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("encoding audit event: %w", err)
+	}
+	return sql.NullString{String: string(encoded), Valid: true}, nil
+}
+
+//recordAudit writes an event to the audit log. pass a transaction to make the event part of the change it describes
+func recordAudit(ctx context.Context, db execer, e auditEvent) error {
+	details, diff, err := encodeAudit(ctx, &e)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, insertAuditEvent,
+		nullableId(e.ActorId), nullableId(e.ActorApiKeyId), nullableId(e.ImpersonatedUserId), e.Action, nullableId(e.TargetUserId), diff, details, nullableString(&e.IP))
+	if err != nil {
+		return fmt.Errorf("writing audit event: %w", err)
+	}
+	return nil
+}
+
+const insertAuditEvent = `INSERT INTO audit_events (actor_id, actor_api_key_id, impersonated_user_id, action, target_user_id, diff, details, ip)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+//encodeAudit fills in the ip of e from ctx when it has none and encodes its details and diff for their columns
+func encodeAudit(ctx context.Context, e *auditEvent) (details, diff sql.NullString, err error) {
+	if e.IP == "" {
+		e.IP = clientIPFrom(ctx)
+	}
+	if details, err = nullableJSON(e.Details); err != nil {
+		return details, diff, err
+	}
+	if len(e.Diff) > 0 {
+		diff, err = nullableJSON(e.Diff)
+	}
+	return details, diff, err
+}
+
+//auditImpersonation logs the request, with the admin behind it, to the audit log and then runs the handler. it is used
+//by authMiddleware for every request made with an impersonation token. the trail is mandatory: a request that cant be
+//logged is refused before the handler runs, and the status it answered with is added to the event afterwards
+func auditImpersonation(db *sql.DB, p principal, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	//a read only database cant take the event, so nothing can be done as someone else on it
+	if readOnlyDatabase {
+		writeError(w, r, http.StatusServiceUnavailable, codeReadOnly, "impersonation needs the audit log, which this read only instance cant write")
+		return
+	}
+	//the event is written even if the client goes away or the deadline passes while the request runs
+	ctx := context.WithoutCancel(r.Context())
+	request := map[string]any{"method": r.Method, "path": r.URL.Path}
+	e := auditEvent{ActorId: p.ImpersonatorId, ImpersonatedUserId: p.UserId, Action: auditImpersonatedRequest, Details: request}
+	details, _, err := encodeAudit(ctx, &e)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	id, err := insertId(ctx, db, insertAuditEvent,
+		nullableId(e.ActorId), nullableId(e.ActorApiKeyId), nullableId(e.ImpersonatedUserId), e.Action, nullableId(e.TargetUserId), nil, details, nullableString(&e.IP))
+	if err != nil {
+		internalServerError(w, r, fmt.Errorf("auditing impersonated request: %w", err))
+		return
+	}
+
+	rec := &statusRecorder{ResponseWriter: w}
+	next.ServeHTTP(rec, r)
+	request["status"] = rec.status
+	if details, err = nullableJSON(request); err == nil {
+		_, err = db.ExecContext(ctx, "UPDATE audit_events SET details = $1 WHERE id = $2", details, id)
+	}
+	if err != nil {
+		loggerFrom(r.Context()).Error("adding the status to the audit of an impersonated request", "user_id", p.UserId, "impersonator_id", p.ImpersonatorId, "error", err)
+	}
+}
+
+//auditEntry is an audit event as returned by the api
+type auditEntry struct {
+	Id                 model.ID        `json:"id" xml:"id"`
+	CreatedAt          time.Time       `json:"created_at" xml:"created_at"`
+	ActorId            *model.ID       `json:"actor_id" xml:"actor_id,omitempty"`
+	ActorApiKeyId      *model.ID       `json:"actor_api_key_id,omitempty" xml:"actor_api_key_id,omitempty"`
+	ImpersonatedUserId *model.ID       `json:"impersonated_user_id,omitempty" xml:"impersonated_user_id,omitempty"`
+	Action             string          `json:"action" xml:"action"`
+	IP                 string          `json:"ip,omitempty" xml:"ip,omitempty"`
+	Diff               json.RawMessage `json:"diff,omitempty" xml:"diff,omitempty"`
+	Details            json.RawMessage `json:"details,omitempty" xml:"details,omitempty"`
+}
+
+//auditPage is one page of a user's audit log, newest first
+//nextBefore is the value for ?before= to get the next (older) page, it is left out on the last page
+type auditPage struct {
+	XMLName    xml.Name     `json:"-" xml:"audit"`
+	Events     []auditEntry `json:"events" xml:"event"`
+	NextBefore int64        `json:"next_before,omitempty" xml:"next_before,omitempty"`
+}
+
+//getUserAudit lists the audit events about a user, newest first
+//?limit= sets the page size (see parsePage), ?before= continues after the last event of the previous page.
+//?offset= skips events too, before is the better choice for paging through a log that grows while it is read
+//the log is kept for deleted users too, so an unknown id simply has no events
+func getUserAudit(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := userIdVar(r)
+		p, ok := parsePage(w, r)
+		if !ok {
+			return
+		}
+		limit := p.Limit
+		var before int64
+		if v := r.URL.Query().Get("before"); v != "" {
+			parsed, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || parsed < 1 {
+				writeValidationError(w, r, model.FieldErrors{"before": "must be an event id"})
+				return
+			}
+			before = parsed
+		}
+
+		//one extra row tells whether there is another page
+		rows, err := db.QueryContext(r.Context(), `SELECT id, created_at, actor_id, actor_api_key_id, impersonated_user_id, action, COALESCE(ip, ''), diff, details
+			FROM audit_events WHERE target_user_id = $1 AND ($2 = 0 OR id < $2) ORDER BY id DESC LIMIT $3 OFFSET $4`, id, before, limit+1, p.Offset)
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("listing audit events: %w", err))
+			return
+		}
+		defer rows.Close()
+
+		page := auditPage{Events: []auditEntry{}}
+		for rows.Next() {
+			var (
+				e                                 auditEntry
+				actorId, apiKeyId, impersonatedId sql.NullInt64
+				diff, details                     []byte
+			)
+			if err := rows.Scan(&e.Id, &e.CreatedAt, &actorId, &apiKeyId, &impersonatedId, &e.Action, &e.IP, &diff, &details); err != nil {
+				internalServerError(w, r, fmt.Errorf("reading audit event: %w", err))
+				return
+			}
+			e.ActorId, e.ActorApiKeyId, e.ImpersonatedUserId = optionalId[model.ID](actorId), optionalId[model.ID](apiKeyId), optionalId[model.ID](impersonatedId)
+			e.Diff, e.Details = diff, details
+			page.Events = append(page.Events, e)
+		}
+		if err := rows.Err(); err != nil {
+			internalServerError(w, r, fmt.Errorf("listing audit events: %w", err))
+			return
+		}
+		if len(page.Events) > limit {
+			page.Events = page.Events[:limit]
+			page.NextBefore = int64(page.Events[limit-1].Id)
+		}
+		writeResponse(w, r, http.StatusOK, page)
+	}
+}
+
+//optionalId maps sql null to nil, T is int64 for user ids and int for the other ids
+func optionalId[T ~int | ~int64](id sql.NullInt64) *T {
+	if !id.Valid {
+		return nil
+	}
+	v := T(id.Int64)
+	return &v
+}
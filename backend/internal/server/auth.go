@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"api/internal/model"
+)
+
+//principal is whoever made an authenticated request: a user with an access token, or a machine with an api key
+type principal struct {
+	UserId   int64
+	ApiKeyId int
+	//impersonatorId is the admin acting as UserId with an impersonation token, zero otherwise
+	ImpersonatorId int64
+	//role is looked up on every request, so demoting someone takes effect immediately and not when their token expires
+	Role string
+	//Locale is the locale the user picked, empty when they didnt, see userLocale
+	Locale string
+}
+
+//contextKey is unexported so no other package can collide with the values we put into a request context
+type contextKey int
+
+const (
+	principalKey contextKey = iota
+	//routeLabelKey holds a *string the router fills in with the matched route template, see metricsMiddleware
+	routeLabelKey
+	//apiKeyCheckKey holds the apiKeyCheck of the request's X-API-Key, see identifyApiKey
+	apiKeyCheckKey
+	//clientIPKey holds the address of the client behind the request, see withClientIP
+	clientIPKey
+	//bodyCaptureKey holds the *bodyCapture of the request, see captureBodies
+	bodyCaptureKey
+	//forwardedBaseKey holds where a trusted proxy says the server is reached, see withForwardedBase
+	forwardedBaseKey
+	//writeRefusalKey holds the writeRefusal of a graphql request made while writes are refused, see refuseWritesInMaintenance
+	writeRefusalKey
+	//welcomeJobsKey holds the *jobQueue RecordUserChange queues the welcome email of a created user on, see userService.create
+	welcomeJobsKey
+)
+
+//principalFromContext returns the authenticated caller stored by authMiddleware
+func principalFromContext(ctx context.Context) (principal, bool) {
+	p, ok := ctx.Value(principalKey).(principal)
+	return p, ok
+}
+
+//apiKeyCheck is the outcome of checking a request's X-API-Key, err is set when the key was rejected or the lookup failed
+type apiKeyCheck struct {
+	key apiKeyIdentity
+	err error
+}
+
+//identifyApiKey checks the X-API-Key header once, before the rate limiter, so requests can be limited per key
+//authMiddleware reuses the result instead of looking the key up again. a rejected key is not answered here,
+//the request goes on anonymously and authMiddleware answers 401 where auth is required
+func identifyApiKey(db *sql.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if key := r.Header.Get("X-API-Key"); key != "" {
+				var c apiKeyCheck
+				c.key, c.err = authenticateApiKey(r.Context(), db, key)
+				r = r.WithContext(context.WithValue(r.Context(), apiKeyCheckKey, c))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+//apiKeyFromContext returns the api key identifyApiKey authenticated, false for anonymous requests and rejected keys
+func apiKeyFromContext(ctx context.Context) (apiKeyIdentity, bool) {
+	c, ok := ctx.Value(apiKeyCheckKey).(apiKeyCheck)
+	return c.key, ok && c.err == nil
+}
+
+//bearerToken extracts the token from an "Authorization: Bearer <token>" header
+func bearerToken(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return "", errors.New("missing Authorization header")
+	}
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", errors.New("Authorization header must have the form \"Bearer <token>\"")
+	}
+	return strings.TrimSpace(token), nil
+}
+
+//parseAccessToken checks the signature and expiry of an access token and returns its claims
+//only hs256 is accepted, so tokens claiming "alg": "none" or any other algorithm are rejected
+func parseAccessToken(token string) (*accessClaims, error) {
+	claims := &accessClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (any, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+//errUserGone means the user a token or session was issued for has been deleted since, errUserDeactivated that they were offboarded
+var (
+	errUserGone        = errors.New("user no longer exists")
+	errUserDeactivated = errors.New("user is deactivated")
+)
+
+//userPrincipal loads the current role of an authenticated user
+//tokens and sessions can outlive the user they were issued for
+func userPrincipal(ctx context.Context, db *sql.DB, userId int64) (principal, error) {
+	p, _, err := userPrincipalRevoked(ctx, db, userId)
+	return p, err
+}
+
+//userPrincipalRevoked is userPrincipal plus when the credentials of the user were last revoked, for checking an access
+//token against it with checkCredentialsRevoked in the same query
+func userPrincipalRevoked(ctx context.Context, db *sql.DB, userId int64) (principal, sql.NullTime, error) {
+	var (
+		role, locale string
+		active       bool
+		revokedAt    sql.NullTime
+	)
+	err := db.QueryRowContext(ctx, "SELECT role, active, credentials_revoked_at, COALESCE(locale, '') FROM users WHERE id = $1", userId).Scan(&role, &active, &revokedAt, &locale)
+	if errors.Is(err, sql.ErrNoRows) {
+		return principal{}, revokedAt, errUserGone
+	}
+	if err != nil {
+		return principal{}, revokedAt, fmt.Errorf("loading role: %w", err)
+	}
+	if !active {
+		return principal{}, revokedAt, errUserDeactivated
+	}
+	return principal{UserId: userId, Role: role, Locale: locale}, revokedAt, nil
+}
+
+//writeUnauthorized answers with 401 and tells the client which auth scheme we expect
+func writeUnauthorized(w http.ResponseWriter, r *http.Request, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+	writeError(w, r, http.StatusUnauthorized, codeUnauthorized, message)
+}
+
+//authMiddleware only lets requests with a valid access token, session cookie or api key through to the next handler
+//an Authorization header wins over a session cookie, so a browser that has both acts as whoever the token says
+//the caller is put into the request context, handlers read it with principalFromContext
+func authMiddleware(db *sql.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			//batch jobs send an api key instead of going through the login flow
+			if key := r.Header.Get("X-API-Key"); key != "" {
+				c, checked := r.Context().Value(apiKeyCheckKey).(apiKeyCheck)
+				if !checked {
+					c.key, c.err = authenticateApiKey(r.Context(), db, key)
+				}
+				k, err := c.key, c.err
+				if errors.Is(err, errApiKeyInvalid) {
+					writeUnauthorized(w, r, err.Error())
+					return
+				}
+				if err != nil {
+					internalServerError(w, r, err)
+					return
+				}
+				p := principal{ApiKeyId: k.Id, Role: k.Role}
+				noteCaller(r.Context(), p)
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey, p)))
+				return
+			}
+
+			var userId, impersonatorId int64
+			//when the access token was issued, it is checked against a revocation of the user's credentials. sessions
+			//dont need the check, revoking deletes them
+			var issuedAt *time.Time
+			if cookie, err := r.Cookie(sessionCookie); err == nil && r.Header.Get("Authorization") == "" {
+				userId, err = sessionUser(r.Context(), db, cookie.Value)
+				if errors.Is(err, errSessionInvalid) {
+					writeUnauthorized(w, r, err.Error())
+					return
+				}
+				if err != nil {
+					internalServerError(w, r, err)
+					return
+				}
+			} else {
+				token, err := bearerToken(r)
+				if err != nil {
+					writeUnauthorized(w, r, err.Error())
+					return
+				}
+				claims, err := parseAccessToken(token)
+				if err != nil {
+					writeUnauthorized(w, r, "access token is invalid or expired")
+					return
+				}
+				userId, err = strconv.ParseInt(claims.Subject, 10, 64)
+				if err != nil {
+					writeUnauthorized(w, r, "access token is invalid or expired")
+					return
+				}
+				issuedAt = &time.Time{}
+				if claims.IssuedAt != nil {
+					*issuedAt = claims.IssuedAt.Time
+				}
+				if claims.Act != nil {
+					impersonatorId, err = strconv.ParseInt(claims.Act.Subject, 10, 64)
+					if err != nil {
+						writeUnauthorized(w, r, "access token is invalid or expired")
+						return
+					}
+				}
+			}
+
+			p, revokedAt, err := userPrincipalRevoked(r.Context(), db, userId)
+			if errors.Is(err, errUserGone) {
+				writeUnauthorized(w, r, "the user you logged in as no longer exists")
+				return
+			}
+			if errors.Is(err, errUserDeactivated) {
+				writeError(w, r, http.StatusForbidden, codeAccountDeactivated, "your account has been deactivated")
+				return
+			}
+			if err != nil {
+				internalServerError(w, r, err)
+				return
+			}
+			if issuedAt != nil && checkCredentialsRevoked(*issuedAt, revokedAt) {
+				writeUnauthorized(w, r, "access token was revoked, log in again")
+				return
+			}
+			//an impersonation token stops working as soon as the admin behind it loses the admin role
+			//and when the credentials of that admin are revoked
+			if impersonatorId != 0 {
+				admin, adminRevokedAt, err := userPrincipalRevoked(r.Context(), db, impersonatorId)
+				if err != nil && !errors.Is(err, errUserGone) && !errors.Is(err, errUserDeactivated) {
+					internalServerError(w, r, err)
+					return
+				}
+				if err != nil || admin.Role != model.RoleAdmin || checkCredentialsRevoked(*issuedAt, adminRevokedAt) {
+					writeUnauthorized(w, r, "the admin this impersonation token was issued to is no longer allowed to impersonate")
+					return
+				}
+				p.ImpersonatorId = impersonatorId
+			}
+
+			noteCaller(r.Context(), p)
+			ctx := context.WithValue(r.Context(), principalKey, p)
+			if p.ImpersonatorId != 0 {
+				auditImpersonation(db, p, next, w, r.WithContext(ctx))
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
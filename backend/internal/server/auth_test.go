@@ -0,0 +1,83 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"api/internal/model"
+)
+
+//signedToken signs claims for u with method and key, for tokens the server never issues
+func signedToken(t *testing.T, u model.User, method jwt.SigningMethod, key any, expires time.Time) string {
+	t.Helper()
+	claims := jwt.RegisteredClaims{Subject: strconv.FormatInt(int64(u.Id), 10), IssuedAt: jwt.NewNumericDate(time.Now())}
+	if !expires.IsZero() {
+		claims.ExpiresAt = jwt.NewNumericDate(expires)
+	}
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAuthMiddlewareRefusesBadTokens(t *testing.T) {
+	ts := newTestServer(t, nil)
+	u := ts.createUser("Admin", "admin@example.com", model.RoleAdmin)
+	hour := time.Now().Add(time.Hour)
+
+	expired, _, err := signAccessToken(int64(u.Id), u.Email, -time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, header := range map[string]string{
+		"missing":           "",
+		"expired":           "Bearer " + expired,
+		"alg none":          "Bearer " + signedToken(t, u, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, hour),
+		"another algorithm": "Bearer " + signedToken(t, u, jwt.SigningMethodHS512, jwtSecret, hour),
+		"another secret":    "Bearer " + signedToken(t, u, jwt.SigningMethodHS256, []byte("not-the-secret-not-the-secret"), hour),
+		"no expiry":         "Bearer " + signedToken(t, u, jwt.SigningMethodHS256, jwtSecret, time.Time{}),
+		"not a jwt":         "Bearer not-a-token",
+		"no token":          "Bearer ",
+		"no scheme":         ts.tokenFor(u),
+		"basic":             "Basic YWRtaW46cGFzc3dvcmQ=",
+	} {
+		res := ts.do("GET", "/api/v1/users", "", nil, "Authorization", header)
+		if res.StatusCode != http.StatusUnauthorized || res.errorCode() != codeUnauthorized {
+			t.Fatalf("%s: got %d: %s", name, res.StatusCode, res.body)
+		}
+		if res.Header.Get("WWW-Authenticate") == "" {
+			t.Fatalf("%s: no WWW-Authenticate", name)
+		}
+	}
+
+	//the scheme is case insensitive
+	expect(t, ts.do("GET", "/api/v1/users", "", nil, "Authorization", "bearer "+ts.tokenFor(u)), http.StatusOK)
+	expect(t, ts.do("GET", "/api/v1/users", ts.tokenFor(u), nil), http.StatusOK)
+	//the token of a deleted user is refused
+	other := ts.createUser("Gone", "gone@example.com", model.RoleMember)
+	token := ts.tokenFor(other)
+	if _, err := ts.users.Delete(t.Context(), int64(other.Id), nil); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, ts.do("GET", "/api/v1/users", token, nil), http.StatusUnauthorized)
+}
+
+func TestLoginAndHealthArePublic(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.createUser("Ada", "ada@example.com", model.RoleMember)
+
+	expect(t, ts.do("GET", "/healthz", "", nil), http.StatusOK)
+	res := ts.do("POST", "/api/v1/login", "", map[string]any{"email": "ada@example.com", "password": "password123"})
+	expect(t, res, http.StatusOK)
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+	}
+	res.decode(t, &tokens)
+	//the token of the login opens the user routes
+	expect(t, ts.do("GET", "/api/v1/users", tokens.AccessToken, nil), http.StatusOK)
+}
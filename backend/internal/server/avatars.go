@@ -0,0 +1,310 @@
+package server
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//defaultAvatarMaxBytes caps avatar uploads when AVATAR_MAX_BYTES isnt set
+const defaultAvatarMaxBytes = 2 << 20
+
+//multipartOverhead is what a multipart body may carry on top of the image, the boundaries and part headers
+const multipartOverhead = 16 << 10
+
+//avatarConfig is how big a profile picture may be and where they are stored
+type avatarConfig struct {
+	maxBytes int64
+	blobs    blobStoreConfig
+}
+
+//avatarExtensions are the image types accepted as avatars, by the content type http.DetectContentType sniffs.
+//the extension ends up in the blob key, which is how the content type is known again when the avatar is served
+var avatarExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+//avatarHandlers serve the profile pictures. the picture is a blob, the user row only has its key
+type avatarHandlers struct {
+	db    *sql.DB
+	users store.UserStore
+	blobs BlobStore
+	//cache is nil when it is off, it has to forget a user whose avatar_url changed
+	cache    *userCache
+	events   eventBroker
+	maxBytes int64
+}
+
+func newAvatarHandlers(db *sql.DB, users store.UserStore, blobs BlobStore, cache *userCache, events eventBroker, maxBytes int64) *avatarHandlers {
+	return &avatarHandlers{db: db, users: users, blobs: blobs, cache: cache, events: events, maxBytes: maxBytes}
+}
+
+//bodyLimit is the body limit of the upload route, room for the biggest image in a multipart body
+func (h *avatarHandlers) bodyLimit() int64 {
+	return h.maxBytes + multipartOverhead
+}
+
+//put stores the image in the body as the avatar of the user in the path and answers with the user.
+//the image is either the whole body or the first file of a multipart/form-data body. its type is sniffed from the bytes,
+//the Content-Type of the request is ignored: browsers guess it from the file name
+func (h *avatarHandlers) put(w http.ResponseWriter, r *http.Request) {
+	id := userIdVar(r)
+	image, err := h.readImage(r)
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxErr) || errors.Is(err, errAvatarTooLarge):
+		writeBodyTooLarge(w, r, h.maxBytes)
+		return
+	case err != nil:
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	case len(image) == 0:
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "the image is missing, send it as the body or as a file of a multipart/form-data body")
+		return
+	}
+	contentType := http.DetectContentType(image)
+	ext, ok := avatarExtensions[contentType]
+	if !ok {
+		writeError(w, r, http.StatusUnsupportedMediaType, codeInvalidRequest, "the avatar must be a JPEG, PNG or WebP image")
+		return
+	}
+
+	//the key is named after the content, a new picture gets a new key and with it a new avatar_url
+	sum := sha256.Sum256(image)
+	key := fmt.Sprintf("avatars/%d/%x%s", id, sum[:8], ext)
+	if err := h.blobs.Put(r.Context(), key, contentType, image); err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	//when the database fails the new blob may or may not be the avatar now, it is kept to be safe
+	previous, found, err := h.swapKey(r, id, key)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	if !found {
+		h.deleteBlob(r, key)
+		writeUserNotFound(w, r, id)
+		return
+	}
+	if previous != "" && previous != key {
+		h.deleteBlob(r, previous)
+	}
+	u, err := h.changed(r, id)
+	if errors.Is(err, store.ErrUserNotFound) {
+		writeUserNotFound(w, r, id)
+		return
+	}
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", userETag(u))
+	writeResponse(w, r, http.StatusOK, u)
+}
+
+//get serves the avatar of the user in the path. with the ?v= of the current avatar_url the picture never changes,
+//so it may be cached for good, the bare url is revalidated with its etag every time
+func (h *avatarHandlers) get(w http.ResponseWriter, r *http.Request) {
+	id := userIdVar(r)
+	key, found, err := h.currentKey(r, id)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	if !found {
+		writeUserNotFound(w, r, id)
+		return
+	}
+	if key == "" {
+		writeNoAvatar(w, r, id)
+		return
+	}
+	version := model.AvatarVersion(key)
+	etag := `"` + version + `"`
+	if r.URL.Query().Get("v") == version {
+		w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+	w.Header().Set("ETag", etag)
+	if etagMatchesNoneMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	blob, err := h.blobs.Get(r.Context(), key)
+	if errors.Is(err, ErrBlobNotFound) {
+		writeNoAvatar(w, r, id)
+		return
+	}
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	defer blob.Close()
+	w.Header().Set("Content-Type", avatarContentType(key))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, blob)
+}
+
+//delete removes the avatar of the user in the path
+func (h *avatarHandlers) delete(w http.ResponseWriter, r *http.Request) {
+	id := userIdVar(r)
+	previous, found, err := h.swapKey(r, id, "")
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	if !found {
+		writeUserNotFound(w, r, id)
+		return
+	}
+	if previous == "" {
+		writeNoAvatar(w, r, id)
+		return
+	}
+	h.deleteBlob(r, previous)
+	if _, err := h.changed(r, id); err != nil && !errors.Is(err, store.ErrUserNotFound) {
+		internalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//errAvatarTooLarge is an image over the limit in a multipart body, whose parts are read without MaxBytesReader
+var errAvatarTooLarge = errors.New("avatar too large")
+
+//readImage reads the image of an upload, see put
+func (h *avatarHandlers) readImage(r *http.Request) ([]byte, error) {
+	body := io.Reader(r.Body)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		parts, err := r.MultipartReader()
+		if err != nil {
+			return nil, fmt.Errorf("reading the multipart body: %w", err)
+		}
+		for {
+			part, err := parts.NextPart()
+			if err == io.EOF {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("reading the multipart body: %w", err)
+			}
+			if part.FileName() != "" {
+				body = part
+				break
+			}
+		}
+	}
+	image, err := io.ReadAll(io.LimitReader(body, h.maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(image)) > h.maxBytes {
+		return nil, errAvatarTooLarge
+	}
+	return image, nil
+}
+
+//currentKey is the blob key of the avatar of user id, empty without one. found is false when the user doesnt exist
+func (h *avatarHandlers) currentKey(r *http.Request, id int64) (key string, found bool, err error) {
+	err = h.db.QueryRowContext(r.Context(), "SELECT COALESCE(avatar_key, '') FROM users WHERE id = $1", id).Scan(&key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("loading avatar key: %w", err)
+	}
+	return key, true, nil
+}
+
+//swapKey makes key the avatar of user id and returns the key it replaces, "" removes the avatar.
+//the write only goes through while the avatar is still the one read before, so of two uploads at the same time
+//each one learns which blob it replaced and none is left behind
+func (h *avatarHandlers) swapKey(r *http.Request, id int64, key string) (previous string, found bool, err error) {
+	for {
+		previous, found, err = h.currentKey(r, id)
+		if err != nil || !found || previous == key {
+			return previous, found, err
+		}
+		swapped, err := h.trySwapKey(r, id, previous, key)
+		if err != nil {
+			return "", false, err
+		}
+		if swapped {
+			h.cache.forget(r.Context(), id)
+			return previous, true, nil
+		}
+	}
+}
+
+//trySwapKey replaces the avatar key previous of user id with key, swapped is false when previous isnt the key anymore
+func (h *avatarHandlers) trySwapKey(r *http.Request, id int64, previous, key string) (swapped bool, err error) {
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		return false, fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(r.Context(), `UPDATE users SET avatar_key = NULLIF($2, ''), version = version + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND COALESCE(avatar_key, '') = $3`, id, key, previous)
+	if err != nil {
+		return false, fmt.Errorf("updating avatar key: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	var u model.User
+	if err := store.ScanUser(tx.QueryRowContext(r.Context(), "SELECT "+store.UserColumns+" FROM users WHERE id = $1", id), &u); err != nil {
+		return false, fmt.Errorf("loading user: %w", err)
+	}
+	if err := enqueueOutbox(r.Context(), tx, outboxUserUpdated, u); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("updating avatar key: %w", err)
+	}
+	return true, nil
+}
+
+//changed reloads user id after its avatar changed and tells the live event stream
+func (h *avatarHandlers) changed(r *http.Request, id int64) (model.User, error) {
+	u, err := h.users.Get(r.Context(), id)
+	if err != nil {
+		return model.User{}, err
+	}
+	h.events.Publish(userEvent{Type: eventUserUpdated, User: u})
+	return u, nil
+}
+
+//deleteBlob removes a blob that is no longer needed. failing to is only logged, the blob is left over then but the request succeeded
+func (h *avatarHandlers) deleteBlob(r *http.Request, key string) {
+	if err := h.blobs.Delete(r.Context(), key); err != nil {
+		loggerFrom(r.Context()).Error("deleting replaced avatar", "key", key, "error", err)
+	}
+}
+
+//avatarContentType is the content type of the avatar stored under key, by the extension avatarExtensions gave it
+func avatarContentType(key string) string {
+	for contentType, ext := range avatarExtensions {
+		if path.Ext(key) == ext {
+			return contentType
+		}
+	}
+	return "application/octet-stream"
+}
+
+func writeNoAvatar(w http.ResponseWriter, r *http.Request, id int64) {
+	writeError(w, r, http.StatusNotFound, codeNotFound, fmt.Sprintf("user %d has no avatar", id))
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/minio/minio-go/v7"
+	s3credentials "github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+//storage backends of BlobStore, AVATAR_STORAGE picks one
+const (
+	blobStorageDisk = "disk"
+	blobStorageS3   = "s3"
+)
+
+//ErrBlobNotFound is returned by BlobStore.Get for a key nothing is stored under
+var ErrBlobNotFound = errors.New("blob not found")
+
+//BlobStore keeps files too big for the database, like avatars. keys are paths like avatars/1/ab12.png
+//Delete of a key that doesnt exist succeeds, so cleaning up twice is harmless
+type BlobStore interface {
+	Put(ctx context.Context, key, contentType string, data []byte) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+//blobStoreConfig is where the blobs are kept: in a directory on local disk, or in an s3 compatible bucket
+type blobStoreConfig struct {
+	storage string
+	dir     string
+	s3      s3Config
+}
+
+//s3Config is an s3 compatible bucket. endpoint is a url like https://s3.eu-central-1.amazonaws.com or http://minio:9000,
+//without the keys the credentials come from the usual AWS_ variables or the instance role
+type s3Config struct {
+	endpoint        string
+	bucket          string
+	region          string
+	accessKeyId     string
+	secretAccessKey string
+}
+
+//newBlobStore opens the store configured in cfg
+func newBlobStore(cfg blobStoreConfig) (BlobStore, error) {
+	if cfg.storage == blobStorageS3 {
+		return newS3BlobStore(cfg.s3)
+	}
+	if err := os.MkdirAll(cfg.dir, 0o750); err != nil {
+		return nil, fmt.Errorf("creating blob directory: %w", err)
+	}
+	return diskBlobStore{dir: cfg.dir}, nil
+}
+
+//diskBlobStore keeps every blob as a file below dir, a key is its path relative to dir.
+//the content type isnt kept, readers go by the extension of the key
+type diskBlobStore struct {
+	dir string
+}
+
+//path maps key below dir, keys are made by the server but a key climbing out of dir is refused anyway
+func (s diskBlobStore) path(key string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(key)) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+//Put writes to a temporary file first and renames it, so a reader never sees half a blob
+func (s diskBlobStore) Put(ctx context.Context, key, contentType string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return fmt.Errorf("storing blob: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("storing blob: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("storing blob: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("storing blob: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("storing blob: %w", err)
+	}
+	return nil
+}
+
+func (s diskBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading blob: %w", err)
+	}
+	return f, nil
+}
+
+func (s diskBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("deleting blob: %w", err)
+	}
+	//the directory of the blob goes too once it is empty, removing one that isnt fails and is fine
+	if dir := filepath.Dir(path); dir != filepath.Clean(s.dir) {
+		os.Remove(dir)
+	}
+	return nil
+}
+
+//s3BlobStore keeps the blobs as objects in one bucket, a key is the object name
+type s3BlobStore struct {
+	client *minio.Client
+	bucket string
+}
+
+func newS3BlobStore(cfg s3Config) (*s3BlobStore, error) {
+	client, err := newS3Client(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &s3BlobStore{client: client, bucket: cfg.bucket}, nil
+}
+
+//CheckHealth checks that the blobs can be kept in dir, for /readyz
+func (s diskBlobStore) CheckHealth(ctx context.Context) error {
+	return checkDir(s.dir)
+}
+
+//CheckHealth checks that the bucket exists and can be reached with the credentials, for /readyz
+func (s *s3BlobStore) CheckHealth(ctx context.Context) error {
+	return checkBucket(ctx, s.client, s.bucket)
+}
+
+//checkDir returns an error unless dir is a directory
+func checkDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
+
+//checkBucket returns an error unless the bucket exists and client may see it
+func checkBucket(ctx context.Context, client *minio.Client, bucket string) error {
+	exists, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("bucket %s does not exist", bucket)
+	}
+	return nil
+}
+
+//newS3Client connects to the endpoint of cfg, the bucket is named in every call
+func newS3Client(cfg s3Config) (*minio.Client, error) {
+	endpoint, err := url.Parse(cfg.endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "https" && endpoint.Scheme != "http") {
+		return nil, fmt.Errorf("s3 endpoint must be a url like https://s3.amazonaws.com, got %q", cfg.endpoint)
+	}
+	creds := s3credentials.NewIAM("")
+	if cfg.accessKeyId != "" {
+		creds = s3credentials.NewStaticV4(cfg.accessKeyId, cfg.secretAccessKey, "")
+	} else if os.Getenv("AWS_ACCESS_KEY_ID") != "" {
+		creds = s3credentials.NewEnvAWS()
+	}
+	client, err := minio.New(endpoint.Host, &minio.Options{
+		Creds:  creds,
+		Secure: endpoint.Scheme == "https",
+		Region: cfg.region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating s3 client: %w", err)
+	}
+	return client, nil
+}
+
+func (s *s3BlobStore) Put(ctx context.Context, key, contentType string, data []byte) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		return fmt.Errorf("storing blob: %w", err)
+	}
+	return nil
+}
+
+//Get checks the object exists before handing it out, GetObject only fails on the first read otherwise
+func (s *s3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("reading blob: %w", err)
+	}
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		if minio.ToErrorResponse(err).Code == minio.NoSuchKey {
+			return nil, ErrBlobNotFound
+		}
+		return nil, fmt.Errorf("reading blob: %w", err)
+	}
+	return obj, nil
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, key string) error {
+	//removing an object that doesnt exist succeeds on s3 already
+	if err := s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("deleting blob: %w", err)
+	}
+	return nil
+}
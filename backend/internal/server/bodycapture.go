@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"api/internal/model"
+)
+
+//body capture defaults
+const (
+	defaultBodyCaptureMaxBytes     = 4096 //DEBUG_BODY_MAX_BYTES
+	defaultBodyCaptureRedactFields = "password,current_password,new_password,token,access_token,refresh_token,id_token,api_key,key,secret,client_secret,code"
+)
+
+//bodyCaptureHeader asks for the bodies of one request to be logged, it only counts for admins
+const bodyCaptureHeader = "X-Debug-Body"
+
+//bodyCaptureConfig is whether the access log carries the request and response bodies, see captureBodies
+type bodyCaptureConfig struct {
+	//always captures every request, without it only admins that send bodyCaptureHeader get theirs logged
+	always bool
+	//maxBytes is how much of each body is kept, the rest is cut off
+	maxBytes int
+	//redact are the json fields and form values whose values are never logged, compared ignoring case
+	redact []string
+}
+
+//bodyCapture is what captureBodies keeps of one request for the access log
+type bodyCapture struct {
+	//captured is set when captureBodies kept the bodies, requested when that was only because of bodyCaptureHeader
+	captured  bool
+	requested bool
+	admin     bool
+	request   *cappedBuffer
+	response  *cappedBuffer
+	redact    map[string]bool
+	//requestType and responseType are the content types of the bodies, for the redaction
+	requestType, responseType string
+}
+
+//withBodyCaptureSlot puts an empty capture into the request context for captureBodies to fill, the access log reads it
+//once the handler is done
+func withBodyCaptureSlot(r *http.Request) (*http.Request, *bodyCapture) {
+	c := &bodyCapture{}
+	return r.WithContext(context.WithValue(r.Context(), bodyCaptureKey, c)), c
+}
+
+//noteCaller tells the capture of the request who the caller is, authMiddleware calls it.
+//bodyCaptureHeader is only honored for admins, everyone else could fill the logs with it
+func noteCaller(ctx context.Context, p principal) {
+	if c, ok := ctx.Value(bodyCaptureKey).(*bodyCapture); ok {
+		c.admin = p.Role == model.RoleAdmin
+	}
+}
+
+//captureBodies keeps the first cfg.maxBytes of the request and the response body of every request when cfg.always is
+//set, and of the requests that carry bodyCaptureHeader otherwise. the handler still reads the whole request body,
+//what it reads is copied on the way. bodies that arent text, json, xml or a form are left out, and so are event streams
+//and websockets. it runs inside the compression, so it sees the response before it is gzipped
+func captureBodies(cfg bodyCaptureConfig, next http.Handler) http.Handler {
+	redact := map[string]bool{}
+	for _, field := range cfg.redact {
+		redact[strings.ToLower(field)] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := r.Context().Value(bodyCaptureKey).(*bodyCapture)
+		requested := r.Header.Get(bodyCaptureHeader) == "true"
+		if !ok || (!cfg.always && !requested) || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		c.captured, c.requested, c.redact = true, !cfg.always, redact
+		if r.Body != nil && r.Body != http.NoBody && capturable(r.Header.Get("Content-Type"), true) {
+			c.request, c.requestType = &cappedBuffer{max: cfg.maxBytes}, r.Header.Get("Content-Type")
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, c.request), r.Body}
+		}
+		c.response = &cappedBuffer{max: cfg.maxBytes}
+		next.ServeHTTP(&captureResponseWriter{ResponseWriter: w, capture: c}, r)
+	})
+}
+
+//capturable reports whether a body of contentType is logged, a request without a content type is taken as json
+func capturable(contentType string, request bool) bool {
+	if contentType == "" {
+		return request
+	}
+	if request {
+		if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "application/x-www-form-urlencoded" {
+			return true
+		}
+	}
+	return compressible(contentType)
+}
+
+//logAttrs are the bodies for the access log line, none when nothing was captured or the caller may not see them
+func (c *bodyCapture) logAttrs() []any {
+	if !c.captured || (c.requested && !c.admin) {
+		return nil
+	}
+	var attrs []any
+	if body, ok := c.request.redacted(c.requestType, c.redact); ok {
+		attrs = append(attrs, "request_body", body)
+	}
+	if body, ok := c.response.redacted(c.responseType, c.redact); ok {
+		attrs = append(attrs, "response_body", body)
+	}
+	return attrs
+}
+
+//captureResponseWriter copies what the handler writes into the capture, once the content type shows it is text
+type captureResponseWriter struct {
+	http.ResponseWriter
+	capture *bodyCapture
+	decided bool
+}
+
+func (c *captureResponseWriter) decide() {
+	if c.decided {
+		return
+	}
+	c.decided = true
+	c.capture.responseType = c.Header().Get("Content-Type")
+	if !capturable(c.capture.responseType, false) {
+		c.capture.response = nil
+	}
+}
+
+func (c *captureResponseWriter) WriteHeader(status int) {
+	c.decide()
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *captureResponseWriter) Write(b []byte) (int, error) {
+	c.decide()
+	n, err := c.ResponseWriter.Write(b)
+	if c.capture.response != nil {
+		c.capture.response.Write(b[:n])
+	}
+	return n, err
+}
+
+//Unwrap lets http.ResponseController reach the underlying writer
+func (c *captureResponseWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+//Hijack is there for the same reason as on statusRecorder, though upgrades are never captured
+func (c *captureResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(c.ResponseWriter).Hijack()
+}
+
+//cappedBuffer keeps the first max bytes written to it and counts the rest
+type cappedBuffer struct {
+	max   int
+	buf   bytes.Buffer
+	total int
+}
+
+//Write never fails, so a TeeReader never stops reading because of it
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.total += len(p)
+	if room := b.max - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+//jsonStringField matches a json field with a string value, for bodies that were cut off and cant be parsed anymore.
+//xmlElementText matches the start of an xml element and the text after it, the api takes users as xml too
+var (
+	jsonStringField = regexp.MustCompile(`"([^"\\]+)"\s*:\s*"(?:[^"\\]|\\.)*"?`)
+	xmlElementText  = regexp.MustCompile(`<([A-Za-z_][\w.-]*)>[^<]*`)
+)
+
+//redacted is the body with the values of the redacted fields replaced, ok is false when there is none.
+//json is parsed and rewritten when it is complete, and scanned for string fields when it was cut off
+func (b *cappedBuffer) redacted(contentType string, redact map[string]bool) (string, bool) {
+	if b == nil || b.total == 0 {
+		return "", false
+	}
+	//the cut can split a character in two
+	body := strings.ToValidUTF8(b.buf.String(), "")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(body)
+		if err != nil {
+			return "", false
+		}
+		for name := range values {
+			if redact[strings.ToLower(name)] {
+				values[name] = []string{"REDACTED"}
+			}
+		}
+		body = values.Encode()
+	case b.total <= b.max && json.Valid(b.buf.Bytes()):
+		var v any
+		json.Unmarshal(b.buf.Bytes(), &v)
+		encoded, _ := json.Marshal(redactJSON(v, redact))
+		body = string(encoded)
+	default:
+		body = jsonStringField.ReplaceAllStringFunc(body, func(field string) string {
+			name := jsonStringField.FindStringSubmatch(field)[1]
+			if !redact[strings.ToLower(name)] {
+				return field
+			}
+			return `"` + name + `":"REDACTED"`
+		})
+		body = xmlElementText.ReplaceAllStringFunc(body, func(element string) string {
+			name := xmlElementText.FindStringSubmatch(element)[1]
+			if !redact[strings.ToLower(name)] {
+				return element
+			}
+			return "<" + name + ">REDACTED"
+		})
+	}
+	if b.total > b.max {
+		body += "...(cut off, " + strconv.Itoa(b.total) + " bytes)"
+	}
+	return body, true
+}
+
+//redactJSON replaces the values of the redacted fields anywhere in v
+func redactJSON(v any, redact map[string]bool) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for name, field := range v {
+			if redact[strings.ToLower(name)] {
+				v[name] = "REDACTED"
+			} else {
+				v[name] = redactJSON(field, redact)
+			}
+		}
+	case []any:
+		for i := range v {
+			v[i] = redactJSON(v[i], redact)
+		}
+	}
+	return v
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//maxBulkUpdateIds caps the ids of one PATCH /users, so one request never locks a big part of the table.
+//scripts with more users send them in batches
+const maxBulkUpdateIds = 1000
+
+//bulkUserUpdate is the body of PATCH /users: the users to change and what to set on all of them
+type bulkUserUpdate struct {
+	Ids []int64     `json:"ids"`
+	Set bulkUserSet `json:"set"`
+}
+
+//bulkUserSet are the fields PATCH /users can set, any other field is refused as unknown by decodeRequest.
+//fields left out are kept. active works like the activate and deactivate endpoints
+type bulkUserSet struct {
+	Role   *string `json:"role,omitempty"`
+	Active *bool   `json:"active,omitempty"`
+}
+
+//bulkUpdateResult is the answer of PATCH /users
+type bulkUpdateResult struct {
+	XMLName xml.Name `json:"-" xml:"bulk_update"`
+	//Updated is how many users changed, Unchanged how many had the values already
+	Updated   int `json:"updated" xml:"updated"`
+	Unchanged int `json:"unchanged" xml:"unchanged"`
+	//Missing are the ids that arent users, the others are updated anyway
+	Missing []int64 `json:"missing" xml:"missing>id"`
+}
+
+//validate checks the update as a whole, nothing is changed when any of it is wrong
+func (b *bulkUserUpdate) validate() model.FieldErrors {
+	errs := model.FieldErrors{}
+	switch {
+	case len(b.Ids) == 0:
+		errs["ids"] = "is required"
+	case len(b.Ids) > maxBulkUpdateIds:
+		errs["ids"] = fmt.Sprintf("must not list more than %d users, send them in batches", maxBulkUpdateIds)
+	case slices.ContainsFunc(b.Ids, func(id int64) bool { return id < 1 }):
+		errs["ids"] = "must be user ids"
+	}
+	switch {
+	case b.Set.Role == nil && b.Set.Active == nil:
+		errs["set"] = "must set role or active"
+	case b.Set.Role != nil && !model.ValidRole(*b.Set.Role):
+		errs["set.role"] = "must be one of admin, member"
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+//bulkUpdateUsers sets the same fields on many users in one transaction and one UPDATE. users that have the values
+//already are left alone, every user that changes is audited and published like a single update. ids that arent users
+//are reported instead of failing the update, everything else that is wrong with the request fails all of it
+func bulkUpdateUsers(db *sql.DB, events eventBroker, cache *userCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req bulkUserUpdate
+		if err := decodeRequest(r, &req); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+		if errs := req.validate(); errs != nil {
+			writeValidationError(w, r, errs)
+			return
+		}
+		slices.Sort(req.Ids)
+		req.Ids = slices.Compact(req.Ids)
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("starting transaction: %w", err))
+			return
+		}
+		defer tx.Rollback()
+
+		//locked in the order of their ids, so two bulk updates of overlapping users cant deadlock
+		list, args := idList(req.Ids, 1)
+		locked, err := queryUsers(r, tx, "SELECT "+store.UserColumns+" FROM users WHERE id IN "+list+" ORDER BY id FOR UPDATE", args...)
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("loading users to update: %w", err))
+			return
+		}
+		before := map[int64]model.User{}
+		for _, u := range locked {
+			before[int64(u.Id)] = u
+		}
+		result := bulkUpdateResult{Missing: []int64{}}
+		//the users are locked, so which of them the change makes a difference to is known before writing
+		var changing []int64
+		for _, id := range req.Ids {
+			u, ok := before[id]
+			switch {
+			case !ok:
+				result.Missing = append(result.Missing, id)
+			case req.Set.Role != nil && u.Role != *req.Set.Role, req.Set.Active != nil && u.Active != *req.Set.Active:
+				changing = append(changing, id)
+			}
+		}
+
+		//a null leaves the column as it is
+		var role sql.NullString
+		var active sql.NullBool
+		if req.Set.Role != nil {
+			role = sql.NullString{String: *req.Set.Role, Valid: true}
+		}
+		if req.Set.Active != nil {
+			active = sql.NullBool{Bool: *req.Set.Active, Valid: true}
+		}
+		var updated []model.User
+		if len(changing) > 0 {
+			list, args := idList(changing, 3)
+			_, err = tx.ExecContext(r.Context(), `UPDATE users SET role = COALESCE($1, role), active = COALESCE($2, active),
+				version = version + 1, updated_at = now() WHERE id IN `+list, append([]any{role, active}, args...)...)
+			if err == nil {
+				list, args = idList(changing, 1)
+				updated, err = queryUsers(r, tx, "SELECT "+store.UserColumns+" FROM users WHERE id IN "+list+" ORDER BY id", args...)
+			}
+			if err != nil {
+				internalServerError(w, r, fmt.Errorf("updating users: %w", err))
+				return
+			}
+		}
+
+		for _, u := range updated {
+			old := before[int64(u.Id)]
+			action := auditUserUpdated
+			switch {
+			case !old.Active && u.Active:
+				action = auditUserActivated
+			case old.Active && !u.Active:
+				action = auditUserDeactivated
+				if err := revokeCredentials(r.Context(), tx, int64(u.Id)); err != nil {
+					internalServerError(w, r, err)
+					return
+				}
+			}
+			if err := auditUserChange(r.Context(), tx, action, &old, &u); err != nil {
+				internalServerError(w, r, err)
+				return
+			}
+			if err := enqueueOutbox(r.Context(), tx, outboxUserUpdated, u); err != nil {
+				internalServerError(w, r, err)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			internalServerError(w, r, fmt.Errorf("updating users: %w", err))
+			return
+		}
+		for _, u := range updated {
+			cache.forget(r.Context(), int64(u.Id))
+			events.Publish(userEvent{Type: eventUserUpdated, User: u})
+		}
+
+		result.Updated = len(updated)
+		result.Unchanged = len(before) - len(updated)
+		writeResponse(w, r, http.StatusOK, result)
+	}
+}
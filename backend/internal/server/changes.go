@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"api/internal/model"
+)
+
+//defaultUserChangesRetention is how long the change feed keeps a change when USER_CHANGES_RETENTION isnt set
+const defaultUserChangesRetention = 30 * 24 * time.Hour
+
+//changeOperations is the operation in the change feed of every outbox event type
+var changeOperations = map[string]string{
+	outboxUserCreated: eventUserCreated,
+	outboxUserUpdated: eventUserUpdated,
+	outboxUserDeleted: eventUserDeleted,
+}
+
+//appendUserChange adds a change to the feed of GET /users/changes. pass the transaction of the change: it takes the
+//next seq by updating the row of user_change_seq, which stays locked until the transaction ends, so the changes are
+//numbered in the order they commit and a reader never sees one before an earlier number is committed too.
+//the price is that the changes to users commit one at a time from there on
+func appendUserChange(ctx context.Context, tx execer, eventType string, u model.User) error {
+	var state sql.NullString
+	if eventType != outboxUserDeleted {
+		encoded, err := json.Marshal(u)
+		if err != nil {
+			return fmt.Errorf("encoding user change: %w", err)
+		}
+		state = sql.NullString{String: string(encoded), Valid: true}
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE user_change_seq SET last_seq = last_seq + 1 WHERE id = 1"); err != nil {
+		return fmt.Errorf("numbering user change: %w", err)
+	}
+	_, err := tx.ExecContext(ctx, `INSERT INTO user_changes (seq, created_at, operation, user_id, state)
+		VALUES ((SELECT last_seq FROM user_change_seq WHERE id = 1), $1, $2, $3, $4)`, time.Now().UTC(), changeOperations[eventType], u.Id, state)
+	if err != nil {
+		return fmt.Errorf("writing user change: %w", err)
+	}
+	return nil
+}
+
+//userChange is one change in the feed, User is the user after it and null for a deletion
+type userChange struct {
+	Seq       int64           `json:"seq" xml:"seq"`
+	Timestamp time.Time       `json:"timestamp" xml:"timestamp"`
+	Operation string          `json:"operation" xml:"operation"`
+	UserId    model.ID        `json:"user_id" xml:"user_id"`
+	User      json.RawMessage `json:"user" xml:"user,omitempty"`
+}
+
+//userChangePage is one page of the change feed, oldest change first
+//nextCursor is the value for ?since= to get the next page, hasMore tells whether it already has changes
+type userChangePage struct {
+	XMLName    xml.Name     `json:"-" xml:"changes"`
+	Changes    []userChange `json:"changes" xml:"change"`
+	NextCursor int64        `json:"next_cursor" xml:"next_cursor"`
+	HasMore    bool         `json:"has_more" xml:"has_more"`
+}
+
+//getUserChanges lists the changes to users after the cursor in ?since=, for jobs that keep a copy of the users in sync
+//without downloading all of them every time. ?since=latest answers no changes but the cursor of the newest one, a
+//full sync takes it before downloading the users and continues from there. ?limit= sets the page size, capped at
+//MAX_PAGE_SIZE like the lists.
+//only what is committed up to the newest seq (the watermark) is read, and the seqs have no gaps, so a page that
+//doesnt start right after the cursor means the changes after it were purged. that is answered with 410: the client
+//has to sync everything again
+func getUserChanges(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		limit := min(defaultPageSize, maxPageSize)
+		if v := query.Get("limit"); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil || parsed < 1 {
+				writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "limit must be a number of at least 1")
+				return
+			}
+			limit = min(parsed, maxPageSize)
+		}
+		w.Header().Set("X-Page-Limit", strconv.Itoa(limit))
+
+		var watermark int64
+		if err := db.QueryRowContext(r.Context(), "SELECT last_seq FROM user_change_seq WHERE id = 1").Scan(&watermark); err != nil {
+			internalServerError(w, r, fmt.Errorf("reading the change watermark: %w", err))
+			return
+		}
+		var since int64
+		switch v := query.Get("since"); v {
+		case "":
+		case "latest":
+			since = watermark
+		default:
+			parsed, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || parsed < 0 || parsed > watermark {
+				writeValidationError(w, r, model.FieldErrors{"since": "must be the next_cursor of a page or latest"})
+				return
+			}
+			since = parsed
+		}
+
+		rows, err := db.QueryContext(r.Context(), `SELECT seq, created_at, operation, user_id, state
+			FROM user_changes WHERE seq > $1 AND seq <= $2 ORDER BY seq LIMIT $3`, since, watermark, limit)
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("listing user changes: %w", err))
+			return
+		}
+		defer rows.Close()
+
+		page := userChangePage{Changes: []userChange{}, NextCursor: since}
+		for rows.Next() {
+			var c userChange
+			var state []byte
+			if err := rows.Scan(&c.Seq, &c.Timestamp, &c.Operation, &c.UserId, &state); err != nil {
+				internalServerError(w, r, fmt.Errorf("reading user change: %w", err))
+				return
+			}
+			c.User = state
+			page.Changes = append(page.Changes, c)
+		}
+		if err := rows.Err(); err != nil {
+			internalServerError(w, r, fmt.Errorf("listing user changes: %w", err))
+			return
+		}
+		if since < watermark && (len(page.Changes) == 0 || page.Changes[0].Seq != since+1) {
+			writeError(w, r, http.StatusGone, codeCursorExpired, "the changes after this cursor were purged, take a new cursor with since=latest and download all users again")
+			return
+		}
+		if n := len(page.Changes); n > 0 {
+			page.NextCursor = page.Changes[n-1].Seq
+		}
+		page.HasMore = page.NextCursor < watermark
+		writeResponse(w, r, http.StatusOK, page)
+	}
+}
+
+//cleanupUserChanges purges the changes older than retention every interval until ctx is cancelled. it deletes up to
+//the newest seq that is old enough rather than by time, the times of changes committing close together can be out of
+//order and the feed must never have a gap in the middle
+func cleanupUserChanges(ctx context.Context, db *sql.DB, logger *slog.Logger, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var last sql.NullInt64
+		if err := db.QueryRowContext(ctx, "SELECT MAX(seq) FROM user_changes WHERE created_at < $1", time.Now().UTC().Add(-retention)).Scan(&last); err != nil {
+			logger.Error("cleaning up user changes", "error", err)
+			continue
+		}
+		if !last.Valid {
+			continue
+		}
+		res, err := db.ExecContext(ctx, "DELETE FROM user_changes WHERE seq <= $1", last.Int64)
+		if err != nil {
+			logger.Error("cleaning up user changes", "error", err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			logger.Info("purged old user changes", "count", n, "through_seq", last.Int64)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+//trustedProxies are the networks of the reverse proxies in front of the server, see withClientIP
+type trustedProxies []netip.Prefix
+
+func (t trustedProxies) contains(addr netip.Addr) bool {
+	for _, p := range t {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+//withClientIP works out the address of the client behind a request and keeps it in the request context for clientIP.
+//it is the peer of the connection, unless that peer is one of the trusted proxies: then it is the rightmost address of
+//X-Forwarded-For that isnt a trusted proxy itself, or X-Real-IP when there is no X-Forwarded-For.
+//anyone can send those headers, so they are ignored from every other peer. without trusted proxies it is always the peer
+func withClientIP(trusted trustedProxies, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := resolveClientIP(trusted, r); ip.IsValid() {
+			r = r.WithContext(context.WithValue(r.Context(), clientIPKey, ip.String()))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//resolveClientIP is the client address of withClientIP, invalid when not even the peer can be parsed
+func resolveClientIP(trusted trustedProxies, r *http.Request) netip.Addr {
+	peer, ok := parseHostAddr(r.RemoteAddr)
+	if !ok || !trusted.contains(peer) {
+		return peer
+	}
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	if len(hops) == 0 {
+		if real, ok := parseHostAddr(r.Header.Get("X-Real-IP")); ok {
+			return real
+		}
+		return peer
+	}
+	//every proxy appends the address it got the request from, so the list is walked back from the proxy we know
+	//until the first hop none of ours added. what is left of that hop was sent by the client and proves nothing
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseHostAddr(hops[i])
+		if !ok {
+			break
+		}
+		client = hop
+		if !trusted.contains(hop) {
+			break
+		}
+	}
+	return client
+}
+
+//parseHostAddr parses an address like 203.0.113.7, 203.0.113.7:443, 2001:db8::1 or [2001:db8::1]:443.
+//ipv4 addresses written as ipv6 (::ffff:203.0.113.7) are turned into plain ipv4, so they match the trusted networks
+func parseHostAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+//clientIP is the address the request came from, without the port, see withClientIP
+func clientIP(r *http.Request) string {
+	if ip := clientIPFrom(r.Context()); ip != "" {
+		return ip
+	}
+	if addr, ok := parseHostAddr(r.RemoteAddr); ok {
+		return addr.String()
+	}
+	return r.RemoteAddr
+}
+
+//clientIPFrom is the client address withClientIP stored in ctx, empty outside of a request
+func clientIPFrom(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey).(string)
+	return ip
+}
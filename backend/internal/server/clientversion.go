@@ -0,0 +1,196 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"api/requestid"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+//maxClientVersionLabels caps the versions http_requests_by_client_version_total tells apart, the versions are sent by
+//the clients and anyone can send a new one with every request. the versions after the cap are counted as other
+const maxClientVersionLabels = 100
+
+//the labels of http_requests_by_client_version_total besides the versions
+const (
+	clientVersionUnknown = "unknown"
+	clientVersionOther   = "other"
+)
+
+//where the version of a client was read from, the source label of http_requests_by_client_version_total
+const (
+	clientVersionFromHeader    = "header"
+	clientVersionFromUserAgent = "user_agent"
+	clientVersionFromNowhere   = "none"
+)
+
+//requests by the version of the client that sent them, see clientVersionOf. version is major.minor, unknown or other
+var httpRequestsByClientVersion = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "http_requests_by_client_version_total",
+	Help: "HTTP requests handled, by the major.minor version of the client and where it was read from.",
+}, []string{"version", "source"})
+
+//clientVersion is the version a client says it is, like 2.3.1. anything after the numbers, a -beta or a +build, is
+//dropped, and missing numbers are 0
+type clientVersion struct {
+	major, minor, patch int
+}
+
+func (v clientVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+}
+
+//label is the version as http_requests_by_client_version_total counts it, the patch level would only add series
+func (v clientVersion) label() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+func (v clientVersion) less(w clientVersion) bool {
+	if v.major != w.major {
+		return v.major < w.major
+	}
+	if v.minor != w.minor {
+		return v.minor < w.minor
+	}
+	return v.patch < w.patch
+}
+
+//parseClientVersion parses a version like 2.3.1, v2.3 or 2.3.1-beta.2. a client may send anything, everything that
+//doesnt start with up to three dot separated numbers of at most 6 digits is refused
+func parseClientVersion(s string) (clientVersion, bool) {
+	s = strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(s), "v"), "V")
+	if end := strings.IndexFunc(s, func(c rune) bool { return (c < '0' || c > '9') && c != '.' }); end >= 0 {
+		//the numbers must end where a suffix begins, 2.3x isnt 2.3
+		if s[end] != '-' && s[end] != '+' {
+			return clientVersion{}, false
+		}
+		s = s[:end]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return clientVersion{}, false
+	}
+	var numbers [3]int
+	for i, part := range parts {
+		if part == "" || len(part) > 6 {
+			return clientVersion{}, false
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return clientVersion{}, false
+		}
+		numbers[i] = n
+	}
+	return clientVersion{major: numbers[0], minor: numbers[1], patch: numbers[2]}, true
+}
+
+//clientVersionOf is the version of the client of r and where it was read from. X-Client-Version is a version like
+//2.3.1, or a client and its version like android/2.3.1. without it the version of the first product of the User-Agent
+//is taken, like the 2.3.1 of UserManagement/2.3.1 (Android 14). browsers all start theirs with Mozilla/5.0, which
+//isnt the version of anything, so theirs are unknown
+func clientVersionOf(r *http.Request) (clientVersion, string, bool) {
+	if header := r.Header.Get("X-Client-Version"); header != "" {
+		_, version, found := strings.Cut(header, "/")
+		if !found {
+			version = header
+		}
+		v, ok := parseClientVersion(version)
+		return v, clientVersionFromHeader, ok
+	}
+	product, _, _ := strings.Cut(strings.TrimSpace(r.UserAgent()), " ")
+	name, version, found := strings.Cut(product, "/")
+	if !found || strings.EqualFold(name, "Mozilla") {
+		return clientVersion{}, clientVersionFromNowhere, false
+	}
+	v, ok := parseClientVersion(version)
+	return v, clientVersionFromUserAgent, ok
+}
+
+//clientVersionLabels are the versions http_requests_by_client_version_total has a series for, at most maxClientVersionLabels
+var clientVersionLabels = struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}{seen: map[string]bool{}}
+
+//countClientVersion counts r in http_requests_by_client_version_total
+func countClientVersion(r *http.Request) {
+	v, source, ok := clientVersionOf(r)
+	label := clientVersionUnknown
+	if ok {
+		label = v.label()
+		clientVersionLabels.mu.Lock()
+		if !clientVersionLabels.seen[label] {
+			if len(clientVersionLabels.seen) < maxClientVersionLabels {
+				clientVersionLabels.seen[label] = true
+			} else {
+				label = clientVersionOther
+			}
+		}
+		clientVersionLabels.mu.Unlock()
+	}
+	httpRequestsByClientVersion.WithLabelValues(label, source).Inc()
+}
+
+//clientVersionLogValue is the version of the client of r for the access log, empty when it isnt known
+func clientVersionLogValue(r *http.Request) string {
+	if v, _, ok := clientVersionOf(r); ok {
+		return v.String()
+	}
+	return ""
+}
+
+//minClientVersions is Config.MinClientVersions, the oldest version of the clients each route group still answers.
+//a route group is the first segment of the path below /api/v1, like users or admin, and * stands for the groups not listed
+type minClientVersions map[string]clientVersion
+
+//allRouteGroups is the route group of MIN_CLIENT_VERSIONS that applies to every group without a minimum of its own
+const allRouteGroups = "*"
+
+//forPath is the minimum for the path p below the api prefix
+func (m minClientVersions) forPath(p string) (clientVersion, bool) {
+	group, _, _ := strings.Cut(strings.TrimPrefix(p, "/"), "/")
+	if minimum, ok := m[group]; ok {
+		return minimum, true
+	}
+	minimum, ok := m[allRouteGroups]
+	return minimum, ok
+}
+
+//requireClientVersion answers 426 to the clients older than the minimum of the route group they call, with the
+//minimum in the meta of the error. the User-Agent is whatever the http library of a client put there, so only the
+//version of X-Client-Version is held against the minimum: clients that dont send one, or send one that isnt a
+//version, are let through. prefix is the path the routes are mounted on. without minimums it does nothing
+func requireClientVersion(mins minClientVersions, prefix string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if len(mins) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			minimum, ok := mins.forPath(strings.TrimPrefix(r.URL.Path, prefix))
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			v, source, ok := clientVersionOf(r)
+			if !ok || source != clientVersionFromHeader || !v.less(minimum) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			writeClientTooOld(w, r, minimum)
+		})
+	}
+}
+
+//writeClientTooOld answers 426 Upgrade Required to a client older than minimum
+func writeClientTooOld(w http.ResponseWriter, r *http.Request, minimum clientVersion) {
+	e := apiError{Code: codeClientUpgradeRequired, RequestId: requestid.FromContext(r.Context()),
+		Message: fmt.Sprintf("this version of the app is no longer supported, update it to version %s or newer", minimum),
+		Meta:    &errorMeta{MinClientVersion: minimum.String()}}
+	writeResponse(w, r, http.StatusUpgradeRequired, errorEnvelope{Error: localizeError(w, r, e)})
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"iter"
+	"strconv"
+
+	"golang.org/x/sync/singleflight"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//coalescingStore lets concurrent reads of the same user share one query: a Get for an id that is already being read
+//waits for that read instead of starting another, and so does the first page of every active user, the one the cache
+//keeps as well. it sits under the caches, so it is what a burst of lookups for an uncached user reaches.
+//every caller gets its own copy of the result. a caller whose context ends stops waiting, the read goes on for the
+//others without it. a write forgets the read in flight for its user, callers that come after it start a new one
+//rather than getting what was read before the write
+type coalescingStore struct {
+	store.UserStore
+	gets  singleflight.Group
+	lists singleflight.Group
+}
+
+func newCoalescingStore(users store.UserStore) *coalescingStore {
+	return &coalescingStore{UserStore: users}
+}
+
+func (c *coalescingStore) Get(ctx context.Context, id int64) (model.User, error) {
+	return coalesce(ctx, &c.gets, strconv.FormatInt(id, 10), "get", func(ctx context.Context) (model.User, error) {
+		return c.UserStore.Get(ctx, id)
+	}, model.User.Clone)
+}
+
+//List shares the reads of the first page of every active user, see userCache.List. anything else is read on its own
+func (c *coalescingStore) List(ctx context.Context, f store.Filter) ([]model.User, error) {
+	if f != (store.Filter{Limit: min(defaultPageSize, maxPageSize)}) {
+		return c.UserStore.List(ctx, f)
+	}
+	return coalesce(ctx, &c.lists, "first-page", "list", func(ctx context.Context) ([]model.User, error) {
+		return c.UserStore.List(ctx, f)
+	}, cloneUsers)
+}
+
+func (c *coalescingStore) Create(ctx context.Context, u model.User, passwordHash string) (model.User, error) {
+	created, err := c.UserStore.Create(ctx, u, passwordHash)
+	if err == nil {
+		c.forget(int64(created.Id))
+	}
+	return created, err
+}
+
+func (c *coalescingStore) Update(ctx context.Context, id int64, change store.Update) (model.User, error) {
+	defer c.forget(id)
+	return c.UserStore.Update(ctx, id, change)
+}
+
+func (c *coalescingStore) Delete(ctx context.Context, id int64, match *store.Match) (model.User, error) {
+	defer c.forget(id)
+	return c.UserStore.Delete(ctx, id, match)
+}
+
+//Stream is the Stream of the store underneath, or its List one user at a time when it has none, like userCache.Stream
+func (c *coalescingStore) Stream(ctx context.Context, f store.Filter) iter.Seq2[model.User, error] {
+	if streamer, ok := c.UserStore.(store.Streamer); ok {
+		return streamer.Stream(ctx, f)
+	}
+	return func(yield func(model.User, error) bool) {
+		users, err := c.UserStore.List(ctx, f)
+		if err != nil {
+			yield(model.User{}, err)
+			return
+		}
+		for _, u := range users {
+			if !yield(u, nil) {
+				return
+			}
+		}
+	}
+}
+
+//Upsert is the Upsert of the store underneath, errUpsertUnsupported when it has none
+func (c *coalescingStore) Upsert(ctx context.Context, id int64, change store.Update) (model.User, bool, error) {
+	upserter, ok := c.UserStore.(store.Upserter)
+	if !ok {
+		return model.User{}, false, errUpsertUnsupported
+	}
+	defer c.forget(id)
+	return upserter.Upsert(ctx, id, change)
+}
+
+//Search is the Search of the store underneath, errSearchUnsupported when it has none. searches arent shared
+func (c *coalescingStore) Search(ctx context.Context, f store.Filter) ([]model.ScoredUser, error) {
+	searcher, ok := c.UserStore.(store.Searcher)
+	if !ok {
+		return nil, errSearchUnsupported
+	}
+	return searcher.Search(ctx, f)
+}
+
+//Snapshot is the Snapshot of the store underneath, errSnapshotUnsupported when it has none. snapshots arent shared
+func (c *coalescingStore) Snapshot(ctx context.Context) (store.Snapshot, error) {
+	snapshotter, ok := c.UserStore.(store.Snapshotter)
+	if !ok {
+		return nil, errSnapshotUnsupported
+	}
+	return snapshotter.Snapshot(ctx)
+}
+
+//forget lets the next reads of the user id and of the first page start a new query, the one in flight may have read
+//them before the write
+func (c *coalescingStore) forget(id int64) {
+	c.gets.Forget(strconv.FormatInt(id, 10))
+	c.lists.Forget("first-page")
+}
+
+//coalesce runs read for key unless a read for it is in flight in g already, then it waits for that one. the read gets
+//ctx without its cancellation, the caller that started it may leave before the others. each caller gets a clone of
+//the result, the ones that didnt run read themselves are counted in userStoreReadsCoalesced with the label name
+func coalesce[T any](ctx context.Context, g *singleflight.Group, key, name string, read func(context.Context) (T, error), clone func(T) T) (T, error) {
+	leader := false
+	ch := g.DoChan(key, func() (any, error) {
+		leader = true
+		return read(context.WithoutCancel(ctx))
+	})
+	select {
+	case res := <-ch:
+		if !leader {
+			userStoreReadsCoalesced.WithLabelValues(name).Inc()
+		}
+		v, _ := res.Val.(T)
+		return clone(v), res.Err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+//cloneUsers is a copy of users that shares nothing with it
+func cloneUsers(users []model.User) []model.User {
+	if users == nil {
+		return nil
+	}
+	clones := make([]model.User, len(users))
+	for i, u := range users {
+		clones[i] = u.Clone()
+	}
+	return clones
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//gatedStore holds every Get until release is closed, and counts the Gets that reached it
+type gatedStore struct {
+	store.UserStore
+	gets    atomic.Int32
+	release chan struct{}
+}
+
+func (s *gatedStore) Get(ctx context.Context, id int64) (model.User, error) {
+	s.gets.Add(1)
+	<-s.release
+	//the read is shared, the context of the caller that started it mustnt end it
+	if err := ctx.Err(); err != nil {
+		return model.User{}, err
+	}
+	return s.UserStore.Get(ctx, id)
+}
+
+//TestCoalescedGetsStress reads one user from many goroutines at once, round after round, and changes every answer.
+//the reads have to share queries, and every caller has to get a copy of its own. run it with -race
+func TestCoalescedGetsStress(t *testing.T) {
+	memory := store.NewMemory()
+	phone := "+14155550100"
+	u, err := memory.Create(context.Background(), model.User{Name: "Featured", Email: "featured@example.com", Phone: &phone}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const rounds, readers = 20, 50
+	coalescedBefore := testutil.ToFloat64(userStoreReadsCoalesced.WithLabelValues("get"))
+	gated := &gatedStore{UserStore: memory}
+	c := newCoalescingStore(gated)
+	for round := range rounds {
+		gated.release = make(chan struct{})
+		var ready, done sync.WaitGroup
+		for i := range readers {
+			ready.Add(1)
+			done.Go(func() {
+				ready.Done()
+				got, err := c.Get(context.Background(), int64(u.Id))
+				if err != nil {
+					t.Errorf("round %d: %v", round, err)
+					return
+				}
+				if got.Name != "Featured" || got.Phone == nil || *got.Phone != phone {
+					t.Errorf("round %d: got %q with phone %v, another caller changed it", round, got.Name, got.Phone)
+					return
+				}
+				got.Name = fmt.Sprintf("Reader %d", i)
+				*got.Phone = fmt.Sprintf("+1415555%04d", i)
+			})
+		}
+		ready.Wait()
+		time.Sleep(10 * time.Millisecond)
+		close(gated.release)
+		done.Wait()
+	}
+	queries := int(gated.gets.Load())
+	if queries >= rounds*readers/2 {
+		t.Fatalf("%d reads made %d queries", rounds*readers, queries)
+	}
+	coalesced := int(testutil.ToFloat64(userStoreReadsCoalesced.WithLabelValues("get")) - coalescedBefore)
+	if coalesced != rounds*readers-queries {
+		t.Fatalf("%d reads made %d queries, %d counted as coalesced", rounds*readers, queries, coalesced)
+	}
+	//the store kept what it had
+	got, err := memory.Get(context.Background(), int64(u.Id))
+	if err != nil || got.Name != "Featured" || *got.Phone != phone {
+		t.Fatalf("the store has %+v, %v", got, err)
+	}
+}
+
+func TestCoalescedGetCancellation(t *testing.T) {
+	memory := store.NewMemory()
+	u, err := memory.Create(context.Background(), model.User{Name: "Featured", Email: "featured@example.com"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gated := &gatedStore{UserStore: memory, release: make(chan struct{})}
+	c := newCoalescingStore(gated)
+
+	//the first caller starts the read and leaves
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, err := c.Get(ctx, int64(u.Id))
+		leader <- err
+	}()
+	for gated.gets.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	type result struct {
+		user model.User
+		err  error
+	}
+	waiter := make(chan result, 1)
+	go func() {
+		got, err := c.Get(context.Background(), int64(u.Id))
+		waiter <- result{got, err}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-leader; !errors.Is(err, context.Canceled) {
+		t.Fatalf("the caller that left got %v", err)
+	}
+	close(gated.release)
+	r := <-waiter
+	if r.err != nil || r.user.Id != u.Id {
+		t.Fatalf("the caller that waited got %+v, %v", r.user, r.err)
+	}
+	if n := gated.gets.Load(); n != 1 {
+		t.Fatalf("%d queries", n)
+	}
+
+	//errors are shared as well
+	_, err = c.Get(context.Background(), int64(u.Id+1))
+	if !errors.Is(err, store.ErrUserNotFound) {
+		t.Fatalf("a missing user got %v", err)
+	}
+}
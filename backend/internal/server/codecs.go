@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+
+	"api/internal/model"
+	"api/userpb"
+)
+
+//binary formats for consumers that find json too slow to encode and decode, negotiated like xml. see codecs
+const (
+	formatProtobuf = "protobuf"
+	formatMsgpack  = "msgpack"
+)
+
+//codecMediaTypes are the media types of the binary formats in accept and content-type headers, responses are sent
+//with the mediaType of the codec
+var codecMediaTypes = map[string]string{
+	"application/x-protobuf": formatProtobuf,
+	"application/protobuf":   formatProtobuf,
+	"application/msgpack":    formatMsgpack,
+	"application/x-msgpack":  formatMsgpack,
+}
+
+//errUnsupportedBody is returned by decodeRequest when the body is in a format the endpoint cant take, writeDecodeError
+//answers it with 415
+var errUnsupportedBody = errors.New("request body format is not supported by this endpoint")
+
+//codec is one binary format, in both directions. writeResponse encodes responses with it and decodeRequest
+//decodes request bodies sent with its content type
+type codec struct {
+	mediaType string
+	//encode returns ok false for a payload the format has no message for, it is sent as json then
+	encode func(payload any) (data []byte, ok bool, err error)
+	//decode reads the whole body into dst, errUnsupportedBody when the format cant express dst
+	decode func(body io.Reader, dst any) error
+}
+
+var codecs = map[string]codec{
+	//protobuf only has messages for users, the ones of userpb/user.proto the grpc service uses too
+	formatProtobuf: {mediaType: "application/x-protobuf", encode: encodeProtobuf, decode: decodeProtobuf},
+	//msgpack has the same fields as json, from the same struct tags
+	formatMsgpack: {mediaType: "application/msgpack", encode: encodeMsgpack, decode: decodeMsgpack},
+}
+
+//writeEncoded writes payload in the binary format of c and returns true, or false without writing anything
+//when the format has no representation for it and the caller should send json instead
+func writeEncoded(w http.ResponseWriter, r *http.Request, status int, c codec, payload any) bool {
+	data, ok, err := c.encode(payload)
+	if err != nil {
+		loggerFrom(r.Context()).Warn("encoding response", "media_type", c.mediaType, "error", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	w.Header().Set("Content-Type", c.mediaType)
+	w.WriteHeader(status)
+	w.Write(data)
+	return true
+}
+
+//encodeProtobuf encodes a user as userpb.User and a list of users as userpb.ListUsersResponse, without a next page token.
+//everything else, errors too, has no message and goes out as json
+func encodeProtobuf(payload any) ([]byte, bool, error) {
+	var msg proto.Message
+	switch v := payload.(type) {
+	case model.User:
+		msg = userToProto(v)
+	case model.UserList:
+		list := &userpb.ListUsersResponse{Users: make([]*userpb.User, len(v.Users))}
+		for i, u := range v.Users {
+			list.Users[i] = userToProto(u)
+		}
+		msg = list
+	default:
+		return nil, false, nil
+	}
+	data, err := proto.Marshal(msg)
+	return data, err == nil, err
+}
+
+//decodeProtobuf decodes a userpb.CreateUserRequest into a user, the body both creating and replacing a user take.
+//fields the message doesnt know are refused, like unknown json fields
+func decodeProtobuf(body io.Reader, dst any) error {
+	u, ok := dst.(*model.User)
+	if !ok {
+		return errUnsupportedBody
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	var msg userpb.CreateUserRequest
+	if err := proto.Unmarshal(data, &msg); err != nil {
+		return fmt.Errorf("request body could not be decoded as protobuf: %v", err)
+	}
+	if len(msg.ProtoReflect().GetUnknown()) > 0 {
+		return errors.New("request body contains unknown protobuf fields")
+	}
+	*u = model.User{Name: msg.Name, Email: msg.Email, Role: msg.Role, Password: msg.Password}
+	return nil
+}
+
+//msgpackPayload unwraps the list types, json sends them as plain arrays through their MarshalJSON
+func msgpackPayload(payload any) any {
+	switch v := payload.(type) {
+	case model.UserList:
+		return v.Users
+	case model.ScoredUserList:
+		return v.Users
+	case model.AddressList:
+		return v.Addresses
+	case model.GroupList:
+		return v.Groups
+	}
+	return payload
+}
+
+func encodeMsgpack(payload any) ([]byte, bool, error) {
+	var b bytes.Buffer
+	enc := msgpack.NewEncoder(&b)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(msgpackPayload(payload)); err != nil {
+		return nil, false, err
+	}
+	return b.Bytes(), true, nil
+}
+
+//decodeMsgpack reads exactly one msgpack value into dst, as strict as decodeJSON about unknown fields and trailing data
+func decodeMsgpack(body io.Reader, dst any) error {
+	br := bufio.NewReader(body)
+	dec := msgpack.NewDecoder(br)
+	dec.SetCustomStructTag("json")
+	dec.DisallowUnknownFields(true)
+	if err := dec.Decode(dst); err != nil {
+		var maxErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxErr):
+			return err
+		case errors.Is(err, io.EOF):
+			return errors.New("request body must not be empty")
+		}
+		return fmt.Errorf("request body could not be decoded as msgpack: %v", err)
+	}
+	if _, err := br.ReadByte(); !errors.Is(err, io.EOF) {
+		return errors.New("request body must contain a single msgpack value")
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+
+	"api/internal/model"
+	"api/userpb"
+)
+
+//unmarshalMsgpack decodes a msgpack body with the json field names, like the server encodes it
+func unmarshalMsgpack(t *testing.T, data []byte, v any) {
+	t.Helper()
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	if err := dec.Decode(v); err != nil {
+		t.Fatalf("decoding msgpack %x: %v", data, err)
+	}
+}
+
+//sameUser fails the test when got and want differ, the times are compared as instants
+func sameUser(t *testing.T, got, want model.User) {
+	t.Helper()
+	if !got.UpdatedAt.Equal(want.UpdatedAt) {
+		t.Fatalf("updated_at %v, want %v", got.UpdatedAt, want.UpdatedAt)
+	}
+	got.UpdatedAt = want.UpdatedAt
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+//sameAsProto fails the test when the protobuf user doesnt carry the fields of the json one. json has no version,
+//the etag carries it
+func sameAsProto(t *testing.T, got *userpb.User, want model.User) {
+	t.Helper()
+	if got.Id != int64(want.Id) || got.Name != want.Name || got.Email != want.Email || got.Role != want.Role ||
+		got.Verified != want.Verified || got.Active != want.Active || got.PendingEmail != want.PendingEmail ||
+		!got.UpdatedAt.AsTime().Equal(want.UpdatedAt) {
+		t.Fatalf("got %v, want %+v", got, want)
+	}
+}
+
+func TestProtobufRoundTrip(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+
+	body, err := proto.Marshal(&userpb.CreateUserRequest{Name: "Ada", Email: "ada@example.com", Password: "password123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := ts.do("POST", "/api/v1/users", admin, string(body), "Content-Type", "application/x-protobuf", "Accept", "application/x-protobuf")
+	expect(t, res, http.StatusCreated)
+	if got := res.Header.Get("Content-Type"); got != "application/x-protobuf" {
+		t.Fatalf("Content-Type %q", got)
+	}
+	var created userpb.User
+	if err := proto.Unmarshal(res.body, &created); err != nil {
+		t.Fatal(err)
+	}
+	var ada model.User
+	res = ts.do("GET", userPath(model.ID(created.Id)), admin, nil)
+	expect(t, res, http.StatusOK)
+	res.decode(t, &ada)
+	sameAsProto(t, &created, ada)
+
+	res = ts.do("GET", "/api/v1/users", admin, nil, "Accept", "application/protobuf")
+	expect(t, res, http.StatusOK)
+	var list userpb.ListUsersResponse
+	if err := proto.Unmarshal(res.body, &list); err != nil {
+		t.Fatal(err)
+	}
+	var users []model.User
+	ts.do("GET", "/api/v1/users", admin, nil).decode(t, &users)
+	if len(list.Users) != len(users) {
+		t.Fatalf("protobuf listed %d users, json %d", len(list.Users), len(users))
+	}
+	for i := range users {
+		sameAsProto(t, list.Users[i], users[i])
+	}
+
+	//fields the message doesnt have are refused like unknown json fields
+	unknown := append(body, 0xf8, 0x06, 0x01)
+	res = ts.do("POST", "/api/v1/users", admin, string(unknown), "Content-Type", "application/x-protobuf")
+	if res.StatusCode != http.StatusBadRequest || res.errorCode() != codeInvalidRequest {
+		t.Fatalf("unknown fields answered %d: %s", res.StatusCode, res.body)
+	}
+	//there is no message for groups, their bodies are refused and their responses are json
+	res = ts.do("POST", "/api/v1/groups", admin, string(body), "Content-Type", "application/x-protobuf")
+	if res.StatusCode != http.StatusUnsupportedMediaType || res.errorCode() != codeUnsupportedMediaType {
+		t.Fatalf("a protobuf group answered %d: %s", res.StatusCode, res.body)
+	}
+	res = ts.do("GET", "/api/v1/groups", admin, nil, "Accept", "application/x-protobuf")
+	expect(t, res, http.StatusOK)
+	if got := res.Header.Get("Content-Type"); got != contentTypeJSON {
+		t.Fatalf("the groups were sent as %q", got)
+	}
+	//and so are errors
+	res = ts.do("GET", userPath(model.ID(created.Id+1000)), admin, nil, "Accept", "application/x-protobuf")
+	if res.StatusCode != http.StatusNotFound || res.Header.Get("Content-Type") != contentTypeJSON || res.errorCode() != codeUserNotFound {
+		t.Fatalf("a missing user answered %d %q: %s", res.StatusCode, res.Header.Get("Content-Type"), res.body)
+	}
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+
+	body, err := msgpack.Marshal(map[string]any{"name": "Ada", "email": "ada@example.com", "password": "password123", "phone": "+41 44 668 18 00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := ts.do("POST", "/api/v1/users", admin, string(body), "Content-Type", "application/msgpack", "Accept", "application/msgpack")
+	expect(t, res, http.StatusCreated)
+	if got := res.Header.Get("Content-Type"); got != "application/msgpack" {
+		t.Fatalf("Content-Type %q", got)
+	}
+	var created, ada model.User
+	unmarshalMsgpack(t, res.body, &created)
+	ts.do("GET", userPath(created.Id), admin, nil).decode(t, &ada)
+	sameUser(t, created, ada)
+
+	//a list is a plain array like in json
+	res = ts.do("GET", "/api/v1/users", admin, nil, "Accept", "application/x-msgpack")
+	expect(t, res, http.StatusOK)
+	var packed, users []model.User
+	unmarshalMsgpack(t, res.body, &packed)
+	ts.do("GET", "/api/v1/users", admin, nil).decode(t, &users)
+	if len(packed) != len(users) || len(users) != 2 {
+		t.Fatalf("msgpack listed %d users, json %d", len(packed), len(users))
+	}
+	for i := range users {
+		sameUser(t, packed[i], users[i])
+	}
+
+	for name, data := range map[string][]byte{
+		"unknown field": must(msgpack.Marshal(map[string]any{"name": "Eve", "email": "eve@example.com", "admin": true})),
+		"trailing data": append(must(msgpack.Marshal(map[string]any{"name": "Eve", "email": "eve@example.com"})), 0x01),
+		"empty":         nil,
+	} {
+		res := ts.do("POST", "/api/v1/users", admin, string(data), "Content-Type", "application/msgpack")
+		if res.StatusCode != http.StatusBadRequest || res.errorCode() != codeInvalidRequest {
+			t.Fatalf("%s answered %d: %s", name, res.StatusCode, res.body)
+		}
+	}
+	if n := ts.count("users", "email = 'eve@example.com'"); n != 0 {
+		t.Fatal("a refused body was stored")
+	}
+
+	//json stays the default, and a 204 has no body to type
+	res = ts.do("GET", userPath(ada.Id), admin, nil, "Accept", "*/*")
+	if got := res.Header.Get("Content-Type"); got != contentTypeJSON {
+		t.Fatalf("the default is %q", got)
+	}
+	res = ts.do("DELETE", userPath(ada.Id), admin, nil, "Accept", "application/msgpack")
+	expect(t, res, http.StatusNoContent)
+	if got := res.Header.Get("Content-Type"); got != "" {
+		t.Fatalf("the 204 has Content-Type %q", got)
+	}
+}
+
+func must(data []byte, err error) []byte {
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
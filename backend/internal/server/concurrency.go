@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	//MAX_IN_FLIGHT_REQUESTS defaults to this many requests per database connection,
+	//a little more than one so requests that dont touch the database or are between queries dont leave the pool idle
+	inFlightPerDBConn = 2
+	//defaultConcurrencyQueueWait is how long a request waits for a slot before it is shed (CONCURRENCY_QUEUE_WAIT)
+	defaultConcurrencyQueueWait = 100 * time.Millisecond
+	//overloadRetryAfter is the Retry-After of a shed request, in seconds
+	overloadRetryAfter = "1"
+)
+
+//concurrencyConfig is the load shedding setup, a queueWait of 0 sheds as soon as every slot is taken
+type concurrencyConfig struct {
+	maxInFlight int
+	queueWait   time.Duration
+}
+
+//limitConcurrency lets at most c.maxInFlight requests run at once. a request that finds every slot taken waits up to
+//c.queueWait for one and is then answered 503 with Retry-After, so an overloaded instance fails fast instead of
+//running out of memory. exempt paths (health checks) and streaming routes, which hold their request open for hours, never take a slot
+func limitConcurrency(c concurrencyConfig, exempt ...string) mux.MiddlewareFunc {
+	slots := make(chan struct{}, c.maxInFlight)
+	skip := map[string]bool{}
+	for _, path := range exempt {
+		skip[path] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if skip[r.URL.Path] || isStreaming(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !acquireSlot(r, slots, c.queueWait) {
+				if r.Context().Err() != nil {
+					//the client went away while waiting, there is no one to answer
+					return
+				}
+				httpRequestsShed.Inc()
+				w.Header().Set("Retry-After", overloadRetryAfter)
+				writeError(w, r, http.StatusServiceUnavailable, codeOverloaded, "the server is overloaded, try again shortly")
+				return
+			}
+			httpRequestsInFlight.Inc()
+			defer func() {
+				httpRequestsInFlight.Dec()
+				<-slots
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+//acquireSlot takes a slot, waiting up to wait for one to free up. it gives up early when the request is cancelled
+func acquireSlot(r *http.Request, slots chan struct{}, wait time.Duration) bool {
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+	if wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
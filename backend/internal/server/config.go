@@ -0,0 +1,693 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+//Config is everything the server reads from the environment, loaded once at startup by LoadConfig
+//secrets (the jwt secret, smtp, google and ldap passwords) are never part of the startup log, see LogValue
+type Config struct {
+	//DBDriver is postgres, mysql or sqlite. sqlite keeps everything in a file and needs no database server, it is meant for
+	//local development. mysql (or mariadb) is for deployments that cant have postgres, DatabaseURL is then a dsn like
+	//user:password@tcp(host:3306)/users. the handlers work on all three, the outbox relay, the ldap sync lock and the read
+	//replica need postgres
+	DBDriver    string
+	DatabaseURL string
+	//DatabaseReplicaURL is an optional read replica of the postgres database, the users are read from it, see store.Postgres
+	DatabaseReplicaURL string
+	DBPool             dbPoolConfig
+	DBConnectTimeout   time.Duration
+	//UserIdFormat is serial or uuid. every user has both, with uuid the routes take only the uuid or the public id (see resolveUserIds)
+	UserIdFormat string
+	//SlowQueryThreshold is how long a query runs before it is logged as slow and counted in db_slow_queries_total, 0 turns that off.
+	//SlowQueryLogArgs adds the query arguments to that log, they are user data like email addresses so it is meant for debugging
+	SlowQueryThreshold time.Duration
+	SlowQueryLogArgs   bool
+	//SeedUsers is how many made up users an empty database gets at startup, 0 seeds none. the -seed flag overrides it
+	SeedUsers int
+
+	ListenAddr string
+	//GRPCAddr is where the grpc user service listens, empty leaves it off
+	GRPCAddr       string
+	RequestTimeout time.Duration
+	//MaxBodyBytes caps request bodies, routes wrapped in withBodyLimit set their own limit
+	MaxBodyBytes int64
+	//MaxPageSize caps ?limit= on the lists, a bigger limit is clamped to it
+	MaxPageSize int
+	Shutdown    shutdownConfig
+	Concurrency concurrencyConfig
+	//Maintenance starts the server refusing writes, POST /admin/maintenance turns it on and off at runtime
+	Maintenance maintenanceConfig
+	//ReadOnly serves the reads only, for an instance on a standby database: the writes are refused, nothing is written in
+	//the background and the migrations are only checked. POST /admin/maintenance switches it at runtime as well
+	ReadOnly bool
+	//UserCache keeps the users read by id in memory, Redis in redis for every instance, see userCache
+	UserCache userCacheConfig
+	Redis     redisConfig
+	//UserNegativeCache remembers the ids no user was found for, see missingUserCache. it is off unless it has a ttl
+	UserNegativeCache userCacheConfig
+
+	LogLevel  slog.Level
+	LogFormat string
+	//paths the access log leaves out, by default health checks and metric scrapes
+	AccessLogSkipPaths []string
+	//BodyCapture adds the request and response bodies to the access log for debugging, see captureBodies
+	BodyCapture bodyCaptureConfig
+	//origins allowed to call the api from a browser, exact origins and https://*.example.com patterns may send the session cookie,
+	//* lets every origin in without credentials and is meant for development. empty means no cross origin access at all
+	CORSAllowedOrigins []string
+	//CORSAllowCredentials lets allowed origins send the session cookie, never together with *
+	CORSAllowCredentials bool
+	//CORSMaxAge is how long browsers may cache a preflight, 0 makes them send one before every request
+	CORSMaxAge time.Duration
+	//CORSAllowedHeaders and CORSAllowedMethods are what cross origin scripts may send, methods only on routes that have them
+	CORSAllowedHeaders []string
+	CORSAllowedMethods []string
+	//TrustedProxies are the networks of the reverse proxies in front of the server, only their X-Forwarded-For and
+	//X-Real-IP headers are believed, and their X-Forwarded-Host, -Proto and -Prefix for the links (see externalURL).
+	//empty, the default, takes the address of the connection as the client's
+	TrustedProxies trustedProxies
+	//ReadyHardDependencies are the dependencies /readyz fails without, the others only make it degraded, see readyz
+	ReadyHardDependencies []string
+	//AdminAllowedNetworks are the only networks the destructive admin routes answer, see adminNetworkGuard.
+	//empty, the default, restricts nothing
+	AdminAllowedNetworks []netip.Prefix
+	//MinClientVersions are the oldest client versions the route groups answer, see requireClientVersion.
+	//empty, the default, lets every version in
+	MinClientVersions minClientVersions
+
+	//JWTSecret signs the access tokens, when it is empty a random one is used, see useAuthConfig
+	JWTSecret       []byte
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	SessionTTL      time.Duration
+
+	RequireIfMatch           bool
+	RequireEmailVerification bool
+	//ErrorFormat is envelope or problem, with problem every json error is an rfc 7807 problem document.
+	//with envelope only clients that accept application/problem+json get those, see wantsProblem
+	ErrorFormat string
+	//JSONStringIds sends ids in json as strings, for clients that parse json with javascript's numbers, see model.StringIds
+	JSONStringIds bool
+	//GraphiQL serves a query editor for the graphql endpoint, meant for development
+	GraphiQL bool
+
+	LoginMaxFailures   int
+	LoginFailureWindow time.Duration
+
+	//RateLimitRPS is how many requests per second a client may send on average, 0 turns rate limiting off
+	RateLimitRPS   float64
+	RateLimitBurst int
+	//DeletionLimit is how many users one caller may delete in a window before its deletions are refused, see deletionGuard
+	DeletionLimit deletionLimitConfig
+	//EmailCheck is how GET /users/email-available answers, see emailAvailabilityChecker
+	EmailCheck emailCheckConfig
+	//NotFoundLimit is how many times one client may look up the same unknown user before it is answered 429, see notFoundThrottle
+	NotFoundLimit notFoundLimitConfig
+	//Jobs is how the background jobs like the welcome emails are run, see jobQueue
+	Jobs jobConfig
+
+	//OutboxPublisher is empty or "nats"
+	OutboxPublisher   string
+	NATSURL           string
+	OutboxNATSSubject string
+
+	SMTP smtpConfig
+	//LegacyAPISunset is when the deprecated /api/go alias of /api/v1 stops working
+	LegacyAPISunset time.Time
+
+	//Avatars is how big a profile picture may be and whether they are kept on disk or in s3
+	Avatars avatarConfig
+	//ImportMaxBytes caps the dumps POST /admin/import takes
+	ImportMaxBytes int64
+	//SnapshotTimeout is how long the read only transaction of GET /admin/export or of a list with ?snapshot=true may
+	//stay open, see snapshotTimeout
+	SnapshotTimeout time.Duration
+	//UserMetricsInterval is how often the users are counted for the user gauges of /metrics, 0 turns that off
+	UserMetricsInterval time.Duration
+	//UserChangesRetention is how long the change feed of GET /users/changes keeps a change, 0 keeps them forever
+	UserChangesRetention time.Duration
+	//Exports is when the server writes a dump like GET /admin/export on its own, and where to, see runScheduledExports
+	Exports exportConfig
+	//LDAP is the directory the users are mirrored from, the sync is off without LDAP_URL, see ldapSyncer
+	LDAP ldapConfig
+
+	//AppBaseURL is where the frontend is served, links in emails point there
+	AppBaseURL string
+	//PublicBaseURL is where clients reach this server when a reverse proxy puts it under another host or path,
+	//like https://example.com/accounts. links in responses start with it, when it is empty they follow the
+	//X-Forwarded-* headers of the trusted proxies or are relative to the request, see externalURL
+	PublicBaseURL string
+	//BasePath mounts the api under a path, like /backend for a proxy that passes /backend/api/v1/users on as it is.
+	//the probes and /metrics stay at the root. empty, the default, serves the api at /api/v1
+	BasePath string
+	Google   googleConfig
+}
+
+//smtpConfig is how emails are sent, without a host they are only logged
+type smtpConfig struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+//googleConfig is the oauth client for "sign in with google", the routes answer 503 until all three are set
+type googleConfig struct {
+	ClientId     string
+	ClientSecret string
+	RedirectURL  string
+}
+
+//LoadConfig reads the configuration from the environment and fills in the defaults
+//every missing or invalid value is reported in the returned error, not only the first one
+func LoadConfig() (*Config, error) {
+	env := &envReader{}
+	c := &Config{
+		DBDriver:           env.oneOf("DB_DRIVER", dbDriverPostgres, dbDriverPostgres, dbDriverMySQL, dbDriverSQLite),
+		DatabaseURL:        os.Getenv("DATABASE_URL"),
+		DatabaseReplicaURL: os.Getenv("DATABASE_REPLICA_URL"),
+		DBPool: dbPoolConfig{
+			maxOpenConns:    env.int("DB_MAX_OPEN_CONNS", defaultDBMaxOpenConns, 1),
+			maxIdleConns:    env.int("DB_MAX_IDLE_CONNS", defaultDBMaxIdleConns, 0),
+			connMaxLifetime: env.duration("DB_CONN_MAX_LIFETIME", defaultDBConnMaxLifetime, 0),
+			connMaxIdleTime: env.duration("DB_CONN_MAX_IDLE_TIME", defaultDBConnMaxIdleTime, 0),
+		},
+		DBConnectTimeout:   env.duration("DB_CONNECT_TIMEOUT", defaultDBConnectTimeout, time.Nanosecond),
+		SlowQueryThreshold: env.duration("SLOW_QUERY_THRESHOLD", defaultSlowQueryThreshold, 0),
+		SlowQueryLogArgs:   env.bool("SLOW_QUERY_LOG_ARGS"),
+		UserIdFormat:       env.oneOf("USER_ID_FORMAT", userIdFormatSerial, userIdFormatSerial, userIdFormatUuid),
+		SeedUsers:          env.int("SEED_USERS", 0, 0),
+
+		ListenAddr:     env.listenAddr(),
+		GRPCAddr:       env.string("GRPC_ADDR", ""),
+		RequestTimeout: env.duration("REQUEST_TIMEOUT", defaultRequestTimeout, time.Nanosecond),
+		MaxBodyBytes:   int64(env.int("MAX_BODY_BYTES", defaultMaxBodyBytes, 1)),
+		MaxPageSize:    env.int("MAX_PAGE_SIZE", defaultMaxPageSize, 1),
+		Shutdown: shutdownConfig{
+			DrainDelay: env.duration("SHUTDOWN_DRAIN_DELAY", defaultDrainDelay, 0),
+			Timeout:    env.duration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout, time.Nanosecond),
+		},
+		Concurrency: concurrencyConfig{
+			maxInFlight: env.int("MAX_IN_FLIGHT_REQUESTS", 0, 0),
+			queueWait:   env.duration("CONCURRENCY_QUEUE_WAIT", defaultConcurrencyQueueWait, 0),
+		},
+		Maintenance: maintenanceConfig{
+			enabled:    env.bool("MAINTENANCE_MODE"),
+			message:    os.Getenv("MAINTENANCE_MESSAGE"),
+			retryAfter: env.duration("MAINTENANCE_RETRY_AFTER", defaultMaintenanceRetryAfter, time.Second),
+		},
+		ReadOnly: env.bool("READ_ONLY"),
+		UserCache: userCacheConfig{
+			size: env.int("USER_CACHE_SIZE", defaultUserCacheSize, 0),
+			ttl:  env.duration("USER_CACHE_TTL", defaultUserCacheTTL, time.Nanosecond),
+		},
+		UserNegativeCache: userCacheConfig{
+			size: env.int("USER_NEGATIVE_CACHE_SIZE", defaultMissingUserCacheSize, 0),
+			ttl:  env.duration("USER_NEGATIVE_CACHE_TTL", defaultMissingUserCacheTTL, 0),
+		},
+		Redis: redisConfig{
+			url:     os.Getenv("REDIS_URL"),
+			userTTL: env.duration("REDIS_USER_TTL", defaultRedisUserTTL, time.Nanosecond),
+			listTTL: env.duration("REDIS_LIST_TTL", 0, 0),
+		},
+
+		LogLevel:           env.logLevel("LOG_LEVEL"),
+		LogFormat:          env.oneOf("LOG_FORMAT", "json", "json", "text"),
+		AccessLogSkipPaths: env.list("ACCESS_LOG_SKIP_PATHS", "/healthz,/livez,/readyz,/metrics"),
+		BodyCapture: bodyCaptureConfig{
+			always:   env.bool("DEBUG_BODY_CAPTURE"),
+			maxBytes: env.int("DEBUG_BODY_MAX_BYTES", defaultBodyCaptureMaxBytes, 1),
+			redact:   env.list("DEBUG_BODY_REDACT_FIELDS", defaultBodyCaptureRedactFields),
+		},
+		CORSAllowedOrigins:   env.list("CORS_ALLOWED_ORIGINS", ""),
+		CORSAllowCredentials: env.bool("CORS_ALLOW_CREDENTIALS"),
+		CORSMaxAge:           env.duration("CORS_MAX_AGE", defaultCORSMaxAge, 0),
+		CORSAllowedHeaders:   env.list("CORS_ALLOWED_HEADERS", defaultCORSAllowedHeaders),
+		CORSAllowedMethods:   env.list("CORS_ALLOWED_METHODS", defaultCORSAllowedMethods),
+		TrustedProxies:       env.prefixes("TRUSTED_PROXIES"),
+		AdminAllowedNetworks: env.prefixes("ADMIN_ALLOWED_NETWORKS"),
+
+		ReadyHardDependencies: env.list("READY_HARD_DEPENDENCIES", defaultHardDependencies),
+		MinClientVersions:     env.minClientVersions("MIN_CLIENT_VERSIONS"),
+
+		JWTSecret:       []byte(os.Getenv("JWT_SECRET")),
+		AccessTokenTTL:  env.duration("JWT_TTL", defaultAccessTokenTTL, time.Nanosecond),
+		RefreshTokenTTL: env.duration("REFRESH_TOKEN_TTL", defaultRefreshTokenTTL, time.Nanosecond),
+		SessionTTL:      env.duration("SESSION_TTL", defaultSessionTTL, time.Nanosecond),
+
+		RequireIfMatch:           env.bool("REQUIRE_IF_MATCH"),
+		RequireEmailVerification: env.bool("REQUIRE_EMAIL_VERIFICATION"),
+		ErrorFormat:              env.oneOf("ERROR_FORMAT", errorFormatEnvelope, errorFormatEnvelope, errorFormatProblem),
+		JSONStringIds:            env.bool("JSON_STRING_IDS"),
+		GraphiQL:                 env.bool("GRAPHIQL"),
+
+		LoginMaxFailures:   env.int("LOGIN_MAX_FAILURES", defaultLoginMaxFailures, 1),
+		LoginFailureWindow: env.duration("LOGIN_FAILURE_WINDOW", defaultLoginFailureWindow, time.Nanosecond),
+
+		RateLimitRPS:   env.float("RATE_LIMIT_RPS", defaultRateLimitRPS),
+		RateLimitBurst: env.int("RATE_LIMIT_BURST", defaultRateLimitBurst, 1),
+		DeletionLimit: deletionLimitConfig{
+			limit:  env.int("DELETION_LIMIT", defaultDeletionLimit, 0),
+			window: env.duration("DELETION_LIMIT_WINDOW", defaultDeletionLimitWindow, time.Second),
+		},
+		EmailCheck: emailCheckConfig{
+			perMinute: env.int("EMAIL_CHECK_LIMIT_PER_MINUTE", defaultEmailCheckLimit, 1),
+			public:    env.bool("EMAIL_CHECK_PUBLIC"),
+		},
+		NotFoundLimit: notFoundLimitConfig{
+			limit:  env.int("NOT_FOUND_LIMIT", defaultNotFoundLimit, 0),
+			window: env.duration("NOT_FOUND_LIMIT_WINDOW", defaultNotFoundLimitWindow, time.Second),
+		},
+		Jobs: jobConfig{
+			workers:     env.int("JOB_WORKERS", defaultJobWorkers, 0),
+			maxAttempts: env.int("JOB_MAX_ATTEMPTS", defaultJobMaxAttempts, 1),
+			retryDelay:  env.duration("JOB_RETRY_DELAY", defaultJobRetryDelay, time.Second),
+		},
+
+		OutboxPublisher:   env.oneOf("OUTBOX_PUBLISHER", "", "", "nats"),
+		NATSURL:           env.string("NATS_URL", nats.DefaultURL),
+		OutboxNATSSubject: env.string("OUTBOX_NATS_SUBJECT", "users.events"),
+
+		SMTP: smtpConfig{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     env.string("SMTP_PORT", "587"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     env.string("MAIL_FROM", "no-reply@localhost"),
+		},
+		Avatars: avatarConfig{
+			maxBytes: int64(env.int("AVATAR_MAX_BYTES", defaultAvatarMaxBytes, 1)),
+			blobs: blobStoreConfig{
+				storage: env.oneOf("AVATAR_STORAGE", blobStorageDisk, blobStorageDisk, blobStorageS3),
+				dir:     env.string("AVATAR_DIR", "avatars"),
+				s3: s3Config{
+					endpoint:        env.string("AVATAR_S3_ENDPOINT", "https://s3.amazonaws.com"),
+					bucket:          os.Getenv("AVATAR_S3_BUCKET"),
+					region:          os.Getenv("AVATAR_S3_REGION"),
+					accessKeyId:     os.Getenv("AVATAR_S3_ACCESS_KEY_ID"),
+					secretAccessKey: os.Getenv("AVATAR_S3_SECRET_ACCESS_KEY"),
+				},
+			},
+		},
+		ImportMaxBytes:       int64(env.int("IMPORT_MAX_BYTES", defaultImportMaxBytes, 1)),
+		SnapshotTimeout:      env.duration("SNAPSHOT_TIMEOUT", defaultSnapshotTimeout, time.Second),
+		UserMetricsInterval:  env.duration("USER_METRICS_INTERVAL", defaultUserMetricsInterval, 0),
+		UserChangesRetention: env.duration("USER_CHANGES_RETENTION", defaultUserChangesRetention, 0),
+		Exports: exportConfig{
+			scheduleExpr: os.Getenv("EXPORT_SCHEDULE"),
+			keep:         env.int("EXPORT_KEEP", defaultExportKeep, 0),
+			dest: blobStoreConfig{
+				storage: env.oneOf("EXPORT_STORAGE", blobStorageDisk, blobStorageDisk, blobStorageS3),
+				dir:     env.string("EXPORT_DIR", "exports"),
+				s3: s3Config{
+					endpoint:        env.string("EXPORT_S3_ENDPOINT", "https://s3.amazonaws.com"),
+					bucket:          os.Getenv("EXPORT_S3_BUCKET"),
+					region:          os.Getenv("EXPORT_S3_REGION"),
+					accessKeyId:     os.Getenv("EXPORT_S3_ACCESS_KEY_ID"),
+					secretAccessKey: os.Getenv("EXPORT_S3_SECRET_ACCESS_KEY"),
+				},
+			},
+		},
+		LDAP: ldapConfig{
+			url:          os.Getenv("LDAP_URL"),
+			startTLS:     env.bool("LDAP_START_TLS"),
+			bindDN:       os.Getenv("LDAP_BIND_DN"),
+			bindPassword: os.Getenv("LDAP_BIND_PASSWORD"),
+			baseDN:       os.Getenv("LDAP_BASE_DN"),
+			filter:       env.string("LDAP_USER_FILTER", defaultLDAPUserFilter),
+			idAttr:       env.string("LDAP_ATTR_ID", "entryUUID"),
+			nameAttr:     env.string("LDAP_ATTR_NAME", "cn"),
+			emailAttr:    env.string("LDAP_ATTR_EMAIL", "mail"),
+			pageSize:     env.int("LDAP_PAGE_SIZE", defaultLDAPPageSize, 1),
+			scheduleExpr: env.string("LDAP_SYNC_SCHEDULE", defaultLDAPSyncSchedule),
+		},
+		LegacyAPISunset: env.date("LEGACY_API_SUNSET", defaultLegacyAPISunset),
+		AppBaseURL:      strings.TrimSuffix(env.string("APP_BASE_URL", "http://localhost:3000"), "/"),
+		PublicBaseURL:   strings.TrimSuffix(env.string("PUBLIC_BASE_URL", ""), "/"),
+		BasePath:        strings.TrimSuffix(env.string("BASE_PATH", ""), "/"),
+		Google: googleConfig{
+			ClientId:     os.Getenv("GOOGLE_CLIENT_ID"),
+			ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
+			RedirectURL:  os.Getenv("GOOGLE_REDIRECT_URL"),
+		},
+	}
+	for _, origin := range c.CORSAllowedOrigins {
+		if err := checkOriginPattern(origin); err != nil {
+			env.fail("CORS_ALLOWED_ORIGINS: %w", err)
+		}
+	}
+	for _, name := range c.ReadyHardDependencies {
+		if !slices.Contains(dependencies, name) {
+			env.fail("READY_HARD_DEPENDENCIES must be some of %s, got %q", strings.Join(dependencies, ", "), name)
+		}
+	}
+	for i, method := range c.CORSAllowedMethods {
+		//methods are case sensitive, but nobody means "get" when they write it
+		c.CORSAllowedMethods[i] = strings.ToUpper(method)
+	}
+	switch {
+	case c.DatabaseURL == "" && c.DBDriver == dbDriverSQLite:
+		c.DatabaseURL = defaultSQLiteDatabase
+	case c.DatabaseURL == "":
+		env.fail("DATABASE_URL is required")
+	}
+	if c.BasePath != "" && !validPathPrefix(c.BasePath) {
+		env.fail("BASE_PATH must be a path like /backend, got %q", c.BasePath)
+	}
+	if c.Avatars.blobs.storage == blobStorageS3 && c.Avatars.blobs.s3.bucket == "" {
+		env.fail("AVATAR_S3_BUCKET is required with AVATAR_STORAGE=s3")
+	}
+	if c.Exports.scheduleExpr != "" {
+		schedule, err := parseCron(c.Exports.scheduleExpr)
+		if err != nil {
+			env.fail("EXPORT_SCHEDULE: %w", err)
+		}
+		c.Exports.schedule = &schedule
+	}
+	if c.Exports.schedule != nil && c.Exports.dest.storage == blobStorageS3 && c.Exports.dest.s3.bucket == "" {
+		env.fail("EXPORT_S3_BUCKET is required with EXPORT_STORAGE=s3")
+	}
+	if c.LDAP.url != "" {
+		if err := c.LDAP.check(); err != nil {
+			env.fail("%w", err)
+		}
+	}
+	if c.DatabaseReplicaURL != "" && c.DBDriver != dbDriverPostgres {
+		env.fail("DATABASE_REPLICA_URL needs DB_DRIVER=postgres")
+	}
+	//the relay locks the outbox with a postgres advisory lock
+	if c.OutboxPublisher != "" && c.DBDriver != dbDriverPostgres {
+		env.fail("OUTBOX_PUBLISHER needs DB_DRIVER=postgres")
+	}
+	//more idle than open connections would never be used
+	c.DBPool.maxIdleConns = min(c.DBPool.maxIdleConns, c.DBPool.maxOpenConns)
+	//nearly every request needs a connection, more requests than connections would only queue up in the pool
+	if c.Concurrency.maxInFlight == 0 {
+		c.Concurrency.maxInFlight = c.DBPool.maxOpenConns * inFlightPerDBConn
+	}
+
+	if err := errors.Join(env.errs...); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return c, nil
+}
+
+//LogValue is what the startup log shows of the configuration: every setting except the secrets
+//and the database url, which usually carries a password
+func (c *Config) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("db_driver", c.DBDriver),
+		slog.Bool("db_replica", c.DatabaseReplicaURL != ""),
+		slog.String("listen_addr", c.ListenAddr),
+		slog.String("grpc_addr", c.GRPCAddr),
+		slog.Int("db_max_open_conns", c.DBPool.maxOpenConns),
+		slog.Int("db_max_idle_conns", c.DBPool.maxIdleConns),
+		slog.String("db_conn_max_lifetime", c.DBPool.connMaxLifetime.String()),
+		slog.String("db_conn_max_idle_time", c.DBPool.connMaxIdleTime.String()),
+		slog.String("db_connect_timeout", c.DBConnectTimeout.String()),
+		slog.String("slow_query_threshold", c.SlowQueryThreshold.String()),
+		slog.Bool("slow_query_log_args", c.SlowQueryLogArgs),
+		slog.Int("seed_users", c.SeedUsers),
+		slog.String("user_id_format", c.UserIdFormat),
+		slog.String("request_timeout", c.RequestTimeout.String()),
+		slog.Int64("max_body_bytes", c.MaxBodyBytes),
+		slog.Int("max_page_size", c.MaxPageSize),
+		slog.String("shutdown_drain_delay", c.Shutdown.DrainDelay.String()),
+		slog.String("shutdown_timeout", c.Shutdown.Timeout.String()),
+		slog.Int("max_in_flight_requests", c.Concurrency.maxInFlight),
+		slog.String("concurrency_queue_wait", c.Concurrency.queueWait.String()),
+		slog.Bool("maintenance_mode", c.Maintenance.enabled),
+		slog.String("maintenance_retry_after", c.Maintenance.retryAfter.String()),
+		slog.Bool("read_only", c.ReadOnly),
+		slog.Int("user_cache_size", c.UserCache.size),
+		slog.String("user_cache_ttl", c.UserCache.ttl.String()),
+		slog.Int("user_negative_cache_size", c.UserNegativeCache.size),
+		slog.String("user_negative_cache_ttl", c.UserNegativeCache.ttl.String()),
+		slog.Bool("redis", c.Redis.url != ""),
+		slog.String("redis_user_ttl", c.Redis.userTTL.String()),
+		slog.String("redis_list_ttl", c.Redis.listTTL.String()),
+		slog.String("log_level", c.LogLevel.String()),
+		slog.String("log_format", c.LogFormat),
+		slog.Any("access_log_skip_paths", c.AccessLogSkipPaths),
+		slog.Any("ready_hard_dependencies", c.ReadyHardDependencies),
+		slog.Bool("debug_body_capture", c.BodyCapture.always),
+		slog.Int("debug_body_max_bytes", c.BodyCapture.maxBytes),
+		slog.Any("debug_body_redact_fields", c.BodyCapture.redact),
+		slog.Any("cors_allowed_origins", c.CORSAllowedOrigins),
+		slog.Bool("cors_allow_credentials", c.CORSAllowCredentials),
+		slog.String("cors_max_age", c.CORSMaxAge.String()),
+		slog.Any("cors_allowed_headers", c.CORSAllowedHeaders),
+		slog.Any("cors_allowed_methods", c.CORSAllowedMethods),
+		slog.Any("trusted_proxies", c.TrustedProxies),
+		slog.Any("admin_allowed_networks", c.AdminAllowedNetworks),
+		slog.Any("min_client_versions", c.MinClientVersions),
+		slog.Bool("jwt_secret_set", len(c.JWTSecret) > 0),
+		slog.String("access_token_ttl", c.AccessTokenTTL.String()),
+		slog.String("refresh_token_ttl", c.RefreshTokenTTL.String()),
+		slog.String("session_ttl", c.SessionTTL.String()),
+		slog.Bool("require_if_match", c.RequireIfMatch),
+		slog.Bool("require_email_verification", c.RequireEmailVerification),
+		slog.String("error_format", c.ErrorFormat),
+		slog.Bool("json_string_ids", c.JSONStringIds),
+		slog.Bool("graphiql", c.GraphiQL),
+		slog.Int("login_max_failures", c.LoginMaxFailures),
+		slog.String("login_failure_window", c.LoginFailureWindow.String()),
+		slog.Float64("rate_limit_rps", c.RateLimitRPS),
+		slog.Int("rate_limit_burst", c.RateLimitBurst),
+		slog.Int("deletion_limit", c.DeletionLimit.limit),
+		slog.String("deletion_limit_window", c.DeletionLimit.window.String()),
+		slog.Int("email_check_limit_per_minute", c.EmailCheck.perMinute),
+		slog.Bool("email_check_public", c.EmailCheck.public),
+		slog.Int("not_found_limit", c.NotFoundLimit.limit),
+		slog.String("not_found_limit_window", c.NotFoundLimit.window.String()),
+		slog.Int("job_workers", c.Jobs.workers),
+		slog.Int("job_max_attempts", c.Jobs.maxAttempts),
+		slog.String("job_retry_delay", c.Jobs.retryDelay.String()),
+		slog.String("outbox_publisher", c.OutboxPublisher),
+		slog.String("smtp_host", c.SMTP.Host),
+		slog.Int64("avatar_max_bytes", c.Avatars.maxBytes),
+		slog.String("avatar_storage", c.Avatars.blobs.storage),
+		slog.String("avatar_dir", c.Avatars.blobs.dir),
+		slog.String("avatar_s3_bucket", c.Avatars.blobs.s3.bucket),
+		slog.Int64("import_max_bytes", c.ImportMaxBytes),
+		slog.String("snapshot_timeout", c.SnapshotTimeout.String()),
+		slog.String("user_metrics_interval", c.UserMetricsInterval.String()),
+		slog.String("user_changes_retention", c.UserChangesRetention.String()),
+		slog.String("export_schedule", c.Exports.scheduleExpr),
+		slog.Int("export_keep", c.Exports.keep),
+		slog.String("export_storage", c.Exports.dest.storage),
+		slog.String("export_dir", c.Exports.dest.dir),
+		slog.String("export_s3_bucket", c.Exports.dest.s3.bucket),
+		slog.String("ldap_url", c.LDAP.url),
+		slog.Bool("ldap_start_tls", c.LDAP.startTLS),
+		slog.String("ldap_bind_dn", c.LDAP.bindDN),
+		slog.String("ldap_base_dn", c.LDAP.baseDN),
+		slog.String("ldap_user_filter", c.LDAP.filter),
+		slog.String("ldap_sync_schedule", c.LDAP.scheduleExpr),
+		slog.String("legacy_api_sunset", c.LegacyAPISunset.Format(time.DateOnly)),
+		slog.String("app_base_url", c.AppBaseURL),
+		slog.String("public_base_url", c.PublicBaseURL),
+		slog.String("base_path", c.BasePath),
+		slog.Bool("google_configured", c.Google.ClientId != "" && c.Google.ClientSecret != "" && c.Google.RedirectURL != ""),
+	)
+}
+
+//envReader reads typed environment variables and collects what is wrong with them instead of stopping at the first error
+type envReader struct {
+	errs []error
+}
+
+func (e *envReader) fail(format string, args ...any) {
+	e.errs = append(e.errs, fmt.Errorf(format, args...))
+}
+
+func (e *envReader) string(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+//bool is true only for "true", like the feature flags always were
+func (e *envReader) bool(name string) bool {
+	switch v := os.Getenv(name); v {
+	case "true":
+		return true
+	case "", "false":
+		return false
+	default:
+		e.fail("%s must be true or false, got %q", name, v)
+		return false
+	}
+}
+
+func (e *envReader) int(name string, def, minimum int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < minimum {
+		e.fail("%s must be a whole number of at least %d, got %q", name, minimum, v)
+		return def
+	}
+	return n
+}
+
+//float parses a non negative number like 2.5
+func (e *envReader) float(name string, def float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+		e.fail("%s must be a number of at least 0, got %q", name, v)
+		return def
+	}
+	return f
+}
+
+//duration parses values like 15m or 720h, minimum is the smallest accepted value (0 allows turning a delay off)
+func (e *envReader) duration(name string, def, minimum time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < minimum {
+		if minimum > 0 {
+			e.fail("%s must be a positive duration like 30s, got %q", name, v)
+		} else {
+			e.fail("%s must be a duration like 30s, got %q", name, v)
+		}
+		return def
+	}
+	return d
+}
+
+//date parses a day like 2027-06-30, def is in the same format
+func (e *envReader) date(name, def string) time.Time {
+	v := os.Getenv(name)
+	if v == "" {
+		v = def
+	}
+	d, err := time.Parse(time.DateOnly, v)
+	if err != nil {
+		e.fail("%s must be a date like 2027-06-30, got %q", name, v)
+	}
+	return d
+}
+
+func (e *envReader) oneOf(name, def string, allowed ...string) string {
+	v := strings.ToLower(os.Getenv(name))
+	if v == "" {
+		return def
+	}
+	for _, a := range allowed {
+		if v == a {
+			return v
+		}
+	}
+	e.fail("%s must be one of %q, got %q", name, allowed, v)
+	return def
+}
+
+//list splits a comma separated variable. def is used when the variable isnt set at all,
+//so setting it to an empty string turns the default off
+func (e *envReader) list(name, def string) []string {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		v = def
+	}
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+//prefixes parses a comma separated list of networks like 10.0.0.0/8 or fd00::/8, a single address is a network of its own
+func (e *envReader) prefixes(name string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, item := range e.list(name, "") {
+		if !strings.Contains(item, "/") {
+			if addr, err := netip.ParseAddr(item); err == nil {
+				prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+				continue
+			}
+		}
+		p, err := netip.ParsePrefix(item)
+		if err != nil {
+			e.fail("%s must list networks like 10.0.0.0/8 or addresses, got %q", name, item)
+			continue
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes
+}
+
+//minClientVersions parses a comma separated list of route groups and versions like users=2.3,admin=1.0,*=1.2
+func (e *envReader) minClientVersions(name string) minClientVersions {
+	mins := minClientVersions{}
+	for _, item := range e.list(name, "") {
+		group, version, _ := strings.Cut(item, "=")
+		group = strings.TrimSpace(group)
+		v, ok := parseClientVersion(version)
+		if group == "" || strings.Contains(group, "/") || !ok {
+			e.fail("%s must list route groups and versions like users=2.3, got %q", name, item)
+			continue
+		}
+		mins[group] = v
+	}
+	return mins
+}
+
+func (e *envReader) logLevel(name string) slog.Level {
+	var level slog.Level
+	if v := os.Getenv(name); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			e.fail("%s must be debug, info, warn or error, got %q", name, v)
+		}
+	}
+	return level
+}
+
+//listenAddr picks the address to listen on from -addr, LISTEN_ADDR or PORT, in that order
+//LISTEN_ADDR can pin an interface like 127.0.0.1:8000, PORT is only a port number as set by most platforms
+func (e *envReader) listenAddr() string {
+	addr := defaultListenAddr
+	switch {
+	case *addrFlag != "":
+		addr = *addrFlag
+	case os.Getenv("LISTEN_ADDR") != "":
+		addr = os.Getenv("LISTEN_ADDR")
+	case os.Getenv("PORT") != "":
+		addr = ":" + os.Getenv("PORT")
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		e.fail("listen address must look like :8000 or 127.0.0.1:8000, got %q", addr)
+		return addr
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		e.fail("listen address %q has an invalid port", addr)
+	}
+	return addr
+}
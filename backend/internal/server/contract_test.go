@@ -0,0 +1,295 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"api/internal/model"
+)
+
+//the contract tests run the flows whose sql differs the most between the engines on every database testdb reaches,
+//through the api like a client would
+
+func TestContractLoginAndRefresh(t *testing.T) {
+	eachDatabase(t, nil, func(t *testing.T, ts *testServer) {
+		ts.createUser("Ada", "ada@example.com", model.RoleMember)
+		res := ts.do("POST", "/api/v1/login", "", map[string]any{"email": "ADA@example.com", "password": "password123"})
+		expect(t, res, http.StatusOK)
+		var tokens tokenResponse
+		res.decode(t, &tokens)
+		if tokens.AccessToken == "" || tokens.RefreshToken == "" {
+			t.Fatalf("login answered %s", res.body)
+		}
+		expect(t, ts.do("GET", "/api/v1/me", tokens.AccessToken, nil), http.StatusOK)
+		expect(t, ts.do("POST", "/api/v1/login", "", map[string]any{"email": "ada@example.com", "password": "wrong-password"}), http.StatusUnauthorized)
+
+		res = ts.do("POST", "/api/v1/token/refresh", "", map[string]any{"refresh_token": tokens.RefreshToken})
+		expect(t, res, http.StatusOK)
+		var refreshed tokenResponse
+		res.decode(t, &refreshed)
+		if refreshed.RefreshToken == "" || refreshed.RefreshToken == tokens.RefreshToken {
+			t.Fatalf("refresh answered %s", res.body)
+		}
+		//a refresh token is used once
+		expect(t, ts.do("POST", "/api/v1/token/refresh", "", map[string]any{"refresh_token": tokens.RefreshToken}), http.StatusUnauthorized)
+
+		expect(t, ts.do("POST", "/api/v1/logout", "", map[string]any{"refresh_token": refreshed.RefreshToken}), http.StatusNoContent)
+		expect(t, ts.do("POST", "/api/v1/token/refresh", "", map[string]any{"refresh_token": refreshed.RefreshToken}), http.StatusUnauthorized)
+	})
+}
+
+func TestContractSessions(t *testing.T) {
+	eachDatabase(t, nil, func(t *testing.T, ts *testServer) {
+		ts.createUser("Ada", "ada@example.com", model.RoleMember)
+		res := ts.do("POST", "/api/v1/login", "", map[string]any{"email": "ada@example.com", "password": "password123", "session": true})
+		expect(t, res, http.StatusNoContent)
+		var cookie *http.Cookie
+		for _, c := range res.Cookies() {
+			if c.Name == sessionCookie {
+				cookie = c
+			}
+		}
+		if cookie == nil || cookie.Value == "" {
+			t.Fatalf("login set no session cookie: %v", res.Header["Set-Cookie"])
+		}
+		session := sessionCookie + "=" + cookie.Value
+		expect(t, ts.do("GET", "/api/v1/me", "", nil, "Cookie", session), http.StatusOK)
+		expect(t, ts.do("POST", "/api/v1/logout", "", nil, "Cookie", session), http.StatusNoContent)
+		expect(t, ts.do("GET", "/api/v1/me", "", nil, "Cookie", session), http.StatusUnauthorized)
+	})
+}
+
+func TestContractApiKeyUsage(t *testing.T) {
+	eachDatabase(t, nil, func(t *testing.T, ts *testServer) {
+		admin := ts.admin()
+		res := ts.do("POST", "/api/v1/apikeys", admin, map[string]any{"label": "sync"})
+		expect(t, res, http.StatusCreated)
+		var key ApiKey
+		res.decode(t, &key)
+		if key.Id == 0 || key.Key == "" || key.CreatedAt.IsZero() {
+			t.Fatalf("created key %s", res.body)
+		}
+		for range 3 {
+			expect(t, ts.do("GET", "/api/v1/users", "", nil, "X-API-Key", key.Key), http.StatusOK)
+		}
+		expect(t, ts.do("GET", "/api/v1/users", "", nil, "X-API-Key", key.Key+"x"), http.StatusUnauthorized)
+
+		res = ts.do("GET", "/api/v1/apikeys/"+strconv.Itoa(int(key.Id))+"/usage", admin, nil)
+		expect(t, res, http.StatusOK)
+		var usage apiKeyUsage
+		res.decode(t, &usage)
+		today := time.Now().UTC().Format(time.DateOnly)
+		if len(usage.Days) != 1 || usage.Days[0].Day != today || usage.Days[0].Requests != 3 {
+			t.Fatalf("usage %s, want 3 requests on %s", res.body, today)
+		}
+		if n := ts.count("api_keys", "id = $1 AND last_used_at IS NOT NULL", key.Id); n != 1 {
+			t.Fatal("last_used_at wasnt set")
+		}
+
+		expect(t, ts.do("DELETE", "/api/v1/apikeys/"+strconv.Itoa(int(key.Id)), admin, nil), http.StatusNoContent)
+		expect(t, ts.do("GET", "/api/v1/users", "", nil, "X-API-Key", key.Key), http.StatusUnauthorized)
+	})
+}
+
+func TestContractIdempotencyKey(t *testing.T) {
+	eachDatabase(t, nil, func(t *testing.T, ts *testServer) {
+		admin := ts.admin()
+		body := map[string]any{"name": "Grace", "email": "grace@example.com", "password": "password123"}
+		first := ts.do("POST", "/api/v1/users", admin, body, "Idempotency-Key", "create-grace")
+		expect(t, first, http.StatusCreated)
+		again := ts.do("POST", "/api/v1/users", admin, body, "Idempotency-Key", "create-grace")
+		expect(t, again, http.StatusCreated)
+		if again.Header.Get("Idempotent-Replayed") != "true" || string(again.body) != string(first.body) {
+			t.Fatalf("retry wasnt replayed: %s", again.body)
+		}
+		if n := ts.count("users", "email = $1", "grace@example.com"); n != 1 {
+			t.Fatalf("%d users created", n)
+		}
+		other := map[string]any{"name": "Other", "email": "other@example.com", "password": "password123"}
+		res := ts.do("POST", "/api/v1/users", admin, other, "Idempotency-Key", "create-grace")
+		expect(t, res, http.StatusUnprocessableEntity)
+		if res.errorCode() != codeIdempotencyKeyReused {
+			t.Fatalf("reused key answered %s", res.body)
+		}
+
+		//another admin's key of the same name is theirs, it neither replays nor is refused
+		second := ts.tokenFor(ts.createUser("Second", "second@example.com", model.RoleAdmin))
+		res = ts.do("POST", "/api/v1/users", second, other, "Idempotency-Key", "create-grace")
+		expect(t, res, http.StatusCreated)
+		if res.Header.Get("Idempotent-Replayed") != "" || strings.Contains(string(res.body), "grace@example.com") {
+			t.Fatalf("another admin's key answered %s", res.body)
+		}
+		if again := ts.do("POST", "/api/v1/users", second, other, "Idempotency-Key", "create-grace"); again.Header.Get("Idempotent-Replayed") != "true" || string(again.body) != string(res.body) {
+			t.Fatalf("the second admin's retry answered %d %s", again.StatusCode, again.body)
+		}
+		if again := ts.do("POST", "/api/v1/users", admin, body, "Idempotency-Key", "create-grace"); string(again.body) != string(first.body) {
+			t.Fatalf("the first admin's retry answered %s", again.body)
+		}
+	})
+}
+
+func TestContractEmailVerification(t *testing.T) {
+	eachDatabase(t, nil, func(t *testing.T, ts *testServer) {
+		admin := ts.admin()
+		res := ts.do("POST", "/api/v1/users", admin, map[string]any{"name": "Grace", "email": "grace@example.com", "password": "password123"})
+		expect(t, res, http.StatusCreated)
+		var u model.User
+		res.decode(t, &u)
+		token := ts.mail.nextWith(t, "grace@example.com", "Confirm your email address").linkToken(t)
+
+		expect(t, ts.do("GET", "/api/v1/users/verify?token=wrong", "", nil), http.StatusBadRequest)
+		expect(t, ts.do("GET", "/api/v1/users/verify?token="+token, "", nil), http.StatusNoContent)
+		res = ts.do("GET", userPath(u.Id), admin, nil)
+		expect(t, res, http.StatusOK)
+		res.decode(t, &u)
+		if !u.Verified {
+			t.Fatalf("user isnt verified: %s", res.body)
+		}
+		expect(t, ts.do("GET", "/api/v1/users/verify?token="+token, "", nil), http.StatusBadRequest)
+	})
+}
+
+func TestContractPasswordReset(t *testing.T) {
+	eachDatabase(t, nil, func(t *testing.T, ts *testServer) {
+		ts.createUser("Ada", "ada@example.com", model.RoleMember)
+		expect(t, ts.do("POST", "/api/v1/password/forgot", "", map[string]any{"email": "ada@example.com"}), http.StatusAccepted)
+		msg := ts.mail.nextTo(t, "ada@example.com")
+		if msg.Subject != "Reset your password" {
+			t.Fatalf("got %q", msg.Subject)
+		}
+		token := msg.linkToken(t)
+		reset := map[string]any{"token": token, "new_password": "a-new-password"}
+		expect(t, ts.do("POST", "/api/v1/password/reset", "", reset), http.StatusNoContent)
+		expect(t, ts.do("POST", "/api/v1/password/reset", "", reset), http.StatusBadRequest)
+		expect(t, ts.do("POST", "/api/v1/login", "", map[string]any{"email": "ada@example.com", "password": "password123"}), http.StatusUnauthorized)
+		expect(t, ts.do("POST", "/api/v1/login", "", map[string]any{"email": "ada@example.com", "password": "a-new-password"}), http.StatusOK)
+
+		//unknown addresses are answered the same, without a mail
+		expect(t, ts.do("POST", "/api/v1/password/forgot", "", map[string]any{"email": "nobody@example.com"}), http.StatusAccepted)
+		ts.mail.none(t)
+	})
+}
+
+func TestContractEmailChange(t *testing.T) {
+	eachDatabase(t, nil, func(t *testing.T, ts *testServer) {
+		admin := ts.admin()
+		u := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+		res := ts.do("PUT", userPath(u.Id), admin, map[string]any{"name": "Ada", "email": "ada@new.example"})
+		expect(t, res, http.StatusOK)
+		token := ts.mail.nextTo(t, "ada@new.example").linkToken(t)
+
+		expect(t, ts.do("POST", userPath(u.Id)+"/email/confirm", admin, map[string]any{"token": "wrong"}), http.StatusBadRequest)
+		res = ts.do("POST", userPath(u.Id)+"/email/confirm", admin, map[string]any{"token": token})
+		expect(t, res, http.StatusOK)
+		var changed model.User
+		res.decode(t, &changed)
+		if changed.Email != "ada@new.example" || changed.PendingEmail != "" {
+			t.Fatalf("confirmed to %s", res.body)
+		}
+
+		//an address taken while the change was pending is refused when it is confirmed
+		res = ts.do("PUT", userPath(u.Id), admin, map[string]any{"name": "Ada", "email": "ada@third.example"})
+		expect(t, res, http.StatusOK)
+		token = ts.mail.nextTo(t, "ada@third.example").linkToken(t)
+		ts.createUser("Thief", "ada@third.example", model.RoleMember)
+		res = ts.do("POST", userPath(u.Id)+"/email/confirm", admin, map[string]any{"token": token})
+		expect(t, res, http.StatusConflict)
+	})
+}
+
+func TestContractGroupsAndAddresses(t *testing.T) {
+	eachDatabase(t, nil, func(t *testing.T, ts *testServer) {
+		admin := ts.admin()
+		u := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+
+		res := ts.do("POST", "/api/v1/groups", admin, map[string]any{"name": "Engineering", "description": "builds things"})
+		expect(t, res, http.StatusCreated)
+		var g model.Group
+		res.decode(t, &g)
+		if g.Id == 0 || g.Name != "Engineering" || g.CreatedAt.IsZero() {
+			t.Fatalf("created group %s", res.body)
+		}
+		groupPath := "/api/v1/groups/" + strconv.Itoa(int(g.Id))
+		//the same values again still find the group
+		expect(t, ts.do("PUT", groupPath, admin, map[string]any{"name": "Engineering", "description": "builds things"}), http.StatusOK)
+		expect(t, ts.do("PUT", "/api/v1/groups/999", admin, map[string]any{"name": "Nobody"}), http.StatusNotFound)
+		expect(t, ts.do("POST", groupPath+"/members", admin, map[string]any{"user_id": u.Id}), http.StatusNoContent)
+		expect(t, ts.do("POST", groupPath+"/members", admin, map[string]any{"user_id": u.Id}), http.StatusConflict)
+
+		address := map[string]any{"label": "home", "line1": "1 Main St", "city": "Springfield", "postal_code": "12345", "country": "US"}
+		res = ts.do("POST", userPath(u.Id)+"/addresses", admin, address)
+		expect(t, res, http.StatusCreated)
+		var a model.Address
+		res.decode(t, &a)
+		if a.Id == 0 || a.UserId != u.Id || a.City != "Springfield" {
+			t.Fatalf("created address %s", res.body)
+		}
+		expect(t, ts.do("POST", userPath(999)+"/addresses", admin, address), http.StatusNotFound)
+		addressPath := userPath(u.Id) + "/addresses/" + strconv.Itoa(int(a.Id))
+		expect(t, ts.do("PUT", addressPath, admin, address), http.StatusOK)
+		expect(t, ts.do("PUT", userPath(u.Id)+"/addresses/999", admin, address), http.StatusNotFound)
+		expect(t, ts.do("DELETE", addressPath, admin, nil), http.StatusNoContent)
+	})
+}
+
+func TestContractBulkUpdateAndActivation(t *testing.T) {
+	eachDatabase(t, nil, func(t *testing.T, ts *testServer) {
+		admin := ts.admin()
+		ada := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+		grace := ts.createUser("Grace", "grace@example.com", model.RoleAdmin)
+
+		res := ts.do("PATCH", "/api/v1/users", admin, map[string]any{"ids": []model.ID{ada.Id, grace.Id, 999}, "set": map[string]any{"role": model.RoleAdmin}})
+		expect(t, res, http.StatusOK)
+		var result bulkUpdateResult
+		res.decode(t, &result)
+		if result.Updated != 1 || result.Unchanged != 1 || len(result.Missing) != 1 || result.Missing[0] != 999 {
+			t.Fatalf("bulk update answered %s", res.body)
+		}
+		if n := ts.count("users", "id = $1 AND role = $2 AND version = 2", ada.Id, model.RoleAdmin); n != 1 {
+			t.Fatal("ada wasnt made an admin")
+		}
+
+		res = ts.do("POST", userPath(ada.Id)+"/deactivate", admin, nil)
+		expect(t, res, http.StatusOK)
+		var u model.User
+		res.decode(t, &u)
+		if u.Active {
+			t.Fatalf("deactivated to %s", res.body)
+		}
+		//deactivating again changes nothing
+		expect(t, ts.do("POST", userPath(ada.Id)+"/deactivate", admin, nil), http.StatusOK)
+		if n := ts.count("users", "id = $1 AND NOT active AND version = 3", ada.Id); n != 1 {
+			t.Fatal("deactivating twice changed the user twice")
+		}
+		expect(t, ts.do("POST", userPath(ada.Id)+"/activate", admin, nil), http.StatusOK)
+	})
+}
+
+func TestContractMergeAndRevokeCredentials(t *testing.T) {
+	eachDatabase(t, nil, func(t *testing.T, ts *testServer) {
+		admin := ts.admin()
+		ada := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+		duplicate := ts.createUser("Ada L", "ada.l@example.com", model.RoleMember)
+
+		res := ts.do("POST", userPath(duplicate.Id)+"/merge", admin, map[string]any{"into": ada.Id})
+		expect(t, res, http.StatusOK)
+		if n := ts.count("users", "id = $1 AND NOT active AND merged_into_id = $2", duplicate.Id, ada.Id); n != 1 {
+			t.Fatal("the duplicate wasnt deactivated and linked")
+		}
+
+		token := ts.tokenFor(ada)
+		expect(t, ts.do("GET", "/api/v1/me", token, nil), http.StatusOK)
+		res = ts.do("POST", userPath(ada.Id)+"/revoke-credentials", admin, nil)
+		expect(t, res, http.StatusOK)
+		var revoked revokedCredentials
+		res.decode(t, &revoked)
+		if revoked.UserId != ada.Id || revoked.RevokedAt.IsZero() {
+			t.Fatalf("revoke answered %s", res.body)
+		}
+		expect(t, ts.do("GET", "/api/v1/me", token, nil), http.StatusUnauthorized)
+		expect(t, ts.do("POST", userPath(999)+"/revoke-credentials", admin, nil), http.StatusNotFound)
+	})
+}
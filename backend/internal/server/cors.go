@@ -0,0 +1,172 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//defaultCORSMaxAge is how long browsers cache a preflight when CORS_MAX_AGE isnt set
+const defaultCORSMaxAge = 10 * time.Minute
+
+//defaults of CORS_ALLOWED_HEADERS, the request headers cross origin scripts may send,
+//and CORS_ALLOWED_METHODS, the methods they may use on the routes that have them. OPTIONS is always answered by enableCORS
+const (
+	defaultCORSAllowedHeaders = "Authorization,X-API-Key,Content-Type,If-Match,If-None-Match,If-Modified-Since,Idempotency-Key,X-Request-ID,X-Client-Version"
+	defaultCORSAllowedMethods = "GET,POST,PUT,PATCH,DELETE"
+)
+
+//corsPolicy decides which origins get cors headers, built from CORS_ALLOWED_ORIGINS
+//entries are exact origins like https://tools.example.com, subdomain patterns like https://*.example.com, or * for development
+type corsPolicy struct {
+	origins map[string]bool
+	//subdomains holds the patterns split around the *, e.g. {"https://", ".example.com"}
+	subdomains [][2]string
+	//anyOrigin is set by a * entry
+	anyOrigin bool
+	//credentials lets listed origins and subdomain patterns send the session cookie
+	credentials bool
+	//maxAge is the Access-Control-Max-Age of preflights, in seconds
+	maxAge string
+	//headers is the Access-Control-Allow-Headers of preflights
+	headers string
+	//methods are the methods preflights are checked for
+	methods []string
+}
+
+//newCORSPolicy builds the policy from the cors settings of cfg, its origins are checked by checkOriginPattern
+func newCORSPolicy(cfg *Config) *corsPolicy {
+	p := &corsPolicy{
+		origins:     map[string]bool{},
+		credentials: cfg.CORSAllowCredentials,
+		maxAge:      strconv.Itoa(int(cfg.CORSMaxAge.Seconds())),
+		headers:     strings.Join(cfg.CORSAllowedHeaders, ", "),
+		methods:     cfg.CORSAllowedMethods,
+	}
+	for _, entry := range cfg.CORSAllowedOrigins {
+		switch {
+		case entry == "*":
+			p.anyOrigin = true
+		case strings.Contains(entry, "*"):
+			scheme, domain, _ := strings.Cut(entry, "*")
+			p.subdomains = append(p.subdomains, [2]string{scheme, domain})
+		default:
+			p.origins[entry] = true
+		}
+	}
+	return p
+}
+
+//allow returns the Access-Control-Allow-Origin for origin and whether credentials (the session cookie) may be sent,
+//an empty value means the origin isnt allowed and gets no cors headers.
+//listed origins and subdomain patterns are echoed back by name, * answers with * which browsers never send cookies to,
+//so credentials are only allowed for named origins
+func (p *corsPolicy) allow(origin string) (string, bool) {
+	if origin == "" {
+		return "", false
+	}
+	if p.origins[origin] {
+		return origin, p.credentials
+	}
+	for _, s := range p.subdomains {
+		sub, ok := strings.CutPrefix(origin, s[0])
+		if !ok {
+			continue
+		}
+		sub, ok = strings.CutSuffix(sub, s[1])
+		//the * stands for one or more whole labels, never an empty one or a path or port
+		if ok && sub != "" && !strings.HasPrefix(sub, ".") && !strings.ContainsAny(sub, "/:@") {
+			return origin, p.credentials
+		}
+	}
+	if p.anyOrigin {
+		return "*", false
+	}
+	return "", false
+}
+
+//checkOriginPattern reports what is wrong with an entry of CORS_ALLOWED_ORIGINS
+func checkOriginPattern(entry string) error {
+	if entry == "*" {
+		return nil
+	}
+	scheme, rest, ok := strings.Cut(entry, "://")
+	if !ok || (scheme != "http" && scheme != "https") || rest == "" || strings.ContainsAny(rest, "/?#") {
+		return fmt.Errorf("%q is not an origin like https://app.example.com", entry)
+	}
+	if strings.Contains(rest, "*") && (!strings.HasPrefix(rest, "*.") || strings.Count(rest, "*") > 1 || len(rest) < 3) {
+		return fmt.Errorf("%q: * may only stand for the subdomain, like https://*.example.com", entry)
+	}
+	return nil
+}
+
+//preflight answers a cors preflight with 204 and the allowed methods registered for its path, which the browser checks
+//Access-Control-Request-Method against. deriving them from the router keeps new routes from drifting out of sync. a path without routes gets 404, a method the path doesnt have 405.
+//allowed is false for origins the policy doesnt know, they get the status but no cors headers
+func preflight(w http.ResponseWriter, r *http.Request, p *corsPolicy, routes *mux.Router, allowed bool) {
+	methods := routeMethods(routes, r, routeMethodCandidates)
+	if len(methods) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Allow", allowHeader(methods))
+	methods = slices.DeleteFunc(methods, func(m string) bool { return !slices.Contains(p.methods, m) })
+	if !slices.Contains(methods, r.Header.Get("Access-Control-Request-Method")) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if allowed {
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", p.headers)
+		w.Header().Set("Access-Control-Max-Age", p.maxAge)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//explanation on http headers and content-type
+//http headers are key value pairs sent between the client and the server with http requests and responses. provide metadata about the request or reponse e.g. content type, length, encoding
+//content-type header indicates the media type of the resource being sent to the client (web browser / mobile app...). when client receives response, it looks at the content-type header to determine how to interpret the response body
+//when u set content-type header to application/json, u are telling the client that the reponse body contains json data
+
+//adds headers to the response to enable cors. allows api to be accessed from web pages hosted on different domains, which is essential for modern web applications that interact with apis
+//params: next of type http.handler, return value of type http.handler
+//only origins the policy allows get cors headers, the others get none and the browser keeps the response from their scripts
+//allowed origins are echoed back by name so they can send credentialed (session cookie) requests when the policy allows credentials
+//routes is the router behind next, preflights are checked against the methods registered on it
+func enableCORS(policy *corsPolicy, routes *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//the allow origin header depends on the request origin, so caches must key on it
+		w.Header().Add("Vary", "Origin")
+		//same origin requests, server to server calls and origins we dont know get no cors headers
+		allowOrigin, credentials := policy.allow(r.Header.Get("Origin"))
+		if allowOrigin != "" {
+			//set cors headers --> set http headers for the response
+			w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+			if credentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			w.Header().Set("Access-Control-Expose-Headers", "ETag, Last-Modified, Location, Idempotent-Replayed, X-Request-ID, X-RateLimit-Limit, X-RateLimit-Remaining, Retry-After, X-API-Version, X-Page-Limit, X-Page-Offset, X-Total-Count, X-Snapshot-At, Deprecation, Sunset, Link") //response headers browser scripts are allowed to read
+		}
+
+		//check if the request is for cors preflight
+		//check if http method is options --> determine if actual request is safe to send
+		//an OPTIONS without Access-Control-Request-Method comes from an api client asking what a resource supports.
+		//neither needs authentication
+		if r.Method == "OPTIONS" {
+			if r.Header.Get("Access-Control-Request-Method") == "" {
+				answerOptions(w, r, routes)
+				return
+			}
+			preflight(w, r, policy, routes, allowOrigin != "")
+			return
+		}
+
+		//pass down the request to the next middleware or final handler
+		next.ServeHTTP(w, r)
+	})
+}
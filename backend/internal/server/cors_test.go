@@ -0,0 +1,150 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"api/internal/model"
+)
+
+//varies reports whether the Vary headers of res list header
+func varies(res testResponse, header string) bool {
+	for _, v := range res.Header.Values("Vary") {
+		for name := range strings.SplitSeq(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), header) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestCORSPolicyAllow(t *testing.T) {
+	p := newCORSPolicy(&Config{CORSAllowedOrigins: []string{"https://app.example.com", "https://*.tools.example.com"}})
+	for origin, want := range map[string]string{
+		"":                                    "",
+		"https://app.example.com":             "https://app.example.com",
+		"http://app.example.com":              "",
+		"https://app.example.com:8443":        "",
+		"https://evil.com":                    "",
+		"https://a.tools.example.com":         "https://a.tools.example.com",
+		"https://a.b.tools.example.com":       "https://a.b.tools.example.com",
+		"https://tools.example.com":           "",
+		"https://.tools.example.com":          "",
+		"https://eviltools.example.com":       "",
+		"https://a.tools.example.com.evil.c":  "",
+		"https://a.tools.example.com:8443":    "",
+		"https://evil.com/.tools.example.com": "",
+		"https://user@a.tools.example.com":    "",
+	} {
+		if got, _ := p.allow(origin); got != want {
+			t.Errorf("allow(%q) = %q, want %q", origin, got, want)
+		}
+	}
+
+	//* is for development, it answers * to everyone and never lets them send credentials
+	p = newCORSPolicy(&Config{CORSAllowedOrigins: []string{"*", "https://app.example.com"}, CORSAllowCredentials: true})
+	if got, credentials := p.allow("https://anything.example.org"); got != "*" || credentials {
+		t.Errorf("allow with * = %q, %v", got, credentials)
+	}
+	if got, credentials := p.allow("https://app.example.com"); got != "https://app.example.com" || !credentials {
+		t.Errorf("allow of a listed origin with * = %q, %v", got, credentials)
+	}
+}
+
+func TestCheckOriginPattern(t *testing.T) {
+	for _, entry := range []string{"*", "https://app.example.com", "http://localhost:3000", "https://*.example.com"} {
+		if err := checkOriginPattern(entry); err != nil {
+			t.Errorf("%q: %v", entry, err)
+		}
+	}
+	for _, entry := range []string{"app.example.com", "ftp://example.com", "https://app.example.com/", "https://", "https://a*.example.com", "https://*.*.example.com", "https://example.*"} {
+		if err := checkOriginPattern(entry); err == nil {
+			t.Errorf("%q was accepted", entry)
+		}
+	}
+}
+
+func TestCORSHeaders(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"CORS_ALLOWED_ORIGINS": "https://app.example.com,https://*.tools.example.com"})
+	admin := ts.admin()
+
+	for origin, want := range map[string]string{
+		"https://app.example.com":     "https://app.example.com",
+		"https://a.tools.example.com": "https://a.tools.example.com",
+		"https://evil.com":            "",
+		"":                            "",
+	} {
+		res := ts.do("GET", "/api/v1/users", admin, nil, "Origin", origin)
+		//an origin that isnt allowed isnt an error, it just gets no cors headers
+		expect(t, res, http.StatusOK)
+		if got := res.Header.Get("Access-Control-Allow-Origin"); got != want {
+			t.Fatalf("%q got Access-Control-Allow-Origin %q, want %q", origin, got, want)
+		}
+		if want == "" && res.Header.Get("Access-Control-Expose-Headers") != "" {
+			t.Fatalf("%q got cors headers", origin)
+		}
+		if !varies(res, "Origin") {
+			t.Fatalf("%q got Vary %q", origin, res.Header.Values("Vary"))
+		}
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"CORS_ALLOWED_ORIGINS": "https://app.example.com"})
+	u := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+
+	//the bulk update of the spa, a patch with a token
+	res := ts.do("OPTIONS", "/api/v1/users", "", nil, "Origin", "https://app.example.com",
+		"Access-Control-Request-Method", "PATCH", "Access-Control-Request-Headers", "authorization,content-type")
+	expect(t, res, http.StatusNoContent)
+	headers := strings.Split(res.Header.Get("Access-Control-Allow-Headers"), ", ")
+	for _, header := range []string{"Authorization", "Content-Type", "X-Request-ID", "Idempotency-Key"} {
+		if !slices.Contains(headers, header) {
+			t.Fatalf("Access-Control-Allow-Headers %q lacks %s", res.Header.Get("Access-Control-Allow-Headers"), header)
+		}
+	}
+	//the methods are the ones registered for the path, the collection has no PUT and the user has no POST or PATCH
+	if got := res.Header.Get("Access-Control-Allow-Methods"); got != "GET, POST, PATCH" {
+		t.Fatalf("the collection allows %q", got)
+	}
+	if res.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" || res.Header.Get("Access-Control-Max-Age") == "" {
+		t.Fatalf("the preflight answered %v", res.Header)
+	}
+	res = ts.do("OPTIONS", userPath(u.Id), "", nil, "Origin", "https://app.example.com", "Access-Control-Request-Method", "DELETE")
+	expect(t, res, http.StatusNoContent)
+	if got := res.Header.Get("Access-Control-Allow-Methods"); got != "GET, PUT, DELETE" {
+		t.Fatalf("the user allows %q", got)
+	}
+	expect(t, ts.do("OPTIONS", userPath(u.Id), "", nil, "Origin", "https://app.example.com", "Access-Control-Request-Method", "PATCH"), http.StatusMethodNotAllowed)
+	expect(t, ts.do("OPTIONS", "/api/v1/nothing-here", "", nil, "Origin", "https://app.example.com", "Access-Control-Request-Method", "GET"), http.StatusNotFound)
+
+	//an origin that isnt allowed gets the status without the cors headers
+	res = ts.do("OPTIONS", "/api/v1/users", "", nil, "Origin", "https://evil.com", "Access-Control-Request-Method", "PATCH")
+	expect(t, res, http.StatusNoContent)
+	if res.Header.Get("Access-Control-Allow-Methods") != "" || res.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("an unknown origin got cors headers %v", res.Header)
+	}
+}
+
+func TestCORSPreflightConfigured(t *testing.T) {
+	ts := newTestServer(t, map[string]string{
+		"CORS_ALLOWED_ORIGINS": "https://app.example.com",
+		"CORS_ALLOWED_HEADERS": "Authorization,X-Custom",
+		"CORS_ALLOWED_METHODS": "get,patch",
+	})
+	u := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+
+	res := ts.do("OPTIONS", "/api/v1/users", "", nil, "Origin", "https://app.example.com", "Access-Control-Request-Method", "PATCH")
+	expect(t, res, http.StatusNoContent)
+	if got := res.Header.Get("Access-Control-Allow-Headers"); got != "Authorization, X-Custom" {
+		t.Fatalf("Access-Control-Allow-Headers %q", got)
+	}
+	if got := res.Header.Get("Access-Control-Allow-Methods"); got != "GET, PATCH" {
+		t.Fatalf("Access-Control-Allow-Methods %q", got)
+	}
+	//the route has the method, the configuration doesnt allow it
+	expect(t, ts.do("OPTIONS", userPath(u.Id), "", nil, "Origin", "https://app.example.com", "Access-Control-Request-Method", "DELETE"), http.StatusMethodNotAllowed)
+}
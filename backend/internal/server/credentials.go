@@ -0,0 +1,110 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"time"
+
+	"api/internal/model"
+)
+
+//revokedCredentials is the answer of POST /users/{id}/revoke-credentials, how many of each kind of credential were
+//revoked. credentials that were expired or used already arent counted, an account that had none left answers all zeros
+type revokedCredentials struct {
+	XMLName            xml.Name  `json:"-" xml:"revoked_credentials"`
+	UserId             model.ID  `json:"user_id" xml:"user_id"`
+	RevokedAt          time.Time `json:"revoked_at" xml:"revoked_at"`
+	Sessions           int64     `json:"sessions" xml:"sessions"`
+	RefreshTokens      int64     `json:"refresh_tokens" xml:"refresh_tokens"`
+	ApiKeys            int64     `json:"api_keys" xml:"api_keys"`
+	PasswordResets     int64     `json:"password_resets" xml:"password_resets"`
+	VerificationTokens int64     `json:"verification_tokens" xml:"verification_tokens"`
+	EmailChanges       int64     `json:"email_changes" xml:"email_changes"`
+}
+
+//revokeUserCredentials is the one button for a compromised account: it ends the sessions of the user, revokes their
+//refresh tokens, deletes the api keys they created, voids their password reset, verification and email change tokens
+//and makes them reset their password before they can log in with one again. access tokens issued up to now are
+//refused from then on, see checkCredentialsRevoked. it all happens in one transaction and is audited with the counts
+func revokeUserCredentials(db *sql.DB, cache *userCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := userIdVar(r)
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("starting transaction: %w", err))
+			return
+		}
+		defer tx.Rollback()
+
+		//in microseconds, what the databases keep of it
+		revoked := revokedCredentials{UserId: model.ID(id), RevokedAt: time.Now().UTC().Truncate(time.Microsecond)}
+		res, err := tx.ExecContext(r.Context(), "UPDATE users SET credentials_revoked_at = $2, password_change_required = true WHERE id = $1", id, revoked.RevokedAt)
+		var found int64
+		if err == nil {
+			found, err = res.RowsAffected()
+		}
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("revoking credentials: %w", err))
+			return
+		}
+		if found == 0 {
+			writeUserNotFound(w, r, id)
+			return
+		}
+		for _, c := range []struct {
+			count *int64
+			stmt  string
+		}{
+			{&revoked.Sessions, "DELETE FROM sessions WHERE user_id = $1 AND expires_at > now()"},
+			{&revoked.RefreshTokens, "UPDATE refresh_tokens SET revoked = true WHERE user_id = $1 AND NOT revoked AND used_at IS NULL AND expires_at > now()"},
+			{&revoked.ApiKeys, "DELETE FROM api_keys WHERE created_by = $1"},
+			{&revoked.PasswordResets, "UPDATE password_resets SET used_at = now() WHERE user_id = $1 AND used_at IS NULL AND expires_at > now()"},
+			{&revoked.VerificationTokens, "UPDATE verification_tokens SET used_at = now() WHERE user_id = $1 AND used_at IS NULL AND expires_at > now()"},
+			//the pending email is part of the user, dropping it is a change like confirming it
+			{&revoked.EmailChanges, `UPDATE users SET pending_email = NULL, pending_email_token_hash = NULL, pending_email_expires_at = NULL,
+				version = version + 1, updated_at = now() WHERE id = $1 AND pending_email_expires_at > now()`},
+		} {
+			res, err := tx.ExecContext(r.Context(), c.stmt, id)
+			if err != nil {
+				internalServerError(w, r, fmt.Errorf("revoking credentials: %w", err))
+				return
+			}
+			*c.count, _ = res.RowsAffected()
+		}
+		//the expired sessions and tokens dont count, but they go as well
+		for _, stmt := range []string{
+			"DELETE FROM sessions WHERE user_id = $1",
+			"UPDATE refresh_tokens SET revoked = true WHERE user_id = $1",
+		} {
+			if _, err := tx.ExecContext(r.Context(), stmt, id); err != nil {
+				internalServerError(w, r, fmt.Errorf("revoking credentials: %w", err))
+				return
+			}
+		}
+		event := auditEventFor(r.Context(), auditUserCredentialsRevoked)
+		event.TargetUserId = id
+		event.Details = map[string]any{"sessions": revoked.Sessions, "refresh_tokens": revoked.RefreshTokens, "api_keys": revoked.ApiKeys,
+			"password_resets": revoked.PasswordResets, "verification_tokens": revoked.VerificationTokens, "email_changes": revoked.EmailChanges}
+		if err := recordAudit(r.Context(), tx, event); err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			internalServerError(w, r, fmt.Errorf("revoking credentials: %w", err))
+			return
+		}
+		if revoked.EmailChanges > 0 {
+			cache.forget(r.Context(), id)
+		}
+		writeResponse(w, r, http.StatusOK, revoked)
+	}
+}
+
+//checkCredentialsRevoked reports whether an access token issued at issuedAt was issued before the credentials of its
+//user were revoked at revokedAt. issued at is in whole seconds, a token from the second of the revocation is refused
+//as well, it may have been issued just before it
+func checkCredentialsRevoked(issuedAt time.Time, revokedAt sql.NullTime) bool {
+	return revokedAt.Valid && !issuedAt.After(revokedAt.Time.Truncate(time.Second))
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/url"
+	"strings"
+	"time"
+
+	"api/internal/store"
+)
+
+//database drivers DB_DRIVER can choose, see Config.DBDriver
+const (
+	dbDriverPostgres = "postgres"
+	dbDriverSQLite   = "sqlite"
+	dbDriverMySQL    = "mysql"
+	//defaultSQLiteDatabase is the file used when DB_DRIVER=sqlite and DATABASE_URL isnt set
+	defaultSQLiteDatabase = "file:dev.db"
+)
+
+//sqliteParams are added to the sqlite database url. the busy timeout makes writers wait for each other instead of failing,
+//immediate transactions take the write lock at BEGIN so a read-then-write transaction cant deadlock on the upgrade,
+//and times are stored in a format sqlite's own date functions understand
+var sqliteParams = url.Values{
+	"_pragma":      {"foreign_keys(1)", "busy_timeout(5000)", "journal_mode(WAL)"},
+	"_txlock":      {"immediate"},
+	"_time_format": {"sqlite"},
+}
+
+//connection pool defaults, each one can be overridden with the environment variable next to it
+const (
+	defaultDBMaxOpenConns     = 25               //DB_MAX_OPEN_CONNS
+	defaultDBMaxIdleConns     = 10               //DB_MAX_IDLE_CONNS
+	defaultDBConnMaxLifetime  = 30 * time.Minute //DB_CONN_MAX_LIFETIME
+	defaultDBConnMaxIdleTime  = 5 * time.Minute  //DB_CONN_MAX_IDLE_TIME
+	defaultDBConnectTimeout   = time.Minute      //DB_CONNECT_TIMEOUT
+	dbPingTimeout             = 5 * time.Second
+	defaultSlowQueryThreshold = 200 * time.Millisecond //SLOW_QUERY_THRESHOLD
+)
+
+//backoff between two startup attempts, it doubles from the first to the max value and gets some jitter
+const (
+	dbConnectFirstBackoff = 500 * time.Millisecond
+	dbConnectMaxBackoff   = 10 * time.Second
+)
+
+//dbPoolConfig is the connection pool setup applied to the database handle
+type dbPoolConfig struct {
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
+	connMaxIdleTime time.Duration
+}
+
+//OpenDB opens the database at cfg.DatabaseURL with the driver of cfg.DBDriver, applies the pool settings, pings it and applies the pending migrations,
+//so a wrong url or an unreachable server fails at startup instead of on the first request.
+//postgres often starts after the api (docker compose, kubernetes), so connecting is retried until cfg.DBConnectTimeout runs out
+//or ctx is cancelled. a failing migration is not retried, it would fail the same way again
+func OpenDB(ctx context.Context, cfg *Config, logger *slog.Logger) (*sql.DB, error) {
+	pool := cfg.DBPool
+	var (
+		connector driver.Connector
+		err       error
+	)
+	switch cfg.DBDriver {
+	case dbDriverMySQL:
+		connector, err = openMySQL(cfg.DatabaseURL)
+	case dbDriverSQLite:
+		connector = sqliteConnector(withSQLiteParams(cfg.DatabaseURL))
+	default:
+		connector, err = openPostgres(cfg.DatabaseURL)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening database: %w", err)
+	}
+	db := sql.OpenDB(wrapConnector(connector, cfg.dbConnHooks()))
+	db.SetMaxOpenConns(pool.maxOpenConns)
+	db.SetMaxIdleConns(pool.maxIdleConns)
+	db.SetConnMaxLifetime(pool.connMaxLifetime)
+	db.SetConnMaxIdleTime(pool.connMaxIdleTime)
+
+	err = retryStartup(ctx, logger, cfg.DBConnectTimeout, func(ctx context.Context) error {
+		pingCtx, cancel := context.WithTimeout(ctx, dbPingTimeout)
+		defer cancel()
+		if err := db.PingContext(pingCtx); err != nil {
+			return fmt.Errorf("connecting to database, check DATABASE_URL: %w", err)
+		}
+		return nil
+	})
+	//a read only database, like a standby, cant be migrated. it has to be up to date with what the primary was migrated to
+	switch {
+	case err == nil && cfg.ReadOnly:
+		err = checkMigrations(ctx, db, cfg.DBDriver, logger)
+	case err == nil:
+		err = applyMigrations(ctx, db, cfg.DBDriver, logger)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	logger.Info("connected to database",
+		"driver", cfg.DBDriver,
+		"max_open_conns", pool.maxOpenConns,
+		"max_idle_conns", pool.maxIdleConns,
+		"conn_max_lifetime", pool.connMaxLifetime.String(),
+		"conn_max_idle_time", pool.connMaxIdleTime.String())
+	return db, nil
+}
+
+//OpenReplica opens the read replica at cfg.DatabaseReplicaURL with the pool settings of the primary, nil when there is none.
+//the replica is optional for serving, one that cant be reached now is only logged, the reads go to the primary until it is back.
+//migrations arent applied, the replica gets them from the primary
+func OpenReplica(ctx context.Context, cfg *Config, logger *slog.Logger) (*sql.DB, error) {
+	if cfg.DatabaseReplicaURL == "" {
+		return nil, nil
+	}
+	connector, err := openPostgres(cfg.DatabaseReplicaURL)
+	if err != nil {
+		return nil, fmt.Errorf("opening database replica: %w", err)
+	}
+	replica := sql.OpenDB(wrapConnector(connector, cfg.dbConnHooks()))
+	pool := cfg.DBPool
+	replica.SetMaxOpenConns(pool.maxOpenConns)
+	replica.SetMaxIdleConns(pool.maxIdleConns)
+	replica.SetConnMaxLifetime(pool.connMaxLifetime)
+	replica.SetConnMaxIdleTime(pool.connMaxIdleTime)
+
+	pingCtx, cancel := context.WithTimeout(ctx, dbPingTimeout)
+	defer cancel()
+	if err := replica.PingContext(pingCtx); err != nil {
+		logger.Warn("database replica is unreachable, reading from the primary until it is back", "error", err)
+		return replica, nil
+	}
+	logger.Info("connected to database replica")
+	return replica, nil
+}
+
+//NewUserStore returns the UserStore for the database cfg.DBDriver names. all of them record every change with RecordUserChange.
+//the postgres store reads from replica when it isnt nil. it holds prepared statements, it is an io.Closer to close before db
+func NewUserStore(ctx context.Context, cfg *Config, db, replica *sql.DB) (store.UserStore, error) {
+	switch cfg.DBDriver {
+	case dbDriverSQLite:
+		return &store.SQLite{DB: db, OnChange: RecordUserChange}, nil
+	case dbDriverMySQL:
+		return &store.MySQL{DB: db, OnChange: RecordUserChange}, nil
+	}
+	s, err := store.NewPostgres(ctx, db, RecordUserChange)
+	if err != nil {
+		return nil, err
+	}
+	s.Replica = replica
+	return s, nil
+}
+
+//sqliteConnector is the connector of sqlite's driver, which has none of its own
+type sqliteConnector string
+
+func (dsn sqliteConnector) Connect(context.Context) (driver.Conn, error) {
+	return sqliteDriver.Open(string(dsn))
+}
+
+func (dsn sqliteConnector) Driver() driver.Driver {
+	return sqliteDriver
+}
+
+//dbConnHooks is what the connections of OpenDB and OpenReplica do besides running the queries
+func (c *Config) dbConnHooks() connHooks {
+	return connHooks{
+		rebind:       c.DBDriver == dbDriverMySQL,
+		dropRowLocks: c.DBDriver == dbDriverSQLite,
+		slowQuery:    c.SlowQueryThreshold,
+		logArgs:      c.SlowQueryLogArgs,
+	}
+}
+
+//withSQLiteParams adds sqliteParams to a sqlite database url like file:dev.db
+func withSQLiteParams(dsn string) string {
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	return dsn + sep + sqliteParams.Encode()
+}
+
+//retryStartup calls attempt until it succeeds, ctx is cancelled or timeout has passed, backing off exponentially in between
+//the error of the last attempt is returned when it gives up
+func retryStartup(ctx context.Context, logger *slog.Logger, timeout time.Duration, attempt func(context.Context) error) error {
+	deadline := time.Now().Add(timeout)
+	backoff := dbConnectFirstBackoff
+	for n := 1; ; n++ {
+		err := attempt(ctx)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("startup aborted: %w", ctx.Err())
+		}
+		//up to half of the backoff is added as jitter so several instances dont retry in lockstep
+		wait := backoff + rand.N(backoff/2)
+		if time.Now().Add(wait).After(deadline) {
+			return fmt.Errorf("giving up after %d attempts: %w", n, err)
+		}
+		logger.Warn("database not ready, retrying", "attempt", n, "retry_in", wait.String(), "error", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("startup aborted: %w", ctx.Err())
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, dbConnectMaxBackoff)
+	}
+}
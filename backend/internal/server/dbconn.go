@@ -0,0 +1,329 @@
+package server
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+)
+
+//connHooks is what the connections of OpenDB do besides passing the queries on to the driver
+type connHooks struct {
+	//rebind rewrites postgres' $1 placeholders to ?, for mysql (see rebindDollars)
+	rebind bool
+	//dropRowLocks takes the FOR UPDATE off the queries, for sqlite (see dropRowLocks)
+	dropRowLocks bool
+	//slowQuery is the duration from which a query is logged and counted as slow, 0 turns that off
+	slowQuery time.Duration
+	//logArgs adds the arguments to the slow query log. they are user data like email addresses, so it is off by default
+	logArgs bool
+}
+
+//wrapConnector returns c with connections that apply hooks, or c itself when there is nothing to do
+func wrapConnector(c driver.Connector, hooks connHooks) driver.Connector {
+	if !hooks.rebind && !hooks.dropRowLocks && hooks.slowQuery <= 0 {
+		return c
+	}
+	return &hookedConnector{Connector: c, hooks: hooks}
+}
+
+type hookedConnector struct {
+	driver.Connector
+	hooks connHooks
+}
+
+func (c *hookedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &hookedConn{Conn: conn, hooks: &c.hooks}, nil
+}
+
+//hookedConn applies the hooks to every query before and after the connection underneath runs it.
+//database/sql looks for the optional interfaces on the connection it gets, so each is passed on here
+type hookedConn struct {
+	driver.Conn
+	hooks *connHooks
+}
+
+//rebind returns the query for the driver and the order of its args, nil when they stay as they are
+func (c *hookedConn) rebind(query string) (string, []int) {
+	if c.hooks.dropRowLocks {
+		query = dropRowLocks(query)
+	}
+	if !c.hooks.rebind {
+		return query, nil
+	}
+	return rebindDollars(query)
+}
+
+func (c *hookedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *hookedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	driverQuery, order := c.rebind(query)
+	var (
+		stmt driver.Stmt
+		err  error
+	)
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, driverQuery)
+	} else {
+		stmt, err = c.Conn.Prepare(driverQuery)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &hookedStmt{Stmt: stmt, query: query, order: order, hooks: c.hooks}, nil
+}
+
+func (c *hookedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	driverQuery, order := c.rebind(query)
+	start := time.Now()
+	res, err := e.ExecContext(ctx, driverQuery, reorderArgs(args, order))
+	//ErrSkip isnt a query, database/sql prepares the statement instead and that one is timed
+	if err != driver.ErrSkip {
+		c.hooks.observeExec(ctx, query, args, start, res, err)
+	}
+	return res, err
+}
+
+func (c *hookedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	driverQuery, order := c.rebind(query)
+	start := time.Now()
+	rows, err := q.QueryContext(ctx, driverQuery, reorderArgs(args, order))
+	if err == driver.ErrSkip {
+		return nil, err
+	}
+	return c.hooks.observeQuery(ctx, query, args, start, rows, err)
+}
+
+func (c *hookedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *hookedConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *hookedConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *hookedConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+//Unwrap is the connection underneath, for code that needs what only the driver itself can do, like COPY on postgres
+func (c *hookedConn) Unwrap() driver.Conn {
+	return c.Conn
+}
+
+func (c *hookedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+//hookedStmt is a prepared statement of hookedConn. query is how it was written, order as for rebindDollars
+type hookedStmt struct {
+	driver.Stmt
+	query string
+	order []int
+	hooks *connHooks
+}
+
+//NumInput is unknown when the placeholders were rewritten, the same $n can stand for several ?
+func (s *hookedStmt) NumInput() int {
+	if s.order != nil {
+		return -1
+	}
+	return s.Stmt.NumInput()
+}
+
+func (s *hookedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	driverArgs := reorderArgs(args, s.order)
+	start := time.Now()
+	var (
+		res driver.Result
+		err error
+	)
+	if e, ok := s.Stmt.(driver.StmtExecContext); ok {
+		res, err = e.ExecContext(ctx, driverArgs)
+	} else {
+		res, err = s.Stmt.Exec(namedValues(driverArgs))
+	}
+	s.hooks.observeExec(ctx, s.query, args, start, res, err)
+	return res, err
+}
+
+func (s *hookedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	driverArgs := reorderArgs(args, s.order)
+	start := time.Now()
+	var (
+		rows driver.Rows
+		err  error
+	)
+	if q, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = q.QueryContext(ctx, driverArgs)
+	} else {
+		rows, err = s.Stmt.Query(namedValues(driverArgs))
+	}
+	return s.hooks.observeQuery(ctx, s.query, args, start, rows, err)
+}
+
+//observeExec logs a statement that took at least slowQuery, with the rows it changed
+func (h *connHooks) observeExec(ctx context.Context, query string, args []driver.NamedValue, start time.Time, res driver.Result, err error) {
+	if h.slowQuery <= 0 {
+		return
+	}
+	var affected int64 = -1
+	if err == nil {
+		if n, rowsErr := res.RowsAffected(); rowsErr == nil {
+			affected = n
+		}
+	}
+	h.logIfSlow(ctx, query, args, time.Since(start), affected, err)
+}
+
+//observeQuery returns rows that log the query when they are closed, a query is only done once its rows are read
+func (h *connHooks) observeQuery(ctx context.Context, query string, args []driver.NamedValue, start time.Time, rows driver.Rows, err error) (driver.Rows, error) {
+	if h.slowQuery <= 0 {
+		return rows, err
+	}
+	if err != nil {
+		h.logIfSlow(ctx, query, args, time.Since(start), -1, err)
+		return nil, err
+	}
+	return &observedRows{Rows: rows, done: func(n int64) { h.logIfSlow(ctx, query, args, time.Since(start), n, nil) }}, nil
+}
+
+//logIfSlow writes the warning and counts the query when it took at least slowQuery.
+//the request logger adds the request id. rows is -1 when it isnt known
+func (h *connHooks) logIfSlow(ctx context.Context, query string, args []driver.NamedValue, d time.Duration, rows int64, err error) {
+	if d < h.slowQuery {
+		return
+	}
+	dbSlowQueries.Inc()
+	attrs := []any{"query", strings.Join(strings.Fields(query), " "), "duration_ms", float64(d.Microseconds()) / 1000, "rows", rows}
+	if h.logArgs {
+		values := make([]any, len(args))
+		for i, a := range args {
+			values[i] = a.Value
+		}
+		attrs = append(attrs, "args", values)
+	}
+	if err != nil {
+		attrs = append(attrs, "error", err)
+	}
+	loggerFrom(ctx).Warn("slow query", attrs...)
+}
+
+//observedRows counts the rows read and calls done with the count when closed
+type observedRows struct {
+	driver.Rows
+	n    int64
+	done func(n int64)
+}
+
+func (r *observedRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err == nil {
+		r.n++
+	}
+	return err
+}
+
+func (r *observedRows) Close() error {
+	err := r.Rows.Close()
+	if r.done != nil {
+		r.done(r.n)
+		r.done = nil
+	}
+	return err
+}
+
+//the column types are passed on, database/sql uses them for Rows.ColumnTypes and the drivers for scanning
+
+func (r *observedRows) ColumnTypeScanType(index int) reflect.Type {
+	if t, ok := r.Rows.(driver.RowsColumnTypeScanType); ok {
+		return t.ColumnTypeScanType(index)
+	}
+	return reflect.TypeFor[any]()
+}
+
+func (r *observedRows) ColumnTypeDatabaseTypeName(index int) string {
+	if t, ok := r.Rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		return t.ColumnTypeDatabaseTypeName(index)
+	}
+	return ""
+}
+
+func (r *observedRows) ColumnTypeNullable(index int) (nullable, ok bool) {
+	if t, ok := r.Rows.(driver.RowsColumnTypeNullable); ok {
+		return t.ColumnTypeNullable(index)
+	}
+	return false, false
+}
+
+func (r *observedRows) ColumnTypeLength(index int) (length int64, ok bool) {
+	if t, ok := r.Rows.(driver.RowsColumnTypeLength); ok {
+		return t.ColumnTypeLength(index)
+	}
+	return 0, false
+}
+
+func (r *observedRows) ColumnTypePrecisionScale(index int) (precision, scale int64, ok bool) {
+	if t, ok := r.Rows.(driver.RowsColumnTypePrecisionScale); ok {
+		return t.ColumnTypePrecisionScale(index)
+	}
+	return 0, 0, false
+}
+
+func (r *observedRows) HasNextResultSet() bool {
+	if n, ok := r.Rows.(driver.RowsNextResultSet); ok {
+		return n.HasNextResultSet()
+	}
+	return false
+}
+
+func (r *observedRows) NextResultSet() error {
+	if n, ok := r.Rows.(driver.RowsNextResultSet); ok {
+		return n.NextResultSet()
+	}
+	return io.EOF
+}
+
+//namedValues is the args for the old Exec and Query of driver.Stmt
+func namedValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, a := range args {
+		values[i] = a.Value
+	}
+	return values
+}
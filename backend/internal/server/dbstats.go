@@ -0,0 +1,57 @@
+package server
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+)
+
+//dbStatsResponse is the body of GET /debug/dbstats: the pool counters of database/sql next to the limits they run into.
+//durations are strings like 1.5s, like the pool settings in the startup log
+type dbStatsResponse struct {
+	Time   time.Time `json:"time"`
+	Driver string    `json:"driver"`
+	Limits struct {
+		MaxOpenConns    int    `json:"max_open_conns"`
+		MaxIdleConns    int    `json:"max_idle_conns"`
+		ConnMaxLifetime string `json:"conn_max_lifetime"`
+		ConnMaxIdleTime string `json:"conn_max_idle_time"`
+	} `json:"limits"`
+	OpenConnections int `json:"open_connections"`
+	InUse           int `json:"in_use"`
+	Idle            int `json:"idle"`
+	//WaitCount is how often a query had to wait for a free connection, WaitDuration the time spent waiting in all
+	WaitCount         int64  `json:"wait_count"`
+	WaitDuration      string `json:"wait_duration"`
+	MaxIdleClosed     int64  `json:"max_idle_closed"`
+	MaxIdleTimeClosed int64  `json:"max_idle_time_closed"`
+	MaxLifetimeClosed int64  `json:"max_lifetime_closed"`
+}
+
+//dbStats answers GET /debug/dbstats with the state of the connection pool, for a quick look with curl when the api is slow
+//and it isnt clear whether the queries wait for connections. /metrics has the same numbers for prometheus.
+//it is for admins only, the route sits outside /api/v1 and always answers json
+func dbStats(db *sql.DB, driver string, pool dbPoolConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := db.Stats()
+		body := dbStatsResponse{
+			Time:              time.Now().UTC(),
+			Driver:            driver,
+			OpenConnections:   stats.OpenConnections,
+			InUse:             stats.InUse,
+			Idle:              stats.Idle,
+			WaitCount:         stats.WaitCount,
+			WaitDuration:      stats.WaitDuration.String(),
+			MaxIdleClosed:     stats.MaxIdleClosed,
+			MaxIdleTimeClosed: stats.MaxIdleTimeClosed,
+			MaxLifetimeClosed: stats.MaxLifetimeClosed,
+		}
+		body.Limits.MaxOpenConns = stats.MaxOpenConnections
+		body.Limits.MaxIdleConns = pool.maxIdleConns
+		body.Limits.ConnMaxLifetime = pool.connMaxLifetime.String()
+		body.Limits.ConnMaxIdleTime = pool.connMaxIdleTime.String()
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.Header().Set("Cache-Control", "no-store")
+		newJSONEncoder(w, wantsPretty(r)).Encode(body)
+	}
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//defaults for DELETION_LIMIT and DELETION_LIMIT_WINDOW, one caller may delete 100 users in 10 minutes
+const (
+	defaultDeletionLimit       = 100
+	defaultDeletionLimitWindow = 10 * time.Minute
+)
+
+//audit actions of the deletion guard
+const (
+	auditDeletionsBlocked = "deletions.blocked"
+	auditDeletionsCleared = "deletions.cleared"
+)
+
+//deletionLimitConfig is how many users one caller may delete in window, a limit of 0 turns the guard off
+type deletionLimitConfig struct {
+	limit  int
+	window time.Duration
+}
+
+//deletionLimitError is a deletion the deletionGuard refused, wait is how long until the caller may delete again
+type deletionLimitError struct {
+	wait time.Duration
+}
+
+func (e *deletionLimitError) Error() string {
+	return "too many users deleted in a short time, deletions are blocked for a while"
+}
+
+//retryAfter is wait in whole seconds for a Retry-After header
+func (e *deletionLimitError) retryAfter() string {
+	return strconv.Itoa(int(math.Ceil(e.wait.Seconds())))
+}
+
+//deletionGuard stops a buggy client or a stolen key from deleting the users one request at a time. the deletions of
+//every caller are counted in a bucket of the rate limit store that holds limit deletions and fills up again over the
+//window, once it is empty the caller's deletions are refused until it has filled up a little or an admin clears it.
+//the buckets and the blocked callers are kept per instance, like the rate limit
+type deletionGuard struct {
+	store rateLimitStore
+	//db gets the audit events, it is nil with the in-memory store
+	db    *sql.DB
+	limit int
+	rate  float64
+	mu    sync.Mutex
+	//blocked are the callers refused since the last deletion they were allowed, with when that started
+	blocked map[string]time.Time
+}
+
+//newDeletionGuard returns nil when cfg.limit is 0, which turns the guard off
+func newDeletionGuard(cfg deletionLimitConfig, db *sql.DB) *deletionGuard {
+	if cfg.limit == 0 {
+		return nil
+	}
+	store := newMemoryRateLimitStore(cfg.window)
+	go store.cleanup(time.Minute)
+	return &deletionGuard{store: store, db: db, limit: cfg.limit, rate: float64(cfg.limit) / cfg.window.Seconds(), blocked: map[string]time.Time{}}
+}
+
+//deletionActor is who the deletions of ctx are counted for: the api key, or the user behind the token, which is the
+//admin while impersonating. ok is false without a caller, like for the cli
+func deletionActor(ctx context.Context) (string, bool) {
+	p, ok := principalFromContext(ctx)
+	switch {
+	case !ok:
+		return "", false
+	case p.ApiKeyId != 0:
+		return "key:" + strconv.Itoa(p.ApiKeyId), true
+	case p.ImpersonatorId != 0:
+		return "user:" + strconv.FormatInt(p.ImpersonatorId, 10), true
+	}
+	return "user:" + strconv.FormatInt(p.UserId, 10), true
+}
+
+//allow counts a deletion of the caller in ctx, a *deletionLimitError is one it has to refuse. every attempt counts,
+//including those that then find no user. the first refusal of a caller is logged and audited, the ones after it
+//until a deletion goes through again arent
+func (g *deletionGuard) allow(ctx context.Context) error {
+	if g == nil {
+		return nil
+	}
+	actor, ok := deletionActor(ctx)
+	if !ok {
+		return nil
+	}
+	ok, _, wait := g.store.Take("delete:"+actor, g.rate, g.limit)
+	g.mu.Lock()
+	_, already := g.blocked[actor]
+	if ok {
+		delete(g.blocked, actor)
+	} else if !already {
+		g.blocked[actor] = time.Now().UTC()
+	}
+	g.mu.Unlock()
+	if ok {
+		return nil
+	}
+	if !already {
+		loggerFrom(ctx).Warn("deletions blocked, the caller deleted too many users in a short time", "actor", actor, "limit", g.limit)
+		event := auditEventFor(ctx, auditDeletionsBlocked)
+		event.Details = map[string]any{"actor": actor, "limit": g.limit, "window_seconds": int(float64(g.limit) / g.rate)}
+		g.audit(ctx, event)
+	}
+	return &deletionLimitError{wait: wait}
+}
+
+//audit records e when there is a database, a failure is only logged: the guard shouldnt fail the request over it
+func (g *deletionGuard) audit(ctx context.Context, e auditEvent) {
+	if g.db == nil {
+		return
+	}
+	if err := recordAudit(context.WithoutCancel(ctx), g.db, e); err != nil {
+		loggerFrom(ctx).Error("auditing the deletion guard", "action", e.Action, "error", err)
+	}
+}
+
+//deletionBlock is a caller whose deletions are refused, in GET /admin/deletion-blocks
+type deletionBlock struct {
+	Actor        string    `json:"actor" xml:"actor"`
+	BlockedSince time.Time `json:"blocked_since" xml:"blocked_since"`
+}
+
+//deletionBlockList is the body of GET /admin/deletion-blocks
+type deletionBlockList struct {
+	XMLName xml.Name        `json:"-" xml:"deletion_blocks"`
+	Blocks  []deletionBlock `json:"blocks" xml:"block"`
+}
+
+//listDeletionBlocks answers with the callers refused on this instance, the oldest block first. without the guard
+//there are none
+func (g *deletionGuard) listDeletionBlocks(w http.ResponseWriter, r *http.Request) {
+	blocks := []deletionBlock{}
+	if g != nil {
+		g.mu.Lock()
+		for actor, since := range g.blocked {
+			blocks = append(blocks, deletionBlock{Actor: actor, BlockedSince: since})
+		}
+		g.mu.Unlock()
+	}
+	slices.SortFunc(blocks, func(a, b deletionBlock) int {
+		if c := a.BlockedSince.Compare(b.BlockedSince); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Actor, b.Actor)
+	})
+	writeResponse(w, r, http.StatusOK, deletionBlockList{Blocks: blocks})
+}
+
+//clearDeletionBlock lets the caller in the path (user:12 or key:3) delete again right away, with its whole limit
+func (g *deletionGuard) clearDeletionBlock(w http.ResponseWriter, r *http.Request) {
+	if g == nil {
+		writeError(w, r, http.StatusNotImplemented, codeNotConfigured, "the deletion guard is off, DELETION_LIMIT is 0")
+		return
+	}
+	actor := mux.Vars(r)["actor"]
+	g.store.Reset("delete:" + actor)
+	g.mu.Lock()
+	_, wasBlocked := g.blocked[actor]
+	delete(g.blocked, actor)
+	g.mu.Unlock()
+	event := auditEventFor(r.Context(), auditDeletionsCleared)
+	event.Details = map[string]any{"actor": actor, "was_blocked": wasBlocked}
+	g.audit(r.Context(), event)
+	w.WriteHeader(http.StatusNoContent)
+}
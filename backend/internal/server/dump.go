@@ -0,0 +1,265 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//dumpFormat names the format in the header of a dump, so a file that isnt one is recognized right away
+const dumpFormat = "user-management-dump"
+
+//dumpTables are the tables of a dump in the order they are written, a table only refers to the ones before it.
+//sessions, tokens, api keys and the outbox are left out: they are short lived or secrets that are rotated after a restore
+var dumpTables = []string{"users", "addresses", "groups", "group_members", "audit_events"}
+
+//a dump is newline delimited json: a dumpHeader, then one dumpRecord per row of dumpTables, then a dumpTrailer.
+//a dump without its trailer was cut off
+type dumpHeader struct {
+	Format string `json:"format"`
+	//SchemaVersion is the newest migration of Driver the database had, versions of different drivers dont compare
+	SchemaVersion int       `json:"schema_version"`
+	Driver        string    `json:"driver"`
+	ExportedAt    time.Time `json:"exported_at"`
+	Tables        []string  `json:"tables"`
+}
+
+type dumpRecord struct {
+	Table string `json:"table"`
+	Row   any    `json:"row"`
+}
+
+type dumpTrailer struct {
+	//Counts is how many rows of each table the dump has
+	Counts map[string]int `json:"counts"`
+}
+
+//dumpUser is a users row as it is stored, including the password hash so a restored user can still sign in.
+//pending email changes arent, their tokens are left out like the other tokens
+type dumpUser struct {
+	Id              model.ID   `json:"id"`
+	Uuid            string     `json:"uuid"`
+	PublicId        string     `json:"public_id"`
+	Name            string     `json:"name"`
+	Email           string     `json:"email"`
+	Username        *string    `json:"username"`
+	Phone           *string    `json:"phone"`
+	Locale          *string    `json:"locale"`
+	Timezone        string     `json:"timezone"`
+	Role            string     `json:"role"`
+	Active          bool       `json:"active"`
+	PasswordHash    *string    `json:"password_hash"`
+	GoogleSubject   *string    `json:"google_subject"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	AvatarKey       *string    `json:"avatar_key"`
+	MergedIntoId    *model.ID  `json:"merged_into_id"`
+	Version         int        `json:"version"`
+	CreatedAt       *time.Time `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+type dumpGroupMember struct {
+	GroupId model.ID  `json:"group_id"`
+	UserId  model.ID  `json:"user_id"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+//dumpAuditEvent is an audit_events row, auditEntry with the user it is about
+type dumpAuditEvent struct {
+	auditEntry
+	TargetUserId *model.ID `json:"target_user_id"`
+}
+
+//exportDump streams every user and the tables that belong to them as a dump for backups, see dumpHeader.
+//the rows are read in one read only transaction and written as they are read, so the dump is consistent and a big
+//table never has to fit in memory. the transaction is REPEATABLE READ, it sees the database as it was at exported_at,
+//which X-Snapshot-At sends as well, and SNAPSHOT_TIMEOUT bounds it. compressResponses gzips it for clients that accept that.
+//?format=xlsx writes the users as an excel workbook instead, see writeUsersWorkbook. ?format=ndjson is the dump
+func exportDump(db *sql.DB, driver string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "ndjson" && format != "xlsx" {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "format must be ndjson or xlsx")
+			return
+		}
+		//the transaction is rolled back once ctx ends, even while a client that stopped reading keeps a write waiting
+		ctx, cancel := context.WithTimeout(r.Context(), snapshotTimeout)
+		defer cancel()
+		tx, header, err := beginDump(ctx, db, driver)
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		defer tx.Rollback()
+		setSnapshotAt(w, header.ExportedAt)
+
+		if format == "xlsx" {
+			filename := "users-" + header.ExportedAt.Format(time.DateOnly) + ".xlsx"
+			w.Header().Set("Content-Type", contentTypeXLSX)
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(http.StatusOK)
+			//like the dump, a failure after the status can only be logged. the workbook is then cut off and wont open
+			if err := writeUsersWorkbook(ctx, tx, w); err != nil {
+				loggerFrom(ctx).Error("writing users workbook", "error", err)
+			}
+			return
+		}
+
+		filename := "users-dump-" + header.ExportedAt.Format(time.DateOnly) + ".ndjson"
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		//the status is sent already, a failure from here on can only be logged. the dump then has no trailer
+		if err := writeDump(ctx, tx, json.NewEncoder(w), header); err != nil {
+			loggerFrom(ctx).Error("writing dump", "error", err)
+		}
+	}
+}
+
+//beginDump starts the read only transaction a dump is read in and records the export in the audit log,
+//before anything is written like the export of a single user. the caller rolls tx back once the dump is written
+func beginDump(ctx context.Context, db *sql.DB, driver string) (*sql.Tx, dumpHeader, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, dumpHeader{}, fmt.Errorf("starting export transaction: %w", err)
+	}
+	header := dumpHeader{Format: dumpFormat, Driver: driver, ExportedAt: time.Now().UTC(), Tables: dumpTables}
+	if header.SchemaVersion, err = SchemaVersion(ctx, tx); err != nil {
+		tx.Rollback()
+		return nil, dumpHeader{}, err
+	}
+	event := auditEventFor(ctx, auditDumpExported)
+	event.Details = map[string]any{"schema_version": header.SchemaVersion}
+	if err := recordAudit(ctx, db, event); err != nil {
+		tx.Rollback()
+		return nil, dumpHeader{}, err
+	}
+	return tx, header, nil
+}
+
+//writeDump writes the header, the rows of every table in dumpTables and the trailer
+func writeDump(ctx context.Context, tx *sql.Tx, enc *json.Encoder, header dumpHeader) error {
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+	counts := map[string]int{}
+	var err error
+	if counts["users"], err = dumpRows(ctx, tx, enc, "users", `SELECT id, uuid, public_id, name, email, username, phone, locale, timezone, role, active, password_hash,
+		google_subject, email_verified_at, avatar_key, merged_into_id, version, created_at, updated_at FROM users ORDER BY id`, func(row store.RowScanner) (dumpUser, error) {
+		var u dumpUser
+		return u, row.Scan(&u.Id, &u.Uuid, &u.PublicId, &u.Name, &u.Email, &u.Username, &u.Phone, &u.Locale, &u.Timezone, &u.Role, &u.Active, &u.PasswordHash, &u.GoogleSubject,
+			&u.EmailVerifiedAt, &u.AvatarKey, &u.MergedIntoId, &u.Version, &u.CreatedAt, &u.UpdatedAt)
+	}); err != nil {
+		return err
+	}
+	if counts["addresses"], err = dumpRows(ctx, tx, enc, "addresses", "SELECT "+addressColumns+" FROM addresses ORDER BY id", func(row store.RowScanner) (model.Address, error) {
+		var a model.Address
+		return a, scanAddress(row, &a)
+	}); err != nil {
+		return err
+	}
+	if counts["groups"], err = dumpRows(ctx, tx, enc, "groups", `SELECT id, name, description, created_at FROM "groups" ORDER BY id`, func(row store.RowScanner) (model.Group, error) {
+		var g model.Group
+		return g, row.Scan(&g.Id, &g.Name, &g.Description, &g.CreatedAt)
+	}); err != nil {
+		return err
+	}
+	if counts["group_members"], err = dumpRows(ctx, tx, enc, "group_members", "SELECT group_id, user_id, added_at FROM group_members ORDER BY group_id, user_id",
+		func(row store.RowScanner) (dumpGroupMember, error) {
+			var m dumpGroupMember
+			return m, row.Scan(&m.GroupId, &m.UserId, &m.AddedAt)
+		}); err != nil {
+		return err
+	}
+	if counts["audit_events"], err = dumpRows(ctx, tx, enc, "audit_events", `SELECT id, created_at, actor_id, actor_api_key_id, impersonated_user_id, action, target_user_id, COALESCE(ip, ''), diff, details
+		FROM audit_events ORDER BY id`, func(row store.RowScanner) (dumpAuditEvent, error) {
+		var (
+			e                                           dumpAuditEvent
+			actorId, apiKeyId, impersonatedId, targetId sql.NullInt64
+			diff, details                               []byte
+		)
+		err := row.Scan(&e.Id, &e.CreatedAt, &actorId, &apiKeyId, &impersonatedId, &e.Action, &targetId, &e.IP, &diff, &details)
+		e.ActorId, e.ActorApiKeyId, e.ImpersonatedUserId, e.TargetUserId = optionalId[model.ID](actorId), optionalId[model.ID](apiKeyId), optionalId[model.ID](impersonatedId), optionalId[model.ID](targetId)
+		e.Diff, e.Details = diff, details
+		return e, err
+	}); err != nil {
+		return err
+	}
+	return enc.Encode(dumpTrailer{Counts: counts})
+}
+
+//usersWorkbookHeader is the header row of the workbook of writeUsersWorkbook
+var usersWorkbookHeader = []string{"id", "uuid", "public_id", "name", "email", "username", "phone", "locale", "timezone", "role", "active",
+	"verified", "created_at", "updated_at", "last_login_at"}
+
+//writeUsersWorkbook writes every user to w as an excel workbook with a row per user, for people who open the users in
+//a spreadsheet rather than restore them. the id is a number, the times are dates in utc and the rest is text, so a
+//phone number keeps its + and zeros. password hashes and the other secrets of the dump are left out
+func writeUsersWorkbook(ctx context.Context, tx *sql.Tx, w io.Writer) error {
+	rows, err := tx.QueryContext(ctx, `SELECT id, uuid, public_id, name, email, username, phone, COALESCE(locale, 'en'), timezone, role, active,
+		email_verified_at IS NOT NULL, created_at, updated_at, last_login_at FROM users ORDER BY id`)
+	if err != nil {
+		return fmt.Errorf("reading users for the workbook: %w", err)
+	}
+	defer rows.Close()
+	x, err := newXLSXWriter(w, "users", usersWorkbookHeader)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var (
+			id                     int64
+			uuid, publicId, name   string
+			email, role            string
+			locale, timezone       string
+			username, phone        *string
+			active, verified       bool
+			createdAt, lastLoginAt *time.Time
+			updatedAt              time.Time
+		)
+		if err := rows.Scan(&id, &uuid, &publicId, &name, &email, &username, &phone, &locale, &timezone, &role, &active, &verified, &createdAt, &updatedAt, &lastLoginAt); err != nil {
+			return fmt.Errorf("scanning users for the workbook: %w", err)
+		}
+		if err := x.WriteRow(id, uuid, publicId, name, email, username, phone, locale, timezone, role, active, verified, createdAt, updatedAt, lastLoginAt); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("reading users for the workbook: %w", err)
+	}
+	return x.Close()
+}
+
+//dumpRows writes every row of query as a dumpRecord of table and returns how many there were
+func dumpRows[T any](ctx context.Context, tx *sql.Tx, enc *json.Encoder, table, query string, scan func(store.RowScanner) (T, error)) (int, error) {
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("dumping %s: %w", table, err)
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		v, err := scan(rows)
+		if err != nil {
+			return n, fmt.Errorf("dumping %s: %w", table, err)
+		}
+		if err := enc.Encode(dumpRecord{Table: table, Row: v}); err != nil {
+			return n, fmt.Errorf("dumping %s: %w", table, err)
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, fmt.Errorf("dumping %s: %w", table, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//names are similar when their trigram similarity is at least ?threshold=. below the 0.3 of pg_trgm's % operator
+//the trigram index cant help the self join anymore, so that is the lowest threshold accepted
+const (
+	defaultDuplicateThreshold = 0.6
+	minDuplicateThreshold     = 0.3
+)
+
+//cluster reasons of the duplicates report
+const (
+	duplicateByEmail = "email"
+	duplicateByName  = "name"
+)
+
+//duplicateCluster is a group of users that look like the same person
+type duplicateCluster struct {
+	//reason is email for addresses that only differ in case and name for similar names
+	Reason string       `json:"reason" xml:"reason,attr"`
+	Users  []model.User `json:"users" xml:"user"`
+}
+
+//duplicateReport is the answer of GET /users/duplicates
+type duplicateReport struct {
+	XMLName  xml.Name           `json:"-" xml:"duplicates"`
+	Clusters []duplicateCluster `json:"clusters" xml:"cluster"`
+}
+
+//mergeRequest is the body of POST /users/{id}/merge
+type mergeRequest struct {
+	//into is the id of the user that stays
+	Into int64 `json:"into"`
+}
+
+//findDuplicateUsers lists the users that may be duplicates of each other for an admin to review, users that were merged
+//already are left out. users whose email addresses only differ in case are always clustered, with ?fuzzy=true so are
+//users whose names have a trigram similarity of at least ?threshold=, pairs chained together ending up in one cluster
+func findDuplicateUsers(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fuzzy := r.URL.Query().Get("fuzzy") == "true"
+		threshold := defaultDuplicateThreshold
+		if v := r.URL.Query().Get("threshold"); v != "" {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil || parsed < minDuplicateThreshold || parsed > 1 {
+				writeError(w, r, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("threshold must be a number between %g and 1", minDuplicateThreshold))
+				return
+			}
+			threshold = parsed
+		}
+
+		report := duplicateReport{Clusters: []duplicateCluster{}}
+		byEmail, err := queryUsers(r, db, "SELECT "+store.UserColumns+` FROM users WHERE merged_into_id IS NULL AND lower(email) IN
+			(SELECT lower(email) FROM users WHERE merged_into_id IS NULL GROUP BY lower(email) HAVING count(*) > 1)
+			ORDER BY lower(email), id`)
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("finding duplicate emails: %w", err))
+			return
+		}
+		for i := 0; i < len(byEmail); {
+			j := i + 1
+			for j < len(byEmail) && strings.EqualFold(byEmail[j].Email, byEmail[i].Email) {
+				j++
+			}
+			report.Clusters = append(report.Clusters, duplicateCluster{Reason: duplicateByEmail, Users: byEmail[i:j]})
+			i = j
+		}
+
+		if fuzzy {
+			clusters, err := similarNameClusters(r, db, threshold)
+			if err != nil {
+				internalServerError(w, r, err)
+				return
+			}
+			report.Clusters = append(report.Clusters, clusters...)
+		}
+		writeResponse(w, r, http.StatusOK, report)
+	}
+}
+
+//similarNameClusters finds the pairs of users with similar names and joins pairs that share a user into one cluster
+func similarNameClusters(r *http.Request, db *sql.DB, threshold float64) ([]duplicateCluster, error) {
+	rows, err := db.QueryContext(r.Context(), `SELECT a.id, b.id FROM users a JOIN users b ON a.id < b.id AND a.name % b.name
+		WHERE a.merged_into_id IS NULL AND b.merged_into_id IS NULL AND similarity(a.name, b.name) >= $1`, threshold)
+	if err != nil {
+		return nil, fmt.Errorf("finding similar names: %w", err)
+	}
+	defer rows.Close()
+	//union find: parent leads from a user to the smallest id of its cluster
+	parent := map[int64]int64{}
+	var root func(id int64) int64
+	root = func(id int64) int64 {
+		p, ok := parent[id]
+		if !ok || p == id {
+			parent[id] = id
+			return id
+		}
+		parent[id] = root(p)
+		return parent[id]
+	}
+	for rows.Next() {
+		var a, b int64
+		if err := rows.Scan(&a, &b); err != nil {
+			return nil, fmt.Errorf("scanning similar names: %w", err)
+		}
+		ra, rb := root(a), root(b)
+		parent[max(ra, rb)] = min(ra, rb)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("finding similar names: %w", err)
+	}
+	if len(parent) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]int64, 0, len(parent))
+	for id := range parent {
+		ids = append(ids, id)
+	}
+	list, args := idList(ids, 1)
+	users, err := queryUsers(r, db, "SELECT "+store.UserColumns+" FROM users WHERE id IN "+list+" ORDER BY id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("loading users with similar names: %w", err)
+	}
+	var clusters []duplicateCluster
+	index := map[int64]int{}
+	for _, u := range users {
+		id := root(int64(u.Id))
+		i, ok := index[id]
+		if !ok {
+			i = len(clusters)
+			index[id] = i
+			clusters = append(clusters, duplicateCluster{Reason: duplicateByName})
+		}
+		clusters[i].Users = append(clusters[i].Users, u)
+	}
+	return clusters, nil
+}
+
+//querier is implemented by both *sql.DB and *sql.Tx
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+//queryUsers runs a query selecting store.UserColumns
+func queryUsers(r *http.Request, db querier, query string, args ...any) ([]model.User, error) {
+	rows, err := db.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []model.User
+	for rows.Next() {
+		var u model.User
+		if err := store.ScanUser(rows, &u); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+//mergeUser merges the user in the path, a duplicate, into the user in the body and answers with that one.
+//the addresses, group memberships and audit events of the duplicate move over in one transaction, then the duplicate is
+//deactivated like an offboarded user and remembers where it went. the user merged into has to be another active user
+func mergeUser(db *sql.DB, users store.UserStore, events eventBroker, cache *userCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := userIdVar(r)
+		var req mergeRequest
+		if err := decodeRequest(r, &req); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+		switch {
+		case req.Into < 1:
+			writeValidationError(w, r, model.FieldErrors{"into": "is required"})
+			return
+		case req.Into == id:
+			writeValidationError(w, r, model.FieldErrors{"into": "must be another user than the one merged"})
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("starting transaction: %w", err))
+			return
+		}
+		defer tx.Rollback()
+
+		//both users are locked, in the order of their ids so two merges of the same pair cant deadlock
+		type mergeState struct {
+			active bool
+			merged bool
+		}
+		states := map[int64]mergeState{}
+		rows, err := tx.QueryContext(r.Context(), "SELECT id, active, merged_into_id IS NOT NULL FROM users WHERE id IN ($1, $2) ORDER BY id FOR UPDATE", id, req.Into)
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("loading users to merge: %w", err))
+			return
+		}
+		for rows.Next() {
+			var userId int64
+			var s mergeState
+			if err := rows.Scan(&userId, &s.active, &s.merged); err != nil {
+				rows.Close()
+				internalServerError(w, r, fmt.Errorf("loading users to merge: %w", err))
+				return
+			}
+			states[userId] = s
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			internalServerError(w, r, fmt.Errorf("loading users to merge: %w", err))
+			return
+		}
+		duplicate, found := states[id]
+		if !found {
+			writeUserNotFound(w, r, id)
+			return
+		}
+		if duplicate.merged {
+			writeError(w, r, http.StatusConflict, codeInvalidState, fmt.Sprintf("user %d was merged into another user already", id))
+			return
+		}
+		into, found := states[req.Into]
+		if !found {
+			writeUserNotFound(w, r, req.Into)
+			return
+		}
+		if into.merged || !into.active {
+			writeError(w, r, http.StatusConflict, codeInvalidState, fmt.Sprintf("user %d is deactivated, users can only be merged into an active user", req.Into))
+			return
+		}
+
+		var before, after model.User
+		if err := store.ScanUser(tx.QueryRowContext(r.Context(), "SELECT "+store.UserColumns+" FROM users WHERE id = $1", id), &before); err != nil {
+			internalServerError(w, r, fmt.Errorf("loading user: %w", err))
+			return
+		}
+		for _, stmt := range []string{
+			"UPDATE addresses SET user_id = $2 WHERE user_id = $1",
+			`INSERT INTO group_members (group_id, user_id) SELECT m.group_id, $2 FROM group_members m
+				WHERE m.user_id = $1 AND NOT EXISTS (SELECT 1 FROM group_members WHERE group_id = m.group_id AND user_id = $2)`,
+			"DELETE FROM group_members WHERE user_id = $1",
+			"UPDATE audit_events SET target_user_id = $2 WHERE target_user_id = $1",
+		} {
+			if _, err := tx.ExecContext(r.Context(), stmt, id, req.Into); err != nil {
+				internalServerError(w, r, fmt.Errorf("moving records of merged user: %w", err))
+				return
+			}
+		}
+		_, err = tx.ExecContext(r.Context(), `UPDATE users SET active = false, merged_into_id = $2, version = version + 1, updated_at = now()
+			WHERE id = $1`, id, req.Into)
+		if err == nil {
+			err = store.ScanUser(tx.QueryRowContext(r.Context(), "SELECT "+store.UserColumns+" FROM users WHERE id = $1", id), &after)
+		}
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("deactivating merged user: %w", err))
+			return
+		}
+		//like on deactivation the duplicate cant sign in anymore
+		for _, stmt := range []string{
+			"UPDATE refresh_tokens SET revoked = true WHERE user_id = $1",
+			"DELETE FROM sessions WHERE user_id = $1",
+		} {
+			if _, err := tx.ExecContext(r.Context(), stmt, id); err != nil {
+				internalServerError(w, r, fmt.Errorf("revoking credentials of merged user: %w", err))
+				return
+			}
+		}
+		if err := auditUserChange(r.Context(), tx, auditUserMerged, &before, &after); err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		e := auditEventFor(r.Context(), auditUserMergedInto)
+		e.TargetUserId, e.Details = req.Into, map[string]any{"merged_user_id": id}
+		if err := recordAudit(r.Context(), tx, e); err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		if err := enqueueOutbox(r.Context(), tx, outboxUserUpdated, after); err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			internalServerError(w, r, fmt.Errorf("merging users: %w", err))
+			return
+		}
+		cache.forget(r.Context(), int64(after.Id))
+		cache.forget(r.Context(), req.Into)
+		events.Publish(userEvent{Type: eventUserUpdated, User: after})
+
+		u, err := users.Get(r.Context(), req.Into)
+		if errors.Is(err, store.ErrUserNotFound) {
+			writeUserNotFound(w, r, req.Into)
+			return
+		}
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		w.Header().Set("ETag", userETag(u))
+		writeResponse(w, r, http.StatusOK, u)
+	}
+}
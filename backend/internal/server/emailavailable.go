@@ -0,0 +1,102 @@
+package server
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//defaultEmailCheckLimit is EMAIL_CHECK_LIMIT_PER_MINUTE when it isnt set
+const defaultEmailCheckLimit = 10
+
+//emailCheckConfig is how GET /users/email-available answers
+type emailCheckConfig struct {
+	//perMinute is how many addresses one client may check in a minute, in bursts of as many
+	perMinute int
+	//public answers available to callers without an api key, without looking the address up
+	public bool
+}
+
+//emailAvailability is the answer of GET /users/email-available, reason is taken when it isnt available
+type emailAvailability struct {
+	Available bool   `json:"available"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+//emailAvailabilityChecker serves GET /users/email-available, which tells a signup form whether an address is registered
+//already before the user is created. whoever can ask that can find out who has an account, so only the frontends with
+//an api key are told, and every client, keyed by its ip address, may only ask perMinute times a minute whatever the
+//api key. without an api key the answer is 401, or with EMAIL_CHECK_PUBLIC always available: the create tells with its
+//409 then. one checker serves both api prefixes, so they share the buckets
+type emailAvailabilityChecker struct {
+	db     *sql.DB
+	limits rateLimitStore
+	cfg    emailCheckConfig
+	//withKey checks the api key like the other routes do, and answers 401 for a key that isnt valid
+	withKey http.Handler
+}
+
+func newEmailAvailabilityChecker(db *sql.DB, cfg emailCheckConfig) *emailAvailabilityChecker {
+	limits := newMemoryRateLimitStore(rateLimitIdleTTL)
+	go limits.cleanup(time.Minute)
+	c := &emailAvailabilityChecker{db: db, limits: limits, cfg: cfg}
+	c.withKey = authMiddleware(db)(http.HandlerFunc(c.lookUp))
+	return c
+}
+
+func (c *emailAvailabilityChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !takeToken(w, r, c.limits, "ip:"+clientIP(r), float64(c.cfg.perMinute)/60, c.cfg.perMinute) {
+		return
+	}
+	if r.Header.Get("X-API-Key") != "" {
+		c.withKey.ServeHTTP(w, r)
+		return
+	}
+	if !c.cfg.public {
+		writeUnauthorized(w, r, "checking an email address needs an api key")
+		return
+	}
+	if _, ok := emailToCheck(w, r); ok {
+		writeResponse(w, r, http.StatusOK, emailAvailability{Available: true})
+	}
+}
+
+//lookUp answers for the callers with an api key, from the unique index of the addresses
+func (c *emailAvailabilityChecker) lookUp(w http.ResponseWriter, r *http.Request) {
+	email, ok := emailToCheck(w, r)
+	if !ok {
+		return
+	}
+	taken, err := store.EmailTaken(r.Context(), c.db, email, 0)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	if taken {
+		writeResponse(w, r, http.StatusOK, emailAvailability{Reason: "taken"})
+		return
+	}
+	writeResponse(w, r, http.StatusOK, emailAvailability{Available: true})
+}
+
+//emailToCheck is the address in ?email= without the spaces around it and in lower case, the case the unique index
+//ignores. an address that isnt one is a validation error like on create, and false is returned
+func emailToCheck(w http.ResponseWriter, r *http.Request) (string, bool) {
+	email := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("email")))
+	switch {
+	case email == "":
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "the email address to check is required, pass it as ?email=")
+		return "", false
+	case len(email) > model.MaxEmailLength:
+		writeValidationError(w, r, model.FieldErrors{"email": "must be at most 320 characters"})
+		return "", false
+	case !model.IsEmailAddress(email):
+		writeValidationError(w, r, model.FieldErrors{"email": "must be a valid address"})
+		return "", false
+	}
+	return email, true
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"api/internal/model"
+)
+
+//checkEmail asks GET /users/email-available about email with the api key, empty for none
+func (ts *testServer) checkEmail(key, email string) testResponse {
+	ts.t.Helper()
+	var headers []string
+	if key != "" {
+		headers = []string{"X-API-Key", key}
+	}
+	return ts.do("GET", "/api/v1/users/email-available?email="+url.QueryEscape(email), "", nil, headers...)
+}
+
+func TestEmailAvailable(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"EMAIL_CHECK_LIMIT_PER_MINUTE": "1000"})
+	admin := ts.admin()
+	key := ts.apiKey(admin, model.RoleMember)
+	ts.createUser("Ada", "Ada.Lovelace@Example.com", model.RoleMember)
+
+	for email, want := range map[string]emailAvailability{
+		"ada.lovelace@example.com":      {Reason: "taken"},
+		"ADA.LOVELACE@EXAMPLE.COM":      {Reason: "taken"},
+		"  Ada.Lovelace@example.COM\t ": {Reason: "taken"},
+		"grace@example.com":             {Available: true},
+		" Grace@Example.com ":           {Available: true},
+		"ada.lovelace@example.com.au":   {Available: true},
+		"lovelace@example.com":          {Available: true},
+		"ada.lovelace%@example.com":     {Available: true},
+	} {
+		res := ts.checkEmail(key, email)
+		expect(t, res, http.StatusOK)
+		var got emailAvailability
+		res.decode(t, &got)
+		if got != want {
+			t.Fatalf("%q answered %s", email, res.body)
+		}
+	}
+	//a taken address isnt told with a 409, and available has no reason
+	if res := ts.checkEmail(key, "grace@example.com"); string(res.body) != `{"available":true}`+"\n" {
+		t.Fatalf("an available address answered %s", res.body)
+	}
+
+	for _, email := range []string{"", "   ", "not-an-email", "Ada <ada@example.com>", "ada.lovelace@example.com' OR 1"} {
+		res := ts.checkEmail(key, email)
+		if res.StatusCode != http.StatusBadRequest && res.StatusCode != http.StatusUnprocessableEntity {
+			t.Fatalf("%q answered %d: %s", email, res.StatusCode, res.body)
+		}
+	}
+
+	//only the frontends with an api key are told
+	for _, res := range []testResponse{
+		ts.checkEmail("", "ada.lovelace@example.com"),
+		ts.checkEmail(key+"x", "ada.lovelace@example.com"),
+		ts.do("GET", "/api/v1/users/email-available?email=ada.lovelace@example.com", admin, nil),
+	} {
+		if res.StatusCode != http.StatusUnauthorized || res.errorCode() != codeUnauthorized {
+			t.Fatalf("without an api key answered %d: %s", res.StatusCode, res.body)
+		}
+	}
+}
+
+func TestEmailAvailablePublic(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"EMAIL_CHECK_PUBLIC": "true"})
+	key := ts.apiKey(ts.admin(), model.RoleMember)
+	ts.createUser("Ada", "ada@example.com", model.RoleMember)
+
+	//without an api key every address is available, the create answers 409 for the taken ones
+	res := ts.checkEmail("", " ADA@example.com ")
+	expect(t, res, http.StatusOK)
+	if string(res.body) != `{"available":true}`+"\n" {
+		t.Fatalf("the public check answered %s", res.body)
+	}
+	expect(t, ts.checkEmail("", "not-an-email"), http.StatusUnprocessableEntity)
+	//the frontends with a key still get the real answer, a key that isnt valid is still refused
+	var got emailAvailability
+	ts.checkEmail(key, "ada@example.com").decode(t, &got)
+	if got.Available || got.Reason != "taken" {
+		t.Fatalf("with an api key the taken address is %+v", got)
+	}
+	expect(t, ts.checkEmail(key+"x", "ada@example.com"), http.StatusUnauthorized)
+}
+
+func TestEmailAvailableRateLimit(t *testing.T) {
+	//the other routes arent limited at all, RATE_LIMIT_RPS is 0 in the tests
+	ts := newTestServer(t, map[string]string{"EMAIL_CHECK_LIMIT_PER_MINUTE": "3", "TRUSTED_PROXIES": "127.0.0.1/32"})
+	key := ts.apiKey(ts.admin(), model.RoleMember)
+
+	//with a key, without one and through the old prefix, one client shares one bucket
+	expect(t, ts.checkEmail(key, "ada@example.com"), http.StatusOK)
+	expect(t, ts.checkEmail("", "ada@example.com"), http.StatusUnauthorized)
+	res := ts.do("GET", "/api/go/users/email-available?email=ada@example.com", "", nil, "X-API-Key", key)
+	expect(t, res, http.StatusOK)
+	if res.Header.Get("X-RateLimit-Limit") != "3" || res.Header.Get("X-RateLimit-Remaining") != "0" {
+		t.Fatalf("the last check left %s of %s", res.Header.Get("X-RateLimit-Remaining"), res.Header.Get("X-RateLimit-Limit"))
+	}
+	for _, k := range []string{key, "", "not-a-key"} {
+		res := ts.checkEmail(k, "grace@example.com")
+		if res.StatusCode != http.StatusTooManyRequests || res.errorCode() != codeTooManyRequests || res.Header.Get("Retry-After") == "" {
+			t.Fatalf("a check over the limit answered %d: %s", res.StatusCode, res.body)
+		}
+	}
+	//the rest of the api isnt affected
+	expect(t, ts.do("GET", "/api/v1/users", "", nil, "X-API-Key", key), http.StatusOK)
+
+	//another client has a bucket of its own
+	res = ts.do("GET", "/api/v1/users/email-available?email=ada@example.com", "", nil, "X-API-Key", key, "X-Forwarded-For", "203.0.113.7")
+	expect(t, res, http.StatusOK)
+	if res.Header.Get("X-RateLimit-Remaining") != "2" {
+		t.Fatalf("another client has %s checks left", res.Header.Get("X-RateLimit-Remaining"))
+	}
+}
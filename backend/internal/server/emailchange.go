@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//a pending email change has to be confirmed within a day, after that the user has to ask again
+const emailChangeTTL = 24 * time.Hour
+
+//confirmEmailRequest is the body of POST /api/v1/users/{id}/email/confirm
+type confirmEmailRequest struct {
+	Token string `json:"token"`
+}
+
+//sendEmailChangeEmails queues the confirmation link to the new address and a heads up to the old one in tx, see
+//jobQueue.enqueue, so the owner notices when someone else is trying to move their account to a different address.
+//each is a job of its own, one that fails doesnt hold up the other
+func sendEmailChangeEmails(ctx context.Context, jobs *jobQueue, tx execer, oldEmail, newEmail, token string) error {
+	err := jobs.enqueue(ctx, tx, jobTypeEmail, emailMessage{
+		To:      newEmail,
+		Subject: "Confirm your new email address",
+		Text: "Open this link within 24 hours to start using this address for your account:\n\n" +
+			frontendLink("/confirm-email", "token", token) + "\n\nIf you didn't ask for this, you can ignore this email.\n",
+	})
+	if err != nil {
+		return err
+	}
+	return jobs.enqueue(ctx, tx, jobTypeEmail, emailMessage{
+		To:      oldEmail,
+		Subject: "Your email address is about to change",
+		Text: "Someone asked to change the email address of your account to " + newEmail + ".\n" +
+			"Nothing changes until the new address is confirmed. If this wasn't you, change your password right away.\n",
+	})
+}
+
+//confirmEmailChange applies a pending email change once the token from the confirmation email is presented
+//the address is checked for uniqueness again, another account may have taken it since the change was requested. one
+//that takes it while this runs is refused by the unique index, which is answered the same
+func confirmEmailChange(db *sql.DB, events eventBroker, cache *userCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := userIdVar(r)
+
+		var body confirmEmailRequest
+		if err := decodeRequest(r, &body); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("starting transaction: %w", err))
+			return
+		}
+		defer tx.Rollback()
+
+		var pending string
+		err = tx.QueryRowContext(r.Context(), `SELECT pending_email FROM users
+			WHERE id = $1 AND pending_email_token_hash = $2 AND pending_email_expires_at > now() FOR UPDATE`,
+			id, hashToken(body.Token)).Scan(&pending)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, http.StatusBadRequest, codeInvalidToken, "email confirmation token is invalid, expired or was replaced by a newer request")
+			return
+		}
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("loading pending email: %w", err))
+			return
+		}
+
+		taken, err := store.EmailTaken(r.Context(), tx, pending, id)
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		if taken {
+			writeEmailTakenMeanwhile(w, r)
+			return
+		}
+
+		var before model.User
+		if err := store.ScanUser(tx.QueryRowContext(r.Context(), "SELECT "+store.UserColumns+" FROM users WHERE id = $1", id), &before); err != nil {
+			internalServerError(w, r, fmt.Errorf("loading user: %w", err))
+			return
+		}
+
+		//the user just proved they can read mail sent to the new address, so it counts as verified
+		_, err = tx.ExecContext(r.Context(), `UPDATE users SET email = pending_email, email_verified_at = now(),
+			pending_email = NULL, pending_email_token_hash = NULL, pending_email_expires_at = NULL,
+			version = version + 1, updated_at = now()
+			WHERE id = $1`, id)
+		if store.IsUniqueViolation(err) {
+			writeEmailTakenMeanwhile(w, r)
+			return
+		}
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("applying email change: %w", err))
+			return
+		}
+		var u model.User
+		if err := store.ScanUser(tx.QueryRowContext(r.Context(), "SELECT "+store.UserColumns+" FROM users WHERE id = $1", id), &u); err != nil {
+			internalServerError(w, r, fmt.Errorf("loading user: %w", err))
+			return
+		}
+		if err := auditUserChange(r.Context(), tx, auditUserEmailChanged, &before, &u); err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		if err := enqueueOutbox(r.Context(), tx, outboxUserUpdated, u); err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			internalServerError(w, r, fmt.Errorf("applying email change: %w", err))
+			return
+		}
+		cache.forget(r.Context(), int64(u.Id))
+		events.Publish(userEvent{Type: eventUserUpdated, User: u})
+
+		w.Header().Set("ETag", userETag(u))
+		writeResponse(w, r, http.StatusOK, u)
+	}
+}
+
+//writeEmailTakenMeanwhile answers 409 to a confirmation of an address another account has taken since it was asked for
+func writeEmailTakenMeanwhile(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusConflict, codeConflict, "this email address has been taken by another account in the meantime")
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//requireIfMatch makes PUT, DELETE, activate and deactivate refuse requests without an If-Match header (428 precondition required)
+//it is off by default so existing clients that never send the header keep working
+var requireIfMatch bool
+
+//userETag is the entity tag of a user, derived from the version column that every write increments
+func userETag(u model.User) string {
+	return fmt.Sprintf(`"%d"`, u.Version)
+}
+
+//parseIfMatch reads the If-Match header of the request, returning nil when there is none
+//if-match uses strong comparison, so weak validators (W/"3") and tags we didnt issue never match
+func parseIfMatch(r *http.Request) *store.Match {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		return nil
+	}
+	if header == "*" {
+		return &store.Match{Any: true}
+	}
+
+	m := &store.Match{Versions: []int64{}}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+			continue
+		}
+		if v, err := strconv.ParseInt(tag[1:len(tag)-1], 10, 64); err == nil {
+			m.Versions = append(m.Versions, v)
+		}
+	}
+	return m
+}
+
+//checkIfMatchRequired writes a 428 and returns false when strict mode is on and the request has no If-Match header
+func checkIfMatchRequired(w http.ResponseWriter, r *http.Request, m *store.Match) bool {
+	if m == nil && requireIfMatch {
+		writeError(w, r, http.StatusPreconditionRequired, codePreconditionRequired, "this request must carry an If-Match header with the user's current etag")
+		return false
+	}
+	return true
+}
+
+//listETag derives an etag for a list of users from the users as they are sent, after visibleUsers
+//every write bumps a version and creates/deletes change the ids, so the tag changes whenever the list does. callers who
+//see different fields of the same users get different tags, a tag of one cant be answered with 304 to the other
+func listETag(users []model.User) string {
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	for _, u := range users {
+		enc.Encode(u)
+	}
+	return fmt.Sprintf(`"%x"`, h.Sum(nil)[:16])
+}
+
+//etagMatchesNoneMatch reports whether an If-None-Match header matches etag
+//if-none-match uses weak comparison, so W/"3" and "3" are treated as the same tag, and * matches anything
+func etagMatchesNoneMatch(header, etag string) bool {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return false
+	}
+	if header == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+//lastModifiedSettle is how long a modification time has to be in the past before we hand it out as last-modified
+//http dates only have second precision. if we sent one while its second was still running, a second write in the
+//same second would get the same date and a client revalidating with if-modified-since would be told nothing changed
+const lastModifiedSettle = 2 * time.Second
+
+//lastModifiedHeader formats modified for the last-modified header (rfc 1123, truncated to seconds)
+//it returns "" when there is no timestamp or it is too recent to be a safe validator yet
+func lastModifiedHeader(modified time.Time) string {
+	if modified.IsZero() || time.Since(modified) < lastModifiedSettle {
+		return ""
+	}
+	return modified.UTC().Truncate(time.Second).Format(http.TimeFormat)
+}
+
+//notModifiedSince reports whether the If-Modified-Since header shows the client already has the version modified at modified
+//unparseable dates and dates in the future (clock skew on the client) are ignored, so we err on the side of sending fresh data
+func notModifiedSince(r *http.Request, modified time.Time) bool {
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || since.After(time.Now()) {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(since)
+}
+
+//checkNotModified sets the etag and last-modified headers and, when the client already has this version, answers 304 and returns true
+//if-none-match takes precedence over if-modified-since when a request carries both (rfc 7232 section 6)
+//a 304 has no body, so it gets no content type
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	lastModified := lastModifiedHeader(modified)
+	if lastModified != "" {
+		w.Header().Set("Last-Modified", lastModified)
+	}
+
+	notModified := false
+	if noneMatch := r.Header.Get("If-None-Match"); noneMatch != "" {
+		notModified = etagMatchesNoneMatch(noneMatch, etag)
+	} else if lastModified != "" {
+		notModified = notModifiedSince(r, modified)
+	}
+	if !notModified {
+		return false
+	}
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
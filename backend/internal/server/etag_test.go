@@ -0,0 +1,147 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"api/internal/model"
+)
+
+func TestETagMatchesNoneMatch(t *testing.T) {
+	for _, tc := range []struct {
+		header, etag string
+		want         bool
+	}{
+		{"", `"3"`, false},
+		{`"3"`, `"3"`, true},
+		{`"4"`, `"3"`, false},
+		{`W/"3"`, `"3"`, true},
+		{`"3"`, `W/"3"`, true},
+		{`"1", "2" , W/"3"`, `"3"`, true},
+		{`"1", "2"`, `"3"`, false},
+		{"*", `"3"`, true},
+		{" * ", `"3"`, true},
+		{"3", `"3"`, false},
+	} {
+		if got := etagMatchesNoneMatch(tc.header, tc.etag); got != tc.want {
+			t.Errorf("etagMatchesNoneMatch(%q, %q) = %v, want %v", tc.header, tc.etag, got, tc.want)
+		}
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	u := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+
+	for _, path := range []string{userPath(u.Id), "/api/v1/users"} {
+		res := ts.do("GET", path, admin, nil)
+		expect(t, res, http.StatusOK)
+		etag := res.Header.Get("ETag")
+		if etag == "" {
+			t.Fatalf("%s has no etag", path)
+		}
+		for _, header := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+			res = ts.do("GET", path, admin, nil, "If-None-Match", header)
+			expect(t, res, http.StatusNotModified)
+			if len(res.body) != 0 || res.Header.Get("Content-Type") != "" || res.Header.Get("ETag") != etag {
+				t.Fatalf("%s with %s answered %q, Content-Type %q, ETag %q", path, header, res.body, res.Header.Get("Content-Type"), res.Header.Get("ETag"))
+			}
+		}
+		expect(t, ts.do("GET", path, admin, nil, "If-None-Match", `"other"`), http.StatusOK)
+	}
+
+	//a change makes the old tags stale
+	userTag := ts.do("GET", userPath(u.Id), admin, nil).Header.Get("ETag")
+	listTag := ts.do("GET", "/api/v1/users", admin, nil).Header.Get("ETag")
+	expect(t, ts.do("PUT", userPath(u.Id), admin, map[string]any{"name": "Ada Lovelace", "email": "ada@example.com"}), http.StatusOK)
+	for path, etag := range map[string]string{userPath(u.Id): userTag, "/api/v1/users": listTag} {
+		res := ts.do("GET", path, admin, nil, "If-None-Match", etag)
+		expect(t, res, http.StatusOK)
+		if res.Header.Get("ETag") == etag {
+			t.Fatalf("%s kept its etag %s after the update", path, etag)
+		}
+	}
+}
+
+func TestParseIfMatch(t *testing.T) {
+	if parseIfMatch(httptest.NewRequest("DELETE", "/", nil)) != nil {
+		t.Fatal("no header is a match")
+	}
+	for header, want := range map[string]string{
+		`"3"`:            "[3]",
+		`"1", "3"`:       "[1 3]",
+		`W/"3"`:          "[]",
+		`3`:              "[]",
+		`"abc", "4"`:     "[4]",
+		`*`:              "any",
+		` "2" ,W/"3",""`: "[2]",
+	} {
+		r := httptest.NewRequest("DELETE", "/", nil)
+		r.Header.Set("If-Match", header)
+		m := parseIfMatch(r)
+		got := fmt.Sprint(m.Versions)
+		if m.Any {
+			got = "any"
+		}
+		if got != want {
+			t.Errorf("If-Match %s matches %s, want %s", header, got, want)
+		}
+	}
+}
+
+func TestConditionalDelete(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	u := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+	etag := ts.do("GET", userPath(u.Id), admin, nil).Header.Get("ETag")
+
+	//a colleague changed the user since it was shown, and a weak tag never matches
+	expect(t, ts.do("PUT", userPath(u.Id), admin, map[string]any{"name": "Ada Lovelace", "email": "ada@example.com"}), http.StatusOK)
+	for _, header := range []string{etag, "W/" + ts.do("GET", userPath(u.Id), admin, nil).Header.Get("ETag")} {
+		res := ts.do("DELETE", userPath(u.Id), admin, nil, "If-Match", header)
+		if res.StatusCode != http.StatusPreconditionFailed || res.errorCode() != codePreconditionFailed {
+			t.Fatalf("If-Match %s answered %d: %s", header, res.StatusCode, res.body)
+		}
+		expect(t, ts.do("GET", userPath(u.Id), admin, nil), http.StatusOK)
+	}
+	//the deactivation is the soft delete, it is checked the same way
+	expect(t, ts.do("POST", userPath(u.Id)+"/deactivate", admin, nil, "If-Match", etag), http.StatusPreconditionFailed)
+	if n := ts.count("users", "id = $1 AND active", u.Id); n != 1 {
+		t.Fatal("a stale deactivate went through")
+	}
+
+	current := ts.do("GET", userPath(u.Id), admin, nil).Header.Get("ETag")
+	expect(t, ts.do("POST", userPath(u.Id)+"/deactivate", admin, nil, "If-Match", current), http.StatusOK)
+	current = ts.do("GET", userPath(u.Id), admin, nil).Header.Get("ETag")
+	expect(t, ts.do("DELETE", userPath(u.Id), admin, nil, "If-Match", `"0", `+current), http.StatusNoContent)
+	expect(t, ts.do("GET", userPath(u.Id), admin, nil), http.StatusNotFound)
+
+	//without the header the delete is unconditional, * matches any version
+	for _, header := range []string{"", "*"} {
+		other := ts.createUser("Grace", "grace@example.com", model.RoleMember)
+		expect(t, ts.do("DELETE", userPath(other.Id), admin, nil, "If-Match", header), http.StatusNoContent)
+	}
+}
+
+func TestConditionalDeleteRequired(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"REQUIRE_IF_MATCH": "true"})
+	admin := ts.admin()
+	u := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+
+	for _, req := range []struct{ method, path string }{
+		{"DELETE", userPath(u.Id)},
+		{"POST", userPath(u.Id) + "/deactivate"},
+		{"POST", userPath(u.Id) + "/activate"},
+	} {
+		res := ts.do(req.method, req.path, admin, nil)
+		if res.StatusCode != http.StatusPreconditionRequired || res.errorCode() != codePreconditionRequired {
+			t.Fatalf("%s %s without If-Match answered %d: %s", req.method, req.path, res.StatusCode, res.body)
+		}
+	}
+	etag := ts.do("GET", userPath(u.Id), admin, nil).Header.Get("ETag")
+	expect(t, ts.do("DELETE", userPath(u.Id), admin, nil, "If-Match", `"999"`), http.StatusPreconditionFailed)
+	expect(t, ts.do("DELETE", userPath(u.Id), admin, nil, "If-Match", etag), http.StatusNoContent)
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"api/internal/model"
+)
+
+//types of user events
+const (
+	eventUserCreated = "created"
+	eventUserUpdated = "updated"
+	eventUserDeleted = "deleted"
+)
+
+//how many events a subscriber may fall behind before it is dropped, and how often idle streams get a heartbeat
+const (
+	subscriberBuffer = 64
+	eventHeartbeat   = 30 * time.Second
+)
+
+//userEvent is published by the mutation handlers after their transaction committed
+type userEvent struct {
+	Type string     `json:"type"`
+	User model.User `json:"user"`
+}
+
+//eventBroker fans user events out to everyone listening in this process
+//the in memory broker only sees events of its own instance. with several instances a broker backed by postgres
+//LISTEN/NOTIFY can implement the same interface, publishing with pg_notify and feeding its subscribers from LISTEN
+type eventBroker interface {
+	Publish(e userEvent)
+	//Subscribe returns a channel of events and a function to stop the subscription. the channel is closed when the
+	//subscription ends, either by calling the function or because the subscriber was too slow
+	Subscribe() (<-chan userEvent, func())
+}
+
+//memoryBroker delivers to every subscriber through a buffered channel
+//publishing never blocks: a subscriber whose buffer is full is dropped, its client reconnects and reloads
+type memoryBroker struct {
+	mu     sync.Mutex
+	subs   map[chan userEvent]bool
+	closed bool
+	logger *slog.Logger
+}
+
+func newMemoryBroker(logger *slog.Logger) *memoryBroker {
+	return &memoryBroker{subs: map[chan userEvent]bool{}, logger: logger}
+}
+
+func (b *memoryBroker) Publish(e userEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			b.logger.Warn("dropping a user event subscriber that fell behind")
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (b *memoryBroker) Subscribe() (<-chan userEvent, func()) {
+	ch := make(chan userEvent, subscriberBuffer)
+	b.mu.Lock()
+	if b.closed {
+		//the server is shutting down, the subscriber gets a stream that ends right away
+		close(ch)
+	} else {
+		b.subs[ch] = true
+	}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if b.subs[ch] {
+				delete(b.subs, ch)
+				close(ch)
+			}
+		})
+	}
+}
+
+//Close ends every subscription, so open event streams and websockets finish and dont hold up the shutdown
+func (b *memoryBroker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+//streamUserEvents sends user events to the client as server sent events until it disconnects
+//browsers cant set an Authorization header on an EventSource, they authenticate with the session cookie instead
+func streamUserEvents(events eventBroker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		//stops nginx style proxies from buffering the stream
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			loggerFrom(r.Context()).Error("streaming not supported", "error", err)
+			return
+		}
+
+		ch, unsubscribe := events.Subscribe()
+		defer unsubscribe()
+		heartbeat := time.NewTicker(eventHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				//comment lines are ignored by clients but keep proxies from closing an idle connection
+				if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+			case e, ok := <-ch:
+				if !ok {
+					return
+				}
+				data, err := json.Marshal(forCaller(r, e.User))
+				if err != nil {
+					loggerFrom(r.Context()).Error("encoding event", "error", err)
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+					return
+				}
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
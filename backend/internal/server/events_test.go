@@ -0,0 +1,67 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBrokerDropsSlowSubscriber(t *testing.T) {
+	broker := newMemoryBroker(slog.New(slog.DiscardHandler))
+	slow, _ := broker.Subscribe()
+	fast, unsubscribe := broker.Subscribe()
+	defer unsubscribe()
+	for range subscriberBuffer {
+		broker.Publish(userEvent{Type: eventUserUpdated})
+		<-fast
+	}
+	//one more than fits in the buffer of the one that doesnt read
+	broker.Publish(userEvent{Type: eventUserDeleted})
+	if e := <-fast; e.Type != eventUserDeleted {
+		t.Fatalf("the subscriber that keeps up got %+v", e)
+	}
+	n := 0
+	for range slow {
+		n++
+	}
+	if n != subscriberBuffer {
+		t.Fatalf("the dropped subscriber got %d events before its channel was closed, want %d", n, subscriberBuffer)
+	}
+}
+
+func TestUserEventsStreamIsForAdmins(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	_, member := ts.member()
+	expect(t, ts.do("GET", "/api/v1/users/events", member, nil), http.StatusForbidden)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", ts.URL+"/api/v1/users/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+admin)
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("an admin's stream answered %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	expect(t, ts.do("POST", "/api/v1/users", admin, map[string]any{"name": "Ada", "email": "ada@example.com", "password": "password123"}), http.StatusCreated)
+	lines := bufio.NewScanner(res.Body)
+	for lines.Scan() {
+		if data, ok := strings.CutPrefix(lines.Text(), "data: "); ok {
+			if !strings.Contains(data, "ada@example.com") {
+				t.Fatalf("the admin got %s", data)
+			}
+			return
+		}
+	}
+	t.Fatalf("the stream ended without an event: %v", lines.Err())
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//userExport is everything stored about one user, for privacy requests. secrets and what is derived from them
+//(password hash, token hashes, api key hashes) are left out, the rest of every row that belongs to the user is in.
+//timestamps are encoded as rfc 3339 like everywhere else in the api
+type userExport struct {
+	ExportedAt time.Time    `json:"exported_at"`
+	User       exportedUser `json:"user"`
+	//the audit events about the user. events where they were the actor are about other users and stay out
+	AuditEvents        []auditEntry           `json:"audit_events"`
+	Sessions           []exportedSession      `json:"sessions"`
+	RefreshTokens      []exportedRefreshToken `json:"refresh_tokens"`
+	PasswordResets     []exportedToken        `json:"password_resets"`
+	VerificationTokens []exportedVerification `json:"verification_tokens"`
+	ApiKeys            []exportedApiKey       `json:"api_keys"`
+	Addresses          []model.Address        `json:"addresses"`
+	//empty until the preferences were first read or set
+	NotificationPrefs []model.NotificationPrefs `json:"notification_prefs"`
+}
+
+//exportedUser is the users row, including what User doesnt show
+type exportedUser struct {
+	Id                    model.ID   `json:"id"`
+	Name                  string     `json:"name"`
+	Email                 string     `json:"email"`
+	Username              string     `json:"username,omitempty"`
+	Phone                 *string    `json:"phone"`
+	Locale                string     `json:"locale"`
+	Timezone              string     `json:"timezone"`
+	Role                  string     `json:"role"`
+	Active                bool       `json:"active"`
+	UpdatedAt             time.Time  `json:"updated_at"`
+	EmailVerifiedAt       *time.Time `json:"email_verified_at"`
+	PendingEmail          string     `json:"pending_email,omitempty"`
+	PendingEmailExpiresAt *time.Time `json:"pending_email_expires_at,omitempty"`
+	GoogleSubject         string     `json:"google_subject,omitempty"`
+	//HasPassword tells whether a password is set, the hash itself is never exported
+	HasPassword bool `json:"has_password"`
+}
+
+type exportedSession struct {
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedIP string    `json:"created_ip"`
+	UserAgent string    `json:"user_agent"`
+}
+
+type exportedRefreshToken struct {
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	Revoked   bool       `json:"revoked"`
+}
+
+//exportedToken is a password reset token without the token
+type exportedToken struct {
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+}
+
+//exportedVerification is an email verification token without the token, with the address it was sent to
+type exportedVerification struct {
+	Email     string     `json:"email"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+}
+
+//exportedApiKey is an api key the user created
+type exportedApiKey struct {
+	Id         model.ID   `json:"id"`
+	Label      string     `json:"label"`
+	Role       string     `json:"role"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+//exportUser serves everything stored about a user as one json document, or with ?format=zip (or an accept header
+//asking for application/zip) as a zip with one json file per kind of record, streamed to the client as it is written.
+//every export is written to the audit log before anything is sent
+func exportUser(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := userIdVar(r)
+		asZip := r.URL.Query().Get("format") == "zip" || acceptsZip(r)
+
+		e, err := gatherUserExport(r.Context(), db, id)
+		if errors.Is(err, store.ErrUserNotFound) {
+			writeUserNotFound(w, r, id)
+			return
+		}
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+
+		format := "json"
+		if asZip {
+			format = "zip"
+		}
+		event := auditEventFor(r.Context(), auditUserExported)
+		event.TargetUserId = int64(e.User.Id)
+		event.Details = map[string]string{"format": format}
+		if err := recordAudit(r.Context(), db, event); err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+
+		setSnapshotAt(w, e.ExportedAt)
+		filename := "user-" + strconv.FormatInt(int64(e.User.Id), 10) + "-export." + format
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+		w.Header().Set("Cache-Control", "no-store")
+		if !asZip {
+			w.Header().Set("Content-Type", contentTypeJSON)
+			w.WriteHeader(http.StatusOK)
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			enc.Encode(e)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.WriteHeader(http.StatusOK)
+		//the status is sent already, a failure from here on can only be logged and leaves the client with a broken zip
+		if err := writeExportZip(w, e); err != nil {
+			loggerFrom(r.Context()).Error("writing user export", "user_id", e.User.Id, "error", err)
+		}
+	}
+}
+
+//acceptsZip reports whether the accept header asks for application/zip
+func acceptsZip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mediaType == "application/zip" {
+			return true
+		}
+	}
+	return false
+}
+
+//writeExportZip writes e as a zip with one json file per kind of record, dated with the time of the export
+func writeExportZip(w http.ResponseWriter, e userExport) error {
+	zw := zip.NewWriter(w)
+	for _, f := range []struct {
+		name string
+		data any
+	}{
+		{"user.json", e.User},
+		{"audit_events.json", e.AuditEvents},
+		{"sessions.json", e.Sessions},
+		{"refresh_tokens.json", e.RefreshTokens},
+		{"password_resets.json", e.PasswordResets},
+		{"verification_tokens.json", e.VerificationTokens},
+		{"api_keys.json", e.ApiKeys},
+		{"addresses.json", e.Addresses},
+		{"notification_prefs.json", e.NotificationPrefs},
+	} {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: e.ExportedAt})
+		if err != nil {
+			return fmt.Errorf("adding %s: %w", f.name, err)
+		}
+		enc := json.NewEncoder(fw)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(f.data); err != nil {
+			return fmt.Errorf("writing %s: %w", f.name, err)
+		}
+	}
+	return zw.Close()
+}
+
+//gatherUserExport reads everything about the user in one read only transaction, so the parts of the export agree with each other
+func gatherUserExport(ctx context.Context, db *sql.DB, id int64) (userExport, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return userExport{}, fmt.Errorf("starting export transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	e := userExport{ExportedAt: time.Now().UTC()}
+	var pendingEmail, googleSubject sql.NullString
+	err = tx.QueryRowContext(ctx, `SELECT id, name, email, COALESCE(username, ''), phone, COALESCE(locale, 'en'), timezone, role, active, updated_at, email_verified_at,
+		pending_email, pending_email_expires_at, google_subject, password_hash IS NOT NULL FROM users WHERE id = $1`, id).Scan(&e.User.Id, &e.User.Name, &e.User.Email,
+		&e.User.Username, &e.User.Phone, &e.User.Locale, &e.User.Timezone, &e.User.Role,
+		&e.User.Active, &e.User.UpdatedAt, &e.User.EmailVerifiedAt, &pendingEmail, &e.User.PendingEmailExpiresAt, &googleSubject, &e.User.HasPassword)
+	if errors.Is(err, sql.ErrNoRows) {
+		return userExport{}, store.ErrUserNotFound
+	}
+	if err != nil {
+		return userExport{}, fmt.Errorf("loading user: %w", err)
+	}
+	e.User.PendingEmail, e.User.GoogleSubject = pendingEmail.String, googleSubject.String
+
+	if e.AuditEvents, err = exportRows(ctx, tx, "audit events", `SELECT id, created_at, actor_id, actor_api_key_id, impersonated_user_id, action, COALESCE(ip, ''), diff, details
+		FROM audit_events WHERE target_user_id = $1 ORDER BY id`, id, func(row store.RowScanner) (auditEntry, error) {
+		var (
+			a                                 auditEntry
+			actorId, apiKeyId, impersonatedId sql.NullInt64
+			diff, details                     []byte
+		)
+		err := row.Scan(&a.Id, &a.CreatedAt, &actorId, &apiKeyId, &impersonatedId, &a.Action, &a.IP, &diff, &details)
+		a.ActorId, a.ActorApiKeyId, a.ImpersonatedUserId = optionalId[model.ID](actorId), optionalId[model.ID](apiKeyId), optionalId[model.ID](impersonatedId)
+		a.Diff, a.Details = diff, details
+		return a, err
+	}); err != nil {
+		return userExport{}, err
+	}
+	if e.Sessions, err = exportRows(ctx, tx, "sessions", `SELECT created_at, expires_at, created_ip, user_agent
+		FROM sessions WHERE user_id = $1 ORDER BY created_at`, id, func(row store.RowScanner) (exportedSession, error) {
+		var s exportedSession
+		return s, row.Scan(&s.CreatedAt, &s.ExpiresAt, &s.CreatedIP, &s.UserAgent)
+	}); err != nil {
+		return userExport{}, err
+	}
+	if e.RefreshTokens, err = exportRows(ctx, tx, "refresh tokens", `SELECT created_at, expires_at, used_at, revoked
+		FROM refresh_tokens WHERE user_id = $1 ORDER BY id`, id, func(row store.RowScanner) (exportedRefreshToken, error) {
+		var t exportedRefreshToken
+		return t, row.Scan(&t.CreatedAt, &t.ExpiresAt, &t.UsedAt, &t.Revoked)
+	}); err != nil {
+		return userExport{}, err
+	}
+	if e.PasswordResets, err = exportRows(ctx, tx, "password resets", `SELECT created_at, expires_at, used_at
+		FROM password_resets WHERE user_id = $1 ORDER BY created_at`, id, func(row store.RowScanner) (exportedToken, error) {
+		var t exportedToken
+		return t, row.Scan(&t.CreatedAt, &t.ExpiresAt, &t.UsedAt)
+	}); err != nil {
+		return userExport{}, err
+	}
+	if e.VerificationTokens, err = exportRows(ctx, tx, "verification tokens", `SELECT email, created_at, expires_at, used_at
+		FROM verification_tokens WHERE user_id = $1 ORDER BY created_at`, id, func(row store.RowScanner) (exportedVerification, error) {
+		var v exportedVerification
+		return v, row.Scan(&v.Email, &v.CreatedAt, &v.ExpiresAt, &v.UsedAt)
+	}); err != nil {
+		return userExport{}, err
+	}
+	if e.ApiKeys, err = exportRows(ctx, tx, "api keys", `SELECT id, label, role, created_at, last_used_at
+		FROM api_keys WHERE created_by = $1 ORDER BY id`, id, func(row store.RowScanner) (exportedApiKey, error) {
+		var k exportedApiKey
+		return k, row.Scan(&k.Id, &k.Label, &k.Role, &k.CreatedAt, &k.LastUsedAt)
+	}); err != nil {
+		return userExport{}, err
+	}
+	if e.Addresses, err = exportRows(ctx, tx, "addresses", "SELECT "+addressColumns+" FROM addresses WHERE user_id = $1 ORDER BY id", id,
+		func(row store.RowScanner) (model.Address, error) {
+			var a model.Address
+			return a, scanAddress(row, &a)
+		}); err != nil {
+		return userExport{}, err
+	}
+	if e.NotificationPrefs, err = exportRows(ctx, tx, "notification preferences", "SELECT "+prefsColumns+" FROM notification_prefs WHERE user_id = $1", id,
+		func(row store.RowScanner) (model.NotificationPrefs, error) {
+			var p model.NotificationPrefs
+			return p, scanPrefs(row, &p)
+		}); err != nil {
+		return userExport{}, err
+	}
+	return e, nil
+}
+
+//exportRows runs query for the user id and scans every row, what names the records in errors.
+//the result is never nil so empty lists are exported as [] rather than null
+func exportRows[T any](ctx context.Context, tx *sql.Tx, what, query string, id int64, scan func(store.RowScanner) (T, error)) ([]T, error) {
+	rows, err := tx.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, fmt.Errorf("exporting %s: %w", what, err)
+	}
+	defer rows.Close()
+	result := []T{}
+	for rows.Next() {
+		v, err := scan(rows)
+		if err != nil {
+			return nil, fmt.Errorf("exporting %s: %w", what, err)
+		}
+		result = append(result, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("exporting %s: %w", what, err)
+	}
+	return result, nil
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+//basePath is the path the api is mounted under, see Config.BasePath. set from the config by New
+var basePath string
+
+//apiPath is the path the server serves the route path p at, like /backend/api/v1/users/3 for /api/v1/users/3
+func apiPath(p string) string {
+	return basePath + p
+}
+
+//externalURL is the url clients follow to reach the path p the server serves, for Location and Link headers and the
+//links in bodies. p is a path as the server sees it, like r.URL.Path or an apiPath. in front of it goes
+//PUBLIC_BASE_URL, or what a trusted proxy said with its X-Forwarded-* headers (see withForwardedBase).
+//without either the url stays relative to the request
+func externalURL(r *http.Request, p string) string {
+	if publicBaseURL != "" {
+		return publicBaseURL + p
+	}
+	base, _ := r.Context().Value(forwardedBaseKey).(string)
+	return base + p
+}
+
+//cookiePath is the path of the cookies the api sets: everything under /api as the browser sees it,
+//which includes the prefix of a proxy that strips it
+func cookiePath(r *http.Request) string {
+	u, err := url.Parse(externalURL(r, apiPath("/api")))
+	if err != nil || u.Path == "" {
+		return apiPath("/api")
+	}
+	return u.Path
+}
+
+//withForwardedBase keeps where a trusted proxy says the server is reached in the request context for externalURL:
+//X-Forwarded-Proto and X-Forwarded-Host are the origin, X-Forwarded-Prefix the path the proxy strips before passing
+//the request on. like X-Forwarded-For they are only believed from the trusted proxies, and values that dont look like
+//a scheme, a host or a path are left out so nothing can be injected into the links
+func withForwardedBase(trusted trustedProxies, next http.Handler) http.Handler {
+	if len(trusted) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if peer, ok := parseHostAddr(r.RemoteAddr); ok && trusted.contains(peer) {
+			if base := forwardedBase(r); base != "" {
+				r = r.WithContext(context.WithValue(r.Context(), forwardedBaseKey, base))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//forwardedBase is the origin and prefix of the X-Forwarded-* headers of r. without a host it is only the prefix,
+//the links stay relative to the request. a proxy that doesnt say the scheme is taken to be reached like the server
+func forwardedBase(r *http.Request) string {
+	prefix := strings.TrimSuffix(firstHeaderValue(r, "X-Forwarded-Prefix"), "/")
+	if prefix != "" && !validPathPrefix(prefix) {
+		prefix = ""
+	}
+	host := firstHeaderValue(r, "X-Forwarded-Host")
+	if host == "" {
+		return prefix
+	}
+	if u, err := url.Parse("//" + host); err != nil || u.Host != host || u.User != nil {
+		return prefix
+	}
+	scheme := strings.ToLower(firstHeaderValue(r, "X-Forwarded-Proto"))
+	if scheme != "http" && scheme != "https" {
+		scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+	}
+	return scheme + "://" + host + prefix
+}
+
+//firstHeaderValue is the first entry of a header that proxies may send as a list, when several of them add to it
+func firstHeaderValue(r *http.Request, name string) string {
+	first, _, _ := strings.Cut(r.Header.Get(name), ",")
+	return strings.TrimSpace(first)
+}
+
+//validPathPrefix reports whether p is a clean absolute path that needs no escaping, like /backend or /a/b
+func validPathPrefix(p string) bool {
+	return strings.HasPrefix(p, "/") && p != "/" && path.Clean(p) == p && (&url.URL{Path: p}).EscapedPath() == p
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"api/internal/model"
+)
+
+func TestForwardedBase(t *testing.T) {
+	for _, tc := range []struct {
+		proto, host, prefix string
+		want                string
+	}{
+		{"", "", "", ""},
+		{"https", "api.example.com", "/backend", "https://api.example.com/backend"},
+		{"", "api.example.com:8443", "", "http://api.example.com:8443"},
+		{"HTTPS, http", "api.example.com, internal:8080", "/backend/, /other", "https://api.example.com/backend"},
+		{"", "", "/backend", "/backend"},
+		//what isnt a plain scheme, host or path is left out
+		{"javascript", "api.example.com", "", "http://api.example.com"},
+		{"https", "evil.com/x", "/backend", "/backend"},
+		{"https", "user@evil.com", "", ""},
+		{"https", "api.example.com", "/../etc", "https://api.example.com"},
+		{"https", "api.example.com", "backend", "https://api.example.com"},
+		{"https", "api.example.com", "/a b", "https://api.example.com"},
+	} {
+		r := httptest.NewRequest("GET", "/api/v1/users", nil)
+		for name, value := range map[string]string{"X-Forwarded-Proto": tc.proto, "X-Forwarded-Host": tc.host, "X-Forwarded-Prefix": tc.prefix} {
+			if value != "" {
+				r.Header.Set(name, value)
+			}
+		}
+		if got := forwardedBase(r); got != tc.want {
+			t.Errorf("%q %q %q: got %q, want %q", tc.proto, tc.host, tc.prefix, got, tc.want)
+		}
+	}
+}
+
+//checkEmittedURLs creates a user as admin and reads a page, an error and the openapi document through the server at
+//path, every url in them has to start with base
+func checkEmittedURLs(t *testing.T, ts *testServer, admin, path, base string, headers ...string) {
+	t.Helper()
+	res := ts.do("POST", path+"/api/v1/users", admin, map[string]any{"name": "Ada", "email": "ada@example.com", "password": "password123"}, headers...)
+	expect(t, res, http.StatusCreated)
+	var u model.User
+	res.decode(t, &u)
+	if got, want := res.Header.Get("Location"), base+userPath(u.Id); got != want {
+		t.Fatalf("Location %q, want %q", got, want)
+	}
+	res = ts.do("GET", path+"/api/v1/users?limit=1", admin, nil, headers...)
+	expect(t, res, http.StatusOK)
+	links := res.Header.Values("Link")
+	if len(links) == 0 {
+		t.Fatal("no Link headers")
+	}
+	for _, link := range links {
+		if !strings.HasPrefix(link, "<"+base+"/api/v1/users?") {
+			t.Fatalf("Link %q isnt under %s", link, base)
+		}
+	}
+	res = ts.do("GET", path+"/api/v1/users/12345", admin, nil, append(headers, "Accept", mediaTypeProblem)...)
+	var problem problemDetails
+	res.decode(t, &problem)
+	if problem.Type != base+"/api/v1/errors/"+codeUserNotFound {
+		t.Fatalf("the problem type is %q", problem.Type)
+	}
+	res = ts.do("GET", path+"/api/v1/openapi.json", "", nil, headers...)
+	expect(t, res, http.StatusOK)
+	var doc struct {
+		Servers []struct {
+			URL string `json:"url"`
+		} `json:"servers"`
+	}
+	res.decode(t, &doc)
+	if len(doc.Servers) != 1 || doc.Servers[0].URL != base+"/api/v1" {
+		t.Fatalf("the openapi servers are %s", res.body)
+	}
+}
+
+func TestBasePathAndPublicBaseURL(t *testing.T) {
+	t.Run("base path", func(t *testing.T) {
+		ts := newTestServer(t, map[string]string{"BASE_PATH": "/backend", "PUBLIC_BASE_URL": "https://api.example.com/"})
+		admin := ts.admin()
+		checkEmittedURLs(t, ts, admin, "/backend", "https://api.example.com/backend")
+		//the api is only under the base path, the probes stay at the root
+		expect(t, ts.do("GET", "/api/v1/users", admin, nil), http.StatusNotFound)
+		expect(t, ts.do("GET", "/healthz", "", nil), http.StatusOK)
+	})
+	//a static address wins over what a proxy says
+	t.Run("proxy", func(t *testing.T) {
+		ts := newTestServer(t, map[string]string{"PUBLIC_BASE_URL": "https://api.example.com", "TRUSTED_PROXIES": "127.0.0.1/32"})
+		checkEmittedURLs(t, ts, ts.admin(), "", "https://api.example.com", "X-Forwarded-Host", "other.example.com")
+	})
+}
+
+func TestForwardedHeadersOfTrustedProxies(t *testing.T) {
+	forwarded := []string{"X-Forwarded-Proto", "https", "X-Forwarded-Host", "gateway.example.com", "X-Forwarded-Prefix", "/backend/go"}
+	t.Run("trusted", func(t *testing.T) {
+		ts := newTestServer(t, map[string]string{"TRUSTED_PROXIES": "127.0.0.1/32"})
+		checkEmittedURLs(t, ts, ts.admin(), "", "https://gateway.example.com/backend/go", forwarded...)
+	})
+	//anyone else could point the links anywhere, they stay relative
+	t.Run("untrusted", func(t *testing.T) {
+		ts := newTestServer(t, map[string]string{"TRUSTED_PROXIES": "10.0.0.0/8"})
+		checkEmittedURLs(t, ts, ts.admin(), "", "", forwarded...)
+	})
+}
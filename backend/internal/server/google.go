@@ -0,0 +1,280 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+
+	"api/internal/store"
+)
+
+const (
+	googleIssuer = "https://accounts.google.com"
+	//the state and nonce cookies only need to survive the trip to google's consent screen and back
+	googleStateCookie = "google_oauth_state"
+	googleNonceCookie = "google_oauth_nonce"
+	googleCookieTTL   = 10 * time.Minute
+)
+
+//googleAuth signs users in with their google account. it is configured from GOOGLE_CLIENT_ID, GOOGLE_CLIENT_SECRET and
+//GOOGLE_REDIRECT_URL, without them both endpoints answer 501
+//the oidc provider is discovered lazily on first use, so google being unreachable doesnt stop the api from starting
+type googleAuth struct {
+	db           *sql.DB
+	cache        *userCache
+	clientId     string
+	clientSecret string
+	redirectURL  string
+
+	mu       sync.Mutex
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+func newGoogleAuth(db *sql.DB, cache *userCache, c googleConfig) *googleAuth {
+	return &googleAuth{
+		db:           db,
+		cache:        cache,
+		clientId:     c.ClientId,
+		clientSecret: c.ClientSecret,
+		redirectURL:  c.RedirectURL,
+	}
+}
+
+func (g *googleAuth) configured() bool {
+	return g.clientId != "" && g.clientSecret != "" && g.redirectURL != ""
+}
+
+//provider returns the oauth2 config and id token verifier, discovering google's endpoints the first time
+func (g *googleAuth) provider(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.oauth != nil {
+		return g.oauth, g.verifier, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, googleIssuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("discovering google oidc provider: %w", err)
+	}
+	g.oauth = &oauth2.Config{
+		ClientID:     g.clientId,
+		ClientSecret: g.clientSecret,
+		RedirectURL:  g.redirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+	}
+	g.verifier = provider.Verifier(&oidc.Config{ClientID: g.clientId})
+	return g.oauth, g.verifier, nil
+}
+
+//setShortLivedCookie stores a value for the duration of the consent round trip. HttpOnly keeps scripts away from it
+func setShortLivedCookie(w http.ResponseWriter, r *http.Request, name, value string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     cookiePath(r),
+		MaxAge:   int(googleCookieTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+//cookieMatches compares a cookie with the expected value in constant time
+func cookieMatches(r *http.Request, name, expected string) bool {
+	c, err := r.Cookie(name)
+	return err == nil && expected != "" && subtle.ConstantTimeCompare([]byte(c.Value), []byte(expected)) == 1
+}
+
+//start redirects the browser to google's consent screen
+//the random state comes back on the callback and must match the cookie, which stops csrf on the callback
+func (g *googleAuth) start(w http.ResponseWriter, r *http.Request) {
+	if !g.configured() {
+		writeError(w, r, http.StatusNotImplemented, codeNotConfigured, "google sign in is not configured")
+		return
+	}
+	config, _, err := g.provider(r.Context())
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+
+	state, err := randomToken(32)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	nonce, err := randomToken(32)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	setShortLivedCookie(w, r, googleStateCookie, state)
+	setShortLivedCookie(w, r, googleNonceCookie, nonce)
+
+	http.Redirect(w, r, config.AuthCodeURL(state, oidc.Nonce(nonce)), http.StatusFound)
+}
+
+//googleClaims are the id token claims we use
+type googleClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	Nonce         string `json:"nonce"`
+}
+
+//callback finishes the sign in: it exchanges the code, verifies the id token and logs the matching user in
+func (g *googleAuth) callback(w http.ResponseWriter, r *http.Request) {
+	if !g.configured() {
+		writeError(w, r, http.StatusNotImplemented, codeNotConfigured, "google sign in is not configured")
+		return
+	}
+	if !cookieMatches(r, googleStateCookie, r.URL.Query().Get("state")) {
+		writeError(w, r, http.StatusBadRequest, codeInvalidState, "the sign in request expired or was not started from this browser, try again")
+		return
+	}
+	if errParam := r.URL.Query().Get("error"); errParam != "" {
+		writeError(w, r, http.StatusUnauthorized, codeInvalidCredentials, "google sign in was cancelled: "+errParam)
+		return
+	}
+
+	config, verifier, err := g.provider(r.Context())
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	token, err := config.Exchange(r.Context(), r.URL.Query().Get("code"))
+	if err != nil {
+		writeError(w, r, http.StatusUnauthorized, codeInvalidCredentials, "google did not accept the authorization code")
+		return
+	}
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		writeError(w, r, http.StatusUnauthorized, codeInvalidCredentials, "google did not return an id token")
+		return
+	}
+	idToken, err := verifier.Verify(r.Context(), rawIdToken)
+	if err != nil {
+		writeError(w, r, http.StatusUnauthorized, codeInvalidCredentials, "google id token is invalid")
+		return
+	}
+	var claims googleClaims
+	if err := idToken.Claims(&claims); err != nil {
+		internalServerError(w, r, fmt.Errorf("reading google id token claims: %w", err))
+		return
+	}
+	if !cookieMatches(r, googleNonceCookie, claims.Nonce) {
+		writeError(w, r, http.StatusUnauthorized, codeInvalidCredentials, "google id token was not issued for this sign in")
+		return
+	}
+	//an unverified address could belong to anyone, linking it would hand them someone else's account
+	if !claims.EmailVerified {
+		writeError(w, r, http.StatusForbidden, codeEmailNotVerified, "your google account email address is not verified")
+		return
+	}
+
+	userId, email, err := g.findOrCreateUser(r.Context(), idToken.Subject, claims)
+	if errors.Is(err, errGoogleAccountConflict) {
+		writeError(w, r, http.StatusConflict, codeConflict, err.Error())
+		return
+	}
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	//linking an account doesnt bring a deactivated one back
+	if _, err := userPrincipal(r.Context(), g.db, userId); errors.Is(err, errUserDeactivated) {
+		writeError(w, r, http.StatusForbidden, codeAccountDeactivated, "this account has been deactivated")
+		return
+	} else if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	recordLogin(r.Context(), g.db, userId)
+
+	tokens, err := issueTokenPair(r.Context(), g.db, userId, email)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	writeResponse(w, r, http.StatusOK, tokens)
+}
+
+var errGoogleAccountConflict = errors.New("this email address belongs to an account that is already linked to a different google account")
+
+//findOrCreateUser maps a google identity to one of our users:
+// 1. a user already linked to this google subject signs in as that user
+// 2. otherwise an existing account with the same (google verified) email is linked to the google subject, whether or not it
+//    also has a local password. the password keeps working, google becomes a second way to sign in, and the email counts as verified
+// 3. an account with that email that is linked to a different google subject is refused, we never relink silently
+// 4. otherwise a new member account without a password is created
+func (g *googleAuth) findOrCreateUser(ctx context.Context, subject string, claims googleClaims) (int64, string, error) {
+	id, email, err := g.linkGoogleUser(ctx, subject, claims)
+	//two first sign-ins with the same google account at once both miss case 1, the one that loses the race on the unique
+	//google_subject finds the user of the other when it tries again
+	if store.IsUniqueViolation(err) {
+		return g.linkGoogleUser(ctx, subject, claims)
+	}
+	return id, email, err
+}
+
+//linkGoogleUser is one attempt of findOrCreateUser, in a transaction
+func (g *googleAuth) linkGoogleUser(ctx context.Context, subject string, claims googleClaims) (int64, string, error) {
+	tx, err := g.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, "", fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var (
+		id            int64
+		email         string
+		linkedSubject sql.NullString
+	)
+	err = tx.QueryRowContext(ctx, "SELECT id, email FROM users WHERE google_subject = $1", subject).Scan(&id, &email)
+	if err == nil {
+		return id, email, tx.Commit()
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, "", fmt.Errorf("looking up google subject: %w", err)
+	}
+
+	googleEmail := strings.ToLower(strings.TrimSpace(claims.Email))
+	err = tx.QueryRowContext(ctx, "SELECT id, email, google_subject FROM users WHERE lower(email) = $1 ORDER BY id LIMIT 1 FOR UPDATE", googleEmail).
+		Scan(&id, &email, &linkedSubject)
+	switch {
+	case err == nil && linkedSubject.Valid:
+		return 0, "", errGoogleAccountConflict
+	case err == nil:
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET google_subject = $1, email_verified_at = COALESCE(email_verified_at, now()), version = version + 1, updated_at = now() WHERE id = $2", subject, id); err != nil {
+			return 0, "", fmt.Errorf("linking google account: %w", err)
+		}
+		//the user is verified now
+		defer g.cache.forget(ctx, id)
+	case errors.Is(err, sql.ErrNoRows):
+		name := strings.TrimSpace(claims.Name)
+		if name == "" {
+			name = googleEmail
+		}
+		email = googleEmail
+		id, err = insertId(ctx, tx, "INSERT INTO users (name, email, google_subject, email_verified_at) VALUES ($1, $2, $3, now())", name, googleEmail, subject)
+		if err != nil {
+			return 0, "", fmt.Errorf("creating user from google account: %w", err)
+		}
+		//the id may have been looked up before, when nobody had it
+		defer g.cache.forget(ctx, id)
+	default:
+		return 0, "", fmt.Errorf("looking up user by email: %w", err)
+	}
+	return id, email, tx.Commit()
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"api/internal/model"
+)
+
+func TestGoogleSignUpForgetsMissingUser(t *testing.T) {
+	ts := newTestServer(t, nil)
+	first := ts.createUser("Admin", "admin@example.com", model.RoleAdmin)
+	cache := newUserCache(ts.users, nil, nil, newMissingUserCache(userCacheConfig{size: 100, ttl: time.Minute}))
+	g := &googleAuth{db: ts.db, cache: cache}
+	ctx := context.Background()
+
+	//the ids are sequential, the next one is probed before anyone has it
+	if _, err := cache.Get(ctx, int64(first.Id+1)); err == nil {
+		t.Fatal("found the next user before it was created")
+	}
+	id, email, err := g.findOrCreateUser(ctx, "google-subject", googleClaims{Email: "Ada@Example.com", EmailVerified: true, Name: "Ada"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != int64(first.Id)+1 || email != "ada@example.com" {
+		t.Fatalf("signed up %d %s", id, email)
+	}
+	u, err := cache.Get(ctx, id)
+	if err != nil || u.Email != email || !u.Verified {
+		t.Fatalf("after the sign up got %+v, %v", u, err)
+	}
+}
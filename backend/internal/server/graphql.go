@@ -0,0 +1,533 @@
+package server
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+const (
+	defaultGraphQLLimit = 50
+	maxGraphQLLimit     = 100
+	//the deepest query of the schema itself is two levels, the rest of the room is for introspection like graphiql's
+	maxGraphQLDepth = 15
+	//every field costs one and fields below users(limit) count limit times, so this is about 300 fully selected users
+	maxGraphQLComplexity = 3000
+)
+
+//graphQLRequest is the body of POST /graphql
+type graphQLRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+	//accepted because clients send it, nothing uses it yet
+	Extensions map[string]any `json:"extensions"`
+}
+
+//graphQLError is a resolver error, its extensions carry the same error code the rest api would answer with
+type graphQLError struct {
+	code    string
+	message string
+	fields  model.FieldErrors
+}
+
+func (e *graphQLError) Error() string { return e.message }
+
+func (e *graphQLError) Extensions() map[string]any {
+	ext := map[string]any{"code": e.code}
+	if e.fields != nil {
+		ext["fields"] = e.fields
+	}
+	return ext
+}
+
+//graphQLHandler answers graphql queries and mutations on the users, resolved with the same functions as the rest handlers.
+//like the rest api any authenticated caller can read and the mutations need the admin role. while the writes are refused,
+//see refuseWritesInMaintenance, the mutations are answered 503 and the queries go through
+func graphQLHandler(users *userService) http.HandlerFunc {
+	schema, err := newGraphQLSchema(users)
+	if err != nil {
+		//the schema is fixed, an error here is a mistake in the definitions below
+		panic("building graphql schema: " + err.Error())
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req graphQLRequest
+		if err := decodeRequest(r, &req); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+
+		//parsing, validation and the cost check happen before anything is resolved,
+		//a query that fails one of them is answered with 400 and no data
+		doc, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{Body: []byte(req.Query), Name: "GraphQL request"})})
+		if err != nil {
+			writeGraphQLResult(w, r, http.StatusBadRequest, &graphql.Result{Errors: gqlerrors.FormatErrors(err)})
+			return
+		}
+		if v := graphql.ValidateDocument(&schema, doc, nil); !v.IsValid {
+			writeGraphQLResult(w, r, http.StatusBadRequest, &graphql.Result{Errors: v.Errors})
+			return
+		}
+		depth, complexity := queryCost(doc, req.OperationName, req.Variables)
+		switch {
+		case depth > maxGraphQLDepth:
+			writeGraphQLResult(w, r, http.StatusBadRequest, graphQLRejection(codeQueryTooComplex,
+				"query is nested "+strconv.Itoa(depth)+" levels deep, at most "+strconv.Itoa(maxGraphQLDepth)+" are allowed"))
+			return
+		case complexity > maxGraphQLComplexity:
+			writeGraphQLResult(w, r, http.StatusBadRequest, graphQLRejection(codeQueryTooComplex,
+				"query has a complexity of "+strconv.Itoa(complexity)+", at most "+strconv.Itoa(maxGraphQLComplexity)+" is allowed"))
+			return
+		}
+
+		//answered like the writes of the rest api
+		if refusal, refused := writeRefusalFrom(r.Context()); refused && isMutation(doc, req.OperationName) {
+			if refusal.retryAfter != "" {
+				w.Header().Set("Retry-After", refusal.retryAfter)
+			}
+			writeGraphQLResult(w, r, http.StatusServiceUnavailable, graphQLRejection(refusal.code, refusal.message))
+			return
+		}
+
+		result := graphql.Execute(graphql.ExecuteParams{
+			Schema:        schema,
+			AST:           doc,
+			OperationName: req.OperationName,
+			Args:          req.Variables,
+			Context:       r.Context(),
+		})
+		writeGraphQLResult(w, r, http.StatusOK, result)
+	}
+}
+
+//writeGraphQLResult writes result as json. errors that didnt come from a resolver get a code here:
+//the ones with a path happened while resolving, like a recovered panic, and are hidden like internalServerError does,
+//the others are about the document or its variables and are the client's fault
+func writeGraphQLResult(w http.ResponseWriter, r *http.Request, status int, result *graphql.Result) {
+	for i, e := range result.Errors {
+		switch {
+		case e.Extensions != nil:
+		case len(e.Path) > 0:
+			loggerFrom(r.Context()).Error("internal server error", "error", e.Message, "graphql_path", e.Path)
+			result.Errors[i] = gqlerrors.FormattedError{Message: "internal server error", Locations: e.Locations, Path: e.Path,
+				Extensions: map[string]any{"code": codeInternalError}}
+		default:
+			result.Errors[i].Extensions = map[string]any{"code": codeInvalidRequest}
+		}
+	}
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(status)
+	newJSONEncoder(w, wantsPretty(r)).Encode(result)
+}
+
+func graphQLRejection(code, message string) *graphql.Result {
+	return &graphql.Result{Errors: []gqlerrors.FormattedError{{Message: message, Extensions: map[string]any{"code": code}}}}
+}
+
+//isMutation reports whether the operation of doc that operationName selects is a mutation, see queryCost
+func isMutation(doc *ast.Document, operationName string) bool {
+	for _, def := range doc.Definitions {
+		if d, ok := def.(*ast.OperationDefinition); ok && (operationName == "" || d.Name != nil && d.Name.Value == operationName) {
+			return d.Operation == ast.OperationTypeMutation
+		}
+	}
+	return false
+}
+
+//queryCost returns how deep the fields of the selected operation are nested and its complexity:
+//every field costs one, and everything selected below a field with a limit argument costs once per entry it may return
+func queryCost(doc *ast.Document, operationName string, variables map[string]any) (depth, complexity int) {
+	fragments := map[string]*ast.FragmentDefinition{}
+	var operation *ast.OperationDefinition
+	for _, def := range doc.Definitions {
+		switch d := def.(type) {
+		case *ast.FragmentDefinition:
+			fragments[d.Name.Value] = d
+		case *ast.OperationDefinition:
+			if operation == nil && (operationName == "" || d.Name != nil && d.Name.Value == operationName) {
+				operation = d
+			}
+		}
+	}
+	if operation == nil {
+		//execution reports the missing operation
+		return 0, 0
+	}
+
+	//a fragment costs the same wherever it is spread, remembering it keeps fragments spreading fragments from taking exponential time
+	type cost struct{ depth, complexity int }
+	fragmentCosts := map[string]cost{}
+	var walk func(set *ast.SelectionSet) cost
+	walk = func(set *ast.SelectionSet) cost {
+		var total cost
+		if set == nil {
+			return total
+		}
+		for _, selection := range set.Selections {
+			var c cost
+			switch s := selection.(type) {
+			case *ast.Field:
+				c = walk(s.SelectionSet)
+				c = cost{c.depth + 1, 1 + c.complexity*fieldMultiplier(s, variables)}
+			case *ast.InlineFragment:
+				c = walk(s.SelectionSet)
+			case *ast.FragmentSpread:
+				known, ok := fragmentCosts[s.Name.Value]
+				if !ok {
+					//validation has rejected unknown and cyclic fragments already
+					if f := fragments[s.Name.Value]; f != nil {
+						known = walk(f.SelectionSet)
+					}
+					fragmentCosts[s.Name.Value] = known
+				}
+				c = known
+			}
+			total.depth = max(total.depth, c.depth)
+			total.complexity += c.complexity
+		}
+		return total
+	}
+	c := walk(operation.SelectionSet)
+	return c.depth, c.complexity
+}
+
+//fieldMultiplier is the most entries a field with a limit argument can return, 1 for every other field
+func fieldMultiplier(field *ast.Field, variables map[string]any) int {
+	for _, arg := range field.Arguments {
+		if arg.Name.Value != "limit" {
+			continue
+		}
+		limit := defaultGraphQLLimit
+		switch v := arg.Value.(type) {
+		case *ast.IntValue:
+			if n, err := strconv.Atoi(v.Value); err == nil {
+				limit = n
+			}
+		case *ast.Variable:
+			//variables come from json, so numbers are float64
+			if n, ok := variables[v.Name.Value].(float64); ok {
+				limit = int(n)
+			}
+		}
+		//the resolver rejects limits out of range, they cost what the largest allowed one would
+		return min(max(limit, 1), maxGraphQLLimit)
+	}
+	return 1
+}
+
+//newGraphQLSchema defines the users schema:
+//
+//	type Query { users(limit: Int, offset: Int, filter: UserFilter): [User!]!  user(id: ID!): User }
+//	type Mutation { createUser(input: CreateUserInput!): User!  updateUser(id: ID!, input: UpdateUserInput!, version: Int): User!  deleteUser(id: ID!, version: Int): User! }
+func newGraphQLSchema(users *userService) (graphql.Schema, error) {
+	//the fields resolve from User by name, which graphql-go matches ignoring case
+	userType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"id":        &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+			"name":      &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"email":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"username":  &graphql.Field{Type: graphql.NewNonNull(graphql.String), Description: "empty when the user has none"},
+			"phone":     &graphql.Field{Type: graphql.String, Description: "in E.164 form, null when the user has none"},
+			"locale":    &graphql.Field{Type: graphql.NewNonNull(graphql.String), Description: "a BCP 47 language tag like de-CH, en until the user picks one"},
+			"timezone":  &graphql.Field{Type: graphql.NewNonNull(graphql.String), Description: "an IANA time zone name like Europe/Zurich, UTC until the user picks one"},
+			"avatarUrl": &graphql.Field{Type: graphql.NewNonNull(graphql.String), Description: "where the profile picture is served, empty when the user has none"},
+			"role":      &graphql.Field{Type: graphql.NewNonNull(graphql.String), Description: "admin or member"},
+			"updatedAt": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+			"verified":  &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"active":    &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"pendingEmail": &graphql.Field{Type: graphql.NewNonNull(graphql.String),
+				Description: "a new address waiting to be confirmed from its inbox, empty when there is none"},
+			"version": &graphql.Field{Type: graphql.NewNonNull(graphql.Int),
+				Description: "goes up with every change, pass it to updateUser or deleteUser to make them conditional"},
+		},
+	})
+	filterType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "UserFilter",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"includeInactive": &graphql.InputObjectFieldConfig{Type: graphql.Boolean, DefaultValue: false},
+			"role":            &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"verified":        &graphql.InputObjectFieldConfig{Type: graphql.Boolean},
+			"search":          &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "part of the name or email address"},
+			"phone":           &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "the exact phone number"},
+			"email":           &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "the whole email address, ignoring case"},
+		},
+	})
+	createInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "CreateUserInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"name":     &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"email":    &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"username": &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"phone":    &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"locale":   &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "defaults to en"},
+			"timezone": &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "defaults to UTC"},
+			"role":     &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "defaults to member"},
+			"password": &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	})
+	updateInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "UpdateUserInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"name":     &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"email":    &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String), Description: "a changed address is kept as pendingEmail until it is confirmed"},
+			"username": &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "left out keeps the current username"},
+			"phone":    &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "left out keeps the current phone, empty removes it"},
+			"locale":   &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "left out keeps the current locale"},
+			"timezone": &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "left out keeps the current timezone"},
+			"role":     &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "left out keeps the current role"},
+		},
+	})
+	idArg := &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)}
+	versionArg := &graphql.ArgumentConfig{Type: graphql.Int, Description: "like If-Match: only change the user while it is still at this version"}
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"users": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(userType))),
+				Args: graphql.FieldConfigArgument{
+					"limit":  &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: defaultGraphQLLimit},
+					"offset": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 0},
+					"filter": &graphql.ArgumentConfig{Type: filterType},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					limit, _ := p.Args["limit"].(int)
+					offset, _ := p.Args["offset"].(int)
+					if limit < 1 || limit > maxGraphQLLimit {
+						return nil, &graphQLError{code: codeInvalidRequest, message: "limit must be between 1 and " + strconv.Itoa(maxGraphQLLimit)}
+					}
+					if offset < 0 {
+						return nil, &graphQLError{code: codeInvalidRequest, message: "offset must not be negative"}
+					}
+					f := store.Filter{Limit: limit, Offset: offset}
+					if in, ok := p.Args["filter"].(map[string]any); ok {
+						f.IncludeInactive, _ = in["includeInactive"].(bool)
+						f.Role, _ = in["role"].(string)
+						f.Search, _ = in["search"].(string)
+						f.Email, _ = in["email"].(string)
+						if v, ok := in["verified"].(bool); ok {
+							f.Verified = &v
+						}
+						if phone, _ := in["phone"].(string); phone != "" {
+							normalized, err := model.NormalizePhone(phone)
+							if err != nil {
+								return nil, &graphQLError{code: codeValidationFailed, message: "one or more fields are invalid", fields: model.FieldErrors{"phone": err.Error()}}
+							}
+							f.Phone = normalized
+						}
+					}
+					//like on GET /users, a caller cant filter on what they dont see of other users
+					for field, set := range map[string]bool{"email": f.Email != "", "phone": f.Phone != ""} {
+						if set && !canSeeUserField(p.Context, field) {
+							return nil, &graphQLError{code: codeForbidden, message: "you cant filter users by their " + field}
+						}
+					}
+					//and the search leaves out the emails they dont see, see searchUsers
+					f.SearchNamesOnly = !canSeeUserField(p.Context, "email")
+					list, err := users.store.List(p.Context, f)
+					if err != nil {
+						return nil, graphQLInternal(p.Context, err)
+					}
+					for i := range list {
+						list[i] = forContext(p.Context, list[i])
+					}
+					return list, nil
+				},
+			},
+			"user": &graphql.Field{
+				Type: userType,
+				Args: graphql.FieldConfigArgument{"id": idArg},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					id, err := graphQLUserId(p.Args)
+					if err != nil {
+						return nil, err
+					}
+					u, err := users.store.Get(p.Context, id)
+					if errors.Is(err, store.ErrUserNotFound) {
+						//like a missing row in sql, a user that doesnt exist is null rather than an error
+						return nil, nil
+					}
+					if err != nil {
+						return nil, graphQLUserOpError(p.Context, err)
+					}
+					return forContext(p.Context, u), nil
+				},
+			},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createUser": &graphql.Field{
+				Type: graphql.NewNonNull(userType),
+				Args: graphql.FieldConfigArgument{"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(createInput)}},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					if err := requireGraphQLAdmin(p.Context); err != nil {
+						return nil, err
+					}
+					in, _ := p.Args["input"].(map[string]any)
+					u := model.User{}
+					u.Name, _ = in["name"].(string)
+					u.Email, _ = in["email"].(string)
+					u.Username, _ = in["username"].(string)
+					if phone, ok := in["phone"].(string); ok {
+						u.Phone = &phone
+					}
+					u.Locale, _ = in["locale"].(string)
+					u.Timezone, _ = in["timezone"].(string)
+					u.Role, _ = in["role"].(string)
+					u.Password, _ = in["password"].(string)
+					if errs := u.Validate(); errs != nil {
+						return nil, &graphQLError{code: codeValidationFailed, message: "one or more fields are invalid", fields: errs}
+					}
+					u, err := users.create(p.Context, u)
+					if err != nil {
+						return nil, graphQLUserOpError(p.Context, err)
+					}
+					return u, nil
+				},
+			},
+			"updateUser": &graphql.Field{
+				Type: graphql.NewNonNull(userType),
+				Args: graphql.FieldConfigArgument{"id": idArg, "input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(updateInput)}, "version": versionArg},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					if err := requireGraphQLAdmin(p.Context); err != nil {
+						return nil, err
+					}
+					in, _ := p.Args["input"].(map[string]any)
+					u := model.User{}
+					u.Name, _ = in["name"].(string)
+					u.Email, _ = in["email"].(string)
+					u.Username, _ = in["username"].(string)
+					if phone, ok := in["phone"].(string); ok {
+						u.Phone = &phone
+					}
+					u.Locale, _ = in["locale"].(string)
+					u.Timezone, _ = in["timezone"].(string)
+					u.Role, _ = in["role"].(string)
+					if errs := u.Validate(); errs != nil {
+						return nil, &graphQLError{code: codeValidationFailed, message: "one or more fields are invalid", fields: errs}
+					}
+					match, err := graphQLVersionMatch(p.Args)
+					if err != nil {
+						return nil, err
+					}
+					id, err := graphQLUserId(p.Args)
+					if err != nil {
+						return nil, err
+					}
+					updated, err := users.update(p.Context, id, u, match)
+					if err != nil {
+						return nil, graphQLUserOpError(p.Context, err)
+					}
+					return updated, nil
+				},
+			},
+			"deleteUser": &graphql.Field{
+				Type:        graphql.NewNonNull(userType),
+				Description: "returns the user as it was before it was deleted",
+				Args:        graphql.FieldConfigArgument{"id": idArg, "version": versionArg},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					if err := requireGraphQLAdmin(p.Context); err != nil {
+						return nil, err
+					}
+					match, err := graphQLVersionMatch(p.Args)
+					if err != nil {
+						return nil, err
+					}
+					id, err := graphQLUserId(p.Args)
+					if err != nil {
+						return nil, err
+					}
+					deleted, err := users.remove(p.Context, id, match)
+					if err != nil {
+						return nil, graphQLUserOpError(p.Context, err)
+					}
+					return deleted, nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation})
+}
+
+//requireGraphQLAdmin is the graphql counterpart of the admin middleware on the write routes
+func requireGraphQLAdmin(ctx context.Context) error {
+	if p, ok := principalFromContext(ctx); !ok || p.Role != model.RoleAdmin {
+		return &graphQLError{code: codeForbidden, message: "this operation needs the admin role"}
+	}
+	return nil
+}
+
+//graphQLUserId is the id argument as a serial id, which like the {id} of the rest routes has to fit in an int64
+func graphQLUserId(args map[string]any) (int64, error) {
+	s, _ := args["id"].(string)
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, &graphQLError{code: codeInvalidRequest, message: "id must be a number up to " + strconv.FormatInt(math.MaxInt64, 10)}
+	}
+	return id, nil
+}
+
+//graphQLVersionMatch turns the optional version argument of a mutation into the condition an If-Match header would give
+func graphQLVersionMatch(args map[string]any) (*store.Match, error) {
+	version, ok := args["version"].(int)
+	if !ok {
+		if requireIfMatch {
+			return nil, &graphQLError{code: codePreconditionRequired, message: "version is required, pass the version of the user you last read"}
+		}
+		return nil, nil
+	}
+	return &store.Match{Versions: []int64{int64(version)}}, nil
+}
+
+//graphQLUserOpError is the graphql counterpart of writeUserOpError
+func graphQLUserOpError(ctx context.Context, err error) error {
+	var limited *deletionLimitError
+	switch {
+	case errors.Is(err, store.ErrUserNotFound):
+		return &graphQLError{code: codeUserNotFound, message: err.Error()}
+	case errors.Is(err, store.ErrEmailTaken), errors.Is(err, store.ErrUsernameTaken):
+		return &graphQLError{code: codeConflict, message: err.Error()}
+	case errors.Is(err, store.ErrVersionChanged):
+		return &graphQLError{code: codePreconditionFailed, message: err.Error()}
+	case errors.As(err, &limited):
+		return &graphQLError{code: codeDeletionLimitExceeded, message: err.Error()}
+	default:
+		return graphQLInternal(ctx, err)
+	}
+}
+
+//graphQLInternal logs err and hides it from the caller, like internalServerError
+func graphQLInternal(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		loggerFrom(ctx).Warn("request timed out", "error", err)
+		return &graphQLError{code: codeTimeout, message: "the request took too long and was cancelled"}
+	}
+	loggerFrom(ctx).Error("internal server error", "error", err)
+	return &graphQLError{code: codeInternalError, message: "internal server error"}
+}
+
+//go:embed graphiql.html
+var graphiQLPage []byte
+
+//graphiQL serves an in-browser query editor for the endpoint, it is only registered when GRAPHIQL is on
+func graphiQL(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(graphiQLPage)
+}
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//groupColumns lists the columns scanGroup expects, in order. "groups" is quoted everywhere, it is a reserved word in mysql
+const groupColumns = "id, name, description, created_at"
+
+func scanGroup(row store.RowScanner, g *model.Group) error {
+	return row.Scan(&g.Id, &g.Name, &g.Description, &g.CreatedAt)
+}
+
+//groupInput is the body of POST /groups and PUT /groups/{id}
+type groupInput struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+//groupMemberInput is the body of POST /groups/{id}/members
+type groupMemberInput struct {
+	UserId model.ID `json:"user_id"`
+}
+
+//decodeGroup reads and validates the group in the body, it has answered the request when ok is false
+func decodeGroup(w http.ResponseWriter, r *http.Request) (model.Group, bool) {
+	var in groupInput
+	if err := decodeRequest(r, &in); err != nil {
+		writeDecodeError(w, r, err)
+		return model.Group{}, false
+	}
+	g := model.Group{Name: in.Name, Description: in.Description}
+	if errs := g.Validate(); errs != nil {
+		writeValidationError(w, r, errs)
+		return model.Group{}, false
+	}
+	return g, true
+}
+
+//groupNameTaken reports whether another group than id has the name, ignoring case.
+//the unique index backs it up, a group created at the same moment fails there instead
+func groupNameTaken(ctx context.Context, db *sql.DB, name, id string) (bool, error) {
+	var taken bool
+	err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM "groups" WHERE lower(name) = lower($1) AND id <> $2)`, name, id).Scan(&taken)
+	if err != nil {
+		return false, fmt.Errorf("checking whether the group name is taken: %w", err)
+	}
+	return taken, nil
+}
+
+func writeGroupNameTaken(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusConflict, codeConflict, "a group with this name already exists")
+}
+
+func writeGroupNotFound(w http.ResponseWriter, r *http.Request, id string) {
+	writeError(w, r, http.StatusNotFound, codeNotFound, fmt.Sprintf("group %s does not exist", id))
+}
+
+//listGroups lists a page of the groups ordered by id like the users, see parsePage
+func listGroups(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := parsePage(w, r)
+		if !ok {
+			return
+		}
+
+		rows, err := db.QueryContext(r.Context(), `SELECT `+groupColumns+` FROM "groups" ORDER BY id LIMIT $1 OFFSET $2`, p.Limit, p.Offset)
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("listing groups: %w", err))
+			return
+		}
+		defer rows.Close()
+		groups := []model.Group{}
+		for rows.Next() {
+			var g model.Group
+			if err := scanGroup(rows, &g); err != nil {
+				internalServerError(w, r, fmt.Errorf("reading group: %w", err))
+				return
+			}
+			groups = append(groups, g)
+		}
+		if err := rows.Err(); err != nil {
+			internalServerError(w, r, fmt.Errorf("listing groups: %w", err))
+			return
+		}
+		writeResponse(w, r, http.StatusOK, model.GroupList{Groups: groups})
+	}
+}
+
+func createGroup(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		g, ok := decodeGroup(w, r)
+		if !ok {
+			return
+		}
+		taken, err := groupNameTaken(r.Context(), db, g.Name, "0")
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		if taken {
+			writeGroupNameTaken(w, r)
+			return
+		}
+		groupId, err := insertId(r.Context(), db, `INSERT INTO "groups" (name, description) VALUES ($1, $2)`, g.Name, g.Description)
+		if err == nil {
+			err = scanGroup(db.QueryRowContext(r.Context(), `SELECT `+groupColumns+` FROM "groups" WHERE id = $1`, groupId), &g)
+		}
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("creating group: %w", err))
+			return
+		}
+		w.Header().Set("Location", externalURL(r, apiPath(fmt.Sprintf("/api/v1/groups/%d", g.Id))))
+		writeResponse(w, r, http.StatusCreated, g)
+	}
+}
+
+func getGroup(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		var g model.Group
+		err := scanGroup(db.QueryRowContext(r.Context(), `SELECT `+groupColumns+` FROM "groups" WHERE id = $1`, id), &g)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeGroupNotFound(w, r, id)
+			return
+		}
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("loading group: %w", err))
+			return
+		}
+		writeResponse(w, r, http.StatusOK, g)
+	}
+}
+
+//updateGroup renames the group or changes its description
+func updateGroup(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		g, ok := decodeGroup(w, r)
+		if !ok {
+			return
+		}
+		taken, err := groupNameTaken(r.Context(), db, g.Name, id)
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		if taken {
+			writeGroupNameTaken(w, r)
+			return
+		}
+		_, err = db.ExecContext(r.Context(), `UPDATE "groups" SET name = $2, description = $3 WHERE id = $1`, id, g.Name, g.Description)
+		if err == nil {
+			//read back rather than counted, mysql doesnt count a row whose values didnt change as affected
+			err = scanGroup(db.QueryRowContext(r.Context(), `SELECT `+groupColumns+` FROM "groups" WHERE id = $1`, id), &g)
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			writeGroupNotFound(w, r, id)
+			return
+		}
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("updating group: %w", err))
+			return
+		}
+		writeResponse(w, r, http.StatusOK, g)
+	}
+}
+
+//deleteGroup removes the group, its memberships go with it
+func deleteGroup(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		res, err := db.ExecContext(r.Context(), `DELETE FROM "groups" WHERE id = $1`, id)
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("deleting group: %w", err))
+			return
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			writeGroupNotFound(w, r, id)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+//addGroupMember adds the user in the body to the group. a user is a member once, adding them again is a conflict
+func addGroupMember(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		var in groupMemberInput
+		if err := decodeRequest(r, &in); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+		if in.UserId < 1 {
+			writeValidationError(w, r, model.FieldErrors{"user_id": "is required"})
+			return
+		}
+
+		//the insert only happens when the group and the user exist and the user isnt a member yet,
+		//when nothing was inserted the lookups below tell which of these it was
+		res, err := db.ExecContext(r.Context(), `INSERT INTO group_members (group_id, user_id)
+			SELECT g.id, u.id FROM "groups" g, users u WHERE g.id = $1 AND u.id = $2
+			AND NOT EXISTS (SELECT 1 FROM group_members WHERE group_id = $1 AND user_id = $2)`, id, in.UserId)
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("adding group member: %w", err))
+			return
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			var groupExists, userExists, member bool
+			err := db.QueryRowContext(r.Context(), `SELECT EXISTS (SELECT 1 FROM "groups" WHERE id = $1), EXISTS (SELECT 1 FROM users WHERE id = $2),
+				EXISTS (SELECT 1 FROM group_members WHERE group_id = $1 AND user_id = $2)`, id, in.UserId).Scan(&groupExists, &userExists, &member)
+			switch {
+			case err != nil:
+				internalServerError(w, r, fmt.Errorf("checking group membership: %w", err))
+			case !groupExists:
+				writeGroupNotFound(w, r, id)
+			case !userExists:
+				writeUserNotFound(w, r, in.UserId)
+			case member:
+				writeError(w, r, http.StatusConflict, codeConflict, fmt.Sprintf("user %d is already a member of group %s", in.UserId, id))
+			default:
+				internalServerError(w, r, errors.New("adding group member inserted nothing"))
+			}
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+//removeGroupMember takes the user out of the group
+func removeGroupMember(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		res, err := db.ExecContext(r.Context(), "DELETE FROM group_members WHERE group_id = $1 AND user_id = $2", vars["id"], vars["userId"])
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("removing group member: %w", err))
+			return
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			writeError(w, r, http.StatusNotFound, codeNotFound, fmt.Sprintf("user %s is not a member of group %s", vars["userId"], vars["id"]))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+//getUserGroups lists the groups the user in the path is a member of
+func getUserGroups(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := userIdVar(r)
+		rows, err := db.QueryContext(r.Context(), `SELECT g.id, g.name, g.description, g.created_at FROM "groups" g
+			JOIN group_members m ON m.group_id = g.id WHERE m.user_id = $1 ORDER BY g.id`, id)
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("listing user groups: %w", err))
+			return
+		}
+		defer rows.Close()
+		groups := []model.Group{}
+		for rows.Next() {
+			var g model.Group
+			if err := scanGroup(rows, &g); err != nil {
+				internalServerError(w, r, fmt.Errorf("reading group: %w", err))
+				return
+			}
+			groups = append(groups, g)
+		}
+		if err := rows.Err(); err != nil {
+			internalServerError(w, r, fmt.Errorf("listing user groups: %w", err))
+			return
+		}
+		if len(groups) == 0 {
+			exists, err := userExists(r.Context(), db, id)
+			if err != nil {
+				internalServerError(w, r, err)
+				return
+			}
+			if !exists {
+				writeUserNotFound(w, r, id)
+				return
+			}
+		}
+		writeResponse(w, r, http.StatusOK, model.GroupList{Groups: groups})
+	}
+}
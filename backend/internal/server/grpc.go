@@ -0,0 +1,266 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"sort"
+	"strconv"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"api/internal/model"
+	"api/internal/store"
+	"api/userpb"
+)
+
+const (
+	defaultGRPCPageSize = 50
+	maxGRPCPageSize     = 100
+)
+
+//grpcUserService serves the user operations of /api/v1/users over grpc for internal services,
+//both go through userService so they cant drift apart
+type grpcUserService struct {
+	userpb.UnimplementedUserServiceServer
+	users *userService
+}
+
+//newGRPCServer builds the grpc server with the user service, callers authenticate with an api key like on the http api
+func newGRPCServer(db *sql.DB, users *userService, maintenance maintenanceSwitch, logger *slog.Logger) *grpc.Server {
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(grpcLogger(logger), grpcRecover, grpcMaintenance(maintenance), grpcApiKeyAuth(db)))
+	userpb.RegisterUserServiceServer(server, &grpcUserService{users: users})
+	return server
+}
+
+//grpcLogger puts a logger carrying the method into the context, the grpc counterpart of withLogger
+func grpcLogger(logger *slog.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		return handler(context.WithValue(ctx, loggerKey, logger.With("grpc_method", info.FullMethod)), req)
+	}
+}
+
+//grpcRecover turns a panic into an internal error instead of taking the whole process down, like recoverPanics
+func grpcRecover(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			loggerFrom(ctx).Error("panic serving rpc", "panic", v)
+			err = status.Error(codes.Internal, "internal server error")
+		}
+	}()
+	return handler(ctx, req)
+}
+
+//grpcApiKeyAuth checks the api key in the x-api-key metadata and puts the caller into the context,
+//so the audit log records the key as the actor just like for http requests
+func grpcApiKeyAuth(db *sql.DB) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		keys := md.Get("x-api-key")
+		if len(keys) == 0 {
+			return nil, status.Error(codes.Unauthenticated, "missing x-api-key metadata")
+		}
+		k, err := authenticateApiKey(ctx, db, keys[0])
+		if errors.Is(err, errApiKeyInvalid) {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		if err != nil {
+			return nil, grpcInternal(ctx, err)
+		}
+		return handler(context.WithValue(ctx, principalKey, principal{ApiKeyId: k.Id, Role: k.Role}), req)
+	}
+}
+
+//requireGRPCAdmin is the grpc counterpart of the admin middleware on the write routes
+func requireGRPCAdmin(ctx context.Context) error {
+	if p, ok := principalFromContext(ctx); !ok || p.Role != model.RoleAdmin {
+		return status.Error(codes.PermissionDenied, "this operation needs an api key with the admin role")
+	}
+	return nil
+}
+
+func (s *grpcUserService) GetUser(ctx context.Context, req *userpb.GetUserRequest) (*userpb.User, error) {
+	u, err := s.users.store.Get(ctx, req.GetId())
+	if err != nil {
+		return nil, grpcUserOpError(ctx, err)
+	}
+	return userToProto(forContext(ctx, u)), nil
+}
+
+//ListUsers pages through the users by id, the page token is the id of the last user of the previous page
+func (s *grpcUserService) ListUsers(ctx context.Context, req *userpb.ListUsersRequest) (*userpb.ListUsersResponse, error) {
+	size := int(req.GetPageSize())
+	switch {
+	case size < 0 || size > maxGRPCPageSize:
+		return nil, status.Errorf(codes.InvalidArgument, "page_size must be between 0 and %d", maxGRPCPageSize)
+	case size == 0:
+		size = defaultGRPCPageSize
+	}
+	var afterId int64
+	if token := req.GetPageToken(); token != "" {
+		id, err := strconv.ParseInt(token, 10, 64)
+		if err != nil || id < 0 {
+			return nil, status.Error(codes.InvalidArgument, "page_token is invalid")
+		}
+		afterId = id
+	}
+
+	//one extra row tells whether there is another page
+	users, err := s.users.store.List(ctx, store.Filter{IncludeInactive: req.GetIncludeInactive(), AfterId: afterId, Limit: size + 1})
+	if err != nil {
+		return nil, grpcInternal(ctx, err)
+	}
+	resp := &userpb.ListUsersResponse{}
+	if len(users) > size {
+		users = users[:size]
+		resp.NextPageToken = strconv.FormatInt(int64(users[size-1].Id), 10)
+	}
+	for _, u := range users {
+		resp.Users = append(resp.Users, userToProto(forContext(ctx, u)))
+	}
+	return resp, nil
+}
+
+func (s *grpcUserService) CreateUser(ctx context.Context, req *userpb.CreateUserRequest) (*userpb.User, error) {
+	if err := requireGRPCAdmin(ctx); err != nil {
+		return nil, err
+	}
+	u := model.User{Name: req.GetName(), Email: req.GetEmail(), Role: req.GetRole(), Password: req.GetPassword()}
+	if errs := u.Validate(); errs != nil {
+		return nil, grpcValidationError(errs)
+	}
+	u, err := s.users.create(ctx, u)
+	if err != nil {
+		return nil, grpcUserOpError(ctx, err)
+	}
+	return userToProto(u), nil
+}
+
+func (s *grpcUserService) UpdateUser(ctx context.Context, req *userpb.UpdateUserRequest) (*userpb.User, error) {
+	if err := requireGRPCAdmin(ctx); err != nil {
+		return nil, err
+	}
+	u := model.User{Name: req.GetName(), Email: req.GetEmail(), Role: req.GetRole()}
+	if errs := u.Validate(); errs != nil {
+		return nil, grpcValidationError(errs)
+	}
+	match, err := grpcVersionMatch(req.Version)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := s.users.update(ctx, req.GetId(), u, match)
+	if err != nil {
+		return nil, grpcUserOpError(ctx, err)
+	}
+	return userToProto(updated), nil
+}
+
+func (s *grpcUserService) DeleteUser(ctx context.Context, req *userpb.DeleteUserRequest) (*emptypb.Empty, error) {
+	if err := requireGRPCAdmin(ctx); err != nil {
+		return nil, err
+	}
+	match, err := grpcVersionMatch(req.Version)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.users.remove(ctx, req.GetId(), match); err != nil {
+		return nil, grpcUserOpError(ctx, err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+//grpcVersionMatch turns the optional version of a write into the condition an If-Match header would give,
+//when REQUIRE_IF_MATCH is on the version has to be there
+func grpcVersionMatch(version *int64) (*store.Match, error) {
+	if version == nil {
+		if requireIfMatch {
+			return nil, status.Error(codes.FailedPrecondition, "version is required, pass the version of the user you last read")
+		}
+		return nil, nil
+	}
+	return &store.Match{Versions: []int64{*version}}, nil
+}
+
+func userToProto(u model.User) *userpb.User {
+	return &userpb.User{
+		Id:           int64(u.Id),
+		Name:         u.Name,
+		Email:        u.Email,
+		Role:         u.Role,
+		UpdatedAt:    timestamppb.New(u.UpdatedAt),
+		Verified:     u.Verified,
+		Active:       u.Active,
+		PendingEmail: u.PendingEmail,
+		Version:      int64(u.Version),
+	}
+}
+
+//grpcValidationError is invalid argument with the per field messages as bad request details, sorted by field
+func grpcValidationError(errs model.FieldErrors) error {
+	details := &errdetails.BadRequest{}
+	for field, msg := range errs {
+		details.FieldViolations = append(details.FieldViolations, &errdetails.BadRequest_FieldViolation{Field: field, Description: msg})
+	}
+	sort.Slice(details.FieldViolations, func(i, j int) bool {
+		return details.FieldViolations[i].Field < details.FieldViolations[j].Field
+	})
+	st, err := status.New(codes.InvalidArgument, "one or more fields are invalid").WithDetails(details)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "one or more fields are invalid")
+	}
+	return st.Err()
+}
+
+//grpcUserOpError is the grpc counterpart of writeUserOpError
+func grpcUserOpError(ctx context.Context, err error) error {
+	var limited *deletionLimitError
+	switch {
+	case errors.Is(err, store.ErrUserNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, store.ErrEmailTaken), errors.Is(err, store.ErrUsernameTaken):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, store.ErrVersionChanged):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.As(err, &limited):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	default:
+		return grpcInternal(ctx, err)
+	}
+}
+
+//grpcInternal logs err and hides it from the caller, like internalServerError
+func grpcInternal(ctx context.Context, err error) error {
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled):
+		loggerFrom(ctx).Debug("client went away", "error", err)
+		return status.FromContextError(ctx.Err()).Err()
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		loggerFrom(ctx).Warn("rpc timed out", "error", err)
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	loggerFrom(ctx).Error("internal server error", "error", err)
+	return status.Error(codes.Internal, "internal server error")
+}
+
+//StopGRPC lets the open rpcs finish within timeout and then cuts the rest off
+func StopGRPC(server *grpc.Server, timeout time.Duration, logger *slog.Logger) {
+	done := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logger.Warn("grpc shutdown timeout reached, closing the remaining connections")
+		server.Stop()
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"api/internal/model"
+	"api/userpb"
+)
+
+//grpcClient serves the grpc service of ts on an in-memory listener and connects a client to it
+func (ts *testServer) grpcClient() userpb.UserServiceClient {
+	ts.t.Helper()
+	if ts.srv.GRPC == nil {
+		ts.t.Fatal("the server has no grpc service, set GRPC_ADDR")
+	}
+	lis := bufconn.Listen(1 << 20)
+	go ts.srv.GRPC.Serve(lis)
+	conn, err := grpc.NewClient("passthrough:///bufconn", grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }))
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	ts.t.Cleanup(func() {
+		conn.Close()
+		StopGRPC(ts.srv.GRPC, time.Second, testLogger(ts.t))
+	})
+	return userpb.NewUserServiceClient(conn)
+}
+
+//apiKey creates an api key with role and returns it
+func (ts *testServer) apiKey(admin, role string) string {
+	ts.t.Helper()
+	res := ts.do("POST", "/api/v1/apikeys", admin, map[string]any{"label": role, "role": role})
+	expect(ts.t, res, http.StatusCreated)
+	var key ApiKey
+	res.decode(ts.t, &key)
+	return key.Key
+}
+
+//grpcCode fails the test when err isnt a grpc status with code
+func grpcCode(t *testing.T, err error, code codes.Code) {
+	t.Helper()
+	if status.Code(err) != code {
+		t.Fatalf("got %v, want %s", err, code)
+	}
+}
+
+func TestGRPCUserService(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"GRPC_ADDR": "127.0.0.1:0"})
+	admin := ts.admin()
+	client := ts.grpcClient()
+	ctx := metadata.AppendToOutgoingContext(t.Context(), "x-api-key", ts.apiKey(admin, model.RoleAdmin))
+
+	created, err := client.CreateUser(ctx, &userpb.CreateUserRequest{Name: "Ada", Email: "Ada@Example.com", Password: "password123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Id == 0 || created.Email != "ada@example.com" || created.Role != model.RoleMember || created.Version == 0 {
+		t.Fatalf("created %v", created)
+	}
+	got, err := client.GetUser(ctx, &userpb.GetUserRequest{Id: created.Id})
+	if err != nil || got.Id != created.Id || got.Name != "Ada" {
+		t.Fatalf("got %v, %v", got, err)
+	}
+	updated, err := client.UpdateUser(ctx, &userpb.UpdateUserRequest{Id: created.Id, Name: "Ada Lovelace", Email: "ada@example.com", Version: &created.Version})
+	if err != nil || updated.Name != "Ada Lovelace" || updated.Version == created.Version {
+		t.Fatalf("updated to %v, %v", updated, err)
+	}
+	//the version of before the update is stale
+	_, err = client.DeleteUser(ctx, &userpb.DeleteUserRequest{Id: created.Id, Version: &created.Version})
+	grpcCode(t, err, codes.FailedPrecondition)
+	if _, err := client.DeleteUser(ctx, &userpb.DeleteUserRequest{Id: created.Id, Version: &updated.Version}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.GetUser(ctx, &userpb.GetUserRequest{Id: created.Id})
+	grpcCode(t, err, codes.NotFound)
+	_, err = client.UpdateUser(ctx, &userpb.UpdateUserRequest{Id: created.Id, Name: "Ghost", Email: "ghost@example.com"})
+	grpcCode(t, err, codes.NotFound)
+
+	_, err = client.CreateUser(ctx, &userpb.CreateUserRequest{Name: "Admin", Email: "admin@example.com"})
+	grpcCode(t, err, codes.AlreadyExists)
+	_, err = client.CreateUser(ctx, &userpb.CreateUserRequest{Name: "", Email: "not-an-email"})
+	grpcCode(t, err, codes.InvalidArgument)
+	var fields []string
+	for _, detail := range status.Convert(err).Details() {
+		if bad, ok := detail.(*errdetails.BadRequest); ok {
+			for _, v := range bad.FieldViolations {
+				fields = append(fields, v.Field)
+			}
+		}
+	}
+	if len(fields) != 2 || fields[0] != "email" || fields[1] != "name" {
+		t.Fatalf("the invalid fields are %v", fields)
+	}
+}
+
+func TestGRPCListUsersPages(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"GRPC_ADDR": "127.0.0.1:0"})
+	admin := ts.admin()
+	for _, name := range []string{"Ada", "Grace", "Hedy", "Katherine"} {
+		ts.createUser(name, name+"@example.com", model.RoleMember)
+	}
+	client := ts.grpcClient()
+	ctx := metadata.AppendToOutgoingContext(t.Context(), "x-api-key", ts.apiKey(admin, model.RoleMember))
+
+	var ids []int64
+	req := &userpb.ListUsersRequest{PageSize: 2}
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("the pages dont end")
+		}
+		resp, err := client.ListUsers(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, u := range resp.Users {
+			ids = append(ids, u.Id)
+		}
+		if resp.NextPageToken == "" {
+			break
+		}
+		req.PageToken = resp.NextPageToken
+	}
+	if len(ids) != 5 {
+		t.Fatalf("listed %v", ids)
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i] <= ids[i-1] {
+			t.Fatalf("listed %v", ids)
+		}
+	}
+	_, err := client.ListUsers(ctx, &userpb.ListUsersRequest{PageSize: 101})
+	grpcCode(t, err, codes.InvalidArgument)
+	_, err = client.ListUsers(ctx, &userpb.ListUsersRequest{PageToken: "x"})
+	grpcCode(t, err, codes.InvalidArgument)
+
+	//a member key reads but doesnt write, a call without one does nothing
+	_, err = client.CreateUser(ctx, &userpb.CreateUserRequest{Name: "Eve", Email: "eve@example.com"})
+	grpcCode(t, err, codes.PermissionDenied)
+	_, err = client.ListUsers(t.Context(), &userpb.ListUsersRequest{})
+	grpcCode(t, err, codes.Unauthenticated)
+	_, err = client.ListUsers(metadata.AppendToOutgoingContext(t.Context(), "x-api-key", "not-a-key"), &userpb.ListUsersRequest{})
+	grpcCode(t, err, codes.Unauthenticated)
+}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	healthPingTimeout = 2 * time.Second
+	//a failing database is logged at most once per interval, load balancers probe every few seconds
+	healthLogInterval = time.Minute
+	//defaultDrainDelay is how long /readyz reports draining before the server stops accepting connections
+	defaultDrainDelay = 5 * time.Second
+	//readinessCacheTTL is how long /readyz answers with the checks it last ran, so probes from several load balancers
+	//dont multiply the load on the dependencies
+	readinessCacheTTL = 2 * time.Second
+	//defaultHardDependencies are the dependencies /readyz fails without when READY_HARD_DEPENDENCIES isnt set
+	defaultHardDependencies = "db,redis"
+)
+
+//the dependencies /readyz can check, by the name they have in READY_HARD_DEPENDENCIES and in its components
+const (
+	dependencyDB      = "db"
+	dependencyRedis   = "redis"
+	dependencySMTP    = "smtp"
+	dependencyOutbox  = "outbox"
+	dependencyAvatars = "avatars"
+	dependencyExports = "exports"
+)
+
+//dependencies are all of them, READY_HARD_DEPENDENCIES may only name these
+var dependencies = []string{dependencyDB, dependencyRedis, dependencySMTP, dependencyOutbox, dependencyAvatars, dependencyExports}
+
+//draining is set when the server starts shutting down, /readyz answers 503 from then on
+//so the load balancer stops sending new requests before connections are refused
+var draining atomic.Bool
+
+//healthStatus is the body of GET /healthz
+type healthStatus struct {
+	XMLName xml.Name `json:"-" xml:"health"`
+	Status  string   `json:"status" xml:"status"`
+	DB      string   `json:"db,omitempty" xml:"db,omitempty"`
+	Error   string   `json:"error,omitempty" xml:"error,omitempty"`
+	//Maintenance is set by /readyz while writes are refused, the instance stays ready for reads
+	Maintenance bool `json:"maintenance,omitempty" xml:"maintenance,omitempty"`
+	//ReadOnly is set by /readyz while the instance only serves reads, see READ_ONLY
+	ReadOnly bool `json:"read_only,omitempty" xml:"read_only,omitempty"`
+	//Components is how each dependency /readyz checked is doing: up, down or, for one it can do without, degraded
+	Components map[string]string `json:"components,omitempty" xml:"-"`
+}
+
+//healthChecker is a dependency /readyz checks, the components register theirs with healthChecks when they start
+type healthChecker interface {
+	//CheckHealth returns nil when the dependency can be used. ctx ends after healthPingTimeout
+	CheckHealth(ctx context.Context) error
+}
+
+//healthCheckFunc is a function as a healthChecker
+type healthCheckFunc func(ctx context.Context) error
+
+func (f healthCheckFunc) CheckHealth(ctx context.Context) error {
+	return f(ctx)
+}
+
+//healthChecks are the dependencies of this process. main starts the workers before New, both register what they use
+var healthChecks = newHealthRegistry()
+
+//healthRegistry runs the checks of the dependencies for /readyz, all at once and each with its own timeout.
+//the hard dependencies are the ones the instance isnt ready without, when a soft one fails it is only degraded
+type healthRegistry struct {
+	mu     sync.Mutex
+	checks map[string]healthChecker
+	hard   []string
+	//the last result and when it was checked, see readinessCacheTTL
+	last      readiness
+	checkedAt time.Time
+	//lastLogged is when the failure of each dependency was last logged, at most once per healthLogInterval
+	lastLogged map[string]time.Time
+}
+
+//readiness is the result of healthRegistry.check
+type readiness struct {
+	components map[string]string
+	//errors are the failures of the hard dependencies by name
+	errors map[string]string
+}
+
+func newHealthRegistry() *healthRegistry {
+	return &healthRegistry{checks: map[string]healthChecker{}, hard: strings.Split(defaultHardDependencies, ","), lastLogged: map[string]time.Time{}}
+}
+
+//register adds the check of a dependency, a check registered under the same name before is replaced
+func (h *healthRegistry) register(name string, c healthChecker) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[name] = c
+	h.checkedAt = time.Time{}
+}
+
+//setHard makes names the hard dependencies, see READY_HARD_DEPENDENCIES
+func (h *healthRegistry) setHard(names []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hard = names
+	h.checkedAt = time.Time{}
+}
+
+//check runs every check, or answers with the last result while it is younger than readinessCacheTTL.
+//probes that come in while the checks run wait for them rather than starting their own
+func (h *healthRegistry) check(ctx context.Context, logger *slog.Logger) readiness {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if time.Since(h.checkedAt) < readinessCacheTTL {
+		return h.last
+	}
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result, len(h.checks))
+	for name, c := range h.checks {
+		go func() {
+			ctx, cancel := context.WithTimeout(ctx, healthPingTimeout)
+			defer cancel()
+			results <- result{name, c.CheckHealth(ctx)}
+		}()
+	}
+	r := readiness{components: map[string]string{}, errors: map[string]string{}}
+	for range h.checks {
+		res := <-results
+		hard := slices.Contains(h.hard, res.name)
+		switch {
+		case res.err == nil:
+			r.components[res.name] = "up"
+			continue
+		case hard:
+			r.components[res.name] = "down"
+			r.errors[res.name] = res.err.Error()
+		default:
+			r.components[res.name] = "degraded"
+		}
+		//the database logs its own failures, see dbProbe
+		if res.name != dependencyDB && time.Since(h.lastLogged[res.name]) >= healthLogInterval {
+			h.lastLogged[res.name] = time.Now()
+			logger.Error("readiness check failed", "dependency", res.name, "hard", hard, "error", res.err)
+		}
+	}
+	//a probe that went away doesnt tell how the dependencies are, it isnt kept
+	if ctx.Err() == nil {
+		h.last, h.checkedAt = r, time.Now()
+	}
+	return r
+}
+
+//status is the overall status of r: down when a hard dependency failed, degraded when only soft ones did
+func (r readiness) status() string {
+	if len(r.errors) > 0 {
+		return "down"
+	}
+	for _, c := range r.components {
+		if c != "up" {
+			return "degraded"
+		}
+	}
+	return "ok"
+}
+
+//errorText joins the errors of the hard dependencies, sorted by name
+func (r readiness) errorText() string {
+	var errs []string
+	for name, err := range r.errors {
+		errs = append(errs, name+": "+err)
+	}
+	slices.Sort(errs)
+	return strings.Join(errs, "; ")
+}
+
+//dbProbe pings the database for the health endpoints and rate limits the log line when it is down
+type dbProbe struct {
+	db         *sql.DB
+	mu         sync.Mutex
+	lastLogged time.Time
+}
+
+func (p *dbProbe) ping(ctx context.Context, logger *slog.Logger) error {
+	ctx, cancel := context.WithTimeout(ctx, healthPingTimeout)
+	defer cancel()
+	err := p.db.PingContext(ctx)
+	if err != nil {
+		p.mu.Lock()
+		if time.Since(p.lastLogged) >= healthLogInterval {
+			p.lastLogged = time.Now()
+			logger.Error("health check failed, database is down", "error", err)
+		}
+		p.mu.Unlock()
+	}
+	return err
+}
+
+//CheckHealth pings the database for /readyz
+func (p *dbProbe) CheckHealth(ctx context.Context) error {
+	return p.ping(ctx, loggerFrom(ctx))
+}
+
+//healthz answers load balancer probes: 200 when the database answers a ping, 503 otherwise
+//it is public and cheap, it doesnt touch any table
+func healthz(probe *dbProbe) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := probe.ping(r.Context(), loggerFrom(r.Context())); err != nil {
+			writeResponse(w, r, http.StatusServiceUnavailable, healthStatus{Status: "degraded", DB: "down", Error: err.Error()})
+			return
+		}
+		writeResponse(w, r, http.StatusOK, healthStatus{Status: "ok", DB: "up"})
+	}
+}
+
+//livez is the kubernetes liveness probe, it answers 200 for as long as the process can serve http at all
+//it sits on the root mux like /readyz, outside the auth, cors and content type middlewares
+func livez(w http.ResponseWriter, r *http.Request) {
+	writeProbe(w, http.StatusOK, healthStatus{Status: "ok"})
+}
+
+//readyz is the kubernetes readiness probe: 200 only when every hard dependency of checks answers and the server isnt
+//draining. a soft dependency that fails, by default anything but the database and redis, makes the status degraded
+//but keeps the 200, the instance can still serve most requests. components says how each dependency is doing.
+//in maintenance it stays 200 with maintenance set, and read only with read_only set, load balancers that route writes
+//elsewhere can look for them
+func readyz(checks *healthRegistry, maintenance maintenanceSwitch) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() {
+			writeProbe(w, http.StatusServiceUnavailable, healthStatus{Status: "draining"})
+			return
+		}
+		ready := checks.check(r.Context(), loggerFrom(r.Context()))
+		body := healthStatus{Status: ready.status(), DB: ready.components[dependencyDB], Error: ready.errorText(), Components: ready.components}
+		if body.Status == "down" {
+			writeProbe(w, http.StatusServiceUnavailable, body)
+			return
+		}
+		body.Maintenance, _ = inMaintenance(r.Context(), maintenance)
+		body.ReadOnly = isReadOnly(r.Context(), maintenance)
+		writeProbe(w, http.StatusOK, body)
+	}
+}
+
+//writeProbe writes a probe answer as plain json, probes dont negotiate formats
+func writeProbe(w http.ResponseWriter, status int, body healthStatus) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"embed"
+	"encoding/json"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"api/internal/model"
+)
+
+//defaultLocale is the language the messages are written in, it has no catalog and is what every other locale falls back to
+const defaultLocale = "en"
+
+//localeFiles are the catalogs of the other locales, one file per language named like es.json
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+//messageCatalog translates the messages of the error envelope into one language. Errors has the message for each
+//error code, it replaces whatever message the handler wrote. Fields translates the per field messages of validation
+//errors, keyed by the english message with every number replaced by {n}, see translateField
+type messageCatalog struct {
+	Errors map[string]string `json:"errors"`
+	Fields map[string]string `json:"fields"`
+}
+
+//catalogs are the embedded catalogs by language, loaded once. a broken catalog is a bug, so it stops the server right away
+var catalogs = loadCatalogs()
+
+func loadCatalogs() map[string]messageCatalog {
+	entries, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	catalogs := map[string]messageCatalog{}
+	for _, e := range entries {
+		data, err := localeFiles.ReadFile("locales/" + e.Name())
+		if err != nil {
+			panic(err)
+		}
+		var c messageCatalog
+		if err := json.Unmarshal(data, &c); err != nil {
+			panic("locale " + e.Name() + ": " + err.Error())
+		}
+		catalogs[strings.TrimSuffix(e.Name(), path.Ext(e.Name()))] = c
+	}
+	return catalogs
+}
+
+//preferredLocale picks the language of the error messages from an Accept-Language header like "es-MX,es;q=0.9,en;q=0.5".
+//only the primary language counts, es-MX gets es. the supported language with the highest q value wins, the first one
+//of those on a tie. a missing or unparseable header, or one without a supported language, gets defaultLocale
+func preferredLocale(header string) string {
+	best, bestQ := defaultLocale, 0.0
+	for part := range strings.SplitSeq(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		lang, _, _ := strings.Cut(strings.ReplaceAll(tag, "_", "-"), "-")
+		if _, ok := catalogs[lang]; !ok && lang != defaultLocale {
+			continue
+		}
+		q := 1.0
+		for param := range strings.SplitSeq(params, ";") {
+			name, value, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(name) != "q" {
+				continue
+			}
+			//a q value that isnt a number between 0 and 1 makes the language unacceptable instead of failing the request
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				parsed = 0
+			}
+			q = parsed
+		}
+		if q > bestQ {
+			best, bestQ = lang, q
+		}
+	}
+	return best
+}
+
+//numberPattern finds the numbers in a field message, they are filled in again after it was translated
+var numberPattern = regexp.MustCompile(`[0-9]+`)
+
+//translateField translates one field message, e.g. "must be at most 255 characters" is looked up as
+//"must be at most {n} characters" and 255 is put back in place of {n}. an unknown message stays in english
+func (c messageCatalog) translateField(msg string) string {
+	numbers := numberPattern.FindAllString(msg, -1)
+	translated, ok := c.Fields[numberPattern.ReplaceAllString(msg, "{n}")]
+	if !ok {
+		return msg
+	}
+	for _, n := range numbers {
+		translated = strings.Replace(translated, "{n}", n, 1)
+	}
+	return translated
+}
+
+//userLocale is the language of the error messages for the user who made r, from the locale they picked. only the
+//language counts like in preferredLocale, de-CH gets de. false when the caller isnt a user who picked a locale, or
+//picked one there is no catalog for, then Accept-Language decides
+func userLocale(r *http.Request) (string, bool) {
+	p, _ := principalFromContext(r.Context())
+	lang, _, _ := strings.Cut(strings.ToLower(p.Locale), "-")
+	if _, ok := catalogs[lang]; !ok && lang != defaultLocale {
+		return "", false
+	}
+	return lang, true
+}
+
+//localizeError translates the message and field messages of e into the language the user picked (see userLocale) or
+//else the request asks for, the code stays the same so clients can keep branching on it. english is what the handlers
+//wrote already, with its details like the id that wasnt found. the response says which language it is in and that it
+//depends on Accept-Language
+func localizeError(w http.ResponseWriter, r *http.Request, e apiError) apiError {
+	w.Header().Add("Vary", "Accept-Language")
+	locale, ok := userLocale(r)
+	if !ok {
+		locale = preferredLocale(r.Header.Get("Accept-Language"))
+	}
+	w.Header().Set("Content-Language", locale)
+	c, ok := catalogs[locale]
+	if !ok {
+		return e
+	}
+	if msg, ok := c.Errors[e.Code]; ok {
+		e.Message = msg
+	}
+	if e.Fields != nil {
+		//the caller's map isnt changed, it may be reused
+		fields := make(model.FieldErrors, len(e.Fields))
+		for name, msg := range e.Fields {
+			fields[name] = c.translateField(msg)
+		}
+		e.Fields = fields
+	}
+	return e
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"api/internal/store"
+)
+
+//idempotency keys are remembered this long, a retry after that is treated as a brand new request
+const (
+	idempotencyKeyTTL       = 24 * time.Hour
+	idempotencyKeyMaxLength = 255
+)
+
+//replayedHeaders are the response headers stored with an idempotency key and sent again on replay
+var replayedHeaders = []string{"Content-Type", "Location", "ETag", "Last-Modified", "Vary"}
+
+//captureWriter passes the response through to the client while keeping a copy of the status and body
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (c *captureWriter) WriteHeader(status int) {
+	c.status = status
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *captureWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	c.body.Write(b)
+	return c.ResponseWriter.Write(b)
+}
+
+//Unwrap lets http.ResponseController reach the underlying writer
+func (c *captureWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+//idempotent wraps a handler so clients can safely retry it by sending an Idempotency-Key header
+//the first request with a key runs the handler and stores its response, a replay with the same key and body gets the stored
+//response back without running the handler again, and a replay with a different body is refused with 422
+//keys are the caller's, see idempotencyPrincipal, so a key another caller picked neither replays their response nor
+//is refused. the primary key on idempotency_keys, the caller and the key, makes sure two concurrent first requests with
+//the same key cant both run the handler
+func idempotent(db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > idempotencyKeyMaxLength {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Idempotency-Key must be at most %d characters", idempotencyKeyMaxLength))
+			return
+		}
+
+		//read the whole body so it can be hashed, then put it back for the handler
+		body, err := io.ReadAll(r.Body)
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeBodyTooLarge(w, r, maxErr.Limit)
+			return
+		}
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "request body could not be read")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+		requestHash := hex.EncodeToString(sum[:])
+		caller := idempotencyPrincipal(r.Context())
+
+		//claim the key. a row left over from an expired key is removed first, so it is claimed as if it wasnt there.
+		//a key that is there already is the primary key refusing the insert
+		now := time.Now().UTC()
+		if _, err := db.ExecContext(r.Context(), `DELETE FROM idempotency_keys WHERE principal = $1 AND "key" = $2 AND created_at < $3`, caller, key, now.Add(-idempotencyKeyTTL)); err != nil {
+			internalServerError(w, r, fmt.Errorf("releasing expired idempotency key: %w", err))
+			return
+		}
+		_, err = db.ExecContext(r.Context(), `INSERT INTO idempotency_keys (principal, "key", request_hash, created_at) VALUES ($1, $2, $3, $4)`,
+			caller, key, requestHash, now)
+		switch {
+		case store.IsUniqueViolation(err):
+			replayStored(db, caller, key, requestHash, w, r)
+		case err != nil:
+			internalServerError(w, r, fmt.Errorf("claiming idempotency key: %w", err))
+		default:
+			runAndStore(db, caller, key, w, r, next)
+		}
+	}
+}
+
+//idempotencyPrincipal is who the idempotency keys of ctx belong to: the api key, or the user of the token, the one
+//impersonated while impersonating
+func idempotencyPrincipal(ctx context.Context) string {
+	p, ok := principalFromContext(ctx)
+	switch {
+	case !ok:
+		return ""
+	case p.ApiKeyId != 0:
+		return "key:" + strconv.Itoa(p.ApiKeyId)
+	}
+	return "user:" + strconv.FormatInt(p.UserId, 10)
+}
+
+//runAndStore runs the handler for a freshly claimed key and saves its response for later replays
+//server errors are not stored, the key is released instead so the client can retry for real
+func runAndStore(db *sql.DB, caller, key string, w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	capture := &captureWriter{ResponseWriter: w}
+	next(capture, r)
+
+	//the key has to be released or stored even if the client went away or the deadline passed meanwhile
+	ctx := context.WithoutCancel(r.Context())
+	if capture.status == 0 || capture.status >= 500 {
+		if _, err := db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE principal = $1 AND "key" = $2`, caller, key); err != nil {
+			loggerFrom(r.Context()).Error("releasing idempotency key", "error", err)
+		}
+		return
+	}
+
+	headers := map[string]string{}
+	for _, name := range replayedHeaders {
+		if v := w.Header().Get(name); v != "" {
+			headers[name] = v
+		}
+	}
+	encodedHeaders, _ := json.Marshal(headers)
+	_, err := db.ExecContext(ctx, `UPDATE idempotency_keys SET status = $3, headers = $4, body = $5 WHERE principal = $1 AND "key" = $2`,
+		caller, key, capture.status, string(encodedHeaders), capture.body.Bytes())
+	if err != nil {
+		loggerFrom(r.Context()).Error("storing idempotent response", "error", err)
+	}
+}
+
+//replayStored answers a request whose key was already claimed by an earlier request
+func replayStored(db *sql.DB, caller, key, requestHash string, w http.ResponseWriter, r *http.Request) {
+	var (
+		storedHash string
+		status     sql.NullInt64
+		headers    []byte
+		body       []byte
+	)
+	err := db.QueryRowContext(r.Context(), `SELECT request_hash, status, headers, body FROM idempotency_keys WHERE principal = $1 AND "key" = $2`, caller, key).
+		Scan(&storedHash, &status, &headers, &body)
+	if errors.Is(err, sql.ErrNoRows) {
+		//the first request failed and released the key between our insert and this select
+		writeError(w, r, http.StatusConflict, codeConflict, "a request with this Idempotency-Key failed, retry it")
+		return
+	}
+	if err != nil {
+		internalServerError(w, r, fmt.Errorf("loading idempotency key: %w", err))
+		return
+	}
+
+	if storedHash != requestHash {
+		writeError(w, r, http.StatusUnprocessableEntity, codeIdempotencyKeyReused, "this Idempotency-Key was already used with a different request body")
+		return
+	}
+	if !status.Valid {
+		writeError(w, r, http.StatusConflict, codeConflict, "a request with this Idempotency-Key is still being processed")
+		return
+	}
+
+	stored := map[string]string{}
+	json.Unmarshal(headers, &stored)
+	for name, v := range stored {
+		w.Header().Set(name, v)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(int(status.Int64))
+	w.Write(body)
+}
+
+//cleanupIdempotencyKeys deletes expired keys every interval until ctx is cancelled
+func cleanupIdempotencyKeys(ctx context.Context, db *sql.DB, logger *slog.Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		res, err := db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE created_at < $1", time.Now().UTC().Add(-idempotencyKeyTTL))
+		if err != nil {
+			logger.Error("cleaning up idempotency keys", "error", err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			logger.Info("cleaned up expired idempotency keys", "count", n)
+		}
+	}
+}
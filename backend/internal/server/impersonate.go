@@ -0,0 +1,75 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"api/internal/model"
+)
+
+//impersonation tokens are deliberately short lived and come without a refresh token, support has to ask for a new one
+const impersonationTokenTTL = 10 * time.Minute
+
+//actorClaim is the rfc 8693 act claim, it names the admin acting on behalf of the token's subject
+type actorClaim struct {
+	Subject string `json:"sub"`
+}
+
+//impersonate issues an access token that acts as the user in the path, for support to see the app exactly as that user does
+//the token carries the admin in its act claim and every request made with it is written to the audit log.
+//admins and deactivated users cant be impersonated, and neither can anyone by an api key
+func impersonate(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, _ := principalFromContext(r.Context())
+		if p.UserId == 0 || p.ImpersonatorId != 0 {
+			writeForbidden(w, r, "impersonation needs an admin's own access token")
+			return
+		}
+		id := userIdVar(r)
+
+		var (
+			userId int64
+			email  string
+			role   string
+			active bool
+		)
+		err := db.QueryRowContext(r.Context(), "SELECT id, email, role, active FROM users WHERE id = $1", id).Scan(&userId, &email, &role, &active)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeUserNotFound(w, r, id)
+			return
+		}
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("loading user to impersonate: %w", err))
+			return
+		}
+		switch {
+		case role == model.RoleAdmin:
+			writeForbidden(w, r, "admins cannot be impersonated")
+			return
+		case !active:
+			writeError(w, r, http.StatusForbidden, codeAccountDeactivated, "deactivated users cannot be impersonated")
+			return
+		}
+
+		token, expires, err := signAccessToken(userId, email, impersonationTokenTTL, &actorClaim{Subject: strconv.FormatInt(p.UserId, 10)})
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		err = recordAudit(r.Context(), db, auditEvent{ActorId: p.UserId, Action: auditImpersonationStarted, TargetUserId: userId,
+			Details: map[string]any{"expires_at": expires}})
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		writeResponse(w, r, http.StatusOK, tokenResponse{
+			AccessToken: token,
+			TokenType:   "Bearer",
+			ExpiresIn:   int(time.Until(expires).Seconds()),
+		})
+	}
+}
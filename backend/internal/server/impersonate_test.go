@@ -0,0 +1,68 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"api/internal/model"
+)
+
+//impersonate has the admin with token impersonate the user id and returns the impersonation token
+func (ts *testServer) impersonate(admin string, id model.ID) string {
+	ts.t.Helper()
+	res := ts.do("POST", userPath(id)+"/impersonate", admin, nil)
+	expect(ts.t, res, http.StatusOK)
+	var token tokenResponse
+	res.decode(ts.t, &token)
+	return token.AccessToken
+}
+
+func TestImpersonatedRequestsAreAudited(t *testing.T) {
+	ts := newTestServer(t, nil)
+	adminUser := ts.createUser("Admin", "admin@example.com", model.RoleAdmin)
+	m, _ := ts.member()
+	token := ts.impersonate(ts.tokenFor(adminUser), m.Id)
+
+	res := ts.do("GET", "/api/v1/me", token, nil)
+	expect(t, res, http.StatusOK)
+	var me model.User
+	res.decode(t, &me)
+	if me.Id != m.Id {
+		t.Fatalf("impersonating %d got %s", m.Id, res.body)
+	}
+	var actor, impersonated model.ID
+	var details string
+	err := ts.db.QueryRow("SELECT actor_id, impersonated_user_id, details FROM audit_events WHERE action = $1", auditImpersonatedRequest).
+		Scan(&actor, &impersonated, &details)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var request struct {
+		Method, Path string
+		Status       int
+	}
+	if err := json.Unmarshal([]byte(details), &request); err != nil {
+		t.Fatal(err)
+	}
+	if actor != adminUser.Id || impersonated != m.Id || request.Method != "GET" || request.Path != "/api/v1/me" || request.Status != http.StatusOK {
+		t.Fatalf("audited actor %d, impersonated %d, details %s", actor, impersonated, details)
+	}
+}
+
+func TestImpersonatedRequestRefusedWithoutAudit(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	m, _ := ts.member()
+	token := ts.impersonate(admin, m.Id)
+
+	//the audit log cant be written from now on
+	if _, err := ts.db.Exec("CREATE TRIGGER refuse_audit BEFORE INSERT ON audit_events BEGIN SELECT RAISE(ABORT, 'audit log unavailable'); END"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, ts.do("PUT", "/api/v1/me", token, map[string]any{"name": "Changed", "email": m.Email}), http.StatusInternalServerError)
+	got, err := ts.users.Get(t.Context(), int64(m.Id))
+	if err != nil || got.Name != m.Name || got.Version != m.Version {
+		t.Fatalf("the request that couldnt be audited changed the user to %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,712 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//modes of POST /admin/import: merge updates and adds, replace empties the tables of the dump first
+const (
+	importMerge   = "merge"
+	importReplace = "replace"
+)
+
+//defaultImportMaxBytes caps the body of an import when IMPORT_MAX_BYTES isnt set
+const defaultImportMaxBytes = 1 << 30
+
+//maxImportErrors is how many invalid records the report lists, the ones after that are only counted as skipped
+const maxImportErrors = 20
+
+//importReport is the answer of POST /admin/import
+type importReport struct {
+	XMLName xml.Name `json:"-" xml:"import"`
+	Mode    string   `json:"mode" xml:"mode,attr"`
+	//DryRun is set when the import was rolled back after the report was made, see importDump
+	DryRun bool           `json:"dry_run,omitempty" xml:"dry_run,attr,omitempty"`
+	Tables []importCounts `json:"tables" xml:"table"`
+	//Errors are the first maxImportErrors records that were skipped because they are invalid or conflict with another row
+	Errors []importError `json:"errors" xml:"error"`
+}
+
+//importCounts is what happened to the rows of one table. rows that are there already and never change,
+//audit events and memberships, count as skipped without an error
+type importCounts struct {
+	Table    string `json:"table" xml:"name,attr"`
+	Inserted int    `json:"inserted" xml:"inserted"`
+	Updated  int    `json:"updated" xml:"updated"`
+	Skipped  int    `json:"skipped" xml:"skipped"`
+}
+
+type importError struct {
+	//Record is the line of the record in the dump, the header is line 1
+	Record  int    `json:"record" xml:"record,attr"`
+	Table   string `json:"table" xml:"table,attr"`
+	Message string `json:"message" xml:",chardata"`
+}
+
+//importLine is a line of a dump after the header, a dumpRecord or the dumpTrailer
+type importLine struct {
+	Table  string          `json:"table"`
+	Row    json.RawMessage `json:"row"`
+	Counts map[string]int  `json:"counts"`
+}
+
+//outcomes of importing one row
+type importOutcome int
+
+const (
+	rowInserted importOutcome = iota
+	rowUpdated
+	rowSkipped
+)
+
+//importDump loads a dump of GET /admin/export in one transaction. the body is read record by record, never as a whole.
+//with ?mode=merge, the default, a user is matched by id and then by email, a group by id and then by name, and what
+//matched is updated while the rest is added. ?mode=replace empties the tables of the dump and loads it instead.
+//the users a merge adds or updates go into the change feed and the outbox like any other change to them.
+//invalid records are skipped and reported, a dump that is cut off or from a newer schema is refused without changing anything.
+//?dry_run=true does the whole import and reports it, then rolls it back. only the id sequences of postgres can move on,
+//they arent transactional
+func importDump(db *sql.DB, driver string, cache *userCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		dryRun := r.URL.Query().Get("dry_run") == "true"
+		mode := r.URL.Query().Get("mode")
+		if mode == "" {
+			mode = importMerge
+		}
+		if mode != importMerge && mode != importReplace {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "mode must be merge or replace")
+			return
+		}
+
+		dec := json.NewDecoder(r.Body)
+		var header dumpHeader
+		if err := dec.Decode(&header); err != nil {
+			writeImportDecodeError(w, r, 1, err)
+			return
+		}
+		if header.Format != dumpFormat {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "the body isnt a dump, it has to start with the header GET /admin/export writes")
+			return
+		}
+		//schema versions only compare between databases of one driver
+		if header.Driver != driver {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("the dump is from a %s database, it can only be imported into a %s database", header.Driver, header.Driver))
+			return
+		}
+		version, err := SchemaVersion(ctx, db)
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		if header.SchemaVersion > version {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest,
+				fmt.Sprintf("the dump is from schema version %d, this database is only at version %d. update the server before importing it", header.SchemaVersion, version))
+			return
+		}
+
+		//the import keeps one connection, the COPY of a replace runs on it beside the transaction
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("starting transaction: %w", err))
+			return
+		}
+		defer conn.Close()
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("starting transaction: %w", err))
+			return
+		}
+		defer tx.Rollback()
+		im := &dumpImporter{ctx: ctx, tx: tx, userIds: map[int64]int64{}, groupIds: map[int]int{}, mergedInto: map[int64]int64{},
+			counts: map[string]*importCounts{}, report: importReport{Mode: mode, DryRun: dryRun, Errors: []importError{}}}
+		if mode == importReplace && copyUserImports {
+			im.copy = newUserCopy(conn)
+		}
+		if mode == importReplace {
+			if err := im.clear(); err != nil {
+				internalServerError(w, r, err)
+				return
+			}
+		}
+
+		seen := map[string]int{}
+		for line := 2; ; line++ {
+			var l importLine
+			if err := dec.Decode(&l); err != nil {
+				writeImportDecodeError(w, r, line, err)
+				return
+			}
+			if l.Table == "" && l.Counts != nil {
+				if problem := checkDumpCounts(l.Counts, seen); problem != "" {
+					writeError(w, r, http.StatusBadRequest, codeInvalidRequest, problem)
+					return
+				}
+				break
+			}
+			seen[l.Table]++
+			if err := im.record(line, l); err != nil {
+				internalServerError(w, r, err)
+				return
+			}
+		}
+
+		if err := im.finish(driver); err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		if dryRun {
+			writeResponse(w, r, http.StatusOK, im.result())
+			return
+		}
+		event := auditEventFor(ctx, auditDumpImported)
+		event.Details = map[string]any{"mode": mode, "schema_version": header.SchemaVersion, "exported_at": header.ExportedAt}
+		if err := recordAudit(ctx, tx, event); err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			internalServerError(w, r, fmt.Errorf("importing dump: %w", err))
+			return
+		}
+		//a replace deleted every user before it, the ones the dump doesnt bring back mustnt be served from a cache either
+		ids := im.cleared
+		for _, id := range im.userIds {
+			ids = append(ids, id)
+		}
+		slices.Sort(ids)
+		for _, id := range slices.Compact(ids) {
+			cache.forget(ctx, id)
+		}
+		writeResponse(w, r, http.StatusOK, im.result())
+	}
+}
+
+//writeImportDecodeError answers for a line of the dump that couldnt be read: 413 when the body is too big,
+//400 when the dump ends before its trailer or the line isnt json
+func writeImportDecodeError(w http.ResponseWriter, r *http.Request, line int, err error) {
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxErr):
+		writeBodyTooLarge(w, r, maxErr.Limit)
+	case errors.Is(err, io.EOF) && line == 1:
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "request body must not be empty")
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("the dump is cut off after line %d, it has no trailer", line-1))
+	default:
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("line %d of the dump isnt valid json: %v", line, err))
+	}
+}
+
+//checkDumpCounts compares the row counts of the trailer with the records read, they differ when lines got lost
+func checkDumpCounts(want, got map[string]int) string {
+	for _, table := range dumpTables {
+		if want[table] != got[table] {
+			return fmt.Sprintf("the dump is incomplete, its trailer lists %d rows of %s but it has %d", want[table], table, got[table])
+		}
+	}
+	return ""
+}
+
+//dumpImporter writes the records of a dump in the transaction of the import
+type dumpImporter struct {
+	ctx context.Context
+	tx  *sql.Tx
+	//copy loads the users of a replace with COPY, nil when they are written row by row
+	copy *userCopy
+	//userIds and groupIds map the ids of the dump to the ids in the database, which differ for a user matched by email
+	//or a group matched by name
+	userIds  map[int64]int64
+	groupIds map[int]int
+	//mergedInto is applied once every user is in, a user may have been merged into one that comes later in the dump
+	mergedInto map[int64]int64
+	//cleared are the ids of the users a replace deleted
+	cleared []int64
+	counts  map[string]*importCounts
+	report  importReport
+}
+
+//clear empties the tables of the dump for a replace, deleting the users takes their sessions and tokens along.
+//the ids of the users go into cleared, they are dropped from the caches once the import is committed.
+//the change feed is emptied too, what it had doesnt lead to the imported users: its clients get 410 and sync everything again
+func (im *dumpImporter) clear() error {
+	rows, err := im.tx.QueryContext(im.ctx, "SELECT id FROM users")
+	if err != nil {
+		return fmt.Errorf("listing the users to delete: %w", err)
+	}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("listing the users to delete: %w", err)
+		}
+		im.cleared = append(im.cleared, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("listing the users to delete: %w", err)
+	}
+	for _, table := range []string{"group_members", `"groups"`, "addresses", "audit_events", "user_changes", "users"} {
+		if _, err := im.tx.ExecContext(im.ctx, "DELETE FROM "+table); err != nil {
+			return fmt.Errorf("emptying %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+//record imports the record on line of the dump and counts what happened to it. a user that goes into the COPY is
+//counted when its batch is written, and every other record writes the pending batch first, it may belong to one of its users
+func (im *dumpImporter) record(line int, l importLine) error {
+	if l.Table == "users" && im.copy != nil {
+		return im.queueUser(line, l.Row)
+	}
+	if err := im.flushUsers(); err != nil {
+		return err
+	}
+	var (
+		outcome importOutcome
+		problem string
+		err     error
+	)
+	switch l.Table {
+	case "users":
+		outcome, problem, err = im.user(l.Row)
+	case "addresses":
+		outcome, problem, err = im.address(l.Row)
+	case "groups":
+		outcome, problem, err = im.group(l.Row)
+	case "group_members":
+		outcome, problem, err = im.groupMember(l.Row)
+	case "audit_events":
+		outcome, problem, err = im.auditEvent(l.Row)
+	default:
+		outcome, problem = rowSkipped, fmt.Sprintf("unknown table %q", l.Table)
+	}
+	if err != nil {
+		return fmt.Errorf("importing line %d: %w", line, err)
+	}
+	im.count(line, l.Table, outcome, problem)
+	return nil
+}
+
+//count adds what happened to the record on line to the report
+func (im *dumpImporter) count(line int, table string, outcome importOutcome, problem string) {
+	c, ok := im.counts[table]
+	if !ok {
+		c = &importCounts{Table: table}
+		im.counts[table] = c
+	}
+	switch outcome {
+	case rowInserted:
+		c.Inserted++
+	case rowUpdated:
+		c.Updated++
+	default:
+		c.Skipped++
+	}
+	if problem != "" && len(im.report.Errors) < maxImportErrors {
+		im.report.Errors = append(im.report.Errors, importError{Record: line, Table: table, Message: problem})
+	}
+}
+
+//checkUser reads a users row and checks it like a user sent to the api, problem is why the row is skipped
+func (im *dumpImporter) checkUser(row json.RawMessage) (d dumpUser, u model.User, parsedUuid uuid.UUID, problem string) {
+	if err := json.Unmarshal(row, &d); err != nil {
+		return d, u, parsedUuid, "invalid row: " + err.Error()
+	}
+	parsedUuid, err := uuid.Parse(d.Uuid)
+	if d.Id < 1 || err != nil {
+		return d, u, parsedUuid, "id and uuid are required"
+	}
+	//dumps from before public ids have none, the user gets one for when it was created like the migration gave them
+	if d.PublicId == "" {
+		created := d.UpdatedAt
+		if d.CreatedAt != nil {
+			created = *d.CreatedAt
+		}
+		d.PublicId = model.NewPublicId(created)
+	} else if publicId, ok := model.ParsePublicId(d.PublicId); ok {
+		d.PublicId = publicId
+	} else {
+		return d, u, parsedUuid, "invalid public_id"
+	}
+	if _, dup := im.userIds[int64(d.Id)]; dup {
+		return d, u, parsedUuid, fmt.Sprintf("user %d is in the dump twice", d.Id)
+	}
+	//dumps from before locales and time zones have neither, the user gets the defaults
+	u = model.User{Name: d.Name, Email: d.Email, Phone: d.Phone, Timezone: d.Timezone, Role: d.Role}
+	if d.Username != nil {
+		u.Username = *d.Username
+	}
+	if d.Locale != nil {
+		u.Locale = *d.Locale
+	}
+	if errs := u.Validate(); errs != nil {
+		return d, u, parsedUuid, fieldErrorsMessage(errs)
+	}
+	return d, u, parsedUuid, ""
+}
+
+//user imports a users row. a row whose email, username, uuid or google account belongs to another user than the one
+//it matched is skipped
+func (im *dumpImporter) user(row json.RawMessage) (importOutcome, string, error) {
+	d, u, parsedUuid, problem := im.checkUser(row)
+	if problem != "" {
+		return rowSkipped, problem, nil
+	}
+	googleSubject := nullableString(d.GoogleSubject)
+
+	//every user the row could collide with: the one with its id, with its email, and the ones with its unique values
+	rows, err := im.tx.QueryContext(im.ctx, `SELECT id, lower(email), uuid, public_id, COALESCE(lower(username), ''), COALESCE(google_subject, '') FROM users
+		WHERE id = $1 OR lower(email) = $2 OR uuid = $3 OR lower(username) = $4 OR google_subject = $5 OR public_id = $6`,
+		d.Id, u.Email, parsedUuid.String(), nullableString(&u.Username), googleSubject, d.PublicId)
+	if err != nil {
+		return rowSkipped, "", fmt.Errorf("looking up user: %w", err)
+	}
+	type existingUser struct {
+		id                                      int64
+		email, uuid, publicId, username, google string
+	}
+	var found []existingUser
+	for rows.Next() {
+		var e existingUser
+		if err := rows.Scan(&e.id, &e.email, &e.uuid, &e.publicId, &e.username, &e.google); err != nil {
+			rows.Close()
+			return rowSkipped, "", fmt.Errorf("looking up user: %w", err)
+		}
+		found = append(found, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return rowSkipped, "", fmt.Errorf("looking up user: %w", err)
+	}
+	var target int64
+	for _, e := range found {
+		if e.id == int64(d.Id) {
+			target = e.id
+		}
+	}
+	for _, e := range found {
+		if target == 0 && e.email == u.Email {
+			target = e.id
+		}
+	}
+	for _, e := range found {
+		switch {
+		case e.id == target:
+		case e.email == u.Email:
+			return rowSkipped, fmt.Sprintf("email %s belongs to user %d", u.Email, e.id), nil
+		case u.Username != "" && e.username == u.Username:
+			return rowSkipped, fmt.Sprintf("username %s belongs to user %d", u.Username, e.id), nil
+		case googleSubject.Valid && e.google == googleSubject.String:
+			return rowSkipped, fmt.Sprintf("the google account belongs to user %d", e.id), nil
+		case target == 0 && strings.EqualFold(e.uuid, parsedUuid.String()):
+			return rowSkipped, fmt.Sprintf("uuid %s belongs to user %d", parsedUuid, e.id), nil
+		case target == 0 && e.publicId == d.PublicId:
+			return rowSkipped, fmt.Sprintf("public id %s belongs to user %d", d.PublicId, e.id), nil
+		}
+	}
+
+	outcome := rowInserted
+	if target == 0 {
+		target = int64(d.Id)
+		_, err = im.tx.ExecContext(im.ctx, `INSERT INTO users (id, uuid, name, email, username, phone, role, active, password_hash, google_subject,
+			email_verified_at, avatar_key, version, created_at, updated_at, public_id, locale, timezone)
+			VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, ''), $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)`,
+			d.Id, parsedUuid.String(), u.Name, u.Email, u.Username, phoneOf(u), u.Role, d.Active, nullableString(d.PasswordHash), googleSubject,
+			d.EmailVerifiedAt, nullableString(d.AvatarKey), max(d.Version, 1), d.CreatedAt, d.UpdatedAt.UTC(), d.PublicId, nullableString(&u.Locale), timezoneOf(u))
+	} else {
+		//the version goes up rather than back to the one of the dump, so etags of the current row dont match the restored one
+		outcome = rowUpdated
+		_, err = im.tx.ExecContext(im.ctx, `UPDATE users SET name = $2, email = $3, username = NULLIF($4, ''), phone = NULLIF($5, ''), role = $6, active = $7,
+			password_hash = $8, google_subject = $9, email_verified_at = $10, avatar_key = $11, merged_into_id = NULL, version = version + 1,
+			created_at = COALESCE($12, created_at), updated_at = $13, locale = $14, timezone = $15 WHERE id = $1`,
+			target, u.Name, u.Email, u.Username, phoneOf(u), u.Role, d.Active, nullableString(d.PasswordHash), googleSubject,
+			d.EmailVerifiedAt, nullableString(d.AvatarKey), d.CreatedAt, d.UpdatedAt.UTC(), nullableString(&u.Locale), timezoneOf(u))
+	}
+	if err != nil {
+		return rowSkipped, "", fmt.Errorf("writing user %d: %w", d.Id, err)
+	}
+	//a merge changes users the change feed and the broker already know, a replace empties the feed instead, see clear
+	if im.report.Mode == importMerge {
+		var written model.User
+		if err := store.ScanUser(im.tx.QueryRowContext(im.ctx, "SELECT "+store.UserColumns+" FROM users WHERE id = $1", target), &written); err != nil {
+			return rowSkipped, "", fmt.Errorf("loading user %d: %w", d.Id, err)
+		}
+		eventType := outboxUserCreated
+		if outcome == rowUpdated {
+			eventType = outboxUserUpdated
+		}
+		if err := enqueueOutbox(im.ctx, im.tx, eventType, written); err != nil {
+			return rowSkipped, "", err
+		}
+	}
+	im.userIds[int64(d.Id)] = target
+	if d.MergedIntoId != nil {
+		im.mergedInto[target] = int64(*d.MergedIntoId)
+	}
+	return outcome, "", nil
+}
+
+//address imports an addresses row, matched by id. the user has to be part of the import
+func (im *dumpImporter) address(row json.RawMessage) (importOutcome, string, error) {
+	var a model.Address
+	if err := json.Unmarshal(row, &a); err != nil {
+		return rowSkipped, "invalid row: " + err.Error(), nil
+	}
+	if a.Id < 1 {
+		return rowSkipped, "id is required", nil
+	}
+	userId, ok := im.userIds[int64(a.UserId)]
+	if !ok {
+		return rowSkipped, fmt.Sprintf("user %d isnt part of the import", a.UserId), nil
+	}
+	if errs := a.Validate(); errs != nil {
+		return rowSkipped, fieldErrorsMessage(errs), nil
+	}
+	res, err := im.tx.ExecContext(im.ctx, `UPDATE addresses SET user_id = $2, label = $3, line1 = $4, line2 = $5, city = $6, postal_code = $7, country = $8
+		WHERE id = $1`, a.Id, userId, a.Label, a.Line1, a.Line2, a.City, a.PostalCode, a.Country)
+	if err != nil {
+		return rowSkipped, "", fmt.Errorf("writing address %d: %w", a.Id, err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return rowUpdated, "", err
+	}
+	_, err = im.tx.ExecContext(im.ctx, `INSERT INTO addresses (id, user_id, label, line1, line2, city, postal_code, country) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		a.Id, userId, a.Label, a.Line1, a.Line2, a.City, a.PostalCode, a.Country)
+	if err != nil {
+		return rowSkipped, "", fmt.Errorf("writing address %d: %w", a.Id, err)
+	}
+	return rowInserted, "", nil
+}
+
+//group imports a groups row, matched by id and then by name
+func (im *dumpImporter) group(row json.RawMessage) (importOutcome, string, error) {
+	var g model.Group
+	if err := json.Unmarshal(row, &g); err != nil {
+		return rowSkipped, "invalid row: " + err.Error(), nil
+	}
+	if g.Id < 1 {
+		return rowSkipped, "id is required", nil
+	}
+	if errs := g.Validate(); errs != nil {
+		return rowSkipped, fieldErrorsMessage(errs), nil
+	}
+	rows, err := im.tx.QueryContext(im.ctx, `SELECT id, lower(name) = lower($2) FROM "groups" WHERE id = $1 OR lower(name) = lower($2)`, g.Id, g.Name)
+	if err != nil {
+		return rowSkipped, "", fmt.Errorf("looking up group: %w", err)
+	}
+	target, byName, nameTakenBy := 0, 0, 0
+	for rows.Next() {
+		var id int
+		var sameName bool
+		if err := rows.Scan(&id, &sameName); err != nil {
+			rows.Close()
+			return rowSkipped, "", fmt.Errorf("looking up group: %w", err)
+		}
+		switch {
+		case id == int(g.Id):
+			target = id
+		case sameName:
+			byName = id
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return rowSkipped, "", fmt.Errorf("looking up group: %w", err)
+	}
+	if target == 0 {
+		target = byName
+	} else {
+		nameTakenBy = byName
+	}
+	if nameTakenBy != 0 {
+		return rowSkipped, fmt.Sprintf("name %s belongs to group %d", g.Name, nameTakenBy), nil
+	}
+
+	outcome := rowUpdated
+	if target == 0 {
+		outcome, target = rowInserted, int(g.Id)
+		_, err = im.tx.ExecContext(im.ctx, `INSERT INTO "groups" (id, name, description, created_at) VALUES ($1, $2, $3, $4)`, g.Id, g.Name, g.Description, g.CreatedAt.UTC())
+	} else {
+		_, err = im.tx.ExecContext(im.ctx, `UPDATE "groups" SET name = $2, description = $3, created_at = $4 WHERE id = $1`, target, g.Name, g.Description, g.CreatedAt.UTC())
+	}
+	if err != nil {
+		return rowSkipped, "", fmt.Errorf("writing group %d: %w", g.Id, err)
+	}
+	im.groupIds[int(g.Id)] = target
+	return outcome, "", nil
+}
+
+//groupMember imports a membership, one that exists already is skipped
+func (im *dumpImporter) groupMember(row json.RawMessage) (importOutcome, string, error) {
+	var m dumpGroupMember
+	if err := json.Unmarshal(row, &m); err != nil {
+		return rowSkipped, "invalid row: " + err.Error(), nil
+	}
+	groupId, ok := im.groupIds[int(m.GroupId)]
+	if !ok {
+		return rowSkipped, fmt.Sprintf("group %d isnt part of the import", m.GroupId), nil
+	}
+	userId, ok := im.userIds[int64(m.UserId)]
+	if !ok {
+		return rowSkipped, fmt.Sprintf("user %d isnt part of the import", m.UserId), nil
+	}
+	var exists bool
+	if err := im.tx.QueryRowContext(im.ctx, "SELECT EXISTS (SELECT 1 FROM group_members WHERE group_id = $1 AND user_id = $2)", groupId, userId).Scan(&exists); err != nil {
+		return rowSkipped, "", fmt.Errorf("looking up membership: %w", err)
+	}
+	if exists {
+		return rowSkipped, "", nil
+	}
+	if _, err := im.tx.ExecContext(im.ctx, "INSERT INTO group_members (group_id, user_id, added_at) VALUES ($1, $2, $3)", groupId, userId, m.AddedAt.UTC()); err != nil {
+		return rowSkipped, "", fmt.Errorf("writing membership: %w", err)
+	}
+	return rowInserted, "", nil
+}
+
+//auditEvent imports an audit event, matched by id. events never change, one that exists already is skipped.
+//the users it mentions are mapped like the rows of the users, ids of users that arent part of the import stay as they are
+func (im *dumpImporter) auditEvent(row json.RawMessage) (importOutcome, string, error) {
+	var e dumpAuditEvent
+	if err := json.Unmarshal(row, &e); err != nil {
+		return rowSkipped, "invalid row: " + err.Error(), nil
+	}
+	if e.Id < 1 || e.Action == "" {
+		return rowSkipped, "id and action are required", nil
+	}
+	var exists bool
+	if err := im.tx.QueryRowContext(im.ctx, "SELECT EXISTS (SELECT 1 FROM audit_events WHERE id = $1)", e.Id).Scan(&exists); err != nil {
+		return rowSkipped, "", fmt.Errorf("looking up audit event: %w", err)
+	}
+	if exists {
+		return rowSkipped, "", nil
+	}
+	_, err := im.tx.ExecContext(im.ctx, `INSERT INTO audit_events (id, created_at, actor_id, actor_api_key_id, impersonated_user_id, action, target_user_id, diff, details, ip)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`, e.Id, e.CreatedAt.UTC(), im.mapUserId(e.ActorId), optionalIdValue(e.ActorApiKeyId), im.mapUserId(e.ImpersonatedUserId),
+		e.Action, im.mapUserId(e.TargetUserId), nullableRawJSON(e.Diff), nullableRawJSON(e.Details), nullableString(&e.IP))
+	if err != nil {
+		return rowSkipped, "", fmt.Errorf("writing audit event %d: %w", e.Id, err)
+	}
+	return rowInserted, "", nil
+}
+
+//finish links the merged users to the users they were merged into and, on postgres, moves the id sequences past the
+//imported ids. mysql and sqlite do that on their own when a row is inserted with an id
+func (im *dumpImporter) finish(driver string) error {
+	if err := im.flushUsers(); err != nil {
+		return err
+	}
+	for id, into := range im.mergedInto {
+		target, ok := im.userIds[into]
+		if !ok {
+			continue
+		}
+		if _, err := im.tx.ExecContext(im.ctx, "UPDATE users SET merged_into_id = $2 WHERE id = $1", id, target); err != nil {
+			return fmt.Errorf("linking merged user %d: %w", id, err)
+		}
+	}
+	//a dry run is rolled back, the sequences wouldnt be
+	if driver != dbDriverPostgres || im.report.DryRun {
+		return nil
+	}
+	for _, table := range []string{"users", "addresses", "groups", "audit_events"} {
+		_, err := im.tx.ExecContext(im.ctx, fmt.Sprintf(`SELECT setval(pg_get_serial_sequence('%[1]s', 'id'), (SELECT COALESCE(max(id), 0) + 1 FROM %[1]s), false)`, table))
+		if err != nil {
+			return fmt.Errorf("moving the id sequence of %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+//result is the report with the tables in the order of the dump
+func (im *dumpImporter) result() importReport {
+	report := im.report
+	report.Tables = []importCounts{}
+	for _, table := range dumpTables {
+		if c, ok := im.counts[table]; ok {
+			report.Tables = append(report.Tables, *c)
+		} else {
+			report.Tables = append(report.Tables, importCounts{Table: table})
+		}
+	}
+	return report
+}
+
+//mapUserId maps a user id of the dump to the id in the database, sql null for none
+func (im *dumpImporter) mapUserId(id *model.ID) sql.NullInt64 {
+	if id == nil {
+		return sql.NullInt64{}
+	}
+	if mapped, ok := im.userIds[int64(*id)]; ok {
+		return nullableId(mapped)
+	}
+	return nullableId(*id)
+}
+
+//fieldErrorsMessage joins the messages of a failed validation into one, like "email must be a valid address"
+func fieldErrorsMessage(errs model.FieldErrors) string {
+	names := make([]string, 0, len(errs))
+	for name := range errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	messages := make([]string, len(names))
+	for i, name := range names {
+		messages[i] = name + " " + errs[name]
+	}
+	return strings.Join(messages, ", ")
+}
+
+//nullableString maps nil and "" to sql null
+func nullableString(s *string) sql.NullString {
+	if s == nil || *s == "" {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: *s, Valid: true}
+}
+
+//nullableRawJSON maps a missing or null json value to sql null, for the jsonb columns
+func nullableRawJSON(raw json.RawMessage) sql.NullString {
+	if len(raw) == 0 || string(raw) == "null" {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: string(raw), Valid: true}
+}
+
+//optionalIdValue is the sql value of an optional id, the reverse of optionalId
+func optionalIdValue[T ~int | ~int64](id *T) sql.NullInt64 {
+	if id == nil {
+		return sql.NullInt64{}
+	}
+	return nullableId(*id)
+}
+
+//timezoneOf is the time zone of a validated user, the default when it has none
+func timezoneOf(u model.User) string {
+	return cmp.Or(u.Timezone, model.DefaultTimezone)
+}
+
+//phoneOf is the phone of a validated user, "" without one
+func phoneOf(u model.User) string {
+	if u.Phone == nil {
+		return ""
+	}
+	return *u.Phone
+}
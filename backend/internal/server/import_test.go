@@ -0,0 +1,121 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"testing"
+
+	"api/internal/model"
+)
+
+func TestImportDryRun(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	ada := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+	ts.createUser("Grace", "grace@example.com", model.RoleMember)
+	expect(t, ts.do("POST", "/api/v1/groups", admin, map[string]any{"name": "engineering"}), http.StatusCreated)
+	res := ts.do("GET", "/api/v1/admin/export", admin, nil)
+	expect(t, res, http.StatusOK)
+	dump := string(res.body)
+
+	//what the dump would bring back or change
+	expect(t, ts.do("DELETE", userPath(ada.Id), admin, nil), http.StatusNoContent)
+	ts.createUser("Katherine", "katherine@example.com", model.RoleMember)
+	tables := []string{"users", "groups", "group_members", "audit_events", "user_changes", "outbox", "jobs"}
+	before := ts.rowCounts(tables...)
+
+	for _, mode := range []string{importMerge, importReplace} {
+		res := ts.do("POST", "/api/v1/admin/import?dry_run=true&mode="+mode, admin, dump)
+		expect(t, res, http.StatusOK)
+		var report importReport
+		res.decode(t, &report)
+		if !report.DryRun || report.Mode != mode {
+			t.Fatalf("%s dry run answered %s", mode, res.body)
+		}
+		inserted := 0
+		for _, c := range report.Tables {
+			if c.Table == "users" {
+				inserted = c.Inserted
+			}
+		}
+		if inserted == 0 {
+			t.Fatalf("%s dry run reported no user it would add: %s", mode, res.body)
+		}
+		if after := ts.rowCounts(tables...); !maps.Equal(after, before) {
+			t.Fatalf("%s: rows before the dry run %v, after %v", mode, before, after)
+		}
+	}
+	if n := ts.count("users", "email = $1", ada.Email); n != 0 {
+		t.Fatal("the dry run brought back the deleted user")
+	}
+	if n := ts.count("users", "email = $1", "katherine@example.com"); n != 1 {
+		t.Fatal("the dry run of the replace removed a user")
+	}
+
+	//without the dry run the same import goes through
+	expect(t, ts.do("POST", "/api/v1/admin/import", admin, dump), http.StatusOK)
+	if n := ts.count("users", "email = $1", ada.Email); n != 1 {
+		t.Fatal("the import didnt bring back the deleted user")
+	}
+}
+
+func TestImportMergeChanges(t *testing.T) {
+	ts := newTestServer(t, nil)
+	//the relay turns it on, the server of the tests has none
+	outboxEnabled = true
+	t.Cleanup(func() { outboxEnabled = false })
+	admin := ts.admin()
+	ada := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+	grace := ts.createUser("Grace", "grace@example.com", model.RoleMember)
+	res := ts.do("GET", "/api/v1/admin/export", admin, nil)
+	expect(t, res, http.StatusOK)
+	dump := string(res.body)
+
+	//the merge renames ada back and brings grace back
+	expect(t, ts.do("PUT", userPath(ada.Id), admin, map[string]any{"name": "Ada Lovelace", "email": ada.Email}), http.StatusOK)
+	expect(t, ts.do("DELETE", userPath(grace.Id), admin, nil), http.StatusNoContent)
+	var cursor userChangePage
+	ts.do("GET", "/api/v1/users/changes?since=latest", admin, nil).decode(t, &cursor)
+	outbox := ts.count("outbox", "")
+
+	expect(t, ts.do("POST", "/api/v1/admin/import", admin, dump), http.StatusOK)
+	res = ts.do("GET", fmt.Sprintf("/api/v1/users/changes?since=%d", cursor.NextCursor), admin, nil)
+	expect(t, res, http.StatusOK)
+	var page userChangePage
+	res.decode(t, &page)
+	changes := map[model.ID]userChange{}
+	for _, c := range page.Changes {
+		changes[c.UserId] = c
+	}
+	var state model.User
+	json.Unmarshal(changes[ada.Id].User, &state)
+	if changes[ada.Id].Operation != eventUserUpdated || state.Name != "Ada" {
+		t.Fatalf("the change of ada is %s %s", changes[ada.Id].Operation, changes[ada.Id].User)
+	}
+	json.Unmarshal(changes[grace.Id].User, &state)
+	if changes[grace.Id].Operation != eventUserCreated || state.Email != grace.Email {
+		t.Fatalf("the change of grace is %s %s", changes[grace.Id].Operation, changes[grace.Id].User)
+	}
+	if n := ts.count("outbox", "type = $1", outboxUserUpdated); n < 1 || ts.count("outbox", "") != outbox+len(page.Changes) {
+		t.Fatalf("the import queued %d of %d events", ts.count("outbox", "")-outbox, len(page.Changes))
+	}
+}
+
+func TestImportReplaceForgetsDeletedUsers(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	ts.createUser("Ada", "ada@example.com", model.RoleMember)
+	res := ts.do("GET", "/api/v1/admin/export", admin, nil)
+	expect(t, res, http.StatusOK)
+	dump := string(res.body)
+
+	//linus is cached and isnt in the dump
+	linus := ts.createUser("Linus", "linus@example.com", model.RoleMember)
+	expect(t, ts.do("GET", userPath(linus.Id), admin, nil), http.StatusOK)
+	expect(t, ts.do("POST", "/api/v1/admin/import?mode=replace", admin, dump), http.StatusOK)
+	if res := ts.do("GET", userPath(linus.Id), admin, nil); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("a user the replace deleted answered %d: %s", res.StatusCode, res.body)
+	}
+}
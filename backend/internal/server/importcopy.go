@@ -0,0 +1,159 @@
+package server
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+//userCopyBatch is how many users of a replace go into one COPY. the batch is all the import keeps in memory of them,
+//the body is still read one record at a time
+const userCopyBatch = 5000
+
+//copyUserImports is whether the users of a replace on postgres go in with COPY, BenchmarkImportReplace turns it off
+//to compare with the row by row path
+var copyUserImports = true
+
+//userCopyColumns are the columns the users of a dump are copied into, line is the line of the record in the dump
+var userCopyColumns = []string{"line", "id", "uuid", "name", "email", "username", "phone", "role", "active", "password_hash",
+	"google_subject", "email_verified_at", "avatar_key", "version", "created_at", "updated_at", "public_id", "locale", "timezone"}
+
+//userCopy loads the users of a replace with COPY, which is much faster than one INSERT per user for big dumps.
+//COPY gives up on the first row that breaks a constraint, so the batches go into a temporary table first and from
+//there into users with ON CONFLICT DO NOTHING. a replace empties users first, so what a row can collide with is an
+//earlier user of the dump. the rows that collided go through the row by row path after their batch, which matches
+//them by email or reports them with their line, the same as an import without COPY
+type userCopy struct {
+	conn    *sql.Conn
+	pending []queuedUser
+	//created is set once the temporary table is there, it is dropped with the transaction
+	created bool
+}
+
+//queuedUser is a checked users row waiting for the COPY of its batch
+type queuedUser struct {
+	line   int
+	id     int64
+	row    json.RawMessage
+	values []any
+}
+
+//newUserCopy returns the COPY for the users of an import on conn, nil when conn isnt a pgx connection.
+//mysql and sqlite have no COPY, their imports write row by row
+func newUserCopy(conn *sql.Conn) *userCopy {
+	ok := false
+	conn.Raw(func(dc any) error {
+		_, ok = pgxConnOf(dc)
+		return nil
+	})
+	if !ok {
+		return nil
+	}
+	return &userCopy{conn: conn}
+}
+
+//pgxConnOf is the pgx connection under the database/sql one, through the hooks of wrapConnector
+func pgxConnOf(dc any) (*pgx.Conn, bool) {
+	for {
+		switch c := dc.(type) {
+		case *stdlib.Conn:
+			return c.Conn(), true
+		case interface{ Unwrap() driver.Conn }:
+			dc = c.Unwrap()
+		default:
+			return nil, false
+		}
+	}
+}
+
+//queueUser checks a users row and adds it to the batch of the COPY, writing the batch when it is full.
+//a row that fails the checks is counted as skipped right away. a queued user counts as imported from here on,
+//until its batch shows it collided
+func (im *dumpImporter) queueUser(line int, row json.RawMessage) error {
+	d, u, parsedUuid, problem := im.checkUser(row)
+	if problem != "" {
+		im.count(line, "users", rowSkipped, problem)
+		return nil
+	}
+	im.copy.pending = append(im.copy.pending, queuedUser{line: line, id: int64(d.Id), row: row,
+		values: []any{line, d.Id, [16]byte(parsedUuid), u.Name, u.Email, nullableString(&u.Username), nullableString(u.Phone), u.Role, d.Active,
+			nullableString(d.PasswordHash), nullableString(d.GoogleSubject), d.EmailVerifiedAt, nullableString(d.AvatarKey), max(d.Version, 1), d.CreatedAt, d.UpdatedAt.UTC(), d.PublicId,
+			nullableString(&u.Locale), timezoneOf(u)}})
+	im.userIds[int64(d.Id)] = int64(d.Id)
+	if d.MergedIntoId != nil {
+		im.mergedInto[int64(d.Id)] = int64(*d.MergedIntoId)
+	}
+	if len(im.copy.pending) < userCopyBatch {
+		return nil
+	}
+	return im.flushUsers()
+}
+
+//flushUsers writes the pending batch of the COPY and counts its users, it does nothing without one
+func (im *dumpImporter) flushUsers() error {
+	if im.copy == nil || len(im.copy.pending) == 0 {
+		return nil
+	}
+	pending := im.copy.pending
+	im.copy.pending = nil
+	if !im.copy.created {
+		if _, err := im.tx.ExecContext(im.ctx, "CREATE TEMPORARY TABLE import_users (line INTEGER, LIKE users INCLUDING DEFAULTS) ON COMMIT DROP"); err != nil {
+			return fmt.Errorf("creating the table to copy users into: %w", err)
+		}
+		im.copy.created = true
+	}
+
+	err := im.copy.conn.Raw(func(dc any) error {
+		conn, _ := pgxConnOf(dc)
+		_, err := conn.CopyFrom(im.ctx, pgx.Identifier{"import_users"}, userCopyColumns, pgx.CopyFromSlice(len(pending), func(i int) ([]any, error) {
+			return pending[i].values, nil
+		}))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("copying users of lines %d to %d: %w", pending[0].line, pending[len(pending)-1].line, err)
+	}
+
+	//in the order of the dump, so of two users that collide the first one is kept like on the row by row path
+	columns := strings.Join(userCopyColumns[1:], ", ")
+	rows, err := im.tx.QueryContext(im.ctx, "INSERT INTO users ("+columns+") SELECT "+columns+" FROM import_users ORDER BY line ON CONFLICT DO NOTHING RETURNING id")
+	if err != nil {
+		return fmt.Errorf("inserting copied users: %w", err)
+	}
+	inserted := map[int64]bool{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("inserting copied users: %w", err)
+		}
+		inserted[id] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("inserting copied users: %w", err)
+	}
+	if _, err := im.tx.ExecContext(im.ctx, "TRUNCATE import_users"); err != nil {
+		return fmt.Errorf("emptying the table to copy users into: %w", err)
+	}
+
+	for _, q := range pending {
+		if inserted[q.id] {
+			im.count(q.line, "users", rowInserted, "")
+			continue
+		}
+		delete(im.userIds, q.id)
+		delete(im.mergedInto, q.id)
+		outcome, problem, err := im.user(q.row)
+		if err != nil {
+			return fmt.Errorf("importing line %d: %w", q.line, err)
+		}
+		im.count(q.line, "users", outcome, problem)
+	}
+	return nil
+}
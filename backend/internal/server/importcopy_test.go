@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"api/internal/model"
+	"api/internal/testdb"
+)
+
+//writeUserDump writes a dump of users alone, from a database of driver at schema version
+func writeUserDump(w io.Writer, driver string, version int, users []dumpUser) error {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(dumpHeader{Format: dumpFormat, SchemaVersion: version, Driver: driver, ExportedAt: time.Now().UTC(), Tables: dumpTables}); err != nil {
+		return err
+	}
+	for _, u := range users {
+		if err := enc.Encode(dumpRecord{Table: "users", Row: u}); err != nil {
+			return err
+		}
+	}
+	return enc.Encode(dumpTrailer{Counts: map[string]int{"users": len(users)}})
+}
+
+//dumpUserN is the users row of a generated user with id i
+func dumpUserN(i int) dumpUser {
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(i) * time.Second)
+	return dumpUser{Id: model.ID(i), Uuid: uuid.NewString(), Name: fmt.Sprintf("User %d", i), Email: fmt.Sprintf("user%d@example.com", i),
+		Timezone: "UTC", Role: model.RoleMember, Active: true, Version: 1, CreatedAt: &created, UpdatedAt: created}
+}
+
+func TestImportCopyCollisions(t *testing.T) {
+	ts := newTestServerOn(t, testdb.New(t, dbDriverPostgres), nil)
+	admin := ts.admin()
+	conn, err := ts.db.Conn(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newUserCopy(conn) == nil {
+		t.Fatal("a replace on postgres doesnt use COPY")
+	}
+	conn.Close()
+	version, err := SchemaVersion(t.Context(), ts.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := []dumpUser{dumpUserN(1), dumpUserN(2), dumpUserN(3), dumpUserN(4), dumpUserN(5)}
+	//line 4 has the email of line 2, the fallback matches it by email and updates that user.
+	//line 5 has the uuid of line 3 and nothing else to match by, it is reported
+	users[2].Name, users[2].Email = "Renamed", users[0].Email
+	users[3].Uuid = users[1].Uuid
+	var dump bytes.Buffer
+	if err := writeUserDump(&dump, ts.cfg.DBDriver, version, users); err != nil {
+		t.Fatal(err)
+	}
+
+	res := ts.do("POST", "/api/v1/admin/import?mode=replace", admin, dump.String())
+	expect(t, res, http.StatusOK)
+	var report importReport
+	res.decode(t, &report)
+	if report.Tables[0] != (importCounts{Table: "users", Inserted: 3, Updated: 1, Skipped: 1}) {
+		t.Fatalf("the users were counted as %+v", report.Tables[0])
+	}
+	want := importError{Record: 5, Table: "users", Message: fmt.Sprintf("uuid %s belongs to user 2", users[1].Uuid)}
+	if len(report.Errors) != 1 || report.Errors[0] != want {
+		t.Fatalf("the import reported %+v", report.Errors)
+	}
+	if n := ts.count("users", ""); n != 3 {
+		t.Fatalf("the import left %d users", n)
+	}
+	if n := ts.count("users", "id = 1 AND name = 'Renamed'"); n != 1 {
+		t.Fatal("the user with the email of the colliding row wasnt updated")
+	}
+}
+
+//BenchmarkImportReplace imports a dump of 100k users with COPY and row by row
+func BenchmarkImportReplace(b *testing.B) {
+	db := testdb.New(b, dbDriverPostgres)
+	b.Setenv("DB_DRIVER", db.Driver)
+	b.Setenv("DATABASE_URL", db.URL)
+	b.Setenv("JWT_SECRET", "test-secret-test-secret-test-secret")
+	cfg, err := LoadConfig()
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn, err := OpenDB(b.Context(), cfg, slog.New(slog.DiscardHandler))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	version, err := SchemaVersion(b.Context(), conn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	const n = 100_000
+	users := make([]dumpUser, n)
+	for i := range users {
+		users[i] = dumpUserN(i + 1)
+	}
+	var dump bytes.Buffer
+	if err := writeUserDump(&dump, cfg.DBDriver, version, users); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		copy bool
+	}{{"copy", true}, {"row by row", false}} {
+		b.Run(tc.name, func(b *testing.B) {
+			defer func(copy bool) { copyUserImports = copy }(copyUserImports)
+			copyUserImports = tc.copy
+			b.SetBytes(int64(dump.Len()))
+			for b.Loop() {
+				r := httptest.NewRequest("POST", "/api/v1/admin/import?mode=replace", bytes.NewReader(dump.Bytes()))
+				r = r.WithContext(context.WithValue(r.Context(), principalKey, principal{UserId: 1, Role: model.RoleAdmin}))
+				w := httptest.NewRecorder()
+				importDump(conn, cfg.DBDriver, nil)(w, r)
+				var report importReport
+				if err := json.Unmarshal(w.Body.Bytes(), &report); w.Code != http.StatusOK || err != nil || report.Tables[0].Inserted != n {
+					b.Fatalf("the import answered %d: %.500s", w.Code, w.Body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,385 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"api/internal/model"
+)
+
+//job types, New registers a handler for each
+const (
+	//jobTypeEmail sends the emailMessage in the payload
+	jobTypeEmail = "email"
+)
+
+//the states of a job in the jobs table. a job that succeeded is deleted, it has none
+const (
+	jobPending = "pending"
+	jobRunning = "running"
+	jobFailed  = "failed"
+)
+
+const (
+	//defaultJobWorkers, defaultJobMaxAttempts and defaultJobRetryDelay are JOB_WORKERS, JOB_MAX_ATTEMPTS and
+	//JOB_RETRY_DELAY when they arent set
+	defaultJobWorkers     = 2
+	defaultJobMaxAttempts = 5
+	defaultJobRetryDelay  = 10 * time.Second
+	//jobMaxRetryDelay caps the backoff between two attempts of a job
+	jobMaxRetryDelay = time.Hour
+	//jobPollInterval is how often an idle worker looks for jobs that came due
+	jobPollInterval = time.Second
+	//jobTimeout bounds one attempt of a job, jobLease is how long a claimed job is left to its worker before another
+	//one may claim it again. the lease is well past the timeout, only the jobs of a worker that died are claimed twice
+	jobTimeout = time.Minute
+	jobLease   = 5 * time.Minute
+	//maxJobErrorLength caps the last_error kept of a failed attempt, in bytes
+	maxJobErrorLength = 1000
+)
+
+//auditJobRetried is a failed job being queued again through POST /admin/jobs/{id}/retry
+const auditJobRetried = "job.retried"
+
+//jobsProcessed counts the attempts of the jobs by their result: succeeded, retried when another attempt is scheduled
+//and failed when it was the last one
+var jobsProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "jobs_processed_total",
+	Help: "Attempts of background jobs, by job type and result.",
+}, []string{"type", "result"})
+
+//jobConfig is how many workers run the jobs of this instance and how often a job is tried
+type jobConfig struct {
+	//workers is JOB_WORKERS, 0 runs no jobs on this instance, they wait for one that does
+	workers     int
+	maxAttempts int
+	//retryDelay is the wait before the second attempt, it doubles with every attempt after that up to jobMaxRetryDelay
+	retryDelay time.Duration
+}
+
+//jobHandler runs one attempt of a job with its payload. an error schedules another attempt, or fails the job after the last
+type jobHandler func(ctx context.Context, payload []byte) error
+
+//jobQueue runs the side effects of the service that dont happen within the request, like the welcome emails, from the
+//jobs table. a job is stored before it runs, so what is queued survives a deploy or a crash, and it is only deleted
+//once its handler succeeded: every job runs at least once, a handler has to cope with running twice.
+//the workers of all instances claim the jobs that are due with SELECT ... FOR UPDATE SKIP LOCKED, so a job is run by one
+//worker at a time, and a job whose every attempt failed is kept as failed for GET /admin/jobs until an admin retries it
+type jobQueue struct {
+	db *sql.DB
+	//lockClause skips the jobs another worker is claiming right now, sqlite has no row locks and only one writer at a time
+	lockClause string
+	cfg        jobConfig
+	handlers   map[string]jobHandler
+	logger     *slog.Logger
+	//wake tells an idle worker that a job was queued on this instance, so it doesnt wait for the next poll
+	wake chan struct{}
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+}
+
+//newJobQueue starts the workers of cfg on the jobs that have a handler in handlers
+func newJobQueue(db *sql.DB, driver string, cfg jobConfig, handlers map[string]jobHandler, logger *slog.Logger) *jobQueue {
+	q := &jobQueue{db: db, cfg: cfg, handlers: handlers, logger: logger, wake: make(chan struct{}, 1)}
+	if driver != dbDriverSQLite {
+		q.lockClause = " FOR UPDATE SKIP LOCKED"
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	q.stop = stop
+	for range cfg.workers {
+		q.wg.Go(func() { q.work(ctx) })
+	}
+	return q
+}
+
+//enqueue stores a job that runs as soon as a worker is free. pass the transaction of a change to queue the job with it,
+//so it only runs for a change that was committed, or the db for a job of its own
+func (q *jobQueue) enqueue(ctx context.Context, tx execer, jobType string, payload any) error {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("encoding %s job: %w", jobType, err)
+	}
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx, "INSERT INTO jobs (type, payload, status, run_after, created_at, updated_at) VALUES ($1, $2, $3, $4, $4, $4)",
+		jobType, string(encoded), jobPending, now); err != nil {
+		return fmt.Errorf("queueing %s job: %w", jobType, err)
+	}
+	q.notify()
+	return nil
+}
+
+//notify tells an idle worker that a job was queued. enqueue does, a job queued in a transaction is only there for the
+//workers once it is committed, notify again after the commit so they dont wait for the next poll
+func (q *jobQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+//close stops claiming jobs and waits up to timeout for the ones running to finish. a job still running after that is
+//claimed again once its lease runs out, by another instance or by this one after its restart
+func (q *jobQueue) close(timeout time.Duration) {
+	q.stop()
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		q.logger.Warn("shutdown timeout reached before the running jobs finished, they run again once their lease is over", "lease", jobLease.String())
+	}
+}
+
+//claimedJob is a job a worker claimed, attempts counts the one it is about to make
+type claimedJob struct {
+	id       int64
+	jobType  string
+	payload  []byte
+	attempts int
+}
+
+//work claims and runs one job after the other until ctx is cancelled. a job that was claimed is always run to its end
+func (q *jobQueue) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		j, ok, err := q.claim(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				q.logger.Error("claiming a job", "error", err)
+				sleepContext(ctx, jobPollInterval)
+			}
+			continue
+		}
+		if !ok {
+			timer := time.NewTimer(jobPollInterval)
+			select {
+			case <-ctx.Done():
+			case <-q.wake:
+			case <-timer.C:
+			}
+			timer.Stop()
+			continue
+		}
+		q.run(j)
+	}
+}
+
+//claim takes the job that is due the longest and marks it running until its lease is over. ok is false when no job is due.
+//the update is conditional on the job still being due, without row locks two workers can select the same one
+func (q *jobQueue) claim(ctx context.Context) (j claimedJob, ok bool, err error) {
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return j, false, err
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC()
+	//the status is spelled out for the partial index of the due jobs
+	err = tx.QueryRowContext(ctx, "SELECT id, type, payload, attempts FROM jobs WHERE status <> 'failed' AND run_after <= $1 ORDER BY run_after, id LIMIT 1"+q.lockClause,
+		now).Scan(&j.id, &j.jobType, &j.payload, &j.attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return j, false, nil
+	}
+	if err != nil {
+		return j, false, err
+	}
+	j.attempts++
+	res, err := tx.ExecContext(ctx, "UPDATE jobs SET status = $1, attempts = $2, run_after = $3, updated_at = $4 WHERE id = $5 AND status <> 'failed' AND run_after <= $4",
+		jobRunning, j.attempts, now.Add(jobLease), now, j.id)
+	if err != nil {
+		return j, false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return j, false, err
+	}
+	return j, true, tx.Commit()
+}
+
+//run makes one attempt of j and records how it went: a job that succeeded is deleted, one that failed waits for its
+//next attempt with exponential backoff, or is kept as failed after its last. the job isnt cancelled on shutdown, close
+//gives it the grace period
+func (q *jobQueue) run(j claimedJob) {
+	logger := q.logger.With("job_id", j.id, "job_type", j.jobType, "attempt", j.attempts)
+	err := errors.New("no handler for this job type")
+	if handle, ok := q.handlers[j.jobType]; ok {
+		ctx, cancel := context.WithTimeout(context.Background(), jobTimeout)
+		err = handle(ctx, j.payload)
+		cancel()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), jobTimeout)
+	defer cancel()
+	now := time.Now().UTC()
+	var result string
+	switch {
+	case err == nil:
+		result = "succeeded"
+		_, err = q.db.ExecContext(ctx, "DELETE FROM jobs WHERE id = $1", j.id)
+	case j.attempts < q.cfg.maxAttempts:
+		result = "retried"
+		delay := q.retryDelay(j.attempts)
+		logger.Warn("job failed, retrying", "retry_in", delay.String(), "error", err)
+		_, err = q.db.ExecContext(ctx, "UPDATE jobs SET status = $1, run_after = $2, last_error = $3, updated_at = $4 WHERE id = $5",
+			jobPending, now.Add(delay), jobErrorText(err), now, j.id)
+	default:
+		result = "failed"
+		logger.Error("job failed, giving up", "error", err)
+		_, err = q.db.ExecContext(ctx, "UPDATE jobs SET status = $1, run_after = $2, last_error = $3, updated_at = $2 WHERE id = $4",
+			jobFailed, now, jobErrorText(err), j.id)
+	}
+	jobsProcessed.WithLabelValues(j.jobType, result).Inc()
+	//the job runs again once its lease is over
+	if err != nil {
+		logger.Error("recording the result of a job", "result", result, "error", err)
+	}
+}
+
+//retryDelay is how long a job waits after its attempt-th attempt failed
+func (q *jobQueue) retryDelay(attempt int) time.Duration {
+	delay := q.cfg.retryDelay
+	for range attempt - 1 {
+		if delay *= 2; delay >= jobMaxRetryDelay {
+			return jobMaxRetryDelay
+		}
+	}
+	return delay
+}
+
+//jobErrorText is err as it is kept in last_error
+func jobErrorText(err error) string {
+	text := err.Error()
+	if len(text) > maxJobErrorLength {
+		text = text[:maxJobErrorLength]
+	}
+	return text
+}
+
+//sendEmailJob is the handler of jobTypeEmail
+func sendEmailJob(mail mailer) jobHandler {
+	return func(ctx context.Context, payload []byte) error {
+		var msg emailMessage
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			return fmt.Errorf("decoding email: %w", err)
+		}
+		return mail.Send(msg)
+	}
+}
+
+//jobEntry is a job in GET /admin/jobs
+type jobEntry struct {
+	Id        model.ID        `json:"id" xml:"id"`
+	Type      string          `json:"type" xml:"type"`
+	Status    string          `json:"status" xml:"status"`
+	Attempts  int             `json:"attempts" xml:"attempts"`
+	RunAfter  time.Time       `json:"run_after" xml:"run_after"`
+	LastError string          `json:"last_error,omitempty" xml:"last_error,omitempty"`
+	CreatedAt time.Time       `json:"created_at" xml:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at" xml:"updated_at"`
+	Payload   json.RawMessage `json:"payload" xml:"payload"`
+}
+
+//jobList is the body of GET /admin/jobs
+type jobList struct {
+	XMLName xml.Name   `json:"-" xml:"jobs"`
+	Jobs    []jobEntry `json:"jobs" xml:"job"`
+}
+
+//jobColumns are the columns scanJob reads
+const jobColumns = "id, type, status, attempts, run_after, COALESCE(last_error, ''), created_at, updated_at, payload"
+
+func scanJob(row interface{ Scan(...any) error }) (jobEntry, error) {
+	var j jobEntry
+	var payload []byte
+	err := row.Scan(&j.Id, &j.Type, &j.Status, &j.Attempts, &j.RunAfter, &j.LastError, &j.CreatedAt, &j.UpdatedAt, &payload)
+	j.Payload = payload
+	return j, err
+}
+
+//listJobs answers with the jobs that are waiting, running or failed, the oldest first. ?status= only lists those in
+//one of the states, ?status=failed the dead letters an admin may retry. ?limit= and ?offset= page through them
+func listJobs(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := parsePage(w, r)
+		if !ok {
+			return
+		}
+		status := r.URL.Query().Get("status")
+		switch status {
+		case "", jobPending, jobRunning, jobFailed:
+		default:
+			writeValidationError(w, r, model.FieldErrors{"status": "must be pending, running or failed"})
+			return
+		}
+		rows, err := db.QueryContext(r.Context(), "SELECT "+jobColumns+" FROM jobs WHERE ($1 = '' OR status = $1) ORDER BY id LIMIT $2 OFFSET $3",
+			status, p.Limit, p.Offset)
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("listing jobs: %w", err))
+			return
+		}
+		defer rows.Close()
+		list := jobList{Jobs: []jobEntry{}}
+		for rows.Next() {
+			j, err := scanJob(rows)
+			if err != nil {
+				internalServerError(w, r, fmt.Errorf("reading job: %w", err))
+				return
+			}
+			list.Jobs = append(list.Jobs, j)
+		}
+		if err := rows.Err(); err != nil {
+			internalServerError(w, r, fmt.Errorf("listing jobs: %w", err))
+			return
+		}
+		writeResponse(w, r, http.StatusOK, list)
+	}
+}
+
+//retryJob queues a failed job again with all its attempts, it runs as soon as a worker is free. only failed jobs can be
+//retried, the others are retried on their own
+func retryJob(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		now := time.Now().UTC()
+		res, err := db.ExecContext(r.Context(), "UPDATE jobs SET status = $1, attempts = 0, run_after = $2, updated_at = $2 WHERE id = $3 AND status = $4",
+			jobPending, now, id, jobFailed)
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("retrying job: %w", err))
+			return
+		}
+		retried, err := res.RowsAffected()
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("retrying job: %w", err))
+			return
+		}
+		j, err := scanJob(db.QueryRowContext(r.Context(), "SELECT "+jobColumns+" FROM jobs WHERE id = $1", id))
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			writeError(w, r, http.StatusNotFound, codeNotFound, fmt.Sprintf("job %d does not exist, it may have succeeded already", id))
+			return
+		case err != nil:
+			internalServerError(w, r, fmt.Errorf("loading job: %w", err))
+			return
+		case retried == 0:
+			writeError(w, r, http.StatusConflict, codeInvalidState, fmt.Sprintf("job %d is %s, only failed jobs can be retried", id, j.Status))
+			return
+		}
+		event := auditEventFor(r.Context(), auditJobRetried)
+		event.Details = map[string]any{"job_id": j.Id, "type": j.Type}
+		if err := recordAudit(r.Context(), db, event); err != nil {
+			loggerFrom(r.Context()).Error("auditing the job retry", "job_id", j.Id, "error", err)
+		}
+		writeResponse(w, r, http.StatusOK, j)
+	}
+}
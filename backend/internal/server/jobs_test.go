@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"api/internal/model"
+)
+
+//noWorkers is the env of a server that queues jobs but runs none, the tests run them with queues of their own
+var noWorkers = map[string]string{"JOB_WORKERS": "0"}
+
+//waitFor fails the test when cond doesnt hold within a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestJobRetriesUntilItSucceeds(t *testing.T) {
+	ts := newTestServer(t, noWorkers)
+	var attempts atomic.Int32
+	q := newJobQueue(ts.db, dbDriverSQLite, jobConfig{workers: 1, maxAttempts: 3, retryDelay: 10 * time.Millisecond},
+		map[string]jobHandler{"flaky": func(ctx context.Context, payload []byte) error {
+			if attempts.Add(1) < 3 {
+				return errors.New("smtp unreachable")
+			}
+			return nil
+		}}, testLogger(t))
+	defer q.close(time.Second)
+
+	if err := q.enqueue(t.Context(), ts.db, "flaky", map[string]string{"to": "ada@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the job to succeed", func() bool { return ts.count("jobs", "type = 'flaky'") == 0 })
+	if n := attempts.Load(); n != 3 {
+		t.Fatalf("the job succeeded after %d attempts, want 3", n)
+	}
+}
+
+func TestJobFailsAfterItsLastAttempt(t *testing.T) {
+	ts := newTestServer(t, noWorkers)
+	var attempts atomic.Int32
+	q := newJobQueue(ts.db, dbDriverSQLite, jobConfig{workers: 1, maxAttempts: 2, retryDelay: 10 * time.Millisecond},
+		map[string]jobHandler{"broken": func(ctx context.Context, payload []byte) error {
+			attempts.Add(1)
+			return errors.New("mailbox full")
+		}}, testLogger(t))
+	defer q.close(time.Second)
+
+	if err := q.enqueue(t.Context(), ts.db, "broken", nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the job to fail", func() bool { return ts.count("jobs", "type = 'broken' AND status = $1", jobFailed) == 1 })
+	if n := ts.count("jobs", "type = 'broken' AND attempts = 2 AND last_error = 'mailbox full'"); n != 1 || attempts.Load() != 2 {
+		t.Fatalf("the failed job was tried %d times", attempts.Load())
+	}
+	//a failed job stays put until an admin retries it
+	time.Sleep(50 * time.Millisecond)
+	if n := attempts.Load(); n != 2 {
+		t.Fatalf("the failed job was tried again, %d attempts", n)
+	}
+}
+
+//TestJobOfCrashedWorkerRunsAgain claims a job like a worker that dies before it records how it went, the job is left
+//running until its lease is over and is then claimed by another worker
+func TestJobOfCrashedWorkerRunsAgain(t *testing.T) {
+	ts := newTestServer(t, noWorkers)
+	ran := make(chan string, 1)
+	handlers := map[string]jobHandler{"welcome": func(ctx context.Context, payload []byte) error {
+		ran <- string(payload)
+		return nil
+	}}
+	crashed := newJobQueue(ts.db, dbDriverSQLite, jobConfig{maxAttempts: 3, retryDelay: time.Second}, handlers, testLogger(t))
+	if err := crashed.enqueue(t.Context(), ts.db, "welcome", "ada@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := crashed.claim(t.Context()); !ok || err != nil {
+		t.Fatalf("claiming the job: %v, %v", ok, err)
+	}
+	crashed.close(time.Second)
+
+	other := newJobQueue(ts.db, dbDriverSQLite, jobConfig{maxAttempts: 3, retryDelay: time.Second}, handlers, testLogger(t))
+	if _, ok, err := other.claim(t.Context()); ok || err != nil {
+		t.Fatalf("another worker claimed the job during its lease: %v, %v", ok, err)
+	}
+	other.close(time.Second)
+
+	//the lease runs out
+	if _, err := ts.db.Exec("UPDATE jobs SET run_after = $1", time.Now().UTC().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	restarted := newJobQueue(ts.db, dbDriverSQLite, jobConfig{workers: 1, maxAttempts: 3, retryDelay: time.Second}, handlers, testLogger(t))
+	defer restarted.close(time.Second)
+	select {
+	case payload := <-ran:
+		if payload != `"ada@example.com"` {
+			t.Fatalf("the job ran with %s", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the job of the crashed worker didnt run again")
+	}
+	waitFor(t, "the job to be deleted", func() bool { return ts.count("jobs", "") == 0 })
+}
+
+func TestEmailsAreQueuedAsJobs(t *testing.T) {
+	ts := newTestServer(t, noWorkers)
+	admin := ts.admin()
+
+	res := ts.do("POST", "/api/v1/users", admin, map[string]any{"name": "Ada", "email": "ada@example.com", "password": "password123"})
+	expect(t, res, http.StatusCreated)
+	//the welcome and the verification link
+	if n := ts.count("jobs", "type = $1 AND payload LIKE '%ada@example.com%'", jobTypeEmail); n != 2 {
+		t.Fatalf("%d emails queued for the new user", n)
+	}
+	expect(t, ts.do("POST", "/api/v1/password/forgot", "", map[string]any{"email": "ada@example.com"}), http.StatusAccepted)
+	expect(t, ts.do("POST", "/api/v1/users/verify/resend", "", map[string]any{"email": "ada@example.com"}), http.StatusAccepted)
+	var u struct {
+		Id model.ID `json:"id"`
+	}
+	res.decode(t, &u)
+	expect(t, ts.do("PUT", userPath(u.Id), admin, map[string]any{"name": "Ada", "email": "lovelace@example.com"}), http.StatusOK)
+	for _, subject := range []string{"Welcome%", "Confirm your email address", "Reset your password", "Confirm your new email address", "Your email address is about to change"} {
+		if n := ts.count("jobs", "payload LIKE $1", `%"subject":"`+subject+`%`); n == 0 {
+			t.Fatalf("no job queued for %q", subject)
+		}
+	}
+	//nothing is sent without a worker
+	ts.mail.none(t)
+}
+
+func TestWelcomeIsQueuedWithTheUser(t *testing.T) {
+	ts := newTestServer(t, noWorkers)
+	admin := ts.admin()
+	//the jobs cant be written from now on
+	if _, err := ts.db.Exec("CREATE TRIGGER refuse_jobs BEFORE INSERT ON jobs BEGIN SELECT RAISE(ABORT, 'jobs unavailable'); END"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, ts.do("POST", "/api/v1/users", admin, map[string]any{"name": "Ada", "email": "ada@example.com", "password": "password123"}), http.StatusInternalServerError)
+	if n := ts.count("users", "email = 'ada@example.com'"); n != 0 {
+		t.Fatal("the user was created without its welcome email")
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"api/internal/model"
+)
+
+//mediaTypeJSONAPI is the media type of json:api documents (https://jsonapi.org/format/)
+const mediaTypeJSONAPI = "application/vnd.api+json"
+
+//jsonAPIDocument is the top level of a json:api response, it has either data or errors
+type jsonAPIDocument struct {
+	Data   any            `json:"data,omitempty"`
+	Errors []jsonAPIError `json:"errors,omitempty"`
+	Links  *jsonAPILinks  `json:"links,omitempty"`
+	Meta   map[string]any `json:"meta,omitempty"`
+	//JSONAPI names the version of the spec the document follows
+	JSONAPI struct {
+		Version string `json:"version"`
+	} `json:"jsonapi"`
+}
+
+//jsonAPILinks are the links of a document or resource, the pagination ones only of a page of a list
+type jsonAPILinks struct {
+	Self  string `json:"self"`
+	First string `json:"first,omitempty"`
+	Prev  string `json:"prev,omitempty"`
+	Next  string `json:"next,omitempty"`
+	Last  string `json:"last,omitempty"`
+}
+
+//jsonAPIResource is a resource object: a type and string id, with every other field in attributes
+type jsonAPIResource struct {
+	Type       string       `json:"type"`
+	Id         string       `json:"id"`
+	Attributes any          `json:"attributes"`
+	Links      jsonAPILinks `json:"links"`
+}
+
+//jsonAPIError is an error object. code is the same machine readable code as in the plain json envelope
+type jsonAPIError struct {
+	Status string              `json:"status"`
+	Code   string              `json:"code"`
+	Title  string              `json:"title"`
+	Detail string              `json:"detail"`
+	Source *jsonAPIErrorSource `json:"source,omitempty"`
+	Meta   map[string]string   `json:"meta,omitempty"`
+}
+
+//jsonAPIErrorSource points at the field of the request body that was invalid
+type jsonAPIErrorSource struct {
+	Pointer string `json:"pointer"`
+}
+
+//userAttributes are the fields of a user besides its id, the json:api counterpart of the User json tags
+type userAttributes struct {
+	Name         string    `json:"name"`
+	Email        string    `json:"email"`
+	Role         string    `json:"role"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	Verified     bool      `json:"verified"`
+	Active       bool      `json:"active"`
+	PendingEmail string    `json:"pending_email,omitempty"`
+}
+
+func newJSONAPIDocument() jsonAPIDocument {
+	var doc jsonAPIDocument
+	doc.JSONAPI.Version = "1.1"
+	return doc
+}
+
+//userResource is u as a json:api resource object, its self link points at the current api version
+func userResource(r *http.Request, u model.User) jsonAPIResource {
+	return jsonAPIResource{
+		Type: "users",
+		Id:   strconv.FormatInt(int64(u.Id), 10),
+		Attributes: userAttributes{
+			Name:         u.Name,
+			Email:        u.Email,
+			Role:         u.Role,
+			UpdatedAt:    u.UpdatedAt,
+			Verified:     u.Verified,
+			Active:       u.Active,
+			PendingEmail: u.PendingEmail,
+		},
+		Links: jsonAPILinks{Self: externalURL(r, apiPath("/api/v1/users/"+strconv.FormatInt(int64(u.Id), 10)))},
+	}
+}
+
+//toJSONAPI converts the payloads that have a json:api representation: users, user lists and errors.
+//everything else is sent as plain json even when json:api was asked for. header is of the response, a page of a list
+//has its size and position there
+func toJSONAPI(r *http.Request, header http.Header, status int, payload any) (jsonAPIDocument, bool) {
+	switch p := payload.(type) {
+	case model.User:
+		doc := newJSONAPIDocument()
+		doc.Data = userResource(r, p)
+		return doc, true
+	case model.UserList:
+		return userListDocument(r, header, p), true
+	case errorEnvelope:
+		return errorDocument(status, p), true
+	}
+	return jsonAPIDocument{}, false
+}
+
+//a page of the list links to the other pages like the Link headers of setPageLinks, and meta counts the whole list
+//and tells where the page is in it. the page is read back from the headers parsePage and setPageLinks set
+func userListDocument(r *http.Request, header http.Header, l model.UserList) jsonAPIDocument {
+	doc := newJSONAPIDocument()
+	resources := make([]jsonAPIResource, 0, len(l.Users))
+	for _, u := range l.Users {
+		resources = append(resources, userResource(r, u))
+	}
+	doc.Data = resources
+	doc.Links = &jsonAPILinks{Self: externalURL(r, r.URL.RequestURI())}
+	doc.Meta = map[string]any{"total": len(l.Users)}
+
+	limit, limitErr := strconv.Atoi(header.Get("X-Page-Limit"))
+	offset, offsetErr := strconv.Atoi(header.Get("X-Page-Offset"))
+	total, totalErr := strconv.Atoi(header.Get("X-Total-Count"))
+	if limitErr != nil || offsetErr != nil || totalErr != nil {
+		return doc
+	}
+	doc.Meta = map[string]any{"total": total, "limit": limit, "offset": offset}
+	for _, link := range pageLinks(r, page{Limit: limit, Offset: offset}, total) {
+		switch link.rel {
+		case "first":
+			doc.Links.First = link.url
+		case "prev":
+			doc.Links.Prev = link.url
+		case "next":
+			doc.Links.Next = link.url
+		case "last":
+			doc.Links.Last = link.url
+		}
+	}
+	return doc
+}
+
+//validation failures become one error object per invalid field, pointing at the field in the request body
+func errorDocument(status int, e errorEnvelope) jsonAPIDocument {
+	base := jsonAPIError{Status: strconv.Itoa(status), Code: e.Error.Code, Title: http.StatusText(status), Detail: e.Error.Message}
+	if e.Error.RequestId != "" {
+		base.Meta = map[string]string{"request_id": e.Error.RequestId}
+	}
+
+	doc := newJSONAPIDocument()
+	if len(e.Error.Fields) == 0 {
+		doc.Errors = []jsonAPIError{base}
+		return doc
+	}
+	names := make([]string, 0, len(e.Error.Fields))
+	for name := range e.Error.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fieldErr := base
+		fieldErr.Detail = name + " " + e.Error.Fields[name]
+		fieldErr.Source = &jsonAPIErrorSource{Pointer: "/" + name}
+		doc.Errors = append(doc.Errors, fieldErr)
+	}
+	return doc
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"api/internal/model"
+)
+
+//checkJSONAPIDocument fails the test when body breaks the structural rules of a json:api document that every response
+//has to follow, and decodes it into doc
+func checkJSONAPIDocument(t *testing.T, res testResponse, doc any) {
+	t.Helper()
+	if ct := res.Header.Get("Content-Type"); ct != mediaTypeJSONAPI {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	var top map[string]json.RawMessage
+	res.decode(t, &top)
+	_, hasData := top["data"]
+	_, hasErrors := top["errors"]
+	if hasData == hasErrors {
+		t.Fatalf("a document needs data or errors but not both: %s", res.body)
+	}
+	for member := range top {
+		switch member {
+		case "data", "errors", "meta", "links", "jsonapi", "included":
+		default:
+			t.Fatalf("the document has a member %q", member)
+		}
+	}
+	res.decode(t, doc)
+}
+
+//jsonAPIResourceDoc is a resource object as clients decode it
+type jsonAPIResourceDoc struct {
+	Type       string         `json:"type"`
+	Id         string         `json:"id"`
+	Attributes map[string]any `json:"attributes"`
+	Links      jsonAPILinks   `json:"links"`
+}
+
+//checkResource fails the test when r isnt the user u
+func checkResource(t *testing.T, r jsonAPIResourceDoc, u model.User) {
+	t.Helper()
+	if r.Type != "users" || r.Id != strconv.FormatInt(int64(u.Id), 10) || r.Attributes["email"] != u.Email || r.Links.Self != userPath(u.Id) {
+		t.Fatalf("the resource of %d is %+v", u.Id, r)
+	}
+	//the spec keeps the id and type out of the attributes
+	if _, ok := r.Attributes["id"]; ok {
+		t.Fatalf("the attributes have the id: %+v", r.Attributes)
+	}
+}
+
+func TestJSONAPIUser(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	u := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+
+	for _, res := range []testResponse{
+		ts.do("GET", userPath(u.Id), admin, nil, "Accept", mediaTypeJSONAPI),
+		ts.do("GET", userPath(u.Id)+"?format=jsonapi", admin, nil),
+	} {
+		expect(t, res, http.StatusOK)
+		var doc struct {
+			Data    jsonAPIResourceDoc `json:"data"`
+			JSONAPI struct {
+				Version string `json:"version"`
+			} `json:"jsonapi"`
+		}
+		checkJSONAPIDocument(t, res, &doc)
+		checkResource(t, doc.Data, u)
+		if doc.JSONAPI.Version != "1.1" {
+			t.Fatalf("json:api version %q", doc.JSONAPI.Version)
+		}
+	}
+
+	//media type parameters other than ext and profile make the range not match, plain json is the default
+	res := ts.do("GET", userPath(u.Id), admin, nil, "Accept", mediaTypeJSONAPI+"; charset=utf-8")
+	expect(t, res, http.StatusOK)
+	var plain model.User
+	res.decode(t, &plain)
+	if res.Header.Get("Content-Type") != contentTypeJSON || plain.Id != u.Id {
+		t.Fatalf("a plain client got %s: %s", res.Header.Get("Content-Type"), res.body)
+	}
+}
+
+func TestJSONAPIUserList(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	var users []model.User
+	for _, name := range []string{"Ada", "Grace", "Hedy"} {
+		users = append(users, ts.createUser(name, name+"@example.com", model.RoleMember))
+	}
+
+	res := ts.do("GET", "/api/v1/users?format=jsonapi&limit=2&offset=1", admin, nil)
+	expect(t, res, http.StatusOK)
+	var doc struct {
+		Data  []jsonAPIResourceDoc `json:"data"`
+		Links jsonAPILinks         `json:"links"`
+		Meta  map[string]int       `json:"meta"`
+	}
+	checkJSONAPIDocument(t, res, &doc)
+	if len(doc.Data) != 2 {
+		t.Fatalf("the page has %d users", len(doc.Data))
+	}
+	checkResource(t, doc.Data[0], users[0])
+	checkResource(t, doc.Data[1], users[1])
+	if doc.Meta["total"] != 4 || doc.Meta["limit"] != 2 || doc.Meta["offset"] != 1 {
+		t.Fatalf("meta %v", doc.Meta)
+	}
+	for rel, want := range map[string]string{"first": "0", "prev": "0", "next": "3", "last": "3"} {
+		link := map[string]string{"first": doc.Links.First, "prev": doc.Links.Prev, "next": doc.Links.Next, "last": doc.Links.Last}[rel]
+		u, err := url.Parse(link)
+		if err != nil || u.Path != "/api/v1/users" || u.Query().Get("offset") != want || u.Query().Get("limit") != "2" || u.Query().Get("format") != "jsonapi" {
+			t.Fatalf("the %s link is %q", rel, link)
+		}
+	}
+	if doc.Links.Self != "/api/v1/users?format=jsonapi&limit=2&offset=1" {
+		t.Fatalf("the self link is %q", doc.Links.Self)
+	}
+}
+
+func TestJSONAPIErrors(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+
+	res := ts.do("GET", userPath(999)+"?format=jsonapi", admin, nil)
+	expect(t, res, http.StatusNotFound)
+	var doc struct {
+		Errors []jsonAPIError `json:"errors"`
+	}
+	checkJSONAPIDocument(t, res, &doc)
+	if len(doc.Errors) != 1 || doc.Errors[0].Status != "404" || doc.Errors[0].Code != codeUserNotFound || doc.Errors[0].Detail == "" {
+		t.Fatalf("the missing user is %s", res.body)
+	}
+
+	//every invalid field is an error of its own, pointing at the field
+	res = ts.do("POST", "/api/v1/users", admin, map[string]any{"name": "", "email": "x", "password": "password123"}, "Accept", mediaTypeJSONAPI)
+	expect(t, res, http.StatusUnprocessableEntity)
+	doc.Errors = nil
+	checkJSONAPIDocument(t, res, &doc)
+	if len(doc.Errors) != 2 {
+		t.Fatalf("the invalid user is %s", res.body)
+	}
+	for i, field := range []string{"email", "name"} {
+		e := doc.Errors[i]
+		if e.Status != "422" || e.Code != codeValidationFailed || e.Source == nil || e.Source.Pointer != "/"+field {
+			t.Fatalf("the error of %s is %+v", field, e)
+		}
+	}
+}
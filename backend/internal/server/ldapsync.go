@@ -0,0 +1,503 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/google/uuid"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//defaults of the LDAP_ settings: every person with an email address, 500 entries a page and a sync every hour
+const (
+	defaultLDAPUserFilter   = "(&(objectClass=person)(mail=*))"
+	defaultLDAPPageSize     = 500
+	defaultLDAPSyncSchedule = "0 * * * *"
+)
+
+//ldapTimeout caps connecting to the directory and every request sent to it
+const ldapTimeout = 30 * time.Second
+
+//ldapSyncLockId is the postgres advisory lock held while a sync runs, so two instances never sync at once
+const ldapSyncLockId = 7268004
+
+//maxLDAPSyncChanges is how many changes the summary lists, the ones after that are only counted
+const maxLDAPSyncChanges = 100
+
+//auditLDAPSynced is the summary of a sync, the changes to the users are audited one by one next to it
+const auditLDAPSynced = "ldap.synced"
+
+//ldapConfig is the directory the users are mirrored from. a user is keyed by idAttr, which has to stay the same
+//when the user is renamed or moved: entryUUID on openldap, objectGUID on active directory
+type ldapConfig struct {
+	//url is ldap://host:389 or ldaps://host:636, empty turns the sync off
+	url string
+	//startTLS upgrades an ldap:// connection to tls before binding
+	startTLS     bool
+	bindDN       string
+	bindPassword string
+	baseDN       string
+	filter       string
+	idAttr       string
+	nameAttr     string
+	emailAttr    string
+	pageSize     int
+	//scheduleExpr is the cron expression schedule was parsed from, "off" leaves only POST /admin/ldap-sync
+	scheduleExpr string
+	schedule     *cronSchedule
+}
+
+//check reports what is wrong with a configured directory and parses the schedule
+func (c *ldapConfig) check() error {
+	var errs []error
+	u, err := url.Parse(c.url)
+	switch {
+	case err != nil:
+		errs = append(errs, fmt.Errorf("LDAP_URL: %w", err))
+	case u.Scheme != "ldap" && u.Scheme != "ldaps":
+		errs = append(errs, fmt.Errorf("LDAP_URL must start with ldap:// or ldaps://, got %q", c.url))
+	case u.Scheme == "ldaps" && c.startTLS:
+		errs = append(errs, errors.New("LDAP_START_TLS is for ldap:// urls, ldaps:// is tls from the start"))
+	}
+	if c.baseDN == "" {
+		errs = append(errs, errors.New("LDAP_BASE_DN is required with LDAP_URL"))
+	}
+	if c.bindDN != "" && c.bindPassword == "" {
+		errs = append(errs, errors.New("LDAP_BIND_PASSWORD is required with LDAP_BIND_DN"))
+	}
+	if _, err := ldap.CompileFilter(c.filter); err != nil {
+		errs = append(errs, fmt.Errorf("LDAP_USER_FILTER: %w", err))
+	}
+	if c.scheduleExpr != "off" {
+		schedule, err := parseCron(c.scheduleExpr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("LDAP_SYNC_SCHEDULE: %w", err))
+		}
+		c.schedule = &schedule
+	}
+	return errors.Join(errs...)
+}
+
+//ldapEntry is a user found in the directory, with the attributes of the mapping
+type ldapEntry struct {
+	ExternalId string
+	Name       string
+	Email      string
+}
+
+//searchDirectory reads every entry below the base dn that matches the filter, page by page
+func searchDirectory(cfg ldapConfig) ([]ldapEntry, error) {
+	u, err := url.Parse(cfg.url)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to ldap: %w", err)
+	}
+	tlsConfig := &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	conn, err := ldap.DialURL(cfg.url, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to ldap: %w", err)
+	}
+	defer conn.Close()
+	conn.SetTimeout(ldapTimeout)
+	if cfg.startTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			return nil, fmt.Errorf("starting tls with ldap: %w", err)
+		}
+	}
+	if cfg.bindDN != "" {
+		if err := conn.Bind(cfg.bindDN, cfg.bindPassword); err != nil {
+			return nil, fmt.Errorf("binding to ldap: %w", err)
+		}
+	}
+	req := ldap.NewSearchRequest(cfg.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		cfg.filter, []string{cfg.idAttr, cfg.nameAttr, cfg.emailAttr}, nil)
+	res, err := conn.SearchWithPaging(req, uint32(cfg.pageSize))
+	if err != nil {
+		return nil, fmt.Errorf("searching ldap: %w", err)
+	}
+	entries := make([]ldapEntry, 0, len(res.Entries))
+	for _, e := range res.Entries {
+		entries = append(entries, ldapEntry{
+			ExternalId: externalIdOf(e.GetEqualFoldRawAttributeValue(cfg.idAttr)),
+			Name:       e.GetEqualFoldAttributeValue(cfg.nameAttr),
+			Email:      e.GetEqualFoldAttributeValue(cfg.emailAttr),
+		})
+	}
+	return entries, nil
+}
+
+//externalIdOf is the id attribute as text. objectGUID is 16 raw bytes, ids that arent text are stored hex encoded
+func externalIdOf(raw []byte) string {
+	if utf8.Valid(raw) && !strings.ContainsRune(string(raw), 0) {
+		return string(raw)
+	}
+	return hex.EncodeToString(raw)
+}
+
+//errLDAPSyncRunning is returned by ldapSyncer.sync when another instance holds the sync lock
+var errLDAPSyncRunning = errors.New("ldap sync is running on another instance")
+
+//errLDAPDirectory wraps what went wrong reading the directory, as opposed to writing the users
+var errLDAPDirectory = errors.New("ldap directory")
+
+//ldapSyncSummary is what a sync did, the answer of POST /admin/ldap-sync
+type ldapSyncSummary struct {
+	XMLName xml.Name `json:"-" xml:"ldap_sync"`
+	//DryRun is set when the sync was rolled back after the summary was made
+	DryRun bool `json:"dry_run,omitempty" xml:"dry_run,attr,omitempty"`
+	//Entries is how many users the directory returned
+	Entries     int `json:"entries" xml:"entries"`
+	Created     int `json:"created" xml:"created"`
+	Updated     int `json:"updated" xml:"updated"`
+	Deactivated int `json:"deactivated" xml:"deactivated"`
+	Unchanged   int `json:"unchanged" xml:"unchanged"`
+	Skipped     int `json:"skipped" xml:"skipped"`
+	//Changes are the first maxLDAPSyncChanges users that were created, updated, deactivated or skipped
+	Changes []ldapSyncChange `json:"changes" xml:"change"`
+}
+
+type ldapSyncChange struct {
+	//Action is created, updated, deactivated or skipped
+	Action     string   `json:"action" xml:"action,attr"`
+	UserId     model.ID `json:"user_id,omitempty" xml:"user_id,attr,omitempty"`
+	ExternalId string   `json:"external_id" xml:"external_id,attr"`
+	Email      string   `json:"email,omitempty" xml:"email,attr,omitempty"`
+	//Message is why an entry was skipped
+	Message string `json:"message,omitempty" xml:",chardata"`
+}
+
+//ldapSyncer mirrors the users of the directory: it creates the users it hasnt seen yet, updates the ones whose name
+//or email changed and deactivates the ones that are gone from it
+type ldapSyncer struct {
+	db     *sql.DB
+	driver string
+	cfg    ldapConfig
+	cache  *userCache
+	events eventBroker
+	//search is searchDirectory with cfg
+	search func() ([]ldapEntry, error)
+}
+
+func newLDAPSyncer(db *sql.DB, driver string, cfg ldapConfig, cache *userCache, events eventBroker) *ldapSyncer {
+	return &ldapSyncer{db: db, driver: driver, cfg: cfg, cache: cache, events: events,
+		search: func() ([]ldapEntry, error) { return searchDirectory(cfg) }}
+}
+
+//ldapSyncRun is the state of one sync inside its transaction
+type ldapSyncRun struct {
+	ctx     context.Context
+	tx      *sql.Tx
+	now     time.Time
+	summary ldapSyncSummary
+	//changed are the users as they were written, published once the sync is committed
+	changed []userEvent
+}
+
+//sync runs one sync in one transaction. an entry is matched by its external id, and then by email to a user that isnt
+//synced yet, which links the two. users nobody manages through the directory, the ones without an external id, are
+//never deactivated. invalid entries and entries whose email belongs to another synced user are skipped and reported.
+//a dry run makes every change and rolls them back. a directory that returns nobody is refused, that is almost always a
+//wrong filter or base dn and would deactivate every synced user
+func (s *ldapSyncer) sync(ctx context.Context, dryRun bool) (ldapSyncSummary, error) {
+	entries, err := s.search()
+	if err != nil {
+		return ldapSyncSummary{}, fmt.Errorf("%w: %w", errLDAPDirectory, err)
+	}
+	if len(entries) == 0 {
+		return ldapSyncSummary{}, fmt.Errorf("%w: the search returned no users, check LDAP_BASE_DN and LDAP_USER_FILTER", errLDAPDirectory)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return ldapSyncSummary{}, fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if s.driver == dbDriverPostgres {
+		var locked bool
+		if err := tx.QueryRowContext(ctx, "SELECT pg_try_advisory_xact_lock($1)", ldapSyncLockId).Scan(&locked); err != nil {
+			return ldapSyncSummary{}, fmt.Errorf("locking ldap sync: %w", err)
+		}
+		if !locked {
+			return ldapSyncSummary{}, errLDAPSyncRunning
+		}
+	}
+
+	run := &ldapSyncRun{ctx: ctx, tx: tx, now: time.Now().UTC(),
+		summary: ldapSyncSummary{DryRun: dryRun, Entries: len(entries), Changes: []ldapSyncChange{}}}
+	seen := map[string]bool{}
+	for _, e := range entries {
+		if err := run.entry(e, seen); err != nil {
+			return ldapSyncSummary{}, err
+		}
+	}
+	if err := run.deactivateMissing(seen); err != nil {
+		return ldapSyncSummary{}, err
+	}
+
+	summary := run.summary
+	event := auditEventFor(ctx, auditLDAPSynced)
+	event.Details = map[string]any{"entries": summary.Entries, "created": summary.Created, "updated": summary.Updated,
+		"deactivated": summary.Deactivated, "unchanged": summary.Unchanged, "skipped": summary.Skipped}
+	if err := recordAudit(ctx, tx, event); err != nil {
+		return ldapSyncSummary{}, err
+	}
+	if dryRun {
+		return summary, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return ldapSyncSummary{}, fmt.Errorf("syncing ldap: %w", err)
+	}
+	for _, e := range run.changed {
+		s.cache.forget(ctx, int64(e.User.Id))
+		s.events.Publish(e)
+	}
+	return summary, nil
+}
+
+//report counts what happened to an entry or user and lists it while there is room
+func (run *ldapSyncRun) report(c ldapSyncChange) {
+	switch c.Action {
+	case "created":
+		run.summary.Created++
+	case "updated":
+		run.summary.Updated++
+	case "deactivated":
+		run.summary.Deactivated++
+	default:
+		run.summary.Skipped++
+	}
+	if len(run.summary.Changes) < maxLDAPSyncChanges {
+		run.summary.Changes = append(run.summary.Changes, c)
+	}
+}
+
+//entry creates or updates the user of one directory entry. seen collects the external ids of the entries
+func (run *ldapSyncRun) entry(e ldapEntry, seen map[string]bool) error {
+	skip := func(message string) error {
+		run.report(ldapSyncChange{Action: "skipped", ExternalId: e.ExternalId, Email: e.Email, Message: message})
+		return nil
+	}
+	if e.ExternalId == "" {
+		return skip("the entry has no id attribute")
+	}
+	if seen[e.ExternalId] {
+		return skip("the id is in the directory twice")
+	}
+	seen[e.ExternalId] = true
+	u := model.User{Name: e.Name, Email: e.Email, Role: model.RoleMember}
+	if errs := u.Validate(); errs != nil {
+		return skip(fieldErrorsMessage(errs))
+	}
+
+	//the synced user and the user with the email of the entry, when they are different users the entry cant be applied
+	var linked, byEmail int64
+	var byEmailExternal string
+	err := run.tx.QueryRowContext(run.ctx, "SELECT id FROM users WHERE external_id = $1", e.ExternalId).Scan(&linked)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("looking up synced user: %w", err)
+	}
+	err = run.tx.QueryRowContext(run.ctx, "SELECT id, COALESCE(external_id, '') FROM users WHERE lower(email) = $1", u.Email).Scan(&byEmail, &byEmailExternal)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("looking up synced user: %w", err)
+	}
+	switch {
+	case linked == 0 && byEmail == 0:
+		return run.create(e.ExternalId, u)
+	case linked == 0 && byEmailExternal != "":
+		return skip(fmt.Sprintf("the email belongs to user %d, who is synced from another entry", byEmail))
+	case linked == 0:
+		return run.update(byEmail, e.ExternalId, u)
+	case byEmail != 0 && byEmail != linked:
+		return skip(fmt.Sprintf("the email belongs to user %d", byEmail))
+	}
+	return run.update(linked, e.ExternalId, u)
+}
+
+//loadUser reads a user in the transaction of the sync
+func (run *ldapSyncRun) loadUser(id int64, u *model.User) error {
+	if err := store.ScanUser(run.tx.QueryRowContext(run.ctx, "SELECT "+store.UserColumns+" FROM users WHERE id = $1", id), u); err != nil {
+		return fmt.Errorf("loading synced user: %w", err)
+	}
+	return nil
+}
+
+//create adds the user of a new entry as a member. the directory vouches for the email, so it counts as verified
+func (run *ldapSyncRun) create(externalId string, u model.User) error {
+	_, err := run.tx.ExecContext(run.ctx, `INSERT INTO users (uuid, name, email, role, external_id, email_verified_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`, uuid.NewString(), u.Name, u.Email, u.Role, externalId, run.now, run.now)
+	if err != nil {
+		return fmt.Errorf("creating synced user: %w", err)
+	}
+	var created model.User
+	if err := store.ScanUser(run.tx.QueryRowContext(run.ctx, "SELECT "+store.UserColumns+" FROM users WHERE external_id = $1", externalId), &created); err != nil {
+		return fmt.Errorf("loading synced user: %w", err)
+	}
+	if err := auditUserChange(run.ctx, run.tx, auditUserCreated, nil, &created); err != nil {
+		return err
+	}
+	if err := enqueueOutbox(run.ctx, run.tx, outboxUserCreated, created); err != nil {
+		return err
+	}
+	run.changed = append(run.changed, userEvent{Type: eventUserCreated, User: created})
+	run.report(ldapSyncChange{Action: "created", UserId: created.Id, ExternalId: externalId, Email: created.Email})
+	return nil
+}
+
+//update writes the name and email of the entry to user id, links it to the entry and activates it again when it was
+//deactivated. the role is left alone, admins promote synced users like any other
+func (run *ldapSyncRun) update(id int64, externalId string, u model.User) error {
+	var before model.User
+	if err := run.loadUser(id, &before); err != nil {
+		return err
+	}
+	var current sql.NullString
+	if err := run.tx.QueryRowContext(run.ctx, "SELECT external_id FROM users WHERE id = $1", id).Scan(&current); err != nil {
+		return fmt.Errorf("loading synced user: %w", err)
+	}
+	if before.Name == u.Name && before.Email == u.Email && before.Active && current.String == externalId {
+		run.summary.Unchanged++
+		return nil
+	}
+	_, err := run.tx.ExecContext(run.ctx, `UPDATE users SET name = $2, email = $3, external_id = $4, active = $5,
+		version = version + 1, updated_at = $6 WHERE id = $1`, id, u.Name, u.Email, externalId, true, run.now)
+	if err != nil {
+		return fmt.Errorf("updating synced user: %w", err)
+	}
+	var after model.User
+	if err := run.loadUser(id, &after); err != nil {
+		return err
+	}
+	action := auditUserUpdated
+	if !before.Active {
+		action = auditUserActivated
+	}
+	if err := auditUserChange(run.ctx, run.tx, action, &before, &after); err != nil {
+		return err
+	}
+	if err := enqueueOutbox(run.ctx, run.tx, outboxUserUpdated, after); err != nil {
+		return err
+	}
+	run.changed = append(run.changed, userEvent{Type: eventUserUpdated, User: after})
+	run.report(ldapSyncChange{Action: "updated", UserId: model.ID(id), ExternalId: externalId, Email: after.Email})
+	return nil
+}
+
+//deactivateMissing deactivates the active synced users whose entry is gone, and like POST /users/{id}/deactivate
+//ends their sessions and revokes their refresh tokens
+func (run *ldapSyncRun) deactivateMissing(seen map[string]bool) error {
+	rows, err := run.tx.QueryContext(run.ctx, "SELECT id, external_id FROM users WHERE external_id IS NOT NULL AND active ORDER BY id")
+	if err != nil {
+		return fmt.Errorf("listing synced users: %w", err)
+	}
+	type syncedUser struct {
+		id         int64
+		externalId string
+	}
+	var missing []syncedUser
+	for rows.Next() {
+		var u syncedUser
+		if err := rows.Scan(&u.id, &u.externalId); err != nil {
+			rows.Close()
+			return fmt.Errorf("listing synced users: %w", err)
+		}
+		if !seen[u.externalId] {
+			missing = append(missing, u)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("listing synced users: %w", err)
+	}
+
+	for _, m := range missing {
+		var before, after model.User
+		if err := run.loadUser(m.id, &before); err != nil {
+			return err
+		}
+		_, err := run.tx.ExecContext(run.ctx, "UPDATE users SET active = false, version = version + 1, updated_at = $2 WHERE id = $1", m.id, run.now)
+		if err != nil {
+			return fmt.Errorf("deactivating synced user: %w", err)
+		}
+		if err := revokeCredentials(run.ctx, run.tx, m.id); err != nil {
+			return err
+		}
+		if err := run.loadUser(m.id, &after); err != nil {
+			return err
+		}
+		if err := auditUserChange(run.ctx, run.tx, auditUserDeactivated, &before, &after); err != nil {
+			return err
+		}
+		if err := enqueueOutbox(run.ctx, run.tx, outboxUserUpdated, after); err != nil {
+			return err
+		}
+		run.changed = append(run.changed, userEvent{Type: eventUserUpdated, User: after})
+		run.report(ldapSyncChange{Action: "deactivated", UserId: model.ID(m.id), ExternalId: m.externalId, Email: after.Email})
+	}
+	return nil
+}
+
+//runScheduled syncs every time the schedule comes around, in utc, until ctx is cancelled. like the scheduled exports
+//a sync that takes longer than the time to the next one skips the times it missed
+func (s *ldapSyncer) runScheduled(ctx context.Context, logger *slog.Logger) {
+	for {
+		next := s.cfg.schedule.next(time.Now().UTC())
+		logger.Debug("next ldap sync", "at", next)
+		sleepContext(ctx, time.Until(next))
+		if ctx.Err() != nil {
+			return
+		}
+		started := time.Now()
+		summary, err := s.sync(ctx, false)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case errors.Is(err, errLDAPSyncRunning):
+			ldapSyncs.WithLabelValues("skipped").Inc()
+			logger.Info("skipping ldap sync, another instance is running it")
+			continue
+		case err != nil:
+			ldapSyncs.WithLabelValues("failure").Inc()
+			logger.Error("ldap sync failed", "error", err)
+			continue
+		}
+		ldapSyncs.WithLabelValues("success").Inc()
+		logger.Info("ldap sync done", "entries", summary.Entries, "created", summary.Created, "updated", summary.Updated,
+			"deactivated", summary.Deactivated, "skipped", summary.Skipped, "duration", time.Since(started).String())
+	}
+}
+
+//syncNow is POST /admin/ldap-sync, it syncs right away and answers with the summary. ?dry_run=true reports what the
+//sync would change without changing it
+func (s *ldapSyncer) syncNow(w http.ResponseWriter, r *http.Request) {
+	if s == nil {
+		writeError(w, r, http.StatusNotImplemented, codeNotConfigured, "ldap sync is not configured")
+		return
+	}
+	summary, err := s.sync(r.Context(), r.URL.Query().Get("dry_run") == "true")
+	switch {
+	case errors.Is(err, errLDAPSyncRunning):
+		writeError(w, r, http.StatusConflict, codeConflict, "an ldap sync is running already, try again once it is done")
+		return
+	case errors.Is(err, errLDAPDirectory):
+		writeError(w, r, http.StatusBadGateway, codeDirectoryUnavailable, err.Error())
+		return
+	case err != nil:
+		internalServerError(w, r, err)
+		return
+	}
+	writeResponse(w, r, http.StatusOK, summary)
+}
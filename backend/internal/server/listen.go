@@ -0,0 +1,27 @@
+package server
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+//defaultListenAddr is used when neither -addr, LISTEN_ADDR nor PORT is set
+const defaultListenAddr = ":8000"
+
+//addrFlag lets the address be given on the command line too, it wins over the environment
+var addrFlag = flag.String("addr", "", "address to listen on, e.g. :8000 or 127.0.0.1:8000 (default from LISTEN_ADDR or PORT, else :8000)")
+
+//Listen opens the listening socket up front, so a port that is taken fails the startup with a clear message
+func Listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return nil, fmt.Errorf("address %s is already in use, choose another one with LISTEN_ADDR, PORT or -addr", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %w", addr, err)
+	}
+	return ln, nil
+}
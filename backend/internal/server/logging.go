@@ -0,0 +1,41 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"api/requestid"
+)
+
+//loggerKey holds the request scoped logger in the request context, its own type keeps it apart from contextKey values
+type loggerKeyType struct{}
+
+var loggerKey loggerKeyType
+
+//NewLogger builds the logger for the configured level and format (json or text)
+func NewLogger(level slog.Level, format string) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == "text" {
+		return slog.New(slog.NewTextHandler(os.Stdout, opts))
+	}
+	return slog.New(slog.NewJSONHandler(os.Stdout, opts))
+}
+
+//loggerFrom returns the logger of the request ctx belongs to, which already carries the request id, method and path
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+//withLogger gives every request its own logger, handlers get it with loggerFrom(r.Context())
+//it has to run after requestid.Middleware
+func withLogger(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestLogger := logger.With("request_id", requestid.FromContext(r.Context()), "method", r.Method, "path", r.URL.Path)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), loggerKey, requestLogger)))
+	})
+}
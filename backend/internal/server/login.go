@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//defaultAccessTokenTTL is how long an access token is valid when JWT_TTL isnt set
+const defaultAccessTokenTTL = 15 * time.Minute
+
+//jwtSecret signs and verifies access tokens (hs256), accessTokenTTL is how long they stay valid
+//both are set by useAuthConfig, together with refreshTokenTTL and sessionTTL
+var (
+	jwtSecret      []byte
+	accessTokenTTL = defaultAccessTokenTTL
+)
+
+//dummyPasswordHash is compared against when the email is unknown, so a failed login takes the same
+//time whether or not the account exists and the timing doesnt reveal which emails are registered
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+//useAuthConfig sets the token and session settings from cfg
+//without a secret a random one is generated, which works but logs everyone out on every restart
+func useAuthConfig(cfg *Config, logger *slog.Logger) error {
+	jwtSecret = cfg.JWTSecret
+	if len(jwtSecret) == 0 {
+		logger.Warn("JWT_SECRET is not set, using a random secret: issued tokens become invalid when the server restarts")
+		jwtSecret = make([]byte, 32)
+		if _, err := rand.Read(jwtSecret); err != nil {
+			return fmt.Errorf("generating jwt secret: %w", err)
+		}
+	}
+	accessTokenTTL = cfg.AccessTokenTTL
+	refreshTokenTTL = cfg.RefreshTokenTTL
+	sessionTTL = cfg.SessionTTL
+	return nil
+}
+
+//accessClaims are the claims carried by an access token. the user id is the standard sub claim
+//act is only set on impersonation tokens and names the admin behind them
+type accessClaims struct {
+	Email string      `json:"email"`
+	Act   *actorClaim `json:"act,omitempty"`
+	jwt.RegisteredClaims
+}
+
+//issueAccessToken signs a new access token for a user
+func issueAccessToken(userId int64, email string) (string, time.Time, error) {
+	return signAccessToken(userId, email, accessTokenTTL, nil)
+}
+
+//signAccessToken signs an access token valid for ttl, act is nil unless an admin is impersonating the user
+func signAccessToken(userId int64, email string, ttl time.Duration, act *actorClaim) (string, time.Time, error) {
+	now := time.Now()
+	expires := now.Add(ttl)
+	claims := accessClaims{
+		Email: email,
+		Act:   act,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatInt(userId, 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("signing access token: %w", err)
+	}
+	return token, expires, nil
+}
+
+//credentials is the body of POST /api/v1/login
+type credentials struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	//session asks for a session cookie instead of tokens, for browser apps that cant keep a bearer token around
+	Session bool `json:"session,omitempty"`
+}
+
+//tokenResponse is returned by a successful login
+type tokenResponse struct {
+	XMLName     xml.Name `json:"-" xml:"token"`
+	AccessToken string   `json:"access_token" xml:"access_token"`
+	TokenType   string   `json:"token_type" xml:"token_type"`
+	ExpiresIn   int      `json:"expires_in" xml:"expires_in"`
+	//refresh token to get the next access token from /api/v1/token/refresh once this one expires
+	RefreshToken string `json:"refresh_token,omitempty" xml:"refresh_token,omitempty"`
+}
+
+//login checks an email and password and hands out an access token, or a session cookie in session mode
+//wrong password, unknown email and users without a password all get the exact same 401
+//too many failures for an email or from an ip address get a 429 until the failure window ends
+func login(db *sql.DB, limiter *loginLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var creds credentials
+		if err := decodeRequest(r, &creds); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+		if wait := limiter.retryAfter(r, creds.Email); wait > 0 {
+			writeTooManyAttempts(w, r, wait)
+			return
+		}
+
+		var (
+			id       int64
+			email    string
+			hash     sql.NullString
+			verified bool
+			active   bool
+			//mustReset is set when the credentials of the user were revoked, see revokeUserCredentials
+			mustReset bool
+		)
+		//emails are matched case insensitively, the oldest account wins if there are several
+		err := db.QueryRowContext(r.Context(), "SELECT id, email, password_hash, email_verified_at IS NOT NULL, active, password_change_required FROM users WHERE lower(email) = lower($1) ORDER BY id LIMIT 1",
+			strings.TrimSpace(creds.Email)).Scan(&id, &email, &hash, &verified, &active, &mustReset)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			internalServerError(w, r, fmt.Errorf("looking up user for login: %w", err))
+			return
+		}
+
+		//always run bcrypt, against the dummy hash when there is no real one
+		compareWith := dummyPasswordHash
+		if hash.Valid {
+			compareWith = []byte(hash.String)
+		}
+		passwordOK := bcrypt.CompareHashAndPassword(compareWith, []byte(creds.Password)) == nil
+		if !hash.Valid || !passwordOK {
+			limiter.recordFailure(r, creds.Email)
+			writeError(w, r, http.StatusUnauthorized, codeInvalidCredentials, "invalid email or password")
+			return
+		}
+		limiter.recordSuccess(creds.Email)
+
+		//only checked after the password, so it doesnt tell strangers anything about the account
+		if !active {
+			writeError(w, r, http.StatusForbidden, codeAccountDeactivated, "this account has been deactivated")
+			return
+		}
+		//whoever compromised the account may know the password, it is worthless until it is reset
+		if mustReset {
+			writeError(w, r, http.StatusForbidden, codePasswordChangeRequired, "your password has to be reset before you can log in, request a reset link with POST /password/forgot")
+			return
+		}
+		if requireEmailVerification && !verified {
+			writeError(w, r, http.StatusForbidden, codeEmailNotVerified, "confirm your email address with the link we sent you before logging in")
+			return
+		}
+
+		recordLogin(r.Context(), db, id)
+
+		if creds.Session {
+			sessionId, expires, err := createSession(db, r, id)
+			if err != nil {
+				internalServerError(w, r, err)
+				return
+			}
+			setSessionCookie(w, r, sessionId, expires)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		tokens, err := issueTokenPair(r.Context(), db, id, email)
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		writeResponse(w, r, http.StatusOK, tokens)
+	}
+}
+
+//lastLoginPrecision is how old the last login of a user has to be before logging in writes it again, so clients that
+//refresh their tokens every few seconds dont turn into a write to the users table each time
+const lastLoginPrecision = time.Minute
+
+//recordLogin sets the last login of the user to now, unless it is more recent than lastLoginPrecision. it is no change
+//to the profile, the version and updated_at stay and no event goes out. a failure is only logged, it shouldnt keep
+//anyone from logging in
+func recordLogin(ctx context.Context, db *sql.DB, userId int64) {
+	now := time.Now().UTC()
+	_, err := db.ExecContext(ctx, "UPDATE users SET last_login_at = $1 WHERE id = $2 AND (last_login_at IS NULL OR last_login_at < $3)",
+		now, userId, now.Add(-lastLoginPrecision))
+	if err != nil {
+		loggerFrom(ctx).Warn("recording the last login failed", "user_id", userId, "error", err)
+	}
+}
+
+//issueTokenPair hands out an access token plus a refresh token that starts a new refresh token family
+//used by every way of logging in
+func issueTokenPair(ctx context.Context, db *sql.DB, userId int64, email string) (tokenResponse, error) {
+	token, expires, err := issueAccessToken(userId, email)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	familyId, err := randomToken(16)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	refresh, err := issueRefreshToken(ctx, db, userId, familyId)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	return tokenResponse{
+		AccessToken:  token,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(time.Until(expires).Seconds()),
+		RefreshToken: refresh,
+	}, nil
+}
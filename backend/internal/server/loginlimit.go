@@ -0,0 +1,140 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//defaults for LOGIN_MAX_FAILURES and LOGIN_FAILURE_WINDOW
+const (
+	defaultLoginMaxFailures   = 10
+	defaultLoginFailureWindow = 15 * time.Minute
+)
+
+//failureStore counts failed logins per key within a fixed window that starts at the first failure
+//the in memory store below is enough for a single instance, a shared store (e.g. redis with INCR and EXPIRE) can implement
+//the same interface once the api runs on several instances
+type failureStore interface {
+	//Count returns the failures recorded for key and when its window ends
+	Count(key string) (int, time.Time)
+	//Increment records a failure, starting a new window when there is none, and returns the new count and window end
+	Increment(key string, window time.Duration) (int, time.Time)
+	Reset(key string)
+}
+
+type failureCounter struct {
+	count   int
+	resetAt time.Time
+}
+
+//memoryFailureStore keeps the counters in a map, cleanup removes expired ones so the map doesnt grow forever
+type memoryFailureStore struct {
+	mu       sync.Mutex
+	counters map[string]*failureCounter
+}
+
+func newMemoryFailureStore() *memoryFailureStore {
+	return &memoryFailureStore{counters: map[string]*failureCounter{}}
+}
+
+func (s *memoryFailureStore) Count(key string) (int, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.counters[key]
+	if !ok || time.Now().After(c.resetAt) {
+		return 0, time.Time{}
+	}
+	return c.count, c.resetAt
+}
+
+func (s *memoryFailureStore) Increment(key string, window time.Duration) (int, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	c, ok := s.counters[key]
+	if !ok || now.After(c.resetAt) {
+		c = &failureCounter{resetAt: now.Add(window)}
+		s.counters[key] = c
+	}
+	c.count++
+	return c.count, c.resetAt
+}
+
+func (s *memoryFailureStore) Reset(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.counters, key)
+}
+
+//cleanup deletes expired counters every interval, it runs for the lifetime of the process
+func (s *memoryFailureStore) cleanup(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now()
+		s.mu.Lock()
+		for key, c := range s.counters {
+			if now.After(c.resetAt) {
+				delete(s.counters, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+//loginLimiter locks out an account and an ip address after too many failed logins
+//accounts are keyed by the email as typed (lowercased), whether or not it exists, so a lockout looks the same for
+//registered and unknown emails
+type loginLimiter struct {
+	store       failureStore
+	maxFailures int
+	window      time.Duration
+}
+
+//newLoginLimiter locks out after maxFailures within window and starts cleaning up the in memory store
+func newLoginLimiter(maxFailures int, window time.Duration) *loginLimiter {
+	l := &loginLimiter{maxFailures: maxFailures, window: window}
+
+	store := newMemoryFailureStore()
+	go store.cleanup(time.Minute)
+	l.store = store
+	return l
+}
+
+func accountLimitKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipLimitKey(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+//retryAfter returns how long the caller has to wait, or 0 when neither the account nor the ip is locked out
+func (l *loginLimiter) retryAfter(r *http.Request, email string) time.Duration {
+	var wait time.Duration
+	for _, key := range []string{accountLimitKey(email), ipLimitKey(r)} {
+		if count, resetAt := l.store.Count(key); count >= l.maxFailures {
+			wait = max(wait, time.Until(resetAt))
+		}
+	}
+	return wait
+}
+
+func (l *loginLimiter) recordFailure(r *http.Request, email string) {
+	l.store.Increment(accountLimitKey(email), l.window)
+	l.store.Increment(ipLimitKey(r), l.window)
+}
+
+//recordSuccess only clears the account counter. the ip counter keeps running, otherwise an attacker could log into an
+//account of their own every few attempts to keep guessing other people's passwords from the same address
+func (l *loginLimiter) recordSuccess(email string) {
+	l.store.Reset(accountLimitKey(email))
+}
+
+//writeTooManyAttempts answers with 429 and a Retry-After header in whole seconds
+func writeTooManyAttempts(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	seconds := int(wait.Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeError(w, r, http.StatusTooManyRequests, codeTooManyRequests, "too many failed login attempts, try again later")
+}
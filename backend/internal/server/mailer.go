@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+//emailMessage is a single email. HTML is optional, when it is set the message is sent as multipart/alternative.
+//it is the payload of the email jobs as well
+type emailMessage struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	HTML    string `json:"html,omitempty"`
+}
+
+//mailer delivers email. handlers only depend on this interface so tests and local development can use logMailer
+type mailer interface {
+	Send(msg emailMessage) error
+}
+
+//newMailer returns an smtp mailer when a host is configured and the log only mailer otherwise
+func newMailer(c smtpConfig, logger *slog.Logger) mailer {
+	if c.Host == "" {
+		logger.Warn("SMTP_HOST is not set, emails are written to the log instead of being sent")
+		return logMailer{logger: logger}
+	}
+	return &smtpMailer{
+		addr:     net.JoinHostPort(c.Host, c.Port),
+		host:     c.Host,
+		username: c.Username,
+		password: c.Password,
+		from:     c.From,
+	}
+}
+
+//logMailer only logs the messages it is given, at debug level since they contain tokens. it never fails
+type logMailer struct {
+	logger *slog.Logger
+}
+
+func (m logMailer) Send(msg emailMessage) error {
+	m.logger.Debug("mail not sent, no smtp server configured", "to", msg.To, "subject", msg.Subject, "body", msg.Text)
+	return nil
+}
+
+//smtpMailer sends mail through an smtp server. smtp.SendMail upgrades to tls with STARTTLS when the server offers it
+type smtpMailer struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+}
+
+func (m *smtpMailer) Send(msg emailMessage) error {
+	body, err := buildMessage(m.from, msg)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+	if err := smtp.SendMail(m.addr, auth, m.from, []string{msg.To}, body); err != nil {
+		return fmt.Errorf("sending mail to %s: %w", msg.To, err)
+	}
+	return nil
+}
+
+//CheckHealth connects to the smtp server and waits for its greeting, for /readyz. it doesnt log in or send anything
+func (m *smtpMailer) CheckHealth(ctx context.Context) error {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", m.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+//headerSanitizer drops line breaks from header values so user data cant inject extra headers
+var headerSanitizer = strings.NewReplacer("\r", "", "\n", "")
+
+//buildMessage renders msg as an rfc 5322 message with quoted printable bodies
+func buildMessage(from string, msg emailMessage) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", headerSanitizer.Replace(from))
+	fmt.Fprintf(&b, "To: %s\r\n", headerSanitizer.Replace(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", headerSanitizer.Replace(msg.Subject)))
+	b.WriteString("MIME-Version: 1.0\r\n")
+
+	if msg.HTML == "" {
+		b.WriteString("Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n")
+		if err := writeQuotedPrintable(&b, msg.Text); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+
+	parts := multipart.NewWriter(&b)
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", parts.Boundary())
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(w, part.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, s string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(s)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+//appBaseURL is where the frontend is served, set from Config.AppBaseURL by New
+var appBaseURL = "http://localhost:3000"
+
+//frontendLink builds a link into the frontend for use in emails, e.g. frontendLink("/reset-password", "token", t)
+func frontendLink(path, param, value string) string {
+	return appBaseURL + path + "?" + url.Values{param: {value}}.Encode()
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"context"
+	"encoding/xml"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"api/internal/model"
+	"api/userpb"
+)
+
+const (
+	//defaultMaintenanceRetryAfter is the Retry-After of a write refused during maintenance (MAINTENANCE_RETRY_AFTER)
+	defaultMaintenanceRetryAfter = 2 * time.Minute
+	//defaultMaintenanceMessage is the error message of a refused write when maintenance was turned on without one
+	defaultMaintenanceMessage = "the api is in maintenance and only serves reads, try again later"
+	//maxMaintenanceMessage caps the message in characters, it goes into every refused response
+	maxMaintenanceMessage = 500
+	//readOnlyMessage is the error message of a write refused while the instance is read only
+	readOnlyMessage = "this instance of the api is read only, send writes to the primary"
+)
+
+//auditMaintenanceChanged is maintenance being turned on or off through POST /admin/maintenance
+const auditMaintenanceChanged = "maintenance.changed"
+
+//maintenanceConfig is the maintenance state the server starts with and how long refused clients are told to wait
+type maintenanceConfig struct {
+	//enabled starts the server in maintenance (MAINTENANCE_MODE), with message as the error of the refused writes
+	enabled    bool
+	message    string
+	retryAfter time.Duration
+}
+
+//maintenanceState is whether the api refuses writes, the body of GET and POST /admin/maintenance
+type maintenanceState struct {
+	XMLName xml.Name `json:"-" xml:"maintenance"`
+	Enabled bool     `json:"enabled" xml:"enabled"`
+	Message string   `json:"message,omitempty" xml:"message,omitempty"`
+	//ReadOnly refuses every write for good rather than for a while, signing in included, see READ_ONLY
+	ReadOnly bool `json:"read_only" xml:"read_only"`
+	//Since is when maintenance was last turned on or off, or when the server started
+	Since time.Time `json:"since" xml:"since"`
+}
+
+//maintenanceSwitch holds the maintenance state. memoryMaintenance keeps it for its own instance only, so with several
+//instances each has to be switched. one backed by redis or a table can implement the same interface to switch them all
+type maintenanceSwitch interface {
+	State(ctx context.Context) (maintenanceState, error)
+	Set(ctx context.Context, state maintenanceState) error
+}
+
+//memoryMaintenance is a maintenanceSwitch in memory
+type memoryMaintenance struct {
+	mu    sync.Mutex
+	state maintenanceState
+}
+
+//newMemoryMaintenance returns a switch in the state of cfg, read only when the instance was started READ_ONLY
+func newMemoryMaintenance(cfg maintenanceConfig, readOnly bool) *memoryMaintenance {
+	return &memoryMaintenance{state: maintenanceState{Enabled: cfg.enabled, Message: cfg.message, ReadOnly: readOnly, Since: time.Now().UTC()}}
+}
+
+func (m *memoryMaintenance) State(ctx context.Context) (maintenanceState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state, nil
+}
+
+func (m *memoryMaintenance) Set(ctx context.Context, state maintenanceState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state = state
+	return nil
+}
+
+//inMaintenance reports whether writes are refused, and the message to refuse them with. a switch that cant be read
+//lets the writes through: a broken shared store shouldnt take the writes of every instance down with it
+func inMaintenance(ctx context.Context, m maintenanceSwitch) (bool, string) {
+	state, err := m.State(ctx)
+	if err != nil {
+		loggerFrom(ctx).Warn("reading the maintenance state", "error", err)
+		return false, ""
+	}
+	if state.Message == "" {
+		state.Message = defaultMaintenanceMessage
+	}
+	return state.Enabled, state.Message
+}
+
+//isReadOnly reports whether every write is refused, like inMaintenance a switch that cant be read lets them through
+func isReadOnly(ctx context.Context, m maintenanceSwitch) bool {
+	state, err := m.State(ctx)
+	if err != nil {
+		loggerFrom(ctx).Warn("reading the maintenance state", "error", err)
+		return false
+	}
+	return state.ReadOnly
+}
+
+//readOnlyDatabase is Config.ReadOnly, set by New. the reads that would write on the side, like recording when an api
+//key was last used, skip that on a read only database. unlike isReadOnly it doesnt change at runtime, the database stays
+//what it is
+var readOnlyDatabase bool
+
+//maintenanceExempt are the writes that go through during maintenance, under the version prefix. signing in and out
+//only touches sessions, and without them the admins couldnt turn maintenance off again
+var maintenanceExempt = map[string]bool{
+	"/login":             true,
+	"/token/refresh":     true,
+	"/logout":            true,
+	"/admin/maintenance": true,
+}
+
+//readOnlyReads are the routes that are read with GET but write all the same, under the version prefix: following the
+//links of the verification and google sign in emails, and the exports, which are audited. read only refuses them too
+var readOnlyReads = map[string]bool{
+	"/users/verify":         true,
+	"/auth/google/callback": true,
+	"/users/{id}/export":    true,
+	"/admin/export":         true,
+}
+
+//refuseWritesInMaintenance answers every request but GET, HEAD and OPTIONS under prefix with 503 and a Retry-After of
+//retryAfter while m is in maintenance, before the request is authenticated or reaches its handler. while m is read only
+//they are answered 503 with read_only and no Retry-After, including the sign ins and the reads of readOnlyReads, only
+//the switch itself stays writable. graphql is let through, its queries come as POST like its mutations: the refusal
+//goes into the context and the handler answers it to mutations only, see graphQLHandler
+func refuseWritesInMaintenance(m maintenanceSwitch, retryAfter time.Duration, prefix string) mux.MiddlewareFunc {
+	seconds := strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path := strings.TrimPrefix(r.URL.Path, prefix)
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				if route := mux.CurrentRoute(r); route != nil {
+					path, _ = route.GetPathTemplate()
+					path = strings.TrimPrefix(path, prefix)
+				}
+				if !readOnlyReads[path] || !isReadOnly(r.Context(), m) {
+					next.ServeHTTP(w, r)
+					return
+				}
+				writeError(w, r, http.StatusServiceUnavailable, codeReadOnly, readOnlyMessage)
+				return
+			}
+			if path == "/graphql" {
+				if refusal, refused := refusedWrite(r.Context(), m, seconds); refused {
+					r = r.WithContext(context.WithValue(r.Context(), writeRefusalKey, refusal))
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			if path != "/admin/maintenance" && isReadOnly(r.Context(), m) {
+				writeError(w, r, http.StatusServiceUnavailable, codeReadOnly, readOnlyMessage)
+				return
+			}
+			if maintenanceExempt[path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if enabled, message := inMaintenance(r.Context(), m); enabled {
+				w.Header().Set("Retry-After", seconds)
+				writeError(w, r, http.StatusServiceUnavailable, codeMaintenance, message)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+//writeRefusal is why the writes of a request are refused, see refusedWrite
+type writeRefusal struct {
+	code, message string
+	//retryAfter is the Retry-After in seconds, empty for read only, which doesnt end by waiting
+	retryAfter string
+}
+
+//refusedWrite is the refusal of a write while m is read only or in maintenance, false when writes go through
+func refusedWrite(ctx context.Context, m maintenanceSwitch, retryAfter string) (writeRefusal, bool) {
+	if isReadOnly(ctx, m) {
+		return writeRefusal{code: codeReadOnly, message: readOnlyMessage}, true
+	}
+	if enabled, message := inMaintenance(ctx, m); enabled {
+		return writeRefusal{code: codeMaintenance, message: message, retryAfter: retryAfter}, true
+	}
+	return writeRefusal{}, false
+}
+
+//writeRefusalFrom is the refusal refuseWritesInMaintenance left in ctx for the handler, false when writes go through
+func writeRefusalFrom(ctx context.Context) (writeRefusal, bool) {
+	refusal, ok := ctx.Value(writeRefusalKey).(writeRefusal)
+	return refusal, ok
+}
+
+//grpcMaintenance refuses the rpcs that change users while m is in maintenance, the grpc counterpart of refuseWritesInMaintenance
+func grpcMaintenance(m maintenanceSwitch) grpc.UnaryServerInterceptor {
+	writes := map[string]bool{
+		userpb.UserService_CreateUser_FullMethodName: true,
+		userpb.UserService_UpdateUser_FullMethodName: true,
+		userpb.UserService_DeleteUser_FullMethodName: true,
+	}
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if writes[info.FullMethod] {
+			if isReadOnly(ctx, m) {
+				return nil, status.Error(codes.Unavailable, readOnlyMessage)
+			}
+			if enabled, message := inMaintenance(ctx, m); enabled {
+				return nil, status.Error(codes.Unavailable, message)
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+//maintenanceRequest is the body of POST /admin/maintenance, enabled or read_only left out keeps what it is
+type maintenanceRequest struct {
+	Enabled  *bool  `json:"enabled"`
+	Message  string `json:"message"`
+	ReadOnly *bool  `json:"read_only"`
+}
+
+//getMaintenance answers with the maintenance state of this instance
+func getMaintenance(m maintenanceSwitch) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state, err := m.State(r.Context())
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		writeResponse(w, r, http.StatusOK, state)
+	}
+}
+
+//setMaintenance turns maintenance or read only on or off. the switch comes first and the audit event after it:
+//maintenance is turned on when the database is about to be busy, a failing audit write is logged rather than keeping
+//it off. read only turned on at runtime freezes the writes of the clients, the background jobs go on. turned off on an
+//instance started READ_ONLY it lets the writes through, but what runs in the background only starts with a restart
+func setMaintenance(db execer, m maintenanceSwitch) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in maintenanceRequest
+		if err := decodeRequest(r, &in); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+		in.Message = strings.TrimSpace(in.Message)
+		errs := model.FieldErrors{}
+		if in.Enabled == nil && in.ReadOnly == nil {
+			errs["enabled"] = "is required unless read_only is set"
+		}
+		if utf8.RuneCountInString(in.Message) > maxMaintenanceMessage {
+			errs["message"] = "must be at most " + strconv.Itoa(maxMaintenanceMessage) + " characters"
+		}
+		if len(errs) > 0 {
+			writeValidationError(w, r, errs)
+			return
+		}
+		state, err := m.State(r.Context())
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		if in.Enabled != nil {
+			state.Enabled = *in.Enabled
+		}
+		if in.ReadOnly != nil {
+			state.ReadOnly = *in.ReadOnly
+		}
+		state.Message, state.Since = in.Message, time.Now().UTC()
+		if err := m.Set(r.Context(), state); err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		//a read only database cant take the event, the log line below is all there is of the change
+		if !readOnlyDatabase {
+			event := auditEventFor(r.Context(), auditMaintenanceChanged)
+			event.Details = map[string]any{"enabled": state.Enabled, "message": state.Message, "read_only": state.ReadOnly}
+			if err := recordAudit(r.Context(), db, event); err != nil {
+				loggerFrom(r.Context()).Error("auditing the maintenance change", "enabled", state.Enabled, "read_only", state.ReadOnly, "error", err)
+			}
+		}
+		loggerFrom(r.Context()).Info("maintenance changed", "enabled", state.Enabled, "message", state.Message, "read_only", state.ReadOnly)
+		writeResponse(w, r, http.StatusOK, state)
+	}
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"api/internal/model"
+)
+
+//writeStatement matches the statements that change a database, upper cased
+var writeStatement = regexp.MustCompile(`\b(INSERT|UPDATE|DELETE|REPLACE|UPSERT|CREATE|DROP|ALTER|TRUNCATE)\b`)
+
+//statementLog keeps the write statements sent to the database through its connections, prepared ones when they run
+type statementLog struct {
+	mu     sync.Mutex
+	writes []string
+}
+
+func (l *statementLog) record(query string) {
+	if !writeStatement.MatchString(strings.ToUpper(query)) {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.writes = append(l.writes, query)
+}
+
+//take returns the writes logged since the last take
+func (l *statementLog) take() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	writes := l.writes
+	l.writes = nil
+	return writes
+}
+
+type loggingConnector struct {
+	driver.Connector
+	log *statementLog
+}
+
+func (c loggingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &loggingConn{Conn: conn, log: c.log}, nil
+}
+
+//loggingConn logs the statements of the connection underneath, which is a hookedConn and has all the optional
+//interfaces database/sql looks for
+type loggingConn struct {
+	driver.Conn
+	log *statementLog
+}
+
+func (c *loggingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &loggingStmt{Stmt: stmt, query: query, log: c.log}, nil
+}
+
+func (c *loggingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	res, err := c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		c.log.record(query)
+	}
+	return res, err
+}
+
+func (c *loggingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		c.log.record(query)
+	}
+	return rows, err
+}
+
+func (c *loggingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c *loggingConn) ResetSession(ctx context.Context) error {
+	return c.Conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+func (c *loggingConn) CheckNamedValue(nv *driver.NamedValue) error {
+	return c.Conn.(driver.NamedValueChecker).CheckNamedValue(nv)
+}
+
+type loggingStmt struct {
+	driver.Stmt
+	query string
+	log   *statementLog
+}
+
+func (s *loggingStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	s.log.record(s.query)
+	return s.Stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+}
+
+func (s *loggingStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	s.log.record(s.query)
+	return s.Stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+}
+
+//newReadOnlyTestServer starts a READ_ONLY server on the database of primary, whose writes go to log
+func newReadOnlyTestServer(t *testing.T, primary *testServer, log *statementLog) *testServer {
+	t.Helper()
+	cfg := *primary.cfg
+	cfg.ReadOnly = true
+	connector := wrapConnector(sqliteConnector(withSQLiteParams(cfg.DatabaseURL)), cfg.dbConnHooks())
+	ts := newTestServerOnDB(t, &cfg, sql.OpenDB(loggingConnector{Connector: connector, log: log}))
+	ts.mail = primary.mail
+	return ts
+}
+
+//readOnlyPathValues are what the variables of the route templates are filled in with
+var readOnlyPathValues = strings.NewReplacer("{actor}", "user:1", "{username}", "member", "{code}", codeNotFound)
+
+//readOnlyPathParam matches the variables of the route templates left after readOnlyPathValues
+var readOnlyPathParam = regexp.MustCompile(`\{[^}]+\}`)
+
+func TestReadOnlyWritesNothing(t *testing.T) {
+	primary := newTestServer(t, nil)
+	adminUser := primary.createUser("Admin", "admin@example.com", model.RoleAdmin)
+	admin := primary.tokenFor(adminUser)
+	m, member := primary.member()
+	res := primary.do("POST", "/api/v1/apikeys", admin, map[string]any{"label": "reports"})
+	expect(t, res, http.StatusCreated)
+	var key ApiKey
+	res.decode(t, &key)
+	expect(t, primary.do("POST", "/api/v1/groups", admin, map[string]any{"name": "engineering"}), http.StatusCreated)
+	impersonation := primary.impersonate(admin, m.Id)
+	res = primary.do("POST", "/api/v1/login", "", map[string]any{"email": m.Email, "password": "password123"})
+	expect(t, res, http.StatusOK)
+	var login tokenResponse
+	res.decode(t, &login)
+
+	log := &statementLog{}
+	ts := newReadOnlyTestServer(t, primary, log)
+	res = ts.do("GET", "/api/v1/openapi.json", "", nil)
+	expect(t, res, http.StatusOK)
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	res.decode(t, &spec)
+	if len(log.take()) != 0 {
+		t.Fatal("the read only server wrote while it started")
+	}
+
+	paths := slices.Sorted(func(yield func(string) bool) {
+		for path := range spec.Paths {
+			if !yield(path) {
+				return
+			}
+		}
+	})
+	refused := 0
+	for _, template := range paths {
+		path := "/api/v1" + readOnlyPathParam.ReplaceAllString(readOnlyPathValues.Replace(template), strconv.FormatInt(int64(m.Id), 10))
+		for method := range spec.Paths[template] {
+			method = strings.ToUpper(method)
+			switch {
+			case method == "GET" && (template == "/users/events" || template == "/ws"):
+				//they stream until the client leaves
+				continue
+			case method == "GET" || method == "HEAD":
+				//reads are answered, whatever they answer they dont write
+				ts.do(method, path, admin, nil)
+			case template == "/graphql":
+				//the queries are reads, see TestReadOnlyGraphQL
+				continue
+			case template == "/admin/maintenance":
+				//the switch stays writable, it is kept in memory
+				expect(t, ts.do(method, path, admin, map[string]any{"read_only": true}), http.StatusOK)
+			default:
+				res := ts.do(method, path, admin, "{}")
+				if res.StatusCode != http.StatusServiceUnavailable || res.errorCode() != codeReadOnly {
+					t.Errorf("%s %s: got %d: %s", method, path, res.StatusCode, res.body)
+				}
+				refused++
+			}
+			if writes := log.take(); len(writes) != 0 {
+				t.Errorf("%s %s wrote %q", method, path, writes)
+			}
+		}
+	}
+	//the bulk routes and the import are among them
+	for _, route := range []string{"/users", "/admin/import"} {
+		if _, ok := spec.Paths[route]; !ok {
+			t.Fatalf("%s isnt in the spec", route)
+		}
+	}
+	if refused < 20 {
+		t.Fatalf("only %d writes were tried", refused)
+	}
+
+	//the reads of the other callers: an api key isnt marked used, a member and a session arent touched, impersonation
+	//is refused since it cant be audited, the sign ins and refreshes are writes
+	expect(t, ts.do("GET", "/api/v1/users", "", nil, "X-API-Key", key.Key), http.StatusOK)
+	expect(t, ts.do("GET", "/api/v1/me", member, nil), http.StatusOK)
+	expect(t, ts.do("GET", "/api/v1/me", impersonation, nil), http.StatusServiceUnavailable)
+	expect(t, ts.do("POST", "/api/v1/login", "", map[string]any{"email": m.Email, "password": "password123"}), http.StatusServiceUnavailable)
+	expect(t, ts.do("POST", "/api/v1/token/refresh", "", map[string]any{"refresh_token": login.RefreshToken}), http.StatusServiceUnavailable)
+	if writes := log.take(); len(writes) != 0 {
+		t.Fatalf("the reads wrote %q", writes)
+	}
+
+	res = ts.do("GET", "/readyz", "", nil)
+	expect(t, res, http.StatusOK)
+	var ready struct {
+		ReadOnly bool `json:"read_only"`
+	}
+	res.decode(t, &ready)
+	if !ready.ReadOnly {
+		t.Fatalf("readyz answered %s", res.body)
+	}
+	//the background writers, like the jobs, dont run
+	time.Sleep(2 * time.Second)
+	if writes := log.take(); len(writes) != 0 {
+		t.Fatalf("the background wrote %q", writes)
+	}
+}
+
+func TestReadOnlyGraphQL(t *testing.T) {
+	primary := newTestServer(t, nil)
+	admin := primary.admin()
+	log := &statementLog{}
+	ts := newReadOnlyTestServer(t, primary, log)
+
+	res := ts.do("POST", "/api/v1/graphql", admin, map[string]any{"query": "{ users { id email } }"})
+	expect(t, res, http.StatusOK)
+	if !strings.Contains(string(res.body), "admin@example.com") {
+		t.Fatalf("query answered %s", res.body)
+	}
+	res = ts.do("POST", "/api/v1/graphql", admin, map[string]any{
+		"query":         `query Read { users { id } } mutation Write { createUser(input: {name: "Ada", email: "ada@example.com", password: "password123"}) { id } }`,
+		"operationName": "Write"})
+	expect(t, res, http.StatusServiceUnavailable)
+	if !strings.Contains(string(res.body), codeReadOnly) {
+		t.Fatalf("mutation answered %s", res.body)
+	}
+	if writes := log.take(); len(writes) != 0 {
+		t.Fatalf("graphql wrote %q", writes)
+	}
+	if n := primary.count("users", ""); n != 1 {
+		t.Fatalf("%d users", n)
+	}
+}
+
+func TestMaintenanceGraphQL(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	expect(t, ts.do("POST", "/api/v1/admin/maintenance", admin, map[string]any{"enabled": true, "message": "migrating"}), http.StatusOK)
+
+	expect(t, ts.do("POST", "/api/v1/graphql", admin, map[string]any{"query": "{ users { id } }"}), http.StatusOK)
+	res := ts.do("POST", "/api/v1/graphql", admin, map[string]any{"query": `mutation { createUser(input: {name: "Ada", email: "ada@example.com", password: "password123"}) { id } }`})
+	expect(t, res, http.StatusServiceUnavailable)
+	if res.Header.Get("Retry-After") == "" || !strings.Contains(string(res.body), "migrating") {
+		t.Fatalf("mutation answered %s with Retry-After %q", res.body, res.Header.Get("Retry-After"))
+	}
+	if n := ts.count("users", ""); n != 1 {
+		t.Fatalf("%d users", n)
+	}
+
+	expect(t, ts.do("POST", "/api/v1/admin/maintenance", admin, map[string]any{"enabled": false}), http.StatusOK)
+	expect(t, ts.do("POST", "/api/v1/graphql", admin, map[string]any{"query": `mutation { createUser(input: {name: "Ada", email: "ada@example.com", password: "password123"}) { id } }`}), http.StatusOK)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//profileUpdate is the body of PUT /api/v1/me. only these fields can be changed by the caller themselves,
+//role and password are rejected as unknown fields
+type profileUpdate struct {
+	Name     string  `json:"name"`
+	Email    string  `json:"email"`
+	Username string  `json:"username"`
+	Phone    *string `json:"phone"`
+	Locale   string  `json:"locale"`
+	Timezone string  `json:"timezone"`
+}
+
+//currentUserId returns the id of the user making the request
+//api keys dont belong to a user, so requests made with one are refused
+func currentUserId(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	p, ok := principalFromContext(r.Context())
+	if !ok {
+		writeUnauthorized(w, r, "authentication required")
+		return 0, false
+	}
+	if p.UserId == 0 {
+		writeForbidden(w, r, "this endpoint needs a user access token, not an api key")
+		return 0, false
+	}
+	return p.UserId, true
+}
+
+//getMe returns the profile of the authenticated caller, so the frontend doesnt need to decode the token itself
+func getMe(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := currentUserId(w, r)
+		if !ok {
+			return
+		}
+
+		var u model.User
+		err := store.ScanUser(db.QueryRowContext(r.Context(), "SELECT "+store.UserColumns+" FROM users WHERE id = $1", id), &u)
+		if errors.Is(err, sql.ErrNoRows) {
+			//deleted after the token was checked, the token no longer stands for anyone
+			writeUnauthorized(w, r, "the user this access token was issued for no longer exists")
+			return
+		}
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("loading current user: %w", err))
+			return
+		}
+		if checkNotModified(w, r, userETag(u), u.UpdatedAt) {
+			return
+		}
+		writeResponse(w, r, http.StatusOK, u)
+	}
+}
+
+//updateMe lets any authenticated user change their own name, email, username, phone, locale and timezone, no admin role needed
+func (s *userService) updateMe(w http.ResponseWriter, r *http.Request) {
+	id, ok := currentUserId(w, r)
+	if !ok {
+		return
+	}
+
+	var body profileUpdate
+	if err := decodeRequest(r, &body); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	u := model.User{Name: body.Name, Email: body.Email, Username: body.Username, Phone: body.Phone, Locale: body.Locale, Timezone: body.Timezone}
+	if errs := u.Validate(); errs != nil {
+		writeValidationError(w, r, errs)
+		return
+	}
+
+	//role stays empty, so saveUser keeps the current one
+	s.saveUser(w, r, id, u)
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+//methodOverrideHeader lets clients that can only send GET and POST send the other methods as a POST
+const methodOverrideHeader = "X-HTTP-Method-Override"
+
+//overridableMethods are the methods a POST can be turned into, the ones those clients cant send themselves
+var overridableMethods = map[string]bool{http.MethodPut: true, http.MethodPatch: true, http.MethodDelete: true}
+
+//overrideMethod turns a POST with methodOverrideHeader into the method of the header before anything else sees the
+//request, so the router, the authorization and the handlers all see the request as if it had been sent with it.
+//a POST with any other method in the header is answered with 400, the header is ignored on every other method.
+//the access log keeps the method that was sent and adds the one used, see overriddenMethod
+func overrideMethod(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, ok := overriddenMethod(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !overridableMethods[method] {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, methodOverrideHeader+" must be PUT, PATCH or DELETE")
+			return
+		}
+		//a copy, the access log keeps the request that was sent
+		r = r.WithContext(r.Context())
+		r.Method = method
+		next.ServeHTTP(w, r)
+	})
+}
+
+//overriddenMethod is the method in methodOverrideHeader of a POST, ok is false for requests without one
+func overriddenMethod(r *http.Request) (string, bool) {
+	if r.Method != http.MethodPost {
+		return "", false
+	}
+	method := strings.ToUpper(strings.TrimSpace(r.Header.Get(methodOverrideHeader)))
+	return method, method != ""
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"api/internal/model"
+	"api/requestid"
+)
+
+func TestMethodOverride(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	m, member := ts.member()
+	u := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+
+	//bogus values are refused and change nothing
+	for _, method := range []string{"TRACE", "GET", "POST", "CONNECT", "DELETE, PUT", "DELET"} {
+		res := ts.do("POST", userPath(u.Id), admin, nil, methodOverrideHeader, method)
+		if res.StatusCode != http.StatusBadRequest || res.errorCode() != codeInvalidRequest {
+			t.Fatalf("override %q answered %d: %s", method, res.StatusCode, res.body)
+		}
+	}
+	//the header means nothing on anything but a POST
+	expect(t, ts.do("GET", userPath(u.Id), admin, nil, methodOverrideHeader, "DELETE"), http.StatusOK)
+
+	//the role checks see the effective method, a member cant delete by posting
+	expect(t, ts.do("POST", userPath(u.Id), member, nil, methodOverrideHeader, "DELETE"), http.StatusForbidden)
+	expect(t, ts.do("POST", userPath(m.Id), member, map[string]any{"name": "Admin", "email": m.Email, "role": model.RoleAdmin}, methodOverrideHeader, "PUT"), http.StatusForbidden)
+	if n := ts.count("users", "id = $1", u.Id); n != 1 {
+		t.Fatal("a refused override deleted the user")
+	}
+
+	res := ts.do("POST", userPath(u.Id), admin, map[string]any{"name": "Ada Lovelace", "email": "ada@example.com"}, methodOverrideHeader, "put")
+	expect(t, res, http.StatusOK)
+	expect(t, ts.do("POST", userPath(u.Id), admin, nil, methodOverrideHeader, "DELETE"), http.StatusNoContent)
+	if n := ts.count("users", "id = $1", u.Id); n != 0 {
+		t.Fatal("the overridden delete left the user")
+	}
+	expect(t, ts.do("GET", userPath(u.Id), admin, nil), http.StatusNotFound)
+}
+
+func TestMethodOverrideAccessLog(t *testing.T) {
+	var logs syncBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	var seen string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Method
+		w.WriteHeader(http.StatusNoContent)
+	})
+	srv := requestid.Middleware(withLogger(logger, accessLog(nil, overrideMethod(handler))))
+
+	r := httptest.NewRequest("POST", "/api/v1/users/1", nil)
+	r.Header.Set(methodOverrideHeader, "DELETE")
+	srv.ServeHTTP(httptest.NewRecorder(), r)
+	if seen != http.MethodDelete {
+		t.Fatalf("the handler saw %s", seen)
+	}
+	if out := logs.String(); !strings.Contains(out, "method=POST") || !strings.Contains(out, "effective_method=DELETE") {
+		t.Fatalf("the override was logged as %s", out)
+	}
+
+	//a request without an override has no effective method in its line
+	before := len(logs.String())
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/v1/users", nil))
+	if out := logs.String()[before:]; seen != http.MethodPost || !strings.Contains(out, "method=POST") || strings.Contains(out, "effective_method") {
+		t.Fatalf("a plain post saw %s and was logged as %s", seen, out)
+	}
+}
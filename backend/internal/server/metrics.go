@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+//http metrics, labelled by route template (e.g. /api/v1/users/{id}) instead of the raw path so the number of series stays bounded
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests handled, by route template, method and status code.",
+	}, []string{"route", "method", "status"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Time spent handling HTTP requests, by route template, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+	//load shedding, see limitConcurrency
+	httpRequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "http_requests_in_flight",
+		Help: "Requests currently holding a slot of the concurrency limiter.",
+	})
+	httpRequestsShed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "http_requests_shed_total",
+		Help: "Requests refused with 503 because the concurrency limit was reached.",
+	})
+	//queries that took at least Config.SlowQueryThreshold, see connHooks
+	dbSlowQueries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "db_slow_queries_total",
+		Help: "Database queries that ran for at least the slow query threshold.",
+	})
+	//lookups in the caches in front of the store, see userCache. cache is local (in-process) or redis
+	userCacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "user_cache_hits_total",
+		Help: "User lookups served from a cache, by cache.",
+	}, []string{"cache"})
+	userCacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "user_cache_misses_total",
+		Help: "User lookups a cache did not have, by cache.",
+	}, []string{"cache"})
+	//reads that waited for the same read of another caller instead of querying themselves, see coalescingStore.
+	//read is get or list
+	userStoreReadsCoalesced = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "user_store_reads_coalesced_total",
+		Help: "User store reads that shared the query of a concurrent identical read, by read.",
+	}, []string{"read"})
+	//the dumps the server writes on EXPORT_SCHEDULE, see runScheduledExports. result is success, failure or skipped,
+	//skipped when another instance was running the export already
+	scheduledExports = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "scheduled_exports_total",
+		Help: "Scheduled exports run, by result.",
+	}, []string{"result"})
+	scheduledExportLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "scheduled_export_last_success_timestamp_seconds",
+		Help: "Unix time the last scheduled export of this instance was written.",
+	})
+	//the syncs from the ldap directory on LDAP_SYNC_SCHEDULE, see ldapSyncer.runScheduled. result is like scheduledExports
+	ldapSyncs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ldap_syncs_total",
+		Help: "Scheduled ldap syncs run, by result.",
+	}, []string{"result"})
+)
+
+//RegisterMetrics registers the http metrics, the requests by client version, the slow query, user cache, coalesced read, scheduled export and ldap sync counters, the user gauges
+//and the connection pool stats of db and of the read replica when there is one, which are read on every scrape. the pools are told apart by the db_name label
+func RegisterMetrics(db, replica *sql.DB) {
+	prometheus.MustRegister(httpRequests, httpRequestDuration, httpRequestsByClientVersion, httpRequestsInFlight, httpRequestsShed, dbSlowQueries, userCacheHits, userCacheMisses, userLookupsThrottled,
+		userStoreReadsCoalesced, scheduledExports, scheduledExportLastSuccess, ldapSyncs, jobsProcessed, usersByState, usersCreatedLastDay, userMetricsErrors, userMetricsLastSuccess,
+		collectors.NewDBStatsCollector(db, "postgres"))
+	if replica != nil {
+		prometheus.MustRegister(collectors.NewDBStatsCollector(replica, "postgres_replica"))
+	}
+}
+
+//unmatchedRoute labels requests no route matched, e.g. 404s for unknown paths
+const unmatchedRoute = "unmatched"
+
+//metricsMiddleware records the count and duration of every request
+//the route is only known once the router matched it, so recordRouteTemplate (registered with router.Use) writes it back
+//into a slot put into the context by withRouteSlot
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, route := withRouteSlot(r)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		labels := prometheus.Labels{"route": *route, "method": r.Method, "status": strconv.Itoa(rec.statusCode())}
+		httpRequests.With(labels).Inc()
+		httpRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+		countClientVersion(r)
+	})
+}
+
+//withRouteSlot makes sure the request context has a slot for the route template and returns it
+//the slot is shared, so the access log and the metrics middleware both see the template the router filled in
+func withRouteSlot(r *http.Request) (*http.Request, *string) {
+	if slot, ok := r.Context().Value(routeLabelKey).(*string); ok {
+		return r, slot
+	}
+	route := unmatchedRoute
+	return r.WithContext(context.WithValue(r.Context(), routeLabelKey, &route)), &route
+}
+
+//recordRouteTemplate runs inside the router after a route matched and hands its template to metricsMiddleware
+func recordRouteTemplate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slot, ok := r.Context().Value(routeLabelKey).(*string); ok {
+			if route := mux.CurrentRoute(r); route != nil {
+				if template, err := route.GetPathTemplate(); err == nil {
+					*slot = template
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
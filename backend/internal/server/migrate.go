@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"api/internal/store"
+)
+
+//migrationFiles are the schema changes, a directory per database driver with one file per change named <version>_<name>.sql.
+//a migration that has been applied must never be edited, add a new one instead
+//
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+//migrationLockId serializes the migrations of instances starting at the same time, like outboxRelayLockId
+const migrationLockId = 7268002
+
+//migration is one file of migrations/<driver>
+type migration struct {
+	version  int
+	name     string
+	sql      string
+	checksum string
+}
+
+//loadMigrations reads the embedded migrations of driver ordered by version
+func loadMigrations(driver string) ([]migration, error) {
+	names, err := fs.Glob(migrationFiles, "migrations/"+driver+"/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	var migrations []migration
+	for _, name := range names {
+		base := strings.TrimSuffix(path.Base(name), ".sql")
+		prefix, rest, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || version < 1 {
+			return nil, fmt.Errorf("migration %s must be named <version>_<name>.sql", name)
+		}
+		content, err := migrationFiles.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(content)
+		migrations = append(migrations, migration{version: version, name: rest, sql: string(content), checksum: hex.EncodeToString(sum[:])})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version == migrations[i-1].version {
+			return nil, fmt.Errorf("two migrations have version %d", migrations[i].version)
+		}
+	}
+	return migrations, nil
+}
+
+//applyMigrations brings the database schema up to date. every pending migration runs in a transaction of its own
+//together with its row in schema_migrations, so it is either applied and recorded or not at all.
+//a migration whose file changed since it was applied stops the startup, the database no longer matches what the code expects
+func applyMigrations(ctx context.Context, db *sql.DB, driver string, logger *slog.Logger) error {
+	migrations, err := loadMigrations(driver)
+	if err != nil {
+		return fmt.Errorf("loading migrations: %w", err)
+	}
+	//everything runs on one connection, the lock of mysql belongs to the connection that took it
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if driver == dbDriverMySQL {
+		unlock, err := lockMySQLMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	//the lock keeps two instances from creating the table at the same time
+	appliedAtType := "TIMESTAMPTZ"
+	if driver == dbDriverMySQL {
+		appliedAtType = "DATETIME(6)"
+	}
+	err = inTx(ctx, conn, func(tx *sql.Tx) error {
+		if err := lockMigrations(ctx, tx, driver); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			checksum VARCHAR(64) NOT NULL,
+			applied_at `+appliedAtType+` NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("creating schema_migrations: %w", err)
+	}
+
+	applied := 0
+	for _, m := range migrations {
+		ran := false
+		err := inTx(ctx, conn, func(tx *sql.Tx) error {
+			//another instance may have applied it while this one waited for the lock
+			if err := lockMigrations(ctx, tx, driver); err != nil {
+				return err
+			}
+			var checksum string
+			err := tx.QueryRowContext(ctx, "SELECT checksum FROM schema_migrations WHERE version = $1", m.version).Scan(&checksum)
+			if err == nil {
+				if checksum != m.checksum {
+					return errors.New("checksum mismatch, the file was changed after it was applied")
+				}
+				return nil
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+				return err
+			}
+			ran = true
+			_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)", m.version, m.name, m.checksum)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %04d_%s: %w", m.version, m.name, err)
+		}
+		if ran {
+			logger.Info("applied migration", "version", m.version, "name", m.name)
+			applied++
+		}
+	}
+	logger.Info("database schema is up to date", "applied", applied, "migrations", len(migrations))
+	return nil
+}
+
+//checkMigrations fails when the database is behind the migrations, without writing anything, for READ_ONLY
+func checkMigrations(ctx context.Context, db *sql.DB, driver string, logger *slog.Logger) error {
+	migrations, err := loadMigrations(driver)
+	if err != nil {
+		return fmt.Errorf("loading migrations: %w", err)
+	}
+	version, err := SchemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	if latest := migrations[len(migrations)-1].version; version < latest {
+		return fmt.Errorf("the database is at schema version %d and this version of the api needs %d, it is read only so migrate the primary first", version, latest)
+	}
+	logger.Info("database schema is up to date, read only so it wasnt migrated", "version", version)
+	return nil
+}
+
+//lockMigrations holds the migration lock of postgres until tx ends. sqlite needs none, its transactions take the write lock
+//when they begin (see OpenDB), and mysql commits in the middle of a migration so it is locked for the whole run instead
+func lockMigrations(ctx context.Context, tx *sql.Tx, driver string) error {
+	if driver != dbDriverPostgres {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLockId)
+	return err
+}
+
+//lockMySQLMigrations takes mysql's named lock for conn, the returned func releases it
+func lockMySQLMigrations(ctx context.Context, conn *sql.Conn) (func(), error) {
+	name := "migrations-" + strconv.Itoa(migrationLockId)
+	var locked sql.NullInt64
+	//a negative timeout waits for as long as it takes
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK($1, -1)", name).Scan(&locked); err != nil {
+		return nil, fmt.Errorf("locking migrations: %w", err)
+	}
+	if locked.Int64 != 1 {
+		return nil, errors.New("locking migrations: GET_LOCK failed")
+	}
+	return func() { conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK($1)", name) }, nil
+}
+
+//txBeginner is implemented by both *sql.DB and *sql.Conn
+type txBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+//inTx runs fn in a transaction and commits it when fn succeeds
+func inTx(ctx context.Context, db txBeginner, fn func(*sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+//SchemaVersion is the version of the newest migration applied to the database, 0 before the first one
+func SchemaVersion(ctx context.Context, q store.QueryRower) (int, error) {
+	var version sql.NullInt64
+	if err := q.QueryRowContext(ctx, "SELECT max(version) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, fmt.Errorf("reading schema version: %w", err)
+	}
+	return int(version.Int64), nil
+}
@@ -0,0 +1,116 @@
+-- the schema of postgres migration 0009 in mysql's dialect, for deployments that only have mysql or mariadb.
+-- serial ids become auto_increment, timestamptz becomes datetime(6) holding utc (see openMySQL), jsonb becomes json,
+-- bytea becomes longblob and text keys become varchar so they can be indexed. a later schema change needs a migration here too.
+-- mysql commits before and after every CREATE, so unlike on postgres a failing migration can leave some tables behind
+
+CREATE TABLE users (
+	id INTEGER PRIMARY KEY AUTO_INCREMENT,
+	name VARCHAR(255),
+	-- the default _ci collation compares case insensitively, the unique key is what lower(email) is elsewhere
+	email VARCHAR(255) UNIQUE,
+	version INTEGER NOT NULL DEFAULT 1,
+	updated_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	password_hash VARCHAR(255),
+	google_subject VARCHAR(255) UNIQUE,
+	role VARCHAR(16) NOT NULL DEFAULT 'member' CHECK (role IN ('admin', 'member')),
+	email_verified_at DATETIME(6),
+	pending_email VARCHAR(255),
+	pending_email_token_hash VARCHAR(64),
+	pending_email_expires_at DATETIME(6),
+	active BOOLEAN NOT NULL DEFAULT true
+);
+
+CREATE TABLE refresh_tokens (
+	id INTEGER PRIMARY KEY AUTO_INCREMENT,
+	user_id INTEGER NOT NULL,
+	token_hash VARCHAR(64) NOT NULL UNIQUE,
+	family_id VARCHAR(64) NOT NULL,
+	expires_at DATETIME(6) NOT NULL,
+	used_at DATETIME(6),
+	revoked BOOLEAN NOT NULL DEFAULT false,
+	created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	INDEX refresh_tokens_family_id_idx (family_id),
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE api_keys (
+	id INTEGER PRIMARY KEY AUTO_INCREMENT,
+	label VARCHAR(255) NOT NULL,
+	key_hash VARCHAR(64) NOT NULL,
+	created_by INTEGER,
+	created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	last_used_at DATETIME(6),
+	role VARCHAR(16) NOT NULL DEFAULT 'member' CHECK (role IN ('admin', 'member')),
+	rate_limit_per_minute INTEGER CHECK (rate_limit_per_minute > 0),
+	FOREIGN KEY (created_by) REFERENCES users (id) ON DELETE SET NULL
+);
+
+CREATE TABLE api_key_usage (
+	api_key_id INTEGER NOT NULL,
+	day DATE NOT NULL,
+	requests INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (api_key_id, day),
+	FOREIGN KEY (api_key_id) REFERENCES api_keys (id) ON DELETE CASCADE
+);
+
+CREATE TABLE idempotency_keys (
+	`key` VARCHAR(255) PRIMARY KEY,
+	request_hash VARCHAR(64) NOT NULL,
+	status INTEGER,
+	headers JSON,
+	body LONGBLOB,
+	created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)
+);
+
+CREATE TABLE sessions (
+	id_hash VARCHAR(64) PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	expires_at DATETIME(6) NOT NULL,
+	created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	created_ip VARCHAR(64) NOT NULL DEFAULT '',
+	user_agent TEXT NOT NULL,
+	INDEX sessions_expires_at_idx (expires_at),
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE password_resets (
+	token_hash VARCHAR(64) PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	expires_at DATETIME(6) NOT NULL,
+	used_at DATETIME(6),
+	created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE verification_tokens (
+	token_hash VARCHAR(64) PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	email VARCHAR(255) NOT NULL,
+	expires_at DATETIME(6) NOT NULL,
+	used_at DATETIME(6),
+	created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE audit_events (
+	id BIGINT PRIMARY KEY AUTO_INCREMENT,
+	created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	actor_id INTEGER,
+	impersonated_user_id INTEGER,
+	action VARCHAR(64) NOT NULL,
+	target_user_id INTEGER,
+	details JSON,
+	diff JSON,
+	actor_api_key_id INTEGER,
+	INDEX audit_events_target_user_id_idx (target_user_id, id)
+);
+
+CREATE TABLE outbox (
+	id BIGINT PRIMARY KEY AUTO_INCREMENT,
+	event_id VARCHAR(64) NOT NULL UNIQUE,
+	type VARCHAR(64) NOT NULL,
+	payload JSON NOT NULL,
+	created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	published_at DATETIME(6),
+	INDEX outbox_published_at_idx (published_at, id)
+);
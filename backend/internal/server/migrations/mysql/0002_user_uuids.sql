@@ -0,0 +1,10 @@
+-- postgres migration 0010 in mysql's dialect. a trigger fills in the uuid instead of a column default,
+-- mariadb and older mysql versions dont take a function as default. the empty default only keeps strict mode from
+-- refusing inserts that leave the column out, the trigger replaces it before the row is written
+ALTER TABLE users ADD COLUMN uuid CHAR(36) NOT NULL DEFAULT '';
+
+UPDATE users SET uuid = UUID();
+
+ALTER TABLE users ADD UNIQUE KEY users_uuid_key (uuid);
+
+CREATE TRIGGER users_uuid BEFORE INSERT ON users FOR EACH ROW SET NEW.uuid = IF(NEW.uuid = '', UUID(), NEW.uuid);
@@ -0,0 +1,5 @@
+-- postgres migration 0011 in mysql's dialect. like for email the _ci collation compares case insensitively,
+-- so a plain unique key does what the index on lower(username) does in postgres
+ALTER TABLE users ADD COLUMN username VARCHAR(30) NULL;
+
+ALTER TABLE users ADD UNIQUE KEY users_username_key (username);
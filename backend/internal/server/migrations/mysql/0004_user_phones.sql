@@ -0,0 +1,4 @@
+-- postgres migration 0012 in mysql's dialect, E.164 numbers are at most 16 characters with the +
+ALTER TABLE users ADD COLUMN phone VARCHAR(16) NULL;
+
+ALTER TABLE users ADD INDEX users_phone_idx (phone);
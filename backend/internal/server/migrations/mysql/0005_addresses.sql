@@ -0,0 +1,13 @@
+-- postgres migration 0013 in mysql's dialect
+CREATE TABLE addresses (
+	id INTEGER PRIMARY KEY AUTO_INCREMENT,
+	user_id INTEGER NOT NULL,
+	label VARCHAR(100) NOT NULL DEFAULT '',
+	line1 VARCHAR(255) NOT NULL,
+	line2 VARCHAR(255) NOT NULL DEFAULT '',
+	city VARCHAR(255) NOT NULL,
+	postal_code VARCHAR(20) NOT NULL DEFAULT '',
+	country CHAR(2) NOT NULL,
+	INDEX addresses_user_id_idx (user_id, id),
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
@@ -0,0 +1,18 @@
+-- postgres migration 0014 in mysql's dialect. groups is a reserved word in mysql 8, the queries quote it like a name in postgres (see openMySQL)
+CREATE TABLE `groups` (
+	id INTEGER PRIMARY KEY AUTO_INCREMENT,
+	name VARCHAR(100) NOT NULL,
+	description TEXT NOT NULL,
+	created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	UNIQUE KEY groups_name_key (name)
+);
+
+CREATE TABLE group_members (
+	group_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	added_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	PRIMARY KEY (group_id, user_id),
+	INDEX group_members_user_id_idx (user_id),
+	FOREIGN KEY (group_id) REFERENCES `groups` (id) ON DELETE CASCADE,
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
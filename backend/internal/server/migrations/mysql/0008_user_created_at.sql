@@ -0,0 +1,5 @@
+-- postgres migration 0016 in mysql's dialect. adding the column with its default would fill it in for the existing users,
+-- so the default is set in a second step that leaves them at null
+ALTER TABLE users ADD COLUMN created_at DATETIME(6) NULL;
+
+ALTER TABLE users MODIFY created_at DATETIME(6) NULL DEFAULT CURRENT_TIMESTAMP(6);
@@ -0,0 +1,4 @@
+-- postgres migration 0017 in mysql's dialect. the unique key on email compares ignoring case under the _ci collation,
+-- so no two users can collide and only the case of the stored addresses changes. BINARY makes the comparison see the case
+UPDATE users SET email = lower(email) WHERE BINARY email <> lower(email);
+UPDATE users SET pending_email = lower(pending_email) WHERE BINARY pending_email <> lower(pending_email);
@@ -0,0 +1,4 @@
+-- postgres migration 0018 in mysql's dialect, without the trigram index: mysql has no pg_trgm
+ALTER TABLE users ADD COLUMN merged_into_id INTEGER NULL;
+
+ALTER TABLE users ADD CONSTRAINT users_merged_into_id_fkey FOREIGN KEY (merged_into_id) REFERENCES users (id) ON DELETE SET NULL;
@@ -0,0 +1,2 @@
+-- postgres migration 0019 in mysql's dialect
+ALTER TABLE users ADD COLUMN external_id VARCHAR(255) NULL UNIQUE;
@@ -0,0 +1,2 @@
+-- postgres migration 0020 in mysql's dialect, long enough for an ipv6 address with a zone
+ALTER TABLE audit_events ADD COLUMN ip VARCHAR(64) NULL;
@@ -0,0 +1,9 @@
+-- postgres migration 0022 in mysql's dialect
+CREATE TABLE notification_prefs (
+	user_id INTEGER PRIMARY KEY,
+	welcome_email BOOLEAN NOT NULL DEFAULT true,
+	marketing BOOLEAN NOT NULL DEFAULT false,
+	security_alerts BOOLEAN NOT NULL DEFAULT true,
+	updated_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
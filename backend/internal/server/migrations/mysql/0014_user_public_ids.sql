@@ -0,0 +1,67 @@
+-- postgres migration 0023 in mysql's dialect, with the ulid spelled out like in sqlite. a trigger fills it in like the uuid,
+-- the empty default only keeps strict mode from refusing inserts that leave the column out
+ALTER TABLE users ADD COLUMN public_id CHAR(26) NOT NULL DEFAULT '';
+
+CREATE TEMPORARY TABLE user_public_id_times AS
+	SELECT id, FLOOR(UNIX_TIMESTAMP(COALESCE(created_at, updated_at)) * 1000) AS ms FROM users;
+
+UPDATE users JOIN user_public_id_times t ON t.id = users.id SET public_id = CONCAT(
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((t.ms >> 45) & 31) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((t.ms >> 40) & 31) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((t.ms >> 35) & 31) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((t.ms >> 30) & 31) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((t.ms >> 25) & 31) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((t.ms >> 20) & 31) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((t.ms >> 15) & 31) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((t.ms >> 10) & 31) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((t.ms >> 5) & 31) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((t.ms >> 0) & 31) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1));
+
+DROP TEMPORARY TABLE user_public_id_times;
+
+ALTER TABLE users ADD UNIQUE KEY users_public_id_key (public_id);
+
+CREATE TRIGGER users_public_id BEFORE INSERT ON users FOR EACH ROW SET NEW.public_id = IF(NEW.public_id = '', (SELECT CONCAT(
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((clock.ms >> 45) & 31) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((clock.ms >> 40) & 31) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((clock.ms >> 35) & 31) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((clock.ms >> 30) & 31) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((clock.ms >> 25) & 31) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((clock.ms >> 20) & 31) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((clock.ms >> 15) & 31) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((clock.ms >> 10) & 31) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((clock.ms >> 5) & 31) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((clock.ms >> 0) & 31) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1),
+		SUBSTRING('0123456789ABCDEFGHJKMNPQRSTVWXYZ', FLOOR(RAND() * 32) + 1, 1))
+	FROM (SELECT FLOOR(UNIX_TIMESTAMP(NOW(3)) * 1000) AS ms) clock), NEW.public_id);
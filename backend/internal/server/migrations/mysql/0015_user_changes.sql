@@ -0,0 +1,14 @@
+-- postgres migration 0024 in mysql's dialect
+CREATE TABLE user_change_seq (
+	id INTEGER PRIMARY KEY CHECK (id = 1),
+	last_seq BIGINT NOT NULL
+);
+INSERT INTO user_change_seq (id, last_seq) VALUES (1, 0);
+CREATE TABLE user_changes (
+	seq BIGINT PRIMARY KEY,
+	created_at DATETIME(6) NOT NULL,
+	operation VARCHAR(16) NOT NULL,
+	user_id INTEGER NOT NULL,
+	state JSON,
+	INDEX user_changes_created_at_idx (created_at)
+);
@@ -0,0 +1,15 @@
+-- postgres migration 0025 in mysql's dialect. mysql only lets the columns of a foreign key change their type with
+-- the checks off, they are turned on again at the end
+SET FOREIGN_KEY_CHECKS = 0;
+ALTER TABLE users MODIFY id BIGINT NOT NULL AUTO_INCREMENT, MODIFY merged_into_id BIGINT NULL;
+ALTER TABLE refresh_tokens MODIFY user_id BIGINT NOT NULL;
+ALTER TABLE api_keys MODIFY created_by BIGINT;
+ALTER TABLE sessions MODIFY user_id BIGINT NOT NULL;
+ALTER TABLE password_resets MODIFY user_id BIGINT NOT NULL;
+ALTER TABLE verification_tokens MODIFY user_id BIGINT NOT NULL;
+ALTER TABLE audit_events MODIFY actor_id BIGINT, MODIFY impersonated_user_id BIGINT, MODIFY target_user_id BIGINT;
+ALTER TABLE addresses MODIFY user_id BIGINT NOT NULL;
+ALTER TABLE group_members MODIFY user_id BIGINT NOT NULL;
+ALTER TABLE notification_prefs MODIFY user_id BIGINT;
+ALTER TABLE user_changes MODIFY user_id BIGINT NOT NULL;
+SET FOREIGN_KEY_CHECKS = 1;
@@ -0,0 +1,4 @@
+-- postgres migration 0026 in mysql's dialect
+ALTER TABLE users ADD COLUMN last_login_at DATETIME(6) NULL;
+
+CREATE INDEX users_last_login_at_idx ON users (last_login_at);
@@ -0,0 +1,3 @@
+-- postgres migration 0027 in mysql's dialect
+ALTER TABLE users ADD COLUMN credentials_revoked_at DATETIME(6) NULL;
+ALTER TABLE users ADD COLUMN password_change_required BOOLEAN NOT NULL DEFAULT false;
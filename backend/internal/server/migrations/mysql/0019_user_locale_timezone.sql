@@ -0,0 +1,3 @@
+-- postgres migration 0028 in mysql's dialect, language tags are kept to 35 characters and zone names to 64
+ALTER TABLE users ADD COLUMN locale VARCHAR(35) NULL;
+ALTER TABLE users ADD COLUMN timezone VARCHAR(64) NOT NULL DEFAULT 'UTC';
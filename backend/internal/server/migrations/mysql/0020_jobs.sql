@@ -0,0 +1,14 @@
+-- postgres migration 0029 in mysql's dialect, without partial indexes the due index covers the failed jobs as well
+CREATE TABLE jobs (
+	id BIGINT PRIMARY KEY AUTO_INCREMENT,
+	type VARCHAR(64) NOT NULL,
+	payload JSON NOT NULL,
+	status VARCHAR(16) NOT NULL DEFAULT 'pending',
+	run_after DATETIME(6) NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT,
+	created_at DATETIME(6) NOT NULL,
+	updated_at DATETIME(6) NOT NULL,
+	INDEX jobs_due_idx (run_after, id),
+	INDEX jobs_status_idx (status, id)
+);
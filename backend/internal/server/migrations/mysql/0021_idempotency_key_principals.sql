@@ -0,0 +1,2 @@
+-- postgres migration 0030 in mysql's dialect
+ALTER TABLE idempotency_keys ADD COLUMN principal VARCHAR(64) NOT NULL DEFAULT '', DROP PRIMARY KEY, ADD PRIMARY KEY (principal, `key`);
@@ -0,0 +1,18 @@
+-- the migrations up to 0009 come from the schema the api used to create at startup. they keep its IF NOT EXISTS
+-- guards so databases set up that way, or still at the original three column users table, are brought up to date
+
+-- id serial primary key: id is an auto incrementing pri key
+-- the rest are text fields
+CREATE TABLE IF NOT EXISTS users (id SERIAL PRIMARY KEY, name TEXT, email TEXT);
+
+-- version is bumped on every write and exposed as the etag for optimistic concurrency
+ALTER TABLE users ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+
+-- updated_at is set on every write and drives the last-modified header
+ALTER TABLE users ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+-- bcrypt hash, null for users that never set a password. never selected by the read paths
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_hash TEXT;
+
+-- the google account (id token sub claim) a user signs in with, if any
+ALTER TABLE users ADD COLUMN IF NOT EXISTS google_subject TEXT UNIQUE;
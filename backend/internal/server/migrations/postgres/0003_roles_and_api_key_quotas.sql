@@ -0,0 +1,14 @@
+-- admins can change users, members can only read them
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'member' CHECK (role IN ('admin', 'member'));
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'member' CHECK (role IN ('admin', 'member'));
+
+-- per key quota, null means the default rate limit
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS rate_limit_per_minute INTEGER CHECK (rate_limit_per_minute > 0);
+
+-- requests per api key and utc day
+CREATE TABLE IF NOT EXISTS api_key_usage (
+	api_key_id INTEGER NOT NULL REFERENCES api_keys (id) ON DELETE CASCADE,
+	day DATE NOT NULL,
+	requests BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (api_key_id, day)
+);
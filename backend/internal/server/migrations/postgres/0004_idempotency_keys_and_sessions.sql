@@ -0,0 +1,20 @@
+-- responses of requests sent with an Idempotency-Key, status stays null while the first request is running
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	key TEXT PRIMARY KEY,
+	request_hash TEXT NOT NULL,
+	status INTEGER,
+	headers JSONB,
+	body BYTEA,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- cookie sessions, the id is stored hashed like refresh tokens
+CREATE TABLE IF NOT EXISTS sessions (
+	id_hash TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	expires_at TIMESTAMPTZ NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	created_ip TEXT NOT NULL DEFAULT '',
+	user_agent TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS sessions_expires_at_idx ON sessions (expires_at);
@@ -0,0 +1,18 @@
+-- set when the user confirms their email address. accounts that existed before verification was introduced count as verified,
+-- the verification_tokens check makes sure that backfill only runs once
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMPTZ;
+DO $$ BEGIN
+	IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'verification_tokens') THEN
+		UPDATE users SET email_verified_at = now() WHERE email_verified_at IS NULL;
+	END IF;
+END $$;
+
+-- email verification tokens, stored hashed. the email is kept so a token only verifies the address it was sent to
+CREATE TABLE IF NOT EXISTS verification_tokens (
+	token_hash TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	email TEXT NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL,
+	used_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
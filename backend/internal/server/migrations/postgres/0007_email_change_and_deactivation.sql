@@ -0,0 +1,7 @@
+-- an email change waiting for confirmation from the new address, the token is stored hashed
+ALTER TABLE users ADD COLUMN IF NOT EXISTS pending_email TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS pending_email_token_hash TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS pending_email_expires_at TIMESTAMPTZ;
+
+-- deactivated users keep their record but cant log in
+ALTER TABLE users ADD COLUMN IF NOT EXISTS active BOOLEAN NOT NULL DEFAULT true;
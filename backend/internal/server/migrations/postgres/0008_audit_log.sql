@@ -0,0 +1,15 @@
+-- who did what and when. no foreign keys, events have to outlive the users they mention
+CREATE TABLE IF NOT EXISTS audit_events (
+	id BIGSERIAL PRIMARY KEY,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	actor_id INTEGER,
+	impersonated_user_id INTEGER,
+	action TEXT NOT NULL,
+	target_user_id INTEGER,
+	details JSONB
+);
+CREATE INDEX IF NOT EXISTS audit_events_target_user_id_idx ON audit_events (target_user_id, id);
+
+-- before and after values of the changed fields, and the api key for changes made by machines
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS diff JSONB;
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS actor_api_key_id INTEGER;
@@ -0,0 +1,4 @@
+-- a random public key for every user next to the serial id, so clients can address users without ids that can be counted up.
+-- the serial id stays the primary key, it is what the other tables refer to
+ALTER TABLE users ADD COLUMN IF NOT EXISTS uuid UUID NOT NULL DEFAULT gen_random_uuid();
+CREATE UNIQUE INDEX IF NOT EXISTS users_uuid_key ON users (uuid);
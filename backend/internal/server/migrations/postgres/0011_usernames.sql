@@ -0,0 +1,4 @@
+-- an optional handle users can be found by. it is unique ignoring case, the index on lower(username) is what
+-- lookups and the availability check use. users without one keep it null, which the unique index allows any number of
+ALTER TABLE users ADD COLUMN IF NOT EXISTS username TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_key ON users (lower(username));
@@ -0,0 +1,4 @@
+-- an optional phone number in E.164 form for the sms notifications, null when the user has none.
+-- the list filters on it by exact match
+ALTER TABLE users ADD COLUMN IF NOT EXISTS phone TEXT;
+CREATE INDEX IF NOT EXISTS users_phone_idx ON users (phone);
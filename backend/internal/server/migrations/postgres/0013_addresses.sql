@@ -0,0 +1,13 @@
+-- postal addresses of a user for shipping, a user can have any number of them.
+-- they go with the user when it is deleted. country is an ISO 3166-1 alpha-2 code like CH
+CREATE TABLE IF NOT EXISTS addresses (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	label TEXT NOT NULL DEFAULT '',
+	line1 TEXT NOT NULL,
+	line2 TEXT NOT NULL DEFAULT '',
+	city TEXT NOT NULL,
+	postal_code TEXT NOT NULL DEFAULT '',
+	country CHAR(2) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS addresses_user_id_idx ON addresses (user_id, id);
@@ -0,0 +1,17 @@
+-- teams of users, the permissions will be granted per group. a user can be in any number of groups, once in each.
+-- memberships go with their group and with their user when either is deleted
+CREATE TABLE IF NOT EXISTS groups (
+	id SERIAL PRIMARY KEY,
+	name TEXT NOT NULL,
+	description TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE UNIQUE INDEX IF NOT EXISTS groups_name_key ON groups (lower(name));
+
+CREATE TABLE IF NOT EXISTS group_members (
+	group_id INTEGER NOT NULL REFERENCES groups (id) ON DELETE CASCADE,
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	added_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (group_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS group_members_user_id_idx ON group_members (user_id);
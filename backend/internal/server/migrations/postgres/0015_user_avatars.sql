@@ -0,0 +1,2 @@
+-- the blob store key of the user's profile picture, like avatars/1/9f86d081884c7d65.png, null without one
+ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar_key TEXT;
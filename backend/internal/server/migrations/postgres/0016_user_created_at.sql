@@ -0,0 +1,4 @@
+-- when a user signed up, for the signups in /users/stats. the users that exist already are left at null,
+-- when they signed up isnt known and backfilling now() would show them all as signups of today
+ALTER TABLE users ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ;
+ALTER TABLE users ALTER COLUMN created_at SET DEFAULT now();
@@ -0,0 +1,20 @@
+-- email addresses are compared ignoring case. the api lower cases them since it validates its input, this brings
+-- the rows stored before that in line and adds the unique index the other databases have had from the start.
+-- users whose addresses only differ in case cant be merged automatically, which account to keep is a decision
+-- for a person: the migration stops and lists them, and it runs again on the next start once they are resolved
+DO $$
+DECLARE
+	collisions TEXT;
+BEGIN
+	SELECT string_agg(email || ' (users ' || ids || ')', ', ' ORDER BY email) INTO collisions
+	FROM (SELECT lower(email) AS email, string_agg(id::text, ', ' ORDER BY id) AS ids FROM users
+		WHERE email IS NOT NULL GROUP BY lower(email) HAVING count(*) > 1) AS duplicates;
+	IF collisions IS NOT NULL THEN
+		RAISE EXCEPTION 'these email addresses belong to more than one user once case is ignored, change or delete all but one of each and restart: %', collisions;
+	END IF;
+END $$;
+
+UPDATE users SET email = lower(email) WHERE email <> lower(email);
+UPDATE users SET pending_email = lower(pending_email) WHERE pending_email <> lower(pending_email);
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_key ON users (lower(email));
@@ -0,0 +1,7 @@
+-- a user merged into another one as a duplicate is deactivated and points at the user it was merged into,
+-- deleting that user later leaves the pointer empty
+ALTER TABLE users ADD COLUMN IF NOT EXISTS merged_into_id INTEGER REFERENCES users (id) ON DELETE SET NULL;
+
+-- trigram similarity of names for finding duplicates, the index serves the % operator of the self join
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX IF NOT EXISTS users_name_trgm_idx ON users USING gin (name gin_trgm_ops);
@@ -0,0 +1,2 @@
+-- the id a user has in the directory it is synced from, see ldapsync.go. users managed through the api have none
+ALTER TABLE users ADD COLUMN IF NOT EXISTS external_id TEXT UNIQUE;
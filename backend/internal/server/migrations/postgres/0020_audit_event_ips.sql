@@ -0,0 +1,2 @@
+-- the address of the client behind the change, as worked out by withClientIP. null for changes made outside a request
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS ip TEXT;
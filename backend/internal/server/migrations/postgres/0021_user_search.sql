@@ -0,0 +1,4 @@
+-- the search of GET /users and GET /users/search looks for the text anywhere in the lower cased name and in the email.
+-- a LIKE with a wildcard in front can only use a trigram index, these serve the prefix matches of the ranking as well
+CREATE INDEX IF NOT EXISTS users_lower_name_trgm_idx ON users USING gin (lower(name) gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS users_email_trgm_idx ON users USING gin (email gin_trgm_ops);
@@ -0,0 +1,9 @@
+-- which emails a user wants, see internal/server/preferences.go. a user without a row has the defaults, the row is
+-- created the first time the preferences are read. it goes with the user when it is deleted
+CREATE TABLE IF NOT EXISTS notification_prefs (
+	user_id INTEGER PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+	welcome_email BOOLEAN NOT NULL DEFAULT true,
+	marketing BOOLEAN NOT NULL DEFAULT false,
+	security_alerts BOOLEAN NOT NULL DEFAULT true,
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,26 @@
+-- a ulid for every user as its public id: 26 characters of crockford's base32, 10 for the unix milliseconds of when
+-- the user was created and 16 random ones. unlike the uuid it sorts by creation time, and unlike the serial id it cant be
+-- counted up. the random part comes from gen_random_uuid, whose bytes are random but for the version and variant bits.
+-- the existing users get the time they were created, or of their last change when that isnt known
+CREATE OR REPLACE FUNCTION generate_ulid(at TIMESTAMPTZ DEFAULT clock_timestamp()) RETURNS TEXT AS $$
+DECLARE
+	alphabet CONSTANT TEXT := '0123456789ABCDEFGHJKMNPQRSTVWXYZ';
+	ms BIGINT := floor(extract(epoch FROM at) * 1000);
+	entropy BYTEA := uuid_send(gen_random_uuid());
+	ulid TEXT := '';
+BEGIN
+	FOR i IN REVERSE 9..0 LOOP
+		ulid := ulid || substr(alphabet, ((ms >> (5 * i)) & 31)::int + 1, 1);
+	END LOOP;
+	FOR i IN 0..15 LOOP
+		ulid := ulid || substr(alphabet, (get_byte(entropy, i) & 31) + 1, 1);
+	END LOOP;
+	RETURN ulid;
+END
+$$ LANGUAGE plpgsql VOLATILE;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS public_id CHAR(26);
+UPDATE users SET public_id = generate_ulid(COALESCE(created_at, updated_at)) WHERE public_id IS NULL;
+ALTER TABLE users ALTER COLUMN public_id SET DEFAULT generate_ulid();
+ALTER TABLE users ALTER COLUMN public_id SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS users_public_id_key ON users (public_id);
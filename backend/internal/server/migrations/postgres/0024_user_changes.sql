@@ -0,0 +1,18 @@
+-- the change feed of GET /users/changes: a row for every committed change to a user, with the user after it (null for
+-- a deletion). the seq numbers have no gaps and follow the order the changes committed: user_change_seq holds the
+-- last one handed out, and a change takes the next by updating its row, which stays locked until the change commits
+-- or rolls back. a rolled back change gives its number back, the next one gets it again
+CREATE TABLE IF NOT EXISTS user_change_seq (
+	id INTEGER PRIMARY KEY CHECK (id = 1),
+	last_seq BIGINT NOT NULL
+);
+INSERT INTO user_change_seq (id, last_seq) VALUES (1, 0) ON CONFLICT DO NOTHING;
+CREATE TABLE IF NOT EXISTS user_changes (
+	seq BIGINT PRIMARY KEY,
+	created_at TIMESTAMPTZ NOT NULL,
+	operation TEXT NOT NULL,
+	user_id INTEGER NOT NULL,
+	state JSONB
+);
+-- for purging what is older than USER_CHANGES_RETENTION
+CREATE INDEX IF NOT EXISTS user_changes_created_at_idx ON user_changes (created_at);
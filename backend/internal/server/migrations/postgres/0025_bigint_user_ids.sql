@@ -0,0 +1,15 @@
+-- user ids are 64 bit from here on, like User.Id. the columns that hold a user id are widened with them, the foreign
+-- keys stay as they are. this rewrites the tables, on a big database it is best run in a quiet hour
+ALTER SEQUENCE IF EXISTS users_id_seq AS BIGINT;
+ALTER TABLE users ALTER COLUMN id TYPE BIGINT, ALTER COLUMN merged_into_id TYPE BIGINT;
+ALTER TABLE refresh_tokens ALTER COLUMN user_id TYPE BIGINT;
+ALTER TABLE api_keys ALTER COLUMN created_by TYPE BIGINT;
+ALTER TABLE sessions ALTER COLUMN user_id TYPE BIGINT;
+ALTER TABLE password_resets ALTER COLUMN user_id TYPE BIGINT;
+ALTER TABLE verification_tokens ALTER COLUMN user_id TYPE BIGINT;
+ALTER TABLE audit_events ALTER COLUMN actor_id TYPE BIGINT, ALTER COLUMN impersonated_user_id TYPE BIGINT,
+	ALTER COLUMN target_user_id TYPE BIGINT;
+ALTER TABLE addresses ALTER COLUMN user_id TYPE BIGINT;
+ALTER TABLE group_members ALTER COLUMN user_id TYPE BIGINT;
+ALTER TABLE notification_prefs ALTER COLUMN user_id TYPE BIGINT;
+ALTER TABLE user_changes ALTER COLUMN user_id TYPE BIGINT;
@@ -0,0 +1,5 @@
+-- when the user last logged in, for finding stale accounts with ?inactive_since= and for the active users in /users/stats.
+-- it is only written when it is a minute old, so refreshing tokens doesnt turn into a write each time. null for users
+-- who havent logged in since it was added
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_login_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS users_last_login_at_idx ON users (last_login_at);
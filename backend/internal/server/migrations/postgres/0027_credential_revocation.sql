@@ -0,0 +1,4 @@
+-- when all credentials of the user were last revoked, access tokens issued before it are refused. a user whose
+-- credentials were revoked has to reset their password before they can log in with one again
+ALTER TABLE users ADD COLUMN IF NOT EXISTS credentials_revoked_at TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_change_required BOOLEAN NOT NULL DEFAULT false;
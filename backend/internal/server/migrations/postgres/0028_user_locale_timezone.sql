@@ -0,0 +1,5 @@
+-- the language and time zone the frontend shows the user's texts and times in. the locale is a BCP 47 tag, null until
+-- the user picks one so the error messages keep following Accept-Language until then, and read as en. the time zone
+-- is an IANA name
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locale TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS timezone TEXT NOT NULL DEFAULT 'UTC';
@@ -0,0 +1,17 @@
+-- the background jobs of the service, like the welcome emails. a job waits as pending until run_after, a worker that
+-- claims it sets it running and moves run_after to when its claim runs out, so the job of a worker that died is claimed
+-- again. a job that succeeds is deleted, one that failed every attempt stays as failed until an admin retries it
+CREATE TABLE IF NOT EXISTS jobs (
+	id BIGSERIAL PRIMARY KEY,
+	type TEXT NOT NULL,
+	payload JSONB NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending',
+	run_after TIMESTAMPTZ NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT,
+	created_at TIMESTAMPTZ NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL
+);
+-- for the workers looking for the next job that is due
+CREATE INDEX IF NOT EXISTS jobs_due_idx ON jobs (run_after, id) WHERE status <> 'failed';
+CREATE INDEX IF NOT EXISTS jobs_status_idx ON jobs (status, id);
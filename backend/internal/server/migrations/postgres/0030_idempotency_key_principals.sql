@@ -0,0 +1,5 @@
+-- idempotency keys are the caller's, two callers picking the same key get a response each. the keys stored before
+-- belong to no caller and are never replayed again, they expire like the others
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS principal TEXT NOT NULL DEFAULT '';
+ALTER TABLE idempotency_keys DROP CONSTRAINT IF EXISTS idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (principal, key);
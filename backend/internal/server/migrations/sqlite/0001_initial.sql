@@ -0,0 +1,110 @@
+-- the schema of postgres migration 0009 in sqlite's dialect, for local development without a postgres server.
+-- serial ids become integer primary keys, timestamptz becomes timestamp (the driver reads those back as times),
+-- jsonb becomes text and bytea becomes blob. a later schema change needs a migration in both directories
+
+CREATE TABLE users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT,
+	email TEXT,
+	version INTEGER NOT NULL DEFAULT 1,
+	updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	password_hash TEXT,
+	google_subject TEXT UNIQUE,
+	role TEXT NOT NULL DEFAULT 'member' CHECK (role IN ('admin', 'member')),
+	email_verified_at TIMESTAMP,
+	pending_email TEXT,
+	pending_email_token_hash TEXT,
+	pending_email_expires_at TIMESTAMP,
+	active BOOLEAN NOT NULL DEFAULT true
+);
+-- postgres checks for a taken address before writing, here the index backs that check up
+CREATE UNIQUE INDEX users_email_key ON users (lower(email));
+
+CREATE TABLE refresh_tokens (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	token_hash TEXT NOT NULL UNIQUE,
+	family_id TEXT NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	used_at TIMESTAMP,
+	revoked BOOLEAN NOT NULL DEFAULT false,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX refresh_tokens_family_id_idx ON refresh_tokens (family_id);
+
+CREATE TABLE api_keys (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	label TEXT NOT NULL,
+	key_hash TEXT NOT NULL,
+	created_by INTEGER REFERENCES users (id) ON DELETE SET NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_used_at TIMESTAMP,
+	role TEXT NOT NULL DEFAULT 'member' CHECK (role IN ('admin', 'member')),
+	rate_limit_per_minute INTEGER CHECK (rate_limit_per_minute > 0)
+);
+
+CREATE TABLE api_key_usage (
+	api_key_id INTEGER NOT NULL REFERENCES api_keys (id) ON DELETE CASCADE,
+	day DATE NOT NULL,
+	requests INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (api_key_id, day)
+);
+
+CREATE TABLE idempotency_keys (
+	key TEXT PRIMARY KEY,
+	request_hash TEXT NOT NULL,
+	status INTEGER,
+	headers TEXT,
+	body BLOB,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE sessions (
+	id_hash TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	expires_at TIMESTAMP NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	created_ip TEXT NOT NULL DEFAULT '',
+	user_agent TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX sessions_expires_at_idx ON sessions (expires_at);
+
+CREATE TABLE password_resets (
+	token_hash TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	expires_at TIMESTAMP NOT NULL,
+	used_at TIMESTAMP,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE verification_tokens (
+	token_hash TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	email TEXT NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	used_at TIMESTAMP,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE audit_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	actor_id INTEGER,
+	impersonated_user_id INTEGER,
+	action TEXT NOT NULL,
+	target_user_id INTEGER,
+	details TEXT,
+	diff TEXT,
+	actor_api_key_id INTEGER
+);
+CREATE INDEX audit_events_target_user_id_idx ON audit_events (target_user_id, id);
+
+CREATE TABLE outbox (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	event_id TEXT NOT NULL UNIQUE,
+	type TEXT NOT NULL,
+	payload TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	published_at TIMESTAMP
+);
+CREATE INDEX outbox_unpublished_idx ON outbox (id) WHERE published_at IS NULL;
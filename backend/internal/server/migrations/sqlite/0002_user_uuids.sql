@@ -0,0 +1,15 @@
+-- postgres migration 0010 in sqlite's dialect. sqlite has no uuid function and a column added later cant have
+-- a computed default, so existing users get a version 4 uuid built from randomblob and new ones get it from a trigger
+ALTER TABLE users ADD COLUMN uuid TEXT;
+
+UPDATE users SET uuid = lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' || substr(lower(hex(randomblob(2))), 2) || '-' ||
+	substr('89ab', 1 + abs(random()) % 4, 1) || substr(lower(hex(randomblob(2))), 2) || '-' || lower(hex(randomblob(6)));
+
+CREATE UNIQUE INDEX users_uuid_key ON users (uuid);
+
+CREATE TRIGGER users_uuid AFTER INSERT ON users FOR EACH ROW WHEN NEW.uuid IS NULL
+BEGIN
+	UPDATE users SET uuid = lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' || substr(lower(hex(randomblob(2))), 2) || '-' ||
+		substr('89ab', 1 + abs(random()) % 4, 1) || substr(lower(hex(randomblob(2))), 2) || '-' || lower(hex(randomblob(6)))
+	WHERE id = NEW.id;
+END;
@@ -0,0 +1,4 @@
+-- postgres migration 0011 in sqlite's dialect
+ALTER TABLE users ADD COLUMN username TEXT;
+
+CREATE UNIQUE INDEX users_username_key ON users (lower(username));
@@ -0,0 +1,4 @@
+-- postgres migration 0012 in sqlite's dialect
+ALTER TABLE users ADD COLUMN phone TEXT;
+
+CREATE INDEX users_phone_idx ON users (phone);
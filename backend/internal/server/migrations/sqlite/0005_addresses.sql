@@ -0,0 +1,12 @@
+-- postgres migration 0013 in sqlite's dialect
+CREATE TABLE addresses (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	label TEXT NOT NULL DEFAULT '',
+	line1 TEXT NOT NULL,
+	line2 TEXT NOT NULL DEFAULT '',
+	city TEXT NOT NULL,
+	postal_code TEXT NOT NULL DEFAULT '',
+	country TEXT NOT NULL
+);
+CREATE INDEX addresses_user_id_idx ON addresses (user_id, id);
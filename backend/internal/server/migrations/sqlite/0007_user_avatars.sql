@@ -0,0 +1,2 @@
+-- postgres migration 0015 in sqlite's dialect
+ALTER TABLE users ADD COLUMN avatar_key TEXT;
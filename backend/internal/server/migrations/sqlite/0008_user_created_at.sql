@@ -0,0 +1,8 @@
+-- postgres migration 0016 in sqlite's dialect. a column added later cant default to the current time,
+-- so new users get it from a trigger and the existing ones stay at null
+ALTER TABLE users ADD COLUMN created_at TIMESTAMP;
+
+CREATE TRIGGER users_created_at AFTER INSERT ON users FOR EACH ROW WHEN NEW.created_at IS NULL
+BEGIN
+	UPDATE users SET created_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+END;
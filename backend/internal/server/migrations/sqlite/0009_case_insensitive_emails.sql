@@ -0,0 +1,4 @@
+-- postgres migration 0017 in sqlite's dialect. users_email_key has been on lower(email) from the start,
+-- so no two users can collide and only the case of the stored addresses changes
+UPDATE users SET email = lower(email) WHERE email <> lower(email);
+UPDATE users SET pending_email = lower(pending_email) WHERE pending_email <> lower(pending_email);
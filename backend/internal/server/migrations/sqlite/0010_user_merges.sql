@@ -0,0 +1,2 @@
+-- postgres migration 0018 in sqlite's dialect, without the trigram index: sqlite has no pg_trgm
+ALTER TABLE users ADD COLUMN merged_into_id INTEGER REFERENCES users (id) ON DELETE SET NULL;
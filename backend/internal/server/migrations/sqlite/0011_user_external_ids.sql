@@ -0,0 +1,4 @@
+-- postgres migration 0019 in sqlite's dialect, sqlite cant add a unique column so the index is created on its own
+ALTER TABLE users ADD COLUMN external_id TEXT;
+
+CREATE UNIQUE INDEX users_external_id_key ON users (external_id);
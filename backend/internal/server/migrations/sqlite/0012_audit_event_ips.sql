@@ -0,0 +1,2 @@
+-- postgres migration 0020 in sqlite's dialect
+ALTER TABLE audit_events ADD COLUMN ip TEXT;
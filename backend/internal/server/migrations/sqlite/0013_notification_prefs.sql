@@ -0,0 +1,8 @@
+-- postgres migration 0022 in sqlite's dialect
+CREATE TABLE notification_prefs (
+	user_id INTEGER PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+	welcome_email BOOLEAN NOT NULL DEFAULT true,
+	marketing BOOLEAN NOT NULL DEFAULT false,
+	security_alerts BOOLEAN NOT NULL DEFAULT true,
+	updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
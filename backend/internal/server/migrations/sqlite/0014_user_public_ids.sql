@@ -0,0 +1,72 @@
+-- postgres migration 0023 in sqlite's dialect. sqlite has no functions to write a ulid with, the expressions spell
+-- it out: a character of crockford's base32 for every 5 bits of the unix milliseconds, then 16 random ones.
+-- the existing users get the time they were created from a temporary table, new ones the current time from a trigger
+ALTER TABLE users ADD COLUMN public_id TEXT;
+
+CREATE TEMPORARY TABLE user_public_id_times AS
+	SELECT id, CAST((julianday(COALESCE(created_at, updated_at)) - 2440587.5) * 86400000 AS INTEGER) AS ms FROM users;
+
+UPDATE users SET public_id = (SELECT
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((t.ms >> 45) & 31) + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((t.ms >> 40) & 31) + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((t.ms >> 35) & 31) + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((t.ms >> 30) & 31) + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((t.ms >> 25) & 31) + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((t.ms >> 20) & 31) + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((t.ms >> 15) & 31) + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((t.ms >> 10) & 31) + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((t.ms >> 5) & 31) + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((t.ms >> 0) & 31) + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1)
+	FROM user_public_id_times t WHERE t.id = users.id);
+
+DROP TABLE user_public_id_times;
+
+CREATE UNIQUE INDEX users_public_id_key ON users (public_id);
+
+CREATE TRIGGER users_public_id AFTER INSERT ON users FOR EACH ROW WHEN NEW.public_id IS NULL
+BEGIN
+	UPDATE users SET public_id = (SELECT
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((clock.ms >> 45) & 31) + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((clock.ms >> 40) & 31) + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((clock.ms >> 35) & 31) + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((clock.ms >> 30) & 31) + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((clock.ms >> 25) & 31) + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((clock.ms >> 20) & 31) + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((clock.ms >> 15) & 31) + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((clock.ms >> 10) & 31) + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((clock.ms >> 5) & 31) + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', ((clock.ms >> 0) & 31) + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1) ||
+		substr('0123456789ABCDEFGHJKMNPQRSTVWXYZ', abs(random()) % 32 + 1, 1)
+	FROM (SELECT CAST((julianday('now') - 2440587.5) * 86400000 AS INTEGER) AS ms) clock) WHERE id = NEW.id;
+END;
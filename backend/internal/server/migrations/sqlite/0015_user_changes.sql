@@ -0,0 +1,14 @@
+-- postgres migration 0024 in sqlite's dialect
+CREATE TABLE user_change_seq (
+	id INTEGER PRIMARY KEY CHECK (id = 1),
+	last_seq INTEGER NOT NULL
+);
+INSERT INTO user_change_seq (id, last_seq) VALUES (1, 0);
+CREATE TABLE user_changes (
+	seq INTEGER PRIMARY KEY,
+	created_at TIMESTAMP NOT NULL,
+	operation TEXT NOT NULL,
+	user_id INTEGER NOT NULL,
+	state TEXT
+);
+CREATE INDEX user_changes_created_at_idx ON user_changes (created_at);
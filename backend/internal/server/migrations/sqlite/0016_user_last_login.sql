@@ -0,0 +1,4 @@
+-- postgres migration 0026 in sqlite's dialect
+ALTER TABLE users ADD COLUMN last_login_at TIMESTAMP;
+
+CREATE INDEX users_last_login_at_idx ON users (last_login_at);
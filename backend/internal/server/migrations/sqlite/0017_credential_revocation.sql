@@ -0,0 +1,3 @@
+-- postgres migration 0027 in sqlite's dialect
+ALTER TABLE users ADD COLUMN credentials_revoked_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN password_change_required BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,3 @@
+-- postgres migration 0028 in sqlite's dialect
+ALTER TABLE users ADD COLUMN locale TEXT;
+ALTER TABLE users ADD COLUMN timezone TEXT NOT NULL DEFAULT 'UTC';
@@ -0,0 +1,14 @@
+-- postgres migration 0029 in sqlite's dialect
+CREATE TABLE jobs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	type TEXT NOT NULL,
+	payload TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending',
+	run_after TIMESTAMP NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT,
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL
+);
+CREATE INDEX jobs_due_idx ON jobs (run_after, id) WHERE status <> 'failed';
+CREATE INDEX jobs_status_idx ON jobs (status, id);
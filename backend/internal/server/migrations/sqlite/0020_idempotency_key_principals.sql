@@ -0,0 +1,15 @@
+-- postgres migration 0030 in sqlite's dialect, sqlite cant change a primary key so the table is created again
+CREATE TABLE idempotency_keys_new (
+	principal TEXT NOT NULL DEFAULT '',
+	key TEXT NOT NULL,
+	request_hash TEXT NOT NULL,
+	status INTEGER,
+	headers TEXT,
+	body BLOB,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (principal, key)
+);
+INSERT INTO idempotency_keys_new (key, request_hash, status, headers, body, created_at)
+	SELECT key, request_hash, status, headers, body, created_at FROM idempotency_keys;
+DROP TABLE idempotency_keys;
+ALTER TABLE idempotency_keys_new RENAME TO idempotency_keys;
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+//openMySQL opens the mysql database at dsn, a go-sql-driver dsn like user:password@tcp(host:3306)/users.
+//the queries of the server are written with postgres' $1 placeholders, mysql only knows ?. instead of a second copy
+//of every query the connections rewrite the placeholders (see rebindDollars), so what is plain sql runs on both. OpenDB wraps the connector in that rewrite.
+//the rest is written to run on all three: RETURNING only where insertId adds it, lists of ids through idList instead
+//of arrays, and no ::casts, intervals or ON CONFLICT. advisory locks are only taken on postgres.
+//store.MySQL has the users queries in mysql's own dialect
+func openMySQL(dsn string) (driver.Connector, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	//datetime columns have no time zone, everything in them is utc like the timestamptz of postgres.
+	//the migrations need several statements per Exec
+	cfg.ParseTime = true
+	cfg.Loc = time.UTC
+	cfg.MultiStatements = true
+	if cfg.Params == nil {
+		cfg.Params = map[string]string{}
+	}
+	cfg.Params["time_zone"] = "'+00:00'"
+	//names are quoted with " like in postgres, for tables like groups whose name is a reserved word in mysql
+	cfg.Params["sql_mode"] = "CONCAT(@@sql_mode, ',ANSI_QUOTES')"
+	return mysql.NewConnector(cfg)
+}
+
+//rebindDollars replaces the $1, $2, ... of query with ? and returns for every ? the index of the arg it stands for.
+//order is nil when query has no $n, then the args are used as they are. quoted strings and names are left alone
+func rebindDollars(query string) (string, []int) {
+	if !strings.Contains(query, "$") {
+		return query, nil
+	}
+	var (
+		b     strings.Builder
+		order []int
+		quote byte
+	)
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+		switch {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"' || ch == '`':
+			quote = ch
+		case ch == '$':
+			j := i + 1
+			for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+				j++
+			}
+			if n, err := strconv.Atoi(query[i+1 : j]); err == nil && n > 0 {
+				b.WriteByte('?')
+				order = append(order, n-1)
+				i = j - 1
+				continue
+			}
+		}
+		b.WriteByte(ch)
+	}
+	return b.String(), order
+}
+
+//reorderArgs returns the args for the ? of a rebound query, an arg whose $n is missing is left for the driver to complain about
+func reorderArgs(args []driver.NamedValue, order []int) []driver.NamedValue {
+	if order == nil {
+		return args
+	}
+	out := make([]driver.NamedValue, len(order))
+	for i, n := range order {
+		if n < len(args) {
+			out[i] = args[n]
+		}
+		out[i].Ordinal = i + 1
+	}
+	return out
+}
+
+//lastInsertIds is set by New for mysql, which has no RETURNING, insertId asks the driver for the new id there
+var lastInsertIds bool
+
+//inserter is implemented by both *sql.DB and *sql.Tx
+type inserter interface {
+	execer
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+//insertId runs query, an INSERT of at most one row into a table with an id column, and returns the id the row got.
+//sql.ErrNoRows means nothing was inserted, like by an INSERT ... SELECT that selected nothing
+func insertId(ctx context.Context, q inserter, query string, args ...any) (int64, error) {
+	var id int64
+	if !lastInsertIds {
+		err := q.QueryRowContext(ctx, query+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+	res, err := q.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return 0, cmp.Or(err, sql.ErrNoRows)
+	}
+	return res.LastInsertId()
+}
+
+//idList is an IN list of placeholders for ids, numbered from $first, and the args they stand for. ids are bound one by
+//one, mysql and sqlite have no arrays like postgres' ANY($1). an empty list matches nothing
+func idList(ids []int64, first int) (string, []any) {
+	if len(ids) == 0 {
+		return "(NULL)", nil
+	}
+	placeholders := make([]string, len(ids))
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		placeholders[i] = "$" + strconv.Itoa(first+i)
+		args[i] = id
+	}
+	return "(" + strings.Join(placeholders, ", ") + ")", args
+}
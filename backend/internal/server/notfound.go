@@ -0,0 +1,222 @@
+package server
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+//defaults of the cache of unknown users and of the throttle on their lookups, both are off unless configured
+const (
+	defaultMissingUserCacheSize = 10000       //USER_NEGATIVE_CACHE_SIZE
+	defaultMissingUserCacheTTL  = 0           //USER_NEGATIVE_CACHE_TTL, 0 turns the cache off
+	defaultNotFoundLimit        = 0           //NOT_FOUND_LIMIT, 0 turns the throttle off
+	defaultNotFoundLimitWindow  = time.Minute //NOT_FOUND_LIMIT_WINDOW
+)
+
+//userLookupsThrottled counts the lookups of a user the notFoundThrottle answered 429 without reading the user
+var userLookupsThrottled = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "user_lookups_throttled_total",
+	Help: "Lookups of unknown users answered 429 because the client kept asking for them.",
+})
+
+//missingUserCache remembers for ttl which ids UserStore.Get found no user for, so a client asking for an unknown user
+//over and over doesnt reach the database every time. it sits in userCache, which forgets an id here with every write to
+//it, creates and imports included, before the write returns. a user created by another instance is only seen once the
+//entry expired, which is why the ttl is meant to be a few seconds. its methods do nothing on a nil cache
+type missingUserCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	size    int
+	entries map[int64]*list.Element
+	//lru has the most recently used entry at the front
+	lru *list.List
+	//generation changes with every forget, like in localUserCache. a Get that found nothing before a create must not
+	//remember that
+	generation uint64
+}
+
+type missingUserCacheEntry struct {
+	id      int64
+	expires time.Time
+}
+
+//newMissingUserCache returns the cache set up by c, nil when its size or ttl turns it off
+func newMissingUserCache(c userCacheConfig) *missingUserCache {
+	if c.size <= 0 || c.ttl <= 0 {
+		return nil
+	}
+	return &missingUserCache{ttl: c.ttl, size: c.size, entries: map[int64]*list.Element{}, lru: list.New()}
+}
+
+//get reports whether id is known not to exist. when it isnt it returns the generation to pass to put
+func (c *missingUserCache) get(id int64) (uint64, bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[id]; ok {
+		if time.Now().Before(el.Value.(*missingUserCacheEntry).expires) {
+			c.lru.MoveToFront(el)
+			userCacheHits.WithLabelValues("negative").Inc()
+			return 0, true
+		}
+		c.remove(el)
+	}
+	userCacheMisses.WithLabelValues("negative").Inc()
+	return c.generation, false
+}
+
+//put remembers that id doesnt exist unless something was forgotten since get returned generation
+func (c *missingUserCache) put(id int64, generation uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != generation {
+		return
+	}
+	if el, ok := c.entries[id]; ok {
+		c.remove(el)
+	}
+	c.entries[id] = c.lru.PushFront(&missingUserCacheEntry{id: id, expires: time.Now().Add(c.ttl)})
+	if c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *missingUserCache) forget(id int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if el, ok := c.entries[id]; ok {
+		c.remove(el)
+	}
+}
+
+//remove drops el, c.mu must be held
+func (c *missingUserCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*missingUserCacheEntry).id)
+}
+
+//notFoundLimitConfig is how many times one client may be told a user doesnt exist within window, a limit of 0 turns
+//the throttle off
+type notFoundLimitConfig struct {
+	limit  int
+	window time.Duration
+}
+
+//notFoundThrottle stops a client that keeps asking for a user that doesnt exist: the 404s of every client for every
+//user are counted in a bucket of the rate limit store that holds limit of them and fills up again over the window. once
+//it is empty the client's lookups of that user are answered 429 with Retry-After, without reading the user, until a
+//token is back. a client is its api key, the user of its token or its ip address. like the rate limit the buckets
+//are kept per instance
+type notFoundThrottle struct {
+	store rateLimitStore
+	limit int
+	rate  float64
+	mu    sync.Mutex
+	//blocked are the lookups answered 429 until the time they map to, by client and user
+	blocked map[string]time.Time
+}
+
+//newNotFoundThrottle returns nil when cfg.limit is 0, which turns the throttle off
+func newNotFoundThrottle(cfg notFoundLimitConfig) *notFoundThrottle {
+	if cfg.limit == 0 {
+		return nil
+	}
+	store := newMemoryRateLimitStore(cfg.window)
+	go store.cleanup(time.Minute)
+	t := &notFoundThrottle{store: store, limit: cfg.limit, rate: float64(cfg.limit) / cfg.window.Seconds(), blocked: map[string]time.Time{}}
+	go t.cleanup(time.Minute)
+	return t
+}
+
+//notFoundClient is who the 404s of r are counted for
+func notFoundClient(r *http.Request) string {
+	p, ok := principalFromContext(r.Context())
+	switch {
+	case ok && p.ApiKeyId != 0:
+		return "key:" + strconv.Itoa(p.ApiKeyId)
+	case ok && p.UserId != 0:
+		return "user:" + strconv.FormatInt(p.UserId, 10)
+	}
+	return "ip:" + clientIP(r)
+}
+
+//middleware throttles the lookups of the user in the {id} of the route, it goes around the handler that reads it
+func (t *notFoundThrottle) middleware(next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := notFoundClient(r) + " " + mux.Vars(r)["id"]
+		if wait, blocked := t.blockedFor(key); blocked {
+			userLookupsThrottled.Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, r, http.StatusTooManyRequests, codeTooManyRequests, "this user doesnt exist and was asked for too often, stop retrying")
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.statusCode() == http.StatusNotFound {
+			t.count(key)
+		}
+	})
+}
+
+//blockedFor reports whether the lookups of key are refused, and for how long still
+func (t *notFoundThrottle) blockedFor(key string) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	until, ok := t.blocked[key]
+	if !ok {
+		return 0, false
+	}
+	if wait := time.Until(until); wait > 0 {
+		return wait, true
+	}
+	delete(t.blocked, key)
+	return 0, false
+}
+
+//count takes a token for a 404 of key, once the last one is taken the lookups are refused until there is another
+func (t *notFoundThrottle) count(key string) {
+	ok, remaining, wait := t.store.Take(key, t.rate, t.limit)
+	if ok && remaining > 0 {
+		return
+	}
+	if ok {
+		wait = time.Duration(float64(time.Second) / t.rate)
+	}
+	t.mu.Lock()
+	t.blocked[key] = time.Now().Add(wait)
+	t.mu.Unlock()
+}
+
+//cleanup drops the blocks that ran out every interval, it runs for the lifetime of the process
+func (t *notFoundThrottle) cleanup(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now()
+		t.mu.Lock()
+		for key, until := range t.blocked {
+			if now.After(until) {
+				delete(t.blocked, key)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
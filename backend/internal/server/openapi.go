@@ -0,0 +1,389 @@
+package server
+
+import (
+	_ "embed"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"github.com/graphql-go/graphql"
+
+	"api/internal/model"
+)
+
+//openAPIOperation documents one method of a route. bodies are example values whose type the schema is reflected from
+type openAPIOperation struct {
+	summary string
+	//public operations need no authentication, admin ones need the admin role
+	public bool
+	admin  bool
+	query  []openAPIParam
+	//headers are optional request headers like Idempotency-Key
+	headers []openAPIParam
+	request any
+	status  int
+	//response is nil when the status has no body, contentType overrides json for vcards and event streams
+	response    any
+	contentType string
+}
+
+type openAPIParam struct {
+	name, description, schemaType string
+}
+
+var (
+	paramIfMatch = openAPIParam{"If-Match", "etag of the version the change is based on, see REQUIRE_IF_MATCH", "string"}
+	paramToken   = openAPIParam{"token", "token from the email link", "string"}
+	paramLimit   = openAPIParam{"limit", "page size, 50 by default. bigger ones than MAX_PAGE_SIZE are clamped, X-Page-Limit says what was used", "integer"}
+	paramOffset  = openAPIParam{"offset", "how many to skip", "integer"}
+)
+
+//apiOperations describes the routes of registerV1Routes, keyed by method and path below the version prefix
+//routes missing here still show up in the spec, the route walk in buildOpenAPISpec adds them with a bare description
+var apiOperations = map[string]openAPIOperation{
+	"POST /login":               {summary: "Log in with email and password", public: true, request: credentials{}, status: http.StatusOK, response: tokenResponse{}},
+	"POST /token/refresh":       {summary: "Exchange a refresh token for new tokens", public: true, request: refreshRequest{}, status: http.StatusOK, response: tokenResponse{}},
+	"POST /logout":              {summary: "Revoke a refresh token or end the session", public: true, request: refreshRequest{}, status: http.StatusNoContent},
+	"POST /password/forgot":     {summary: "Email a password reset link", public: true, request: forgotPasswordRequest{}, status: http.StatusAccepted},
+	"POST /password/reset":      {summary: "Set a new password with a reset token", public: true, request: resetPasswordRequest{}, status: http.StatusNoContent},
+	"GET /auth/google":          {summary: "Start signing in with Google", public: true, status: http.StatusFound},
+	"GET /auth/google/callback": {summary: "Finish signing in with Google", public: true, status: http.StatusOK, response: tokenResponse{}},
+	"GET /users/verify":         {summary: "Verify an email address", public: true, query: []openAPIParam{paramToken}, status: http.StatusNoContent},
+	"POST /users/verify/resend": {summary: "Send the verification email again", public: true, request: resendVerificationRequest{}, status: http.StatusAccepted},
+	"GET /ws":                   {summary: "Live user events over a websocket", public: true, query: []openAPIParam{{"access_token", "access token, browsers cant set headers on a websocket", "string"}}, status: http.StatusSwitchingProtocols},
+	"GET /users": {summary: "List users", query: []openAPIParam{{"include_inactive", "also list deactivated users", "boolean"},
+		{"phone", "admins only: the user with this phone number, matched in E.164 form", "string"},
+		{"email", "admins only: the user with this email address, ignoring case", "string"},
+		{"inactive_since", "admins only: the users who last logged in before this date or time, or signed up before it and never logged in", "string"},
+		{"sort", "id (the default), name, email, role, updated_at, phone or username, several separated by commas and each with a - in front for descending order. " +
+			"users without a phone or username come last, users equal in every key are sorted by id", "string"},
+		{"snapshot", "read the page and X-Total-Count from one snapshot of the users, X-Snapshot-At says when it was taken", "boolean"}, paramLimit, paramOffset},
+		status: http.StatusOK, response: []model.User{}},
+	"HEAD /users": {summary: "The headers of GET /users without the body", status: http.StatusOK},
+	"POST /users": {summary: "Create a user", admin: true, headers: []openAPIParam{{"Idempotency-Key", "makes retries of the request safe", "string"}},
+		request: model.User{}, status: http.StatusCreated, response: model.User{}},
+	"PATCH /users": {summary: "Set the role or the active state of up to 1000 users at once, all or nothing", admin: true,
+		request: bulkUserUpdate{}, status: http.StatusOK, response: bulkUpdateResult{}},
+	"GET /users/events": {summary: "Live user events as server sent events", admin: true, status: http.StatusOK, contentType: "text/event-stream"},
+	"GET /users/{id}": {summary: "Get a user", query: []openAPIParam{{"include", "addresses embeds the addresses of the user and preferences its notification preferences, comma separated, for admins and the user themself", "string"}},
+		status: http.StatusOK, response: model.User{}},
+	"HEAD /users/{id}": {summary: "Check whether a user exists, the headers of GET /users/{id} without the body", status: http.StatusOK},
+	"GET /users/stats": {summary: "User counts for the dashboard: the total, the users active in the last 30 days, signups per day and the most common email domains", admin: true,
+		query:  []openAPIParam{{"days", "how many days of signups, up to 366", "integer"}, {"top", "how many email domains, up to 100", "integer"}},
+		status: http.StatusOK, response: userStats{}},
+	"GET /users/duplicates": {summary: "Clusters of users that may be the same person, by email and with fuzzy by similar names", admin: true,
+		query: []openAPIParam{{"fuzzy", "also cluster users with similar names", "boolean"},
+			{"threshold", "how similar names have to be with fuzzy, from 0.3 to 1, 0.6 by default", "number"}},
+		status: http.StatusOK, response: duplicateReport{}},
+	"GET /users/search": {summary: "Search users by name and email, best matches first: the exact email, then names and emails starting with q, then the rest", admin: true,
+		query: []openAPIParam{{"q", "the text to look for, ignoring case", "string"}, {"include_inactive", "also find deactivated users", "boolean"},
+			{"role", "only users with this role", "string"}, paramLimit, paramOffset},
+		status: http.StatusOK, response: []model.ScoredUser{}},
+	"GET /users/email-available": {summary: "Check whether an email address is registered already, for signup forms with an api key",
+		query:  []openAPIParam{{"email", "the email address, case and surrounding spaces are ignored", "string"}},
+		status: http.StatusOK, response: emailAvailability{}},
+	"GET /users/username-available": {summary: "Check whether a username can still be taken", query: []openAPIParam{{"u", "the username", "string"}},
+		status: http.StatusOK, response: usernameAvailability{}},
+	"GET /users/by-username/{username}": {summary: "Get a user by username", status: http.StatusOK, response: model.User{}},
+	"PUT /users/{id}": {summary: "Update a user", admin: true, headers: []openAPIParam{paramIfMatch},
+		query:   []openAPIParam{{"create", "create the user with this id when it doesnt exist (201), without If-Match", "boolean"}},
+		request: model.User{}, status: http.StatusOK, response: model.User{}},
+	"DELETE /users/{id}": {summary: "Delete a user", admin: true, headers: []openAPIParam{paramIfMatch},
+		query:  []openAPIParam{{"dry_run", "delete nothing and answer 200 with the user that would be deleted", "boolean"}},
+		status: http.StatusNoContent},
+	"GET /admin/export": {summary: "Dump every user and the tables that belong to them for backups, as newline delimited json", admin: true,
+		query:  []openAPIParam{{"format", "ndjson (the default) for the dump, xlsx for an excel workbook of the users without their secrets", "string"}},
+		status: http.StatusOK, contentType: "application/x-ndjson"},
+	"POST /admin/import": {summary: "Load a dump of GET /admin/export, merging it into the database or replacing what is there", admin: true,
+		query: []openAPIParam{{"mode", "merge (the default) updates matching rows and adds the rest, replace empties the tables first", "string"},
+			{"dry_run", "report what the import would do and roll it back", "boolean"}},
+		status: http.StatusOK, response: importReport{}},
+	"POST /admin/ldap-sync": {summary: "Sync the users from the ldap directory of LDAP_URL now, answers 501 without one", admin: true,
+		query:  []openAPIParam{{"dry_run", "report what the sync would change and roll it back", "boolean"}},
+		status: http.StatusOK, response: ldapSyncSummary{}},
+	"GET /admin/maintenance": {summary: "Whether this instance refuses writes for maintenance or is read only", admin: true, status: http.StatusOK, response: maintenanceState{}},
+	"POST /admin/maintenance": {summary: "Turn maintenance or read only on or off, writes are answered 503 while either is on", admin: true,
+		request: maintenanceRequest{}, status: http.StatusOK, response: maintenanceState{}},
+	"GET /admin/deletion-blocks": {summary: "The callers on this instance whose deletions are refused for deleting too many users", admin: true,
+		status: http.StatusOK, response: deletionBlockList{}},
+	"DELETE /admin/deletion-blocks/{actor}": {summary: "Let a caller (user:12 or key:3) delete users again right away", admin: true, status: http.StatusNoContent},
+	"GET /admin/jobs": {summary: "The background jobs that are waiting, running or failed every attempt, oldest first", admin: true,
+		query:  []openAPIParam{{"status", "only the jobs that are pending, running or failed", "string"}, paramLimit, paramOffset},
+		status: http.StatusOK, response: jobList{}},
+	"POST /admin/jobs/{id}/retry": {summary: "Queue a failed job again with all its attempts", admin: true, status: http.StatusOK, response: jobEntry{}},
+	"GET /users/{id}/vcard":       {summary: "Export a user as a vCard", status: http.StatusOK, contentType: "text/vcard"},
+	"POST /users/{id}/deactivate": {summary: "Deactivate a user", admin: true, headers: []openAPIParam{paramIfMatch}, status: http.StatusOK, response: model.User{}},
+	"POST /users/{id}/activate":   {summary: "Activate a user", admin: true, headers: []openAPIParam{paramIfMatch}, status: http.StatusOK, response: model.User{}},
+	"POST /users/{id}/merge": {summary: "Merge a duplicate into another user, answers with the user it was merged into", admin: true,
+		request: mergeRequest{}, status: http.StatusOK, response: model.User{}},
+	"POST /users/{id}/impersonate":             {summary: "Get a short lived token acting as the user", admin: true, status: http.StatusOK, response: tokenResponse{}},
+	"GET /users/{id}/addresses":                {summary: "List the addresses of a user", status: http.StatusOK, response: []model.Address{}},
+	"POST /users/{id}/addresses":               {summary: "Add an address", request: addressInput{}, status: http.StatusCreated, response: model.Address{}},
+	"GET /users/{id}/addresses/{addressId}":    {summary: "Get an address", status: http.StatusOK, response: model.Address{}},
+	"PUT /users/{id}/addresses/{addressId}":    {summary: "Replace an address", request: addressInput{}, status: http.StatusOK, response: model.Address{}},
+	"DELETE /users/{id}/addresses/{addressId}": {summary: "Delete an address", status: http.StatusNoContent},
+	"GET /users/{id}/groups":                   {summary: "List the groups a user is a member of", status: http.StatusOK, response: []model.Group{}},
+	"GET /users/{id}/preferences":              {summary: "Get the notification preferences of a user", status: http.StatusOK, response: model.NotificationPrefs{}},
+	"PUT /users/{id}/preferences": {summary: "Replace the notification preferences of a user, security alerts cant be turned off",
+		request: prefsInput{}, status: http.StatusOK, response: model.NotificationPrefs{}},
+	"PUT /users/{id}/avatar": {summary: "Upload a profile picture, a JPEG, PNG or WebP image as the body or as the file of a multipart/form-data body",
+		status: http.StatusOK, response: model.User{}},
+	"GET /users/{id}/avatar":         {summary: "Get the profile picture", query: []openAPIParam{{"v", "version of the picture from avatar_url, makes the response cacheable for good", "string"}}, status: http.StatusOK, contentType: "image/*"},
+	"DELETE /users/{id}/avatar":      {summary: "Remove the profile picture", status: http.StatusNoContent},
+	"PUT /users/{id}/password":       {summary: "Change a password", request: passwordChange{}, status: http.StatusNoContent},
+	"POST /users/{id}/email/confirm": {summary: "Confirm a pending email change", request: confirmEmailRequest{}, status: http.StatusOK, response: model.User{}},
+	"POST /graphql":                  {summary: "Query and change users with GraphQL", request: graphQLRequest{}, status: http.StatusOK, response: graphql.Result{}},
+	"GET /graphql":                   {summary: "GraphiQL query editor, only served when GRAPHIQL is on", public: true, status: http.StatusOK, contentType: "text/html"},
+	"GET /users/changes": {summary: "The changes to users after a cursor, oldest first, for keeping a copy of the users in sync. 410 when they were purged", admin: true,
+		query:  []openAPIParam{{"since", "next_cursor of the previous page, or latest for the cursor of the newest change", "string"}, paramLimit},
+		status: http.StatusOK, response: userChangePage{}},
+	"GET /users/{id}/audit": {summary: "A user's audit log, newest first", admin: true,
+		query:  []openAPIParam{paramLimit, {"before", "next_before of the previous page", "integer"}, paramOffset},
+		status: http.StatusOK, response: auditPage{}},
+	"POST /users/{id}/revoke-credentials": {summary: "Revoke every session, token and api key of a compromised account and make the user reset their password, answers how many of each were revoked", admin: true,
+		status: http.StatusOK, response: revokedCredentials{}},
+	"GET /users/{id}/export": {summary: "Everything stored about a user, for privacy requests",
+		query:  []openAPIParam{{"format", "zip for a zip of json files instead of one json document", "string"}},
+		status: http.StatusOK, response: userExport{}},
+	"GET /me":                              {summary: "Get the caller's profile", status: http.StatusOK, response: model.User{}},
+	"PUT /me":                              {summary: "Update the caller's profile", request: profileUpdate{}, status: http.StatusOK, response: model.User{}},
+	"POST /apikeys":                        {summary: "Create an api key", admin: true, request: apiKeyRequest{}, status: http.StatusCreated, response: ApiKey{}},
+	"DELETE /apikeys/{id}":                 {summary: "Revoke an api key", admin: true, status: http.StatusNoContent},
+	"GET /apikeys/{id}/usage":              {summary: "Daily requests of an api key", admin: true, query: []openAPIParam{{"days", "how many days back to look", "integer"}}, status: http.StatusOK, response: apiKeyUsage{}},
+	"GET /groups":                          {summary: "List groups", query: []openAPIParam{paramLimit, paramOffset}, status: http.StatusOK, response: []model.Group{}},
+	"POST /groups":                         {summary: "Create a group", admin: true, request: groupInput{}, status: http.StatusCreated, response: model.Group{}},
+	"GET /groups/{id}":                     {summary: "Get a group", status: http.StatusOK, response: model.Group{}},
+	"PUT /groups/{id}":                     {summary: "Rename a group or change its description", admin: true, request: groupInput{}, status: http.StatusOK, response: model.Group{}},
+	"DELETE /groups/{id}":                  {summary: "Delete a group and its memberships", admin: true, status: http.StatusNoContent},
+	"POST /groups/{id}/members":            {summary: "Add a user to a group", admin: true, request: groupMemberInput{}, status: http.StatusNoContent},
+	"DELETE /groups/{id}/members/{userId}": {summary: "Remove a user from a group", admin: true, status: http.StatusNoContent},
+	"GET /openapi.json":                    {summary: "This description of the api", public: true, status: http.StatusOK},
+	"GET /errors/{code}":                   {summary: "Describe an error code, the type of the problem documents links here", public: true, status: http.StatusOK, response: errorTypeDoc{}},
+	"GET /docs":                            {summary: "Browsable api documentation", public: true, status: http.StatusOK, contentType: "text/html"},
+}
+
+//openAPISpec serves the openapi 3 description of the routes registered on routes, the subrouter of a version prefix
+//the spec is built on the first request, once every route is registered
+func openAPISpec(routes *mux.Router) http.HandlerFunc {
+	var once sync.Once
+	var spec map[string]any
+	var prefix string
+	return func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() {
+			template, _ := mux.CurrentRoute(r).GetPathTemplate()
+			prefix = strings.TrimSuffix(template, "/openapi.json")
+			spec = buildOpenAPISpec(routes, prefix)
+		})
+		//the server entry is where the client of r reaches the api, the rest is the same for everyone
+		doc := maps.Clone(spec)
+		doc["servers"] = []any{map[string]any{"url": externalURL(r, prefix)}}
+		encoded, err := json.Marshal(doc)
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.Write(encoded)
+	}
+}
+
+//docsPage is a redoc page rendering openapi.json next to it
+//
+//go:embed docs.html
+var docsPage []byte
+
+//apiDocs serves docsPage
+func apiDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(docsPage)
+}
+
+//pathParam matches the {name} and {name:pattern} variables of a route template
+var pathParam = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+//buildOpenAPISpec walks routes and describes every route below prefix
+func buildOpenAPISpec(routes *mux.Router, prefix string) map[string]any {
+	schemas := map[string]any{}
+	paths := map[string]map[string]any{}
+	routes.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			//subrouter prefixes have no methods, their routes are walked on their own
+			return nil
+		}
+		path := strings.TrimPrefix(template, prefix)
+		path = pathParam.ReplaceAllString(path, "{$1}")
+		for _, method := range methods {
+			if paths[path] == nil {
+				paths[path] = map[string]any{}
+			}
+			paths[path][strings.ToLower(method)] = describeOperation(method, path, apiOperations[method+" "+path], schemas)
+		}
+		return nil
+	})
+
+	schemas["Error"] = schemaOf(reflect.TypeOf(errorEnvelope{}), schemas)
+	schemas["Problem"] = schemaOf(reflect.TypeOf(problemDetails{}), schemas)
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "User management API",
+			"version": "v1",
+		},
+		"servers": []any{map[string]any{"url": prefix}},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"bearerAuth":    map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"apiKeyAuth":    map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"sessionCookie": map[string]any{"type": "apiKey", "in": "cookie", "name": sessionCookie},
+			},
+		},
+		//every operation accepts all three, public ones override this with an empty list
+		"security": []any{
+			map[string]any{"bearerAuth": []any{}},
+			map[string]any{"apiKeyAuth": []any{}},
+			map[string]any{"sessionCookie": []any{}},
+		},
+	}
+}
+
+//describeOperation is the openapi operation object of one route method
+func describeOperation(method, path string, op openAPIOperation, schemas map[string]any) map[string]any {
+	summary := op.summary
+	if summary == "" {
+		summary = method + " " + path
+	}
+	o := map[string]any{"summary": summary}
+	if op.admin {
+		o["description"] = "Needs the admin role."
+	}
+	if op.public {
+		o["security"] = []any{}
+	}
+
+	var params []any
+	for _, m := range pathParam.FindAllStringSubmatch(path, -1) {
+		params = append(params, map[string]any{"name": m[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+	}
+	for _, p := range op.query {
+		params = append(params, map[string]any{"name": p.name, "in": "query", "description": p.description, "schema": map[string]any{"type": p.schemaType}})
+	}
+	for _, p := range op.headers {
+		params = append(params, map[string]any{"name": p.name, "in": "header", "description": p.description, "schema": map[string]any{"type": p.schemaType}})
+	}
+	if params != nil {
+		o["parameters"] = params
+	}
+
+	if op.request != nil {
+		o["requestBody"] = map[string]any{
+			"required": true,
+			"content":  map[string]any{"application/json": map[string]any{"schema": schemaOf(reflect.TypeOf(op.request), schemas)}},
+		}
+	}
+
+	status := op.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]any{"description": http.StatusText(status)}
+	switch {
+	case op.contentType != "":
+		success["content"] = map[string]any{op.contentType: map[string]any{"schema": map[string]any{"type": "string"}}}
+	case op.response != nil:
+		success["content"] = map[string]any{"application/json": map[string]any{"schema": schemaOf(reflect.TypeOf(op.response), schemas)}}
+	}
+	o["responses"] = map[string]any{
+		strconv.Itoa(status): success,
+		"default": map[string]any{
+			"description": "Error",
+			"content": map[string]any{
+				"application/json": map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/Error"}},
+				mediaTypeProblem:   map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/Problem"}},
+			},
+		},
+	}
+	return o
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+//schemaOf reflects the json schema of t from its json tags. structs become named components in schemas and are referenced
+func schemaOf(t reflect.Type, schemas map[string]any) map[string]any {
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == reflect.TypeOf(json.RawMessage{}):
+		return map[string]any{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := schemaOf(t.Elem(), schemas)
+		if _, ref := s["$ref"]; ref {
+			return map[string]any{"allOf": []any{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		name := componentName(t)
+		if _, ok := schemas[name]; !ok {
+			//placeholder first, so a struct referring to itself doesnt recurse forever
+			schemas[name] = nil
+			schemas[name] = structSchema(t, schemas)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
+
+//structSchema is the object schema of a struct. the same types are used for requests and responses,
+//so no field is marked required: an id is always in a response but never needed in a request
+func structSchema(t reflect.Type, schemas map[string]any) map[string]any {
+	properties := map[string]any{}
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if !f.IsExported() || tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = schemaOf(f.Type, schemas)
+	}
+	return map[string]any{"type": "object", "properties": properties}
+}
+
+//componentName turns go type names like tokenResponse into schema names like TokenResponse
+func componentName(t reflect.Type) string {
+	name := []rune(t.Name())
+	name[0] = unicode.ToUpper(name[0])
+	return string(name)
+}
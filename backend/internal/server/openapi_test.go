@@ -0,0 +1,102 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+//openAPIDoc is the part of the spec the tests look at
+type openAPIDoc struct {
+	OpenAPI string `json:"openapi"`
+	Servers []struct {
+		URL string `json:"url"`
+	} `json:"servers"`
+	Paths map[string]map[string]struct {
+		Summary    string            `json:"summary"`
+		Parameters []openAPIParamDoc `json:"parameters"`
+		Security   *[]any            `json:"security"`
+		Responses  map[string]any    `json:"responses"`
+	} `json:"paths"`
+	Components struct {
+		Schemas         map[string]map[string]any `json:"schemas"`
+		SecuritySchemes map[string]any            `json:"securitySchemes"`
+	} `json:"components"`
+}
+
+type openAPIParamDoc struct {
+	Name string `json:"name"`
+	In   string `json:"in"`
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	//graphiql is the only route that is registered or not, with it every documented route is served
+	ts := newTestServer(t, map[string]string{"GRAPHIQL": "true"})
+
+	res := ts.do("GET", "/api/v1/openapi.json", "", nil)
+	expect(t, res, http.StatusOK)
+	var doc openAPIDoc
+	res.decode(t, &doc)
+	if doc.OpenAPI != "3.0.3" || len(doc.Servers) != 1 || doc.Servers[0].URL != "/api/v1" {
+		t.Fatalf("the spec is %s %+v", doc.OpenAPI, doc.Servers)
+	}
+
+	//every route is in the spec and documented, and nothing documented is missing from the routes
+	documented := map[string]bool{}
+	for key := range apiOperations {
+		documented[key] = false
+	}
+	for path, methods := range doc.Paths {
+		for method, op := range methods {
+			key := strings.ToUpper(method) + " " + path
+			if _, ok := documented[key]; !ok {
+				t.Errorf("%s is served but not described in apiOperations", key)
+			}
+			documented[key] = true
+			if op.Responses["default"] == nil {
+				t.Errorf("%s has no error response", key)
+			}
+		}
+	}
+	for key, seen := range documented {
+		if !seen {
+			t.Errorf("%s is described but no route serves it", key)
+		}
+	}
+
+	list := doc.Paths["/users"]["get"]
+	for _, name := range []string{"limit", "offset", "sort"} {
+		if !slices.Contains(list.Parameters, openAPIParamDoc{name, "query"}) {
+			t.Errorf("GET /users has no %s parameter", name)
+		}
+	}
+	if login := doc.Paths["/login"]["post"]; login.Security == nil || len(*login.Security) != 0 {
+		t.Error("the login isnt public")
+	}
+	if list.Security != nil {
+		t.Error("the list is public")
+	}
+	for _, schema := range []string{"User", "Error", "Problem"} {
+		if doc.Components.Schemas[schema] == nil {
+			t.Errorf("no %s schema", schema)
+		}
+	}
+	properties, _ := doc.Components.Schemas["User"]["properties"].(map[string]any)
+	for _, field := range []string{"id", "name", "email", "phone", "public_id"} {
+		if properties[field] == nil {
+			t.Errorf("the User schema has no %s", field)
+		}
+	}
+	for _, scheme := range []string{"bearerAuth", "apiKeyAuth", "sessionCookie"} {
+		if doc.Components.SecuritySchemes[scheme] == nil {
+			t.Errorf("no %s security scheme", scheme)
+		}
+	}
+
+	res = ts.do("GET", "/api/v1/docs", "", nil)
+	expect(t, res, http.StatusOK)
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") || !strings.Contains(string(res.body), "openapi.json") {
+		t.Fatalf("the docs are %s: %.100s", res.Header.Get("Content-Type"), res.body)
+	}
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"api/internal/model"
+)
+
+//outbox event types, published to the message bus
+const (
+	outboxUserCreated = "user.created"
+	outboxUserUpdated = "user.updated"
+	outboxUserDeleted = "user.deleted"
+)
+
+//relay timings: how often an idle relay looks for new rows, and the backoff range while the broker is down
+const (
+	outboxPollInterval = time.Second
+	outboxBatchSize    = 100
+	outboxMinBackoff   = time.Second
+	outboxMaxBackoff   = time.Minute
+	//any constant works, it only has to be the same for every instance of the api
+	outboxRelayLockId = 7268001
+)
+
+//outboxEnabled is set by StartWorkers when OUTBOX_PUBLISHER names a broker. without one nothing is written to the outbox,
+//so deployments without a message bus dont collect rows nobody ever sends
+var outboxEnabled bool
+
+//outboxEvent is the payload published for every user change
+type outboxEvent struct {
+	Id        string     `json:"id"`
+	Type      string     `json:"type"`
+	Timestamp time.Time  `json:"timestamp"`
+	User      model.User `json:"user"`
+}
+
+//enqueueOutbox stores an event for the relay. pass the transaction of the change, so the event is only ever
+//published for changes that were committed and never lost for those that were.
+//the change goes into the change feed of GET /users/changes as well, that one is written with or without a broker
+func enqueueOutbox(ctx context.Context, tx execer, eventType string, u model.User) error {
+	if err := appendUserChange(ctx, tx, eventType, u); err != nil {
+		return err
+	}
+	if !outboxEnabled {
+		return nil
+	}
+	id, err := randomToken(16)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(outboxEvent{Id: id, Type: eventType, Timestamp: time.Now().UTC(), User: u})
+	if err != nil {
+		return fmt.Errorf("encoding outbox event: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO outbox (event_id, type, payload) VALUES ($1, $2, $3)", id, eventType, string(payload)); err != nil {
+		return fmt.Errorf("writing outbox event: %w", err)
+	}
+	return nil
+}
+
+//publisher sends an event to the message bus and only returns nil once the broker has it
+//nats is built in, a kafka producer writing to a topic would implement the same interface
+type publisher interface {
+	Publish(eventId, eventType string, payload []byte) error
+	//Close flushes what is still buffered and releases the connection, it is called once at shutdown
+	Close() error
+}
+
+//natsPublisher publishes every event to one subject. the event id goes into the Nats-Msg-Id header,
+//so a jetstream stream on the subject drops the duplicates at least once delivery can produce
+type natsPublisher struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func (p *natsPublisher) Publish(eventId, eventType string, payload []byte) error {
+	msg := nats.NewMsg(p.subject)
+	msg.Header.Set(nats.MsgIdHdr, eventId)
+	msg.Header.Set("Event-Type", eventType)
+	msg.Data = payload
+	if err := p.conn.PublishMsg(msg); err != nil {
+		return err
+	}
+	//flush waits for the server to acknowledge everything sent so far
+	return p.conn.FlushTimeout(5 * time.Second)
+}
+
+//Close delivers the messages still buffered by the client before closing the connection
+func (p *natsPublisher) Close() error {
+	return p.conn.Drain()
+}
+
+//CheckHealth reports whether the connection to nats is up, for /readyz. while it is down the relay retries and the
+//events wait in the outbox
+func (p *natsPublisher) CheckHealth(ctx context.Context) error {
+	if !p.conn.IsConnected() {
+		return fmt.Errorf("nats connection is %s", p.conn.Status())
+	}
+	return nil
+}
+
+//newPublisher returns the publisher chosen by cfg.OutboxPublisher, or nil when there is none
+//"nats" publishes to cfg.OutboxNATSSubject on the server at cfg.NATSURL
+func newPublisher(cfg *Config) (publisher, error) {
+	if cfg.OutboxPublisher != "nats" {
+		return nil, nil
+	}
+	//keep reconnecting forever, the relay backs off and retries while the connection is down
+	conn, err := nats.Connect(cfg.NATSURL, nats.MaxReconnects(-1), nats.RetryOnFailedConnect(true))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to nats: %w", err)
+	}
+	return &natsPublisher{conn: conn, subject: cfg.OutboxNATSSubject}, nil
+}
+
+//runOutboxRelay publishes outbox rows in order and marks them sent, it runs for the lifetime of the process
+//a row is marked only after the broker accepted it, so a crash in between publishes it again: delivery is at least once.
+//while the broker is down the relay backs off exponentially and keeps the order by retrying the same row
+func runOutboxRelay(ctx context.Context, db *sql.DB, pub publisher, logger *slog.Logger) {
+	backoff := outboxMinBackoff
+	for ctx.Err() == nil {
+		sent, err := relayOutboxBatch(db, pub)
+		if err != nil {
+			logger.Warn("relaying outbox failed, backing off", "error", err, "retry_in", backoff.String())
+			sleepContext(ctx, backoff)
+			backoff = min(backoff*2, outboxMaxBackoff)
+			continue
+		}
+		backoff = outboxMinBackoff
+		if sent < outboxBatchSize {
+			sleepContext(ctx, outboxPollInterval)
+		}
+	}
+}
+
+//sleepContext waits for d, or less if ctx is cancelled first
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+//relayOutboxBatch publishes up to one batch of unsent rows and returns how many were sent
+//the advisory lock makes sure only one instance relays at a time, otherwise two relays could publish out of order
+func relayOutboxBatch(db *sql.DB, pub publisher) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRow("SELECT pg_try_advisory_xact_lock($1)", outboxRelayLockId).Scan(&locked); err != nil {
+		return 0, fmt.Errorf("locking outbox: %w", err)
+	}
+	if !locked {
+		return 0, nil
+	}
+
+	rows, err := tx.Query("SELECT id, event_id, type, payload FROM outbox WHERE published_at IS NULL ORDER BY id LIMIT $1", outboxBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("loading outbox: %w", err)
+	}
+	type pending struct {
+		id            int64
+		eventId, kind string
+		payload       []byte
+	}
+	var batch []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.eventId, &p.kind, &p.payload); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("reading outbox: %w", err)
+		}
+		batch = append(batch, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("reading outbox: %w", err)
+	}
+
+	sent := 0
+	var publishErr error
+	for _, p := range batch {
+		if publishErr = pub.Publish(p.eventId, p.kind, p.payload); publishErr != nil {
+			break
+		}
+		if _, err := tx.Exec("UPDATE outbox SET published_at = now() WHERE id = $1", p.id); err != nil {
+			return 0, fmt.Errorf("marking outbox event sent: %w", err)
+		}
+		sent++
+	}
+	//whatever was published before a failure is still marked as sent
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("marking outbox events sent: %w", err)
+	}
+	if publishErr != nil {
+		return sent, fmt.Errorf("publishing outbox event: %w", publishErr)
+	}
+	return sent, nil
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+//defaultPageSize is the page size of the lists when ?limit= isnt given, defaultMaxPageSize caps ?limit= when
+//MAX_PAGE_SIZE isnt set
+const (
+	defaultPageSize    = 50
+	defaultMaxPageSize = 500
+)
+
+//maxPageSize is the largest page a list hands out, set from the config by New
+var maxPageSize = defaultMaxPageSize
+
+//publicBaseURL is put in front of the paths of links, see Config.PublicBaseURL and externalURL. set from the config by New
+var publicBaseURL string
+
+//page is the ?limit= and ?offset= of a list request after defaults and clamping
+type page struct {
+	Limit  int
+	Offset int
+}
+
+//parsePage reads ?limit= and ?offset= for the users, the groups and the audit log. a missing limit is defaultPageSize,
+//or maxPageSize when that is smaller. a bigger one than maxPageSize is cut down to it instead of failing, so clients
+//that ask for everything get the first page. values that arent numbers, a limit below 1 and a negative offset are
+//answered with 400 and ok is false. what was used goes into the X-Page-Limit and X-Page-Offset headers, clients see
+//there when their limit was clamped
+func parsePage(w http.ResponseWriter, r *http.Request) (p page, ok bool) {
+	query := r.URL.Query()
+	p.Limit = min(defaultPageSize, maxPageSize)
+	if v := query.Get("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "limit must be a number of at least 1")
+			return page{}, false
+		}
+		p.Limit = min(parsed, maxPageSize)
+	}
+	if v := query.Get("offset"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 0 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "offset must be a number of at least 0")
+			return page{}, false
+		}
+		p.Offset = parsed
+	}
+	w.Header().Set("X-Page-Limit", strconv.Itoa(p.Limit))
+	w.Header().Set("X-Page-Offset", strconv.Itoa(p.Offset))
+	return p, true
+}
+
+//setPageLinks sends the number of items of the whole list as X-Total-Count, and Link headers for the first,
+//previous, next and last page that clients can follow instead of computing offsets, see pageLinks
+func setPageLinks(w http.ResponseWriter, r *http.Request, p page, total int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	for _, l := range pageLinks(r, p, total) {
+		w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="%s"`, l.url, l.rel))
+	}
+}
+
+//pageLink is the url of one of the pages of a list
+type pageLink struct {
+	rel, url string
+}
+
+//pageLinks are the first, previous, next and last page of the list r asked for p of. the links are the url of r
+//with every other query parameter kept, so filters carry over. there is no prev link on the first page
+//and no next link on the last one
+func pageLinks(r *http.Request, p page, total int) []pageLink {
+	var links []pageLink
+	link := func(rel string, offset int) {
+		query := r.URL.Query()
+		query.Set("limit", strconv.Itoa(p.Limit))
+		query.Set("offset", strconv.Itoa(offset))
+		links = append(links, pageLink{rel, externalURL(r, r.URL.Path) + "?" + query.Encode()})
+	}
+	//the last page is the one following next from this page ends at, also when the offset isnt a multiple of the limit
+	last := p.Offset % p.Limit
+	if total > last {
+		last += (total - 1 - last) / p.Limit * p.Limit
+	}
+	link("first", 0)
+	if p.Offset > 0 {
+		link("prev", max(p.Offset-p.Limit, 0))
+	}
+	if p.Offset+p.Limit < total {
+		link("next", p.Offset+p.Limit)
+	}
+	link("last", last)
+	return links
+}
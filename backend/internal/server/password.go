@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//hashPassword hashes a password that already passed model.ValidatePassword
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("hashing password: %w", err)
+	}
+	return string(hash), nil
+}
+
+//SetPassword sets the password of user id without knowing the current one, for operators locked out of the api.
+//like a password reset it ends every session and revokes every refresh token of the user. it writes the database
+//directly, cached copies of the user in a running server are only refreshed once they expire
+func SetPassword(ctx context.Context, db *sql.DB, id, password string) error {
+	if msg := model.ValidatePassword(password); msg != "" {
+		return fmt.Errorf("the password %s", msg)
+	}
+	userId, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return store.ErrUserNotFound
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "UPDATE users SET password_hash = $1, password_change_required = false, version = version + 1, updated_at = CURRENT_TIMESTAMP WHERE id = $2", hash, userId)
+	if err != nil {
+		return fmt.Errorf("updating password: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err != nil {
+			return fmt.Errorf("updating password: %w", err)
+		}
+		return store.ErrUserNotFound
+	}
+	for _, stmt := range []string{
+		"UPDATE refresh_tokens SET revoked = true WHERE user_id = $1",
+		"DELETE FROM sessions WHERE user_id = $1",
+	} {
+		if _, err := tx.ExecContext(ctx, stmt, userId); err != nil {
+			return fmt.Errorf("revoking credentials after setting password: %w", err)
+		}
+	}
+	//there is no actor, the audit log shows the change without one
+	if err := recordAudit(ctx, tx, auditEvent{Action: auditUserPasswordReset, TargetUserId: userId, Details: map[string]any{"via": "cli"}}); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("updating password: %w", err)
+	}
+	return nil
+}
+
+//passwordChange is the body of PUT /api/v1/users/{id}/password
+type passwordChange struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+//changePassword sets a new password for a user after checking the current one
+//users created without a password can set their first one without sending current_password
+func changePassword(db *sql.DB, cache *userCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := userIdVar(r)
+
+		var body passwordChange
+		if err := decodeRequest(r, &body); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+		if msg := model.ValidatePassword(body.NewPassword); msg != "" {
+			writeValidationError(w, r, model.FieldErrors{"new_password": msg})
+			return
+		}
+
+		var currentHash sql.NullString
+		err := db.QueryRowContext(r.Context(), "SELECT password_hash FROM users WHERE id = $1", id).Scan(&currentHash)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeUserNotFound(w, r, id)
+			return
+		}
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("loading password hash: %w", err))
+			return
+		}
+		if currentHash.Valid && bcrypt.CompareHashAndPassword([]byte(currentHash.String), []byte(body.CurrentPassword)) != nil {
+			writeError(w, r, http.StatusForbidden, codeInvalidCredentials, "current password is incorrect")
+			return
+		}
+
+		newHash, err := hashPassword(body.NewPassword)
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("starting transaction: %w", err))
+			return
+		}
+		defer tx.Rollback()
+
+		//only overwrite the hash we checked, so two concurrent changes cant both succeed with the same current password
+		res, err := tx.ExecContext(r.Context(), "UPDATE users SET password_hash = $1, password_change_required = false, version = version + 1, updated_at = now() WHERE id = $2 AND COALESCE(password_hash, '') = COALESCE($3, '')",
+			newHash, id, currentHash)
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("updating password: %w", err))
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			writeError(w, r, http.StatusConflict, codeConflict, "the password was changed by another request, try again")
+			return
+		}
+		//the audit event only says that the password changed, never anything about the password itself
+		event := auditEventFor(r.Context(), auditUserPasswordChanged)
+		event.TargetUserId = id
+		if err := recordAudit(r.Context(), tx, event); err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			internalServerError(w, r, fmt.Errorf("updating password: %w", err))
+			return
+		}
+		//the version went up, the etag of a cached copy would be out of date
+		cache.forget(r.Context(), id)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
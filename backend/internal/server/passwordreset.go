@@ -0,0 +1,160 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"api/internal/model"
+)
+
+//password reset tokens are only valid for a short time, they are as good as the password itself
+const passwordResetTTL = time.Hour
+
+//forgotPasswordRequest is the body of POST /api/v1/password/forgot
+type forgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+//resetPasswordRequest is the body of POST /api/v1/password/reset
+type resetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+//forgotPassword emails a one time reset link to the account with the given email
+//it always answers 202, whether or not the email belongs to an account, so it cant be used to find out who is registered.
+//the email is sent by a job for the same reason, otherwise a slow smtp server would give it away through timing
+func forgotPassword(db *sql.DB, jobs *jobQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body forgotPasswordRequest
+		if err := decodeRequest(r, &body); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+
+		var (
+			userId int64
+			email  string
+		)
+		err := db.QueryRowContext(r.Context(), "SELECT id, email FROM users WHERE lower(email) = lower($1) ORDER BY id LIMIT 1",
+			strings.TrimSpace(body.Email)).Scan(&userId, &email)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			//nothing to send, but the answer is the same
+		case err != nil:
+			internalServerError(w, r, fmt.Errorf("looking up user for password reset: %w", err))
+			return
+		default:
+			token, err := randomToken(32)
+			if err != nil {
+				internalServerError(w, r, err)
+				return
+			}
+			//the token and its email are stored together, a reset link is only mailed for a token that was stored.
+			//a reset is an emailSecurity email, the notification preferences cant turn it off
+			tx, err := db.BeginTx(r.Context(), nil)
+			if err != nil {
+				internalServerError(w, r, err)
+				return
+			}
+			defer tx.Rollback()
+			_, err = tx.ExecContext(r.Context(), "INSERT INTO password_resets (token_hash, user_id, expires_at) VALUES ($1, $2, $3)",
+				hashToken(token), userId, time.Now().UTC().Add(passwordResetTTL))
+			if err != nil {
+				internalServerError(w, r, fmt.Errorf("storing password reset token: %w", err))
+				return
+			}
+			err = jobs.enqueue(r.Context(), tx, jobTypeEmail, emailMessage{
+				To:      email,
+				Subject: "Reset your password",
+				Text: "Someone asked to reset the password of your account. If that was you, open this link within an hour to choose a new password:\n\n" +
+					frontendLink("/reset-password", "token", token) + "\n\nIf it wasn't you, you can ignore this email, your password stays the same.\n",
+			})
+			if err != nil {
+				internalServerError(w, r, err)
+				return
+			}
+			if err := tx.Commit(); err != nil {
+				internalServerError(w, r, fmt.Errorf("storing password reset token: %w", err))
+				return
+			}
+			jobs.notify()
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+//resetPassword sets a new password using a token from forgotPassword
+//the token is consumed, and so are all other outstanding reset tokens of the user. existing sessions and refresh tokens are
+//revoked too, whoever had access before the reset shouldnt keep it
+func resetPassword(db *sql.DB, cache *userCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body resetPasswordRequest
+		if err := decodeRequest(r, &body); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+		if msg := model.ValidatePassword(body.NewPassword); msg != "" {
+			writeValidationError(w, r, model.FieldErrors{"new_password": msg})
+			return
+		}
+		newHash, err := hashPassword(body.NewPassword)
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("starting transaction: %w", err))
+			return
+		}
+		defer tx.Rollback()
+
+		//the token is locked while it is checked and consumed with the other tokens of the user below, so two concurrent
+		//resets cant both use it
+		var userId int64
+		err = tx.QueryRowContext(r.Context(), "SELECT user_id FROM password_resets WHERE token_hash = $1 AND used_at IS NULL AND expires_at > now() FOR UPDATE",
+			hashToken(body.Token)).Scan(&userId)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, http.StatusBadRequest, codeInvalidToken, "password reset token is invalid, expired or already used")
+			return
+		}
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("consuming password reset token: %w", err))
+			return
+		}
+
+		if _, err := tx.ExecContext(r.Context(), "UPDATE users SET password_hash = $1, password_change_required = false, version = version + 1, updated_at = now() WHERE id = $2", newHash, userId); err != nil {
+			internalServerError(w, r, fmt.Errorf("updating password: %w", err))
+			return
+		}
+		for _, stmt := range []string{
+			"UPDATE password_resets SET used_at = now() WHERE user_id = $1 AND used_at IS NULL",
+			"UPDATE refresh_tokens SET revoked = true WHERE user_id = $1",
+			"DELETE FROM sessions WHERE user_id = $1",
+		} {
+			if _, err := tx.ExecContext(r.Context(), stmt, userId); err != nil {
+				internalServerError(w, r, fmt.Errorf("revoking credentials after password reset: %w", err))
+				return
+			}
+		}
+		//nobody is logged in here, the reset token stands in for the user
+		if err := recordAudit(r.Context(), tx, auditEvent{ActorId: userId, Action: auditUserPasswordReset, TargetUserId: userId}); err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			internalServerError(w, r, fmt.Errorf("resetting password: %w", err))
+			return
+		}
+		cache.forget(r.Context(), userId)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//prefsColumns lists the columns scanPrefs expects, in order
+const prefsColumns = "welcome_email, marketing, security_alerts, updated_at"
+
+func scanPrefs(row store.RowScanner, p *model.NotificationPrefs) error {
+	return row.Scan(&p.WelcomeEmail, &p.Marketing, &p.SecurityAlerts, &p.UpdatedAt)
+}
+
+//the kinds of email a user can be asked about, see emailAllowed. each is a column of notification_prefs
+type emailKind string
+
+const (
+	emailWelcome   emailKind = "welcome_email"
+	emailMarketing emailKind = "marketing"
+	//emailSecurity are the password resets and the warnings about changes to the account, they are always sent
+	emailSecurity emailKind = "security_alerts"
+)
+
+//prefsInput is the body of PUT /users/{id}/preferences. it replaces all of them, so none can be left out
+type prefsInput struct {
+	WelcomeEmail   *bool `json:"welcome_email"`
+	Marketing      *bool `json:"marketing"`
+	SecurityAlerts *bool `json:"security_alerts"`
+}
+
+func (in prefsInput) validate() model.FieldErrors {
+	errs := model.FieldErrors{}
+	for field, v := range map[string]*bool{"welcome_email": in.WelcomeEmail, "marketing": in.Marketing, "security_alerts": in.SecurityAlerts} {
+		if v == nil {
+			errs[field] = "is required"
+		}
+	}
+	if in.SecurityAlerts != nil && !*in.SecurityAlerts {
+		errs["security_alerts"] = "cant be turned off, they are about the safety of the account"
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+//loadPrefs returns the preferences of the user id, creating its row with the defaults when it has none yet, unless the
+//database is read only.
+//store.ErrUserNotFound is a user that doesnt exist. the insert only adds a row that is missing and is plain sql for
+//all three databases, when another request added it first the row is read again
+func loadPrefs(ctx context.Context, db *sql.DB, id int64) (model.NotificationPrefs, error) {
+	var p model.NotificationPrefs
+	query := "SELECT " + prefsColumns + " FROM notification_prefs WHERE user_id = $1"
+	err := scanPrefs(db.QueryRowContext(ctx, query, id), &p)
+	if !errors.Is(err, sql.ErrNoRows) {
+		if err != nil {
+			return p, fmt.Errorf("loading notification preferences: %w", err)
+		}
+		return p, nil
+	}
+	//a read only database cant take the row, the user gets the defaults of the table without it
+	if readOnlyDatabase {
+		var exists bool
+		if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", id).Scan(&exists); err != nil {
+			return p, fmt.Errorf("loading notification preferences: %w", err)
+		}
+		if !exists {
+			return p, store.ErrUserNotFound
+		}
+		return model.NotificationPrefs{WelcomeEmail: true, SecurityAlerts: true}, nil
+	}
+	_, insertErr := db.ExecContext(ctx, `INSERT INTO notification_prefs (user_id)
+		SELECT id FROM users WHERE id = $1 AND NOT EXISTS (SELECT 1 FROM notification_prefs WHERE user_id = $1)`, id)
+	err = scanPrefs(db.QueryRowContext(ctx, query, id), &p)
+	switch {
+	case errors.Is(err, sql.ErrNoRows) && insertErr != nil:
+		return p, fmt.Errorf("creating notification preferences: %w", insertErr)
+	case errors.Is(err, sql.ErrNoRows):
+		return p, store.ErrUserNotFound
+	case err != nil:
+		return p, fmt.Errorf("loading notification preferences: %w", err)
+	}
+	return p, nil
+}
+
+//emailAllowed reports whether the user id wants emails of kind. a user without preferences has the defaults of the
+//table, and security emails are sent whatever the preferences say. q is the db or the transaction the user is in
+func emailAllowed(ctx context.Context, q inserter, id int64, kind emailKind) (bool, error) {
+	if kind == emailSecurity {
+		return true, nil
+	}
+	var allowed bool
+	//kind is one of the constants above, never input
+	err := q.QueryRowContext(ctx, "SELECT "+string(kind)+" FROM notification_prefs WHERE user_id = $1", id).Scan(&allowed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return kind == emailWelcome, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("loading notification preferences: %w", err)
+	}
+	return allowed, nil
+}
+
+//getPrefs returns the notification preferences of the user in the path
+func getPrefs(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := userIdVar(r)
+		p, err := loadPrefs(r.Context(), db, id)
+		if err != nil {
+			writeUserOpError(w, r, id, err)
+			return
+		}
+		writeResponse(w, r, http.StatusOK, p)
+	}
+}
+
+//putPrefs replaces the notification preferences of the user in the path
+func putPrefs(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := userIdVar(r)
+		var in prefsInput
+		if err := decodeRequest(r, &in); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+		if errs := in.validate(); errs != nil {
+			writeValidationError(w, r, errs)
+			return
+		}
+		//the row is there after loading, so the update always finds it
+		if _, err := loadPrefs(r.Context(), db, id); err != nil {
+			writeUserOpError(w, r, id, err)
+			return
+		}
+		_, err := db.ExecContext(r.Context(), "UPDATE notification_prefs SET welcome_email = $1, marketing = $2, security_alerts = $3, updated_at = $4 WHERE user_id = $5",
+			*in.WelcomeEmail, *in.Marketing, *in.SecurityAlerts, time.Now().UTC(), id)
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("updating notification preferences: %w", err))
+			return
+		}
+		p, err := loadPrefs(r.Context(), db, id)
+		if err != nil {
+			writeUserOpError(w, r, id, err)
+			return
+		}
+		writeResponse(w, r, http.StatusOK, p)
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"api/internal/model"
+)
+
+//error formats ERROR_FORMAT can choose for json errors, see Config.ErrorFormat
+const (
+	errorFormatEnvelope = "envelope"
+	errorFormatProblem  = "problem"
+)
+
+//mediaTypeProblem is the content type of rfc 7807 problem documents
+const mediaTypeProblem = "application/problem+json"
+
+//problemErrors answers every json error with a problem document instead of the error envelope, not only those of
+//clients that accept mediaTypeProblem. set from Config.ErrorFormat by New
+var problemErrors bool
+
+//errorTitles has the title of every error code, the short summary that stays the same from one occurrence to the next.
+//it is the one place an error code is described: the problem types are made from it (see problemType),
+//GET /errors/{code} serves it, and a code missing here is sent with about:blank as its type
+var errorTitles = map[string]string{
+	codeUserNotFound:           "User not found",
+	codeNotFound:               "Not found",
+	codeInvalidRequest:         "Invalid request",
+	codeValidationFailed:       "Validation failed",
+	codeConflict:               "Conflict",
+	codeInternalError:          "Internal server error",
+	codePreconditionFailed:     "Precondition failed",
+	codePreconditionRequired:   "Precondition required",
+	codeIdempotencyKeyReused:   "Idempotency key reused",
+	codeInvalidCredentials:     "Invalid credentials",
+	codeUnauthorized:           "Unauthorized",
+	codeForbidden:              "Forbidden",
+	codeNotConfigured:          "Not configured",
+	codeInvalidState:           "Invalid state",
+	codeEmailNotVerified:       "Email not verified",
+	codeInvalidToken:           "Invalid token",
+	codeTooManyRequests:        "Too many requests",
+	codeAccountDeactivated:     "Account deactivated",
+	codeTimeout:                "Timeout",
+	codePayloadTooLarge:        "Payload too large",
+	codeOverloaded:             "Overloaded",
+	codeMethodNotAllowed:       "Method not allowed",
+	codeRouteNotFound:          "Route not found",
+	codeQueryTooComplex:        "Query too complex",
+	codeUnsupportedMediaType:   "Unsupported media type",
+	codeDirectoryUnavailable:   "Directory unavailable",
+	codeMaintenance:            "Maintenance",
+	codeNetworkNotAllowed:      "Network not allowed",
+	codeDeletionLimitExceeded:  "Deletion limit exceeded",
+	codeCursorExpired:          "Cursor expired",
+	codePasswordChangeRequired: "Password change required",
+	codeClientUpgradeRequired:  "Client upgrade required",
+	codeReadOnly:               "Read only",
+}
+
+//problemDetails is an error as an rfc 7807 problem document. it carries what the error envelope does: code, fields,
+//meta and request_id are extension members with the same names, detail is the message
+type problemDetails struct {
+	Type      string            `json:"type"`
+	Title     string            `json:"title"`
+	Status    int               `json:"status"`
+	Detail    string            `json:"detail,omitempty"`
+	Instance  string            `json:"instance"`
+	Code      string            `json:"code"`
+	Fields    model.FieldErrors `json:"fields,omitempty"`
+	Meta      *errorMeta        `json:"meta,omitempty"`
+	RequestId string            `json:"request_id,omitempty"`
+}
+
+//problemType is the type uri and the title of an error code. the uri is GET /errors/{code} of this server as the
+//client of r reaches it, so following it describes the error
+func problemType(r *http.Request, code string) (string, string, bool) {
+	title, ok := errorTitles[code]
+	if !ok {
+		return "about:blank", "", false
+	}
+	return externalURL(r, apiPath("/api/v1/errors/"+code)), title, true
+}
+
+//toProblem turns an error envelope of a response with status into a problem document about the request r
+func toProblem(r *http.Request, status int, e errorEnvelope) problemDetails {
+	typeURI, title, ok := problemType(r, e.Error.Code)
+	if !ok {
+		//about:blank has the status text as its title
+		title = http.StatusText(status)
+	}
+	return problemDetails{
+		Type:      typeURI,
+		Title:     title,
+		Status:    status,
+		Detail:    e.Error.Message,
+		Instance:  r.URL.Path,
+		Code:      e.Error.Code,
+		Fields:    e.Error.Fields,
+		Meta:      e.Error.Meta,
+		RequestId: e.Error.RequestId,
+	}
+}
+
+//wantsProblem reports whether an error in format is sent as a problem document: when the accept header lists
+//mediaTypeProblem, whatever it ranks it against, since it only ever applies to errors, or for json errors when
+//problemErrors is on
+func wantsProblem(r *http.Request, format string) bool {
+	if problemErrors && format == formatJSON {
+		return true
+	}
+	for part := range strings.SplitSeq(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mediaType != mediaTypeProblem {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+//errorTypeDoc is the body of GET /errors/{code}
+type errorTypeDoc struct {
+	XMLName xml.Name `json:"-" xml:"error_type"`
+	Type    string   `json:"type" xml:"type"`
+	Code    string   `json:"code" xml:"code"`
+	Title   string   `json:"title" xml:"title"`
+}
+
+//getErrorType describes the error code in the path, the type uris of the problem documents point here
+func getErrorType(w http.ResponseWriter, r *http.Request) {
+	code := mux.Vars(r)["code"]
+	typeURI, title, ok := problemType(r, code)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "there is no error code "+code)
+		return
+	}
+	writeResponse(w, r, http.StatusOK, errorTypeDoc{Type: typeURI, Code: code, Title: title})
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"api/internal/model"
+)
+
+//TestEveryErrorCodeHasATitle reads the codes out of response.go, a code without a title would be sent with about:blank
+func TestEveryErrorCodeHasATitle(t *testing.T) {
+	file, err := parser.ParseFile(token.NewFileSet(), "response.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes := 0
+	ast.Inspect(file, func(n ast.Node) bool {
+		spec, ok := n.(*ast.ValueSpec)
+		if !ok || len(spec.Names) != 1 || !strings.HasPrefix(spec.Names[0].Name, "code") || len(spec.Values) != 1 {
+			return true
+		}
+		lit, ok := spec.Values[0].(*ast.BasicLit)
+		if !ok {
+			return true
+		}
+		code, _ := strconv.Unquote(lit.Value)
+		codes++
+		if errorTitles[code] == "" {
+			t.Errorf("%s (%s) has no title", spec.Names[0].Name, code)
+		}
+		return true
+	})
+	if codes != len(errorTitles) {
+		t.Fatalf("response.go has %d codes, errorTitles %d", codes, len(errorTitles))
+	}
+}
+
+func TestProblemDocuments(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	u := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+	if _, err := ts.db.Exec("CREATE TRIGGER refuse_updates BEFORE UPDATE OF name ON users WHEN NEW.name = 'Boom' BEGIN SELECT RAISE(ABORT, 'disk I/O error'); END"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		method, path string
+		body         any
+		status       int
+		code         string
+	}{
+		{"POST", "/api/v1/users", "not json", http.StatusBadRequest, codeInvalidRequest},
+		{"GET", userPath(u.Id + 1000), nil, http.StatusNotFound, codeUserNotFound},
+		{"POST", "/api/v1/users", map[string]any{"name": "Ada", "email": "ada@example.com", "password": "password123"}, http.StatusConflict, codeConflict},
+		{"POST", "/api/v1/users", map[string]any{"name": "", "email": "nope"}, http.StatusUnprocessableEntity, codeValidationFailed},
+		{"PUT", userPath(u.Id), map[string]any{"name": "Boom", "email": "ada@example.com"}, http.StatusInternalServerError, codeInternalError},
+	} {
+		res := ts.do(tc.method, tc.path, admin, tc.body, "Accept", "application/problem+json")
+		if res.StatusCode != tc.status || res.Header.Get("Content-Type") != mediaTypeProblem {
+			t.Fatalf("%s %s answered %d %q: %s", tc.method, tc.path, res.StatusCode, res.Header.Get("Content-Type"), res.body)
+		}
+		var doc map[string]any
+		res.decode(t, &doc)
+		for _, member := range []string{"type", "title", "status", "detail", "instance", "request_id"} {
+			if doc[member] == nil || doc[member] == "" {
+				t.Fatalf("%s %s has no %s: %s", tc.method, tc.path, member, res.body)
+			}
+		}
+		if !strings.HasSuffix(doc["type"].(string), "/api/v1/errors/"+tc.code) || doc["title"] != errorTitles[tc.code] ||
+			doc["status"] != float64(tc.status) || doc["instance"] != tc.path || doc["code"] != tc.code ||
+			doc["request_id"] != res.Header.Get("X-Request-ID") {
+			t.Fatalf("%s %s answered %s", tc.method, tc.path, res.body)
+		}
+		if tc.code == codeValidationFailed && doc["fields"] == nil {
+			t.Fatalf("the fields are missing: %s", res.body)
+		}
+		if strings.Contains(string(res.body), "disk I/O") {
+			t.Fatalf("the 500 told the client %s", res.body)
+		}
+		//the type describes the error
+		typeRes := ts.do("GET", strings.TrimPrefix(doc["type"].(string), ts.URL), "", nil)
+		expect(t, typeRes, http.StatusOK)
+		var described errorTypeDoc
+		typeRes.decode(t, &described)
+		if described.Code != tc.code || described.Title != doc["title"] {
+			t.Fatalf("%s describes %s", doc["type"], typeRes.body)
+		}
+	}
+
+	//successes and the clients that dont ask stay as they were
+	res := ts.do("GET", userPath(u.Id), admin, nil, "Accept", "application/problem+json, application/json")
+	expect(t, res, http.StatusOK)
+	if res.Header.Get("Content-Type") != contentTypeJSON {
+		t.Fatalf("a user was sent as %q", res.Header.Get("Content-Type"))
+	}
+	for _, accept := range []string{"", "application/json", "application/problem+json;q=0"} {
+		res := ts.do("GET", userPath(u.Id+1000), admin, nil, "Accept", accept)
+		if res.Header.Get("Content-Type") != contentTypeJSON || res.errorCode() != codeUserNotFound {
+			t.Fatalf("Accept %q got %q: %s", accept, res.Header.Get("Content-Type"), res.body)
+		}
+	}
+}
+
+func TestProblemErrorFormat(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"ERROR_FORMAT": "problem"})
+	//New sets it for the package, the tests without a server expect the envelope
+	t.Cleanup(func() { problemErrors = false })
+	admin := ts.admin()
+
+	res := ts.do("GET", "/api/v1/users/12345", admin, nil)
+	expect(t, res, http.StatusNotFound)
+	var doc problemDetails
+	if err := json.Unmarshal(res.body, &doc); err != nil || res.Header.Get("Content-Type") != mediaTypeProblem || doc.Code != codeUserNotFound || doc.Status != http.StatusNotFound {
+		t.Fatalf("answered %q: %s", res.Header.Get("Content-Type"), res.body)
+	}
+	//xml clients keep the envelope in xml
+	res = ts.do("GET", "/api/v1/users/12345", admin, nil, "Accept", "application/xml")
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "application/xml") || !strings.Contains(string(res.body), "<code>user_not_found</code>") {
+		t.Fatalf("xml answered %q: %s", res.Header.Get("Content-Type"), res.body)
+	}
+}
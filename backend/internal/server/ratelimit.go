@@ -0,0 +1,148 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//defaults for RATE_LIMIT_RPS and RATE_LIMIT_BURST, a client can send a burst of 20 requests and then 10 per second
+const (
+	defaultRateLimitRPS   = 10
+	defaultRateLimitBurst = 20
+	//buckets untouched for this long are full again anyway and get evicted
+	rateLimitIdleTTL = 10 * time.Minute
+)
+
+//rateLimitStore hands out tokens from a bucket per client key
+//the in memory store below is enough for a single instance, a shared store (e.g. redis with a lua script) can implement
+//the same interface once the api runs on several instances
+type rateLimitStore interface {
+	//Take takes one token from key's bucket and returns how many are left
+	//when the bucket is empty it returns false and how long until the next token
+	Take(key string, rate float64, burst int) (ok bool, remaining int, wait time.Duration)
+	//Reset fills key's bucket up again
+	Reset(key string)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+//memoryRateLimitStore keeps the buckets in a map, cleanup evicts idle ones so the map stays bounded
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	//idleTTL is how long a bucket goes untouched before it is evicted, long enough for it to be full again by then
+	idleTTL time.Duration
+}
+
+func newMemoryRateLimitStore(idleTTL time.Duration) *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]*tokenBucket{}, idleTTL: idleTTL}
+}
+
+func (s *memoryRateLimitStore) Take(key string, rate float64, burst int) (bool, int, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		s.buckets[key] = b
+	}
+	//refill for the time since the last request, never above the burst size
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, 0, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, int(b.tokens), 0
+}
+
+//Reset drops key's bucket, the next Take starts with a full one
+func (s *memoryRateLimitStore) Reset(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.buckets, key)
+}
+
+//cleanup evicts buckets that were idle for s.idleTTL every interval, it runs for the lifetime of the process
+func (s *memoryRateLimitStore) cleanup(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now()
+		s.mu.Lock()
+		for key, b := range s.buckets {
+			if now.Sub(b.last) > s.idleTTL {
+				delete(s.buckets, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+//rateLimiter limits every client to rate requests per second with bursts of up to burst requests
+//api keys with their own rate_limit_per_minute get a bucket of that size refilling over a minute instead
+type rateLimiter struct {
+	store rateLimitStore
+	rate  float64
+	burst int
+	//exempt paths like health checks are never limited
+	exempt map[string]bool
+}
+
+//newRateLimiter returns nil when rate is 0, which turns rate limiting off
+func newRateLimiter(rate float64, burst int, exempt ...string) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	store := newMemoryRateLimitStore(rateLimitIdleTTL)
+	go store.cleanup(time.Minute)
+	l := &rateLimiter{store: store, rate: rate, burst: burst, exempt: map[string]bool{}}
+	for _, path := range exempt {
+		l.exempt[path] = true
+	}
+	return l
+}
+
+//middleware answers 429 with Retry-After once a client ran out of tokens
+//requests with a valid api key are keyed by the key, so a sync job has the same quota from every host, all others by ip address
+//X-RateLimit-Limit and X-RateLimit-Remaining tell clients the size of their bucket and what is left of it
+//it goes inside the cors middleware so browsers can read the 429, and after identifyApiKey
+func (l *rateLimiter) middleware(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.exempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key, rate, burst := "ip:"+clientIP(r), l.rate, l.burst
+		if k, ok := apiKeyFromContext(r.Context()); ok {
+			key = "key:" + strconv.Itoa(k.Id)
+			if k.RateLimitPerMinute > 0 {
+				rate, burst = float64(k.RateLimitPerMinute)/60, k.RateLimitPerMinute
+			}
+		}
+		if takeToken(w, r, l.store, key, rate, burst) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+//takeToken takes a token from the bucket of key in s and sets the X-RateLimit headers. when the bucket is empty it
+//answers 429 with Retry-After and returns false
+func takeToken(w http.ResponseWriter, r *http.Request, s rateLimitStore, key string, rate float64, burst int) bool {
+	ok, remaining, wait := s.Take(key, rate, burst)
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(burst))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		writeError(w, r, http.StatusTooManyRequests, codeTooManyRequests, "rate limit exceeded, slow down")
+	}
+	return ok
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+//recoverPanics turns a panic in a handler into a logged 500 instead of a reset connection
+//the stack is logged with the request id, the client only gets the generic internal error envelope.
+//if the handler already started the response the status cant change anymore, so the panic is only logged.
+//http.ErrAbortHandler is re-panicked, it is how a handler asks net/http to abort the response on purpose
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if err, ok := v.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(v)
+			}
+			logger := loggerFrom(r.Context())
+			if rec.status != 0 {
+				logger.Error("panic after the response was started", "panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+				return
+			}
+			logger.Error("panic serving request", "panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+			writeError(w, r, http.StatusInternalServerError, codeInternalError, "internal server error")
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"api/requestid"
+)
+
+//syncBuffer is a bytes.Buffer the handlers of a test server can log to while the test reads it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestRecoverPanics(t *testing.T) {
+	var logs syncBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/nil-map", func(w http.ResponseWriter, r *http.Request) {
+		var m map[string]int
+		m["boom"]++
+	})
+	mux.HandleFunc("/started", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("partial"))
+		panic("after the header")
+	})
+	mux.HandleFunc("/abort", func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})
+	mux.HandleFunc("/fine", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fine"))
+	})
+	srv := httptest.NewUnstartedServer(requestid.Middleware(withLogger(logger, recoverPanics(mux))))
+	//net/http logs the aborted handler, the test doesnt need to see it
+	srv.Config.ErrorLog = slog.NewLogLogger(slog.DiscardHandler, slog.LevelError)
+	srv.Start()
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/nil-map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	tr := testResponse{Response: res, body: body}
+	if res.StatusCode != http.StatusInternalServerError || tr.errorCode() != codeInternalError || strings.Contains(string(body), "nil map") {
+		t.Fatalf("the panic answered %d: %s", res.StatusCode, body)
+	}
+	id := res.Header.Get("X-Request-ID")
+	if out := logs.String(); !strings.Contains(out, "panic serving request") || !strings.Contains(out, "request_id="+id) || !strings.Contains(out, "recover_test.go") {
+		t.Fatalf("the panic was logged as %s", out)
+	}
+
+	//a started response keeps what it had
+	res, err = http.Get(srv.URL + "/started")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "partial" {
+		t.Fatalf("the started response became %d: %s", res.StatusCode, body)
+	}
+	if !strings.Contains(logs.String(), "panic after the response was started") {
+		t.Fatalf("the late panic was logged as %s", logs.String())
+	}
+
+	//net/http aborts the connection for ErrAbortHandler
+	if res, err := http.Get(srv.URL + "/abort"); err == nil {
+		res.Body.Close()
+		t.Fatalf("the aborted handler answered %d", res.StatusCode)
+	}
+
+	//the server is still up
+	res, err = http.Get(srv.URL + "/fine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "fine" {
+		t.Fatalf("after the panics got %d: %s", res.StatusCode, body)
+	}
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"api/internal/model"
+)
+
+//redis defaults. the timeouts are short, a cache that takes longer than the database to answer is no help
+const (
+	defaultRedisUserTTL     = 5 * time.Minute        //REDIS_USER_TTL
+	defaultRedisDialTimeout = time.Second            //dial_timeout in REDIS_URL
+	defaultRedisReadTimeout = 250 * time.Millisecond //read_timeout in REDIS_URL, writes get the same
+	redisRetryAfter         = 10 * time.Second
+	redisUserListKey        = "users:list"
+	redisUserKeyPrefix      = "user:"
+)
+
+//redisConfig is the shared cache, it is off when url is empty
+type redisConfig struct {
+	url string
+	//userTTL is how long a user read by id is kept, listTTL the first page of users, 0 doesnt cache the list
+	userTTL time.Duration
+	listTTL time.Duration
+}
+
+//OpenRedis connects to the redis at cfg.Redis.url, nil when there is none. like the read replica it is optional for serving,
+//one that cant be reached now is only logged and the users are read from the database until it is back
+func OpenRedis(ctx context.Context, cfg *Config, logger *slog.Logger) (*redis.Client, error) {
+	if cfg.Redis.url == "" {
+		return nil, nil
+	}
+	opts, err := redis.ParseURL(cfg.Redis.url)
+	if err != nil {
+		return nil, fmt.Errorf("parsing REDIS_URL: %w", err)
+	}
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = defaultRedisDialTimeout
+	}
+	if opts.ReadTimeout == 0 {
+		opts.ReadTimeout = defaultRedisReadTimeout
+	}
+	//a redis that is down fails fast instead of retrying while the request waits, the next request tries again
+	if opts.DialerRetries == 0 {
+		opts.DialerRetries = 1
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = -1
+	}
+	//the failures are logged by sharedUserCache, what the client says about them is debug output
+	redis.SetLogger(redisLogger{logger})
+	client := redis.NewClient(opts)
+	pingCtx, cancel := context.WithTimeout(ctx, dbPingTimeout)
+	defer cancel()
+	if err := client.Ping(pingCtx).Err(); err != nil {
+		logger.Warn("redis is unreachable, reading users from the database until it is back", "error", err)
+		return client, nil
+	}
+	logger.Info("connected to redis")
+	return client, nil
+}
+
+//sharedUserCache keeps users in redis for every instance of the api: a user under user:{id} and the first page of
+//the user list under users:list, both as the json the api answers with plus the version the etags are made of,
+//so redis-cli GET shows what a client would get.
+//redis failing never fails a request, it is logged and skipped for redisRetryAfter, reads go to the database meanwhile.
+//its methods do nothing on a nil cache
+type sharedUserCache struct {
+	client  *redis.Client
+	userTTL time.Duration
+	listTTL time.Duration
+	//downUntil is when redis is tried again after it failed, in unix nanoseconds
+	downUntil atomic.Int64
+}
+
+//cachedUser is a user as redis keeps it
+type cachedUser struct {
+	model.User
+	Version int `json:"version"`
+}
+
+//newSharedUserCache returns the cache in client, nil when there is no client
+func newSharedUserCache(client *redis.Client, c redisConfig) *sharedUserCache {
+	if client == nil {
+		return nil
+	}
+	return &sharedUserCache{client: client, userTTL: c.userTTL, listTTL: c.listTTL}
+}
+
+//redisUserKey is the key of the user id
+func redisUserKey(id int64) string {
+	return redisUserKeyPrefix + strconv.FormatInt(id, 10)
+}
+
+func (c *sharedUserCache) get(ctx context.Context, id int64) (model.User, bool) {
+	var cached cachedUser
+	if !c.load(ctx, redisUserKey(id), &cached) {
+		return model.User{}, false
+	}
+	cached.User.Version = cached.Version
+	return cached.User, true
+}
+
+func (c *sharedUserCache) put(ctx context.Context, id int64, u model.User) {
+	if c == nil {
+		return
+	}
+	c.store(ctx, redisUserKey(id), cachedUser{User: u, Version: u.Version}, c.userTTL)
+}
+
+func (c *sharedUserCache) getList(ctx context.Context) ([]model.User, bool) {
+	if c == nil || c.listTTL <= 0 {
+		return nil, false
+	}
+	var cached []cachedUser
+	if !c.load(ctx, redisUserListKey, &cached) {
+		return nil, false
+	}
+	users := make([]model.User, len(cached))
+	for i, cu := range cached {
+		users[i] = cu.User
+		users[i].Version = cu.Version
+	}
+	return users, true
+}
+
+func (c *sharedUserCache) putList(ctx context.Context, users []model.User) {
+	if c == nil || c.listTTL <= 0 {
+		return
+	}
+	cached := make([]cachedUser, len(users))
+	for i, u := range users {
+		cached[i] = cachedUser{User: u, Version: u.Version}
+	}
+	c.store(ctx, redisUserListKey, cached, c.listTTL)
+}
+
+//forget deletes the user id and the list, which may show it. unlike the reads it is tried while redis is considered down,
+//a user left in redis after a write would be served stale once it is back
+func (c *sharedUserCache) forget(ctx context.Context, id int64) {
+	if c == nil {
+		return
+	}
+	if err := c.client.Del(ctx, redisUserKey(id), redisUserListKey).Err(); err != nil {
+		c.failed(ctx, "forgetting user in redis", err)
+	}
+}
+
+//load reads key into v, false on a miss or when redis isnt there
+func (c *sharedUserCache) load(ctx context.Context, key string, v any) bool {
+	if !c.up() {
+		return false
+	}
+	data, err := c.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		userCacheMisses.WithLabelValues("redis").Inc()
+		return false
+	}
+	if err != nil {
+		c.failed(ctx, "reading from redis", err)
+		return false
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		//written by a version of the api with another shape, it is replaced on the next write
+		userCacheMisses.WithLabelValues("redis").Inc()
+		return false
+	}
+	userCacheHits.WithLabelValues("redis").Inc()
+	return true
+}
+
+func (c *sharedUserCache) store(ctx context.Context, key string, v any, ttl time.Duration) {
+	if !c.up() {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		loggerFrom(ctx).Warn("encoding for redis", "key", key, "error", err)
+		return
+	}
+	if err := c.client.Set(ctx, key, data, ttl).Err(); err != nil {
+		c.failed(ctx, "writing to redis", err)
+	}
+}
+
+//up reports whether redis should be tried, false for a nil cache and for a while after it failed
+func (c *sharedUserCache) up() bool {
+	return c != nil && time.Now().UnixNano() >= c.downUntil.Load()
+}
+
+//failed logs err and leaves redis alone for redisRetryAfter. a request that gave up on its own says nothing about redis
+func (c *sharedUserCache) failed(ctx context.Context, msg string, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	c.downUntil.Store(time.Now().Add(redisRetryAfter).UnixNano())
+	loggerFrom(ctx).Warn(msg+", using the database for "+redisRetryAfter.String(), "error", err)
+}
+
+//redisLogger passes the log of the redis client on to logger at debug level
+type redisLogger struct {
+	logger *slog.Logger
+}
+
+func (l redisLogger) Printf(ctx context.Context, format string, args ...any) {
+	l.logger.DebugContext(ctx, fmt.Sprintf(format, args...), "component", "redis")
+}
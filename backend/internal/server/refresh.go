@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+//refresh tokens live much longer than access tokens, REFRESH_TOKEN_TTL overrides the default
+const defaultRefreshTokenTTL = 30 * 24 * time.Hour
+
+var refreshTokenTTL = defaultRefreshTokenTTL
+
+//randomToken returns a url safe random string with n bytes of entropy
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating random token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+//hashToken is what we store instead of the token itself, so a leaked database doesnt leak usable tokens
+//a plain sha256 is enough because the tokens are long random strings, not guessable passwords
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+//execer is implemented by both *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+//issueRefreshToken stores a new refresh token for the user and returns it
+//every token belongs to a family: the one started at login plus all tokens obtained by rotating it
+func issueRefreshToken(ctx context.Context, db execer, userId int64, familyId string) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.ExecContext(ctx, "INSERT INTO refresh_tokens (user_id, token_hash, family_id, expires_at) VALUES ($1, $2, $3, $4)",
+		userId, hashToken(token), familyId, time.Now().UTC().Add(refreshTokenTTL))
+	if err != nil {
+		return "", fmt.Errorf("storing refresh token: %w", err)
+	}
+	return token, nil
+}
+
+//refreshRequest is the body of POST /api/v1/token/refresh and POST /api/v1/logout
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+//errRefreshTokenInvalid covers every reason a refresh token cant be used, the client just has to log in again
+var errRefreshTokenInvalid = errors.New("refresh token is invalid, expired or revoked")
+
+//rotateRefreshToken marks the presented token as used and issues its successor in the same family
+//presenting a token that was already used means it was copied by someone: the whole family is revoked,
+//which logs out both the thief and the real user, and the user has to log in again
+func rotateRefreshToken(ctx context.Context, db *sql.DB, logger *slog.Logger, token string) (userId int64, email, newToken string, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, "", "", fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var (
+		id        int64
+		familyId  string
+		expiresAt time.Time
+		usedAt    sql.NullTime
+		revoked   bool
+	)
+	//for update: two concurrent refreshes with the same token are serialized, the second one sees used_at set
+	err = tx.QueryRowContext(ctx, `SELECT t.id, t.user_id, u.email, t.family_id, t.expires_at, t.used_at, t.revoked
+		FROM refresh_tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1 FOR UPDATE OF t`, hashToken(token)).Scan(&id, &userId, &email, &familyId, &expiresAt, &usedAt, &revoked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, "", "", errRefreshTokenInvalid
+	}
+	if err != nil {
+		return 0, "", "", fmt.Errorf("loading refresh token: %w", err)
+	}
+
+	if usedAt.Valid && !revoked {
+		if _, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET revoked = true WHERE family_id = $1", familyId); err != nil {
+			return 0, "", "", fmt.Errorf("revoking refresh token family: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, "", "", fmt.Errorf("revoking refresh token family: %w", err)
+		}
+		logger.Warn("refresh token reuse detected, revoked token family", "user_id", userId, "family_id", familyId)
+		return 0, "", "", errRefreshTokenInvalid
+	}
+	if revoked || usedAt.Valid || time.Now().After(expiresAt) {
+		return 0, "", "", errRefreshTokenInvalid
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET used_at = now() WHERE id = $1", id); err != nil {
+		return 0, "", "", fmt.Errorf("marking refresh token used: %w", err)
+	}
+	newToken, err = issueRefreshToken(ctx, tx, userId, familyId)
+	if err != nil {
+		return 0, "", "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, "", "", fmt.Errorf("committing refresh token rotation: %w", err)
+	}
+	return userId, email, newToken, nil
+}
+
+//refreshToken exchanges a refresh token for a new access token and a new refresh token
+func refreshToken(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body refreshRequest
+		if err := decodeRequest(r, &body); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+
+		userId, email, newRefreshToken, err := rotateRefreshToken(r.Context(), db, loggerFrom(r.Context()), body.RefreshToken)
+		if errors.Is(err, errRefreshTokenInvalid) {
+			writeError(w, r, http.StatusUnauthorized, codeInvalidToken, err.Error())
+			return
+		}
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		//a client that keeps refreshing is still using the account
+		recordLogin(r.Context(), db, userId)
+
+		accessToken, expires, err := issueAccessToken(userId, email)
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		writeResponse(w, r, http.StatusOK, tokenResponse{
+			AccessToken:  accessToken,
+			TokenType:    "Bearer",
+			ExpiresIn:    int(time.Until(expires).Seconds()),
+			RefreshToken: newRefreshToken,
+		})
+	}
+}
+
+//logout ends the session from the session cookie and revokes the refresh token from the body, whichever are present
+//the body may be left out when logging out of a session. it answers 204 even for unknown tokens and sessions, there is nothing left to log out of
+func logout(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookie, cookieErr := r.Cookie(sessionCookie)
+		if cookieErr == nil {
+			if _, err := db.ExecContext(r.Context(), "DELETE FROM sessions WHERE id_hash = $1", hashToken(cookie.Value)); err != nil {
+				internalServerError(w, r, fmt.Errorf("deleting session: %w", err))
+				return
+			}
+			expireSessionCookie(w, r)
+		}
+
+		if cookieErr != nil || r.ContentLength != 0 {
+			var body refreshRequest
+			if err := decodeRequest(r, &body); err != nil {
+				writeDecodeError(w, r, err)
+				return
+			}
+			if _, err := db.ExecContext(r.Context(), "UPDATE refresh_tokens SET revoked = true WHERE token_hash = $1", hashToken(body.RefreshToken)); err != nil {
+				internalServerError(w, r, fmt.Errorf("revoking refresh token: %w", err))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
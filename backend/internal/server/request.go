@@ -0,0 +1,121 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+//defaultMaxBodyBytes caps request bodies when MAX_BODY_BYTES isnt set, json bodies of this api are tiny
+const defaultMaxBodyBytes = 1 << 20
+
+//bodyLimit is a route handler that accepts bodies up to a different size than the default, see withBodyLimit
+type bodyLimit struct {
+	limit   int64
+	handler http.Handler
+}
+
+func (b bodyLimit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.handler.ServeHTTP(w, r)
+}
+
+//withBodyLimit overrides the body size limit for one route, e.g. an upload that is bigger than any json body
+//it has to be the outermost wrapper of the handler passed to Handle, limitRequestBodies only looks at that one
+func withBodyLimit(limit int64, h http.Handler) http.Handler {
+	return bodyLimit{limit: limit, handler: h}
+}
+
+//limitRequestBodies caps the body of every matched route at defaultLimit, or at the limit set with withBodyLimit
+//a declared Content-Length over the limit is refused right away, otherwise reading past the limit fails
+//and decodeRequest turns that into a 413
+func limitRequestBodies(defaultLimit int64) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit := defaultLimit
+			if route := mux.CurrentRoute(r); route != nil {
+				if b, ok := route.GetHandler().(bodyLimit); ok {
+					limit = b.limit
+				}
+			}
+			if r.ContentLength > limit {
+				writeBodyTooLarge(w, r, limit)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+//writeBodyTooLarge answers with 413 and the limit that was exceeded
+func writeBodyTooLarge(w http.ResponseWriter, r *http.Request, limit int64) {
+	writeError(w, r, http.StatusRequestEntityTooLarge, codePayloadTooLarge, fmt.Sprintf("request body must be at most %d bytes", limit))
+}
+
+//writeDecodeError answers a request whose body decodeRequest refused: 413 when it was too big, 415 when the endpoint
+//doesnt take its format, 400 otherwise
+func writeDecodeError(w http.ResponseWriter, r *http.Request, err error) {
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxErr):
+		writeBodyTooLarge(w, r, maxErr.Limit)
+	case errors.Is(err, errUnsupportedBody):
+		writeError(w, r, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, err.Error())
+	default:
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, err.Error())
+	}
+}
+
+//decodeRequest reads the request body into dst. a body sent as one of the binary formats of codecMediaTypes is
+//decoded by its codec, anything else is json, also without a content type like before there were other formats.
+//the returned error message is safe to send back to the client, writeDecodeError picks the status for it
+func decodeRequest(r *http.Request, dst any) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if format, ok := codecMediaTypes[mediaType]; ok {
+		return codecs[format].decode(r.Body, dst)
+	}
+	return decodeJSON(r, dst)
+}
+
+//decodeJSON reads exactly one json value from the request body into dst, for decodeRequest.
+//with model.StringIds the ids may come as strings, see model.ID
+func decodeJSON(r *http.Request, dst any) error {
+	dec := json.NewDecoder(r.Body)
+	//typos like "emial" should be an error instead of being silently dropped
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(dst); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		var maxErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxErr):
+			return err
+		case errors.Is(err, io.EOF):
+			return errors.New("request body must not be empty")
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			return errors.New("request body contains incomplete json")
+		case errors.As(err, &syntaxErr):
+			return fmt.Errorf("request body contains malformed json at offset %d", syntaxErr.Offset)
+		case errors.As(err, &typeErr):
+			return fmt.Errorf("request body field %q must be of type %s (offset %d)", typeErr.Field, typeErr.Type, typeErr.Offset)
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			//the json package has no dedicated error type for unknown fields, only this message
+			return fmt.Errorf("request body contains unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+		default:
+			return fmt.Errorf("request body could not be decoded: %v", err)
+		}
+	}
+
+	//anything after the first value (e.g. `{...}{...}`) is rejected too
+	if err := dec.Decode(&struct{}{}); !errors.Is(err, io.EOF) {
+		return errors.New("request body must contain a single json value")
+	}
+	return nil
+}
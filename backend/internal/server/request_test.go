@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"api/internal/model"
+)
+
+func TestDecodeJSON(t *testing.T) {
+	for _, tc := range []struct {
+		name, body, want string
+	}{
+		{"empty", "", "request body must not be empty"},
+		{"incomplete", `{"name": "Ada"`, "request body contains incomplete json"},
+		{"malformed", `{"name": Ada}`, "request body contains malformed json at offset 10"},
+		{"not json", "not json", "request body contains malformed json at offset 2"},
+		{"wrong type", `{"name": 42}`, `request body field "name" must be of type string (offset 11)`},
+		{"typo", `{"name": "Ada", "emial": "ada@example.com"}`, `request body contains unknown field "emial"`},
+		{"two values", `{"name": "Ada"}{"name": "Grace"}`, "request body must contain a single json value"},
+		{"trailing garbage", `{"name": "Ada"} x`, "request body must contain a single json value"},
+		{"valid", `{"name": "Ada", "email": "ada@example.com"}`, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var u model.User
+			err := decodeJSON(httptest.NewRequest("POST", "/api/v1/users", strings.NewReader(tc.body)), &u)
+			var got string
+			if err != nil {
+				got = err.Error()
+			}
+			if got != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMalformedBodiesAreRefused(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	u := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+
+	for _, body := range []string{"", "not json", `{"name": "Grace", "emial": "grace@example.com"}`, `{"name": "Grace"}{"name": "Hopper"}`} {
+		for _, req := range []struct{ method, path string }{{"POST", "/api/v1/users"}, {"PUT", userPath(u.Id)}} {
+			res := ts.do(req.method, req.path, admin, body)
+			expect(t, res, http.StatusBadRequest)
+			if res.errorCode() != codeInvalidRequest {
+				t.Fatalf("%s %s with %q answered %s", req.method, req.path, body, res.body)
+			}
+		}
+	}
+	//nothing was created or changed
+	if n := ts.count("users", ""); n != 2 {
+		t.Fatalf("%d users after the refused bodies", n)
+	}
+	if n := ts.count("users", "id = $1 AND name = 'Ada'", u.Id); n != 1 {
+		t.Fatal("a refused body changed the user")
+	}
+}
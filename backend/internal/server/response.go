@@ -0,0 +1,291 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"api/internal/model"
+	"api/requestid"
+)
+
+//response formats the api can negotiate through the accept header
+const (
+	formatJSON = "json"
+	formatXML  = "xml"
+	//formatJSONAPI wraps users and errors in json:api documents, see jsonapi.go
+	formatJSONAPI = "jsonapi"
+)
+
+//contentTypeJSON is the content type of every json response. the charset is redundant for json,
+//older clients decode the body as latin-1 without it
+const contentTypeJSON = "application/json; charset=utf-8"
+
+//machine readable error codes, clients branch on these instead of parsing messages
+const (
+	codeUserNotFound     = "user_not_found"
+	codeNotFound         = "not_found"
+	codeInvalidRequest   = "invalid_request"
+	codeValidationFailed = "validation_failed"
+	codeConflict         = "conflict"
+	codeInternalError    = "internal_error"
+	//conditional requests (etags)
+	codePreconditionFailed   = "precondition_failed"
+	codePreconditionRequired = "precondition_required"
+	codeIdempotencyKeyReused = "idempotency_key_reused"
+	codeInvalidCredentials   = "invalid_credentials"
+	codeUnauthorized         = "unauthorized"
+	codeForbidden            = "forbidden"
+	codeNotConfigured        = "not_configured"
+	codeInvalidState         = "invalid_state"
+	codeEmailNotVerified     = "email_not_verified"
+	codeInvalidToken         = "invalid_token"
+	codeTooManyRequests      = "too_many_requests"
+	codeAccountDeactivated   = "account_deactivated"
+	codeTimeout              = "timeout"
+	codePayloadTooLarge      = "payload_too_large"
+	codeOverloaded           = "overloaded"
+	codeMethodNotAllowed     = "method_not_allowed"
+	//codeRouteNotFound is an unknown path, codeNotFound a known route whose resource doesnt exist
+	codeRouteNotFound = "route_not_found"
+	//a graphql query nested too deep or asking for too much at once
+	codeQueryTooComplex = "query_too_complex"
+	//a request body in a format the endpoint doesnt take, see decodeRequest
+	codeUnsupportedMediaType = "unsupported_media_type"
+	//the ldap directory of LDAP_URL couldnt be searched, see ldapSyncer
+	codeDirectoryUnavailable = "directory_unavailable"
+	//a write refused while the api is in maintenance, see refuseWritesInMaintenance
+	codeMaintenance = "maintenance"
+	//an admin request from outside ADMIN_ALLOWED_NETWORKS, see adminNetworkGuard
+	codeNetworkNotAllowed = "network_not_allowed"
+	//a caller that deleted too many users in a short time, see deletionGuard
+	codeDeletionLimitExceeded = "deletion_limit_exceeded"
+	//a cursor of the change feed whose changes were purged, see getUserChanges
+	codeCursorExpired = "cursor_expired"
+	//a login with the password of an account whose credentials were revoked, see revokeUserCredentials
+	codePasswordChangeRequired = "password_change_required"
+	//a client older than the minimum version of the route group it called, see requireClientVersion
+	codeClientUpgradeRequired = "client_upgrade_required"
+	//a write refused by an instance that is read only, see refuseWritesInMaintenance
+	codeReadOnly = "read_only"
+)
+
+//apiError describes why a request failed: a stable code plus a human readable message
+//validation failures also list a message per invalid field so the frontend can highlight the right input
+//requestId is the X-Request-ID of the failed request, users can quote it when reporting a problem
+type apiError struct {
+	Code      string            `json:"code" xml:"code"`
+	Message   string            `json:"message" xml:"message"`
+	Fields    model.FieldErrors `json:"fields,omitempty" xml:"fields,omitempty"`
+	Meta      *errorMeta        `json:"meta,omitempty" xml:"meta,omitempty"`
+	RequestId string            `json:"request_id,omitempty" xml:"request_id,omitempty"`
+}
+
+//errorMeta is what some errors add for the callers allowed to see it
+type errorMeta struct {
+	//ExistingUser is the user that already has the email of a conflict, only admins are told, see writeSaveError
+	ExistingUser *existingUserRef `json:"existing_user,omitempty" xml:"existing_user,omitempty"`
+	//MinClientVersion is the oldest version of the client the route answers, see requireClientVersion
+	MinClientVersion string `json:"min_client_version,omitempty" xml:"min_client_version,omitempty"`
+}
+
+//existingUserRef points at a user from an error
+type existingUserRef struct {
+	Id       model.ID `json:"id" xml:"id"`
+	PublicId string   `json:"public_id" xml:"public_id"`
+}
+
+func (e *apiError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+//errorEnvelope is the body of every error response, e.g.
+//{"error": {"code": "user_not_found", "message": "user 42 does not exist"}}
+type errorEnvelope struct {
+	XMLName xml.Name `json:"-" xml:"response"`
+	Error   apiError `json:"error" xml:"error"`
+}
+
+//negotiateFormat picks the response format from the accept header of the request
+//each media range can carry a q value (e.g. "application/xml;q=0.9"), the highest one we support wins
+//json is the default, so a missing, wildcard or unsupported accept value falls back to it instead of a 406.
+//the binary formats of codecMediaTypes are negotiated the same way.
+//?format=jsonapi asks for json:api without an accept header, for clients that cant set one
+func negotiateFormat(r *http.Request) string {
+	if r.URL.Query().Get("format") == formatJSONAPI {
+		return formatJSONAPI
+	}
+	best, bestQ := formatJSON, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		var format string
+		switch mediaType {
+		case "application/json":
+			format = formatJSON
+		case "application/xml", "text/xml":
+			format = formatXML
+		case mediaTypeJSONAPI:
+			//the spec reserves media type parameters other than ext and profile, a range with others doesnt match
+			if hasOtherParams(params, "q", "ext", "profile") {
+				continue
+			}
+			format = formatJSONAPI
+		default:
+			var ok bool
+			if format, ok = codecMediaTypes[mediaType]; !ok {
+				continue
+			}
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+//hasOtherParams reports whether params has a parameter not in allowed
+func hasOtherParams(params map[string]string, allowed ...string) bool {
+	for name := range params {
+		if !slices.Contains(allowed, name) {
+			return true
+		}
+	}
+	return false
+}
+
+//wantsPretty reports whether the body should be indented for reading: with ?pretty=true, or when the request comes
+//from a browser, which lists text/html in its accept header. everything else gets compact bodies, they are smaller
+func wantsPretty(r *http.Request) bool {
+	if r.URL.Query().Get("pretty") == "true" {
+		return true
+	}
+	for part := range strings.SplitSeq(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mediaType == "text/html" {
+			return true
+		}
+	}
+	return false
+}
+
+//newJSONEncoder is json.NewEncoder, indenting by two spaces when pretty is set
+func newJSONEncoder(w http.ResponseWriter, pretty bool) *json.Encoder {
+	enc := json.NewEncoder(w)
+	if pretty {
+		enc.SetIndent("", "  ")
+	}
+	return enc
+}
+
+//writeResponse encodes payload in the negotiated format and writes it with the given status code
+//handlers should go through this instead of calling json.NewEncoder directly so every response respects the accept header.
+//json and xml are indented when wantsPretty says so, the binary formats never are.
+//errors go out as problem documents instead of the envelope when wantsProblem says so
+func writeResponse(w http.ResponseWriter, r *http.Request, status int, payload any) {
+	//the body depends on the accept header, so caches must key on it too
+	w.Header().Add("Vary", "Accept")
+	pretty := wantsPretty(r)
+	format := negotiateFormat(r)
+	//whatever the format, the users in the body are sent as the caller may see them
+	payload = visibleTo(r, payload)
+
+	if e, ok := payload.(errorEnvelope); ok && wantsProblem(r, format) {
+		w.Header().Set("Content-Type", mediaTypeProblem)
+		w.WriteHeader(status)
+		if err := newJSONEncoder(w, pretty).Encode(toProblem(r, status, e)); err != nil {
+			loggerFrom(r.Context()).Warn("encoding problem response", "error", err)
+		}
+		return
+	}
+
+	switch format {
+	case formatProtobuf, formatMsgpack:
+		//what the format has no message for is sent as json below
+		if writeEncoded(w, r, status, codecs[format], payload) {
+			return
+		}
+	case formatXML:
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(status)
+		w.Write([]byte(xml.Header))
+		enc := xml.NewEncoder(w)
+		if pretty {
+			enc.Indent("", "  ")
+		}
+		if err := enc.Encode(payload); err != nil {
+			loggerFrom(r.Context()).Warn("encoding xml response", "error", err)
+		}
+		return
+	case formatJSONAPI:
+		if doc, ok := toJSONAPI(r, w.Header(), status, payload); ok {
+			w.Header().Set("Content-Type", mediaTypeJSONAPI)
+			w.WriteHeader(status)
+			if err := newJSONEncoder(w, pretty).Encode(doc); err != nil {
+				loggerFrom(r.Context()).Warn("encoding json:api response", "error", err)
+			}
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(status)
+	if err := newJSONEncoder(w, pretty).Encode(payload); err != nil {
+		loggerFrom(r.Context()).Warn("encoding json response", "error", err)
+	}
+}
+
+//writeError sends the error envelope in the negotiated format
+//every handler and middleware reports failures through this so the shape never drifts
+//the message is translated into the language of the Accept-Language header, see localizeError
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	e := apiError{Code: code, Message: message, RequestId: requestid.FromContext(r.Context())}
+	writeResponse(w, r, status, errorEnvelope{Error: localizeError(w, r, e)})
+}
+
+//internalServerError logs err together with the request that caused it and answers with a generic 500
+//the error itself is never sent to the client, and the process keeps serving other requests.
+//errors caused by the request deadline answer 504 instead, and nothing is sent when the client already went away
+func internalServerError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(r.Context().Err(), context.Canceled) {
+		loggerFrom(r.Context()).Debug("client went away", "error", err)
+		return
+	}
+	if timedOut(r) {
+		loggerFrom(r.Context()).Warn("request timed out", "error", err)
+		writeTimeout(w, r)
+		return
+	}
+	loggerFrom(r.Context()).Error("internal server error", "error", err)
+	writeError(w, r, http.StatusInternalServerError, codeInternalError, "internal server error")
+}
+
+//writeValidationError answers with 422 and the per field messages returned by User.Validate
+func writeValidationError(w http.ResponseWriter, r *http.Request, fields model.FieldErrors) {
+	writeResponse(w, r, http.StatusUnprocessableEntity, errorEnvelope{Error: localizeError(w, r, apiError{
+		Code:      codeValidationFailed,
+		Message:   "one or more fields are invalid",
+		Fields:    fields,
+		RequestId: requestid.FromContext(r.Context()),
+	})})
+}
+
+//writeUserNotFound answers with the 404 used whenever the {id} in the path doesnt match a user.
+//id is the serial id, or what the client sent in its place
+func writeUserNotFound[T ~int64 | string](w http.ResponseWriter, r *http.Request, id T) {
+	writeError(w, r, http.StatusNotFound, codeUserNotFound, fmt.Sprintf("user %v does not exist", id))
+}
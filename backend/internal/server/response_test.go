@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"api/internal/model"
+)
+
+//TestErrorEnvelope fails a request at every handler and middleware that can refuse one, each answers the same
+//envelope with the code of the failure and a message
+func TestErrorEnvelope(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	_, member := ts.member()
+
+	for _, tc := range []struct {
+		name   string
+		res    testResponse
+		status int
+		code   string
+	}{
+		{"missing user", ts.do("GET", userPath(999), admin, nil), http.StatusNotFound, codeUserNotFound},
+		{"deleting a missing user", ts.do("DELETE", userPath(999), admin, nil), http.StatusNotFound, codeUserNotFound},
+		{"malformed body", ts.do("POST", "/api/v1/users", admin, "{"), http.StatusBadRequest, codeInvalidRequest},
+		{"invalid user", ts.do("POST", "/api/v1/users", admin, map[string]any{"name": "", "email": "x", "password": "password123"}), http.StatusUnprocessableEntity, codeValidationFailed},
+		{"duplicate email", ts.do("POST", "/api/v1/users", admin, map[string]any{"name": "Admin", "email": "admin@example.com", "password": "password123"}), http.StatusConflict, codeConflict},
+		{"no token", ts.do("GET", "/api/v1/users", "", nil), http.StatusUnauthorized, codeUnauthorized},
+		{"member writing", ts.do("DELETE", userPath(1), member, nil), http.StatusForbidden, codeForbidden},
+		{"unknown route", ts.do("GET", "/api/v1/user/1", admin, nil), http.StatusNotFound, codeRouteNotFound},
+		{"wrong method", ts.do("DELETE", "/api/v1/users", admin, nil), http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{"bad login", ts.do("POST", "/api/v1/login", "", map[string]any{"email": "admin@example.com", "password": "wrong-password"}), http.StatusUnauthorized, codeInvalidCredentials},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			expect(t, tc.res, tc.status)
+			if ct := tc.res.Header.Get("Content-Type"); ct != contentTypeJSON {
+				t.Fatalf("Content-Type %q", ct)
+			}
+			//nothing but the error, which has nothing but what apiError knows
+			var body map[string]json.RawMessage
+			tc.res.decode(t, &body)
+			if len(body) != 1 || body["error"] == nil {
+				t.Fatalf("not an envelope: %s", tc.res.body)
+			}
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(body["error"], &fields); err != nil {
+				t.Fatal(err)
+			}
+			for name := range fields {
+				switch name {
+				case "code", "message", "fields", "meta", "request_id":
+				default:
+					t.Fatalf("the error has a field %q: %s", name, tc.res.body)
+				}
+			}
+			var e apiError
+			if err := json.Unmarshal(body["error"], &e); err != nil {
+				t.Fatal(err)
+			}
+			if e.Code != tc.code || e.Message == "" || e.RequestId != tc.res.Header.Get("X-Request-ID") {
+				t.Fatalf("got %s, want the code %s", tc.res.body, tc.code)
+			}
+			if (tc.code == codeValidationFailed) != (len(e.Fields) > 0) {
+				t.Fatalf("the fields of %s", tc.res.body)
+			}
+		})
+	}
+}
+
+func TestPrettyJSON(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	u := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+	indented := func(res testResponse) bool { return strings.Contains(string(res.body), "\n  ") }
+
+	for _, path := range []string{userPath(u.Id), "/api/v1/users", userPath(u.Id + 1000)} {
+		//machine clients get compact bodies
+		if res := ts.do("GET", path, admin, nil); indented(res) || strings.Count(string(res.body), "\n") != 1 {
+			t.Fatalf("%s was indented: %s", path, res.body)
+		}
+		//errors are indented like the rest
+		if res := ts.do("GET", path+"?pretty=true", admin, nil); !indented(res) || !json.Valid(res.body) {
+			t.Fatalf("%s?pretty=true wasnt indented: %s", path, res.body)
+		}
+		if res := ts.do("GET", path, admin, nil, "Accept", "text/html,application/xhtml+xml,*/*;q=0.8"); !indented(res) {
+			t.Fatalf("%s wasnt indented for a browser: %s", path, res.body)
+		}
+		if res := ts.do("GET", path+"?pretty=false", admin, nil); indented(res) {
+			t.Fatalf("%s?pretty=false was indented: %s", path, res.body)
+		}
+	}
+
+	//the binary formats dont change
+	compact := ts.do("GET", userPath(u.Id), admin, nil, "Accept", "application/msgpack")
+	pretty := ts.do("GET", userPath(u.Id)+"?pretty=true", admin, nil, "Accept", "application/msgpack")
+	if compact.Header.Get("Content-Type") != "application/msgpack" || !bytes.Equal(compact.body, pretty.body) {
+		t.Fatalf("?pretty=true changed the msgpack body from %x to %x", compact.body, pretty.body)
+	}
+}
+
+//TestContentType checks that json goes out with its charset and that the routes writing something else keep their
+//own content type
+func TestContentType(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	u := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+
+	for _, tc := range []struct {
+		path, accept, want string
+	}{
+		{userPath(u.Id), "", contentTypeJSON},
+		{"/api/v1/users", "application/json", contentTypeJSON},
+		{userPath(u.Id + 1000), "", contentTypeJSON},
+		{"/api/v1/openapi.json", "", contentTypeJSON},
+		//the spec of json:api allows no charset
+		{userPath(u.Id), mediaTypeJSONAPI, mediaTypeJSONAPI},
+		{userPath(u.Id), "application/xml", "application/xml; charset=utf-8"},
+		{"/api/v1/admin/export", "", "application/x-ndjson"},
+		{"/api/v1/admin/export?format=xlsx", "", contentTypeXLSX},
+		{userPath(u.Id) + "/vcard", "", "text/vcard; charset=utf-8"},
+		{"/api/v1/docs", "", "text/html; charset=utf-8"},
+	} {
+		res := ts.do("GET", tc.path, admin, nil, "Accept", tc.accept)
+		if got := res.Header.Get("Content-Type"); got != tc.want {
+			t.Fatalf("%s with Accept %q answered Content-Type %q, want %q", tc.path, tc.accept, got, tc.want)
+		}
+	}
+
+	//a 204 has no body and no content type
+	res := ts.do("DELETE", userPath(u.Id), admin, nil)
+	expect(t, res, http.StatusNoContent)
+	if len(res.body) != 0 || res.Header.Get("Content-Type") != "" {
+		t.Fatalf("the 204 answered %q with Content-Type %q", res.body, res.Header.Get("Content-Type"))
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"net/http"
+
+	"api/internal/model"
+)
+
+//writeForbidden answers with 403, used when the caller is authenticated but not allowed to do this
+func writeForbidden(w http.ResponseWriter, r *http.Request, message string) {
+	writeError(w, r, http.StatusForbidden, codeForbidden, message)
+}
+
+//requireRole only lets callers with the given role through, it has to run after authMiddleware
+func requireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := principalFromContext(r.Context())
+			if !ok {
+				writeUnauthorized(w, r, "authentication required")
+				return
+			}
+			if p.Role != role {
+				writeForbidden(w, r, "this action requires the "+role+" role")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+//requireAdminOrSelf lets admins through, and members only when the {id} in the path is their own user id
+func requireAdminOrSelf(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := principalFromContext(r.Context())
+		if !ok {
+			writeUnauthorized(w, r, "authentication required")
+			return
+		}
+		if !p.isAdminOrSelf(userIdVar(r)) {
+			writeForbidden(w, r, "you can only do this for your own account")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//isAdminOrSelf reports whether the principal is an admin or the user id
+func (p principal) isAdminOrSelf(id int64) bool {
+	return p.Role == model.RoleAdmin || (p.UserId != 0 && id == p.UserId)
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+//routeMethodCandidates are the methods routeMethods looks for, every method a route is registered with is among them
+var routeMethodCandidates = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+//routeMethods returns which of candidates routes has a route for at the path of r
+//a match with MatchErr set is the router falling back to its MethodNotAllowedHandler, not a route
+func routeMethods(routes *mux.Router, r *http.Request, candidates []string) []string {
+	var methods []string
+	for _, method := range candidates {
+		probe := r.Clone(r.Context())
+		probe.Method = method
+		var match mux.RouteMatch
+		if routes.Match(probe, &match) && match.MatchErr == nil {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+//methodNotAllowed answers requests for a path that exists, but not with their method, with 405
+//and an Allow header listing the methods routes has for the path. it runs inside enableCORS, so browsers can read it
+func methodNotAllowed(routes *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeMethodNotAllowed(w, r, routeMethods(routes, r, routeMethodCandidates))
+	})
+}
+
+//notFound answers requests no route matched with 404 and the json error envelope, it runs inside enableCORS too. mux forgets a wrong method when a later route of the same subrouter
+//matches the path prefix (DELETE /api/v1/users is reported as not found because of /api/v1/users/{id}),
+//so the path is checked for other methods here and gets the 405 it should have had
+func notFound(routes *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if methods := routeMethods(routes, r, routeMethodCandidates); len(methods) > 0 {
+			writeMethodNotAllowed(w, r, methods)
+			return
+		}
+		writeRouteNotFound(w, r)
+	})
+}
+
+//writeRouteNotFound answers with 404, no route matches the path
+func writeRouteNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, codeRouteNotFound, "no route matches "+r.Method+" "+r.URL.Path)
+}
+
+//answerOptions answers a plain OPTIONS request with 204 and an Allow header listing the methods of the path
+func answerOptions(w http.ResponseWriter, r *http.Request, routes *mux.Router) {
+	methods := routeMethods(routes, r, routeMethodCandidates)
+	if len(methods) == 0 {
+		writeRouteNotFound(w, r)
+		return
+	}
+	w.Header().Set("Allow", allowHeader(methods))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//allowHeader is the value of an Allow header for the methods of a path, OPTIONS is answered for every path
+func allowHeader(methods []string) string {
+	return strings.Join(append(methods, "OPTIONS"), ", ")
+}
+
+//writeMethodNotAllowed answers with 405, methods are the ones the path does have
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request, methods []string) {
+	w.Header().Set("Allow", allowHeader(methods))
+	writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, r.Method+" is not allowed here, use one of "+strings.Join(methods, ", "))
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"api/internal/model"
+)
+
+func TestMethodNotAllowed(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"CORS_ALLOWED_ORIGINS": "https://app.example.com"})
+	admin := ts.admin()
+	u := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+
+	for _, tc := range []struct{ method, path, allow string }{
+		{"POST", userPath(u.Id), "GET, HEAD, PUT, DELETE, OPTIONS"},
+		{"PATCH", userPath(u.Id), "GET, HEAD, PUT, DELETE, OPTIONS"},
+		{"DELETE", "/api/v1/users", "GET, HEAD, POST, PATCH, OPTIONS"},
+		{"PUT", "/api/v1/users", "GET, HEAD, POST, PATCH, OPTIONS"},
+		//the same path of the alias
+		{"POST", "/api/go/users/1", "GET, HEAD, PUT, DELETE, OPTIONS"},
+	} {
+		res := ts.do(tc.method, tc.path, admin, nil, "Origin", "https://app.example.com")
+		expect(t, res, http.StatusMethodNotAllowed)
+		if res.errorCode() != codeMethodNotAllowed || res.Header.Get("Content-Type") != contentTypeJSON {
+			t.Fatalf("%s %s answered %s: %s", tc.method, tc.path, res.Header.Get("Content-Type"), res.body)
+		}
+		if got := res.Header.Get("Allow"); got != tc.allow {
+			t.Fatalf("%s %s allows %q, want %q", tc.method, tc.path, got, tc.allow)
+		}
+		//browsers can read it
+		if res.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+			t.Fatalf("%s %s has no cors headers", tc.method, tc.path)
+		}
+	}
+	if n := ts.count("users", ""); n != 2 {
+		t.Fatalf("%d users after the refused methods", n)
+	}
+}
+
+func TestRouteNotFound(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"CORS_ALLOWED_ORIGINS": "https://app.example.com"})
+	admin := ts.admin()
+
+	for _, path := range []string{"/api/v1/user/1", "/api/go/user/1", "/api/v1/users/1/nothing", "/nothing"} {
+		res := ts.do("GET", path, admin, nil, "Origin", "https://app.example.com")
+		expect(t, res, http.StatusNotFound)
+		if res.Header.Get("Content-Type") != contentTypeJSON {
+			t.Fatalf("%s answered %q", path, res.Header.Get("Content-Type"))
+		}
+		var e struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		res.decode(t, &e)
+		if e.Error.Code != codeRouteNotFound || e.Error.Message != "no route matches GET "+path {
+			t.Fatalf("%s answered %s", path, res.body)
+		}
+		if res.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+			t.Fatalf("%s has no cors headers", path)
+		}
+	}
+	//no token is needed to be told
+	expect(t, ts.do("GET", "/api/v1/user/1", "", nil), http.StatusNotFound)
+}
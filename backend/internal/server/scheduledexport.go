@@ -0,0 +1,280 @@
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+//the scheduled exports are gzipped dumps named after the time they were taken, so sorting the names sorts them by age.
+//gunzip one before posting it to /admin/import
+const (
+	exportFilePrefix = "users-dump-"
+	exportFileSuffix = ".ndjson.gz"
+)
+
+//exportLockId is the postgres advisory lock held while a scheduled export runs, see runExport
+const exportLockId = 7268003
+
+//defaultExportKeep is how many scheduled exports are kept when EXPORT_KEEP isnt set
+const defaultExportKeep = 7
+
+//exportConfig is when the server writes a dump on its own and where it goes, the schedule is nil when it doesnt
+type exportConfig struct {
+	//scheduleExpr is the cron expression schedule was parsed from, for the startup log
+	scheduleExpr string
+	schedule     *cronSchedule
+	//keep is how many exports are kept, older ones are deleted after every export. 0 keeps all of them
+	keep int
+	dest blobStoreConfig
+}
+
+//exportDestination is where the scheduled exports are written. names are file names without a directory,
+//List only returns the names of exports so anything else stored next to them is left alone
+type exportDestination interface {
+	Write(ctx context.Context, name string, r io.Reader) error
+	List(ctx context.Context) ([]string, error)
+	Delete(ctx context.Context, name string) error
+}
+
+//newExportDestination opens the destination configured in cfg, like newBlobStore does for blobs
+func newExportDestination(cfg blobStoreConfig) (exportDestination, error) {
+	if cfg.storage == blobStorageS3 {
+		client, err := newS3Client(cfg.s3)
+		if err != nil {
+			return nil, err
+		}
+		return s3ExportDestination{client: client, bucket: cfg.s3.bucket}, nil
+	}
+	if err := os.MkdirAll(cfg.dir, 0o750); err != nil {
+		return nil, fmt.Errorf("creating export directory: %w", err)
+	}
+	return dirExportDestination{dir: cfg.dir}, nil
+}
+
+//isExportName tells whether name is one of the scheduled exports
+func isExportName(name string) bool {
+	return strings.HasPrefix(name, exportFilePrefix) && strings.HasSuffix(name, exportFileSuffix)
+}
+
+//dirExportDestination keeps the exports as files in dir
+type dirExportDestination struct {
+	dir string
+}
+
+//CheckHealth checks that the exports can be written to dir, for /readyz
+func (d dirExportDestination) CheckHealth(ctx context.Context) error {
+	return checkDir(d.dir)
+}
+
+//Write goes to a temporary file that is renamed once it is complete, so a failed export never leaves half a file
+//that looks like a finished one
+func (d dirExportDestination) Write(ctx context.Context, name string, r io.Reader) error {
+	tmp, err := os.CreateTemp(d.dir, ".export-*")
+	if err != nil {
+		return fmt.Errorf("writing export: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing export: %w", err)
+	}
+	//the export should survive a crash right after it was written, it is a backup
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing export: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing export: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(d.dir, name)); err != nil {
+		return fmt.Errorf("writing export: %w", err)
+	}
+	return nil
+}
+
+func (d dirExportDestination) List(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, fmt.Errorf("listing exports: %w", err)
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && isExportName(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func (d dirExportDestination) Delete(ctx context.Context, name string) error {
+	if err := os.Remove(filepath.Join(d.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("deleting export: %w", err)
+	}
+	return nil
+}
+
+//s3ExportDestination keeps the exports as objects in the top level of a bucket
+type s3ExportDestination struct {
+	client *minio.Client
+	bucket string
+}
+
+//exportPartSize is the size of the parts an export is uploaded in. the size of an export isnt known up front,
+//without a part size minio would buffer parts big enough for the largest object s3 takes
+const exportPartSize = 16 << 20
+
+//CheckHealth checks that the bucket exists and can be reached with the credentials, for /readyz
+func (d s3ExportDestination) CheckHealth(ctx context.Context) error {
+	return checkBucket(ctx, d.client, d.bucket)
+}
+
+//Write uploads the export in parts, an upload that fails half way is aborted and leaves no object behind
+func (d s3ExportDestination) Write(ctx context.Context, name string, r io.Reader) error {
+	_, err := d.client.PutObject(ctx, d.bucket, name, r, -1, minio.PutObjectOptions{ContentType: "application/gzip", PartSize: exportPartSize})
+	if err != nil {
+		return fmt.Errorf("writing export: %w", err)
+	}
+	return nil
+}
+
+func (d s3ExportDestination) List(ctx context.Context) ([]string, error) {
+	var names []string
+	for obj := range d.client.ListObjects(ctx, d.bucket, minio.ListObjectsOptions{Prefix: exportFilePrefix}) {
+		if obj.Err != nil {
+			return nil, fmt.Errorf("listing exports: %w", obj.Err)
+		}
+		if isExportName(obj.Key) {
+			names = append(names, obj.Key)
+		}
+	}
+	return names, nil
+}
+
+func (d s3ExportDestination) Delete(ctx context.Context, name string) error {
+	if err := d.client.RemoveObject(ctx, d.bucket, name, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("deleting export: %w", err)
+	}
+	return nil
+}
+
+//runScheduledExports writes a dump to dest every time cfg.schedule comes around, in utc, until ctx is cancelled.
+//the exports run one after the other in this goroutine, one that takes longer than the time to the next skips the
+//times it missed instead of running twice. cancelling ctx stops a running export, which then leaves nothing behind
+func runScheduledExports(ctx context.Context, db *sql.DB, driver string, cfg exportConfig, dest exportDestination, logger *slog.Logger) {
+	for {
+		next := cfg.schedule.next(time.Now().UTC())
+		logger.Debug("next scheduled export", "at", next)
+		sleepContext(ctx, time.Until(next))
+		if ctx.Err() != nil {
+			return
+		}
+		started := time.Now()
+		name, err := runExport(ctx, db, driver, dest)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case errors.Is(err, errExportRunning):
+			scheduledExports.WithLabelValues("skipped").Inc()
+			logger.Info("skipping scheduled export, another instance is running it")
+			continue
+		case err != nil:
+			scheduledExports.WithLabelValues("failure").Inc()
+			logger.Error("scheduled export failed", "error", err)
+			continue
+		}
+		scheduledExports.WithLabelValues("success").Inc()
+		scheduledExportLastSuccess.SetToCurrentTime()
+		logger.Info("scheduled export written", "name", name, "duration", time.Since(started).String())
+		if cfg.keep > 0 {
+			pruneExports(ctx, dest, cfg.keep, logger)
+		}
+	}
+}
+
+//errExportRunning is returned by runExport when another instance holds the export lock
+var errExportRunning = errors.New("export is running on another instance")
+
+//runExport writes one gzipped dump to dest and returns its name. on postgres only one instance exports at a time,
+//the others get errExportRunning. the dump is streamed from the database through gzip into dest without being kept anywhere
+func runExport(ctx context.Context, db *sql.DB, driver string, dest exportDestination) (string, error) {
+	if driver == dbDriverPostgres {
+		//a session lock on a connection of its own, the dump is read in a read only transaction next to it
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return "", fmt.Errorf("locking export: %w", err)
+		}
+		defer conn.Close()
+		var locked bool
+		if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", exportLockId).Scan(&locked); err != nil {
+			return "", fmt.Errorf("locking export: %w", err)
+		}
+		if !locked {
+			return "", errExportRunning
+		}
+		defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", exportLockId)
+	}
+
+	tx, header, err := beginDump(ctx, db, driver)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	name := exportFilePrefix + header.ExportedAt.Format("2006-01-02T150405Z") + exportFileSuffix
+
+	pr, pw := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		gz := gzip.NewWriter(pw)
+		err := writeDump(ctx, tx, json.NewEncoder(gz), header)
+		if err == nil {
+			err = gz.Close()
+		}
+		//the error ends the upload too, so a dump that failed half way is never stored as if it were complete
+		pw.CloseWithError(err)
+		written <- err
+	}()
+	err = dest.Write(ctx, name, pr)
+	//a destination that gave up stops the dump from being written any further
+	pr.Close()
+	if dumpErr := <-written; dumpErr != nil && err == nil {
+		err = dumpErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+//pruneExports deletes all but the newest keep exports in dest. what cant be deleted is logged and tried again
+//after the next export
+func pruneExports(ctx context.Context, dest exportDestination, keep int, logger *slog.Logger) {
+	names, err := dest.List(ctx)
+	if err != nil {
+		logger.Error("pruning exports", "error", err)
+		return
+	}
+	if len(names) <= keep {
+		return
+	}
+	slices.Sort(names)
+	for _, name := range names[:len(names)-keep] {
+		if err := dest.Delete(ctx, name); err != nil {
+			logger.Error("pruning exports", "name", name, "error", err)
+			continue
+		}
+		logger.Info("deleted old export", "name", name)
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"api/internal/seed"
+	"api/internal/store"
+)
+
+//SeedUsers fills an empty users table with n made up users from package seed for development and demos, all in one
+//transaction. it returns how many it created, none when the table already has users unless force is set.
+//with force the seeded users whose email is taken already are skipped, so seeding twice doesnt create them twice.
+//the seeded users have no password, they sign in through a password reset
+func SeedUsers(ctx context.Context, db *sql.DB, n int, force bool) (int, error) {
+	if n <= 0 {
+		return 0, nil
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if !force {
+		var exists bool
+		if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users)").Scan(&exists); err != nil {
+			return 0, fmt.Errorf("checking for users: %w", err)
+		}
+		if exists {
+			return 0, nil
+		}
+	}
+	created := 0
+	for _, u := range seed.Users(n) {
+		taken, err := store.EmailTaken(ctx, tx, u.Email, 0)
+		if err != nil {
+			return 0, err
+		}
+		if taken {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO users (name, email) VALUES ($1, $2)", u.Name, u.Email); err != nil {
+			return 0, fmt.Errorf("seeding user %s: %w", u.Email, err)
+		}
+		created++
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("seeding users: %w", err)
+	}
+	return created, nil
+}
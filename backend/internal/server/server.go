@@ -0,0 +1,380 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc"
+
+	"api/internal/model"
+	"api/internal/store"
+	"api/requestid"
+)
+
+//Server is the api assembled by New. it doesnt listen yet, main hands HTTP to Serve and GRPC to its own listener
+type Server struct {
+	//HTTP serves the rest api, graphql and the probes. its Handler is the whole api with every middleware,
+	//so it can be mounted on httptest.NewServer as well
+	HTTP *http.Server
+	//GRPC shares the user operations with the http routes, it is nil unless cfg.GRPCAddr is set
+	GRPC *grpc.Server
+
+	jobs     *jobQueue
+	shutdown shutdownConfig
+	//stopLDAPSync ends the scheduled ldap syncs, it is nil without them. a sync that is running is rolled back
+	stopLDAPSync context.CancelFunc
+	ldapSyncDone sync.WaitGroup
+}
+
+//Close stops the scheduled ldap syncs and the workers of the jobs, the jobs running get at most the shutdown timeout
+//to finish. it is called once HTTP and GRPC are stopped
+func (s *Server) Close() {
+	if s.stopLDAPSync != nil {
+		s.stopLDAPSync()
+		s.ldapSyncDone.Wait()
+	}
+	s.jobs.close(s.shutdown.Timeout)
+}
+
+//New builds the server with every route and middleware, configured by cfg
+//the token, session and feature flag settings are package level, New sets them from cfg before building the routes.
+//the users are kept in users, everything else (sessions, api keys, tokens, the audit log) in db.
+//rdb is the redis of OpenRedis, nil without one
+func New(cfg *Config, db *sql.DB, users store.UserStore, rdb *redis.Client, logger *slog.Logger) (*Server, error) {
+	//signing secret and lifetime of the access tokens handed out by login
+	if err := useAuthConfig(cfg, logger); err != nil {
+		return nil, err
+	}
+	requireIfMatch = cfg.RequireIfMatch
+	requireEmailVerification = cfg.RequireEmailVerification
+	appBaseURL = cfg.AppBaseURL
+	maxPageSize = cfg.MaxPageSize
+	snapshotTimeout = cfg.SnapshotTimeout
+	publicBaseURL = cfg.PublicBaseURL
+	basePath = cfg.BasePath
+	uuidUserIds = cfg.UserIdFormat == userIdFormatUuid
+	model.StringIds = cfg.JSONStringIds
+	problemErrors = cfg.ErrorFormat == errorFormatProblem
+	readOnlyDatabase = cfg.ReadOnly
+	lastInsertIds = cfg.DBDriver == dbDriverMySQL
+
+	//failed logins are counted per account and per ip address
+	loginLimiter := newLoginLimiter(cfg.LoginMaxFailures, cfg.LoginFailureWindow)
+
+	//mutation handlers publish user changes here for the live event stream
+	events := newMemoryBroker(logger)
+
+	//emails like password resets go through smtp when it is configured and are logged otherwise
+	mail := newMailer(cfg.SMTP, logger)
+
+	//concurrent reads of the same user share one query, under the caches so it is what their misses reach
+	users = newCoalescingStore(users)
+	//users read by id are kept in memory and in redis for a while, and the ids without a user in memory for a few
+	//seconds. the writes forget what they change
+	cache := newUserCache(users, newLocalUserCache(cfg.UserCache), newSharedUserCache(rdb, cfg.Redis), newMissingUserCache(cfg.UserNegativeCache))
+	if cache != nil {
+		users = cache
+	}
+
+	//profile pictures are kept on disk or in s3, not in the database
+	blobs, err := newBlobStore(cfg.Avatars.blobs)
+	if err != nil {
+		return nil, err
+	}
+
+	//users are mirrored from the ldap directory when LDAP_URL is set, without it POST /admin/ldap-sync answers 501.
+	//it runs here rather than with the workers, it writes users and has to tell the cache and the event stream
+	var ldapSync *ldapSyncer
+	if cfg.LDAP.url != "" {
+		ldapSync = newLDAPSyncer(db, cfg.DBDriver, cfg.LDAP, cache, events)
+	}
+
+	//maintenance refuses writes on this instance while the database is being migrated, MAINTENANCE_MODE starts with it on.
+	//READ_ONLY starts it refusing all of them
+	maintenance := newMemoryMaintenance(cfg.Maintenance, cfg.ReadOnly)
+	if cfg.Maintenance.enabled {
+		logger.Warn("starting in maintenance, writes are refused until POST /admin/maintenance turns it off")
+	}
+	if cfg.ReadOnly {
+		logger.Warn("starting read only, writes are refused and nothing runs in the background")
+	}
+
+	//welcome emails are stored as jobs and sent by a few workers that retry, there can be many of them at once and
+	//they survive a restart. a read only instance runs none, they are left to the instances on the primary
+	jobCfg := cfg.Jobs
+	if cfg.ReadOnly {
+		jobCfg.workers = 0
+	}
+	jobs := newJobQueue(db, cfg.DBDriver, jobCfg, map[string]jobHandler{jobTypeEmail: sendEmailJob(mail)}, logger)
+	//the user operations shared by the rest routes, graphql and grpc
+	service := &userService{store: users, events: events, jobs: jobs, db: db, deletions: newDeletionGuard(cfg.DeletionLimit, db)}
+
+	//create router
+	//creates new router using gorilla mux package
+	router := mux.NewRouter()
+	//wrong methods get the json error envelope and the methods the path does have
+	router.MethodNotAllowedHandler = methodNotAllowed(router)
+	//unknown paths get a json 404 as well
+	router.NotFoundHandler = notFound(router)
+	//lets metricsMiddleware label requests with the route template they matched
+	router.Use(recordRouteTemplate)
+	//caps the requests handled at once so a slow database sheds load instead of piling requests up in memory,
+	//it goes before the deadline so waiting for a slot doesnt eat into it
+	router.Use(limitConcurrency(cfg.Concurrency, "/healthz"))
+	//every matched route except the streaming ones gets a deadline of cfg.RequestTimeout
+	router.Use(withRequestTimeout(cfg.RequestTimeout))
+	//bodies are capped before any handler starts reading them
+	router.Use(limitRequestBodies(cfg.MaxBodyBytes))
+	//load balancer probe, public and registered before anything that could shadow it
+	probe := &dbProbe{db: db}
+	//readyz checks every dependency that is configured, the workers registered theirs already
+	healthChecks.setHard(cfg.ReadyHardDependencies)
+	healthChecks.register(dependencyDB, probe)
+	if rdb != nil {
+		healthChecks.register(dependencyRedis, healthCheckFunc(func(ctx context.Context) error { return rdb.Ping(ctx).Err() }))
+	}
+	if c, ok := mail.(healthChecker); ok {
+		healthChecks.register(dependencySMTP, c)
+	}
+	if c, ok := blobs.(healthChecker); ok {
+		healthChecks.register(dependencyAvatars, c)
+	}
+	router.HandleFunc("/healthz", healthz(probe)).Methods("GET")
+	//BASE_PATH mounts everything from here on under a path, the probes above stay at the root
+	mounted := router
+	if cfg.BasePath != "" {
+		mounted = router.PathPrefix(cfg.BasePath).Subrouter()
+	}
+	//the connection pool for operators, admins only
+	mounted.Handle("/debug/dbstats", authMiddleware(db)(requireRole(model.RoleAdmin)(dbStats(db, cfg.DBDriver, cfg.DBPool)))).Methods("GET")
+
+	//the api lives under /api/v1. /api/go is the path it had before versioning, it serves the same routes
+	//as a deprecated alias until its sunset date. a v2 would get its own prefix and registerV2Routes next to these
+	deps := routeDeps{db: db, users: service, cache: cache, jobs: jobs, events: events, loginLimiter: loginLimiter, emailCheck: newEmailAvailabilityChecker(db, cfg.EmailCheck), notFound: newNotFoundThrottle(cfg.NotFoundLimit), google: newGoogleAuth(db, cache, cfg.Google), graphiQL: cfg.GraphiQL, driver: cfg.DBDriver,
+		importMaxBytes: cfg.ImportMaxBytes, ldapSync: ldapSync, maintenance: maintenance, adminNetworks: adminNetworkGuard(cfg.AdminAllowedNetworks),
+		avatars: newAvatarHandlers(db, users, blobs, cache, events, cfg.Avatars.maxBytes)}
+	v1 := mounted.PathPrefix("/api/v1").Subrouter()
+	v1.Use(apiVersion("v1"), requireClientVersion(cfg.MinClientVersions, apiPath("/api/v1")), refuseWritesInMaintenance(maintenance, cfg.Maintenance.retryAfter, apiPath("/api/v1")))
+	registerV1Routes(v1, deps)
+	legacy := mounted.PathPrefix("/api/go").Subrouter()
+	legacy.Use(apiVersion("v1"), deprecatedAlias("/api/go", "/api/v1", cfg.LegacyAPISunset), requireClientVersion(cfg.MinClientVersions, apiPath("/api/go")),
+		refuseWritesInMaintenance(maintenance, cfg.Maintenance.retryAfter, apiPath("/api/go")))
+	registerV1Routes(legacy, deps)
+
+	//wrap the router with the cors and rate limit middlewares --> combine multiple middleware functions to create an enhanced router
+	//the rate limit goes inside cors so browsers can read its 429, /healthz is exempt like the probes on the root mux
+	//identifyApiKey runs first so api keys are limited per key
+	limiter := newRateLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst, "/healthz")
+	enhancedRouter := metricsMiddleware(enableCORS(newCORSPolicy(cfg), router, identifyApiKey(db)(limiter.middleware(router))))
+
+	//prometheus scrapes /metrics directly, outside the cors middleware
+	root := http.NewServeMux()
+	root.Handle("/metrics", promhttp.Handler())
+	//kubernetes probes, like /metrics they skip auth and cors
+	root.HandleFunc("GET /livez", livez)
+	root.Handle("GET /readyz", readyz(healthChecks, maintenance))
+	root.Handle("/", enhancedRouter)
+
+	//the access log wraps everything, including preflights and scrapes,
+	//only the request id, the client address and the request logger go on before it so every log line can carry them.
+	//panics are recovered inside the access log so the 500 they turn into is logged like any other response
+	//compression sits inside the access log so it counts the bytes actually sent, the body capture for debugging inside
+	//the compression so it logs what the handler wrote. X-HTTP-Method-Override is applied right inside the access log,
+	//before the router and the authorization, so everything after it only sees the method it stands for
+	handler := requestid.Middleware(withClientIP(cfg.TrustedProxies, withForwardedBase(cfg.TrustedProxies, withLogger(logger, accessLog(accessLogSkipPaths(cfg.AccessLogSkipPaths),
+		overrideMethod(recoverPanics(compressResponses(captureBodies(cfg.BodyCapture, root)))))))))
+	//the write timeout leaves the handlers some room past their own deadline to send the 504,
+	//streaming routes clear it for their connection
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      cfg.RequestTimeout + 5*time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	//event streams and websockets never finish on their own, they are ended as soon as the shutdown starts
+	server.RegisterOnShutdown(events.Close)
+
+	s := &Server{HTTP: server, jobs: jobs, shutdown: cfg.Shutdown}
+	if ldapSync != nil && cfg.LDAP.schedule != nil && !cfg.ReadOnly {
+		ctx, stop := context.WithCancel(context.Background())
+		s.stopLDAPSync = stop
+		s.ldapSyncDone.Go(func() { ldapSync.runScheduled(ctx, logger) })
+	}
+	if cfg.GRPCAddr != "" {
+		s.GRPC = newGRPCServer(db, service, maintenance, logger)
+	}
+	return s, nil
+}
+
+//routeDeps is what the route handlers are built from, shared by every prefix the routes are registered under
+type routeDeps struct {
+	db    *sql.DB
+	users *userService
+	//cache is nil when it is off, the handlers that write users with their own sql tell it what they changed
+	cache        *userCache
+	jobs         *jobQueue
+	events       eventBroker
+	loginLimiter *loginLimiter
+	emailCheck   *emailAvailabilityChecker
+	google       *googleAuth
+	avatars      *avatarHandlers
+	graphiQL     bool
+	//driver is the database driver, dumps are tagged with it and the stats are counted in its sql
+	driver         string
+	importMaxBytes int64
+	//ldapSync is nil when LDAP_URL isnt set
+	ldapSync    *ldapSyncer
+	maintenance maintenanceSwitch
+	//adminNetworks keeps the destructive admin routes to ADMIN_ALLOWED_NETWORKS, it goes in front of their authentication
+	adminNetworks mux.MiddlewareFunc
+	//notFound answers 429 to clients that keep asking for a user that doesnt exist, nil when NOT_FOUND_LIMIT is 0
+	notFound *notFoundThrottle
+}
+
+//registerV1Routes registers version 1 of the api on r, a subrouter for the prefix it is served under
+func registerV1Routes(r *mux.Router, d routeDeps) {
+	db, jobs, events := d.db, d.jobs, d.events
+	//machine readable description of everything below, built from the routes registered on r, and a page to browse it
+	r.HandleFunc("/openapi.json", openAPISpec(r)).Methods("GET")
+	r.HandleFunc("/docs", apiDocs).Methods("GET")
+	//what an error code means, the type uris of the problem documents point here
+	r.HandleFunc("/errors/{code}", getErrorType).Methods("GET")
+	//register new route with the router.
+	//login(db) is a handler function that will process post requests to /login under the prefix. db passed inside to allow database interaction within the handler
+	//login stays public, it is how clients get a token in the first place
+	r.HandleFunc("/login", login(db, d.loginLimiter)).Methods("POST")
+	r.HandleFunc("/token/refresh", refreshToken(db)).Methods("POST")
+	r.HandleFunc("/logout", logout(db)).Methods("POST")
+	r.HandleFunc("/password/forgot", forgotPassword(db, jobs)).Methods("POST")
+	r.HandleFunc("/password/reset", resetPassword(db, d.cache)).Methods("POST")
+	r.HandleFunc("/auth/google", d.google.start).Methods("GET")
+	r.HandleFunc("/auth/google/callback", d.google.callback).Methods("GET")
+
+	//email verification links are opened from the inbox without a token, so these are public
+	//they are registered before the users subrouter so /verify isnt taken for an {id}
+	r.HandleFunc("/users/verify", verifyEmail(db, d.cache)).Methods("GET")
+	r.HandleFunc("/users/verify/resend", resendVerification(db, jobs)).Methods("POST")
+	//for signup forms, it authenticates the api key of the frontend itself, see emailAvailabilityChecker
+	r.Handle("/users/email-available", d.emailCheck).Methods("GET")
+
+	//websocket alternative to /users/events, it authenticates itself because browsers cant set headers on a websocket
+	r.Handle("/ws", streamingHandler(userEventsSocket(db, events))).Methods("GET")
+
+	//everything under /users needs a valid access token
+	//subrouter: routes registered on it share the prefix and the middlewares added with Use
+	//any authenticated caller can read, changing data needs the admin role
+	admin := requireRole(model.RoleAdmin)
+	//a user can be addressed by its uuid or its public id as well, see resolveUserIds
+	users := r.PathPrefix("/users").Subrouter()
+	users.Use(authMiddleware(db), resolveUserIds(db, d.users.store))
+	//HEAD answers with the headers of the GET, net/http drops the body the handler writes. provisioning scripts use it
+	//to check whether a user exists without downloading it
+	users.HandleFunc("", d.users.getUsers).Methods("GET", "HEAD")
+	//createUser can be retried safely by clients that send an Idempotency-Key header
+	users.Handle("", admin(idempotent(db, http.HandlerFunc(d.users.createUser)))).Methods("POST")
+	//the same change to many users at once, like a new role for a whole team
+	users.Handle("", d.adminNetworks(admin(bulkUpdateUsers(db, events, d.cache)))).Methods("PATCH")
+	//live stream of user changes for the admin dashboard, registered before /{id} so "events" isnt taken for an id
+	users.Handle("/events", admin(streamingHandler(streamUserEvents(events)))).Methods("GET")
+	//counts for the admin dashboard, before /{id} as well
+	users.Handle("/stats", admin(getUserStats(db, d.driver))).Methods("GET")
+	//possible duplicates for an admin to review and merge, before /{id} as well
+	users.Handle("/duplicates", admin(findDuplicateUsers(db))).Methods("GET")
+	//what changed since a cursor, for jobs that keep a copy of the users in sync. before /{id} as well
+	users.Handle("/changes", admin(getUserChanges(db))).Methods("GET")
+	//the ranked search of the admin dashboard, before /{id} as well
+	users.Handle("/search", admin(http.HandlerFunc(d.users.searchUsers))).Methods("GET")
+	//usernames, before /{id} as well. a user found by username is answered like GET /{id}
+	users.HandleFunc("/username-available", usernameAvailable(db)).Methods("GET")
+	users.HandleFunc("/by-username/{username}", userByUsername(db, http.HandlerFunc(d.users.getUser))).Methods("GET")
+	users.Handle("/{id}", d.notFound.middleware(http.HandlerFunc(d.users.getUser))).Methods("GET", "HEAD")
+	users.Handle("/{id}", admin(http.HandlerFunc(d.users.updateUser))).Methods("PUT")
+	users.Handle("/{id}", admin(http.HandlerFunc(d.users.deleteUser))).Methods("DELETE")
+	users.HandleFunc("/{id}/vcard", getUserVCard(d.users.store)).Methods("GET")
+	//offboarding disables a user without deleting the record
+	users.Handle("/{id}/deactivate", admin(setUserActive(db, events, d.cache, false))).Methods("POST")
+	users.Handle("/{id}/activate", admin(setUserActive(db, events, d.cache, true))).Methods("POST")
+	users.Handle("/{id}/merge", admin(mergeUser(db, d.users.store, events, d.cache))).Methods("POST")
+	//support can act as a member for a few minutes, everything they do is audited
+	users.Handle("/{id}/impersonate", d.adminNetworks(admin(impersonate(db)))).Methods("POST")
+	users.Handle("/{id}/audit", admin(getUserAudit(db))).Methods("GET")
+	//kills everything a compromised account could be used with and makes the user reset their password
+	users.Handle("/{id}/revoke-credentials", admin(revokeUserCredentials(db, d.cache))).Methods("POST")
+	//everything stored about a user for privacy requests, admins and the user themself can download it
+	users.Handle("/{id}/export", requireAdminOrSelf(exportUser(db))).Methods("GET")
+	//postal addresses for shipping, for admins and the user themself
+	users.Handle("/{id}/addresses", requireAdminOrSelf(getAddresses(db))).Methods("GET")
+	users.Handle("/{id}/addresses", requireAdminOrSelf(createAddress(db))).Methods("POST")
+	users.Handle("/{id}/addresses/{addressId:[0-9]+}", requireAdminOrSelf(getAddress(db))).Methods("GET")
+	users.Handle("/{id}/addresses/{addressId:[0-9]+}", requireAdminOrSelf(updateAddress(db))).Methods("PUT")
+	users.Handle("/{id}/addresses/{addressId:[0-9]+}", requireAdminOrSelf(deleteAddress(db))).Methods("DELETE")
+	users.HandleFunc("/{id}/groups", getUserGroups(db)).Methods("GET")
+	//which emails the user wants, for admins and the user themself
+	users.Handle("/{id}/preferences", requireAdminOrSelf(getPrefs(db))).Methods("GET")
+	users.Handle("/{id}/preferences", requireAdminOrSelf(putPrefs(db))).Methods("PUT")
+	//profile pictures, any authenticated caller can see them, admins and the user themself change them
+	users.Handle("/{id}/avatar", withBodyLimit(d.avatars.bodyLimit(), requireAdminOrSelf(http.HandlerFunc(d.avatars.put)))).Methods("PUT")
+	users.HandleFunc("/{id}/avatar", d.avatars.get).Methods("GET")
+	users.Handle("/{id}/avatar", requireAdminOrSelf(http.HandlerFunc(d.avatars.delete))).Methods("DELETE")
+	//members may change their own password
+	users.Handle("/{id}/password", requireAdminOrSelf(changePassword(db, d.cache))).Methods("PUT")
+	//applies a pending email change with the token mailed to the new address
+	users.Handle("/{id}/email/confirm", requireAdminOrSelf(confirmEmailChange(db, events, d.cache))).Methods("POST")
+
+	//the authenticated caller's own profile. /me lives outside /users so it can never be mistaken for an {id}
+	me := r.PathPrefix("/me").Subrouter()
+	me.Use(authMiddleware(db))
+	me.HandleFunc("", getMe(db)).Methods("GET")
+	me.HandleFunc("", d.users.updateMe).Methods("PUT")
+
+	//graphql over the same users for clients that want to pick their fields and batch lookups,
+	//it authenticates like /users and checks the admin role on the mutations itself
+	r.Handle("/graphql", authMiddleware(db)(graphQLHandler(d.users))).Methods("POST")
+	if d.graphiQL {
+		r.HandleFunc("/graphql", graphiQL).Methods("GET")
+	}
+
+	//groups of users, any authenticated caller can read them and admins manage them and their members
+	groups := r.PathPrefix("/groups").Subrouter()
+	groups.Use(authMiddleware(db))
+	groups.HandleFunc("", listGroups(db)).Methods("GET")
+	groups.Handle("", admin(createGroup(db))).Methods("POST")
+	groups.HandleFunc("/{id:[0-9]+}", getGroup(db)).Methods("GET")
+	groups.Handle("/{id:[0-9]+}", admin(updateGroup(db))).Methods("PUT")
+	groups.Handle("/{id:[0-9]+}", admin(deleteGroup(db))).Methods("DELETE")
+	groups.Handle("/{id:[0-9]+}/members", admin(addGroupMember(db))).Methods("POST")
+	groups.Handle("/{id:[0-9]+}/members/{userId:[0-9]+}", admin(removeGroupMember(db))).Methods("DELETE")
+
+	//backups of the whole database for admins. both stream, so a big dump isnt cut off by the request timeout.
+	//everything under /admin is only answered from ADMIN_ALLOWED_NETWORKS, like the bulk update and impersonation above
+	adminRoutes := r.PathPrefix("/admin").Subrouter()
+	adminRoutes.Use(d.adminNetworks, authMiddleware(db), admin)
+	adminRoutes.Handle("/export", streamingHandler(exportDump(db, d.driver))).Methods("GET")
+	adminRoutes.Handle("/import", withBodyLimit(d.importMaxBytes, streamingHandler(importDump(db, d.driver, d.cache)))).Methods("POST")
+	//mirrors the users from the ldap directory right away, streaming as well since a big directory takes a while
+	adminRoutes.Handle("/ldap-sync", streamingHandler(d.ldapSync.syncNow)).Methods("POST")
+	//refuses writes while the database is migrated, reads keep working
+	adminRoutes.HandleFunc("/maintenance", getMaintenance(d.maintenance)).Methods("GET")
+	adminRoutes.HandleFunc("/maintenance", setMaintenance(db, d.maintenance)).Methods("POST")
+	//the callers whose deletions the deletion guard refuses, and lifting that early
+	adminRoutes.HandleFunc("/deletion-blocks", d.users.deletions.listDeletionBlocks).Methods("GET")
+	adminRoutes.HandleFunc("/deletion-blocks/{actor:(?:user|key):[0-9]+}", d.users.deletions.clearDeletionBlock).Methods("DELETE")
+	//the background jobs, with the ones that failed every attempt, and queueing those again
+	adminRoutes.HandleFunc("/jobs", listJobs(db)).Methods("GET")
+	adminRoutes.HandleFunc("/jobs/{id:[0-9]+}/retry", retryJob(db)).Methods("POST")
+
+	//api keys for machine callers, managed by admins
+	apiKeys := r.PathPrefix("/apikeys").Subrouter()
+	apiKeys.Use(authMiddleware(db), admin)
+	apiKeys.HandleFunc("", createApiKey(db)).Methods("POST")
+	apiKeys.HandleFunc("/{id}", deleteApiKey(db)).Methods("DELETE")
+	apiKeys.HandleFunc("/{id}/usage", getApiKeyUsage(db)).Methods("GET")
+}
@@ -0,0 +1,424 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	netmail "net/mail"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"api/internal/model"
+	"api/internal/store"
+	"api/internal/testdb"
+)
+
+//testServer is the whole server on a sqlite database of its own, served by httptest. the settings New puts in package
+//variables are shared by every server, so the tests that use one dont run in parallel
+type testServer struct {
+	*httptest.Server
+	t     *testing.T
+	cfg   *Config
+	db    *sql.DB
+	users store.UserStore
+	srv   *Server
+	//mail is what the server sent, it is its smtp server
+	mail *testMailbox
+}
+
+//newTestServer starts a server on a sqlite database, configured by env on top of the defaults
+func newTestServer(t *testing.T, env map[string]string) *testServer {
+	t.Helper()
+	return newTestServerOn(t, testdb.New(t, dbDriverSQLite), env)
+}
+
+//eachDatabase runs fn as a subtest with a server on every database engine testdb can reach, for what has to work the
+//same on all of them
+func eachDatabase(t *testing.T, env map[string]string, fn func(t *testing.T, ts *testServer)) {
+	testdb.Each(t, func(t *testing.T, db testdb.Database) {
+		fn(t, newTestServerOn(t, db, env))
+	})
+}
+
+//newTestServerOn starts a server on db, configured by env on top of the defaults
+func newTestServerOn(t *testing.T, db testdb.Database, env map[string]string) *testServer {
+	t.Helper()
+	t.Setenv("DB_DRIVER", db.Driver)
+	t.Setenv("DATABASE_URL", db.URL)
+	t.Setenv("JWT_SECRET", "test-secret-test-secret-test-secret")
+	t.Setenv("RATE_LIMIT_RPS", "0")
+	t.Setenv("AVATAR_DIR", t.TempDir())
+	mail := newTestMailbox(t)
+	t.Setenv("SMTP_HOST", mail.host)
+	t.Setenv("SMTP_PORT", mail.port)
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+	ts := newTestServerWith(t, cfg)
+	ts.mail = mail
+	return ts
+}
+
+//newTestServerWith starts a server with cfg, which names the database
+func newTestServerWith(t *testing.T, cfg *Config) *testServer {
+	t.Helper()
+	db, err := OpenDB(context.Background(), cfg, testLogger(t))
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	return newTestServerOnDB(t, cfg, db)
+}
+
+//newTestServerOnDB starts a server with cfg on db, which it closes when the test ends
+func newTestServerOnDB(t *testing.T, cfg *Config, db *sql.DB) *testServer {
+	t.Helper()
+	logger := testLogger(t)
+	users, err := NewUserStore(context.Background(), cfg, db, nil)
+	if err != nil {
+		t.Fatalf("preparing user store: %v", err)
+	}
+	srv, err := New(cfg, db, users, nil, logger)
+	if err != nil {
+		t.Fatalf("building server: %v", err)
+	}
+	ts := &testServer{Server: httptest.NewServer(srv.HTTP.Handler), t: t, cfg: cfg, db: db, users: users, srv: srv}
+	t.Cleanup(func() {
+		ts.Close()
+		srv.Close()
+		if c, ok := users.(io.Closer); ok {
+			c.Close()
+		}
+		db.Close()
+	})
+	return ts
+}
+
+//testLogger logs the errors of the server with the test
+func testLogger(t *testing.T) *slog.Logger {
+	return slog.New(slog.NewTextHandler(testLogWriter{t}, &slog.HandlerOptions{Level: slog.LevelError}))
+}
+
+//testLogWriter logs the errors of the server with the test, the internal errors the responses dont tell
+type testLogWriter struct {
+	t *testing.T
+}
+
+func (w testLogWriter) Write(p []byte) (int, error) {
+	w.t.Log(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+//createUser stores a user with role and the password "password123" straight in the database
+func (ts *testServer) createUser(name, email, role string) model.User {
+	ts.t.Helper()
+	hash, err := hashPassword("password123")
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	u, err := ts.users.Create(context.Background(), model.User{Name: name, Email: email, Role: role, Locale: "en", Timezone: "UTC"}, hash)
+	if err != nil {
+		ts.t.Fatalf("creating %s: %v", email, err)
+	}
+	return u
+}
+
+//tokenFor is an access token of u
+func (ts *testServer) tokenFor(u model.User) string {
+	ts.t.Helper()
+	token, _, err := issueAccessToken(int64(u.Id), u.Email)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return token
+}
+
+//admin creates an admin and returns its token
+func (ts *testServer) admin() string {
+	ts.t.Helper()
+	return ts.tokenFor(ts.createUser("Admin", "admin@example.com", model.RoleAdmin))
+}
+
+//member creates a member and returns it with its token
+func (ts *testServer) member() (model.User, string) {
+	ts.t.Helper()
+	u := ts.createUser("Member", "member@example.com", model.RoleMember)
+	return u, ts.tokenFor(u)
+}
+
+//testResponse is a response with its body read
+type testResponse struct {
+	*http.Response
+	body []byte
+}
+
+//decode unmarshals the body into v
+func (r testResponse) decode(t *testing.T, v any) {
+	t.Helper()
+	if err := json.Unmarshal(r.body, v); err != nil {
+		t.Fatalf("decoding %q: %v", r.body, err)
+	}
+}
+
+//errorCode is the code of the json error envelope in the body, empty when it isnt one
+func (r testResponse) errorCode() string {
+	var e struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	json.Unmarshal(r.body, &e)
+	return e.Error.Code
+}
+
+//do sends a request with the token, when it isnt empty, and body, which is sent as json unless it is a string or nil.
+//headers are pairs of names and values
+func (ts *testServer) do(method, path, token string, body any, headers ...string) testResponse {
+	ts.t.Helper()
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(b)
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, ts.URL+path, reader)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	if reader != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		ts.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return testResponse{Response: res, body: data}
+}
+
+//expect fails the test when res doesnt have status
+func expect(t *testing.T, res testResponse, status int) {
+	t.Helper()
+	if res.StatusCode != status {
+		t.Fatalf("%s %s: got %d, want %d: %s", res.Request.Method, res.Request.URL.Path, res.StatusCode, status, res.body)
+	}
+}
+
+//count is the number of rows of table matching where
+func (ts *testServer) count(table, where string, args ...any) int {
+	ts.t.Helper()
+	var n int
+	query := "SELECT count(*) FROM " + table
+	if where != "" {
+		query += " WHERE " + where
+	}
+	if err := ts.db.QueryRow(query, args...).Scan(&n); err != nil {
+		ts.t.Fatalf("counting %s: %v", table, err)
+	}
+	return n
+}
+
+//userPath is the path of the user id under /api/v1
+func userPath(id model.ID) string {
+	return "/api/v1/users/" + strconv.FormatInt(int64(id), 10)
+}
+
+//testMailbox is a minimal smtp server that keeps the messages it is sent
+type testMailbox struct {
+	host, port string
+	messages   chan testMail
+}
+
+//testMail is a message the server sent, with its text decoded
+type testMail struct {
+	To, Subject, Text string
+}
+
+func newTestMailbox(t *testing.T) *testMailbox {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	m := &testMailbox{host: host, port: port, messages: make(chan testMail, 100)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+	return m
+}
+
+//serve speaks just enough smtp for smtp.SendMail
+func (m *testMailbox) serve(conn net.Conn) {
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	c.PrintfLine("220 localhost ready")
+	var to string
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "RCPT":
+			_, to, _ = strings.Cut(arg, ":")
+			to = strings.Trim(to, "<> ")
+			c.PrintfLine("250 ok")
+		case "DATA":
+			c.PrintfLine("354 go ahead")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg, err := parseTestMail(data)
+			if err != nil {
+				c.PrintfLine("554 %v", err)
+				continue
+			}
+			msg.To = to
+			m.messages <- msg
+			c.PrintfLine("250 ok")
+		case "QUIT":
+			c.PrintfLine("221 bye")
+			return
+		default:
+			c.PrintfLine("250 ok")
+		}
+	}
+}
+
+//parseTestMail decodes the subject and the plain text of a message buildMessage rendered
+func parseTestMail(data []byte) (testMail, error) {
+	msg, err := netmail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return testMail{}, err
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		return testMail{}, err
+	}
+	body := msg.Body
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return testMail{}, err
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		part, err := multipart.NewReader(body, params["boundary"]).NextPart()
+		if err != nil {
+			return testMail{}, err
+		}
+		body = part
+	}
+	text, err := io.ReadAll(quotedprintable.NewReader(body))
+	if err != nil {
+		return testMail{}, err
+	}
+	return testMail{Subject: subject, Text: string(text)}, nil
+}
+
+//next waits for the next message the server sends
+func (m *testMailbox) next(t *testing.T) testMail {
+	t.Helper()
+	select {
+	case msg := <-m.messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email was sent")
+		return testMail{}
+	}
+}
+
+//nextTo waits for the next message to the address to, skipping the others
+func (m *testMailbox) nextTo(t *testing.T, to string) testMail {
+	t.Helper()
+	for {
+		if msg := m.next(t); msg.To == to {
+			return msg
+		}
+	}
+}
+
+//nextWith waits for the next message to the address to with subject, skipping the others
+func (m *testMailbox) nextWith(t *testing.T, to, subject string) testMail {
+	t.Helper()
+	for {
+		if msg := m.nextTo(t, to); msg.Subject == subject {
+			return msg
+		}
+	}
+}
+
+//none checks that nothing more is sent for a moment
+func (m *testMailbox) none(t *testing.T) {
+	t.Helper()
+	select {
+	case msg := <-m.messages:
+		t.Fatalf("unexpected email to %s: %s", msg.To, msg.Subject)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+//linkToken is the token in the link of a message
+func (msg testMail) linkToken(t *testing.T) string {
+	t.Helper()
+	match := regexp.MustCompile(`[?&]token=([^\s&]+)`).FindStringSubmatch(msg.Text)
+	if match == nil {
+		t.Fatalf("no link with a token in %q", msg.Text)
+	}
+	token, err := url.QueryUnescape(match[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+//rowCounts is the number of rows of each of tables, to tell that a request changed nothing
+func (ts *testServer) rowCounts(tables ...string) map[string]int {
+	ts.t.Helper()
+	counts := map[string]int{}
+	for _, table := range tables {
+		counts[table] = ts.count(table, "")
+	}
+	return counts
+}
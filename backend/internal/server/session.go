@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+//sessionCookie carries the session id for clients that log in with "session": true instead of using bearer tokens
+const sessionCookie = "session_id"
+
+//sessions expire this long after login, SESSION_TTL overrides the default
+const defaultSessionTTL = 12 * time.Hour
+
+var sessionTTL = defaultSessionTTL
+
+//errSessionInvalid covers unknown and expired sessions alike
+var errSessionInvalid = errors.New("session is invalid or expired")
+
+//createSession stores a new session for a user and returns its id. like refresh tokens only the hash of the id is stored,
+//so a leaked database dump cant be used to take over sessions
+func createSession(db *sql.DB, r *http.Request, userId int64) (string, time.Time, error) {
+	id, err := randomToken(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expires := time.Now().UTC().Add(sessionTTL)
+	_, err = db.ExecContext(r.Context(), "INSERT INTO sessions (id_hash, user_id, expires_at, created_ip, user_agent) VALUES ($1, $2, $3, $4, $5)",
+		hashToken(id), userId, expires, clientIP(r), r.UserAgent())
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("storing session: %w", err)
+	}
+	return id, expires, nil
+}
+
+//sessionUser returns the user a session id belongs to
+func sessionUser(ctx context.Context, db *sql.DB, id string) (int64, error) {
+	var userId int64
+	err := db.QueryRowContext(ctx, "SELECT user_id FROM sessions WHERE id_hash = $1 AND expires_at > now()", hashToken(id)).Scan(&userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errSessionInvalid
+	}
+	if err != nil {
+		return 0, fmt.Errorf("loading session: %w", err)
+	}
+	return userId, nil
+}
+
+//setSessionCookie hands the session id to the browser. HttpOnly keeps scripts from reading it and SameSite=Lax keeps other sites
+//from sending it along with their POST, PUT and DELETE requests
+func setSessionCookie(w http.ResponseWriter, r *http.Request, id string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     cookiePath(r),
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+//expireSessionCookie tells the browser to forget the session cookie
+func expireSessionCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     cookiePath(r),
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+//cleanupSessions deletes expired sessions every interval until ctx is cancelled
+func cleanupSessions(ctx context.Context, db *sql.DB, logger *slog.Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		res, err := db.ExecContext(ctx, "DELETE FROM sessions WHERE expires_at <= now()")
+		if err != nil {
+			logger.Error("cleaning up sessions", "error", err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			logger.Info("cleaned up expired sessions", "count", n)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+//defaultShutdownTimeout is how long open requests get to finish once the server stops accepting connections
+const defaultShutdownTimeout = 30 * time.Second
+
+//shutdownConfig is how the server winds down on SIGINT or SIGTERM
+type shutdownConfig struct {
+	//DrainDelay is how long /readyz reports draining before connections stop being accepted,
+	//it should be a bit longer than the readiness probe period of the load balancer
+	DrainDelay time.Duration
+	//Timeout is the grace period open requests get after that
+	Timeout time.Duration
+}
+
+//Serve runs the server on ln until SIGINT or SIGTERM. the server is first marked as draining so /readyz fails,
+//after the drain delay it stops accepting connections and gives the open requests the shutdown timeout to finish.
+//a second signal exits right away
+func Serve(server *http.Server, ln net.Listener, logger *slog.Logger, c shutdownConfig) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(ln)
+	}()
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		logger.Info("shutting down, draining", "signal", sig.String(), "drain_delay", c.DrainDelay.String(), "timeout", c.Timeout.String())
+	}
+	go func() {
+		sig := <-signals
+		logger.Warn("second signal, exiting without waiting for open requests", "signal", sig.String())
+		os.Exit(1)
+	}()
+
+	draining.Store(true)
+	time.Sleep(c.DrainDelay)
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		logger.Warn("shutdown timeout reached, closing the remaining connections")
+		return server.Close()
+	}
+	if err != nil {
+		return err
+	}
+	logger.Info("open requests finished", "took", time.Since(start).String())
+	return nil
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//defaultSnapshotTimeout is how long a snapshot or the transaction of an export may stay open when SNAPSHOT_TIMEOUT isnt set
+const defaultSnapshotTimeout = 15 * time.Minute
+
+//snapshotTimeout bounds the read only transactions of ?snapshot=true and of GET /admin/export. as long as one of them
+//is open postgres keeps every row version written after it began, a client that stops reading mid stream mustnt hold
+//that open for good. it is set from SNAPSHOT_TIMEOUT in New
+var snapshotTimeout = defaultSnapshotTimeout
+
+//errSnapshotUnsupported is ?snapshot=true on a store that cant read from one, all the stores of internal/store can
+var errSnapshotUnsupported = errors.New("reading from a snapshot isnt supported by this user store")
+
+//userLister is what a page of users is read from, the store or a snapshot of it
+type userLister interface {
+	List(ctx context.Context, f store.Filter) ([]model.User, error)
+	Count(ctx context.Context, f store.Filter) (int, error)
+}
+
+//openSnapshot takes a snapshot of users that lasts until ctx ends or it is closed, whichever comes first.
+//the caller bounds ctx with snapshotTimeout and closes the snapshot when it is done, also when the client went away
+func openSnapshot(ctx context.Context, users store.UserStore) (store.Snapshot, error) {
+	snapshotter, ok := users.(store.Snapshotter)
+	if !ok {
+		return nil, errSnapshotUnsupported
+	}
+	return snapshotter.Snapshot(ctx)
+}
+
+//setSnapshotAt sends when the data of the response was read as X-Snapshot-At, in rfc 3339 with the fraction of the second
+func setSnapshotAt(w http.ResponseWriter, at time.Time) {
+	w.Header().Set("X-Snapshot-At", at.UTC().Format(time.RFC3339Nano))
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//writesDuring is a user store that runs write right after each of its snapshots was taken, like other requests
+//writing while a page is read from the snapshot
+type writesDuring struct {
+	store.UserStore
+	write func()
+}
+
+func (s writesDuring) Snapshot(ctx context.Context) (store.Snapshot, error) {
+	snapshot, err := s.UserStore.(store.Snapshotter).Snapshot(ctx)
+	if err == nil {
+		s.write()
+	}
+	return snapshot, err
+}
+
+//writingRecorder is a ResponseRecorder that calls write once, before the first bytes of the body are written
+type writingRecorder struct {
+	*httptest.ResponseRecorder
+	write func()
+}
+
+func (w *writingRecorder) Write(p []byte) (int, error) {
+	if w.write != nil {
+		w.write()
+		w.write = nil
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+//blockingWriter is a client that stops reading: its first Write waits until release is closed
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	blocked, release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	select {
+	case <-w.blocked:
+	default:
+		close(w.blocked)
+		<-w.release
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+//checkSnapshotAt checks that X-Snapshot-At is a time between start and now
+func checkSnapshotAt(t *testing.T, h http.Header, start time.Time) time.Time {
+	t.Helper()
+	at, err := time.Parse(time.RFC3339Nano, h.Get("X-Snapshot-At"))
+	if err != nil || at.Before(start.Add(-time.Millisecond)) || at.After(time.Now()) {
+		t.Fatalf("X-Snapshot-At %q of a request started at %v: %v", h.Get("X-Snapshot-At"), start, err)
+	}
+	return at
+}
+
+//waitIdle waits until ts has no database connection in use, the snapshot transactions hold one until they are rolled back
+func waitIdle(t *testing.T, ts *testServer) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for ts.db.Stats().InUse > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections are still in use", ts.db.Stats().InUse)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSnapshotList(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"MAX_PAGE_SIZE": "1000"})
+	for _, name := range []string{"Ada", "Grace", "Linus"} {
+		u := model.User{Name: name, Email: name + "@example.com", Role: model.RoleMember, Locale: "en", Timezone: "UTC"}
+		if _, err := ts.users.Create(t.Context(), u, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//the buffered page and the streamed one
+	for _, limit := range []int{20, 200} {
+		before, err := ts.users.List(t.Context(), store.Filter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		first, last := before[0], before[len(before)-1]
+		s := &userService{events: newMemoryBroker(slog.New(slog.DiscardHandler)), store: writesDuring{ts.users, func() {
+			if _, err := ts.users.Update(t.Context(), int64(first.Id), store.Update{Name: fmt.Sprintf("Renamed %d", limit), Email: first.Email}); err != nil {
+				t.Error(err)
+			}
+			if _, err := ts.users.Delete(t.Context(), int64(last.Id), nil); err != nil {
+				t.Error(err)
+			}
+			u := model.User{Name: "Late", Email: fmt.Sprintf("late%d@example.com", limit), Role: model.RoleMember, Locale: "en", Timezone: "UTC"}
+			if _, err := ts.users.Create(t.Context(), u, ""); err != nil {
+				t.Error(err)
+			}
+		}}}
+		start := time.Now()
+		w := httptest.NewRecorder()
+		s.getUsers(w, adminRequest(fmt.Sprintf("/api/v1/users?snapshot=true&limit=%d", limit)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("limit %d answered %d: %s", limit, w.Code, w.Body)
+		}
+		checkSnapshotAt(t, w.Header(), start)
+		var users []model.User
+		if err := json.Unmarshal(w.Body.Bytes(), &users); err != nil {
+			t.Fatal(err)
+		}
+		//the page and its count are the users as they were, none of the writes are in them
+		if w.Header().Get("X-Total-Count") != fmt.Sprint(len(before)) || len(users) != len(before) {
+			t.Fatalf("limit %d listed %d users of %s, there were %d", limit, len(users), w.Header().Get("X-Total-Count"), len(before))
+		}
+		for i, u := range users {
+			if u.Id != before[i].Id || u.Name != before[i].Name {
+				t.Fatalf("limit %d listed %d %s, it was %d %s", limit, u.Id, u.Name, before[i].Id, before[i].Name)
+			}
+		}
+		//they happened
+		if n := ts.count("users", "email = $1", fmt.Sprintf("late%d@example.com", limit)); n != 1 {
+			t.Fatalf("limit %d: the writes didnt happen", limit)
+		}
+	}
+	waitIdle(t, ts)
+
+	//without ?snapshot there is no snapshot
+	admin := ts.admin()
+	res := ts.do("GET", "/api/v1/users", admin, nil)
+	expect(t, res, http.StatusOK)
+	if res.Header.Get("X-Snapshot-At") != "" {
+		t.Fatalf("a list without ?snapshot has X-Snapshot-At %s", res.Header.Get("X-Snapshot-At"))
+	}
+	res = ts.do("GET", "/api/v1/users?snapshot=true", admin, nil)
+	expect(t, res, http.StatusOK)
+	checkSnapshotAt(t, res.Header, time.Now().Add(-time.Minute))
+
+	//a store that cant take snapshots
+	s := &userService{store: generatedStore{n: 3}, events: newMemoryBroker(slog.New(slog.DiscardHandler))}
+	w := httptest.NewRecorder()
+	s.getUsers(w, adminRequest("/api/v1/users?snapshot=true"))
+	if w.Code != http.StatusNotImplemented || (testResponse{Response: w.Result(), body: w.Body.Bytes()}).errorCode() != codeNotConfigured {
+		t.Fatalf("a store without snapshots answered %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestSnapshotExport(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ada := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+	grace := ts.createUser("Grace", "grace@example.com", model.RoleMember)
+
+	//the users change while the export is streamed
+	w := &writingRecorder{ResponseRecorder: httptest.NewRecorder(), write: func() {
+		if _, err := ts.users.Update(t.Context(), int64(ada.Id), store.Update{Name: "Ada Lovelace", Email: ada.Email}); err != nil {
+			t.Error(err)
+		}
+		if _, err := ts.users.Delete(t.Context(), int64(grace.Id), nil); err != nil {
+			t.Error(err)
+		}
+		ts.createUser("Linus", "linus@example.com", model.RoleMember)
+	}}
+	start := time.Now()
+	exportDump(ts.db, ts.cfg.DBDriver)(w, adminRequest("/api/v1/admin/export"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("the export answered %d: %s", w.Code, w.Body)
+	}
+	at := checkSnapshotAt(t, w.Header(), start)
+
+	var (
+		header  dumpHeader
+		names   []string
+		trailer dumpTrailer
+	)
+	lines := bufio.NewScanner(bytes.NewReader(w.Body.Bytes()))
+	lines.Buffer(nil, 1<<20)
+	for i := 0; lines.Scan(); i++ {
+		var record struct {
+			Table  string          `json:"table"`
+			Row    json.RawMessage `json:"row"`
+			Counts map[string]int  `json:"counts"`
+		}
+		if err := json.Unmarshal(lines.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case i == 0:
+			json.Unmarshal(lines.Bytes(), &header)
+		case record.Table == "users":
+			var u dumpUser
+			json.Unmarshal(record.Row, &u)
+			names = append(names, u.Name)
+		case record.Counts != nil:
+			trailer.Counts = record.Counts
+		}
+	}
+	if !header.ExportedAt.Equal(at) {
+		t.Fatalf("the dump was exported at %v, X-Snapshot-At says %v", header.ExportedAt, at)
+	}
+	if fmt.Sprint(names) != "[Ada Grace]" || trailer.Counts["users"] != 2 {
+		t.Fatalf("the export has the users %v and counts %v", names, trailer.Counts)
+	}
+	if n := ts.count("users", "name = 'Linus'"); n != 1 {
+		t.Fatal("the writes during the export didnt happen")
+	}
+	waitIdle(t, ts)
+}
+
+func TestSnapshotRolledBack(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"MAX_PAGE_SIZE": "1000"})
+	ts.createUser("Ada", "ada@example.com", model.RoleMember)
+	s := &userService{store: ts.users, events: newMemoryBroker(slog.New(slog.DiscardHandler))}
+	waitIdle(t, ts)
+
+	for _, tc := range []struct {
+		name, path string
+		timeout    time.Duration
+		serve      http.HandlerFunc
+	}{
+		{"streamed list", "/api/v1/users?snapshot=true&limit=200", 200 * time.Millisecond, s.getUsers},
+		{"export", "/api/v1/admin/export", 200 * time.Millisecond, exportDump(ts.db, ts.cfg.DBDriver)},
+		//the client goes away long before the timeout
+		{"streamed list of a client that went away", "/api/v1/users?snapshot=true&limit=200", time.Hour, s.getUsers},
+		{"export of a client that went away", "/api/v1/admin/export", time.Hour, exportDump(ts.db, ts.cfg.DBDriver)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func(timeout time.Duration) { snapshotTimeout = timeout }(snapshotTimeout)
+			snapshotTimeout = tc.timeout
+			ctx, cancel := context.WithCancel(context.WithValue(t.Context(), principalKey, principal{UserId: 1, Role: model.RoleAdmin}))
+			defer cancel()
+			r := httptest.NewRequestWithContext(ctx, "GET", tc.path, nil)
+			w := &blockingWriter{ResponseRecorder: httptest.NewRecorder(), blocked: make(chan struct{}), release: make(chan struct{})}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				//a stream that fails after its status aborts the handler
+				defer func() { recover() }()
+				tc.serve(w, r)
+			}()
+
+			<-w.blocked
+			if ts.db.Stats().InUse == 0 {
+				t.Fatal("the snapshot holds no connection")
+			}
+			if tc.timeout == time.Hour {
+				cancel()
+			}
+			//the transaction is rolled back while the writer still waits
+			waitIdle(t, ts)
+			close(w.release)
+			<-done
+		})
+	}
+}
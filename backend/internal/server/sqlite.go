@@ -0,0 +1,39 @@
+package server
+
+import (
+	"database/sql/driver"
+	"regexp"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+)
+
+//sqliteTimeFormat is how the driver writes times with _time_format=sqlite, see sqliteParams
+const sqliteTimeFormat = "2006-01-02 15:04:05.999999999-07:00"
+
+//sqliteDriver is the sqlite driver of OpenDB. the queries of the server are written for postgres, it has the now() they
+//use. it returns the time in utc the way the driver writes times, so it compares with the stored ones as text. FOR
+//UPDATE is taken off by the connections (see dropRowLocks)
+var sqliteDriver = func() *sqlite.Driver {
+	d := &sqlite.Driver{}
+	err := d.RegisterScalarFunction("now", 0, func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+		return time.Now().UTC().Format(sqliteTimeFormat), nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return d
+}()
+
+//rowLockClause is a FOR UPDATE with what can follow it on postgres, see dropRowLocks
+var rowLockClause = regexp.MustCompile(`\s+FOR UPDATE(\s+OF\s+\w+)?(\s+SKIP LOCKED|\s+NOWAIT)?`)
+
+//dropRowLocks takes the FOR UPDATE clauses off query. sqlite has no row locks, a transaction takes the write lock of the
+//whole database at BEGIN already (see sqliteParams), so they would lock nothing more than it holds
+func dropRowLocks(query string) string {
+	if !strings.Contains(query, "FOR UPDATE") {
+		return query
+	}
+	return rowLockClause.ReplaceAllString(query, "")
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"api/internal/store"
+)
+
+//limits of the query parameters of GET /users/stats
+const (
+	defaultStatsDays       = 30
+	maxStatsDays           = 366
+	defaultStatsTopDomains = 10
+	maxStatsTopDomains     = 100
+	//activeUserDays is how recently a user has to have logged in to count as active
+	activeUserDays = 30
+)
+
+//signupDay is the number of users who signed up on one utc day
+type signupDay struct {
+	Day     string `json:"day" xml:"day"`
+	Signups int64  `json:"signups" xml:"signups"`
+}
+
+//emailDomainCount is the number of users with an address at one domain
+type emailDomainCount struct {
+	Domain string `json:"domain" xml:"domain"`
+	Users  int64  `json:"users" xml:"users"`
+}
+
+//userStats is the answer of GET /users/stats. signups has a day for every one of the last days, oldest first,
+//it is left out when the database has no created_at column yet. users from before that column are in total only.
+//active is the users who logged in during the last activeUserDays days, left out without a last_login_at column
+type userStats struct {
+	XMLName      xml.Name           `json:"-" xml:"stats"`
+	Total        int64              `json:"total" xml:"total"`
+	Active       *int64             `json:"active_last_30_days,omitempty" xml:"active_last_30_days,omitempty"`
+	Days         int                `json:"days" xml:"days"`
+	Signups      []signupDay        `json:"signups,omitempty" xml:"signups>day,omitempty"`
+	EmailDomains []emailDomainCount `json:"email_domains" xml:"email_domains>domain"`
+}
+
+//getUserStats counts the users for the admin dashboard: all of them, the signups per day of the last ?days= days
+//and the ?top= most common email domains
+func getUserStats(db *sql.DB, driver string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		days, ok := statsParam(w, r, "days", defaultStatsDays, maxStatsDays)
+		if !ok {
+			return
+		}
+		top, ok := statsParam(w, r, "top", defaultStatsTopDomains, maxStatsTopDomains)
+		if !ok {
+			return
+		}
+
+		stats := userStats{Days: days, EmailDomains: []emailDomainCount{}}
+		if err := db.QueryRowContext(r.Context(), "SELECT count(*) FROM users").Scan(&stats.Total); err != nil {
+			internalServerError(w, r, fmt.Errorf("counting users: %w", err))
+			return
+		}
+		signups, err := countSignups(r.Context(), db, driver, days)
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		stats.Signups = signups
+		if stats.Active, err = countActiveUsers(r.Context(), db, activeUserDays); err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+
+		rows, err := db.QueryContext(r.Context(), `SELECT `+emailDomainExpr[driver]+` AS domain, count(*) FROM users
+			GROUP BY domain ORDER BY count(*) DESC, domain LIMIT $1`, top)
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("counting email domains: %w", err))
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var d emailDomainCount
+			if err := rows.Scan(&d.Domain, &d.Users); err != nil {
+				internalServerError(w, r, fmt.Errorf("scanning email domains: %w", err))
+				return
+			}
+			stats.EmailDomains = append(stats.EmailDomains, d)
+		}
+		if err := rows.Err(); err != nil {
+			internalServerError(w, r, fmt.Errorf("counting email domains: %w", err))
+			return
+		}
+		writeResponse(w, r, http.StatusOK, stats)
+	}
+}
+
+//emailDomainExpr is the domain of the users' email in the sql of each driver
+var emailDomainExpr = map[string]string{
+	dbDriverPostgres: "split_part(email, '@', 2)",
+	dbDriverMySQL:    "substring_index(email, '@', -1)",
+	dbDriverSQLite:   "substr(email, instr(email, '@') + 1)",
+}
+
+//signupDayExpr is the utc day a user was created on as YYYY-MM-DD in the sql of each driver. mysql and sqlite store
+//the times in utc already
+var signupDayExpr = map[string]string{
+	dbDriverPostgres: "to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD')",
+	dbDriverMySQL:    "date_format(created_at, '%Y-%m-%d')",
+	dbDriverSQLite:   "substr(created_at, 1, 10)",
+}
+
+//countSignups counts the users created on each of the last days utc days, today included. the days without signups
+//are there with 0 so the dashboard can draw them. nil without an error means the users have no created_at column
+func countSignups(ctx context.Context, db *sql.DB, driver string, days int) ([]signupDay, error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	first := today.AddDate(0, 0, 1-days)
+	rows, err := db.QueryContext(ctx, `SELECT `+signupDayExpr[driver]+` AS day, count(*) FROM users
+		WHERE created_at >= $1 GROUP BY day`, first)
+	if store.IsUndefinedColumn(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("counting signups: %w", err)
+	}
+	defer rows.Close()
+	counts := map[string]int64{}
+	for rows.Next() {
+		var day string
+		var n int64
+		if err := rows.Scan(&day, &n); err != nil {
+			return nil, fmt.Errorf("scanning signups: %w", err)
+		}
+		counts[day] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("counting signups: %w", err)
+	}
+	signups := make([]signupDay, 0, days)
+	for d := first; !d.After(today); d = d.AddDate(0, 0, 1) {
+		day := d.Format(time.DateOnly)
+		signups = append(signups, signupDay{Day: day, Signups: counts[day]})
+	}
+	return signups, nil
+}
+
+//countActiveUsers counts the users who logged in during the last days days. nil without an error means the users have
+//no last_login_at column
+func countActiveUsers(ctx context.Context, db *sql.DB, days int) (*int64, error) {
+	var n int64
+	since := time.Now().UTC().AddDate(0, 0, -days)
+	err := db.QueryRowContext(ctx, "SELECT count(*) FROM users WHERE last_login_at > $1", since).Scan(&n)
+	if store.IsUndefinedColumn(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("counting active users: %w", err)
+	}
+	return &n, nil
+}
+
+//statsParam reads the number in the query parameter name, def when it isnt set. it has answered the request when ok is false
+func statsParam(w http.ResponseWriter, r *http.Request, name string, def, maximum int) (n int, ok bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > maximum {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("%s must be a number between 1 and %d", name, maximum))
+		return 0, false
+	}
+	return n, true
+}
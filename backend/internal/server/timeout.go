@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//defaultRequestTimeout is how long a handler may take when REQUEST_TIMEOUT isnt set
+const defaultRequestTimeout = 10 * time.Second
+
+//streamingHandler marks a long lived request like an event stream, a websocket or a big upload
+//it opts out of the request deadline and clears the server read and write timeouts for its connection
+type streamingHandler http.HandlerFunc
+
+func (h streamingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	//zero means no deadline, an error only means the writer doesnt support deadlines
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+	h(w, r)
+}
+
+//withRequestTimeout cancels the context of a request after timeout, so the queries it runs are cancelled too
+//a handler that gives up because of the deadline answers 504 through internalServerError,
+//one that returns without writing anything gets the 504 from here. streaming routes are left alone
+func withRequestTimeout(timeout time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isStreaming(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r)
+			if rec.status == 0 && timedOut(r) {
+				writeTimeout(w, r)
+			}
+		})
+	}
+}
+
+//isStreaming reports whether the route the request matched is a streamingHandler, maybe inside withBodyLimit
+func isStreaming(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+	h := route.GetHandler()
+	if b, ok := h.(bodyLimit); ok {
+		h = b.handler
+	}
+	_, ok := h.(streamingHandler)
+	return ok
+}
+
+//timedOut reports whether the request deadline has passed
+//a cancelled query can come back as a postgres error (query_canceled) or a closed connection, so the context is checked rather than the error
+func timedOut(r *http.Request) bool {
+	return errors.Is(r.Context().Err(), context.DeadlineExceeded)
+}
+
+//writeTimeout answers with 504, the request took longer than requestTimeout
+func writeTimeout(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusGatewayTimeout, codeTimeout, "the request took too long and was cancelled")
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"iter"
+	"sync"
+	"time"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//user cache defaults, USER_CACHE_SIZE=0 turns the in-process cache off
+const (
+	defaultUserCacheSize = 10000            //USER_CACHE_SIZE
+	defaultUserCacheTTL  = 30 * time.Second //USER_CACHE_TTL
+)
+
+//userCacheConfig is the setup of the in-process cache in front of UserStore.Get, a size of 0 leaves it out
+type userCacheConfig struct {
+	size int
+	ttl  time.Duration
+}
+
+//userCache is the store behind the caches in front of it: users read by id are kept in this process (local)
+//and in redis (shared), and the ids no user was found for in this process as well (missing), any of them can be off.
+//every write through it forgets the user it changed once the write is done, and the handlers that write users with
+//their own sql call forget after committing.
+//a change made by another instance reaches the shared cache, the local one only sees it when the entry expires,
+//so deployments with several instances that cant live with that staleness turn the local cache off.
+//the other methods go straight to the store underneath
+type userCache struct {
+	store.UserStore
+	local   *localUserCache
+	shared  *sharedUserCache
+	missing *missingUserCache
+}
+
+//newUserCache returns users behind the caches that are on, nil when all of them are off
+func newUserCache(users store.UserStore, local *localUserCache, shared *sharedUserCache, missing *missingUserCache) *userCache {
+	if local == nil && shared == nil && missing == nil {
+		return nil
+	}
+	return &userCache{UserStore: users, local: local, shared: shared, missing: missing}
+}
+
+func (c *userCache) Get(ctx context.Context, id int64) (model.User, error) {
+	u, generation, ok := c.local.get(id)
+	if ok {
+		return u, nil
+	}
+	if u, ok := c.shared.get(ctx, id); ok {
+		c.local.put(id, u, generation)
+		return u, nil
+	}
+	//after the shared cache, which has the users other instances created since
+	missingGeneration, missing := c.missing.get(id)
+	if missing {
+		return model.User{}, store.ErrUserNotFound
+	}
+	u, err := c.UserStore.Get(ctx, id)
+	if errors.Is(err, store.ErrUserNotFound) {
+		c.missing.put(id, missingGeneration)
+	}
+	if err != nil {
+		return u, err
+	}
+	c.shared.put(ctx, id, u)
+	c.local.put(id, u, generation)
+	return u, nil
+}
+
+//List serves the first page of every active user from the shared cache when it keeps lists, anything else is read from the store.
+//the first page is what GET /users without parameters asks for, see parsePage
+func (c *userCache) List(ctx context.Context, f store.Filter) ([]model.User, error) {
+	if f != (store.Filter{Limit: min(defaultPageSize, maxPageSize)}) {
+		return c.UserStore.List(ctx, f)
+	}
+	if users, ok := c.shared.getList(ctx); ok {
+		return users, nil
+	}
+	users, err := c.UserStore.List(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	c.shared.putList(ctx, users)
+	return users, nil
+}
+
+func (c *userCache) Create(ctx context.Context, u model.User, passwordHash string) (model.User, error) {
+	created, err := c.UserStore.Create(ctx, u, passwordHash)
+	if err == nil {
+		c.forget(ctx, int64(created.Id))
+	}
+	return created, err
+}
+
+func (c *userCache) Update(ctx context.Context, id int64, change store.Update) (model.User, error) {
+	defer c.forget(ctx, id)
+	return c.UserStore.Update(ctx, id, change)
+}
+
+func (c *userCache) Delete(ctx context.Context, id int64, match *store.Match) (model.User, error) {
+	defer c.forget(ctx, id)
+	return c.UserStore.Delete(ctx, id, match)
+}
+
+//Stream is the Stream of the store underneath, or its List one user at a time when it has none. streamed lists are
+//never cached, they are the long ones past the first page
+func (c *userCache) Stream(ctx context.Context, f store.Filter) iter.Seq2[model.User, error] {
+	if streamer, ok := c.UserStore.(store.Streamer); ok {
+		return streamer.Stream(ctx, f)
+	}
+	return func(yield func(model.User, error) bool) {
+		users, err := c.UserStore.List(ctx, f)
+		if err != nil {
+			yield(model.User{}, err)
+			return
+		}
+		for _, u := range users {
+			if !yield(u, nil) {
+				return
+			}
+		}
+	}
+}
+
+//Upsert is the Upsert of the store underneath, errUpsertUnsupported when it has none
+func (c *userCache) Upsert(ctx context.Context, id int64, change store.Update) (model.User, bool, error) {
+	upserter, ok := c.UserStore.(store.Upserter)
+	if !ok {
+		return model.User{}, false, errUpsertUnsupported
+	}
+	defer c.forget(ctx, id)
+	return upserter.Upsert(ctx, id, change)
+}
+
+//Search is the Search of the store underneath, errSearchUnsupported when it has none. results are never cached
+func (c *userCache) Search(ctx context.Context, f store.Filter) ([]model.ScoredUser, error) {
+	searcher, ok := c.UserStore.(store.Searcher)
+	if !ok {
+		return nil, errSearchUnsupported
+	}
+	return searcher.Search(ctx, f)
+}
+
+//Snapshot is the Snapshot of the store underneath, errSnapshotUnsupported when it has none. snapshots are never cached
+func (c *userCache) Snapshot(ctx context.Context) (store.Snapshot, error) {
+	snapshotter, ok := c.UserStore.(store.Snapshotter)
+	if !ok {
+		return nil, errSnapshotUnsupported
+	}
+	return snapshotter.Snapshot(ctx)
+}
+
+//forget drops the user id from the caches. it is called after a write to that user is committed, c may be nil.
+//the write is done by then, so it goes through even when ctx was cancelled meanwhile
+func (c *userCache) forget(ctx context.Context, id int64) {
+	if c == nil {
+		return
+	}
+	c.local.forget(id)
+	c.missing.forget(id)
+	c.shared.forget(context.WithoutCancel(ctx), id)
+}
+
+//localUserCache keeps users in memory, the least recently used one is dropped when it is full.
+//its methods do nothing on a nil cache
+type localUserCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	size    int
+	entries map[int64]*list.Element
+	//lru has the most recently used entry at the front
+	lru *list.List
+	//generation changes with every forget. a Get that started before a write must not cache what it read,
+	//it may be the row as it was before the write
+	generation uint64
+}
+
+type localUserCacheEntry struct {
+	id      int64
+	user    model.User
+	expires time.Time
+}
+
+//newLocalUserCache returns the cache set up by c, nil when c turns it off
+func newLocalUserCache(c userCacheConfig) *localUserCache {
+	if c.size <= 0 {
+		return nil
+	}
+	return &localUserCache{ttl: c.ttl, size: c.size, entries: map[int64]*list.Element{}, lru: list.New()}
+}
+
+//get returns the cached user id. on a miss it returns the generation to pass to put with what the caller reads instead
+func (c *localUserCache) get(id int64) (model.User, uint64, bool) {
+	if c == nil {
+		return model.User{}, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[id]; ok {
+		e := el.Value.(*localUserCacheEntry)
+		if time.Now().Before(e.expires) {
+			c.lru.MoveToFront(el)
+			userCacheHits.WithLabelValues("local").Inc()
+			return e.user, 0, true
+		}
+		c.remove(el)
+	}
+	userCacheMisses.WithLabelValues("local").Inc()
+	return model.User{}, c.generation, false
+}
+
+//put caches u unless something was forgotten since get returned generation
+func (c *localUserCache) put(id int64, u model.User, generation uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != generation {
+		return
+	}
+	if el, ok := c.entries[id]; ok {
+		c.remove(el)
+	}
+	c.entries[id] = c.lru.PushFront(&localUserCacheEntry{id: id, user: u, expires: time.Now().Add(c.ttl)})
+	if c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *localUserCache) forget(id int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if el, ok := c.entries[id]; ok {
+		c.remove(el)
+	}
+}
+
+//remove drops el, c.mu must be held
+func (c *localUserCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*localUserCacheEntry).id)
+}
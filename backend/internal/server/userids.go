@@ -0,0 +1,92 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//user id formats USER_ID_FORMAT can choose, see Config.UserIdFormat
+const (
+	userIdFormatSerial = "serial"
+	userIdFormatUuid   = "uuid"
+)
+
+//uuidUserIds makes the user routes refuse serial ids, only the uuid of a user finds it. set from Config.UserIdFormat by New
+var uuidUserIds bool
+
+//resolveUserIds lets the routes with an {id} take the uuid or the public id of a user in its place, told apart by
+//their format. they are looked up and replaced by the serial id, so the handlers, the caches and the store behind it
+//only ever see serial ids. anything else has to be a serial id that fits in an int64, a malformed one or one that
+//overflows is a 400 rather than a user that isnt there. with uuidUserIds a serial id is answered like a user that
+//doesnt exist, so the ids cant be counted up
+func resolveUserIds(db *sql.DB, users store.UserStore) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			vars := mux.Vars(r)
+			id, ok := vars["id"]
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			var serial int64
+			if publicId, ok := model.ParsePublicId(id); ok {
+				u, err := users.GetByPublicId(r.Context(), publicId)
+				if errors.Is(err, store.ErrUserNotFound) {
+					writeUserNotFound(w, r, id)
+					return
+				}
+				if err != nil {
+					internalServerError(w, r, fmt.Errorf("looking up user public id: %w", err))
+					return
+				}
+				serial = int64(u.Id)
+			} else if parsed, err := uuid.Parse(id); err == nil {
+				err := db.QueryRowContext(r.Context(), "SELECT id FROM users WHERE uuid = $1", parsed.String()).Scan(&serial)
+				if errors.Is(err, sql.ErrNoRows) {
+					writeUserNotFound(w, r, id)
+					return
+				}
+				if err != nil {
+					internalServerError(w, r, fmt.Errorf("looking up user uuid: %w", err))
+					return
+				}
+			} else if uuidUserIds {
+				writeUserNotFound(w, r, id)
+				return
+			} else if serial, err = strconv.ParseInt(id, 10, 64); err != nil {
+				writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "a user id is a number up to "+strconv.FormatInt(math.MaxInt64, 10)+", a uuid or a public id")
+				return
+			}
+			resolved := make(map[string]string, len(vars))
+			for k, v := range vars {
+				resolved[k] = v
+			}
+			resolved["id"] = strconv.FormatInt(serial, 10)
+			next.ServeHTTP(w, mux.SetURLVars(r, resolved))
+		})
+	}
+}
+
+//userIdVar is the {id} of a route behind resolveUserIds, which made sure it is a serial id
+func userIdVar(r *http.Request) int64 {
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	return id
+}
+
+//userLocation is the url of u for Location headers, by uuid when the routes only take uuids
+func userLocation(r *http.Request, u model.User) string {
+	if uuidUserIds {
+		return externalURL(r, apiPath("/api/v1/users/"+u.Uuid))
+	}
+	return externalURL(r, apiPath("/api/v1/users/"+strconv.FormatInt(int64(u.Id), 10)))
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"api/internal/model"
+)
+
+//withUserId moves u to id, for ids the sequence wont hand out in a test
+func (ts *testServer) withUserId(u model.User, id model.ID) model.User {
+	ts.t.Helper()
+	if _, err := ts.db.Exec("UPDATE users SET id = $1 WHERE id = $2", id, u.Id); err != nil {
+		ts.t.Fatalf("moving user %d to %d: %v", u.Id, id, err)
+	}
+	u.Id = id
+	return u
+}
+
+func TestStringJSONIds(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"JSON_STRING_IDS": "true"})
+	admin := ts.admin()
+	res := ts.do("POST", "/api/v1/groups", admin, map[string]any{"name": "Boundaries"})
+	expect(t, res, http.StatusCreated)
+	var group struct {
+		Id string `json:"id"`
+	}
+	res.decode(t, &group)
+	if _, err := strconv.ParseInt(group.Id, 10, 64); err != nil {
+		t.Fatalf("the group id isnt a string of digits: %s", res.body)
+	}
+
+	for _, id := range []model.ID{math.MaxInt32, math.MaxInt32 + 1, 1<<53 + 1, math.MaxInt64} {
+		digits := strconv.FormatInt(int64(id), 10)
+		u := ts.withUserId(ts.createUser("User "+digits, "user"+digits+"@example.com", model.RoleMember), id)
+		res := ts.do("GET", userPath(u.Id), admin, nil)
+		expect(t, res, http.StatusOK)
+		if !strings.Contains(string(res.body), `"id":"`+digits+`"`) {
+			t.Fatalf("user %s answered %s", digits, res.body)
+		}
+		res = ts.do("GET", "/api/v1/users?sort=-id&limit=1", admin, nil)
+		expect(t, res, http.StatusOK)
+		if !strings.Contains(string(res.body), `"id":"`+digits+`"`) {
+			t.Fatalf("the list with user %s answered %s", digits, res.body)
+		}
+		//requests may send them as strings
+		expect(t, ts.do("POST", "/api/v1/groups/"+group.Id+"/members", admin, `{"user_id": "`+digits+`"}`), http.StatusNoContent)
+		expect(t, ts.do("DELETE", "/api/v1/groups/"+group.Id+"/members/"+digits, admin, nil), http.StatusNoContent)
+		expect(t, ts.do("POST", "/api/v1/groups/"+group.Id+"/members", admin, `{"user_id": `+digits+`}`), http.StatusNoContent)
+	}
+	expect(t, ts.do("POST", "/api/v1/groups/"+group.Id+"/members", admin, `{"user_id": "9223372036854775808"}`), http.StatusBadRequest)
+}
+
+func TestNumericJSONIds(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	u := ts.withUserId(ts.createUser("Max", "max@example.com", model.RoleMember), math.MaxInt64)
+	res := ts.do("GET", userPath(u.Id), admin, nil)
+	expect(t, res, http.StatusOK)
+	if !strings.Contains(string(res.body), `"id":9223372036854775807,`) {
+		t.Fatalf("the user answered %s", res.body)
+	}
+	res = ts.do("POST", "/api/v1/groups", admin, map[string]any{"name": "Boundaries"})
+	expect(t, res, http.StatusCreated)
+	var group model.Group
+	res.decode(t, &group)
+	members := "/api/v1/groups/" + strconv.FormatInt(int64(group.Id), 10) + "/members"
+	//without JSON_STRING_IDS an id has to be a number
+	expect(t, ts.do("POST", members, admin, `{"user_id": "9223372036854775807"}`), http.StatusBadRequest)
+	expect(t, ts.do("POST", members, admin, `{"user_id": 9223372036854775808}`), http.StatusBadRequest)
+	expect(t, ts.do("POST", members, admin, `{"user_id": 9223372036854775807}`), http.StatusNoContent)
+}
+
+//TestUserIdForms sends every user route the serial id and the public id of a user, both find the same one
+func TestUserIdForms(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	u := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+	if _, ok := model.ParsePublicId(u.PublicId); !ok {
+		t.Fatalf("the public id is %q", u.PublicId)
+	}
+
+	for _, id := range []string{strconv.FormatInt(int64(u.Id), 10), u.PublicId, strings.ToLower(u.PublicId), u.Uuid} {
+		res := ts.do("GET", "/api/v1/users/"+id, admin, nil)
+		expect(t, res, http.StatusOK)
+		var got model.User
+		res.decode(t, &got)
+		if got.Id != u.Id || got.PublicId != u.PublicId {
+			t.Fatalf("%s found %s", id, res.body)
+		}
+		expect(t, ts.do("GET", "/api/v1/users/"+id+"/vcard", admin, nil), http.StatusOK)
+		expect(t, ts.do("PUT", "/api/v1/users/"+id, admin, map[string]any{"name": "Ada " + id, "email": "ada@example.com"}), http.StatusOK)
+		if n := ts.count("users", "id = $1 AND name = $2", u.Id, "Ada "+id); n != 1 {
+			t.Fatalf("the update by %s didnt reach the user", id)
+		}
+	}
+
+	//an id of the right form that nobody has is a user that isnt there, one of no form a bad request
+	expect(t, ts.do("GET", "/api/v1/users/"+model.NewPublicId(time.Now()), admin, nil), http.StatusNotFound)
+	expect(t, ts.do("GET", "/api/v1/users/8ZZZZZZZZZZZZZZZZZZZZZZZZZ", admin, nil), http.StatusBadRequest)
+
+	expect(t, ts.do("DELETE", "/api/v1/users/"+u.PublicId, admin, nil), http.StatusNoContent)
+	expect(t, ts.do("GET", userPath(u.Id), admin, nil), http.StatusNotFound)
+	expect(t, ts.do("GET", "/api/v1/users/"+u.PublicId, admin, nil), http.StatusNotFound)
+}
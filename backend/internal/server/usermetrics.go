@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+//defaultUserMetricsInterval is how often the user gauges are counted when USER_METRICS_INTERVAL isnt set
+const defaultUserMetricsInterval = time.Minute
+
+//the user gauges, counted by runUserMetrics every USER_METRICS_INTERVAL instead of on every scrape, so a tight scrape
+//interval doesnt turn into queries. when a count fails the gauges keep the values they had and the error is counted
+var (
+	usersByState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "users",
+		Help: "Users in the database, by state (active or deactivated).",
+	}, []string{"state"})
+	usersCreatedLastDay = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "users_created_last_24h",
+		Help: "Users created in the last 24 hours.",
+	})
+	userMetricsErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "user_metrics_errors_total",
+		Help: "Counts of the user gauges that failed, the gauges keep their last values then.",
+	})
+	userMetricsLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "user_metrics_last_success_timestamp_seconds",
+		Help: "Unix time the user gauges were last counted.",
+	})
+)
+
+//runUserMetrics counts the users for the gauges right away and then every interval until ctx is cancelled
+func runUserMetrics(ctx context.Context, db *sql.DB, interval time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := countUsers(ctx, db); err != nil && ctx.Err() == nil {
+			userMetricsErrors.Inc()
+			logger.Warn("counting users for the metrics", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//countUsers sets the user gauges with one query. users without a created_at are from before it was recorded,
+//they arent new
+func countUsers(ctx context.Context, db *sql.DB) error {
+	//a slow database shouldnt keep a count running into the next one
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	var active, deactivated, created int64
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(SUM(CASE WHEN active THEN 1 ELSE 0 END), 0), COALESCE(SUM(CASE WHEN active THEN 0 ELSE 1 END), 0),
+		COALESCE(SUM(CASE WHEN created_at >= $1 THEN 1 ELSE 0 END), 0) FROM users`, time.Now().UTC().Add(-24*time.Hour)).Scan(&active, &deactivated, &created)
+	if err != nil {
+		return fmt.Errorf("counting users: %w", err)
+	}
+	usersByState.WithLabelValues("active").Set(float64(active))
+	usersByState.WithLabelValues("deactivated").Set(float64(deactivated))
+	usersCreatedLastDay.Set(float64(created))
+	userMetricsLastSuccess.SetToCurrentTime()
+	return nil
+}
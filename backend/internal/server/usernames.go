@@ -0,0 +1,60 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//usernameAvailability is the answer of GET /users/username-available
+type usernameAvailability struct {
+	Available bool `json:"available"`
+}
+
+//usernameAvailable tells a form whether the username in ?u= can still be taken, before the user is saved with it.
+//a username that isnt valid at all is a validation error with the reason, like on create
+func usernameAvailable(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("u")))
+		if username == "" {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "the username to check is required, pass it as ?u=")
+			return
+		}
+		if msg := model.ValidateUsername(username); msg != "" {
+			writeValidationError(w, r, model.FieldErrors{"u": msg})
+			return
+		}
+		taken, err := store.UsernameTaken(r.Context(), db, username, 0)
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		writeResponse(w, r, http.StatusOK, usernameAvailability{Available: !taken})
+	}
+}
+
+//userByUsername serves next, the handler of GET /users/{id}, for the user with the {username} of the path,
+//ignoring case. like resolveUserIds it looks up the serial id and hands next that as {id}
+func userByUsername(db *sql.DB, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := mux.Vars(r)["username"]
+		var id int
+		err := db.QueryRowContext(r.Context(), "SELECT id FROM users WHERE lower(username) = lower($1)", username).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeUserNotFound(w, r, username)
+			return
+		}
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("looking up username: %w", err))
+			return
+		}
+		next.ServeHTTP(w, mux.SetURLVars(r, map[string]string{"id": fmt.Sprint(id)}))
+	}
+}
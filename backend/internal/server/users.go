@@ -0,0 +1,519 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"api/internal/model"
+	"api/internal/store"
+	"api/requestid"
+)
+
+//userService is what the user operations go through: the http handlers below, the grpc service and the graphql resolvers.
+//it adds what comes with a change besides storing it, the live events and the emails
+type userService struct {
+	store  store.UserStore
+	events eventBroker
+	//jobs sends the emails, the welcome, the verification links and the email change confirmations. it is nil where no
+	//emails are sent
+	jobs *jobQueue
+	//db keeps the email verification tokens and the jobs, it is nil with the in-memory store, which sends no emails
+	db *sql.DB
+	//deletions refuses the deletions of a caller that deleted too many users at once, nil when DELETION_LIMIT is 0
+	deletions *deletionGuard
+}
+
+//create stores u, which has passed Validate, and mails the new user a welcome and the verification link
+func (s *userService) create(ctx context.Context, u model.User) (model.User, error) {
+	//only the bcrypt hash of the password is stored. clear the plaintext so it cant end up in the response
+	var passwordHash string
+	if u.Password != "" {
+		hash, err := hashPassword(u.Password)
+		if err != nil {
+			return model.User{}, err
+		}
+		passwordHash = hash
+		u.Password = ""
+	}
+	//the welcome is queued in the transaction of the create by RecordUserChange, a user is only committed with it
+	if s.jobs != nil {
+		ctx = context.WithValue(ctx, welcomeJobsKey, s.jobs)
+	}
+	u, err := s.store.Create(ctx, u, passwordHash)
+	if err != nil {
+		return model.User{}, err
+	}
+	s.events.Publish(userEvent{Type: eventUserCreated, User: u})
+	//the new user has to confirm they own the address
+	if s.jobs != nil {
+		s.jobs.notify()
+		if err := sendVerificationEmail(ctx, s.db, s.jobs, int64(u.Id), u.Email); err != nil {
+			return u, err
+		}
+	}
+	return u, nil
+}
+
+//queueWelcome queues the welcome email of u, who was just created in tx, unless u turned welcome emails off
+func queueWelcome(ctx context.Context, jobs *jobQueue, tx inserter, u model.User) error {
+	allowed, err := emailAllowed(ctx, tx, int64(u.Id), emailWelcome)
+	if err != nil || !allowed {
+		return err
+	}
+	msg, err := welcomeEmail(u)
+	if err != nil {
+		return fmt.Errorf("rendering welcome email: %w", err)
+	}
+	return jobs.enqueue(ctx, tx, jobTypeEmail, msg)
+}
+
+//update writes the validated fields of u to the user with the given id, conditional on match when it isnt nil.
+//a new email address is mailed a confirmation link, see emailchange.go
+func (s *userService) update(ctx context.Context, id int64, u model.User, match *store.Match) (model.User, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return model.User{}, err
+	}
+	updated, err := s.store.Update(ctx, id, store.Update{Name: u.Name, Email: u.Email, Username: u.Username, Phone: u.Phone, Locale: u.Locale, Timezone: u.Timezone, Role: u.Role,
+		EmailTokenHash: hashToken(token), PendingEmailExpiresAt: time.Now().Add(emailChangeTTL), Match: match})
+	if err != nil {
+		return model.User{}, err
+	}
+	s.events.Publish(userEvent{Type: eventUserUpdated, User: updated})
+	s.sendEmailChange(ctx, updated, u.Email, token)
+	return updated, nil
+}
+
+//errUpsertUnsupported is upsert on a store that cant create users with a given id
+var errUpsertUnsupported = errors.New("creating users with put is only supported with the postgres store")
+
+//upsert is update for a put with ?create=true: a user id that doesnt exist is created with that id instead of being a 404.
+//created tells which happened, a created user is mailed the verification link like after create
+func (s *userService) upsert(ctx context.Context, id int64, u model.User) (model.User, bool, error) {
+	upserter, ok := s.store.(store.Upserter)
+	if !ok {
+		return model.User{}, false, errUpsertUnsupported
+	}
+	token, err := randomToken(32)
+	if err != nil {
+		return model.User{}, false, err
+	}
+	saved, created, err := upserter.Upsert(ctx, id, store.Update{Name: u.Name, Email: u.Email, Username: u.Username, Phone: u.Phone, Locale: u.Locale, Timezone: u.Timezone, Role: u.Role,
+		EmailTokenHash: hashToken(token), PendingEmailExpiresAt: time.Now().Add(emailChangeTTL)})
+	if err != nil {
+		return model.User{}, false, err
+	}
+	if created {
+		s.events.Publish(userEvent{Type: eventUserCreated, User: saved})
+		if s.jobs != nil {
+			return saved, true, sendVerificationEmail(ctx, s.db, s.jobs, int64(saved.Id), saved.Email)
+		}
+		return saved, true, nil
+	}
+	s.events.Publish(userEvent{Type: eventUserUpdated, User: saved})
+	s.sendEmailChange(ctx, saved, u.Email, token)
+	return saved, false, nil
+}
+
+//sendEmailChange queues the emails of a change of the address of saved to newEmail, when it is one, see
+//sendEmailChangeEmails. the change is committed by now, emails that cant be queued are logged but dont fail it
+func (s *userService) sendEmailChange(ctx context.Context, saved model.User, newEmail, token string) {
+	if s.jobs == nil || strings.EqualFold(saved.Email, newEmail) {
+		return
+	}
+	if err := sendEmailChangeEmails(ctx, s.jobs, s.db, saved.Email, newEmail, token); err != nil {
+		loggerFrom(ctx).Error("sending email change emails", "user_id", saved.Id, "error", err)
+	}
+}
+
+//remove deletes the user with the given id, conditional on match when it isnt nil, and returns what was deleted.
+//in a dry run (see store.WithDryRun) nothing is deleted and nobody is told, it returns what would have been deleted
+func (s *userService) remove(ctx context.Context, id int64, match *store.Match) (model.User, error) {
+	//a dry run deletes nothing, so it doesnt count
+	if !store.IsDryRun(ctx) {
+		if err := s.deletions.allow(ctx); err != nil {
+			return model.User{}, err
+		}
+	}
+	deleted, err := s.store.Delete(ctx, id, match)
+	if err != nil {
+		return model.User{}, err
+	}
+	if !store.IsDryRun(ctx) {
+		s.events.Publish(userEvent{Type: eventUserDeleted, User: deleted})
+	}
+	return deleted, nil
+}
+
+//dryRunDeletion is the answer of DELETE /users/{id}?dry_run=true
+type dryRunDeletion struct {
+	XMLName xml.Name   `json:"-" xml:"deletion"`
+	DryRun  bool       `json:"dry_run" xml:"dry_run,attr"`
+	User    model.User `json:"user" xml:"user"`
+}
+
+//RecordUserChange is the store.ChangeHook of the database stores: it writes the change to the audit log and the outbox,
+//with the caller in ctx as the actor. a user created by userService.create gets its welcome email queued as well
+func RecordUserChange(ctx context.Context, tx *sql.Tx, before, after *model.User) error {
+	action, eventType, u := auditUserUpdated, outboxUserUpdated, after
+	switch {
+	case before == nil:
+		action, eventType = auditUserCreated, outboxUserCreated
+	case after == nil:
+		action, eventType, u = auditUserDeleted, outboxUserDeleted, before
+	}
+	if err := auditUserChange(ctx, tx, action, before, after); err != nil {
+		return err
+	}
+	if jobs, ok := ctx.Value(welcomeJobsKey).(*jobQueue); ok && before == nil {
+		if err := queueWelcome(ctx, jobs, tx, *after); err != nil {
+			return err
+		}
+	}
+	return enqueueOutbox(ctx, tx, eventType, *u)
+}
+
+//writeUserOpError answers with the status that fits an error of the user operations above
+func writeUserOpError[T ~int64 | string](w http.ResponseWriter, r *http.Request, id T, err error) {
+	var limited *deletionLimitError
+	switch {
+	case errors.Is(err, store.ErrUserNotFound):
+		writeUserNotFound(w, r, id)
+	case errors.Is(err, store.ErrEmailTaken), errors.Is(err, store.ErrUsernameTaken):
+		writeError(w, r, http.StatusConflict, codeConflict, err.Error())
+	case errors.Is(err, store.ErrVersionChanged):
+		writeError(w, r, http.StatusPreconditionFailed, codePreconditionFailed, err.Error())
+	case errors.As(err, &limited):
+		w.Header().Set("Retry-After", limited.retryAfter())
+		writeError(w, r, http.StatusTooManyRequests, codeDeletionLimitExceeded, err.Error())
+	default:
+		internalServerError(w, r, err)
+	}
+}
+
+//writeSaveError answers a failed create or update of a user with email like writeUserOpError. when the email belongs
+//to another user and the caller is an admin, the conflict says which user under meta.existing_user, so support can go
+//straight to it. everyone else gets the plain conflict, it shouldnt tell them more about other accounts.
+//the user is looked up after the write failed, when it was deleted in between the conflict is plain as well
+func (s *userService) writeSaveError(w http.ResponseWriter, r *http.Request, id int64, email string, err error) {
+	p, _ := principalFromContext(r.Context())
+	if !errors.Is(err, store.ErrEmailTaken) || p.Role != model.RoleAdmin {
+		writeUserOpError(w, r, id, err)
+		return
+	}
+	//the lookup is by lower(email), the unique index of the emails
+	found, lookupErr := s.store.List(r.Context(), store.Filter{Email: email, IncludeInactive: true, Limit: 1})
+	if lookupErr != nil {
+		loggerFrom(r.Context()).Warn("looking up the user with a taken email", "error", lookupErr)
+	}
+	if lookupErr != nil || len(found) == 0 {
+		writeUserOpError(w, r, id, err)
+		return
+	}
+	e := apiError{Code: codeConflict, Message: err.Error(), RequestId: requestid.FromContext(r.Context()),
+		Meta: &errorMeta{ExistingUser: &existingUserRef{Id: found[0].Id, PublicId: found[0].PublicId}}}
+	writeResponse(w, r, http.StatusConflict, errorEnvelope{Error: localizeError(w, r, e)})
+}
+
+//getUsers lists the users from the store, a page of them ordered by id, see parsePage
+func (s *userService) getUsers(w http.ResponseWriter, r *http.Request) {
+	//handles http request to get a alist of users from the store and send it back as a json response
+	p, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+	//deactivated users are only listed when asked for
+	f := store.Filter{IncludeInactive: r.URL.Query().Get("include_inactive") == "true", Limit: p.Limit, Offset: p.Offset}
+	//the phone to filter on can be written like on create, it is compared in E.164.
+	//a caller cant filter on what they dont see of other users, the filter would tell them
+	for _, field := range []string{"phone", "email"} {
+		if r.URL.Query().Get(field) != "" && !canSeeUserField(r.Context(), field) {
+			writeForbidden(w, r, "you cant filter users by their "+field)
+			return
+		}
+	}
+	if phone := r.URL.Query().Get("phone"); phone != "" {
+		normalized, err := model.NormalizePhone(phone)
+		if err != nil {
+			writeValidationError(w, r, model.FieldErrors{"phone": err.Error()})
+			return
+		}
+		f.Phone = normalized
+	}
+	//?email= finds the user with an address however it is capitalized, like login does
+	f.Email = strings.TrimSpace(r.URL.Query().Get("email"))
+	//?inactive_since=2025-01-01 finds the stale accounts. when users last logged in is for admins only
+	if since := r.URL.Query().Get("inactive_since"); since != "" {
+		if p, _ := principalFromContext(r.Context()); p.Role != model.RoleAdmin {
+			writeForbidden(w, r, "only admins can filter by the last login")
+			return
+		}
+		t, err := parseDateParam(since)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "inactive_since must be a date like 2025-01-01 or a time like 2025-01-01T12:00:00Z")
+			return
+		}
+		f.InactiveSince = t
+	}
+	//?sort=name, ?sort=-name for descending or ?sort=role,-updated_at, the store refuses what isnt made of store.SortKeys.
+	//the order of the users would tell what the caller doesnt see of them, like a filter
+	f.Sort = r.URL.Query().Get("sort")
+	for key := range strings.SplitSeq(f.Sort, ",") {
+		if field := strings.TrimPrefix(strings.TrimSpace(key), "-"); field != "" && !canSeeUserField(r.Context(), field) {
+			writeForbidden(w, r, "you cant sort users by their "+field)
+			return
+		}
+	}
+	//?snapshot=true reads the page and X-Total-Count from one snapshot of the users, so they agree with each other
+	//however long the page takes to stream. X-Snapshot-At says when it was taken
+	var lister userLister = s.store
+	streamer, canStream := s.store.(store.Streamer)
+	if r.URL.Query().Get("snapshot") == "true" {
+		ctx, cancel := context.WithTimeout(r.Context(), snapshotTimeout)
+		defer cancel()
+		snapshot, err := openSnapshot(ctx, s.store)
+		if errors.Is(err, errSnapshotUnsupported) {
+			writeError(w, r, http.StatusNotImplemented, codeNotConfigured, err.Error())
+			return
+		}
+		if err != nil {
+			internalServerError(w, r, err)
+			return
+		}
+		//rolls the transaction back however the handler ends, a client that went away cancelled ctx already
+		defer snapshot.Close()
+		lister, streamer, canStream = snapshot, snapshot, true
+		setSnapshotAt(w, snapshot.At())
+	}
+	//pages bigger than the default one are streamed, the smaller ones are encoded as a whole, which gives them an etag
+	//and a last modified date and lets them be answered with 304. only plain json is streamed
+	if canStream && p.Limit > defaultPageSize && negotiateFormat(r) == formatJSON {
+		s.streamUsers(w, r, lister, streamer, f, p)
+		return
+	}
+	users, err := lister.List(r.Context(), f)
+	if errors.Is(err, store.ErrInvalidSort) {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	total, err := lister.Count(r.Context(), f)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	setPageLinks(w, r, p, total)
+	//encodes users slice as json (or xml if the client asked for it) and write it to the response.
+	//json encoder: convert go data structures to json. json decoder: convert json data to go data structures
+	//writeResponse picks the encoder from the accept header and writes to w. w is a http.responsewriter, a type of net/http package that allows u to construct a http response
+	//model.UserList wraps the slice so xml clients get a <users> root element
+	//the list as a whole was last modified when its most recently updated user was
+	//note that a delete doesnt move this forward, clients that need to notice deletes should use the etag
+	var lastModified time.Time
+	for _, u := range users {
+		if u.UpdatedAt.After(lastModified) {
+			lastModified = u.UpdatedAt
+		}
+	}
+	//the etag is of the list as the caller sees it, callers who see different fields of the same users dont share it
+	if checkNotModified(w, r, listETag(visibleUsers(r, users)), lastModified) {
+		return
+	}
+	writeResponse(w, r, http.StatusOK, model.UserList{Users: users})
+}
+
+//parseDateParam reads a query parameter that is a date, midnight utc, or a time in rfc 3339
+func parseDateParam(v string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+func (s *userService) createUser(w http.ResponseWriter, r *http.Request) {
+	var u model.User
+	//r.body: body of the http request, contians data sent by client
+	//&u: decoded data is stored in the address of u
+	//&: address operator, used to get memory address of a variable. because u need to provide a pointer to the struct so that the decoder can directly modify the original struct
+	//a body that isnt valid json is rejected with 400 instead of inserting a user with empty fields
+	if err := decodeRequest(r, &u); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	//trims and lowercases the input, then rejects anything we shouldnt store
+	if errs := u.Validate(); errs != nil {
+		writeValidationError(w, r, errs)
+		return
+	}
+
+	created, err := s.create(r.Context(), u)
+	if err != nil {
+		s.writeSaveError(w, r, 0, u.Email, err)
+		return
+	}
+	//201 created with a location header pointing at the new resource
+	w.Header().Set("Location", userLocation(r, created))
+	w.Header().Set("ETag", userETag(created))
+	writeResponse(w, r, http.StatusCreated, created)
+}
+
+func (s *userService) getUser(w http.ResponseWriter, r *http.Request) {
+	//extract id
+	id := userIdVar(r)
+
+	u, err := s.store.Get(r.Context(), id)
+	if err != nil {
+		//404 only when the user doesnt exist. a database that cant be reached is a 500, the client shouldnt think the user was deleted
+		writeUserOpError(w, r, id, err)
+		return
+	}
+	//?include=addresses embeds the addresses and ?include=preferences the notification preferences, which only admins
+	//and the user themself may see. they change without the user's version, so the etag doesnt cover them and such a
+	//response is never a 304
+	include := strings.Split(r.URL.Query().Get("include"), ",")
+	withAddresses, withPrefs := slices.Contains(include, "addresses"), slices.Contains(include, "preferences")
+	if (withAddresses || withPrefs) && s.db != nil {
+		if p, _ := principalFromContext(r.Context()); !p.isAdminOrSelf(id) {
+			writeForbidden(w, r, "you can only see the addresses and preferences of your own account")
+			return
+		}
+		if withAddresses {
+			if u.Addresses, err = listAddresses(r.Context(), s.db, id); err != nil {
+				internalServerError(w, r, err)
+				return
+			}
+		}
+		if withPrefs {
+			prefs, err := loadPrefs(r.Context(), s.db, id)
+			if err != nil {
+				writeUserOpError(w, r, id, err)
+				return
+			}
+			u.Preferences = &prefs
+		}
+		w.Header().Set("ETag", userETag(u))
+		writeResponse(w, r, http.StatusOK, u)
+		return
+	}
+	//the etag lets clients make their next write conditional with if-match
+	//and lets pollers skip the download with if-none-match when nothing changed
+	if checkNotModified(w, r, userETag(u), u.UpdatedAt) {
+		return
+	}
+	writeResponse(w, r, http.StatusOK, u)
+}
+
+func (s *userService) updateUser(w http.ResponseWriter, r *http.Request) {
+	var u model.User
+	if err := decodeRequest(r, &u); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	//trims and lowercases the input, then rejects anything we shouldnt store
+	errs := u.Validate()
+	if u.Password != "" {
+		//changing the password needs the current one, which this endpoint doesnt take
+		if errs == nil {
+			errs = model.FieldErrors{}
+		}
+		errs["password"] = "cannot be changed here, use PUT /api/v1/users/{id}/password"
+	}
+	if errs != nil {
+		writeValidationError(w, r, errs)
+		return
+	}
+
+	//retrieve id
+	id := userIdVar(r)
+
+	//nobody but an admin may change a role, so members cant promote themselves
+	if p, _ := principalFromContext(r.Context()); u.Role != "" && p.Role != model.RoleAdmin {
+		writeForbidden(w, r, "only admins can change roles")
+		return
+	}
+
+	//?create=true makes the put an upsert, for sync jobs that mirror users from another system with their ids
+	if r.URL.Query().Get("create") == "true" {
+		s.upsertUser(w, r, id, u)
+		return
+	}
+	s.saveUser(w, r, id, u)
+}
+
+//upsertUser creates the user with the given id or updates it, answering 201 or 200.
+//it is unconditional, REQUIRE_IF_MATCH doesnt apply: a user that doesnt exist yet has no etag to match
+func (s *userService) upsertUser(w http.ResponseWriter, r *http.Request, id int64, u model.User) {
+	if r.Header.Get("If-Match") != "" {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "If-Match cannot be combined with create=true")
+		return
+	}
+	saved, created, err := s.upsert(r.Context(), id, u)
+	if errors.Is(err, errUpsertUnsupported) {
+		writeError(w, r, http.StatusNotImplemented, codeNotConfigured, err.Error())
+		return
+	}
+	if err != nil {
+		s.writeSaveError(w, r, id, u.Email, err)
+		return
+	}
+	w.Header().Set("ETag", userETag(saved))
+	if created {
+		w.Header().Set("Location", userLocation(r, saved))
+		writeResponse(w, r, http.StatusCreated, saved)
+		return
+	}
+	writeResponse(w, r, http.StatusOK, saved)
+}
+
+//saveUser writes the validated fields of u to the user with the given id and responds with the updated user
+//shared by updateUser and updateMe
+func (s *userService) saveUser(w http.ResponseWriter, r *http.Request, id int64, u model.User) {
+	//if-match makes the update conditional on the version the client last saw
+	match := parseIfMatch(r)
+	if !checkIfMatchRequired(w, r, match) {
+		return
+	}
+	updatedUser, err := s.update(r.Context(), id, u, match)
+	if err != nil {
+		s.writeSaveError(w, r, id, u.Email, err)
+		return
+	}
+	w.Header().Set("ETag", userETag(updatedUser))
+	writeResponse(w, r, http.StatusOK, updatedUser)
+}
+
+func (s *userService) deleteUser(w http.ResponseWriter, r *http.Request) {
+	//retrieve id
+	id := userIdVar(r)
+
+	match := parseIfMatch(r)
+	if !checkIfMatchRequired(w, r, match) {
+		return
+	}
+	//?dry_run=true goes through the whole delete and rolls it back, the answer is the user that would be deleted
+	if r.URL.Query().Get("dry_run") == "true" {
+		deleted, err := s.remove(store.WithDryRun(r.Context()), id, match)
+		if err != nil {
+			writeUserOpError(w, r, id, err)
+			return
+		}
+		writeResponse(w, r, http.StatusOK, dryRunDeletion{DryRun: true, User: deleted})
+		return
+	}
+	if _, err := s.remove(r.Context(), id, match); err != nil {
+		writeUserOpError(w, r, id, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,538 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+func TestUserCRUD(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+
+	res := ts.do("POST", "/api/v1/users", admin, map[string]any{"name": "Grace Hopper", "email": "Grace@Example.com", "password": "password123"})
+	expect(t, res, http.StatusCreated)
+	var created model.User
+	res.decode(t, &created)
+	if created.Id == 0 || created.Name != "Grace Hopper" || created.Email != "grace@example.com" || created.Role != model.RoleMember || !created.Active {
+		t.Fatalf("created %s", res.body)
+	}
+	if !strings.HasSuffix(res.Header.Get("Location"), userPath(created.Id)) || res.Header.Get("ETag") == "" {
+		t.Fatalf("create answered Location %q and ETag %q", res.Header.Get("Location"), res.Header.Get("ETag"))
+	}
+	//the password never comes back
+	if strings.Contains(string(res.body), "password") {
+		t.Fatalf("create answered the password: %s", res.body)
+	}
+
+	res = ts.do("GET", userPath(created.Id), admin, nil)
+	expect(t, res, http.StatusOK)
+	var got model.User
+	res.decode(t, &got)
+	if got.Id != created.Id || got.Email != created.Email || got.Uuid != created.Uuid {
+		t.Fatalf("got %s", res.body)
+	}
+
+	res = ts.do("GET", "/api/v1/users", admin, nil)
+	expect(t, res, http.StatusOK)
+	var listed []model.User
+	res.decode(t, &listed)
+	if len(listed) != 2 || listed[1].Id != created.Id {
+		t.Fatalf("listed %s", res.body)
+	}
+
+	res = ts.do("PUT", userPath(created.Id), admin, map[string]any{"name": "Rear Admiral Hopper", "email": "grace@example.com", "role": model.RoleAdmin})
+	expect(t, res, http.StatusOK)
+	var updated model.User
+	res.decode(t, &updated)
+	if updated.Name != "Rear Admiral Hopper" || updated.Role != model.RoleAdmin || updated.Email != "grace@example.com" {
+		t.Fatalf("updated to %s", res.body)
+	}
+
+	expect(t, ts.do("DELETE", userPath(created.Id), admin, nil), http.StatusNoContent)
+	expect(t, ts.do("GET", userPath(created.Id), admin, nil), http.StatusNotFound)
+	expect(t, ts.do("DELETE", userPath(created.Id), admin, nil), http.StatusNotFound)
+	expect(t, ts.do("PUT", userPath(created.Id), admin, map[string]any{"name": "Ghost", "email": "ghost@example.com"}), http.StatusNotFound)
+}
+
+func TestUserCRUDValidation(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+
+	res := ts.do("POST", "/api/v1/users", admin, map[string]any{"name": "", "email": "not-an-email", "password": "password123"})
+	expect(t, res, http.StatusUnprocessableEntity)
+	var e struct {
+		Error struct {
+			Code   string            `json:"code"`
+			Fields map[string]string `json:"fields"`
+		} `json:"error"`
+	}
+	res.decode(t, &e)
+	if e.Error.Code != codeValidationFailed || e.Error.Fields["name"] == "" || e.Error.Fields["email"] == "" {
+		t.Fatalf("invalid user answered %s", res.body)
+	}
+
+	expect(t, ts.do("POST", "/api/v1/users", admin, `{"name": "Broken"`), http.StatusBadRequest)
+	expect(t, ts.do("POST", "/api/v1/users", admin, map[string]any{"name": "Ada", "email": "ada@example.com", "password": "password123", "admin": true}), http.StatusBadRequest)
+
+	body := map[string]any{"name": "Ada", "email": "ada@example.com", "password": "password123"}
+	expect(t, ts.do("POST", "/api/v1/users", admin, body), http.StatusCreated)
+	res = ts.do("POST", "/api/v1/users", admin, body)
+	expect(t, res, http.StatusConflict)
+	if res.errorCode() != codeConflict {
+		t.Fatalf("duplicate email answered %s", res.body)
+	}
+	if n := ts.count("users", ""); n != 2 {
+		t.Fatalf("%d users after the refused creates", n)
+	}
+}
+
+func TestUserCRUDAuthorization(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.admin()
+	m, member := ts.member()
+
+	expect(t, ts.do("GET", "/api/v1/users", "", nil), http.StatusUnauthorized)
+	expect(t, ts.do("GET", "/api/v1/users", "not-a-token", nil), http.StatusUnauthorized)
+	//members read, only admins write
+	expect(t, ts.do("GET", "/api/v1/users", member, nil), http.StatusOK)
+	expect(t, ts.do("GET", userPath(m.Id), member, nil), http.StatusOK)
+	expect(t, ts.do("POST", "/api/v1/users", member, map[string]any{"name": "Eve", "email": "eve@example.com", "password": "password123"}), http.StatusForbidden)
+	expect(t, ts.do("PUT", userPath(m.Id), member, map[string]any{"name": "Admin", "email": m.Email, "role": model.RoleAdmin}), http.StatusForbidden)
+	expect(t, ts.do("DELETE", userPath(m.Id), member, nil), http.StatusForbidden)
+	if n := ts.count("users", "role = $1", model.RoleAdmin); n != 1 {
+		t.Fatalf("%d admins", n)
+	}
+}
+
+func TestDeleteUserDryRun(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	u := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+	before := ts.rowCounts("users", "audit_events", "user_changes", "outbox", "jobs")
+
+	res := ts.do("DELETE", userPath(u.Id)+"?dry_run=true", admin, nil)
+	expect(t, res, http.StatusOK)
+	var answer dryRunDeletion
+	res.decode(t, &answer)
+	if !answer.DryRun || answer.User.Id != u.Id || answer.User.Email != u.Email {
+		t.Fatalf("dry run answered %s", res.body)
+	}
+	//a stale If-Match is refused like it is without the dry run
+	expect(t, ts.do("DELETE", userPath(u.Id)+"?dry_run=true", admin, nil, "If-Match", `"999"`), http.StatusPreconditionFailed)
+
+	if after := ts.rowCounts("users", "audit_events", "user_changes", "outbox", "jobs"); !maps.Equal(after, before) {
+		t.Fatalf("rows before the dry run %v, after %v", before, after)
+	}
+	got, err := ts.users.Get(t.Context(), int64(u.Id))
+	if err != nil || got.Version != u.Version {
+		t.Fatalf("after the dry run got %+v, %v", got, err)
+	}
+	expect(t, ts.do("DELETE", userPath(u.Id), admin, nil), http.StatusNoContent)
+}
+
+//conflictMeta is the error of a 409 with its meta
+type conflictMeta struct {
+	Error struct {
+		Code string `json:"code"`
+		Meta *struct {
+			ExistingUser *existingUserRef `json:"existing_user"`
+		} `json:"meta"`
+	} `json:"error"`
+}
+
+func TestConflictNamesExistingUserToAdmins(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	ts.createUser("Someone", "someone@example.com", model.RoleMember)
+	ada := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+	grace := ts.createUser("Grace", "grace@example.com", model.RoleMember)
+
+	for _, res := range []testResponse{
+		ts.do("POST", "/api/v1/users", admin, map[string]any{"name": "Ada", "email": "ADA@example.com", "password": "password123"}),
+		ts.do("PUT", userPath(grace.Id), admin, map[string]any{"name": "Grace", "email": "ada@example.com"}),
+	} {
+		expect(t, res, http.StatusConflict)
+		var e conflictMeta
+		res.decode(t, &e)
+		if e.Error.Code != codeConflict || e.Error.Meta == nil || e.Error.Meta.ExistingUser == nil {
+			t.Fatalf("%s %s answered %s", res.Request.Method, res.Request.URL.Path, res.body)
+		}
+		if ref := e.Error.Meta.ExistingUser; ref.Id != ada.Id || ref.PublicId != ada.PublicId {
+			t.Fatalf("%s %s named %+v, the email is %d's", res.Request.Method, res.Request.URL.Path, ref, ada.Id)
+		}
+	}
+}
+
+func TestConflictIsGenericForMembers(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.admin()
+	_, member := ts.member()
+	res := ts.do("PUT", "/api/v1/me", member, map[string]any{"name": "Member", "email": "admin@example.com"})
+	expect(t, res, http.StatusConflict)
+	var e conflictMeta
+	res.decode(t, &e)
+	if e.Error.Code != codeConflict || e.Error.Meta != nil || strings.Contains(string(res.body), "existing_user") {
+		t.Fatalf("a member's conflict answered %s", res.body)
+	}
+}
+
+//deletingStore deletes the user that has the email of a create right after the create failed on it, like a concurrent
+//delete between the unique violation and the lookup of the conflict
+type deletingStore struct {
+	store.UserStore
+}
+
+func (s deletingStore) Create(ctx context.Context, u model.User, passwordHash string) (model.User, error) {
+	created, err := s.UserStore.Create(ctx, u, passwordHash)
+	if errors.Is(err, store.ErrEmailTaken) {
+		found, listErr := s.UserStore.List(ctx, store.Filter{Email: u.Email, IncludeInactive: true})
+		if listErr != nil || len(found) != 1 {
+			return model.User{}, fmt.Errorf("looking up the conflict: %d users, %v", len(found), listErr)
+		}
+		if _, err := s.UserStore.Delete(ctx, int64(found[0].Id), nil); err != nil {
+			return model.User{}, err
+		}
+	}
+	return created, err
+}
+
+func TestConflictWithUserDeletedSince(t *testing.T) {
+	memory := store.NewMemory()
+	if _, err := memory.Create(context.Background(), model.User{Name: "Ada", Email: "ada@example.com"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	s := &userService{store: deletingStore{memory}, events: newMemoryBroker(slog.New(slog.DiscardHandler))}
+	r := httptest.NewRequest("POST", "/api/v1/users", strings.NewReader(`{"name": "Ada", "email": "ada@example.com", "password": "password123"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r = r.WithContext(context.WithValue(r.Context(), principalKey, principal{UserId: 1, Role: model.RoleAdmin}))
+	w := httptest.NewRecorder()
+	s.createUser(w, r)
+
+	res := testResponse{Response: w.Result(), body: w.Body.Bytes()}
+	if res.StatusCode != http.StatusConflict {
+		t.Fatalf("got %d: %s", res.StatusCode, res.body)
+	}
+	var e conflictMeta
+	res.decode(t, &e)
+	if e.Error.Code != codeConflict || e.Error.Meta != nil {
+		t.Fatalf("the conflict with a deleted user answered %s", res.body)
+	}
+}
+
+func TestCreateUserAnswersCreated(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+
+	res := ts.do("POST", "/api/v1/users", admin, map[string]any{"name": "Ada", "email": "ada@example.com", "password": "password123"})
+	expect(t, res, http.StatusCreated)
+	var created model.User
+	res.decode(t, &created)
+	if created.Id == 0 {
+		t.Fatalf("created %s", res.body)
+	}
+	//the location is where the new user is
+	location, err := res.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = ts.do("GET", location.Path, admin, nil)
+	expect(t, res, http.StatusOK)
+	var got model.User
+	res.decode(t, &got)
+	if got.Id != created.Id {
+		t.Fatalf("the location %s is %s", location, res.body)
+	}
+
+	//a body that isnt json creates nobody
+	for _, body := range []string{"not json", ""} {
+		res = ts.do("POST", "/api/v1/users", admin, body)
+		expect(t, res, http.StatusBadRequest)
+		if res.errorCode() != codeInvalidRequest || res.Header.Get("Location") != "" {
+			t.Fatalf("%q answered %s", body, res.body)
+		}
+	}
+	if n := ts.count("users", ""); n != 2 {
+		t.Fatalf("%d users after the refused creates", n)
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	u := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+
+	res := ts.do("PUT", userPath(u.Id), admin, map[string]any{"name": "Ada Lovelace", "email": "ada@example.com"})
+	expect(t, res, http.StatusOK)
+	var updated model.User
+	res.decode(t, &updated)
+	if updated.Id != u.Id || updated.Name != "Ada Lovelace" || updated.Email != "ada@example.com" {
+		t.Fatalf("updated to %s", res.body)
+	}
+	if n := ts.count("users", "id = $1 AND name = 'Ada Lovelace' AND email = 'ada@example.com'", u.Id); n != 1 {
+		t.Fatal("the update wasnt stored")
+	}
+
+	res = ts.do("PUT", userPath(u.Id+1000), admin, map[string]any{"name": "Ghost", "email": "ghost@example.com"})
+	expect(t, res, http.StatusNotFound)
+	if res.errorCode() != codeUserNotFound {
+		t.Fatalf("updating a missing user answered %s", res.body)
+	}
+
+	//the database fails the update
+	if _, err := ts.db.Exec("CREATE TRIGGER refuse_updates BEFORE UPDATE ON users BEGIN SELECT RAISE(ABORT, 'disk I/O error'); END"); err != nil {
+		t.Fatal(err)
+	}
+	res = ts.do("PUT", userPath(u.Id), admin, map[string]any{"name": "Countess", "email": "ada@example.com"})
+	expect(t, res, http.StatusInternalServerError)
+	if res.errorCode() != codeInternalError || strings.Contains(string(res.body), "disk I/O") {
+		t.Fatalf("the failed update answered %s", res.body)
+	}
+	if _, err := ts.db.Exec("DROP TRIGGER refuse_updates"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, ts.do("PUT", userPath(u.Id), admin, map[string]any{"name": "Countess", "email": "ada@example.com"}), http.StatusOK)
+}
+
+//failingStore fails every read and write like a database that went away
+type failingStore struct {
+	store.UserStore
+}
+
+var errDatabaseDown = errors.New("dial tcp 10.0.0.5:5432: connection refused")
+
+func (failingStore) List(context.Context, store.Filter) ([]model.User, error) {
+	return nil, errDatabaseDown
+}
+func (failingStore) Count(context.Context, store.Filter) (int, error) { return 0, errDatabaseDown }
+func (failingStore) Create(context.Context, model.User, string) (model.User, error) {
+	return model.User{}, errDatabaseDown
+}
+func (failingStore) Update(context.Context, int64, store.Update) (model.User, error) {
+	return model.User{}, errDatabaseDown
+}
+func (failingStore) Get(context.Context, int64) (model.User, error) {
+	return model.User{}, errDatabaseDown
+}
+func (failingStore) Delete(context.Context, int64, *store.Match) (model.User, error) {
+	return model.User{}, errDatabaseDown
+}
+
+//TestDatabaseErrorsAnswer500 sends the handlers to a store that fails, they answer 500 without the error and the
+//handler keeps serving
+func TestDatabaseErrorsAnswer500(t *testing.T) {
+	s := &userService{store: failingStore{store.NewMemory()}, events: newMemoryBroker(slog.New(slog.DiscardHandler))}
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/users", s.getUsers).Methods("GET")
+	router.HandleFunc("/api/v1/users", s.createUser).Methods("POST")
+	router.HandleFunc("/api/v1/users/{id}", s.updateUser).Methods("PUT")
+
+	for range 2 {
+		for _, req := range []struct{ method, path, body string }{
+			{"GET", "/api/v1/users", ""},
+			{"POST", "/api/v1/users", `{"name": "Ada", "email": "ada@example.com", "password": "password123"}`},
+			{"PUT", "/api/v1/users/1", `{"name": "Ada", "email": "ada@example.com"}`},
+		} {
+			r := httptest.NewRequest(req.method, req.path, strings.NewReader(req.body))
+			r = r.WithContext(context.WithValue(r.Context(), principalKey, principal{UserId: 1, Role: model.RoleAdmin}))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			res := testResponse{Response: w.Result(), body: w.Body.Bytes()}
+			if res.StatusCode != http.StatusInternalServerError || res.errorCode() != codeInternalError {
+				t.Fatalf("%s %s: got %d: %s", req.method, req.path, res.StatusCode, res.body)
+			}
+			if strings.Contains(string(res.body), "connection refused") {
+				t.Fatalf("%s %s told the client the error: %s", req.method, req.path, res.body)
+			}
+		}
+	}
+}
+
+//TestMissingUserIsntADatabaseError tells a user that doesnt exist, a 404, from a database that fails, a 500 that
+//doesnt tell the client why
+func TestMissingUserIsntADatabaseError(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		store  store.UserStore
+		status int
+		code   string
+	}{
+		{"missing user", store.NewMemory(), http.StatusNotFound, codeUserNotFound},
+		{"failing database", failingStore{store.NewMemory()}, http.StatusInternalServerError, codeInternalError},
+	} {
+		s := &userService{store: tc.store, events: newMemoryBroker(slog.New(slog.DiscardHandler))}
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/users/{id}", s.getUser).Methods("GET")
+		router.HandleFunc("/api/v1/users/{id}", s.deleteUser).Methods("DELETE")
+		for _, method := range []string{"GET", "DELETE"} {
+			r := httptest.NewRequest(method, "/api/v1/users/42", nil)
+			r = r.WithContext(context.WithValue(r.Context(), principalKey, principal{UserId: 1, Role: model.RoleAdmin}))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			res := testResponse{Response: w.Result(), body: w.Body.Bytes()}
+			if res.StatusCode != tc.status || res.errorCode() != tc.code || strings.Contains(string(res.body), "connection refused") {
+				t.Fatalf("%s: %s answered %d: %s", tc.name, method, res.StatusCode, res.body)
+			}
+		}
+	}
+}
+
+//TestFailingLookupIsA500 fails the queries of a real database instead of the store
+func TestFailingLookupIsA500(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	u := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+
+	if _, err := ts.db.Exec("CREATE TRIGGER refuse_deletes BEFORE DELETE ON users BEGIN SELECT RAISE(ABORT, 'disk I/O error'); END"); err != nil {
+		t.Fatal(err)
+	}
+	res := ts.do("DELETE", userPath(u.Id), admin, nil)
+	expect(t, res, http.StatusInternalServerError)
+	if strings.Contains(string(res.body), "disk I/O") {
+		t.Fatalf("the failed delete told the client %s", res.body)
+	}
+	expect(t, ts.do("GET", userPath(u.Id), admin, nil), http.StatusOK)
+	expect(t, ts.do("DELETE", userPath(u.Id+1000), admin, nil), http.StatusNotFound)
+}
+
+func TestUserPhone(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+
+	res := ts.do("POST", "/api/v1/users", admin, map[string]any{"name": "Ada", "email": "ada@example.com", "phone": "+41 44-668 18 00"})
+	expect(t, res, http.StatusCreated)
+	var ada model.User
+	res.decode(t, &ada)
+	if ada.Phone == nil || *ada.Phone != "+41446681800" {
+		t.Fatalf("created %s", res.body)
+	}
+	//without a phone it is null, not empty
+	res = ts.do("POST", "/api/v1/users", admin, map[string]any{"name": "Grace", "email": "grace@example.com"})
+	expect(t, res, http.StatusCreated)
+	if !strings.Contains(string(res.body), `"phone":null`) {
+		t.Fatalf("created %s", res.body)
+	}
+	if n := ts.count("users", "email = 'grace@example.com' AND phone IS NULL"); n != 1 {
+		t.Fatal("the missing phone wasnt stored as null")
+	}
+
+	res = ts.do("POST", "/api/v1/users", admin, map[string]any{"name": "Hedy", "email": "hedy@example.com", "phone": "044 668 18 00"})
+	expect(t, res, http.StatusUnprocessableEntity)
+	var e struct {
+		Error struct {
+			Fields map[string]string `json:"fields"`
+		} `json:"error"`
+	}
+	res.decode(t, &e)
+	if e.Error.Fields["phone"] == "" {
+		t.Fatalf("an invalid phone answered %s", res.body)
+	}
+
+	//the filter takes the number however it is written
+	res = ts.do("GET", "/api/v1/users?phone="+url.QueryEscape("+41 44 668 18 00"), admin, nil)
+	expect(t, res, http.StatusOK)
+	var found []model.User
+	res.decode(t, &found)
+	if len(found) != 1 || found[0].Id != ada.Id {
+		t.Fatalf("the phone filter found %s", res.body)
+	}
+	expect(t, ts.do("GET", "/api/v1/users?phone=0446681800", admin, nil), http.StatusUnprocessableEntity)
+}
+
+func TestEmailsIgnoreCase(t *testing.T) {
+	eachDatabase(t, nil, func(t *testing.T, ts *testServer) {
+		admin := ts.admin()
+		res := ts.do("POST", "/api/v1/users", admin, map[string]any{"name": "Bob", "email": "Bob@Example.com", "password": "password123"})
+		expect(t, res, http.StatusCreated)
+		var bob model.User
+		res.decode(t, &bob)
+		if bob.Email != "bob@example.com" {
+			t.Fatalf("stored %q", bob.Email)
+		}
+		res = ts.do("POST", "/api/v1/users", admin, map[string]any{"name": "Bob", "email": "BOB@example.com", "password": "password123"})
+		if res.StatusCode != http.StatusConflict || res.errorCode() != codeConflict {
+			t.Fatalf("the same address in other case answered %d: %s", res.StatusCode, res.body)
+		}
+
+		//a mixed case login finds the normalized account
+		expect(t, ts.do("POST", "/api/v1/login", "", map[string]any{"email": "BoB@EXAMPLE.com", "password": "password123"}), http.StatusOK)
+		expect(t, ts.do("POST", "/api/v1/login", "", map[string]any{"email": "BoB@EXAMPLE.com", "password": "wrong-password"}), http.StatusUnauthorized)
+
+		res = ts.do("GET", "/api/v1/users?email="+url.QueryEscape("BOB@Example.COM"), admin, nil)
+		expect(t, res, http.StatusOK)
+		var found []model.User
+		res.decode(t, &found)
+		if len(found) != 1 || found[0].Id != bob.Id {
+			t.Fatalf("the email filter found %s", res.body)
+		}
+		//the whole address, not a part of it
+		res = ts.do("GET", "/api/v1/users?email=bob", admin, nil)
+		expect(t, res, http.StatusOK)
+		found = nil
+		res.decode(t, &found)
+		if len(found) != 0 {
+			t.Fatalf("a part of the address found %s", res.body)
+		}
+	})
+}
+
+func TestCaseInsensitiveEmailsMigration(t *testing.T) {
+	ts := newTestServer(t, nil)
+	u := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+	//a row from before the normalization
+	if _, err := ts.db.Exec("UPDATE users SET email = 'Ada@Example.COM', pending_email = 'Countess@Example.COM' WHERE id = $1", u.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.db.Exec("DELETE FROM schema_migrations WHERE name = 'case_insensitive_emails'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyMigrations(t.Context(), ts.db, dbDriverSQLite, testLogger(t)); err != nil {
+		t.Fatal(err)
+	}
+	if n := ts.count("users", "id = $1 AND email = 'ada@example.com' AND pending_email = 'countess@example.com'", u.Id); n != 1 {
+		t.Fatal("the migration didnt lowercase the stored addresses")
+	}
+	expect(t, ts.do("POST", "/api/v1/login", "", map[string]any{"email": "ADA@example.com", "password": "password123"}), http.StatusOK)
+}
+
+func TestHostileListParameters(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	ts.createUser("Ada", "ada@example.com", model.RoleMember)
+
+	for _, sort := range []string{"name;DROP TABLE users", "name DESC", "password_hash", "(SELECT 1)"} {
+		res := ts.do("GET", "/api/v1/users?sort="+url.QueryEscape(sort), admin, nil)
+		if res.StatusCode != http.StatusBadRequest || res.errorCode() != codeInvalidRequest {
+			t.Fatalf("sort %q answered %d: %s", sort, res.StatusCode, res.body)
+		}
+	}
+	//the values of the filters are bound, they match nothing instead of changing the query
+	for _, path := range []string{
+		"/api/v1/users?email=" + url.QueryEscape("x' OR 1=1 --"),
+		"/api/v1/users/search?q=" + url.QueryEscape("' OR '1'='1"),
+	} {
+		res := ts.do("GET", path, admin, nil)
+		if res.StatusCode == http.StatusOK && strings.Contains(string(res.body), "ada@example.com") {
+			t.Fatalf("%s found %s", path, res.body)
+		}
+	}
+	if n := ts.count("users", "1 = 1"); n != 2 {
+		t.Fatalf("%d users are left", n)
+	}
+	res := ts.do("GET", "/api/v1/users?sort=-name,role", admin, nil)
+	expect(t, res, http.StatusOK)
+}
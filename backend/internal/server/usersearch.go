@@ -0,0 +1,60 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//errSearchUnsupported is a search on a store that cant rank users, all the stores of internal/store can
+var errSearchUnsupported = errors.New("searching users isnt supported by this user store")
+
+//searchUsers answers GET /users/search?q= for the search box of the admin dashboard: the users whose name or email
+//contain q, best matches first and each with its score, see store.Searcher. an exact email comes before the names and
+//emails starting with q, and those before the rest. ?include_inactive= and ?role= narrow it down, the pages work like
+//the ones of GET /users
+func (s *userService) searchUsers(w http.ResponseWriter, r *http.Request) {
+	p, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	f := store.Filter{IncludeInactive: query.Get("include_inactive") == "true", Role: query.Get("role"),
+		Search: strings.TrimSpace(query.Get("q")), Limit: p.Limit, Offset: p.Offset}
+	errs := model.FieldErrors{}
+	if f.Search == "" {
+		errs["q"] = "is required"
+	}
+	if f.Role != "" && !model.ValidRole(f.Role) {
+		errs["role"] = "must be one of admin, member"
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, r, errs)
+		return
+	}
+
+	searcher, ok := s.store.(store.Searcher)
+	if !ok {
+		writeError(w, r, http.StatusNotImplemented, codeNotConfigured, errSearchUnsupported.Error())
+		return
+	}
+	users, err := searcher.Search(r.Context(), f)
+	if errors.Is(err, errSearchUnsupported) {
+		writeError(w, r, http.StatusNotImplemented, codeNotConfigured, err.Error())
+		return
+	}
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	total, err := s.store.Count(r.Context(), f)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	setPageLinks(w, r, p, total)
+	writeResponse(w, r, http.StatusOK, model.ScoredUserList{Users: users})
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"api/internal/model"
+)
+
+func TestSearchUsers(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	carol := ts.createUser("Carol", "carol@alice.example", model.RoleAdmin)
+	alice := ts.createUser("Alice Smith", "alice@example.com", model.RoleMember)
+	mary := ts.createUser("Mary Alice", "mary@example.com", model.RoleMember)
+
+	type scored struct {
+		model.User
+		Score int `json:"score"`
+	}
+	search := func(query string) ([]scored, testResponse) {
+		t.Helper()
+		res := ts.do("GET", "/api/v1/users/search?"+query, admin, nil)
+		expect(t, res, http.StatusOK)
+		var found []scored
+		res.decode(t, &found)
+		return found, res
+	}
+
+	found, res := search("q=alice")
+	if len(found) != 3 || found[0].Id != alice.Id || found[1].Id != mary.Id || found[2].Id != carol.Id ||
+		found[0].Score != 2 || found[1].Score != 2 || found[2].Score != 1 {
+		t.Fatalf("q=alice found %s", res.body)
+	}
+	if res.Header.Get("X-Total-Count") != "3" {
+		t.Fatalf("X-Total-Count %q", res.Header.Get("X-Total-Count"))
+	}
+	//pages and the filters work like on GET /users
+	found, res = search("q=alice&limit=1&offset=1")
+	if len(found) != 1 || found[0].Id != mary.Id || res.Header.Get("X-Total-Count") != "3" {
+		t.Fatalf("the second page is %s", res.body)
+	}
+	found, res = search("q=alice&role=admin")
+	if len(found) != 1 || found[0].Id != carol.Id {
+		t.Fatalf("the admins are %s", res.body)
+	}
+
+	for _, query := range []string{"", "q=+", "q=alice&role=root"} {
+		res := ts.do("GET", "/api/v1/users/search?"+query, admin, nil)
+		if res.StatusCode != http.StatusUnprocessableEntity || res.errorCode() != codeValidationFailed {
+			t.Fatalf("%q answered %d: %s", query, res.StatusCode, res.body)
+		}
+	}
+}
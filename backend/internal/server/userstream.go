@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"iter"
+	"net/http"
+
+	"api/internal/store"
+)
+
+//streamFlushEvery is how many users a streamed list writes between flushes, so the client gets them while the rest
+//is still being read instead of whenever the buffers on the way happen to fill up
+const streamFlushEvery = 500
+
+//streamUsers writes a page of GET /users as a json array while it is read from the store, so memory stays flat however
+//big the page is. the first user is read before anything is written, so a sort that doesnt exist or a query that fails
+//right away still get an error response. a failure after that cant change the status anymore: it is logged with the
+//request id and the connection is closed without the closing bracket, the client sees a broken body instead of a list
+//that only looks complete. streamed pages have no ETag and no Last-Modified, they would need the whole list up front.
+//the total is counted with lister, the snapshot of the stream when there is one
+func (s *userService) streamUsers(w http.ResponseWriter, r *http.Request, lister userLister, streamer store.Streamer, f store.Filter, p page) {
+	next, stop := iter.Pull2(streamer.Stream(r.Context(), f))
+	defer stop()
+	u, err, ok := next()
+	if errors.Is(err, store.ErrInvalidSort) {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	total, err := lister.Count(r.Context(), f)
+	if err != nil {
+		internalServerError(w, r, err)
+		return
+	}
+	setPageLinks(w, r, p, total)
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(http.StatusOK)
+
+	//the same bytes newJSONEncoder writes for the whole slice, one element at a time
+	pretty := wantsPretty(r)
+	separator, end := ",", "]\n"
+	if pretty {
+		separator, end = ",\n  ", "\n]\n"
+	}
+	rc := http.NewResponseController(w)
+	written := 0
+	for ; ok; u, err, ok = next() {
+		if err != nil {
+			if errors.Is(r.Context().Err(), context.Canceled) {
+				loggerFrom(r.Context()).Debug("client went away", "error", err)
+				return
+			}
+			loggerFrom(r.Context()).Error("streaming users failed, closing the connection", "error", err, "written", written)
+			panic(http.ErrAbortHandler)
+		}
+		u = forCaller(r, u)
+		var encoded []byte
+		if pretty {
+			encoded, err = json.MarshalIndent(u, "  ", "  ")
+		} else {
+			encoded, err = json.Marshal(u)
+		}
+		if err != nil {
+			loggerFrom(r.Context()).Error("encoding streamed user, closing the connection", "error", err, "written", written)
+			panic(http.ErrAbortHandler)
+		}
+		switch {
+		case written > 0:
+			w.Write([]byte(separator))
+		case pretty:
+			w.Write([]byte("[\n  "))
+		default:
+			w.Write([]byte("["))
+		}
+		if _, err := w.Write(encoded); err != nil {
+			//the client went away, there is nobody to tell
+			return
+		}
+		written++
+		if written%streamFlushEvery == 0 {
+			rc.Flush()
+		}
+	}
+	if written == 0 {
+		w.Write([]byte("[]\n"))
+		return
+	}
+	w.Write([]byte(end))
+}
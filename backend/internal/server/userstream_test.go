@@ -0,0 +1,206 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"api/internal/model"
+	"api/internal/store"
+	"api/requestid"
+)
+
+//generatedStore streams n users made up on the fly, so a test can list more of them than it could keep. with failAt
+//above 0 the stream fails at that user
+type generatedStore struct {
+	store.UserStore
+	n, failAt int
+	//seen is called with the number of users streamed so far before each one, for looking at the heap along the way
+	seen func(i int)
+}
+
+func (s generatedStore) Count(context.Context, store.Filter) (int, error) {
+	return s.n, nil
+}
+
+func (s generatedStore) Stream(ctx context.Context, f store.Filter) iter.Seq2[model.User, error] {
+	return func(yield func(model.User, error) bool) {
+		for i := range s.n {
+			if s.seen != nil {
+				s.seen(i)
+			}
+			if s.failAt > 0 && i == s.failAt {
+				yield(model.User{}, errDatabaseDown)
+				return
+			}
+			u := model.User{Id: model.ID(i + 1), Name: fmt.Sprintf("User %d", i), Email: fmt.Sprintf("user%d@example.com", i),
+				Role: model.RoleMember, Active: true, Locale: "en", Timezone: "UTC", UpdatedAt: time.Unix(1790000000, 0).UTC()}
+			if !yield(u, nil) {
+				return
+			}
+		}
+	}
+}
+
+//countingWriter is a ResponseWriter that keeps nothing of the body, it counts the bytes and the flushes
+type countingWriter struct {
+	header  http.Header
+	status  int
+	written int
+	flushes []int
+}
+
+func (w *countingWriter) Header() http.Header         { return w.header }
+func (w *countingWriter) WriteHeader(status int)      { w.status = status }
+func (w *countingWriter) Write(p []byte) (int, error) { w.written += len(p); return len(p), nil }
+func (w *countingWriter) Flush()                      { w.flushes = append(w.flushes, w.written) }
+
+//adminRequest is a GET of path by an admin
+func adminRequest(path string) *http.Request {
+	r := httptest.NewRequest("GET", path, nil)
+	return r.WithContext(context.WithValue(r.Context(), principalKey, principal{UserId: 1, Role: model.RoleAdmin}))
+}
+
+func TestStreamedListMatchesBuffered(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"MAX_PAGE_SIZE": "1000"})
+	admin := ts.admin()
+	//without passwords, hashing 120 of them takes long
+	for i := range 120 {
+		u := model.User{Name: fmt.Sprintf("User %d", i), Email: fmt.Sprintf("user%d@example.com", i), Role: model.RoleMember, Locale: "en", Timezone: "UTC"}
+		if _, err := ts.users.Create(t.Context(), u, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users, err := ts.users.List(t.Context(), store.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pretty := range []bool{false, true} {
+		want := httptest.NewRecorder()
+		newJSONEncoder(want, pretty).Encode(model.UserList{Users: users})
+		path := "/api/v1/users?limit=200"
+		if pretty {
+			path += "&pretty=true"
+		}
+		res := ts.do("GET", path, admin, nil)
+		expect(t, res, http.StatusOK)
+		if !bytes.Equal(res.body, want.Body.Bytes()) {
+			t.Fatalf("%s streamed\n%s\nbuffered\n%s", path, res.body, want.Body.Bytes())
+		}
+		if res.Header.Get("ETag") != "" || res.Header.Get("X-Total-Count") != "121" || res.Header.Get("Content-Type") != contentTypeJSON {
+			t.Fatalf("%s answered %v", path, res.Header)
+		}
+	}
+
+	//the first user is read before the status, a bad sort still gets its 400
+	expect(t, ts.do("GET", "/api/v1/users?limit=200&sort=password", admin, nil), http.StatusBadRequest)
+	//and an empty page is an empty array
+	res := ts.do("GET", "/api/v1/users?limit=200&offset=500", admin, nil)
+	expect(t, res, http.StatusOK)
+	if string(res.body) != "[]\n" {
+		t.Fatalf("the empty page is %q", res.body)
+	}
+}
+
+func TestStreamedListFailureAbortsTheConnection(t *testing.T) {
+	var logs syncBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	s := &userService{store: generatedStore{UserStore: store.NewMemory(), n: 2000, failAt: 1200}, events: newMemoryBroker(logger)}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.getUsers(w, r.WithContext(context.WithValue(r.Context(), principalKey, principal{UserId: 1, Role: model.RoleAdmin})))
+	})
+	srv := httptest.NewUnstartedServer(requestid.Middleware(withLogger(logger, recoverPanics(handler))))
+	srv.Config.ErrorLog = slog.NewLogLogger(slog.DiscardHandler, slog.LevelError)
+	srv.Start()
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/api/v1/users?limit=500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got %d", res.StatusCode)
+	}
+	body, err := io.ReadAll(res.Body)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("reading the broken list: %v", err)
+	}
+	//the client has part of a list that doesnt parse, not a list that looks complete
+	if !strings.HasPrefix(string(body), "[{") || json.Valid(body) {
+		t.Fatalf("the client got %d bytes ending in %q", len(body), body[max(0, len(body)-20):])
+	}
+	id := res.Header.Get("X-Request-ID")
+	if out := logs.String(); !strings.Contains(out, "streaming users failed") || !strings.Contains(out, "request_id="+id) {
+		t.Fatalf("the failure was logged as %s", out)
+	}
+}
+
+func TestStreamedListFlushes(t *testing.T) {
+	s := &userService{store: store.NewMemory()}
+	gen := generatedStore{n: 1200}
+	w := &countingWriter{header: http.Header{}}
+	s.streamUsers(w, adminRequest("/api/v1/users?limit=1200"), gen, gen, store.Filter{Limit: 1200}, page{Limit: 1200})
+	if w.status != http.StatusOK || len(w.flushes) != 2 {
+		t.Fatalf("answered %d with flushes after %v bytes", w.status, w.flushes)
+	}
+	if w.flushes[0] >= w.flushes[1] || w.flushes[1] >= w.written {
+		t.Fatalf("flushed after %v of %d bytes", w.flushes, w.written)
+	}
+}
+
+//TestStreamedListMemoryIsFlat lists 20000 users and looks at the live heap after the first 1000 and at the end, a list
+//built in memory would hold several megabytes more by then
+func TestStreamedListMemoryIsFlat(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs the garbage collector while streaming")
+	}
+	const n = 20000
+	var heap []uint64
+	gen := generatedStore{n: n, seen: func(i int) {
+		if i == 1000 || i == n-1 {
+			runtime.GC()
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			heap = append(heap, m.HeapAlloc)
+		}
+	}}
+	s := &userService{store: store.NewMemory()}
+	w := &countingWriter{header: http.Header{}}
+	s.streamUsers(w, adminRequest("/api/v1/users"), gen, gen, store.Filter{Limit: n}, page{Limit: n})
+	if w.status != http.StatusOK || len(heap) != 2 {
+		t.Fatalf("answered %d, heap %v", w.status, heap)
+	}
+	//19000 users are well over 3MB of json and more as structs
+	if heap[1] > heap[0] && heap[1]-heap[0] > 1<<20 {
+		t.Fatalf("the heap grew from %d to %d bytes while streaming %d bytes", heap[0], heap[1], w.written)
+	}
+}
+
+func BenchmarkStreamUsers(b *testing.B) {
+	for _, n := range []int{1000, 10000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			gen := generatedStore{n: n}
+			s := &userService{store: store.NewMemory()}
+			b.ReportAllocs()
+			for b.Loop() {
+				w := &countingWriter{header: http.Header{}}
+				s.streamUsers(w, adminRequest("/api/v1/users"), gen, gen, store.Filter{Limit: n}, page{Limit: n})
+			}
+			//stays the same per user however long the list is
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*n), "ns/user")
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"api/internal/model"
+	"api/internal/store"
+)
+
+//vcard lines must be folded once they get longer than 75 octets (rfc 2425 section 5.8.1)
+const vcardLineLimit = 75
+
+//vcardEscaper escapes the characters that have a special meaning inside a vcard text value
+//backslash has to come first so we dont escape the escapes we add for the others
+var vcardEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	",", `\,`,
+	";", `\;`,
+	"\r\n", `\n`,
+	"\n", `\n`,
+	"\r", `\n`,
+)
+
+//marshalVCard renders a user as a vcard 3.0 document
+//FN and N are both required by the spec, we only have a single name so it goes into the family name slot of N
+func marshalVCard(u model.User) []byte {
+	name := vcardEscaper.Replace(u.Name)
+
+	lines := []string{
+		"BEGIN:VCARD",
+		"VERSION:3.0",
+		"UID:" + strconv.FormatInt(int64(u.Id), 10),
+		"FN:" + name,
+		"N:" + name + ";;;;",
+	}
+	//the email is empty for callers who may not see it, see forCaller
+	if u.Email != "" {
+		lines = append(lines, "EMAIL;TYPE=INTERNET:"+vcardEscaper.Replace(u.Email))
+	}
+	if u.Phone != nil {
+		lines = append(lines, "TEL;TYPE=CELL:"+*u.Phone)
+	}
+	lines = append(lines, "END:VCARD")
+
+	var b strings.Builder
+	for _, line := range lines {
+		writeFoldedLine(&b, line)
+	}
+	return []byte(b.String())
+}
+
+//writeFoldedLine writes a content line terminated by crlf, folding it into continuation lines (starting with a space) when it is too long
+//it never splits a multi byte utf-8 character across two lines
+func writeFoldedLine(b *strings.Builder, line string) {
+	limit := vcardLineLimit
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		//continuation lines start with a space which counts towards the limit
+		limit = vcardLineLimit - 1
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+//vcardFilename builds a safe download filename from the user's name, e.g. "Jane Doe" becomes jane-doe.vcf
+//names without any usable characters fall back to the user id
+func vcardFilename(u model.User) string {
+	var b strings.Builder
+	dash := false
+	for _, c := range strings.ToLower(u.Name) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+			b.WriteRune(c)
+			dash = false
+		case b.Len() > 0 && !dash:
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	name := strings.TrimSuffix(b.String(), "-")
+	if name == "" {
+		name = "user-" + strconv.FormatInt(int64(u.Id), 10)
+	}
+	return name + ".vcf"
+}
+
+//getUserVCard serves a single user as a downloadable vcard, used by the desk phone provisioning tool
+func getUserVCard(users store.UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := userIdVar(r)
+
+		u, err := users.Get(r.Context(), id)
+		if err != nil {
+			//same behaviour as getUser
+			writeUserOpError(w, r, id, err)
+			return
+		}
+		u = forCaller(r, u)
+
+		w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": vcardFilename(u)}))
+		w.WriteHeader(http.StatusOK)
+		w.Write(marshalVCard(u))
+	}
+}
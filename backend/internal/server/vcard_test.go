@@ -0,0 +1,88 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"api/internal/model"
+)
+
+func TestMarshalVCard(t *testing.T) {
+	phone := "+14155550100"
+	for _, tc := range []struct {
+		name string
+		user model.User
+		want []string
+	}{
+		{"plain", model.User{Id: 42, Name: "Ada Lovelace", Email: "ada@example.com"},
+			[]string{"BEGIN:VCARD", "VERSION:3.0", "UID:42", "FN:Ada Lovelace", "N:Ada Lovelace;;;;", "EMAIL;TYPE=INTERNET:ada@example.com", "END:VCARD"}},
+		{"escaped", model.User{Id: 1, Name: "Doe, Jane; \\admin\nsecond line", Email: "jane@example.com"},
+			[]string{"BEGIN:VCARD", "VERSION:3.0", "UID:1", `FN:Doe\, Jane\; \\admin\nsecond line`, `N:Doe\, Jane\; \\admin\nsecond line;;;;`, "EMAIL;TYPE=INTERNET:jane@example.com", "END:VCARD"}},
+		//the email of a user the caller may not see is empty
+		{"without email", model.User{Id: 7, Name: "Grace", Phone: &phone},
+			[]string{"BEGIN:VCARD", "VERSION:3.0", "UID:7", "FN:Grace", "N:Grace;;;;", "TEL;TYPE=CELL:+14155550100", "END:VCARD"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := string(marshalVCard(tc.user))
+			if want := strings.Join(tc.want, "\r\n") + "\r\n"; got != want {
+				t.Fatalf("got\n%q\nwant\n%q", got, want)
+			}
+		})
+	}
+}
+
+func TestVCardFoldsLongLines(t *testing.T) {
+	name := strings.Repeat("é", 60)
+	card := string(marshalVCard(model.User{Id: 1, Name: name}))
+	for _, line := range strings.Split(strings.TrimSuffix(card, "\r\n"), "\r\n") {
+		if len(line) > vcardLineLimit {
+			t.Fatalf("line of %d octets: %q", len(line), line)
+		}
+		if !strings.HasPrefix(line, " ") && strings.Contains(line, "\uFFFD") {
+			t.Fatalf("a character was split: %q", line)
+		}
+	}
+	//unfolding gives back the name
+	if unfolded := strings.ReplaceAll(card, "\r\n ", ""); !strings.Contains(unfolded, "\r\nFN:"+name+"\r\n") {
+		t.Fatalf("unfolded to %q", unfolded)
+	}
+}
+
+func TestVCardFilename(t *testing.T) {
+	for name, want := range map[string]string{
+		"Jane Doe":         "jane-doe.vcf",
+		"  O'Brien, Pat  ": "o-brien-pat.vcf",
+		"Ünïcode":          "n-code.vcf",
+		"日本":               "user-9.vcf",
+		"":                 "user-9.vcf",
+	} {
+		if got := vcardFilename(model.User{Id: 9, Name: name}); got != want {
+			t.Errorf("vcardFilename(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestGetUserVCard(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	u := ts.createUser("Doe, Jane", "jane@example.com", model.RoleMember)
+
+	res := ts.do("GET", userPath(u.Id)+"/vcard", admin, nil)
+	expect(t, res, http.StatusOK)
+	if ct := res.Header.Get("Content-Type"); ct != "text/vcard; charset=utf-8" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	if cd := res.Header.Get("Content-Disposition"); cd != `attachment; filename=doe-jane.vcf` {
+		t.Fatalf("Content-Disposition %q", cd)
+	}
+	if body := string(res.body); !strings.HasPrefix(body, "BEGIN:VCARD\r\n") || !strings.Contains(body, `FN:Doe\, Jane`) {
+		t.Fatalf("vcard %q", body)
+	}
+
+	res = ts.do("GET", userPath(u.Id+1000)+"/vcard", admin, nil)
+	expect(t, res, http.StatusNotFound)
+	if res.errorCode() != codeUserNotFound {
+		t.Fatalf("a missing user answered %s", res.body)
+	}
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//verification links stay valid for a day, and at most this many are sent to a user per hour
+const (
+	verificationTokenTTL      = 24 * time.Hour
+	maxVerificationEmailsHour = 3
+)
+
+//requireEmailVerification blocks password logins of unverified users, it is turned on with REQUIRE_EMAIL_VERIFICATION=true
+var requireEmailVerification bool
+
+//resendVerificationRequest is the body of POST /api/v1/users/verify/resend
+type resendVerificationRequest struct {
+	Email string `json:"email"`
+}
+
+//sendVerificationEmail stores a new verification token for the user's current email and queues the mail with the link
+//with it, see jobQueue.enqueue. a slow or broken smtp server doesnt fail the request that triggered it
+func sendVerificationEmail(ctx context.Context, db *sql.DB, jobs *jobQueue, userId int64, email string) error {
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, "INSERT INTO verification_tokens (token_hash, user_id, email, expires_at) VALUES ($1, $2, $3, $4)",
+		hashToken(token), userId, email, time.Now().UTC().Add(verificationTokenTTL))
+	if err != nil {
+		return fmt.Errorf("storing verification token: %w", err)
+	}
+	err = jobs.enqueue(ctx, tx, jobTypeEmail, emailMessage{
+		To:      email,
+		Subject: "Confirm your email address",
+		Text: "Please confirm that this is your email address by opening this link within 24 hours:\n\n" +
+			frontendLink("/verify-email", "token", token) + "\n\nIf you didn't sign up, you can ignore this email.\n",
+	})
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("storing verification token: %w", err)
+	}
+	jobs.notify()
+	return nil
+}
+
+//verifyEmail marks the account verified and consumes the token from ?token=
+//a token only counts while the user still has the email it was sent to
+func verifyEmail(db *sql.DB, cache *userCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "the token query parameter is required")
+			return
+		}
+
+		userId, verified, err := consumeVerificationToken(r.Context(), db, hashToken(token))
+		if err != nil {
+			internalServerError(w, r, fmt.Errorf("verifying email: %w", err))
+			return
+		}
+		if !verified {
+			writeError(w, r, http.StatusBadRequest, codeInvalidToken, "verification token is invalid, expired or already used")
+			return
+		}
+		cache.forget(r.Context(), userId)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+//consumeVerificationToken uses up the token with tokenHash and verifies the user it was sent to, unless it isnt valid or
+//the user has changed their email since. a token is used up either way
+func consumeVerificationToken(ctx context.Context, db *sql.DB, tokenHash string) (userId int64, verified bool, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+	var email string
+	err = tx.QueryRowContext(ctx, "SELECT user_id, email FROM verification_tokens WHERE token_hash = $1 AND used_at IS NULL AND expires_at > now() FOR UPDATE",
+		tokenHash).Scan(&userId, &email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE verification_tokens SET used_at = now() WHERE token_hash = $1", tokenHash); err != nil {
+		return 0, false, err
+	}
+	res, err := tx.ExecContext(ctx, `UPDATE users SET email_verified_at = COALESCE(email_verified_at, now()), version = version + 1, updated_at = now()
+		WHERE id = $1 AND email = $2`, userId, email)
+	if err != nil {
+		return 0, false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, false, err
+	}
+	return userId, n > 0, tx.Commit()
+}
+
+//resendVerification sends a fresh verification link to an unverified account
+//like forgotPassword it always answers 202, so neither unknown emails nor the per hour limit give away who is registered
+func resendVerification(db *sql.DB, jobs *jobQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body resendVerificationRequest
+		if err := decodeRequest(r, &body); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+
+		var (
+			userId     int64
+			email      string
+			recentSent int
+		)
+		err := db.QueryRowContext(r.Context(), `SELECT u.id, u.email,
+				(SELECT count(*) FROM verification_tokens t WHERE t.user_id = u.id AND t.created_at > $2)
+			FROM users u WHERE lower(u.email) = lower($1) AND u.email_verified_at IS NULL ORDER BY u.id LIMIT 1`,
+			strings.TrimSpace(body.Email), time.Now().UTC().Add(-time.Hour)).Scan(&userId, &email, &recentSent)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			//unknown or already verified, nothing to send
+		case err != nil:
+			internalServerError(w, r, fmt.Errorf("looking up user for verification: %w", err))
+			return
+		case recentSent >= maxVerificationEmailsHour:
+			loggerFrom(r.Context()).Info("not resending verification email, hourly limit reached", "user_id", userId, "sent_last_hour", recentSent)
+		default:
+			if err := sendVerificationEmail(r.Context(), db, jobs, userId, email); err != nil {
+				internalServerError(w, r, err)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	//legacyAPIDeprecated is when /api/go was deprecated in favour of /api/v1
+	legacyAPIDeprecated = "2026-10-16"
+	//defaultLegacyAPISunset is when /api/go goes away, unless LEGACY_API_SUNSET says otherwise
+	defaultLegacyAPISunset = "2027-06-30"
+)
+
+//apiVersion tells clients which version of the api answered them
+func apiVersion(version string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-API-Version", version)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+//deprecatedAlias marks responses under the from prefix as deprecated (RFC 9745) with the date they stop working (RFC 8594)
+//and links to the same path under the to prefix, which replaces it. both are route paths, without BASE_PATH
+func deprecatedAlias(from, to string, sunset time.Time) mux.MiddlewareFunc {
+	deprecated, _ := time.Parse(time.DateOnly, legacyAPIDeprecated)
+	deprecation := fmt.Sprintf("@%d", deprecated.Unix())
+	sunsetValue := sunset.UTC().Format(http.TimeFormat)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", deprecation)
+			w.Header().Set("Sunset", sunsetValue)
+			if rest, ok := strings.CutPrefix(r.URL.Path, apiPath(from)); ok {
+				w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, externalURL(r, apiPath(to)+rest)))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"api/internal/model"
+)
+
+func TestLegacyAlias(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"LEGACY_API_SUNSET": "2027-01-31"})
+	admin := ts.admin()
+	u := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+	id := strings.TrimPrefix(userPath(u.Id), "/api/v1/users/")
+
+	for _, path := range []string{"/users", "/users/" + id, "/users/" + id + "/vcard"} {
+		current := ts.do("GET", "/api/v1"+path, admin, nil)
+		legacy := ts.do("GET", "/api/go"+path, admin, nil)
+		expect(t, current, http.StatusOK)
+		expect(t, legacy, http.StatusOK)
+		//the same handler answered both
+		if !bytes.Equal(current.body, legacy.body) || current.Header.Get("ETag") != legacy.Header.Get("ETag") {
+			t.Fatalf("%s answered\n%s\nand under /api/go\n%s", path, current.body, legacy.body)
+		}
+		for _, res := range []testResponse{current, legacy} {
+			if res.Header.Get("X-API-Version") != "v1" {
+				t.Fatalf("%s has X-API-Version %q", res.Request.URL.Path, res.Header.Get("X-API-Version"))
+			}
+		}
+		if current.Header.Get("Deprecation") != "" || current.Header.Get("Sunset") != "" {
+			t.Fatalf("/api/v1%s is deprecated", path)
+		}
+		if got := legacy.Header.Get("Deprecation"); got != "@1792108800" {
+			t.Fatalf("/api/go%s has Deprecation %q", path, got)
+		}
+		if got := legacy.Header.Get("Sunset"); got != "Sun, 31 Jan 2027 00:00:00 GMT" {
+			t.Fatalf("/api/go%s has Sunset %q", path, got)
+		}
+		if got := legacy.Header.Get("Link"); got != "</api/v1"+path+`>; rel="successor-version"` {
+			t.Fatalf("/api/go%s links %q", path, got)
+		}
+	}
+
+	//writes go through the alias too
+	res := ts.do("POST", "/api/go/users", admin, map[string]any{"name": "Grace", "email": "grace@example.com", "password": "password123"})
+	expect(t, res, http.StatusCreated)
+	if res.Header.Get("Deprecation") == "" {
+		t.Fatal("a create through the alias isnt deprecated")
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+
+	"api/internal/model"
+)
+
+//hiddenUserFields are the fields of other users each role doesnt see, by their json name. admins see everything,
+//members the names and what a directory of colleagues needs, not how to contact them. a role missing here sees what
+//members see. hidden fields are sent empty, in every format
+var hiddenUserFields = map[string][]string{
+	model.RoleAdmin:  nil,
+	model.RoleMember: {"email", "phone", "pending_email", "last_login_at"},
+}
+
+//ownHiddenUserFields are the fields of hiddenUserFields a caller doesnt see on their own account either
+var ownHiddenUserFields = []string{"last_login_at"}
+
+//userFieldIndex is the index of every field of model.User by its json name
+var userFieldIndex = func() map[string]int {
+	index := map[string]int{}
+	t := reflect.TypeFor[model.User]()
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			index[name] = i
+		}
+	}
+	return index
+}()
+
+//hiddenFieldsFor are the fields of the user id that p doesnt see
+func hiddenFieldsFor(p principal, id int64) []string {
+	hidden, ok := hiddenUserFields[p.Role]
+	if !ok {
+		hidden = hiddenUserFields[model.RoleMember]
+	}
+	if p.UserId != 0 && p.UserId == id {
+		var own []string
+		for _, field := range hidden {
+			if slices.Contains(ownHiddenUserFields, field) {
+				own = append(own, field)
+			}
+		}
+		return own
+	}
+	return hidden
+}
+
+//forPrincipal is u with the fields p may not see emptied, see hiddenUserFields. it is applied to every user a read
+//sends, the rest routes through writeResponse, graphql, grpc and the event streams alike
+func forPrincipal(p principal, u model.User) model.User {
+	v := reflect.ValueOf(&u).Elem()
+	for _, field := range hiddenFieldsFor(p, int64(u.Id)) {
+		v.Field(userFieldIndex[field]).SetZero()
+	}
+	return u
+}
+
+//forCaller is u as the caller of r may see it, see forPrincipal
+func forCaller(r *http.Request, u model.User) model.User {
+	return forContext(r.Context(), u)
+}
+
+//forContext is u as the caller in ctx may see it, see forPrincipal
+func forContext(ctx context.Context, u model.User) model.User {
+	p, _ := principalFromContext(ctx)
+	return forPrincipal(p, u)
+}
+
+//visibleTo is payload as the caller of r may see it, the users in it go through forCaller. writeResponse applies it
+//to every body, so a handler cant send a user with fields its caller doesnt see. the users are copied, a list a store
+//or a cache handed out stays as it was
+func visibleTo(r *http.Request, payload any) any {
+	switch v := payload.(type) {
+	case model.User:
+		return forCaller(r, v)
+	case model.UserList:
+		v.Users = visibleUsers(r, v.Users)
+		return v
+	case model.ScoredUserList:
+		if v.Users == nil {
+			return v
+		}
+		users := make([]model.ScoredUser, len(v.Users))
+		for i, u := range v.Users {
+			users[i] = model.ScoredUser{User: forCaller(r, u.User), Score: u.Score}
+		}
+		v.Users = users
+		return v
+	case dryRunDeletion:
+		v.User = forCaller(r, v.User)
+		return v
+	}
+	return payload
+}
+
+//visibleUsers is a copy of users as the caller of r may see them
+func visibleUsers(r *http.Request, users []model.User) []model.User {
+	if users == nil {
+		return nil
+	}
+	visible := make([]model.User, len(users))
+	for i, u := range users {
+		visible[i] = forCaller(r, u)
+	}
+	return visible
+}
+
+//canSeeUserField reports whether the caller in ctx sees field on other users. filtering on a field they dont see
+//would tell them its value, so those filters are refused
+func canSeeUserField(ctx context.Context, field string) bool {
+	p, _ := principalFromContext(ctx)
+	return !slices.Contains(hiddenFieldsFor(p, 0), field)
+}
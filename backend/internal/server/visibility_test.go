@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+
+	"api/internal/model"
+	"api/userpb"
+)
+
+//TestMembersDontSeeHiddenFields checks that a member can neither read the fields hiddenUserFields keeps from them on
+//other users nor tell them from what filters, sorts and searches answer
+func TestMembersDontSeeHiddenFields(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"MAX_PAGE_SIZE": "1000", "GRPC_ADDR": "127.0.0.1:0"})
+	admin := ts.admin()
+	m, member := ts.member()
+	phone := "+14155550100"
+	grace := ts.createUser("Grace Hopper", "ghopper@navy.example", model.RoleMember)
+	expect(t, ts.do("PUT", userPath(grace.Id), admin, map[string]any{"name": grace.Name, "email": grace.Email, "phone": phone}), http.StatusOK)
+
+	res := ts.do("GET", "/api/v1/users", member, nil)
+	expect(t, res, http.StatusOK)
+	if body := string(res.body); strings.Contains(body, grace.Email) || strings.Contains(body, phone) || strings.Contains(body, "admin@example.com") {
+		t.Fatalf("a member listed %s", body)
+	}
+	if !strings.Contains(string(res.body), m.Email) {
+		t.Fatalf("a member doesnt see their own email: %s", res.body)
+	}
+
+	//nor on any other read of grace, in any format
+	pending := "grace.new@navy.example"
+	if _, err := ts.db.Exec("UPDATE users SET pending_email = $1, pending_email_expires_at = $2, last_login_at = $3 WHERE id = $4",
+		pending, time.Now().Add(time.Hour).UTC(), time.Now().UTC(), grace.Id); err != nil {
+		t.Fatal(err)
+	}
+	hidden := []string{grace.Email, phone, pending, "last_login_at"}
+	checkHidden := func(what string, body []byte) {
+		t.Helper()
+		for _, value := range hidden {
+			if bytes.Contains(body, []byte(value)) {
+				t.Fatalf("%s told a member %s: %s", what, value, body)
+			}
+		}
+	}
+	res = ts.do("GET", userPath(grace.Id), admin, nil)
+	for _, value := range hidden {
+		if !strings.Contains(string(res.body), value) {
+			t.Fatalf("an admin doesnt see %s: %s", value, res.body)
+		}
+	}
+	for _, tc := range []struct{ path, accept string }{
+		{userPath(grace.Id), ""},
+		{userPath(grace.Id), "application/xml"},
+		{userPath(grace.Id), "application/msgpack"},
+		{userPath(grace.Id), "application/x-protobuf"},
+		{userPath(grace.Id), mediaTypeJSONAPI},
+		{userPath(grace.Id) + "/vcard", ""},
+		{"/api/v1/users", "application/xml"},
+		{"/api/v1/users", "application/msgpack"},
+		{"/api/v1/users", "application/x-protobuf"},
+		{"/api/v1/users?limit=200", ""},
+	} {
+		res := ts.do("GET", tc.path, member, nil, "Accept", tc.accept)
+		expect(t, res, http.StatusOK)
+		checkHidden(fmt.Sprintf("GET %s as %q", tc.path, tc.accept), res.body)
+	}
+	//that one was streamed, the pages that are have no etag
+	if res := ts.do("GET", "/api/v1/users?limit=200", member, nil); res.Header.Get("ETag") != "" {
+		t.Fatal("the list of 200 wasnt streamed")
+	}
+
+	//the change events: the stream of the admins refuses them, the websocket leaves the fields out
+	expect(t, ts.do("GET", "/api/v1/users/events", member, nil), http.StatusForbidden)
+	conn, _, err := ts.dialEvents(member)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readEvent(t, conn)
+	expect(t, ts.do("PUT", userPath(grace.Id), admin, map[string]any{"name": "Admiral Grace Hopper", "email": grace.Email, "phone": phone}), http.StatusOK)
+	if e := readEvent(t, conn); e.User.Id != grace.Id || e.User.Email != "" || e.User.Phone != nil || e.User.PendingEmail != "" || e.User.LastLoginAt != nil {
+		t.Fatalf("a member was sent the event %+v", e)
+	}
+
+	client := ts.grpcClient()
+	ctx := metadata.AppendToOutgoingContext(t.Context(), "x-api-key", ts.apiKey(admin, model.RoleMember))
+	got, err := client.GetUser(ctx, &userpb.GetUserRequest{Id: int64(grace.Id)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := client.ListUsers(ctx, &userpb.ListUsersRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range append(list.Users, got) {
+		if u.Id == int64(grace.Id) && (u.Email != "" || u.PendingEmail != "") {
+			t.Fatalf("grpc told a member %v", u)
+		}
+	}
+
+	for _, query := range []string{"email=" + url.QueryEscape(grace.Email), "phone=" + url.QueryEscape(phone),
+		"sort=email", "sort=-email", "sort=name,phone", "sort=last_login_at"} {
+		expect(t, ts.do("GET", "/api/v1/users?"+query, member, nil), http.StatusForbidden)
+	}
+	expect(t, ts.do("GET", "/api/v1/users?sort=-email", admin, nil), http.StatusOK)
+	expect(t, ts.do("GET", "/api/v1/users?sort=name,-updated_at", member, nil), http.StatusOK)
+
+	//graphql searches the names only for them
+	search := func(token, q string) string {
+		t.Helper()
+		res := ts.do("POST", "/api/v1/graphql", token, map[string]any{"query": `query($q: String) { users(filter: {search: $q}) { id name email } }`,
+			"variables": map[string]any{"q": q}})
+		expect(t, res, http.StatusOK)
+		return string(res.body)
+	}
+	for _, q := range []string{grace.Email, "navy", "ghopper"} {
+		if body := search(member, q); strings.Contains(body, "Grace") {
+			t.Fatalf("a member searching %q found %s", q, body)
+		}
+		if body := search(admin, q); !strings.Contains(body, grace.Email) {
+			t.Fatalf("an admin searching %q found %s", q, body)
+		}
+	}
+	if body := search(member, "hopper"); !strings.Contains(body, "Grace Hopper") || strings.Contains(body, grace.Email) {
+		t.Fatalf("a member searching a name found %s", body)
+	}
+}
+
+func TestSearchScoresEmailsForAdminsOnly(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	grace := ts.createUser("Grace Hopper", "ghopper@navy.example", model.RoleMember)
+	ts.createUser("Navy Grace", "someone@example.com", model.RoleMember)
+	_, member := ts.member()
+
+	res := ts.do("GET", "/api/v1/users/search?q="+url.QueryEscape(grace.Email), admin, nil)
+	expect(t, res, http.StatusOK)
+	var found []struct {
+		model.User
+		Score int `json:"score"`
+	}
+	res.decode(t, &found)
+	if len(found) != 1 || found[0].Id != grace.Id || found[0].Score != 3 {
+		t.Fatalf("an admin searching the email found %s", res.body)
+	}
+	//the ranked search is the admin dashboard's, members search the names with graphql
+	expect(t, ts.do("GET", "/api/v1/users/search?q=navy", member, nil), http.StatusForbidden)
+}
+
+//TestListETagPerView checks that the etag of a list is that of what the caller sees, so a tag an admin got cant be
+//answered with 304 to a member
+func TestListETagPerView(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	_, member := ts.member()
+
+	res := ts.do("GET", "/api/v1/users", admin, nil)
+	expect(t, res, http.StatusOK)
+	adminTag := res.Header.Get("ETag")
+	res = ts.do("GET", "/api/v1/users", member, nil, "If-None-Match", adminTag)
+	expect(t, res, http.StatusOK)
+	memberTag := res.Header.Get("ETag")
+	if memberTag == "" || memberTag == adminTag {
+		t.Fatalf("admin tag %s, member tag %s", adminTag, memberTag)
+	}
+	expect(t, ts.do("GET", "/api/v1/users", member, nil, "If-None-Match", memberTag), http.StatusNotModified)
+	expect(t, ts.do("GET", "/api/v1/users", admin, nil, "If-None-Match", adminTag), http.StatusNotModified)
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//websocket timings. pings go out a bit more often than the pong deadline, so a healthy client always answers in time
+const (
+	wsAuthTimeout  = 10 * time.Second
+	wsWriteTimeout = 10 * time.Second
+	wsPongTimeout  = 60 * time.Second
+	wsPingInterval = wsPongTimeout * 9 / 10
+	//clients only ever send the auth message, anything bigger is a misbehaving client
+	wsMaxMessageSize = 4096
+)
+
+//the socket authenticates with a token rather than the session cookie, so a page on another origin gains nothing
+//from opening it and any origin is accepted
+var wsUpgrader = websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+
+//wsMessage is a control message on the socket: the client's {"type": "auth", "token": "..."} and our {"type": "authenticated"}
+type wsMessage struct {
+	Type  string `json:"type"`
+	Token string `json:"token,omitempty"`
+}
+
+//errWsTokenInvalid covers every reason an access token cant open a socket
+var errWsTokenInvalid = errors.New("access token is invalid or expired")
+
+//wsPrincipal checks an access token sent to the socket
+//impersonation tokens are refused: every impersonated request is audited, which a long lived socket cant be
+func wsPrincipal(ctx context.Context, db *sql.DB, token string) (principal, error) {
+	claims, err := parseAccessToken(token)
+	if err != nil || claims.Act != nil {
+		return principal{}, errWsTokenInvalid
+	}
+	userId, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return principal{}, errWsTokenInvalid
+	}
+	p, err := userPrincipal(ctx, db, userId)
+	if errors.Is(err, errUserGone) || errors.Is(err, errUserDeactivated) {
+		return principal{}, errWsTokenInvalid
+	}
+	return p, err
+}
+
+//userEventsSocket forwards user events as json frames ({"type": "updated", "user": {...}}) over a websocket
+//the access token comes either in ?access_token= or as the first message, for clients that dont want it in urls and logs.
+//each connection gets its own subscription to the broker, whose buffer caps how far a stuck client can fall behind
+//before it is disconnected
+func userEventsSocket(db *sql.DB, events eventBroker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		//with the token in the url a bad token can still get a proper 401 before upgrading
+		token := r.URL.Query().Get("access_token")
+		var caller principal
+		if token != "" {
+			var err error
+			if caller, err = wsPrincipal(r.Context(), db, token); errors.Is(err, errWsTokenInvalid) {
+				writeUnauthorized(w, r, err.Error())
+				return
+			} else if err != nil {
+				internalServerError(w, r, err)
+				return
+			}
+		}
+
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			//Upgrade already answered the client
+			return
+		}
+		defer conn.Close()
+		conn.SetReadLimit(wsMaxMessageSize)
+
+		if token == "" {
+			conn.SetReadDeadline(time.Now().Add(wsAuthTimeout))
+			var msg wsMessage
+			if err := conn.ReadJSON(&msg); err != nil || msg.Type != "auth" {
+				closeSocket(conn, websocket.ClosePolicyViolation, "the first message must be {\"type\": \"auth\", \"token\": \"...\"}")
+				return
+			}
+			if caller, err = wsPrincipal(r.Context(), db, msg.Token); err != nil {
+				if !errors.Is(err, errWsTokenInvalid) {
+					loggerFrom(r.Context()).Error("authenticating websocket", "error", err)
+				}
+				closeSocket(conn, websocket.ClosePolicyViolation, errWsTokenInvalid.Error())
+				return
+			}
+		}
+
+		ch, unsubscribe := events.Subscribe()
+		defer unsubscribe()
+
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		if err := conn.WriteJSON(wsMessage{Type: "authenticated"}); err != nil {
+			return
+		}
+
+		//the read loop only handles pongs and notices when the client goes away
+		conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+		})
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		ping := time.NewTicker(wsPingInterval)
+		defer ping.Stop()
+		for {
+			select {
+			case <-closed:
+				return
+			case e, ok := <-ch:
+				if !ok {
+					closeSocket(conn, websocket.CloseTryAgainLater, "too slow to keep up with events, reconnect and reload")
+					return
+				}
+				//every subscriber gets the users as their caller may see them, see forPrincipal
+				e.User = forPrincipal(caller, e.User)
+				conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+				if err := conn.WriteJSON(e); err != nil {
+					return
+				}
+			case <-ping.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+//closeSocket sends a close frame with a reason, the caller still closes the connection
+func closeSocket(conn *websocket.Conn, code int, reason string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteTimeout))
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"api/internal/model"
+)
+
+//dialEvents opens the websocket of ts, with the access token in the url unless it is empty
+func (ts *testServer) dialEvents(token string) (*websocket.Conn, *http.Response, error) {
+	u := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/v1/ws"
+	if token != "" {
+		u += "?access_token=" + token
+	}
+	conn, res, err := websocket.DefaultDialer.Dial(u, nil)
+	if err == nil {
+		ts.t.Cleanup(func() { conn.Close() })
+	}
+	return conn, res, err
+}
+
+//readEvent reads the next frame of the socket as a user event
+func readEvent(t *testing.T, conn *websocket.Conn) userEvent {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var e userEvent
+	if err := conn.ReadJSON(&e); err != nil {
+		t.Fatalf("reading event: %v", err)
+	}
+	return e
+}
+
+func TestWebSocketEvents(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	conn, _, err := ts.dialEvents(admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := readEvent(t, conn); e.Type != "authenticated" {
+		t.Fatalf("first frame %+v", e)
+	}
+
+	res := ts.do("POST", "/api/v1/users", admin, map[string]any{"name": "Ada", "email": "ada@example.com", "password": "password123"})
+	expect(t, res, http.StatusCreated)
+	var created model.User
+	res.decode(t, &created)
+	if e := readEvent(t, conn); e.Type != eventUserCreated || e.User.Id != created.Id || e.User.Email != "ada@example.com" {
+		t.Fatalf("after the create got %+v", e)
+	}
+	expect(t, ts.do("PUT", userPath(created.Id), admin, map[string]any{"name": "Ada Lovelace", "email": "ada@example.com"}), http.StatusOK)
+	if e := readEvent(t, conn); e.Type != eventUserUpdated || e.User.Name != "Ada Lovelace" {
+		t.Fatalf("after the update got %+v", e)
+	}
+	expect(t, ts.do("DELETE", userPath(created.Id), admin, nil), http.StatusNoContent)
+	if e := readEvent(t, conn); e.Type != eventUserDeleted || e.User.Id != created.Id {
+		t.Fatalf("after the delete got %+v", e)
+	}
+}
+
+func TestWebSocketAuthMessage(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	_, member := ts.member()
+
+	conn, _, err := ts.dialEvents("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteJSON(wsMessage{Type: "auth", Token: member}); err != nil {
+		t.Fatal(err)
+	}
+	if e := readEvent(t, conn); e.Type != "authenticated" {
+		t.Fatalf("first frame %+v", e)
+	}
+	expect(t, ts.do("POST", "/api/v1/users", admin, map[string]any{"name": "Ada", "email": "ada@example.com", "password": "password123"}), http.StatusCreated)
+	if e := readEvent(t, conn); e.Type != eventUserCreated || e.User.Name != "Ada" {
+		t.Fatalf("after the create got %+v", e)
+	}
+}
+
+func TestWebSocketRefusesBadTokens(t *testing.T) {
+	ts := newTestServer(t, nil)
+
+	//a token in the url is checked before the upgrade
+	_, res, err := ts.dialEvents("not-a-token")
+	if err == nil || res == nil || res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("dialing with a bad token got %v, %v", res, err)
+	}
+
+	//one in the first message after it, the socket is closed
+	for _, first := range []wsMessage{{Type: "auth", Token: "not-a-token"}, {Type: "hello"}} {
+		conn, _, err := ts.dialEvents("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteJSON(first); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err = conn.ReadMessage()
+		if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			t.Fatalf("after %+v got %v, want a policy violation close", first, err)
+		}
+	}
+}
+
+//TestWebSocketSlowClient has a broker drop the subscription of the socket, like it does when the client cant keep up
+func TestWebSocketSlowClient(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	broker := newMemoryBroker(slog.New(slog.DiscardHandler))
+	server := httptest.NewServer(userEventsSocket(ts.db, broker))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?access_token="+admin, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if e := readEvent(t, conn); e.Type != "authenticated" {
+		t.Fatalf("first frame %+v", e)
+	}
+
+	//what Publish does to a subscriber whose buffer is full
+	broker.mu.Lock()
+	dropped := len(broker.subs)
+	for ch := range broker.subs {
+		delete(broker.subs, ch)
+		close(ch)
+	}
+	broker.mu.Unlock()
+	if dropped != 1 {
+		t.Fatalf("the socket has %d subscriptions", dropped)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err = conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Fatalf("got %v, want a try again later close", err)
+	}
+}
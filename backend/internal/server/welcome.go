@@ -0,0 +1,46 @@
+package server
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"text/template"
+
+	"api/internal/model"
+)
+
+//welcomeData is what the welcome email templates are rendered with
+type welcomeData struct {
+	Name      string
+	Email     string
+	SignInURL string
+}
+
+//the html template escapes the name, it is whatever the user was created with. the text part is sent as text/plain
+//and isnt escaped, entities would show up literally there
+var (
+	welcomeText = template.Must(template.New("welcome.txt").Parse(`Hi {{.Name}},
+
+an account has been created for you with the email address {{.Email}}.
+You can sign in at {{.SignInURL}}
+
+If you didn't expect this, you can ignore this email.
+`))
+	welcomeHTML = htmltemplate.Must(htmltemplate.New("welcome.html").Parse(`<p>Hi {{.Name}},</p>
+<p>an account has been created for you with the email address {{.Email}}.
+You can <a href="{{.SignInURL}}">sign in here</a>.</p>
+<p>If you didn't expect this, you can ignore this email.</p>
+`))
+)
+
+//welcomeEmail is the email a newly created user gets
+func welcomeEmail(u model.User) (emailMessage, error) {
+	data := welcomeData{Name: u.Name, Email: u.Email, SignInURL: appBaseURL}
+	var text, html bytes.Buffer
+	if err := welcomeText.Execute(&text, data); err != nil {
+		return emailMessage{}, err
+	}
+	if err := welcomeHTML.Execute(&html, data); err != nil {
+		return emailMessage{}, err
+	}
+	return emailMessage{To: u.Email, Subject: "Welcome!", Text: text.String(), HTML: html.String()}, nil
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+//Workers are the jobs that run in the background next to the server until Stop is called
+type Workers struct {
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+	pub  publisher
+}
+
+//StartWorkers starts the cleanup of expired idempotency keys, sessions and user changes, the count of the users for
+//the metrics, when cfg names a publisher the relay that sends user changes from the outbox to the message bus, and when
+//it has an EXPORT_SCHEDULE the scheduled exports. the cleanups run on every database.
+//a READ_ONLY instance only counts the users, everything else writes
+func StartWorkers(cfg *Config, db *sql.DB, logger *slog.Logger) (*Workers, error) {
+	if cfg.ReadOnly {
+		ctx, stop := context.WithCancel(context.Background())
+		w := &Workers{stop: stop}
+		if cfg.UserMetricsInterval > 0 {
+			w.wg.Go(func() { runUserMetrics(ctx, db, cfg.UserMetricsInterval, logger) })
+		}
+		return w, nil
+	}
+	var dest exportDestination
+	if cfg.Exports.schedule != nil {
+		var err error
+		if dest, err = newExportDestination(cfg.Exports.dest); err != nil {
+			return nil, err
+		}
+	}
+	pub, err := newPublisher(cfg)
+	if err != nil {
+		return nil, err
+	}
+	//readyz checks the broker and the export destination, both only when they are configured
+	if c, ok := pub.(healthChecker); ok {
+		healthChecks.register(dependencyOutbox, c)
+	}
+	if c, ok := dest.(healthChecker); ok {
+		healthChecks.register(dependencyExports, c)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	w := &Workers{stop: stop, pub: pub}
+	w.wg.Go(func() { cleanupIdempotencyKeys(ctx, db, logger, time.Hour) })
+	w.wg.Go(func() { cleanupSessions(ctx, db, logger, time.Hour) })
+	if cfg.UserChangesRetention > 0 {
+		w.wg.Go(func() { cleanupUserChanges(ctx, db, logger, cfg.UserChangesRetention, time.Hour) })
+	}
+	if cfg.UserMetricsInterval > 0 {
+		w.wg.Go(func() { runUserMetrics(ctx, db, cfg.UserMetricsInterval, logger) })
+	}
+	if pub != nil {
+		outboxEnabled = true
+		w.wg.Go(func() { runOutboxRelay(ctx, db, pub, logger) })
+	}
+	if dest != nil {
+		w.wg.Go(func() { runScheduledExports(ctx, db, cfg.DBDriver, cfg.Exports, dest, logger) })
+	}
+	return w, nil
+}
+
+//Stop cancels the workers, waits for them to return and then closes the message bus they publish to
+func (w *Workers) Stop(logger *slog.Logger) {
+	w.stop()
+	w.wg.Wait()
+	if w.pub != nil {
+		if err := w.pub.Close(); err != nil {
+			logger.Error("closing outbox publisher", "error", err)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//contentTypeXLSX is the media type of an excel workbook
+const contentTypeXLSX = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+//xlsxWriter writes a workbook with one sheet to a zip stream while its rows come in, without a shared strings table:
+//strings are written inline into their cells. nothing but the row being written is held in memory, so a sheet of any
+//size streams in bounded memory. the first row is the header, it is bold and frozen so it stays on screen when scrolling
+type xlsxWriter struct {
+	zip   *zip.Writer
+	sheet *bufio.Writer
+	rows  int
+}
+
+//the parts of the workbook besides the sheet, they dont depend on what is in it
+const (
+	xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+		`</Types>`
+	xlsxRootRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`
+	xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+		`</Relationships>`
+	//the cell styles by index: 0 is plain, 1 the bold header and 2 a date and time in the built in format 22
+	xlsxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+		`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+		`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+		`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+		`<cellXfs count="3"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+		`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>` +
+		`<xf numFmtId="22" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/></cellXfs>` +
+		`</styleSheet>`
+)
+
+//cell styles of xlsxStyles
+const (
+	xlsxStyleHeader = 1
+	xlsxStyleDate   = 2
+)
+
+//newXLSXWriter starts a workbook with a sheet called sheetName on w and writes header as its first row.
+//the workbook is only complete once Close returns
+func newXLSXWriter(w io.Writer, sheetName string, header []string) (*xlsxWriter, error) {
+	x := &xlsxWriter{zip: zip.NewWriter(w)}
+	var name strings.Builder
+	xml.EscapeText(&name, []byte(sheetName))
+	workbook := `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="` + name.String() + `" sheetId="1" r:id="rId1"/></sheets></workbook>`
+	parts := []struct{ name, content string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRootRels},
+		{"xl/workbook.xml", workbook},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+		{"xl/styles.xml", xlsxStyles},
+	}
+	for _, p := range parts {
+		f, err := x.zip.Create(p.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, p.content); err != nil {
+			return nil, err
+		}
+	}
+	sheet, err := x.zip.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	x.sheet = bufio.NewWriter(sheet)
+	x.sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>` +
+		`<sheetData>`)
+	cells := make([]any, len(header))
+	for i, h := range header {
+		cells[i] = xlsxHeaderCell(h)
+	}
+	return x, x.WriteRow(cells...)
+}
+
+//xlsxHeaderCell is a string written in the bold header style
+type xlsxHeaderCell string
+
+//WriteRow adds a row to the sheet. a cell is an int64, a bool, a time.Time or a *time.Time, which become a number,
+//a boolean and a date, or a string or *string. nil and nil pointers leave the cell empty
+func (x *xlsxWriter) WriteRow(cells ...any) error {
+	x.rows++
+	row := strconv.Itoa(x.rows)
+	x.sheet.WriteString(`<row r="` + row + `">`)
+	for i, cell := range cells {
+		ref := xlsxColumn(i) + row
+		switch v := cell.(type) {
+		case int64:
+			x.sheet.WriteString(`<c r="` + ref + `"><v>` + strconv.FormatInt(v, 10) + `</v></c>`)
+		case bool:
+			b := "0"
+			if v {
+				b = "1"
+			}
+			x.sheet.WriteString(`<c r="` + ref + `" t="b"><v>` + b + `</v></c>`)
+		case time.Time:
+			x.writeDate(ref, v)
+		case *time.Time:
+			if v != nil {
+				x.writeDate(ref, *v)
+			}
+		case string:
+			x.writeString(ref, v, 0)
+		case *string:
+			if v != nil {
+				x.writeString(ref, *v, 0)
+			}
+		case nil:
+		case xlsxHeaderCell:
+			x.writeString(ref, string(v), xlsxStyleHeader)
+		default:
+			return fmt.Errorf("an xlsx cell cant be a %T", cell)
+		}
+	}
+	_, err := x.sheet.WriteString(`</row>`)
+	return err
+}
+
+//writeString writes s as an inline string, so it stays text however much it looks like a number
+func (x *xlsxWriter) writeString(ref, s string, style int) {
+	x.sheet.WriteString(`<c r="` + ref + `" t="inlineStr"`)
+	if style != 0 {
+		x.sheet.WriteString(` s="` + strconv.Itoa(style) + `"`)
+	}
+	x.sheet.WriteString(`><is><t xml:space="preserve">`)
+	xml.EscapeText(x.sheet, []byte(s))
+	x.sheet.WriteString(`</t></is></c>`)
+}
+
+//xlsxEpoch is day 0 of the dates of a workbook. excel counts 1900 as a leap year, starting on the last day of 1899
+//rather than the first makes the days since march 1900 come out right
+var xlsxEpoch = time.Date(1899, time.December, 30, 0, 0, 0, 0, time.UTC)
+
+//writeDate writes t in utc as the number of days since xlsxEpoch in the date style
+func (x *xlsxWriter) writeDate(ref string, t time.Time) {
+	days := t.UTC().Sub(xlsxEpoch).Hours() / 24
+	x.sheet.WriteString(`<c r="` + ref + `" s="` + strconv.Itoa(xlsxStyleDate) + `"><v>` + strconv.FormatFloat(days, 'f', -1, 64) + `</v></c>`)
+}
+
+//Close ends the sheet and writes the directory of the zip, it doesnt close the writer underneath
+func (x *xlsxWriter) Close() error {
+	x.sheet.WriteString(`</sheetData></worksheet>`)
+	if err := x.sheet.Flush(); err != nil {
+		return err
+	}
+	return x.zip.Close()
+}
+
+//xlsxColumn is the letters of the column with the index i counting from 0: A to Z, then AA and so on
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"api/internal/model"
+)
+
+//xlsxSheet is the part of a worksheet the tests look at
+type xlsxSheet struct {
+	Panes []struct {
+		YSplit int    `xml:"ySplit,attr"`
+		State  string `xml:"state,attr"`
+	} `xml:"sheetViews>sheetView>pane"`
+	Rows []struct {
+		R     int `xml:"r,attr"`
+		Cells []struct {
+			R    string `xml:"r,attr"`
+			T    string `xml:"t,attr"`
+			S    int    `xml:"s,attr"`
+			V    string `xml:"v"`
+			Text string `xml:"is>t"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+//openWorkbook reads the sheet of a workbook xlsxWriter wrote, failing the test when it isnt a zip with every part
+func openWorkbook(t *testing.T, data []byte) xlsxSheet {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("the workbook isnt a zip: %v", err)
+	}
+	var sheet xlsxSheet
+	var parts []string
+	for _, f := range zr.File {
+		parts = append(parts, f.Name)
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		//every part has to be well formed xml
+		var anything struct{}
+		if err := xml.Unmarshal(content, &anything); err != nil {
+			t.Fatalf("%s: %v", f.Name, err)
+		}
+		if f.Name == "xl/worksheets/sheet1.xml" {
+			if err := xml.Unmarshal(content, &sheet); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, part := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels", "xl/styles.xml", "xl/worksheets/sheet1.xml"} {
+		if !slices.Contains(parts, part) {
+			t.Fatalf("the workbook has no %s, only %v", part, parts)
+		}
+	}
+	return sheet
+}
+
+func TestXLSXColumn(t *testing.T) {
+	for i, want := range map[int]string{0: "A", 25: "Z", 26: "AA", 27: "AB", 701: "ZZ", 702: "AAA"} {
+		if got := xlsxColumn(i); got != want {
+			t.Errorf("xlsxColumn(%d) = %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestXLSXWriter(t *testing.T) {
+	var buf bytes.Buffer
+	x, err := newXLSXWriter(&buf, "users & more", []string{"id", "code", "when", "ok", "none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	noon := time.Date(2026, 10, 17, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	code := "007"
+	if err := x.WriteRow(int64(42), &code, noon, true, (*string)(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.WriteRow(int64(-1), "<a & b>", time.Date(1900, 3, 1, 0, 0, 0, 0, time.UTC), false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.Close(); err != nil {
+		t.Fatal(err)
+	}
+	//a workbook that got a cell it cant write is broken, its writer isnt closed
+	if err := x.WriteRow(1.5); err == nil {
+		t.Fatal("a float was written")
+	}
+
+	sheet := openWorkbook(t, buf.Bytes())
+	if len(sheet.Panes) != 1 || sheet.Panes[0].YSplit != 1 || sheet.Panes[0].State != "frozen" {
+		t.Fatalf("the header isnt frozen: %+v", sheet.Panes)
+	}
+	if len(sheet.Rows) != 3 {
+		t.Fatalf("%d rows", len(sheet.Rows))
+	}
+	header := sheet.Rows[0]
+	if len(header.Cells) != 5 || header.Cells[0].Text != "id" || header.Cells[0].S != xlsxStyleHeader || header.Cells[4].R != "E1" {
+		t.Fatalf("the header is %+v", header)
+	}
+	row := sheet.Rows[1].Cells
+	//the id is a number, the code stays text with its zeros, the time is a date in utc and nil leaves nothing
+	if len(row) != 4 || row[0].R != "A2" || row[0].T != "" || row[0].V != "42" ||
+		row[1].T != "inlineStr" || row[1].Text != "007" ||
+		row[2].S != xlsxStyleDate || row[3].T != "b" || row[3].V != "1" {
+		t.Fatalf("the first row is %+v", row)
+	}
+	if days, _ := strconv.ParseFloat(row[2].V, 64); days != 46312.416666666664 {
+		t.Fatalf("10am utc on 2026-10-17 is day %s", row[2].V)
+	}
+	row = sheet.Rows[2].Cells
+	//excel has a 29th of february 1900, the first of march is day 61
+	if row[1].Text != "<a & b>" || row[2].V != "61" || row[3].V != "0" {
+		t.Fatalf("the second row is %+v", row)
+	}
+}
+
+func TestUsersWorkbookExport(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := ts.admin()
+	ada := ts.createUser("Ada", "ada@example.com", model.RoleMember)
+
+	res := ts.do("GET", "/api/v1/admin/export?format=xlsx", admin, nil)
+	expect(t, res, http.StatusOK)
+	if res.Header.Get("Content-Type") != contentTypeXLSX {
+		t.Fatalf("Content-Type %q", res.Header.Get("Content-Type"))
+	}
+	disposition, params, err := mime.ParseMediaType(res.Header.Get("Content-Disposition"))
+	if err != nil || disposition != "attachment" || params["filename"] != "users-"+time.Now().UTC().Format(time.DateOnly)+".xlsx" {
+		t.Fatalf("Content-Disposition %q", res.Header.Get("Content-Disposition"))
+	}
+	sheet := openWorkbook(t, res.body)
+	if len(sheet.Rows) != 3 {
+		t.Fatalf("%d rows for 2 users", len(sheet.Rows))
+	}
+	var header []string
+	for _, c := range sheet.Rows[0].Cells {
+		header = append(header, c.Text)
+	}
+	if !slices.Equal(header, usersWorkbookHeader) {
+		t.Fatalf("the header is %v", header)
+	}
+	cells := map[string]string{}
+	for _, c := range sheet.Rows[2].Cells {
+		cells[header[int(c.R[0]-'A')]] = c.V + c.Text
+		if header[int(c.R[0]-'A')] == "created_at" && c.S != xlsxStyleDate {
+			t.Fatalf("created_at isnt a date: %+v", c)
+		}
+	}
+	if cells["id"] != strconv.FormatInt(int64(ada.Id), 10) || cells["email"] != "ada@example.com" || cells["public_id"] != ada.PublicId || cells["active"] != "1" {
+		t.Fatalf("ada's row is %v", cells)
+	}
+
+	//the dump stays the default
+	res = ts.do("GET", "/api/v1/admin/export", admin, nil)
+	if res.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("the default export is %q", res.Header.Get("Content-Type"))
+	}
+	expect(t, ts.do("GET", "/api/v1/admin/export?format=csv", admin, nil), http.StatusBadRequest)
+}
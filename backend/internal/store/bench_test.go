@@ -0,0 +1,73 @@
+package store_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"api/internal/model"
+	"api/internal/store"
+	"api/internal/testdb"
+)
+
+//eachBenchStore runs fn as a sub benchmark on the store of every database engine testdb can reach, the in memory
+//one is left out, it says nothing about a driver. compare runs with benchstat
+func eachBenchStore(b *testing.B, fn func(b *testing.B, s store.UserStore)) {
+	for _, driver := range testdb.Drivers {
+		b.Run(driver, func(b *testing.B) {
+			fn(b, openStore(b, testdb.New(b, driver)))
+		})
+	}
+}
+
+func BenchmarkCreate(b *testing.B) {
+	eachBenchStore(b, func(b *testing.B, s store.UserStore) {
+		ctx := context.Background()
+		i := 0
+		for b.Loop() {
+			i++
+			if _, err := s.Create(ctx, model.User{Name: "Ada", Email: fmt.Sprintf("ada%d@example.com", i)}, ""); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+//BenchmarkList reads the first page of 1000 users, the read the user list of the frontend makes
+func BenchmarkList(b *testing.B) {
+	eachBenchStore(b, func(b *testing.B, s store.UserStore) {
+		ctx := context.Background()
+		for i := range 1000 {
+			if _, err := s.Create(ctx, model.User{Name: fmt.Sprintf("User %d", i), Email: fmt.Sprintf("user%d@example.com", i)}, ""); err != nil {
+				b.Fatal(err)
+			}
+		}
+		for b.Loop() {
+			users, err := s.List(ctx, store.Filter{Sort: "name", Limit: 50})
+			if err != nil || len(users) != 50 {
+				b.Fatalf("listed %d users, %v", len(users), err)
+			}
+		}
+	})
+}
+
+//BenchmarkListParallel is BenchmarkList from many goroutines, what the connection pool and the statement cache are for
+func BenchmarkListParallel(b *testing.B) {
+	eachBenchStore(b, func(b *testing.B, s store.UserStore) {
+		ctx := context.Background()
+		for i := range 1000 {
+			if _, err := s.Create(ctx, model.User{Name: fmt.Sprintf("User %d", i), Email: fmt.Sprintf("user%d@example.com", i)}, ""); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := s.List(ctx, store.Filter{Sort: "name", Limit: 50}); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
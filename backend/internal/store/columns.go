@@ -0,0 +1,90 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"api/internal/model"
+)
+
+//UserColumns lists the columns ScanUser expects, in order. always select these explicitly instead of *.
+//the locale is null until the user picks one, see userLocale in internal/server
+const UserColumns = "id, uuid, public_id, name, email, COALESCE(username, ''), phone, COALESCE(locale, 'en'), timezone, COALESCE(avatar_key, ''), role, updated_at, " +
+	"email_verified_at IS NOT NULL, active, CASE WHEN pending_email_expires_at > now() THEN pending_email ELSE '' END, version, last_login_at"
+
+//RowScanner is implemented by both *sql.Row and *sql.Rows
+type RowScanner interface {
+	Scan(dest ...any) error
+}
+
+//ScanUser reads a row selected with UserColumns into u
+func ScanUser(row RowScanner, u *model.User) error {
+	var avatarKey string
+	err := row.Scan(&u.Id, &u.Uuid, &u.PublicId, &u.Name, &u.Email, &u.Username, &u.Phone, &u.Locale, &u.Timezone, &avatarKey, &u.Role, &u.UpdatedAt, &u.Verified, &u.Active, &u.PendingEmail, &u.Version, &u.LastLoginAt)
+	if err != nil {
+		return err
+	}
+	u.AvatarURL = model.AvatarPath(u.Uuid, avatarKey)
+	return nil
+}
+
+//QueryRower is implemented by both *sql.DB and *sql.Tx
+type QueryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+//EmailTaken reports whether another user than id already has the address
+func EmailTaken(ctx context.Context, q QueryRower, email string, id int64) (bool, error) {
+	var taken bool
+	err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE lower(email) = lower($1) AND id <> $2)", email, id).Scan(&taken)
+	if err != nil {
+		return false, fmt.Errorf("checking whether the email is taken: %w", err)
+	}
+	return taken, nil
+}
+
+//UsernameTaken reports whether another user than id already has the username, ignoring case. an empty one is never taken
+func UsernameTaken(ctx context.Context, q QueryRower, username string, id int64) (bool, error) {
+	if username == "" {
+		return false, nil
+	}
+	var taken bool
+	err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE lower(username) = lower($1) AND id <> $2)", username, id).Scan(&taken)
+	if err != nil {
+		return false, fmt.Errorf("checking whether the username is taken: %w", err)
+	}
+	return taken, nil
+}
+
+//duplicateError is the error for a write a unique index refused, which the checks above missed because the other
+//user was written at the same time. the databases name the index in their message
+func duplicateError(err error) error {
+	switch {
+	case strings.Contains(err.Error(), "users_username_key"):
+		return ErrUsernameTaken
+	//sqlite names the column instead of the index
+	case strings.Contains(err.Error(), "public_id"):
+		return errPublicIdTaken
+	}
+	return ErrEmailTaken
+}
+
+//errPublicIdTaken is a public id the database generated for a new user that another user has already. with 80 random
+//bits per millisecond it shouldnt ever happen, when it does the create is tried again with a new one
+var errPublicIdTaken = errors.New("the generated public id is taken")
+
+//publicIdAttempts is how often a create is tried when its public id is taken
+const publicIdAttempts = 3
+
+//retryPublicIdTaken runs create until it doesnt fail with errPublicIdTaken, at most publicIdAttempts times
+func retryPublicIdTaken(create func() (model.User, error)) (model.User, error) {
+	for attempt := 1; ; attempt++ {
+		u, err := create()
+		if !errors.Is(err, errPublicIdTaken) || attempt == publicIdAttempts {
+			return u, err
+		}
+	}
+}
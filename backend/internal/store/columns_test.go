@@ -0,0 +1,37 @@
+package store
+
+import (
+	"errors"
+	"testing"
+
+	"api/internal/model"
+)
+
+func TestRetryPublicIdTaken(t *testing.T) {
+	for _, tc := range []struct {
+		fails, calls int
+		err          error
+	}{
+		{0, 1, nil},
+		{2, 3, nil},
+		//a third collision in a row is given up on
+		{5, publicIdAttempts, errPublicIdTaken},
+	} {
+		calls := 0
+		u, err := retryPublicIdTaken(func() (model.User, error) {
+			calls++
+			if calls <= tc.fails {
+				return model.User{}, errPublicIdTaken
+			}
+			return model.User{Id: 1}, nil
+		})
+		if calls != tc.calls || !errors.Is(err, tc.err) || err == nil && u.Id != 1 {
+			t.Fatalf("%d collisions: %d calls, %v", tc.fails, calls, err)
+		}
+	}
+	//other errors arent retried
+	calls := 0
+	if _, err := retryPublicIdTaken(func() (model.User, error) { calls++; return model.User{}, ErrEmailTaken }); calls != 1 || err != ErrEmailTaken {
+		t.Fatalf("an email taken was tried %d times, %v", calls, err)
+	}
+}
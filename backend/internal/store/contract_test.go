@@ -0,0 +1,545 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"api/internal/model"
+	"api/internal/server"
+	"api/internal/store"
+	"api/internal/testdb"
+)
+
+//eachStore runs fn on every UserStore: the in memory one, and the one the server opens on each database engine,
+//migrated like it is at startup. the contract tests hold all of them to the same behavior
+func eachStore(t *testing.T, fn func(t *testing.T, s store.UserStore)) {
+	t.Run("memory", func(t *testing.T) {
+		fn(t, store.NewMemory())
+	})
+	testdb.Each(t, func(t *testing.T, db testdb.Database) {
+		fn(t, openStore(t, db))
+	})
+}
+
+//openStore is the UserStore the server opens on db, migrated like it is at startup
+func openStore(t testing.TB, db testdb.Database) store.UserStore {
+	t.Helper()
+	t.Setenv("DB_DRIVER", db.Driver)
+	t.Setenv("DATABASE_URL", db.URL)
+	t.Setenv("JWT_SECRET", "test-secret-test-secret-test-secret")
+	cfg, err := server.LoadConfig()
+	if err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+	logger := slog.New(slog.DiscardHandler)
+	conn, err := server.OpenDB(context.Background(), cfg, logger)
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	s, err := server.NewUserStore(context.Background(), cfg, conn, nil)
+	if err != nil {
+		t.Fatalf("preparing user store: %v", err)
+	}
+	if c, ok := s.(io.Closer); ok {
+		t.Cleanup(func() { c.Close() })
+	}
+	return s
+}
+
+func create(t *testing.T, s store.UserStore, name, email string) model.User {
+	t.Helper()
+	u, err := s.Create(context.Background(), model.User{Name: name, Email: email}, "")
+	if err != nil {
+		t.Fatalf("creating %s: %v", email, err)
+	}
+	return u
+}
+
+func TestCreateAndGet(t *testing.T) {
+	eachStore(t, func(t *testing.T, s store.UserStore) {
+		ctx := context.Background()
+		u := create(t, s, "Ada", "ada@example.com")
+		if u.Id == 0 || u.Uuid == "" || u.PublicId == "" {
+			t.Fatalf("created user without its ids: %+v", u)
+		}
+		if u.Version != 1 || u.Role != model.RoleMember || !u.Active || u.Verified {
+			t.Fatalf("created user with version %d, role %q, active %v, verified %v", u.Version, u.Role, u.Active, u.Verified)
+		}
+		if u.Locale != model.DefaultLocale || u.Timezone != model.DefaultTimezone {
+			t.Fatalf("created user with locale %q and timezone %q", u.Locale, u.Timezone)
+		}
+		got, err := s.Get(ctx, int64(u.Id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Id != u.Id || got.Name != "Ada" || got.Email != "ada@example.com" || got.Uuid != u.Uuid {
+			t.Fatalf("got %+v, created %+v", got, u)
+		}
+		byPublicId, err := s.GetByPublicId(ctx, u.PublicId)
+		if err != nil || byPublicId.Id != u.Id {
+			t.Fatalf("by public id got %+v, %v", byPublicId, err)
+		}
+		second := create(t, s, "Grace", "grace@example.com")
+		if second.Id <= u.Id {
+			t.Fatalf("second user has id %d after %d", second.Id, u.Id)
+		}
+	})
+}
+
+func TestMissingUser(t *testing.T) {
+	eachStore(t, func(t *testing.T, s store.UserStore) {
+		ctx := context.Background()
+		if _, err := s.Get(ctx, 42); !errors.Is(err, store.ErrUserNotFound) {
+			t.Fatalf("get: got %v", err)
+		}
+		if _, err := s.Update(ctx, 42, store.Update{Name: "Nobody"}); !errors.Is(err, store.ErrUserNotFound) {
+			t.Fatalf("update: got %v", err)
+		}
+		if _, err := s.Delete(ctx, 42, nil); !errors.Is(err, store.ErrUserNotFound) {
+			t.Fatalf("delete: got %v", err)
+		}
+	})
+}
+
+func TestEmailTaken(t *testing.T) {
+	eachStore(t, func(t *testing.T, s store.UserStore) {
+		ctx := context.Background()
+		create(t, s, "Ada", "ada@example.com")
+		grace := create(t, s, "Grace", "grace@example.com")
+		for _, email := range []string{"ada@example.com", "ADA@Example.com"} {
+			if _, err := s.Create(ctx, model.User{Name: "Copy", Email: email}, ""); !errors.Is(err, store.ErrEmailTaken) {
+				t.Fatalf("creating %s: got %v, want ErrEmailTaken", email, err)
+			}
+		}
+		if _, err := s.Update(ctx, int64(grace.Id), store.Update{Name: "Grace", Email: "ada@example.com"}); !errors.Is(err, store.ErrEmailTaken) {
+			t.Fatalf("updating to a taken email: got %v, want ErrEmailTaken", err)
+		}
+		//the refused writes left nothing behind
+		n, err := s.Count(ctx, store.Filter{})
+		if err != nil || n != 2 {
+			t.Fatalf("count got %d, %v", n, err)
+		}
+	})
+}
+
+func TestUsernameTaken(t *testing.T) {
+	eachStore(t, func(t *testing.T, s store.UserStore) {
+		ctx := context.Background()
+		if _, err := s.Create(ctx, model.User{Name: "Ada", Email: "ada@example.com", Username: "ada"}, ""); err != nil {
+			t.Fatal(err)
+		}
+		_, err := s.Create(ctx, model.User{Name: "Other", Email: "other@example.com", Username: "ada"}, "")
+		if !errors.Is(err, store.ErrUsernameTaken) {
+			t.Fatalf("got %v, want ErrUsernameTaken", err)
+		}
+	})
+}
+
+func TestUpdate(t *testing.T) {
+	eachStore(t, func(t *testing.T, s store.UserStore) {
+		ctx := context.Background()
+		u := create(t, s, "Ada", "ada@example.com")
+		phone := "+14155550100"
+		updated, err := s.Update(ctx, int64(u.Id), store.Update{Name: "Ada Lovelace", Email: u.Email, Role: model.RoleAdmin, Phone: &phone,
+			Locale: "fr", Timezone: "Europe/Paris", Match: &store.Match{Versions: []int64{int64(u.Version)}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated.Name != "Ada Lovelace" || updated.Role != model.RoleAdmin || updated.Phone == nil || *updated.Phone != phone ||
+			updated.Locale != "fr" || updated.Timezone != "Europe/Paris" {
+			t.Fatalf("updated to %+v", updated)
+		}
+		if updated.Version != u.Version+1 {
+			t.Fatalf("version %d after %d", updated.Version, u.Version)
+		}
+		//the version it was read at is gone
+		_, err = s.Update(ctx, int64(u.Id), store.Update{Name: "Stale", Email: u.Email, Match: &store.Match{Versions: []int64{int64(u.Version)}}})
+		if !errors.Is(err, store.ErrVersionChanged) {
+			t.Fatalf("stale update: got %v, want ErrVersionChanged", err)
+		}
+		if _, err := s.Delete(ctx, int64(u.Id), &store.Match{Versions: []int64{int64(u.Version)}}); !errors.Is(err, store.ErrVersionChanged) {
+			t.Fatalf("stale delete: got %v, want ErrVersionChanged", err)
+		}
+	})
+}
+
+func TestDelete(t *testing.T) {
+	eachStore(t, func(t *testing.T, s store.UserStore) {
+		ctx := context.Background()
+		u := create(t, s, "Ada", "ada@example.com")
+		deleted, err := s.Delete(ctx, int64(u.Id), &store.Match{Any: true})
+		if err != nil || deleted.Id != u.Id || deleted.Email != u.Email {
+			t.Fatalf("deleted %+v, %v", deleted, err)
+		}
+		if _, err := s.Get(ctx, int64(u.Id)); !errors.Is(err, store.ErrUserNotFound) {
+			t.Fatalf("get after delete: got %v", err)
+		}
+		//the address is free again
+		create(t, s, "Ada", "ada@example.com")
+	})
+}
+
+func TestListFilterAndSort(t *testing.T) {
+	eachStore(t, func(t *testing.T, s store.UserStore) {
+		ctx := context.Background()
+		carol := create(t, s, "Carol", "carol@b.example")
+		alice := create(t, s, "Alice", "alice@a.example")
+		bob := create(t, s, "Bob", "bob@a.example")
+		if _, err := s.Update(ctx, int64(bob.Id), store.Update{Name: bob.Name, Email: bob.Email, Role: model.RoleAdmin}); err != nil {
+			t.Fatal(err)
+		}
+		ids := func(f store.Filter) []model.ID {
+			t.Helper()
+			users, err := s.List(ctx, f)
+			if err != nil {
+				t.Fatalf("listing %+v: %v", f, err)
+			}
+			var ids []model.ID
+			for _, u := range users {
+				ids = append(ids, u.Id)
+			}
+			return ids
+		}
+		for _, c := range []struct {
+			filter store.Filter
+			want   []model.ID
+		}{
+			{store.Filter{}, []model.ID{carol.Id, alice.Id, bob.Id}},
+			{store.Filter{Sort: "name"}, []model.ID{alice.Id, bob.Id, carol.Id}},
+			{store.Filter{Sort: "-email"}, []model.ID{carol.Id, bob.Id, alice.Id}},
+			{store.Filter{Role: model.RoleAdmin}, []model.ID{bob.Id}},
+			{store.Filter{Search: "A.EXAMPLE"}, []model.ID{alice.Id, bob.Id}},
+			{store.Filter{Search: "A.EXAMPLE", SearchNamesOnly: true}, nil},
+			{store.Filter{Search: "o", SearchNamesOnly: true}, []model.ID{carol.Id, bob.Id}},
+			{store.Filter{Email: "Alice@A.example"}, []model.ID{alice.Id}},
+			{store.Filter{Sort: "name", Limit: 2, Offset: 1}, []model.ID{bob.Id, carol.Id}},
+			{store.Filter{AfterId: int64(carol.Id), Limit: 1}, []model.ID{alice.Id}},
+		} {
+			if got := ids(c.filter); !slices.Equal(got, c.want) {
+				t.Errorf("list %+v: got %v, want %v", c.filter, got, c.want)
+			}
+		}
+		n, err := s.Count(ctx, store.Filter{Search: "a.example", Limit: 1})
+		if err != nil || n != 2 {
+			t.Fatalf("count got %d, %v, want 2", n, err)
+		}
+		if _, err := s.List(ctx, store.Filter{Sort: "password_hash"}); !errors.Is(err, store.ErrInvalidSort) {
+			t.Fatalf("sorting by an unknown key: got %v, want ErrInvalidSort", err)
+		}
+	})
+}
+
+//TestSortedPagesDontOverlap walks the pages of sorts that many users are equal in, every user has to come exactly once
+//and the users without the nullable column last in either direction
+func TestSortedPagesDontOverlap(t *testing.T) {
+	eachStore(t, func(t *testing.T, s store.UserStore) {
+		ctx := context.Background()
+		for i := range 23 {
+			u := model.User{Name: []string{"Ada", "Bob", "Cy"}[i%3], Email: fmt.Sprintf("user%02d@example.com", i)}
+			if i%2 == 0 {
+				phone := fmt.Sprintf("+4144668180%d", i%4)
+				u.Phone = &phone
+			}
+			if _, err := s.Create(ctx, u, ""); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, sort := range []string{"name", "-name", "phone", "-phone", "name,-phone", "-name,-id"} {
+			all, err := s.List(ctx, store.Filter{Sort: sort})
+			if err != nil {
+				t.Fatalf("sort %s: %v", sort, err)
+			}
+			var walked []model.ID
+			for offset := 0; ; offset += 4 {
+				page, err := s.List(ctx, store.Filter{Sort: sort, Limit: 4, Offset: offset})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(page) == 0 {
+					break
+				}
+				for _, u := range page {
+					walked = append(walked, u.Id)
+				}
+			}
+			var want []model.ID
+			for _, u := range all {
+				want = append(want, u.Id)
+			}
+			seen := map[model.ID]bool{}
+			for _, id := range walked {
+				seen[id] = true
+			}
+			if len(walked) != 23 || len(seen) != 23 || !slices.Equal(walked, want) {
+				t.Fatalf("sort %s walked %v, the whole list is %v", sort, walked, want)
+			}
+
+			for i := 1; i < len(all); i++ {
+				a, b := all[i-1], all[i]
+				if strings.HasPrefix(sort, "-name") && a.Name < b.Name || strings.HasPrefix(sort, "name") && a.Name > b.Name {
+					t.Fatalf("sort %s put %s before %s", sort, a.Name, b.Name)
+				}
+				//the nulls come last among the users equal in the keys before the phone
+				if strings.HasSuffix(sort, "phone") && (sort != "name,-phone" || a.Name == b.Name) && a.Phone == nil && b.Phone != nil {
+					t.Fatalf("sort %s put a user without a phone before one with", sort)
+				}
+				//users equal in every key are in the order of their ids
+				if sortKey(sort, a) == sortKey(sort, b) && a.Id > b.Id {
+					t.Fatalf("sort %s put %d before %d", sort, a.Id, b.Id)
+				}
+			}
+		}
+	})
+}
+
+//TestSearchRanking seeds users matching "alice" in every way Searcher scores and checks the order of the results
+func TestSearchRanking(t *testing.T) {
+	eachStore(t, func(t *testing.T, s store.UserStore) {
+		ctx := context.Background()
+		searcher, ok := s.(store.Searcher)
+		if !ok {
+			t.Fatal("the store cant search")
+		}
+		carol := create(t, s, "Carol", "carol@alice.example")
+		alice := create(t, s, "Alice Smith", "alice@example.com")
+		bob := create(t, s, "Bob", "malice@example.com")
+		mary := create(t, s, "Mary Alice", "mary@example.com")
+		au := create(t, s, "Zed", "alice@example.com.au")
+		create(t, s, "Alicia", "alicia@example.com")
+		zoe := create(t, s, "Zoe", "zoe%@example.com")
+
+		type scored struct {
+			id    model.ID
+			score int
+		}
+		search := func(f store.Filter) []scored {
+			t.Helper()
+			users, err := searcher.Search(ctx, f)
+			if err != nil {
+				t.Fatalf("searching %+v: %v", f, err)
+			}
+			var got []scored
+			for _, u := range users {
+				got = append(got, scored{u.Id, u.Score})
+			}
+			return got
+		}
+		for _, c := range []struct {
+			filter store.Filter
+			want   []scored
+		}{
+			//the exact email first, then the email and the words of the names starting with it by name, then the rest
+			{store.Filter{Search: "Alice@Example.com"}, []scored{{alice.Id, 3}, {au.Id, 2}, {bob.Id, 1}}},
+			{store.Filter{Search: "alice"}, []scored{{alice.Id, 2}, {mary.Id, 2}, {au.Id, 2}, {bob.Id, 1}, {carol.Id, 1}}},
+			{store.Filter{Search: "alice", SearchNamesOnly: true}, []scored{{alice.Id, 2}, {mary.Id, 2}}},
+			{store.Filter{Search: "alice", Limit: 2, Offset: 2}, []scored{{au.Id, 2}, {bob.Id, 1}}},
+			{store.Filter{Search: "smith"}, []scored{{alice.Id, 2}}},
+			{store.Filter{Search: "ICE S"}, []scored{{alice.Id, 1}}},
+			//wildcards are searched for themselves
+			{store.Filter{Search: "%"}, []scored{{zoe.Id, 1}}},
+			{store.Filter{Search: "_"}, nil},
+		} {
+			if got := search(c.filter); !slices.Equal(got, c.want) {
+				t.Errorf("search %q: got %v, want %v", c.filter.Search, got, c.want)
+			}
+		}
+		n, err := s.Count(ctx, store.Filter{Search: "alice"})
+		if err != nil || n != 5 {
+			t.Fatalf("count got %d, %v, want 5", n, err)
+		}
+	})
+}
+
+//sortKey is what u is sorted by under sort, without the id tiebreaker
+func sortKey(sort string, u model.User) string {
+	phone := "null"
+	if u.Phone != nil {
+		phone = *u.Phone
+	}
+	switch strings.TrimPrefix(sort, "-") {
+	case "name":
+		return u.Name
+	case "phone":
+		return phone
+	case "name,-phone":
+		return u.Name + " " + phone
+	}
+	return fmt.Sprint(u.Id)
+}
+
+//TestConcurrentUpdateAndDelete hammers one user with updates and deletes. every answer has to be a state the row was
+//really in: an update sees its own name at a version nobody else got, and the one delete that wins answers the row as
+//the last update left it. run it with -race
+func TestConcurrentUpdateAndDelete(t *testing.T) {
+	eachStore(t, func(t *testing.T, s store.UserStore) {
+		ctx := context.Background()
+		u := create(t, s, "Ada", "ada@example.com")
+		const writers, deleters = 16, 4
+		type result struct {
+			user model.User
+			err  error
+		}
+		updates := make(chan result, writers)
+		deletes := make(chan result, deleters)
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := range writers {
+			wg.Go(func() {
+				<-start
+				updated, err := s.Update(ctx, int64(u.Id), store.Update{Name: fmt.Sprintf("Ada %d", i), Email: u.Email})
+				updates <- result{updated, err}
+			})
+		}
+		for range deleters {
+			wg.Go(func() {
+				<-start
+				deleted, err := s.Delete(ctx, int64(u.Id), &store.Match{Any: true})
+				deletes <- result{deleted, err}
+			})
+		}
+		close(start)
+		wg.Wait()
+		close(updates)
+		close(deletes)
+
+		last := u
+		versions := map[int]string{}
+		for r := range updates {
+			if errors.Is(r.err, store.ErrUserNotFound) {
+				continue
+			}
+			if r.err != nil {
+				t.Fatalf("update: %v", r.err)
+			}
+			if other, ok := versions[r.user.Version]; ok {
+				t.Fatalf("%q and %q both answered version %d", other, r.user.Name, r.user.Version)
+			}
+			versions[r.user.Version] = r.user.Name
+			if r.user.Version > last.Version {
+				last = r.user
+			}
+		}
+		var deleted []model.User
+		for r := range deletes {
+			if errors.Is(r.err, store.ErrUserNotFound) {
+				continue
+			}
+			if r.err != nil {
+				t.Fatalf("delete: %v", r.err)
+			}
+			deleted = append(deleted, r.user)
+		}
+		if len(deleted) != 1 {
+			t.Fatalf("%d deletes succeeded", len(deleted))
+		}
+		if deleted[0].Version != last.Version || deleted[0].Name != last.Name {
+			t.Fatalf("deleted %q at version %d, the last update left %q at version %d", deleted[0].Name, deleted[0].Version, last.Name, last.Version)
+		}
+		if _, err := s.Get(ctx, int64(u.Id)); !errors.Is(err, store.ErrUserNotFound) {
+			t.Fatalf("get after the deletes: got %v", err)
+		}
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	eachStore(t, func(t *testing.T, s store.UserStore) {
+		ctx := context.Background()
+		ada := create(t, s, "Ada", "ada@example.com")
+		grace := create(t, s, "Grace", "grace@example.com")
+		start := time.Now()
+		snapshot, err := s.(store.Snapshotter).Snapshot(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer snapshot.Close()
+		if at := snapshot.At(); at.Before(start.Add(-time.Millisecond)) || at.After(time.Now()) || at.Location() != time.UTC {
+			t.Fatalf("the snapshot taken at %v says %v", start, at)
+		}
+
+		//what is written after it was taken isnt in it
+		if _, err := s.Update(ctx, int64(ada.Id), store.Update{Name: "Ada Lovelace", Email: ada.Email}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Delete(ctx, int64(grace.Id), nil); err != nil {
+			t.Fatal(err)
+		}
+		create(t, s, "Linus", "linus@example.com")
+		names := func(users []model.User) string {
+			var s []string
+			for _, u := range users {
+				s = append(s, u.Name)
+			}
+			return strings.Join(s, ",")
+		}
+		users, err := snapshot.List(ctx, store.Filter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := names(users); got != "Ada,Grace" {
+			t.Fatalf("the snapshot lists %s", got)
+		}
+		var streamed []model.User
+		for u, err := range snapshot.Stream(ctx, store.Filter{Sort: "-name"}) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			streamed = append(streamed, u)
+		}
+		if got := names(streamed); got != "Grace,Ada" {
+			t.Fatalf("the snapshot streams %s", got)
+		}
+		if n, err := snapshot.Count(ctx, store.Filter{}); err != nil || n != 2 {
+			t.Fatalf("the snapshot counts %d, %v", n, err)
+		}
+		//the store has them
+		users, err = s.List(ctx, store.Filter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := names(users); got != "Ada Lovelace,Linus" {
+			t.Fatalf("the store lists %s", got)
+		}
+		if err := snapshot.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := snapshot.Close(); err != nil {
+			t.Fatalf("closing twice: %v", err)
+		}
+	})
+}
+
+func TestSnapshotEndsWithItsContext(t *testing.T) {
+	testdb.Each(t, func(t *testing.T, db testdb.Database) {
+		s := openStore(t, db)
+		create(t, s, "Ada", "ada@example.com")
+		ctx, cancel := context.WithCancel(context.Background())
+		snapshot, err := s.(store.Snapshotter).Snapshot(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+		//database/sql rolls the transaction back in the background, soon the snapshot cant be read anymore
+		deadline := time.Now().Add(time.Second)
+		for {
+			if _, err := snapshot.List(context.Background(), store.Filter{}); err != nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("a snapshot whose context ended is still read")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err := snapshot.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,28 @@
+package store
+
+import "slices"
+
+//Match is a parsed If-Match header
+//Any is set for "*", otherwise the write only goes ahead when the current version is one of Versions
+type Match struct {
+	Any      bool
+	Versions []int64
+}
+
+//acceptedVersions returns the versions a conditional write may find, nil when any version will do.
+//the postgres statements check it in the same statement as the write, so no other writer can sneak in between.
+//null skips the check there, so an empty list stays an empty array that matches no version
+func (m *Match) acceptedVersions() []int64 {
+	if m == nil || m.Any {
+		return nil
+	}
+	return append([]int64{}, m.Versions...)
+}
+
+//Matches reports whether a user at version meets the condition, for stores that check it themselves instead of in sql
+func (m *Match) Matches(version int) bool {
+	if m == nil || m.Any {
+		return true
+	}
+	return slices.Contains(m.Versions, int64(version))
+}
@@ -0,0 +1,361 @@
+package store
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"api/internal/model"
+)
+
+//Memory is a UserStore backed by a map, for tests and demos. it has no audit log or outbox
+//and keeps no passwords, so its users cant log in
+type Memory struct {
+	mu     sync.Mutex
+	users  map[int64]*memoryUser
+	nextId int64
+}
+
+//memoryUser is a stored user with the parts of its pending email change that User doesnt show
+type memoryUser struct {
+	model.User
+	pendingEmailTokenHash string
+	pendingEmailExpiresAt time.Time
+	createdAt             time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{users: map[int64]*memoryUser{}, nextId: 1}
+}
+
+//matches reports whether m is one of the users f lists, leaving Limit and Offset aside.
+//memory users cant log in, so they are inactive since they were created
+func (f Filter) matches(m *memoryUser) bool {
+	u := m.view()
+	switch {
+	case !u.Active && !f.IncludeInactive,
+		f.Role != "" && u.Role != f.Role,
+		f.Verified != nil && u.Verified != *f.Verified,
+		f.Search != "" && !strings.Contains(strings.ToLower(u.Name), strings.ToLower(f.Search)) &&
+			(f.SearchNamesOnly || !strings.Contains(u.Email, strings.ToLower(f.Search))),
+		f.Phone != "" && (u.Phone == nil || *u.Phone != f.Phone),
+		f.Email != "" && !strings.EqualFold(u.Email, f.Email),
+		int64(u.Id) <= f.AfterId,
+		!f.InactiveSince.IsZero() && !m.createdAt.Before(f.InactiveSince):
+		return false
+	}
+	return true
+}
+
+//memorySortOrder compares users like ORDER BY the columns of sortColumns does, for users that arent null in it
+var memorySortOrder = map[string]func(a, b model.User) int{
+	"id":         func(a, b model.User) int { return cmp.Compare(a.Id, b.Id) },
+	"name":       func(a, b model.User) int { return strings.Compare(a.Name, b.Name) },
+	"email":      func(a, b model.User) int { return strings.Compare(a.Email, b.Email) },
+	"role":       func(a, b model.User) int { return strings.Compare(a.Role, b.Role) },
+	"updated_at": func(a, b model.User) int { return a.UpdatedAt.Compare(b.UpdatedAt) },
+	"phone":      func(a, b model.User) int { return strings.Compare(*a.Phone, *b.Phone) },
+	"username":   func(a, b model.User) int { return strings.Compare(a.Username, b.Username) },
+}
+
+//memorySortNull reports whether u is null in a nullable column of sortColumns
+var memorySortNull = map[string]func(u model.User) bool{
+	"phone":    func(u model.User) bool { return u.Phone == nil },
+	"username": func(u model.User) bool { return u.Username == "" },
+}
+
+//compareUsers orders a and b by fields, with the nulls last in either direction like orderSQL
+func compareUsers(fields []sortField, a, b model.User) int {
+	for _, f := range fields {
+		if isNull, ok := memorySortNull[f.key]; ok {
+			switch aNull, bNull := isNull(a), isNull(b); {
+			case aNull && bNull:
+				continue
+			case aNull:
+				return 1
+			case bNull:
+				return -1
+			}
+		}
+		c := memorySortOrder[f.key](a, b)
+		if f.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func (s *Memory) List(ctx context.Context, f Filter) ([]model.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users := []model.User{}
+	for _, m := range s.users {
+		if f.matches(m) {
+			users = append(users, m.view())
+		}
+	}
+	fields, err := parseSort(f.Sort)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(users, func(a, b model.User) int { return compareUsers(fields, a, b) })
+
+	users = users[min(f.Offset, len(users)):]
+	if f.Limit > 0 && len(users) > f.Limit {
+		users = users[:f.Limit]
+	}
+	return users, nil
+}
+
+//Search scores the users like searchUsers, comparing names ignoring case the way lower() does
+func (s *Memory) Search(ctx context.Context, f Filter) ([]model.ScoredUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	search := strings.ToLower(f.Search)
+	users := []model.ScoredUser{}
+	for _, m := range s.users {
+		if !f.matches(m) {
+			continue
+		}
+		u := m.view()
+		name := strings.ToLower(u.Name)
+		score := scoreSubstring
+		email := u.Email
+		if f.SearchNamesOnly {
+			email = ""
+		}
+		switch {
+		case email != "" && email == search:
+			score = scoreExactEmail
+		case email != "" && strings.HasPrefix(email, search), strings.HasPrefix(name, search), strings.Contains(name, " "+search):
+			score = scorePrefix
+		}
+		users = append(users, model.ScoredUser{User: u, Score: score})
+	}
+	slices.SortFunc(users, func(a, b model.ScoredUser) int {
+		if a.Score != b.Score {
+			return b.Score - a.Score
+		}
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Id, b.Id)
+	})
+
+	users = users[min(f.Offset, len(users)):]
+	if f.Limit > 0 && len(users) > f.Limit {
+		users = users[:f.Limit]
+	}
+	return users, nil
+}
+
+func (s *Memory) Count(ctx context.Context, f Filter) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, m := range s.users {
+		if f.matches(m) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *Memory) Get(ctx context.Context, id int64) (model.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.lookup(id)
+	if !ok {
+		return model.User{}, ErrUserNotFound
+	}
+	return m.view(), nil
+}
+
+func (s *Memory) Create(ctx context.Context, u model.User, passwordHash string) (model.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.emailTaken(u.Email, 0) {
+		return model.User{}, ErrEmailTaken
+	}
+	if s.usernameTaken(u.Username, 0) {
+		return model.User{}, ErrUsernameTaken
+	}
+	if u.Role == "" {
+		u.Role = model.RoleMember
+	}
+	u.Locale, u.Timezone = cmp.Or(u.Locale, model.DefaultLocale), cmp.Or(u.Timezone, model.DefaultTimezone)
+	u.Id, u.Password, u.Active, u.Verified, u.PendingEmail = model.ID(s.nextId), "", true, false, ""
+	u.Uuid, u.PublicId, u.Phone, u.Version, u.UpdatedAt = uuid.NewString(), s.newPublicId(), storedPhone(u.Phone), 1, time.Now()
+	s.users[int64(u.Id)] = &memoryUser{User: u, createdAt: u.UpdatedAt}
+	s.nextId++
+	return u, nil
+}
+
+func (s *Memory) Update(ctx context.Context, id int64, change Update) (model.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.update(id, change)
+}
+
+//update is Update for a caller that holds s.mu
+func (s *Memory) update(id int64, change Update) (model.User, error) {
+	m, ok := s.lookup(id)
+	if !ok {
+		return model.User{}, ErrUserNotFound
+	}
+	if s.emailTaken(change.Email, int64(m.Id)) {
+		return model.User{}, ErrEmailTaken
+	}
+	if s.usernameTaken(change.Username, int64(m.Id)) {
+		return model.User{}, ErrUsernameTaken
+	}
+	if !change.Match.Matches(m.Version) {
+		return model.User{}, ErrVersionChanged
+	}
+	m.Name = change.Name
+	if change.Role != "" {
+		m.Role = change.Role
+	}
+	if change.Username != "" {
+		m.Username = change.Username
+	}
+	if change.Phone != nil {
+		m.Phone = storedPhone(change.Phone)
+	}
+	m.Locale, m.Timezone = cmp.Or(change.Locale, m.Locale), cmp.Or(change.Timezone, m.Timezone)
+	//like in postgres the current address stays until the new one is confirmed
+	if !strings.EqualFold(m.Email, change.Email) {
+		m.PendingEmail = change.Email
+		m.pendingEmailTokenHash = change.EmailTokenHash
+		m.pendingEmailExpiresAt = change.PendingEmailExpiresAt
+	}
+	m.Version++
+	m.UpdatedAt = time.Now()
+	return m.view(), nil
+}
+
+func (s *Memory) Upsert(ctx context.Context, n int64, change Update) (model.User, bool, error) {
+	if n < 1 {
+		return model.User{}, false, ErrUserNotFound
+	}
+	change.Match = nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.users[n]; exists {
+		u, err := s.update(n, change)
+		return u, false, err
+	}
+	if s.emailTaken(change.Email, n) {
+		return model.User{}, false, ErrEmailTaken
+	}
+	if s.usernameTaken(change.Username, n) {
+		return model.User{}, false, ErrUsernameTaken
+	}
+	u := model.User{Id: model.ID(n), Uuid: uuid.NewString(), PublicId: s.newPublicId(), Name: change.Name, Email: change.Email, Username: change.Username, Phone: storedPhone(change.Phone),
+		Locale: cmp.Or(change.Locale, model.DefaultLocale), Timezone: cmp.Or(change.Timezone, model.DefaultTimezone), Role: change.Role, Active: true, Version: 1, UpdatedAt: time.Now()}
+	if u.Role == "" {
+		u.Role = model.RoleMember
+	}
+	s.users[n] = &memoryUser{User: u, createdAt: u.UpdatedAt}
+	//later creates must not pick the id
+	s.nextId = max(s.nextId, n+1)
+	return u, true, nil
+}
+
+func (s *Memory) Delete(ctx context.Context, id int64, match *Match) (model.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.lookup(id)
+	if !ok {
+		return model.User{}, ErrUserNotFound
+	}
+	if !match.Matches(m.Version) {
+		return model.User{}, ErrVersionChanged
+	}
+	if !IsDryRun(ctx) {
+		delete(s.users, int64(m.Id))
+	}
+	return m.view(), nil
+}
+
+//GetByPublicId looks at every user, there is no index to find it by
+func (s *Memory) GetByPublicId(ctx context.Context, publicId string) (model.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.users {
+		if m.PublicId == publicId {
+			return m.view(), nil
+		}
+	}
+	return model.User{}, ErrUserNotFound
+}
+
+//newPublicId returns a public id no user has yet, generating another one when it is taken like the databases do.
+//the caller holds s.mu
+func (s *Memory) newPublicId() string {
+	for {
+		id := model.NewPublicId(time.Now())
+		taken := false
+		for _, m := range s.users {
+			taken = taken || m.PublicId == id
+		}
+		if !taken {
+			return id
+		}
+	}
+}
+
+//lookup finds the user with the given id, the caller holds s.mu
+func (s *Memory) lookup(id int64) (*memoryUser, bool) {
+	m, ok := s.users[id]
+	return m, ok
+}
+
+//emailTaken reports whether a user other than exceptId has the address, the caller holds s.mu
+func (s *Memory) emailTaken(email string, exceptId int64) bool {
+	for _, m := range s.users {
+		if int64(m.Id) != exceptId && strings.EqualFold(m.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+//usernameTaken reports whether a user other than exceptId has the username, the caller holds s.mu. an empty one is never taken
+func (s *Memory) usernameTaken(username string, exceptId int64) bool {
+	if username == "" {
+		return false
+	}
+	for _, m := range s.users {
+		if int64(m.Id) != exceptId && strings.EqualFold(m.Username, username) {
+			return true
+		}
+	}
+	return false
+}
+
+//storedPhone is the phone as the databases keep it, nil instead of empty. it is copied so the caller cant change it later
+func storedPhone(phone *string) *string {
+	if phone == nil || *phone == "" {
+		return nil
+	}
+	p := *phone
+	return &p
+}
+
+//view is the user as UserColumns reads it, with a pending email only until it expires
+func (m *memoryUser) view() model.User {
+	u := m.User
+	if !m.pendingEmailExpiresAt.After(time.Now()) {
+		u.PendingEmail = ""
+	}
+	return u
+}
@@ -0,0 +1,261 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"iter"
+
+	"github.com/go-sql-driver/mysql"
+
+	"api/internal/model"
+)
+
+//MySQL keeps the users in mysql or mariadb. its queries are written with mysql's ? placeholders, so it works on any
+//*sql.DB of go-sql-driver/mysql opened with parseTime and a utc session. there is no RETURNING, rows are read back
+//after writing in the same transaction.
+//OnChange is optional, it is called inside the transaction of every change like for Postgres
+type MySQL struct {
+	DB       *sql.DB
+	OnChange ChangeHook
+}
+
+//error numbers of mysql: a write that a unique key refused, and a transaction rolled back to break a deadlock
+const (
+	mysqlDuplicateEntry = 1062
+	mysqlDeadlock       = 1213
+)
+
+func (s *MySQL) List(ctx context.Context, f Filter) ([]model.User, error) {
+	return collectUsers(s.Stream(ctx, f))
+}
+
+func (s *MySQL) Stream(ctx context.Context, f Filter) iter.Seq2[model.User, error] {
+	query, args, err := listUsers(mysqlDialect, UserColumns, f)
+	if err != nil {
+		return failedUsers(err)
+	}
+	return scanUsers(func() (*sql.Rows, error) { return s.DB.QueryContext(ctx, query, args...) }, ScanUser)
+}
+
+func (s *MySQL) Search(ctx context.Context, f Filter) ([]model.ScoredUser, error) {
+	query, args := searchUsers(mysqlDialect, UserColumns, f)
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("searching users: %w", err)
+	}
+	return scanScoredUsers(rows, ScanUser)
+}
+
+func (s *MySQL) Count(ctx context.Context, f Filter) (int, error) {
+	query, args := countUsers(mysqlDialect, f)
+	var n int
+	if err := s.DB.QueryRowContext(ctx, query, args...).Scan(&n); err != nil {
+		return 0, fmt.Errorf("counting users: %w", err)
+	}
+	return n, nil
+}
+
+func (s *MySQL) Get(ctx context.Context, id int64) (model.User, error) {
+	if !validUserId(id) {
+		return model.User{}, ErrUserNotFound
+	}
+	u, err := s.get(ctx, s.DB, id, "")
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return model.User{}, fmt.Errorf("loading user: %w", err)
+	}
+	return u, nil
+}
+
+//get reads the user with q, lock is appended to the query (FOR UPDATE or nothing)
+func (s *MySQL) get(ctx context.Context, q QueryRower, id int64, lock string) (model.User, error) {
+	var u model.User
+	err := ScanUser(q.QueryRowContext(ctx, "SELECT "+UserColumns+" FROM users WHERE id = ?"+lock, id), &u)
+	return u, err
+}
+
+//emailTaken is EmailTaken with mysql's placeholders
+func (s *MySQL) emailTaken(ctx context.Context, q QueryRower, email string, id int64) (bool, error) {
+	var taken bool
+	err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE lower(email) = lower(?) AND id <> ?)", email, id).Scan(&taken)
+	if err != nil {
+		return false, fmt.Errorf("checking whether the email is taken: %w", err)
+	}
+	return taken, nil
+}
+
+//usernameTaken is UsernameTaken with mysql's placeholders
+func (s *MySQL) usernameTaken(ctx context.Context, q QueryRower, username string, id int64) (bool, error) {
+	if username == "" {
+		return false, nil
+	}
+	var taken bool
+	err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE username = ? AND id <> ?)", username, id).Scan(&taken)
+	if err != nil {
+		return false, fmt.Errorf("checking whether the username is taken: %w", err)
+	}
+	return taken, nil
+}
+
+func (s *MySQL) GetByPublicId(ctx context.Context, publicId string) (model.User, error) {
+	var u model.User
+	err := ScanUser(s.DB.QueryRowContext(ctx, "SELECT "+UserColumns+" FROM users WHERE public_id = ?", publicId), &u)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return model.User{}, fmt.Errorf("loading user: %w", err)
+	}
+	return u, nil
+}
+
+//Create is tried again when the public id the database generated is taken, see retryPublicIdTaken
+func (s *MySQL) Create(ctx context.Context, u model.User, passwordHash string) (model.User, error) {
+	return retryPublicIdTaken(func() (model.User, error) { return s.create(ctx, u, passwordHash) })
+}
+
+func (s *MySQL) create(ctx context.Context, u model.User, passwordHash string) (model.User, error) {
+	var created model.User
+	err := inTx(ctx, s.DB, func(tx *sql.Tx) error {
+		taken, err := s.emailTaken(ctx, tx, u.Email, 0)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrEmailTaken
+		}
+		if taken, err = s.usernameTaken(ctx, tx, u.Username, 0); err != nil {
+			return err
+		}
+		if taken {
+			return ErrUsernameTaken
+		}
+		res, err := tx.ExecContext(ctx, `INSERT INTO users (name, email, password_hash, role, username, phone, locale, timezone)
+			VALUES (?, ?, NULLIF(?, ''), COALESCE(NULLIF(?, ''), 'member'), NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), COALESCE(NULLIF(?, ''), 'UTC'))`,
+			u.Name, u.Email, passwordHash, u.Role, u.Username, u.Phone, u.Locale, u.Timezone)
+		//the checks above can miss a user created at the same time, the unique keys on email and username cant
+		if isMySQLDuplicate(err) {
+			return duplicateError(err)
+		}
+		if err != nil {
+			return fmt.Errorf("creating user: %w", err)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("creating user: %w", err)
+		}
+		if created, err = s.get(ctx, tx, id, ""); err != nil {
+			return fmt.Errorf("loading created user: %w", err)
+		}
+		return s.changed(ctx, tx, nil, &created)
+	})
+	if err != nil {
+		return model.User{}, err
+	}
+	return created, nil
+}
+
+func (s *MySQL) Update(ctx context.Context, id int64, change Update) (model.User, error) {
+	if !validUserId(id) {
+		return model.User{}, ErrUserNotFound
+	}
+	var updated model.User
+	err := inTx(ctx, s.DB, func(tx *sql.Tx) error {
+		taken, err := s.emailTaken(ctx, tx, change.Email, id)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrEmailTaken
+		}
+		if taken, err = s.usernameTaken(ctx, tx, change.Username, id); err != nil {
+			return err
+		}
+		if taken {
+			return ErrUsernameTaken
+		}
+		//the row stays locked until commit, so the version checked here is still the current one when the update runs
+		before, err := s.get(ctx, tx, id, " FOR UPDATE")
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("loading user: %w", err)
+		}
+		if !change.Match.Matches(before.Version) {
+			return ErrVersionChanged
+		}
+
+		//a request for another new address replaces the token of the previous one, so only the latest link works
+		pendingExpiresAt := change.PendingEmailExpiresAt.UTC()
+		_, err = tx.ExecContext(ctx, `UPDATE users SET name = ?,
+			pending_email = CASE WHEN lower(email) = ? THEN pending_email ELSE ? END,
+			pending_email_token_hash = CASE WHEN lower(email) = ? THEN pending_email_token_hash ELSE ? END,
+			pending_email_expires_at = CASE WHEN lower(email) = ? THEN pending_email_expires_at ELSE ? END,
+			role = COALESCE(NULLIF(?, ''), role), username = COALESCE(NULLIF(?, ''), username),
+			phone = CASE WHEN ? IS NULL THEN phone ELSE NULLIF(?, '') END,
+			locale = COALESCE(NULLIF(?, ''), locale), timezone = COALESCE(NULLIF(?, ''), timezone), version = version + 1, updated_at = now(6)
+			WHERE id = ?`, change.Name, change.Email, change.Email, change.Email, change.EmailTokenHash, change.Email, pendingExpiresAt, change.Role, change.Username,
+			change.Phone, change.Phone, change.Locale, change.Timezone, id)
+		if isMySQLDuplicate(err) {
+			return duplicateError(err)
+		}
+		if err != nil {
+			return fmt.Errorf("updating user: %w", err)
+		}
+		if updated, err = s.get(ctx, tx, id, ""); err != nil {
+			return fmt.Errorf("loading updated user: %w", err)
+		}
+		return s.changed(ctx, tx, &before, &updated)
+	})
+	if err != nil {
+		return model.User{}, err
+	}
+	return updated, nil
+}
+
+func (s *MySQL) Delete(ctx context.Context, id int64, match *Match) (model.User, error) {
+	if !validUserId(id) {
+		return model.User{}, ErrUserNotFound
+	}
+	var deleted model.User
+	err := inTx(ctx, s.DB, func(tx *sql.Tx) error {
+		var err error
+		deleted, err = s.get(ctx, tx, id, " FOR UPDATE")
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("loading user: %w", err)
+		}
+		if !match.Matches(deleted.Version) {
+			return ErrVersionChanged
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM users WHERE id = ?", id); err != nil {
+			return fmt.Errorf("deleting user: %w", err)
+		}
+		return s.changed(ctx, tx, &deleted, nil)
+	})
+	if err != nil {
+		return model.User{}, err
+	}
+	return deleted, nil
+}
+
+//changed calls OnChange when there is one
+func (s *MySQL) changed(ctx context.Context, tx *sql.Tx, before, after *model.User) error {
+	if s.OnChange == nil {
+		return nil
+	}
+	return s.OnChange(ctx, tx, before, after)
+}
+
+//isMySQLDuplicate reports whether err is mysql refusing a duplicate in a unique key
+func isMySQLDuplicate(err error) bool {
+	var myErr *mysql.MySQLError
+	return errors.As(err, &myErr) && myErr.Number == mysqlDuplicateEntry
+}
@@ -0,0 +1,436 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"iter"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"api/internal/model"
+)
+
+//Postgres is the UserStore the server runs on, made with NewPostgres.
+//onChange writes every change to the audit log and the outbox in the same transaction, so neither can disagree with the data
+type Postgres struct {
+	DB       *sql.DB
+	OnChange ChangeHook
+	//Replica is an optional read replica of DB. List and Get read from it, the writes and what they read go to DB.
+	//a replica that fails is left alone for replicaRetryAfter and the reads go to DB meanwhile.
+	//the replica lags a little behind, a user that was just created can be missing there for a moment
+	Replica *sql.DB
+	//replicaDownUntil is when the replica is tried again after it failed, in unix nanoseconds
+	replicaDownUntil atomic.Int64
+
+	//the statements every request runs, prepared once by NewPostgres instead of parsed again for each call.
+	//database/sql prepares them again by itself on connections that dont have them yet, like new ones after a reset
+	getStmt, lockStmt, insertStmt, updateStmt, deleteStmt *sql.Stmt
+}
+
+const getUserQuery = "SELECT " + UserColumns + " FROM users WHERE id = $1"
+
+//NewPostgres prepares the statements of the store on db, Close releases them
+func NewPostgres(ctx context.Context, db *sql.DB, onChange ChangeHook) (*Postgres, error) {
+	s := &Postgres{DB: db, OnChange: onChange}
+	for _, p := range []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&s.getStmt, getUserQuery},
+		{&s.lockStmt, "SELECT " + UserColumns + " FROM users WHERE id = $1 FOR UPDATE"},
+		//returning: postresql feature that return the columns of the newly inserted row, e.g. the generated id
+		//an empty role falls back to member, an empty username and locale are null, an empty timezone is utc
+		{&s.insertStmt, `INSERT INTO users (name, email, password_hash, role, username, phone, locale, timezone)
+			VALUES ($1, $2, NULLIF($3, ''), COALESCE(NULLIF($4, ''), 'member'), NULLIF($5, ''), NULLIF($6, ''), NULLIF($7, ''), COALESCE(NULLIF($8, ''), 'UTC')) RETURNING ` + UserColumns},
+		//a request for another new address replaces the token of the previous one, so only the latest link works.
+		//the versions are null for an unconditional update, see acceptedVersions
+		{&s.updateStmt, `UPDATE users SET name = $1,
+			pending_email = CASE WHEN lower(email) = $2 THEN pending_email ELSE $2 END,
+			pending_email_token_hash = CASE WHEN lower(email) = $2 THEN pending_email_token_hash ELSE $5 END,
+			pending_email_expires_at = CASE WHEN lower(email) = $2 THEN pending_email_expires_at ELSE $6 END,
+			role = COALESCE(NULLIF($4, ''), role), username = COALESCE(NULLIF($8, ''), username),
+			phone = CASE WHEN $9::text IS NULL THEN phone ELSE NULLIF($9, '') END,
+			locale = COALESCE(NULLIF($10, ''), locale), timezone = COALESCE(NULLIF($11, ''), timezone), version = version + 1, updated_at = now()
+			WHERE id = $3 AND ($7::bigint[] IS NULL OR version = ANY($7)) RETURNING ` + UserColumns},
+		{&s.deleteStmt, "DELETE FROM users WHERE id = $1 AND ($2::bigint[] IS NULL OR version = ANY($2)) RETURNING " + UserColumns},
+	} {
+		stmt, err := db.PrepareContext(ctx, p.query)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("preparing user statements: %w", err)
+		}
+		*p.stmt = stmt
+	}
+	return s, nil
+}
+
+//Close releases the prepared statements, the store cant be used afterwards
+func (s *Postgres) Close() error {
+	var errs []error
+	for _, stmt := range []*sql.Stmt{s.getStmt, s.lockStmt, s.insertStmt, s.updateStmt, s.deleteStmt} {
+		if stmt != nil {
+			errs = append(errs, stmt.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+//replicaRetryAfter is how long the reads stay on the primary after the replica failed
+const replicaRetryAfter = 30 * time.Second
+
+//dbExecutor is what the reads run their queries on, the primary or the replica
+type dbExecutor interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+//read runs fn on the replica when there is one and it is up, otherwise or when it fails on DB.
+//not finding a row is an answer, not a failure of the replica
+func (s *Postgres) read(ctx context.Context, what string, fn func(q dbExecutor) error) error {
+	if s.Replica == nil || time.Now().UnixNano() < s.replicaDownUntil.Load() {
+		return fn(s.DB)
+	}
+	err := fn(s.Replica)
+	if err == nil || errors.Is(err, sql.ErrNoRows) || ctx.Err() != nil {
+		return err
+	}
+	s.replicaDownUntil.Store(time.Now().Add(replicaRetryAfter).UnixNano())
+	slog.WarnContext(ctx, "reading from the database replica failed, reading from the primary for a while", "query", what, "retry_after", replicaRetryAfter.String(), "error", err)
+	return fn(s.DB)
+}
+
+//Stream reads from the replica like List. a replica that fails before the first user falls back to DB, once users were
+//handed out a failure ends the sequence instead, they cant be taken back
+func (s *Postgres) Stream(ctx context.Context, f Filter) iter.Seq2[model.User, error] {
+	query, args, err := listUsers(postgresDialect, UserColumns, f)
+	if err != nil {
+		return failedUsers(err)
+	}
+	return scanUsers(func() (rows *sql.Rows, err error) {
+		err = s.read(ctx, "stream users", func(q dbExecutor) error {
+			rows, err = q.QueryContext(ctx, query, args...)
+			return err
+		})
+		return rows, err
+	}, ScanUser)
+}
+
+func (s *Postgres) List(ctx context.Context, f Filter) ([]model.User, error) {
+	query, args, err := listUsers(postgresDialect, UserColumns, f)
+	if err != nil {
+		return nil, err
+	}
+	var users []model.User
+	err = s.read(ctx, "list users", func(q dbExecutor) error {
+		rows, err := q.QueryContext(ctx, query, args...)
+		if err != nil {
+			return fmt.Errorf("listing users: %w", err)
+		}
+		defer rows.Close()
+		users = []model.User{}
+		for rows.Next() {
+			var u model.User
+			if err := ScanUser(rows, &u); err != nil {
+				return fmt.Errorf("scanning user: %w", err)
+			}
+			users = append(users, u)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("listing users: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+//Search reads from the replica like List
+func (s *Postgres) Search(ctx context.Context, f Filter) ([]model.ScoredUser, error) {
+	query, args := searchUsers(postgresDialect, UserColumns, f)
+	var users []model.ScoredUser
+	err := s.read(ctx, "search users", func(q dbExecutor) error {
+		rows, err := q.QueryContext(ctx, query, args...)
+		if err != nil {
+			return fmt.Errorf("searching users: %w", err)
+		}
+		users, err = scanScoredUsers(rows, ScanUser)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *Postgres) Count(ctx context.Context, f Filter) (int, error) {
+	query, args := countUsers(postgresDialect, f)
+	var n int
+	err := s.read(ctx, "count users", func(q dbExecutor) error {
+		if err := q.QueryRowContext(ctx, query, args...).Scan(&n); err != nil {
+			return fmt.Errorf("counting users: %w", err)
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (s *Postgres) Get(ctx context.Context, id int64) (model.User, error) {
+	if !validUserId(id) {
+		return model.User{}, ErrUserNotFound
+	}
+	var u model.User
+	err := s.read(ctx, "get user", func(q dbExecutor) error {
+		//the statement is prepared on the primary, the replica gets the query
+		if q == dbExecutor(s.DB) {
+			return ScanUser(s.getStmt.QueryRowContext(ctx, id), &u)
+		}
+		return ScanUser(q.QueryRowContext(ctx, getUserQuery, id), &u)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return model.User{}, fmt.Errorf("loading user: %w", err)
+	}
+	return u, nil
+}
+
+//GetByPublicId reads from the replica like Get, the unique index on public_id finds the row
+func (s *Postgres) GetByPublicId(ctx context.Context, publicId string) (model.User, error) {
+	var u model.User
+	err := s.read(ctx, "get user by public id", func(q dbExecutor) error {
+		return ScanUser(q.QueryRowContext(ctx, "SELECT "+UserColumns+" FROM users WHERE public_id = $1", publicId), &u)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return model.User{}, fmt.Errorf("loading user: %w", err)
+	}
+	return u, nil
+}
+
+//Create is tried again when the public id the database generated is taken, see retryPublicIdTaken
+func (s *Postgres) Create(ctx context.Context, u model.User, passwordHash string) (model.User, error) {
+	return retryPublicIdTaken(func() (model.User, error) { return s.create(ctx, u, passwordHash) })
+}
+
+func (s *Postgres) create(ctx context.Context, u model.User, passwordHash string) (model.User, error) {
+	var created model.User
+	err := inTx(ctx, s.DB, func(tx *sql.Tx) error {
+		taken, err := EmailTaken(ctx, tx, u.Email, 0)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrEmailTaken
+		}
+		if taken, err = UsernameTaken(ctx, tx, u.Username, 0); err != nil {
+			return err
+		}
+		if taken {
+			return ErrUsernameTaken
+		}
+		//insert new row into users table with the specified name and email values
+		err = ScanUser(tx.StmtContext(ctx, s.insertStmt).QueryRowContext(ctx, u.Name, u.Email, passwordHash, u.Role, u.Username, u.Phone, u.Locale, u.Timezone), &created)
+		//the checks above can miss a user created at the same time, the unique indexes cant
+		if IsUniqueViolation(err) {
+			return duplicateError(err)
+		}
+		if err != nil {
+			return fmt.Errorf("creating user: %w", err)
+		}
+		return s.OnChange(ctx, tx, nil, &created)
+	})
+	if err != nil {
+		return model.User{}, err
+	}
+	return created, nil
+}
+
+//Update changes the user and writes the change to the audit log (OnChange) in one transaction,
+//the user is locked from the first read to the commit so no other write can come in between
+func (s *Postgres) Update(ctx context.Context, id int64, change Update) (model.User, error) {
+	if !validUserId(id) {
+		return model.User{}, ErrUserNotFound
+	}
+	var updated model.User
+	err := inTx(ctx, s.DB, func(tx *sql.Tx) error {
+		taken, err := EmailTaken(ctx, tx, change.Email, id)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrEmailTaken
+		}
+		if taken, err = UsernameTaken(ctx, tx, change.Username, id); err != nil {
+			return err
+		}
+		if taken {
+			return ErrUsernameTaken
+		}
+		var before model.User
+		err = ScanUser(tx.StmtContext(ctx, s.lockStmt).QueryRowContext(ctx, id), &before)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("loading user: %w", err)
+		}
+
+		//execute the update and read the row back in one statement. returning gives back the updated columns,
+		//so there is no gap between the update and a re-read where another writer could sneak in
+		//if the version doesnt match no row comes back and scan returns sql.ErrNoRows
+		err = ScanUser(tx.StmtContext(ctx, s.updateStmt).QueryRowContext(ctx, change.Name, change.Email, id, change.Role, change.EmailTokenHash,
+			change.PendingEmailExpiresAt, change.Match.acceptedVersions(), change.Username, change.Phone, change.Locale, change.Timezone), &updated)
+		if errors.Is(err, sql.ErrNoRows) {
+			return s.conditionalMiss(ctx, id, change.Match)
+		}
+		if IsUniqueViolation(err) {
+			return duplicateError(err)
+		}
+		if err != nil {
+			return fmt.Errorf("updating user: %w", err)
+		}
+		return s.OnChange(ctx, tx, &before, &updated)
+	})
+	if err != nil {
+		return model.User{}, err
+	}
+	return updated, nil
+}
+
+func (s *Postgres) Delete(ctx context.Context, id int64, match *Match) (model.User, error) {
+	if !validUserId(id) {
+		return model.User{}, ErrUserNotFound
+	}
+	var deleted model.User
+	err := inTx(ctx, s.DB, func(tx *sql.Tx) error {
+		//a single statement instead of select then delete, so the row cant vanish between two queries
+		//returning: only gives back a row if something was actually deleted, and the deleted state goes to the audit log
+		err := ScanUser(tx.StmtContext(ctx, s.deleteStmt).QueryRowContext(ctx, id, match.acceptedVersions()), &deleted)
+		if errors.Is(err, sql.ErrNoRows) {
+			return s.conditionalMiss(ctx, id, match)
+		}
+		if err != nil {
+			return fmt.Errorf("deleting user: %w", err)
+		}
+		return s.OnChange(ctx, tx, &deleted, nil)
+	})
+	if err != nil {
+		return model.User{}, err
+	}
+	return deleted, nil
+}
+
+func (s *Postgres) Upsert(ctx context.Context, id int64, change Update) (model.User, bool, error) {
+	if !validUserId(id) {
+		return model.User{}, false, ErrUserNotFound
+	}
+	var (
+		after   model.User
+		created bool
+	)
+	err := inTx(ctx, s.DB, func(tx *sql.Tx) error {
+		taken, err := EmailTaken(ctx, tx, change.Email, id)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrEmailTaken
+		}
+		if taken, err = UsernameTaken(ctx, tx, change.Username, id); err != nil {
+			return err
+		}
+		if taken {
+			return ErrUsernameTaken
+		}
+		//the user as it was for the audit log, nil when it doesnt exist yet
+		var current model.User
+		before := &current
+		err = ScanUser(tx.StmtContext(ctx, s.lockStmt).QueryRowContext(ctx, id), &current)
+		if errors.Is(err, sql.ErrNoRows) {
+			before = nil
+		} else if err != nil {
+			return fmt.Errorf("loading user: %w", err)
+		}
+
+		//an existing user is updated like Update does, a new address stays pending until confirmed.
+		//xmax is 0 only on a row the statement inserted
+		row := tx.QueryRowContext(ctx, `INSERT INTO users (id, name, email, role, username, phone, locale, timezone)
+			VALUES ($1, $2, $3, COALESCE(NULLIF($4, ''), 'member'), NULLIF($7, ''), NULLIF($8, ''), NULLIF($9, ''), COALESCE(NULLIF($10, ''), 'UTC'))
+			ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name,
+			pending_email = CASE WHEN lower(users.email) = $3 THEN users.pending_email ELSE $3 END,
+			pending_email_token_hash = CASE WHEN lower(users.email) = $3 THEN users.pending_email_token_hash ELSE $5 END,
+			pending_email_expires_at = CASE WHEN lower(users.email) = $3 THEN users.pending_email_expires_at ELSE $6 END,
+			role = COALESCE(NULLIF($4, ''), users.role), username = COALESCE(EXCLUDED.username, users.username),
+			phone = CASE WHEN $8::text IS NULL THEN users.phone ELSE EXCLUDED.phone END, locale = COALESCE(EXCLUDED.locale, users.locale),
+			timezone = CASE WHEN $10 = '' THEN users.timezone ELSE EXCLUDED.timezone END, version = users.version + 1, updated_at = now()
+			RETURNING `+UserColumns+", xmax = 0", id, change.Name, change.Email, change.Role, change.EmailTokenHash, change.PendingEmailExpiresAt, change.Username, change.Phone,
+			change.Locale, change.Timezone)
+		if err := ScanUser(withColumn{row, &created}, &after); err != nil {
+			return fmt.Errorf("upserting user: %w", err)
+		}
+		//another upsert created the user between the select and the insert, its state before this change is unknown
+		if before == nil && !created {
+			return ErrVersionChanged
+		}
+		if created {
+			//the id didnt come from the sequence, move it past the id so later creates dont pick it again.
+			//nextval makes sure the sequence only ever moves forward
+			if _, err := tx.ExecContext(ctx, "SELECT setval(pg_get_serial_sequence('users', 'id'), GREATEST(nextval(pg_get_serial_sequence('users', 'id')), $1))", id); err != nil {
+				return fmt.Errorf("advancing the user id sequence: %w", err)
+			}
+		}
+		return s.OnChange(ctx, tx, before, &after)
+	})
+	if err != nil {
+		return model.User{}, false, err
+	}
+	return after, created, nil
+}
+
+//withColumn scans one more column after the ones ScanUser reads
+type withColumn struct {
+	row  RowScanner
+	dest any
+}
+
+func (w withColumn) Scan(dest ...any) error {
+	return w.row.Scan(append(dest, w.dest)...)
+}
+
+//conditionalMiss explains a conditional write that matched no row:
+//either the user doesnt exist or its version has moved on since the client read it
+func (s *Postgres) conditionalMiss(ctx context.Context, id int64, m *Match) error {
+	if m == nil || m.Any {
+		return ErrUserNotFound
+	}
+	var exists bool
+	if err := s.DB.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", id).Scan(&exists); err != nil {
+		return fmt.Errorf("checking user exists: %w", err)
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+	return ErrVersionChanged
+}
+
+//IsUndefinedColumn reports whether err is postgres refusing a query for a column the table doesnt have
+func IsUndefinedColumn(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UndefinedColumn
+}
+
+//validUserId reports whether id can be a user id at all, the serials start at 1
+func validUserId(id int64) bool {
+	return id > 0
+}
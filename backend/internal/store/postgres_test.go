@@ -0,0 +1,97 @@
+package store_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	_ "github.com/jackc/pgx/v5/stdlib"
+
+	"api/internal/model"
+	"api/internal/store"
+	"api/internal/testdb"
+)
+
+//TestPreparedStatementsSurviveDroppedConnections kills every connection of the store in the middle of its use, like a
+//failover or a restart of postgres does. a call on a connection that was killed under it may fail, the ones after it
+//run the prepared statements again on new connections
+func TestPreparedStatementsSurviveDroppedConnections(t *testing.T) {
+	db := testdb.New(t, "postgres")
+	s := openStore(t, db)
+	ctx := context.Background()
+	u := create(t, s, "Ada", "ada@example.com")
+
+	admin, err := sql.Open("pgx", db.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	for round := range 3 {
+		var killed int
+		if err := admin.QueryRow("SELECT count(pg_terminate_backend(pid)) FROM pg_stat_activity WHERE datname = current_database() AND pid <> pg_backend_pid()").Scan(&killed); err != nil {
+			t.Fatal(err)
+		}
+		if killed == 0 {
+			t.Fatal("the store had no connection to kill")
+		}
+		name := fmt.Sprintf("Ada %d", round)
+		var updated model.User
+		for attempt := 0; ; attempt++ {
+			updated, err = s.Update(ctx, int64(u.Id), store.Update{Name: name, Email: u.Email})
+			if err == nil {
+				break
+			}
+			//every killed connection of the pool fails once at most
+			if attempt > killed {
+				t.Fatalf("round %d: the store doesnt recover from dropped connections: %v", round, err)
+			}
+		}
+		for range 5 {
+			got, err := s.Get(ctx, int64(u.Id))
+			if err != nil || got.Name != name || got.Version != updated.Version {
+				t.Fatalf("round %d: got %+v, %v", round, got, err)
+			}
+		}
+	}
+}
+
+//BenchmarkGet reads a user by id with the prepared statement of the store and, as unprepared, with the same query
+//parsed again for every call, the difference is what preparing saves a request
+func BenchmarkGet(b *testing.B) {
+	db := testdb.New(b, "postgres")
+	s := openStore(b, db)
+	ctx := context.Background()
+	u, err := s.Create(ctx, model.User{Name: "Ada", Email: "ada@example.com"}, "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("prepared", func(b *testing.B) {
+		for b.Loop() {
+			if _, err := s.Get(ctx, int64(u.Id)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("unprepared", func(b *testing.B) {
+		conn, err := sql.Open("pgx", db.URL)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+		//pgx caches the statements it is sent by default, which would prepare them as well. in exec mode the query is
+		//parsed again every time
+		query := "SELECT " + store.UserColumns + " FROM users WHERE id = $1"
+		for b.Loop() {
+			rows, err := conn.QueryContext(ctx, query, pgx.QueryExecModeExec, u.Id)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if !rows.Next() {
+				b.Fatal("the user is gone")
+			}
+			rows.Close()
+		}
+	})
+}
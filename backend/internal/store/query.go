@@ -0,0 +1,334 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"iter"
+	"strconv"
+	"strings"
+
+	"api/internal/model"
+)
+
+//ErrInvalidSort is a Filter.Sort that isnt made of SortKeys
+var ErrInvalidSort = errors.New("invalid sort")
+
+//sortColumn is a column List can sort by. the nulls of a nullable one come last in either direction
+type sortColumn struct {
+	column   string
+	nullable bool
+}
+
+//sortColumns are the columns List can sort by, keyed by the name in Filter.Sort. only these ever end up in ORDER BY,
+//a sort key from a request is looked up here and never put into the sql itself
+var sortColumns = map[string]sortColumn{
+	"id":         {column: "id"},
+	"name":       {column: "name"},
+	"email":      {column: "email"},
+	"role":       {column: "role"},
+	"updated_at": {column: "updated_at"},
+	"phone":      {column: "phone", nullable: true},
+	"username":   {column: "username", nullable: true},
+}
+
+//SortKeys are the names Filter.Sort takes, for error messages and documentation
+func SortKeys() []string {
+	return []string{"id", "name", "email", "role", "updated_at", "phone", "username"}
+}
+
+//dialect is what the sql of the list queries differs in between the databases
+type dialect struct {
+	//placeholder is the parameter marker of the nth argument, counting from 1
+	placeholder func(n int) string
+	//equalFold is the condition that the text column equals value ignoring case
+	equalFold func(column, value string) string
+	//noLimit is a LIMIT that doesnt limit anything, OFFSET needs one before it in sqlite and mysql
+	noLimit string
+	//nullsLast is the ORDER BY term of a nullable column in direction with its nulls at the end
+	nullsLast func(column, direction string) string
+}
+
+var (
+	postgresDialect = dialect{
+		placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+		equalFold:   func(column, value string) string { return "lower(" + column + ") = lower(" + value + ")" },
+		noLimit:     "ALL",
+		nullsLast:   func(column, direction string) string { return column + " " + direction + " NULLS LAST" },
+	}
+	//sqlite takes $n like postgres
+	sqliteDialect = dialect{
+		placeholder: postgresDialect.placeholder,
+		equalFold:   postgresDialect.equalFold,
+		noLimit:     "-1",
+		nullsLast:   postgresDialect.nullsLast,
+	}
+	//mysql compares text ignoring case already, lower() would keep it from using the email index.
+	//it has no NULLS LAST, sorting by IS NULL first puts them there
+	mysqlDialect = dialect{
+		placeholder: func(int) string { return "?" },
+		equalFold:   func(column, value string) string { return column + " = " + value },
+		noLimit:     "18446744073709551615",
+		nullsLast:   func(column, direction string) string { return column + " IS NULL, " + column + " " + direction },
+	}
+)
+
+//query builds the WHERE, ORDER BY and LIMIT of a list query. values only go into the sql as placeholders, and the
+//identifiers come from the code or from sortColumns. mysql numbers nothing, so the parts have to be built in the order
+//they appear in the statement: conditions first, then the order, then the page
+type query struct {
+	d     dialect
+	conds []string
+	args  []any
+}
+
+//bind adds v to the arguments and returns its placeholder
+func (q *query) bind(v any) string {
+	q.args = append(q.args, v)
+	return q.d.placeholder(len(q.args))
+}
+
+//where adds a condition, it is joined to the others with AND
+func (q *query) where(cond string) {
+	q.conds = append(q.conds, cond)
+}
+
+//whereSQL is the WHERE clause with a space in front, empty without conditions
+func (q *query) whereSQL() string {
+	if len(q.conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(q.conds, " AND ")
+}
+
+//sortField is one key of a Filter.Sort and its direction
+type sortField struct {
+	key  string
+	desc bool
+}
+
+//parseSort splits a Filter.Sort like "name" or "role,-updated_at" into its keys, a - in front of one sorts it
+//descending. the users are sorted by id after the keys unless id is one of them, so users that are equal in every key
+//still come in the same order on every page. an empty sort is by id. ErrInvalidSort is a key that isnt in sortColumns,
+//one that is there twice or an empty one
+func parseSort(sort string) ([]sortField, error) {
+	if sort == "" {
+		return []sortField{{key: "id"}}, nil
+	}
+	var fields []sortField
+	byId := false
+	for item := range strings.SplitSeq(sort, ",") {
+		key, desc := strings.CutPrefix(strings.TrimSpace(item), "-")
+		if _, ok := sortColumns[key]; !ok {
+			return nil, fmt.Errorf("%w %q, sort by one or more of %s separated by commas", ErrInvalidSort, key, strings.Join(SortKeys(), ", "))
+		}
+		for _, f := range fields {
+			if f.key == key {
+				return nil, fmt.Errorf("%w, %s is in it twice", ErrInvalidSort, key)
+			}
+		}
+		fields = append(fields, sortField{key: key, desc: desc})
+		byId = byId || key == "id"
+	}
+	if !byId {
+		fields = append(fields, sortField{key: "id"})
+	}
+	return fields, nil
+}
+
+//orderSQL is the ORDER BY clause for a Filter.Sort, see parseSort
+func (q *query) orderSQL(sort string) (string, error) {
+	fields, err := parseSort(sort)
+	if err != nil {
+		return "", err
+	}
+	terms := make([]string, len(fields))
+	for i, f := range fields {
+		direction := "ASC"
+		if f.desc {
+			direction = "DESC"
+		}
+		c := sortColumns[f.key]
+		if c.nullable {
+			terms[i] = q.d.nullsLast(c.column, direction)
+		} else {
+			terms[i] = c.column + " " + direction
+		}
+	}
+	return " ORDER BY " + strings.Join(terms, ", "), nil
+}
+
+//pageSQL is the LIMIT and OFFSET for a page, 0 for limit is no limit. empty when nothing is skipped or cut
+func (q *query) pageSQL(limit, offset int) string {
+	if limit == 0 && offset == 0 {
+		return ""
+	}
+	page := " LIMIT " + q.d.noLimit
+	if limit > 0 {
+		page = " LIMIT " + q.bind(limit)
+	}
+	if offset > 0 {
+		page += " OFFSET " + q.bind(offset)
+	}
+	return page
+}
+
+//likeEscape escapes the wildcards of s for a LIKE with ESCAPE '!', the one escape character all three databases read
+//the same way. a backslash would need escaping itself in mysql's string literals
+func likeEscape(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
+
+//filterUsers is a query with the conditions of f, List and Count share it
+func filterUsers(d dialect, f Filter) *query {
+	q := &query{d: d}
+	q.filter(f)
+	return q
+}
+
+//filter adds the conditions of f. the search is a LIKE rather than strpos so the trigram indexes of postgres serve it
+func (q *query) filter(f Filter) {
+	if !f.IncludeInactive {
+		q.where("active")
+	}
+	if f.Role != "" {
+		q.where("role = " + q.bind(f.Role))
+	}
+	if f.Verified != nil {
+		if *f.Verified {
+			q.where("email_verified_at IS NOT NULL")
+		} else {
+			q.where("email_verified_at IS NULL")
+		}
+	}
+	if f.Search != "" {
+		//emails are stored in lower case already
+		search := "%" + likeEscape(strings.ToLower(f.Search)) + "%"
+		if f.SearchNamesOnly {
+			q.where("lower(name) LIKE " + q.bind(search) + " ESCAPE '!'")
+		} else {
+			q.where("(lower(name) LIKE " + q.bind(search) + " ESCAPE '!' OR email LIKE " + q.bind(search) + " ESCAPE '!')")
+		}
+	}
+	if f.Phone != "" {
+		q.where("phone = " + q.bind(f.Phone))
+	}
+	if f.Email != "" {
+		q.where(q.d.equalFold("email", q.bind(f.Email)))
+	}
+	if !f.InactiveSince.IsZero() {
+		since := q.bind(f.InactiveSince.UTC())
+		q.where("(COALESCE(last_login_at, created_at) IS NULL OR COALESCE(last_login_at, created_at) < " + since + ")")
+	}
+	if f.AfterId > 0 {
+		q.where("id > " + q.bind(f.AfterId))
+	}
+}
+
+//listUsers is the SELECT of List with columns and its arguments
+func listUsers(d dialect, columns string, f Filter) (string, []any, error) {
+	q := filterUsers(d, f)
+	where := q.whereSQL()
+	order, err := q.orderSQL(f.Sort)
+	if err != nil {
+		return "", nil, err
+	}
+	page := q.pageSQL(f.Limit, f.Offset)
+	return "SELECT " + columns + " FROM users" + where + order + page, q.args, nil
+}
+
+//the scores of Search, from the best match down
+const (
+	scoreExactEmail = 3
+	scorePrefix     = 2
+	scoreSubstring  = 1
+)
+
+//searchUsers is the SELECT of Search with columns and the score after them, and its arguments. the score is
+//scoreExactEmail when the search is the whole email address, scorePrefix when the email, the name or a word of the name
+//starts with it and scoreSubstring for the rest of the users the search of f matches. the best scores come first, equal
+//ones by name and id so pages dont overlap. with f.SearchNamesOnly only the names score. f.Sort is ignored
+func searchUsers(d dialect, columns string, f Filter) (string, []any) {
+	q := &query{d: d}
+	search := likeEscape(strings.ToLower(f.Search))
+	score := "CASE"
+	if !f.SearchNamesOnly {
+		score += " WHEN " + d.equalFold("email", q.bind(f.Search)) + " THEN " + strconv.Itoa(scoreExactEmail) +
+			" WHEN email LIKE " + q.bind(search+"%") + " ESCAPE '!' THEN " + strconv.Itoa(scorePrefix)
+	}
+	score += " WHEN lower(name) LIKE " + q.bind(search+"%") + " ESCAPE '!'" +
+		" OR lower(name) LIKE " + q.bind("% "+search+"%") + " ESCAPE '!' THEN " + strconv.Itoa(scorePrefix) +
+		" ELSE " + strconv.Itoa(scoreSubstring) + " END"
+	q.filter(f)
+	where := q.whereSQL()
+	page := q.pageSQL(f.Limit, f.Offset)
+	return "SELECT " + columns + ", " + score + " AS score FROM users" + where + " ORDER BY score DESC, name, id" + page, q.args
+}
+
+//countUsers is the SELECT of Count and its arguments
+func countUsers(d dialect, f Filter) (string, []any) {
+	q := filterUsers(d, f)
+	return "SELECT count(*) FROM users" + q.whereSQL(), q.args
+}
+
+//scanUsers yields the users of the rows open returns, read with scan. the rows are closed when the loop ends,
+//whether it read them all or not
+func scanUsers(open func() (*sql.Rows, error), scan func(RowScanner, *model.User) error) iter.Seq2[model.User, error] {
+	return func(yield func(model.User, error) bool) {
+		rows, err := open()
+		if err != nil {
+			yield(model.User{}, fmt.Errorf("listing users: %w", err))
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var u model.User
+			if err := scan(rows, &u); err != nil {
+				yield(model.User{}, fmt.Errorf("scanning user: %w", err))
+				return
+			}
+			if !yield(u, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(model.User{}, fmt.Errorf("listing users: %w", err))
+		}
+	}
+}
+
+//scanScoredUsers reads the rows of searchUsers with scan and closes them
+func scanScoredUsers(rows *sql.Rows, scan func(RowScanner, *model.User) error) ([]model.ScoredUser, error) {
+	defer rows.Close()
+	users := []model.ScoredUser{}
+	for rows.Next() {
+		var u model.ScoredUser
+		if err := scan(withColumn{row: rows, dest: &u.Score}, &u.User); err != nil {
+			return nil, fmt.Errorf("scanning user: %w", err)
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("searching users: %w", err)
+	}
+	return users, nil
+}
+
+//failedUsers is a sequence of nothing but err, for a Stream whose query cant even be built
+func failedUsers(err error) iter.Seq2[model.User, error] {
+	return func(yield func(model.User, error) bool) {
+		yield(model.User{}, err)
+	}
+}
+
+//collectUsers reads all of seq into a slice, List is Stream collected
+func collectUsers(seq iter.Seq2[model.User, error]) ([]model.User, error) {
+	users := []model.User{}
+	for u, err := range seq {
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
@@ -0,0 +1,130 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"iter"
+	"time"
+
+	"api/internal/model"
+)
+
+//snapshotTxOptions is the transaction a snapshot of the sql stores is read in. REPEATABLE READ reads every statement
+//from the snapshot the first one took, in postgres and in mysql. sqlite ignores the level, a read transaction of
+//sqlite sees one point in time anyway
+var snapshotTxOptions = &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+
+//sqlSnapshot is the Snapshot of the sql stores, a read only transaction
+type sqlSnapshot struct {
+	tx      *sql.Tx
+	d       dialect
+	columns string
+	scan    func(RowScanner, *model.User) error
+	at      time.Time
+}
+
+//beginSnapshot starts the transaction of a snapshot on db and reads a row right away, so it is taken now and not with
+//the first list: postgres takes it with the first statement, mysql with the first read of a table
+func beginSnapshot(ctx context.Context, db *sql.DB, d dialect, columns string, scan func(RowScanner, *model.User) error) (*sqlSnapshot, error) {
+	tx, err := db.BeginTx(ctx, snapshotTxOptions)
+	if err != nil {
+		return nil, fmt.Errorf("starting snapshot transaction: %w", err)
+	}
+	at := time.Now().UTC()
+	var id int64
+	err = tx.QueryRowContext(ctx, "SELECT id FROM users ORDER BY id LIMIT 1").Scan(&id)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		tx.Rollback()
+		return nil, fmt.Errorf("taking snapshot: %w", err)
+	}
+	return &sqlSnapshot{tx: tx, d: d, columns: columns, scan: scan, at: at}, nil
+}
+
+func (s *sqlSnapshot) List(ctx context.Context, f Filter) ([]model.User, error) {
+	return collectUsers(s.Stream(ctx, f))
+}
+
+func (s *sqlSnapshot) Stream(ctx context.Context, f Filter) iter.Seq2[model.User, error] {
+	query, args, err := listUsers(s.d, s.columns, f)
+	if err != nil {
+		return failedUsers(err)
+	}
+	return scanUsers(func() (*sql.Rows, error) { return s.tx.QueryContext(ctx, query, args...) }, s.scan)
+}
+
+func (s *sqlSnapshot) Count(ctx context.Context, f Filter) (int, error) {
+	query, args := countUsers(s.d, f)
+	var n int
+	if err := s.tx.QueryRowContext(ctx, query, args...).Scan(&n); err != nil {
+		return 0, fmt.Errorf("counting users: %w", err)
+	}
+	return n, nil
+}
+
+func (s *sqlSnapshot) At() time.Time {
+	return s.at
+}
+
+//Close rolls the transaction back, nothing was written in it. closing a snapshot whose context ended already does nothing
+func (s *sqlSnapshot) Close() error {
+	if err := s.tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+		return err
+	}
+	return nil
+}
+
+//Snapshot reads from DB and never from the replica, its pages are meant to agree with the writes that came before
+func (s *Postgres) Snapshot(ctx context.Context) (Snapshot, error) {
+	return beginSnapshot(ctx, s.DB, postgresDialect, UserColumns, ScanUser)
+}
+
+func (s *MySQL) Snapshot(ctx context.Context) (Snapshot, error) {
+	return beginSnapshot(ctx, s.DB, mysqlDialect, UserColumns, ScanUser)
+}
+
+func (s *SQLite) Snapshot(ctx context.Context) (Snapshot, error) {
+	return beginSnapshot(ctx, s.DB, sqliteDialect, sqliteUserColumns, scanSQLiteUser)
+}
+
+//memorySnapshot is the Snapshot of Memory, a copy of its users that nothing writes to
+type memorySnapshot struct {
+	*Memory
+	at time.Time
+}
+
+//Snapshot copies the users, ctx doesnt matter to a copy
+func (s *Memory) Snapshot(ctx context.Context) (Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users := make(map[int64]*memoryUser, len(s.users))
+	for id, m := range s.users {
+		c := *m
+		c.User = m.User.Clone()
+		users[id] = &c
+	}
+	return memorySnapshot{Memory: &Memory{users: users, nextId: s.nextId}, at: time.Now().UTC()}, nil
+}
+
+func (s memorySnapshot) Stream(ctx context.Context, f Filter) iter.Seq2[model.User, error] {
+	users, err := s.List(ctx, f)
+	if err != nil {
+		return failedUsers(err)
+	}
+	return func(yield func(model.User, error) bool) {
+		for _, u := range users {
+			if !yield(u, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (s memorySnapshot) At() time.Time {
+	return s.at
+}
+
+func (s memorySnapshot) Close() error {
+	return nil
+}
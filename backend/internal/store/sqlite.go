@@ -0,0 +1,252 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"iter"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+
+	"api/internal/model"
+)
+
+//SQLite keeps the users in a sqlite database, for running the server locally without postgres.
+//it answers like Postgres does, the differences are only in the sql: sqlite has no now() of its own (the server registers one), no FOR UPDATE and no arrays.
+//OnChange is optional here, it is called inside the transaction of every change like for Postgres
+type SQLite struct {
+	DB       *sql.DB
+	OnChange ChangeHook
+}
+
+//sqliteUserColumns is UserColumns without now(), the pending email is dropped in scanSQLiteUser once it expired
+const sqliteUserColumns = "id, uuid, public_id, name, email, COALESCE(username, ''), phone, COALESCE(locale, 'en'), timezone, COALESCE(avatar_key, ''), role, updated_at, " +
+	"email_verified_at IS NOT NULL, active, COALESCE(pending_email, ''), pending_email_expires_at, version, last_login_at"
+
+//scanSQLiteUser reads a row selected with sqliteUserColumns into u
+func scanSQLiteUser(row RowScanner, u *model.User) error {
+	var avatarKey string
+	var pendingExpiresAt sql.NullTime
+	err := row.Scan(&u.Id, &u.Uuid, &u.PublicId, &u.Name, &u.Email, &u.Username, &u.Phone, &u.Locale, &u.Timezone, &avatarKey, &u.Role, &u.UpdatedAt, &u.Verified, &u.Active, &u.PendingEmail, &pendingExpiresAt, &u.Version, &u.LastLoginAt)
+	if err != nil {
+		return err
+	}
+	if !pendingExpiresAt.Valid || !pendingExpiresAt.Time.After(time.Now()) {
+		u.PendingEmail = ""
+	}
+	u.AvatarURL = model.AvatarPath(u.Uuid, avatarKey)
+	return nil
+}
+
+func (s *SQLite) List(ctx context.Context, f Filter) ([]model.User, error) {
+	return collectUsers(s.Stream(ctx, f))
+}
+
+func (s *SQLite) Stream(ctx context.Context, f Filter) iter.Seq2[model.User, error] {
+	query, args, err := listUsers(sqliteDialect, sqliteUserColumns, f)
+	if err != nil {
+		return failedUsers(err)
+	}
+	return scanUsers(func() (*sql.Rows, error) { return s.DB.QueryContext(ctx, query, args...) }, scanSQLiteUser)
+}
+
+func (s *SQLite) Search(ctx context.Context, f Filter) ([]model.ScoredUser, error) {
+	query, args := searchUsers(sqliteDialect, sqliteUserColumns, f)
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("searching users: %w", err)
+	}
+	return scanScoredUsers(rows, scanSQLiteUser)
+}
+
+func (s *SQLite) Count(ctx context.Context, f Filter) (int, error) {
+	query, args := countUsers(sqliteDialect, f)
+	var n int
+	if err := s.DB.QueryRowContext(ctx, query, args...).Scan(&n); err != nil {
+		return 0, fmt.Errorf("counting users: %w", err)
+	}
+	return n, nil
+}
+
+func (s *SQLite) Get(ctx context.Context, id int64) (model.User, error) {
+	if !validUserId(id) {
+		return model.User{}, ErrUserNotFound
+	}
+	u, err := s.get(ctx, s.DB, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return model.User{}, fmt.Errorf("loading user: %w", err)
+	}
+	return u, nil
+}
+
+//get reads the user with q. the writes read the row back with it instead of RETURNING, whose columns sqlite
+//hands out without their declared type, so the driver couldnt turn the timestamps into times
+func (s *SQLite) get(ctx context.Context, q QueryRower, id int64) (model.User, error) {
+	var u model.User
+	err := scanSQLiteUser(q.QueryRowContext(ctx, "SELECT "+sqliteUserColumns+" FROM users WHERE id = $1", id), &u)
+	return u, err
+}
+
+func (s *SQLite) GetByPublicId(ctx context.Context, publicId string) (model.User, error) {
+	var u model.User
+	err := scanSQLiteUser(s.DB.QueryRowContext(ctx, "SELECT "+sqliteUserColumns+" FROM users WHERE public_id = $1", publicId), &u)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return model.User{}, fmt.Errorf("loading user: %w", err)
+	}
+	return u, nil
+}
+
+//Create is tried again when the public id the database generated is taken, see retryPublicIdTaken
+func (s *SQLite) Create(ctx context.Context, u model.User, passwordHash string) (model.User, error) {
+	return retryPublicIdTaken(func() (model.User, error) { return s.create(ctx, u, passwordHash) })
+}
+
+func (s *SQLite) create(ctx context.Context, u model.User, passwordHash string) (model.User, error) {
+	var created model.User
+	err := inTx(ctx, s.DB, func(tx *sql.Tx) error {
+		taken, err := EmailTaken(ctx, tx, u.Email, 0)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrEmailTaken
+		}
+		if taken, err = UsernameTaken(ctx, tx, u.Username, 0); err != nil {
+			return err
+		}
+		if taken {
+			return ErrUsernameTaken
+		}
+		res, err := tx.ExecContext(ctx, `INSERT INTO users (name, email, password_hash, role, updated_at, username, phone, locale, timezone)
+			VALUES ($1, $2, NULLIF($3, ''), COALESCE(NULLIF($4, ''), 'member'), $5, NULLIF($6, ''), NULLIF($7, ''), NULLIF($8, ''), COALESCE(NULLIF($9, ''), 'UTC'))`,
+			u.Name, u.Email, passwordHash, u.Role, time.Now().UTC(), u.Username, u.Phone, u.Locale, u.Timezone)
+		if isSQLiteDuplicate(err) {
+			return duplicateError(err)
+		}
+		if err != nil {
+			return fmt.Errorf("creating user: %w", err)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("creating user: %w", err)
+		}
+		if created, err = s.get(ctx, tx, id); err != nil {
+			return fmt.Errorf("loading created user: %w", err)
+		}
+		return s.changed(ctx, tx, nil, &created)
+	})
+	if err != nil {
+		return model.User{}, err
+	}
+	return created, nil
+}
+
+//Update runs in a transaction that holds sqlite's write lock from its start (see _txlock in server.OpenDB),
+//which does what FOR UPDATE does for postgres
+func (s *SQLite) Update(ctx context.Context, id int64, change Update) (model.User, error) {
+	if !validUserId(id) {
+		return model.User{}, ErrUserNotFound
+	}
+	var updated model.User
+	err := inTx(ctx, s.DB, func(tx *sql.Tx) error {
+		taken, err := EmailTaken(ctx, tx, change.Email, id)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrEmailTaken
+		}
+		if taken, err = UsernameTaken(ctx, tx, change.Username, id); err != nil {
+			return err
+		}
+		if taken {
+			return ErrUsernameTaken
+		}
+		before, err := s.get(ctx, tx, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("loading user: %w", err)
+		}
+		if !change.Match.Matches(before.Version) {
+			return ErrVersionChanged
+		}
+
+		//a request for another new address replaces the token of the previous one, so only the latest link works
+		_, err = tx.ExecContext(ctx, `UPDATE users SET name = $1,
+			pending_email = CASE WHEN lower(email) = $2 THEN pending_email ELSE $2 END,
+			pending_email_token_hash = CASE WHEN lower(email) = $2 THEN pending_email_token_hash ELSE $5 END,
+			pending_email_expires_at = CASE WHEN lower(email) = $2 THEN pending_email_expires_at ELSE $6 END,
+			role = COALESCE(NULLIF($4, ''), role), username = COALESCE(NULLIF($8, ''), username),
+			phone = CASE WHEN $9 IS NULL THEN phone ELSE NULLIF($9, '') END,
+			locale = COALESCE(NULLIF($10, ''), locale), timezone = COALESCE(NULLIF($11, ''), timezone), version = version + 1, updated_at = $7
+			WHERE id = $3`, change.Name, change.Email, id, change.Role, change.EmailTokenHash, change.PendingEmailExpiresAt.UTC(), time.Now().UTC(), change.Username, change.Phone,
+			change.Locale, change.Timezone)
+		if isSQLiteDuplicate(err) {
+			return duplicateError(err)
+		}
+		if err != nil {
+			return fmt.Errorf("updating user: %w", err)
+		}
+		if updated, err = s.get(ctx, tx, id); err != nil {
+			return fmt.Errorf("loading updated user: %w", err)
+		}
+		return s.changed(ctx, tx, &before, &updated)
+	})
+	if err != nil {
+		return model.User{}, err
+	}
+	return updated, nil
+}
+
+func (s *SQLite) Delete(ctx context.Context, id int64, match *Match) (model.User, error) {
+	if !validUserId(id) {
+		return model.User{}, ErrUserNotFound
+	}
+	var deleted model.User
+	err := inTx(ctx, s.DB, func(tx *sql.Tx) error {
+		var err error
+		deleted, err = s.get(ctx, tx, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("loading user: %w", err)
+		}
+		if !match.Matches(deleted.Version) {
+			return ErrVersionChanged
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM users WHERE id = $1", id); err != nil {
+			return fmt.Errorf("deleting user: %w", err)
+		}
+		return s.changed(ctx, tx, &deleted, nil)
+	})
+	if err != nil {
+		return model.User{}, err
+	}
+	return deleted, nil
+}
+
+//changed calls OnChange when there is one
+func (s *SQLite) changed(ctx context.Context, tx *sql.Tx, before, after *model.User) error {
+	if s.OnChange == nil {
+		return nil
+	}
+	return s.OnChange(ctx, tx, before, after)
+}
+
+//isSQLiteDuplicate reports whether err is sqlite refusing a duplicate in a unique index, the lower(email) or the lower(username) one
+func isSQLiteDuplicate(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
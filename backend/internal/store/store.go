@@ -0,0 +1,129 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"iter"
+	"time"
+
+	"api/internal/model"
+)
+
+//UserStore keeps the users. Postgres is the one the server runs on, MySQL is for deployments without postgres,
+//SQLite is for local development and Memory keeps them in a map for tests and demos.
+//all of them return the errors below so handlers answer the same whichever is behind them
+type UserStore interface {
+	//List returns the users matching f, ordered by id
+	List(ctx context.Context, f Filter) ([]model.User, error)
+	//Count returns how many users List would return for f without its Limit and Offset
+	Count(ctx context.Context, f Filter) (int, error)
+	Get(ctx context.Context, id int64) (model.User, error)
+	//GetByPublicId finds a user by its public id, which the caller has checked with model.ParsePublicId
+	GetByPublicId(ctx context.Context, publicId string) (model.User, error)
+	//Create stores u, which has passed Validate, and returns it with its id, version and timestamps filled in.
+	//the password is only stored as passwordHash, empty for users without one
+	Create(ctx context.Context, u model.User, passwordHash string) (model.User, error)
+	Update(ctx context.Context, id int64, change Update) (model.User, error)
+	//Delete removes the user and returns it as it was, conditional on match when it isnt nil
+	Delete(ctx context.Context, id int64, match *Match) (model.User, error)
+}
+
+//Upserter is implemented by the stores that can create a user with an id the caller picked, for PUT with ?create=true.
+//Upsert creates the user id with the fields of change when it doesnt exist, and otherwise updates it like Update does
+//(change.Match is ignored). created tells which of the two happened
+type Upserter interface {
+	Upsert(ctx context.Context, id int64, change Update) (u model.User, created bool, err error)
+}
+
+//Streamer is implemented by the stores that can hand out the users of List one by one while they are read, so a long
+//list is never held in memory as a whole. the users come in the order of List, a failure is yielded as the error of a
+//zero user and ends the sequence. leaving the loop early closes the query
+type Streamer interface {
+	Stream(ctx context.Context, f Filter) iter.Seq2[model.User, error]
+}
+
+//Searcher is implemented by the stores that can rank the users a search matches, for GET /users/search.
+//Search returns the page of f of the users List returns for f, which has a Search, best matches first and scored like
+//searchUsers does. f.Sort is ignored, Count tells how many there are in all
+type Searcher interface {
+	Search(ctx context.Context, f Filter) ([]model.ScoredUser, error)
+}
+
+//Snapshotter is implemented by the stores that can read the users as they were at one point in time, for
+//?snapshot=true on GET /users: the page and the count read from a snapshot agree with each other whatever is written
+//meanwhile. the sql stores hold a read only REPEATABLE READ transaction and its connection until Close, or until the
+//ctx of Snapshot ends, which rolls it back as well
+type Snapshotter interface {
+	Snapshot(ctx context.Context) (Snapshot, error)
+}
+
+//Snapshot reads like UserStore and Streamer do, from the users as they were at At. it must be closed
+type Snapshot interface {
+	List(ctx context.Context, f Filter) ([]model.User, error)
+	Count(ctx context.Context, f Filter) (int, error)
+	Stream(ctx context.Context, f Filter) iter.Seq2[model.User, error]
+	//At is when the snapshot was taken, in utc
+	At() time.Time
+	Close() error
+}
+
+//the errors of UserStore, the http handlers, the grpc service and the graphql resolvers map these to their own
+var (
+	ErrUserNotFound = errors.New("user does not exist")
+	ErrEmailTaken   = errors.New("this email address is already used by another account")
+	//ErrUsernameTaken is a username another user already has, ignoring case
+	ErrUsernameTaken = errors.New("this username is already taken")
+	//ErrVersionChanged is a conditional write whose expected version is no longer the current one
+	ErrVersionChanged = errors.New("the user was modified since it was last read, fetch it again and retry")
+)
+
+//Filter narrows UserStore.List, its zero value lists every active user
+type Filter struct {
+	IncludeInactive bool
+	//Role and Verified only filter when set
+	Role     string
+	Verified *bool
+	//Search matches part of the name or the email address, ignoring case
+	Search string
+	//SearchNamesOnly leaves the email addresses out of Search and out of the scores of Searcher, for callers who dont
+	//see them
+	SearchNamesOnly bool
+	//Phone matches the phone number exactly, in E.164 form. it only filters when set
+	Phone string
+	//Email matches the whole address ignoring case, it only filters when set
+	Email string
+	//InactiveSince only lists the users who last logged in before it, or signed up before it when they never did.
+	//users from before either was recorded count as inactive. it only filters when set
+	InactiveSince time.Time
+	//AfterId skips the users up to and including that id, for keyset pagination
+	AfterId int64
+	//Sort is one or more of SortKeys separated by commas, each with a - in front for descending order. users equal in
+	//all of them are sorted by id, and so are all users when it is empty. List returns ErrInvalidSort for anything else
+	Sort   string
+	Offset int
+	//Limit caps the number of users returned, 0 returns all of them
+	Limit int
+}
+
+//Update is a change to a user's profile, conditional on Match when it isnt nil.
+//a new email isnt applied right away, it is kept as pending until confirmed with the token whose hash is EmailTokenHash (see internal/server/emailchange.go)
+type Update struct {
+	Name  string
+	Email string
+	//an empty username or role keeps the current one
+	Username string
+	Role     string
+	//a nil phone keeps the current one, an empty one removes it
+	Phone *string
+	//an empty locale or timezone keeps the current one
+	Locale                string
+	Timezone              string
+	EmailTokenHash        string
+	PendingEmailExpiresAt time.Time
+	Match                 *Match
+}
+
+//ChangeHook is called inside the transaction of every change Postgres makes, so what it writes commits or rolls back with the change.
+//before is nil when the user was created and after is nil when it was deleted
+type ChangeHook func(ctx context.Context, tx *sql.Tx, before, after *model.User) error
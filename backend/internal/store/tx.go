@@ -0,0 +1,96 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+//txAttempts is how often inTx runs a transaction the database gave up on because of a concurrent one
+const txAttempts = 3
+
+//inTx runs fn in a transaction with ctx and commits it when fn returns nil, anything else rolls it back.
+//a serialization failure or deadlock (see retryableTxError) doesnt mean the change is wrong, only that it lost a race
+//with another transaction, so fn runs again in a new transaction, up to txAttempts times in all.
+//fn must not keep anything from an attempt that failed
+func inTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = runTx(ctx, db, fn)
+		if attempt == txAttempts || !retryableTxError(err) {
+			return err
+		}
+		//a short and growing pause, so the transactions that collided dont collide again right away
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt) * 10 * time.Millisecond):
+		}
+	}
+}
+
+//runTx is one attempt of inTx
+func runTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if IsDryRun(ctx) {
+		return nil
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
+	return nil
+}
+
+type dryRunKey struct{}
+
+//WithDryRun marks ctx as a dry run: the writes of the stores run with every check and hook like always, but their
+//transaction is rolled back instead of committed. the memory store leaves its users as they are
+func WithDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+//IsDryRun reports whether ctx was marked with WithDryRun
+func IsDryRun(ctx context.Context) bool {
+	dryRun, _ := ctx.Value(dryRunKey{}).(bool)
+	return dryRun
+}
+
+//retryableTxError reports whether err is a transaction the database aborted because of a concurrent one:
+//a serialization failure or deadlock of postgres, or a deadlock of mysql
+func retryableTxError(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == pgerrcode.SerializationFailure || pgErr.Code == pgerrcode.DeadlockDetected
+	}
+	var myErr *mysql.MySQLError
+	return errors.As(err, &myErr) && myErr.Number == mysqlDeadlock
+}
+
+//IsUniqueViolation reports whether err is the database refusing a duplicate in a unique index or constraint, on
+//postgres, sqlite and mysql alike
+func IsUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == pgerrcode.UniqueViolation
+	}
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+	}
+	return isMySQLDuplicate(err)
+}
@@ -0,0 +1,117 @@
+//Package testdb gives the tests an empty database of every engine they can reach, so what has to behave the same
+//on all of them is tested on all of them. sqlite is always there, it is a file in the test's temp dir.
+//postgres and mysql need a server: TEST_POSTGRES_URL (a postgres:// url, with sslmode=disable for a local server)
+//and TEST_MYSQL_DSN name one, with a user that can create databases. every test gets a database of its own there,
+//dropped when it ends. without them those runs are skipped
+package testdb
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+//Database is an empty database, the DB_DRIVER and DATABASE_URL of the server to open it with
+type Database struct {
+	Driver string
+	URL    string
+}
+
+//Drivers are the engines Each runs on, in order
+var Drivers = []string{"sqlite", "postgres", "mysql"}
+
+//Each runs fn as a subtest on a new database of every engine, named after its driver
+func Each(t *testing.T, fn func(t *testing.T, db Database)) {
+	t.Helper()
+	for _, driver := range Drivers {
+		t.Run(driver, func(t *testing.T) {
+			fn(t, New(t, driver))
+		})
+	}
+}
+
+//New creates an empty database of driver for t, it skips t when there is no server for it
+func New(t testing.TB, driver string) Database {
+	t.Helper()
+	switch driver {
+	case "postgres":
+		return newPostgres(t)
+	case "mysql":
+		return newMySQL(t)
+	}
+	return Database{Driver: "sqlite", URL: "file:" + filepath.Join(t.TempDir(), "test.db")}
+}
+
+func newPostgres(t testing.TB) Database {
+	t.Helper()
+	server := os.Getenv("TEST_POSTGRES_URL")
+	if server == "" {
+		t.Skip("TEST_POSTGRES_URL isnt set")
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		t.Fatalf("parsing TEST_POSTGRES_URL: %v", err)
+	}
+	name := databaseName()
+	admin := open(t, "pgx", server)
+	if _, err := admin.Exec("CREATE DATABASE " + name); err != nil {
+		t.Fatalf("creating postgres database: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP DATABASE IF EXISTS " + name + " WITH (FORCE)"); err != nil {
+			t.Logf("dropping postgres database %s: %v", name, err)
+		}
+	})
+	u.Path = "/" + name
+	return Database{Driver: "postgres", URL: u.String()}
+}
+
+func newMySQL(t testing.TB) Database {
+	t.Helper()
+	server := os.Getenv("TEST_MYSQL_DSN")
+	if server == "" {
+		t.Skip("TEST_MYSQL_DSN isnt set")
+	}
+	cfg, err := mysql.ParseDSN(server)
+	if err != nil {
+		t.Fatalf("parsing TEST_MYSQL_DSN: %v", err)
+	}
+	name := databaseName()
+	admin := open(t, "mysql", server)
+	if _, err := admin.Exec("CREATE DATABASE " + name); err != nil {
+		t.Fatalf("creating mysql database: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP DATABASE IF EXISTS " + name); err != nil {
+			t.Logf("dropping mysql database %s: %v", name, err)
+		}
+	})
+	cfg.DBName = name
+	return Database{Driver: "mysql", URL: cfg.FormatDSN()}
+}
+
+//open connects to the server the tests create their databases on, it is closed after them
+func open(t testing.TB, driver, dsn string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		t.Fatalf("opening %s: %v", driver, err)
+	}
+	//registered first, so it runs after the cleanup dropping the database
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+//databaseName is a random name of a test database
+func databaseName() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return "test_" + hex.EncodeToString(b)
+}
@@ -0,0 +1,67 @@
+//Package requestid gives every request an id that is sent back to the client and attached to logs and errors,
+//so a user's bug report can be matched with what the server logged for it
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+//Header is read from the request and echoed on the response
+const Header = "X-Request-ID"
+
+//maxLength caps ids sent by clients, longer ones are replaced
+const maxLength = 128
+
+type contextKey struct{}
+
+//FromContext returns the id of the request the context belongs to, or "" outside of a request
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+//NewContext returns a copy of ctx carrying id
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+//New returns a random (version 4) uuid
+func New() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+//valid accepts ids a proxy or client could reasonably have generated. anything else, e.g. ids with spaces or control
+//characters that could forge extra log lines, is replaced instead of being trusted
+func valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+//Middleware reuses the incoming X-Request-ID when it is well formed and generates one otherwise,
+//then stores it in the request context and sets it on the response
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if !valid(id) {
+			id = New()
+		}
+		w.Header().Set(Header, id)
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+	})
+}